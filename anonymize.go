@@ -0,0 +1,110 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"time"
+)
+
+// ContentReplacement selects how the contents of the entries are replaced by the Anonymize
+// functions of the tar and zip packages.
+type ContentReplacement int
+
+const (
+	// ReplaceWithZeros replaces the contents of the entries with NUL-bytes.
+	ReplaceWithZeros ContentReplacement = iota
+	// ReplaceWithHash replaces the contents of the entries with the hex encoded SHA-256 digest of
+	// the original contents, repeated (or truncated) to the original size. It allows telling
+	// whether entries had the same contents.
+	ReplaceWithHash
+)
+
+// AnonymizedModTime is the modification time of the entries of anonymized archives. It is the
+// earliest time both tar and zip archives can represent.
+var AnonymizedModTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// AnonymizedContent returns the replacement of the contents read from r, which are declared to be
+// size bytes long. The contents are read in any case, and the replacement is only as long as the
+// contents actually read (up to size), so an entry declaring more data than its archive holds
+// cannot make the anonymized archive larger; the read errors of r are returned by the replacement,
+// or by AnonymizedContent itself for ReplaceWithHash. For contents that cannot be read (e.g.
+// encrypted ones), r may be nil: ReplaceWithZeros then replaces them with size NUL-bytes, so the
+// caller must bound size.
+func AnonymizedContent(r io.Reader, size int64, repl ContentReplacement) (io.Reader, error) {
+	if r == nil {
+		if repl == ReplaceWithHash {
+			return nil, errors.New("safearchive: contents to hash cannot be read")
+		}
+		return io.LimitReader(zeros{}, size), nil
+	}
+	r = io.LimitReader(r, size)
+	if repl != ReplaceWithHash {
+		return zeroed{r}, nil
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return nil, err
+	}
+	digest := []byte(hex.EncodeToString(h.Sum(nil)))
+	if int64(len(digest)) >= n {
+		return bytes.NewReader(digest[:n]), nil
+	}
+	return io.LimitReader(&repeater{b: digest}, n), nil
+}
+
+// zeroed replaces the bytes read from r with NUL-bytes.
+type zeroed struct {
+	r io.Reader
+}
+
+func (z zeroed) Read(p []byte) (int, error) {
+	n, err := z.r.Read(p)
+	for i := range p[:n] {
+		p[i] = 0
+	}
+	return n, err
+}
+
+// zeros is an endless stream of NUL-bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// repeater is an endless repetition of b.
+type repeater struct {
+	b   []byte
+	off int
+}
+
+func (r *repeater) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		c := copy(p[n:], r.b[r.off:])
+		n += c
+		r.off = (r.off + c) % len(r.b)
+	}
+	return n, nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestAnonymizedContent(t *testing.T) {
+	const digest = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" // SHA-256 of "hello"
+	long := strings.Repeat("hello", 26)
+	longDigest := hashOf(long)
+	tests := []struct {
+		content string
+		repl    ContentReplacement
+		size    int64
+		want    string
+	}{
+		{"hello", ReplaceWithZeros, 5, "\x00\x00\x00\x00\x00"},
+		{"", ReplaceWithZeros, 0, ""},
+		{"hello", ReplaceWithHash, 5, digest[:5]},
+		{long[:64], ReplaceWithHash, 64, hashOf(long[:64])},
+		{long, ReplaceWithHash, 130, longDigest + longDigest + longDigest[:2]},
+		// the replacement is no longer than the contents, whatever their declared size
+		{"hello", ReplaceWithZeros, 1 << 40, "\x00\x00\x00\x00\x00"},
+		{"hello", ReplaceWithHash, 1 << 40, digest[:5]},
+		{"hello", ReplaceWithZeros, 2, "\x00\x00"},
+	}
+	for _, tc := range tests {
+		r, err := AnonymizedContent(strings.NewReader(tc.content), tc.size, tc.repl)
+		if err != nil {
+			t.Fatalf("AnonymizedContent(%d, %d) error = %v", tc.size, tc.repl, err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("ReadAll() error = %v", err)
+		}
+		if string(got) != tc.want {
+			t.Errorf("AnonymizedContent(%q, %d, %d) = %q, want %q", tc.content, tc.size, tc.repl, got, tc.want)
+		}
+	}
+
+	// contents that cannot be read
+	if r, err := AnonymizedContent(nil, 3, ReplaceWithZeros); err != nil {
+		t.Errorf("AnonymizedContent(nil, ReplaceWithZeros) error = %v", err)
+	} else if got, _ := io.ReadAll(r); string(got) != "\x00\x00\x00" {
+		t.Errorf("AnonymizedContent(nil, ReplaceWithZeros) = %q, want 3 NUL-bytes", got)
+	}
+	if _, err := AnonymizedContent(nil, 3, ReplaceWithHash); err == nil {
+		t.Errorf("AnonymizedContent(nil, ReplaceWithHash) succeeded, want an error")
+	}
+}
+
+func hashOf(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,506 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ar reads Unix ar archives, e.g. static libraries (.a) and Debian binary packages, with
+// the security focus of the tar and zip packages.
+//
+// Both variants of the format are read:
+//   - GNU and System V archives terminate the names of the members with a slash, and store the
+//     names longer than 15 bytes in a table (the "//" member), referenced as "/<offset>".
+//   - BSD archives store the names longer than 16 bytes (or with spaces) at the start of the data
+//     of the members, whose name field is "#1/<length>".
+//
+// The symbol tables of both variants ("/", "/SYM64/" and "__.SYMDEF") are skipped.
+//
+// The names of the members are sanitized like the names of the entries of the other formats
+// (dropping .. path components and turning absolute names into relative ones), and the sizes of
+// the members may be limited:
+//
+//	r := ar.NewReader(f)
+//	r.SetMaxTotalSize(1 << 30)
+//	for {
+//		h, err := r.Next()
+//		if err == io.EOF {
+//			break
+//		}
+//		...
+//	}
+package ar
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/safearchive"
+)
+
+const (
+	// Magic is the signature at the start of ar archives.
+	Magic     = "!<arch>\n"
+	headerLen = 60
+	// maxNameTable is the maximum size of the GNU long name table.
+	maxNameTable = 16 << 20
+	// maxBSDName is the maximum length of the BSD long names.
+	maxBSDName = 4096
+)
+
+var (
+	// ErrHeader is wrapped by the errors of reading an invalid member header, or a file that is
+	// not an ar archive.
+	ErrHeader = errors.New("ar: invalid header")
+	// ErrLimitExceeded is wrapped by the errors of Next when the archive exceeds a limit of the
+	// Reader.
+	ErrLimitExceeded = safearchive.ErrLimitExceeded
+)
+
+// Header describes a member of an ar archive.
+type Header struct {
+	// Name is the name of the member, resolved from the long name tables and without the
+	// terminating slash of the GNU variant.
+	Name    string
+	ModTime time.Time
+	Uid     int
+	Gid     int
+	Mode    int64
+	// Size is the length of the data of the member, excluding the BSD long name.
+	Size int64
+}
+
+// SecurityMode controls security features to enforce
+type SecurityMode int
+
+const (
+	// SanitizeFilenames will sanitize filenames (dropping .. path components and turning entries
+	// into relative). Members with nothing left of their name are skipped.
+	// This feature is enabled by default.
+	SanitizeFilenames SecurityMode = 1
+	// SanitizeFileMode will drop special file modes (e.g. setuid and the sticky bit).
+	// This feature is not enabled by default.
+	SanitizeFileMode SecurityMode = 2
+	// SanitizeUnicode strips the characters used to disguise names in listings from the names of
+	// the members, see sanitizer.IsUnsafeRune.
+	// This feature is part of MaximumSecurityMode.
+	SanitizeUnicode SecurityMode = 4
+	// ValidateNameEncoding checks that the names of the members are valid UTF-8 without NUL bytes,
+	// as set by the NameEncodingPolicy of the Reader (see SetNameEncodingPolicy).
+	// This feature is part of MaximumSecurityMode.
+	ValidateNameEncoding SecurityMode = 8
+	// StrictMode makes Next fail with a typed error (e.g. ErrPathTraversal) instead of silently
+	// skipping or rewriting members flagged by the other security features.
+	// This feature is not enabled by default, nor is it part of MaximumSecurityMode.
+	StrictMode SecurityMode = 16
+)
+
+// MaximumSecurityMode enables all features for maximum security.
+const MaximumSecurityMode = SanitizeFilenames | SanitizeFileMode | SanitizeUnicode | ValidateNameEncoding
+
+var securityModeNames = []struct {
+	mode SecurityMode
+	name string
+}{
+	{SanitizeFilenames, "SanitizeFilenames"},
+	{SanitizeFileMode, "SanitizeFileMode"},
+	{SanitizeUnicode, "SanitizeUnicode"},
+	{ValidateNameEncoding, "ValidateNameEncoding"},
+	{StrictMode, "StrictMode"},
+}
+
+// options are the names of the configurable behaviors of the Reader, registered as features.
+var options = []string{
+	"MaxEntries",
+	"MaxEntrySize",
+	"MaxTotalSize",
+	"NameEncodingPolicy",
+}
+
+func init() {
+	safearchive.RegisterFeatures(safearchive.Feature{Package: "ar", Kind: safearchive.FeatureFormat, Name: "ar"})
+	for _, m := range securityModeNames {
+		safearchive.RegisterFeatures(safearchive.Feature{Package: "ar", Kind: safearchive.FeatureRule, Name: m.name})
+	}
+	for _, o := range options {
+		safearchive.RegisterFeatures(safearchive.Feature{Package: "ar", Kind: safearchive.FeatureOption, Name: o})
+	}
+}
+
+// String returns the names of the enabled features separated by |.
+func (s SecurityMode) String() string {
+	var names []string
+	for _, m := range securityModeNames {
+		if s&m.mode != 0 {
+			names = append(names, m.name)
+			s &^= m.mode
+		}
+	}
+	if s != 0 {
+		names = append(names, fmt.Sprintf("%#x", int(s)))
+	}
+	if len(names) == 0 {
+		return "0"
+	}
+	return strings.Join(names, "|")
+}
+
+// Reader provides sequential access to the members of an ar archive. Reader.Next advances to the
+// next member (including the first), and then Reader can be treated as an io.Reader to access the
+// data of the member.
+type Reader struct {
+	r            io.Reader
+	securityMode SecurityMode
+	encoding     safearchive.NameEncodingPolicy
+	maxEntrySize int64
+	maxTotalSize int64
+	maxEntries   int
+
+	// started is set once the magic of the archive was read.
+	started bool
+	// err is the sticky error of an invalid header or an exceeded limit.
+	err error
+	// names is the GNU long name table.
+	names []byte
+	// entries and totalSize are the number and the total size of the members read so far,
+	// including the skipped ones.
+	entries   int
+	totalSize int64
+
+	// pos is the position in the archive, and remaining and pad the number of bytes of the data
+	// and of the padding of the current member not read yet.
+	pos, remaining, pad int64
+	// offset and name are the position and the original name of the current member.
+	offset int64
+	name   string
+
+	findings []safearchive.Finding
+}
+
+// NewReader creates a new Reader reading from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r, securityMode: DefaultSecurityMode}
+}
+
+// SetSecurityMode controls the security features applied when reading this archive
+func (ar *Reader) SetSecurityMode(s SecurityMode) {
+	ar.securityMode = s
+}
+
+// GetSecurityMode returns the currently enabled security features
+func (ar *Reader) GetSecurityMode() SecurityMode {
+	return ar.securityMode
+}
+
+// SetNameEncodingPolicy controls what ValidateNameEncoding does with the names that are not valid
+// UTF-8 or have NUL bytes. By default (safearchive.NameEncodingReplace) the invalid bytes are
+// replaced with U+FFFD.
+func (ar *Reader) SetNameEncodingPolicy(p safearchive.NameEncodingPolicy) {
+	ar.encoding = p
+}
+
+// SetMaxEntrySize limits the size of the members of the archive. Next fails with an error wrapping
+// ErrLimitExceeded when a member declares a larger size. Zero (the default) means no limit.
+func (ar *Reader) SetMaxEntrySize(n int64) {
+	ar.maxEntrySize = n
+}
+
+// SetMaxTotalSize limits the total size of the members of the archive, including the ones skipped
+// by the security features and the symbol and name tables. Next fails with an error wrapping ErrLimitExceeded when a member would
+// exceed the limit. Zero (the default) means no limit.
+func (ar *Reader) SetMaxTotalSize(n int64) {
+	ar.maxTotalSize = n
+}
+
+// SetMaxEntries limits the number of members of the archive, including the ones skipped by the
+// security features and the symbol and name tables. Next fails with an error wrapping ErrLimitExceeded when the archive has more
+// members. Zero (the default) means no limit.
+func (ar *Reader) SetMaxEntries(n int) {
+	ar.maxEntries = n
+}
+
+// Report returns the findings about the members read so far: every member that was renamed,
+// sanitized or dropped, along with the reason code of the security feature that flagged it.
+func (ar *Reader) Report() *safearchive.Report {
+	return &safearchive.Report{Findings: append([]safearchive.Finding{}, ar.findings...)}
+}
+
+// flag records a finding about the current member.
+func (ar *Reader) flag(v safearchive.Verdict) safearchive.Finding {
+	f := safearchive.Finding{Name: ar.name, Offset: ar.offset, Reason: v.Reason, Action: v.Action, Detail: v.Detail}
+	ar.findings = append(ar.findings, f)
+	return f
+}
+
+// Next advances to the next member of the archive. io.EOF is returned at the end of the archive.
+// Other errors are *safearchive.EntryError values telling which member failed (e.g. wrapping
+// ErrHeader, ErrLimitExceeded or a rejection of StrictMode). Once the archive had an invalid
+// header or exceeded a limit, Next keeps returning the same error.
+func (ar *Reader) Next() (*Header, error) {
+	if ar.err != nil {
+		return nil, ar.err
+	}
+	h, err := ar.next()
+	if err != nil && err != io.EOF {
+		if _, ok := err.(*safearchive.EntryError); !ok {
+			err = &safearchive.EntryError{Name: ar.name, Offset: ar.offset, Err: err}
+		}
+		ar.err = err
+	}
+	return h, err
+}
+
+func (ar *Reader) next() (*Header, error) {
+	if !ar.started {
+		magic := make([]byte, len(Magic))
+		if _, err := io.ReadFull(ar.r, magic); err != nil || string(magic) != Magic {
+			return nil, fmt.Errorf("%w: not an ar archive", ErrHeader)
+		}
+		ar.started, ar.pos = true, int64(len(Magic))
+	}
+	for {
+		if err := ar.skip(ar.remaining + ar.pad); err != nil {
+			return nil, err
+		}
+		ar.remaining, ar.pad = 0, 0
+		ar.offset, ar.name = ar.pos, ""
+		var b [headerLen]byte
+		if _, err := io.ReadFull(ar.r, b[:]); err != nil {
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			return nil, unexpectedEOF(err)
+		}
+		ar.pos += headerLen
+		h, err := parseHeader(b[:])
+		if err != nil {
+			return nil, err
+		}
+		ar.remaining, ar.pad = h.Size, h.Size%2
+		if err := ar.resolveName(h); err != nil {
+			return nil, err
+		}
+		ar.name = h.Name
+		if err := ar.checkLimits(h); err != nil {
+			return nil, err
+		}
+		switch h.Name {
+		case "/", "/SYM64/", "__.SYMDEF", "__.SYMDEF SORTED", "__.SYMDEF_64":
+			// symbol tables
+			continue
+		case "//":
+			if err := ar.readNames(h.Size); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		start := len(ar.findings)
+		keep, err := ar.applyRules(h)
+		if err != nil {
+			return nil, err
+		}
+		if !keep {
+			continue
+		}
+		if h.Name != ar.name {
+			for i := start; i < len(ar.findings); i++ {
+				ar.findings[i].NewName = h.Name
+			}
+		}
+		return h, nil
+	}
+}
+
+// parseHeader parses a member header. The name of the returned header is the raw name field.
+func parseHeader(b []byte) (*Header, error) {
+	if !bytes.Equal(b[58:60], []byte("`\n")) {
+		return nil, fmt.Errorf("%w: bad terminator", ErrHeader)
+	}
+	field := func(from, to int) string {
+		return strings.TrimRight(string(b[from:to]), " ")
+	}
+	number := func(from, to, base int) (int64, error) {
+		s := field(from, to)
+		if s == "" {
+			return 0, nil
+		}
+		n, err := strconv.ParseInt(s, base, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("%w: bad number %q", ErrHeader, s)
+		}
+		return n, nil
+	}
+	h := &Header{Name: field(0, 16)}
+	mtime, err := number(16, 28, 10)
+	if err != nil {
+		return nil, err
+	}
+	h.ModTime = time.Unix(mtime, 0)
+	uid, err := number(28, 34, 10)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := number(34, 40, 10)
+	if err != nil {
+		return nil, err
+	}
+	h.Uid, h.Gid = int(uid), int(gid)
+	if h.Mode, err = number(40, 48, 8); err != nil {
+		return nil, err
+	}
+	if h.Size, err = number(48, 58, 10); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// resolveName replaces the raw name field of h with the name of the member, reading the BSD long
+// names from the data of the member.
+func (ar *Reader) resolveName(h *Header) error {
+	name := h.Name
+	switch {
+	case name == "/" || name == "//" || name == "/SYM64/":
+	case strings.HasPrefix(name, "#1/"):
+		n, err := strconv.Atoi(name[3:])
+		if err != nil || n <= 0 || n > maxBSDName || int64(n) > h.Size {
+			return fmt.Errorf("%w: bad BSD long name %q", ErrHeader, name)
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(ar, b); err != nil {
+			return unexpectedEOF(err)
+		}
+		// the names are padded with NULs
+		h.Name = strings.TrimRight(string(b), "\x00")
+		h.Size -= int64(n)
+	case strings.HasPrefix(name, "/"):
+		off, err := strconv.Atoi(name[1:])
+		if err != nil || off < 0 || off >= len(ar.names) {
+			return fmt.Errorf("%w: bad GNU long name %q", ErrHeader, name)
+		}
+		end := bytes.Index(ar.names[off:], []byte("/\n"))
+		if end < 0 {
+			return fmt.Errorf("%w: unterminated GNU long name %q", ErrHeader, name)
+		}
+		h.Name = string(ar.names[off : off+end])
+	default:
+		// GNU ar terminates the names with a slash
+		h.Name = strings.TrimSuffix(name, "/")
+	}
+	if h.Name == "" {
+		return fmt.Errorf("%w: empty name", ErrHeader)
+	}
+	return nil
+}
+
+// readNames reads the GNU long name table of size bytes.
+func (ar *Reader) readNames(size int64) error {
+	if size > maxNameTable {
+		return fmt.Errorf("%w: long name table of %d bytes", ErrLimitExceeded, size)
+	}
+	// the buffer grows with the data actually read, not with the declared size
+	b, err := io.ReadAll(io.LimitReader(ar, size))
+	if err != nil {
+		return err
+	}
+	if int64(len(b)) < size {
+		return io.ErrUnexpectedEOF
+	}
+	ar.names = b
+	return nil
+}
+
+// checkLimits accounts h against the limits of the reader, and returns the error to fail Next with
+// if it exceeds one of them.
+func (ar *Reader) checkLimits(h *Header) error {
+	ar.entries++
+	var detail string
+	switch {
+	case ar.maxEntries > 0 && ar.entries > ar.maxEntries:
+		detail = fmt.Sprintf("archive has more than %d members", ar.maxEntries)
+	case ar.maxEntrySize > 0 && h.Size > ar.maxEntrySize:
+		detail = fmt.Sprintf("member declares %d bytes, the limit is %d", h.Size, ar.maxEntrySize)
+	case ar.maxTotalSize > 0 && h.Size > ar.maxTotalSize-ar.totalSize:
+		detail = fmt.Sprintf("members declare more than %d bytes in total", ar.maxTotalSize)
+	}
+	ar.totalSize += h.Size
+	if detail == "" {
+		return nil
+	}
+	f := ar.flag(safearchive.Verdict{Action: safearchive.ActionRejected, Reason: safearchive.ReasonLimitExceeded, Detail: detail})
+	return f.Err(ErrLimitExceeded)
+}
+
+// applyRules applies the security features on h, until one of them drops or rejects it. It
+// reports whether the member is to be kept.
+func (ar *Reader) applyRules(h *Header) (bool, error) {
+	names := safearchive.NameChecks{
+		ValidateEncoding: ar.securityMode&ValidateNameEncoding != 0,
+		Encoding:         ar.encoding,
+		SanitizeUnicode:  ar.securityMode&SanitizeUnicode != 0,
+		SanitizePath:     ar.securityMode&SanitizeFilenames != 0,
+	}
+	rules := append(names.Rules(&h.Name), func() safearchive.Verdict { return ar.sanitizeFileMode(h) })
+	return safearchive.ApplyRules(rules, ar.securityMode&StrictMode != 0, ar.flag)
+}
+
+func (ar *Reader) sanitizeFileMode(h *Header) safearchive.Verdict {
+	const special = 07000
+	if ar.securityMode&SanitizeFileMode == 0 || h.Mode&special == 0 {
+		return safearchive.Pass
+	}
+	v := safearchive.Verdict{Action: safearchive.ActionModified, Reason: safearchive.ReasonSpecialMode, Detail: fmt.Sprintf("mode %o changed to %o", h.Mode, h.Mode&^special)}
+	h.Mode &^= special
+	return v
+}
+
+// Read reads from the current member of the archive. It returns (0, io.EOF) when it reaches the
+// end of that member, until Next is called to advance to the next member.
+//
+// Errors other than io.EOF are *safearchive.EntryError values about the current member.
+func (ar *Reader) Read(b []byte) (int, error) {
+	if ar.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > ar.remaining {
+		b = b[:ar.remaining]
+	}
+	n, err := ar.r.Read(b)
+	ar.remaining -= int64(n)
+	ar.pos += int64(n)
+	if err == io.EOF && ar.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil && err != io.EOF {
+		err = &safearchive.EntryError{Name: ar.name, Offset: ar.offset, Err: err}
+	}
+	return n, err
+}
+
+// skip discards n bytes of the archive.
+func (ar *Reader) skip(n int64) error {
+	if n == 0 {
+		return nil
+	}
+	k, err := io.CopyN(io.Discard, ar.r, n)
+	ar.pos += k
+	return unexpectedEOF(err)
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
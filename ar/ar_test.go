@@ -0,0 +1,239 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ar
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/safearchive"
+)
+
+type member struct {
+	// name is the raw name field
+	name string
+	mode int64
+	data string
+}
+
+// archive returns an ar archive of the members.
+func archive(members ...member) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(Magic)
+	for _, m := range members {
+		mode := m.mode
+		if mode == 0 {
+			mode = 0100644
+		}
+		// padded to 16 bytes, rather than runes
+		buf.WriteString(m.name + strings.Repeat(" ", 16-len(m.name)))
+		fmt.Fprintf(&buf, "%-12d%-6d%-6d%-8o%-10d`\n", 1700000000, 1000, 1000, mode, len(m.data))
+		buf.WriteString(m.data)
+		if len(m.data)%2 == 1 {
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+// read returns the names and contents of the members of the archive.
+func read(t *testing.T, r *Reader) (map[string]string, error) {
+	t.Helper()
+	re := map[string]string{}
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			return re, nil
+		}
+		if err != nil {
+			return re, err
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return re, err
+		}
+		if int64(len(b)) != h.Size {
+			t.Errorf("%q has %d bytes, want %d", h.Name, len(b), h.Size)
+		}
+		re[h.Name] = string(b)
+	}
+}
+
+func TestVariants(t *testing.T) {
+	longName := "a_rather_long_object_name.o"
+	tests := []struct {
+		name    string
+		archive []byte
+	}{
+		{
+			name: "GNU",
+			archive: archive(
+				member{name: "/", data: "\x00\x00\x00\x00"},
+				member{name: "//", data: "other_long_object_name.o/\n" + longName + "/\n"},
+				member{name: "short.o/", data: "short"},
+				member{name: "/26", data: "long"},
+			),
+		},
+		{
+			name: "BSD",
+			archive: archive(
+				member{name: "#1/20", data: "__.SYMDEF SORTED\x00\x00\x00\x00symbols"},
+				member{name: "short.o", data: "short"},
+				member{name: fmt.Sprintf("#1/%d", len(longName)+1), data: longName + "\x00long"},
+			),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := read(t, NewReader(bytes.NewReader(tc.archive)))
+			if err != nil {
+				t.Fatalf("Next() error = %v", err)
+			}
+			if want := map[string]string{"short.o": "short", longName: "long"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("members = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestSecurityModes(t *testing.T) {
+	a := archive(
+		member{name: "//", data: "../../etc/cron.d/evil/\n/abs.o/\n"},
+		member{name: "/0", data: "evil"},
+		member{name: "/23", data: "abs"},
+		member{name: "suid.o/", mode: 0104755, data: "suid"},
+		member{name: "bidi‮.o/", data: "bidi"},
+		member{name: "../", data: "dots"},
+	)
+
+	r := NewReader(bytes.NewReader(a))
+	r.SetSecurityMode(SanitizeFilenames)
+	got, err := read(t, r)
+	if err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	want := map[string]string{"etc/cron.d/evil": "evil", "abs.o": "abs", "suid.o": "suid", "bidi‮.o": "bidi"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("members = %q, want %q", got, want)
+	}
+	var reasons []safearchive.Reason
+	for _, f := range r.Report().Findings {
+		reasons = append(reasons, f.Reason)
+	}
+	wantReasons := []safearchive.Reason{safearchive.ReasonPathTraversal, safearchive.ReasonAbsolutePath, safearchive.ReasonPathTraversal}
+	if !reflect.DeepEqual(reasons, wantReasons) {
+		t.Errorf("Report() reasons = %q, want %q", reasons, wantReasons)
+	}
+
+	r = NewReader(bytes.NewReader(a))
+	r.SetSecurityMode(MaximumSecurityMode)
+	if got, err = read(t, r); err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	want = map[string]string{"etc/cron.d/evil": "evil", "abs.o": "abs", "suid.o": "suid", "bidi.o": "bidi"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("members in MaximumSecurityMode = %q, want %q", got, want)
+	}
+
+	r = NewReader(bytes.NewReader(a))
+	r.SetSecurityMode(MaximumSecurityMode | StrictMode)
+	if _, err := read(t, r); !errors.Is(err, safearchive.ErrPathTraversal) {
+		t.Errorf("Next() in StrictMode error = %v, want %v", err, safearchive.ErrPathTraversal)
+	}
+
+	r = NewReader(bytes.NewReader(archive(member{name: "suid.o/", mode: 0104755, data: "suid"})))
+	r.SetSecurityMode(SanitizeFileMode)
+	h, err := r.Next()
+	if err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	if h.Mode != 0100755 {
+		t.Errorf("Mode = %o, want %o", h.Mode, 0100755)
+	}
+}
+
+func TestSanitizeUnicodeTraversal(t *testing.T) {
+	name := ".\u200b./.\u200b./etc/passwd"
+	r := NewReader(bytes.NewReader(archive(member{name: fmt.Sprintf("#1/%d", len(name)), data: name + "evil"})))
+	r.SetSecurityMode(MaximumSecurityMode)
+	got, err := read(t, r)
+	if err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	if want := map[string]string{"etc/passwd": "evil"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("members = %q, want %q", got, want)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	a := archive(member{name: "a/", data: "aaaa"}, member{name: "b/", data: "bbbb"}, member{name: "c/", data: "cccc"})
+	// the symbol and name tables are skipped, but they still count
+	tables := archive(member{name: "/", data: "sym"}, member{name: "//", data: "x/\n"}, member{name: "/SYM64/", data: "sym"})
+	tests := []struct {
+		name    string
+		archive []byte
+		set     func(r *Reader)
+	}{
+		{name: "entries", archive: a, set: func(r *Reader) { r.SetMaxEntries(2) }},
+		{name: "entry size", archive: a, set: func(r *Reader) { r.SetMaxEntrySize(3) }},
+		{name: "total size", archive: a, set: func(r *Reader) { r.SetMaxTotalSize(10) }},
+		{name: "tables entries", archive: tables, set: func(r *Reader) { r.SetMaxEntries(2) }},
+		{name: "tables size", archive: tables, set: func(r *Reader) { r.SetMaxTotalSize(8) }},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := NewReader(bytes.NewReader(tc.archive))
+			tc.set(r)
+			_, err := read(t, r)
+			if !errors.Is(err, ErrLimitExceeded) {
+				t.Errorf("Next() error = %v, want %v", err, ErrLimitExceeded)
+			}
+			if _, again := r.Next(); again != err {
+				t.Errorf("Next() after a failure error = %v, want %v", again, err)
+			}
+		})
+	}
+}
+
+func TestInvalidArchives(t *testing.T) {
+	valid := archive(member{name: "a/", data: "aaaa"})
+	tests := []struct {
+		name    string
+		archive []byte
+		wantErr error
+	}{
+		{name: "empty", archive: nil, wantErr: ErrHeader},
+		{name: "not ar", archive: []byte("PK\x03\x04 not an ar archive"), wantErr: ErrHeader},
+		{name: "bad terminator", archive: append(valid[:len(valid)-6:len(valid)-6], "xx"...), wantErr: ErrHeader},
+		{name: "bad size", archive: []byte(strings.Replace(string(valid), "4         `", "-4        `", 1)), wantErr: ErrHeader},
+		{name: "bad GNU name", archive: archive(member{name: "/12", data: "x"}), wantErr: ErrHeader},
+		{name: "bad BSD name", archive: archive(member{name: "#1/10", data: "x"}), wantErr: ErrHeader},
+		{name: "truncated header", archive: valid[:len(Magic)+30], wantErr: io.ErrUnexpectedEOF},
+		{name: "truncated data", archive: valid[:len(valid)-2], wantErr: io.ErrUnexpectedEOF},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := read(t, NewReader(bytes.NewReader(tc.archive)))
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("Next() error = %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
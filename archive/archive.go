@@ -0,0 +1,361 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package archive opens archives of any format the safearchive readers support, detecting the
+// format from the magic bytes, so consumers handling user uploads get the safe behavior without
+// per-format plumbing:
+//
+//	ar, err := archive.OpenReader(path)
+//	if err != nil {
+//		return err
+//	}
+//	defer ar.Close()
+//	for {
+//		e, err := ar.Next()
+//		if err == io.EOF {
+//			break
+//		}
+//		if err != nil {
+//			return err
+//		}
+//		// e.Name is sanitized, ar reads the data of the entry
+//	}
+//
+// Supported formats are tar, gzip and bzip2 compressed tar, zip (including zip archives with
+// leading data, e.g. self-extracting executables) and ISO 9660 and UDF disk images. xz and zstd
+// compressed tar archives are supported once codecs are registered for them with the decompress
+// package.
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/decompress"
+	"github.com/google/safearchive/gzip"
+	"github.com/google/safearchive/internal/limits"
+	"github.com/google/safearchive/iso"
+	"github.com/google/safearchive/tar"
+	"github.com/google/safearchive/zip"
+)
+
+// ErrUnsupportedFormat is returned when the archive is not in a format the safearchive readers can
+// read.
+var ErrUnsupportedFormat = errors.New("archive: unsupported archive format")
+
+// Entry is an entry of an archive, as returned by the safearchive reader of its format.
+type Entry struct {
+	safearchive.Entry
+	// HardLink reports if the entry is a hard link to Linkname. Only tar archives have hard links.
+	HardLink bool
+}
+
+// ArchiveReader provides sequential access to the entries of an archive, regardless of its format.
+// Next advances to the next entry (including the first), and then ArchiveReader can be treated as
+// an io.Reader to access the data of the entry.
+type ArchiveReader interface {
+	io.Reader
+	io.Closer
+	// Format returns the format of the archive.
+	Format() safearchive.Format
+	// Next advances to the next entry of the archive. io.EOF is returned at the end of the
+	// archive.
+	Next() (*Entry, error)
+	// Report returns the findings of the security features about the entries read so far.
+	Report() *safearchive.Report
+}
+
+// Options configures the readers of the archives. The zero value uses the default settings of the
+// readers.
+type Options struct {
+	// TarSecurityMode is the security mode of the tar reader. tar.DefaultSecurityMode is used if
+	// not set.
+	TarSecurityMode tar.SecurityMode
+	// ZipSecurityMode is the security mode of the zip reader. zip.DefaultSecurityMode is used if
+	// not set.
+	ZipSecurityMode zip.SecurityMode
+	// ISOSecurityMode is the security mode of the iso reader. iso.DefaultSecurityMode is used if
+	// not set.
+	ISOSecurityMode iso.SecurityMode
+	// MaxChildren limits the number of children per directory. No limit is applied if not set.
+	MaxChildren int
+	// ZipTolerant reads zip archives in tolerant mode, see zip.Options.
+	ZipTolerant bool
+	// GzipLimits are the limits of the decompression of gzip compressed archives.
+	// gzip.DefaultLimits are used if not set.
+	GzipLimits *gzip.Limits
+	// DecompressLimits are the limits of the decompression of archives compressed with other
+	// codecs (bzip2, and the xz and zstd codecs registered with the decompress package).
+	// decompress.DefaultLimits are used if not set; &decompress.Limits{} applies no limits.
+	DecompressLimits *decompress.Limits
+}
+
+// Open detects the format of the archive in r, which is size bytes long, and returns a reader of
+// its entries with the default settings of the readers.
+func Open(r io.ReaderAt, size int64) (ArchiveReader, error) {
+	return OpenWithOptions(r, size, Options{})
+}
+
+// OpenWithOptions is like Open, but configures the readers with opts.
+func OpenWithOptions(r io.ReaderAt, size int64, opts Options) (ArchiveReader, error) {
+	format, confidence, err := safearchive.DetectFormatAt(r, size)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := compressedTar[format]; ok {
+		return openCompressedTar(r, size, format, opts)
+	}
+	if confidence < safearchive.ConfidenceMedium {
+		return nil, ErrUnsupportedFormat
+	}
+	switch format {
+	case safearchive.FormatZip:
+		zr, err := zip.NewReaderWithOptions(r, size, zip.Options{Tolerant: opts.ZipTolerant})
+		if err != nil {
+			return nil, err
+		}
+		if opts.ZipSecurityMode != 0 {
+			zr.SetSecurityMode(opts.ZipSecurityMode)
+		}
+		zr.SetMaxChildren(opts.MaxChildren)
+		return &zipReader{r: zr}, nil
+	case safearchive.FormatISO:
+		ir, err := iso.NewReader(r, size)
+		if err != nil {
+			return nil, err
+		}
+		if opts.ISOSecurityMode != 0 {
+			ir.SetSecurityMode(opts.ISOSecurityMode)
+		}
+		return &isoReader{Reader: ir}, nil
+	case safearchive.FormatTar:
+		return newTarReader(io.NewSectionReader(r, 0, size), format, nil, opts), nil
+	case safearchive.FormatTarGzip:
+		limits := gzip.DefaultLimits
+		if opts.GzipLimits != nil {
+			limits = *opts.GzipLimits
+		}
+		zr, err := gzip.NewReaderWithLimits(io.NewSectionReader(r, 0, size), limits)
+		if err != nil {
+			return nil, err
+		}
+		return newTarReader(zr, format, zr, opts), nil
+	}
+	return nil, ErrUnsupportedFormat
+}
+
+// compressedTar maps the formats of compressed streams (other than gzip) to the name of their
+// decompress.Codec and to the format of the tar archives compressed with them.
+var compressedTar = map[safearchive.Format]struct {
+	codec  string
+	format safearchive.Format
+}{
+	safearchive.FormatTarBzip2: {"bzip2", safearchive.FormatTarBzip2},
+	safearchive.FormatBzip2:    {"bzip2", safearchive.FormatTarBzip2},
+	safearchive.FormatXz:       {"xz", safearchive.FormatTarXz},
+	safearchive.FormatZstd:     {"zstd", safearchive.FormatTarZstd},
+}
+
+// openCompressedTar decompresses the stream in r with the registered codec of format, and returns a
+// reader of the tar archive it contains.
+func openCompressedTar(r io.ReaderAt, size int64, format safearchive.Format, opts Options) (ArchiveReader, error) {
+	ct := compressedTar[format]
+	c, ok := decompress.Lookup(ct.codec)
+	if !ok {
+		return nil, fmt.Errorf("%w: no %s codec is registered", ErrUnsupportedFormat, ct.codec)
+	}
+	limits := decompress.DefaultLimits
+	if opts.DecompressLimits != nil {
+		limits = *opts.DecompressLimits
+	}
+	zr, err := decompress.NewReader(io.NewSectionReader(r, 0, size), c, limits)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(zr)
+	blk, err := br.Peek(512)
+	if f, c := safearchive.DetectFormat(blk); f != safearchive.FormatTar || c < safearchive.ConfidenceMedium {
+		zr.Close()
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		return nil, ErrUnsupportedFormat
+	}
+	return newTarReader(br, ct.format, zr, opts), nil
+}
+
+// OpenReader opens the archive file specified by name and returns a reader of its entries with
+// the default settings of the readers. The ArchiveReader must be closed to close the file.
+func OpenReader(name string) (ArchiveReader, error) {
+	return OpenReaderWithOptions(name, Options{})
+}
+
+// OpenReaderWithOptions is like OpenReader, but configures the readers with opts.
+func OpenReaderWithOptions(name string, opts Options) (ArchiveReader, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	ar, err := OpenWithOptions(f, fi.Size(), opts)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileReader{ArchiveReader: ar, f: f}, nil
+}
+
+// fileReader closes the underlying file of an ArchiveReader.
+type fileReader struct {
+	ArchiveReader
+	f *os.File
+}
+
+func (r *fileReader) Close() error {
+	err := r.ArchiveReader.Close()
+	if ferr := r.f.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+type tarReader struct {
+	*tar.Reader
+	format safearchive.Format
+	closer io.Closer
+}
+
+func newTarReader(r io.Reader, format safearchive.Format, closer io.Closer, opts Options) *tarReader {
+	tr := tar.NewReader(r)
+	if opts.TarSecurityMode != 0 {
+		tr.SetSecurityMode(opts.TarSecurityMode)
+	}
+	tr.SetMaxChildren(opts.MaxChildren)
+	return &tarReader{Reader: tr, format: format, closer: closer}
+}
+
+func (r *tarReader) Format() safearchive.Format {
+	return r.format
+}
+
+func (r *tarReader) Next() (*Entry, error) {
+	h, err := r.Reader.Next()
+	if err != nil {
+		return nil, err
+	}
+	return &Entry{Entry: tar.EntryOf(h), HardLink: h.Typeflag == tar.TypeLink}, nil
+}
+
+func (r *tarReader) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer.Close()
+}
+
+type zipReader struct {
+	r *zip.Reader
+	// next is the index of the next entry in r.File.
+	next int
+	// rc is the data of the current entry.
+	rc io.ReadCloser
+}
+
+func (r *zipReader) Format() safearchive.Format {
+	return safearchive.FormatZip
+}
+
+func (r *zipReader) Next() (*Entry, error) {
+	if err := r.closeEntry(); err != nil {
+		return nil, err
+	}
+	if err := r.r.Err(); err != nil {
+		return nil, err
+	}
+	if r.next >= len(r.r.File) {
+		return nil, io.EOF
+	}
+	f := r.r.File[r.next]
+	r.next++
+	e := &Entry{Entry: zip.EntryOf(f)}
+	rc, err := r.r.OpenFile(f)
+	if err != nil {
+		return nil, safearchive.NewEntryError(f.Name, "", err)
+	}
+	r.rc = rc
+	if e.Mode&fs.ModeSymlink != 0 {
+		target, err := io.ReadAll(io.LimitReader(rc, limits.MaxLinknameLen))
+		if err != nil {
+			return nil, safearchive.NewEntryError(f.Name, "", err)
+		}
+		e.Linkname = string(target)
+		r.closeEntry()
+		r.rc = io.NopCloser(bytes.NewReader(nil))
+	}
+	return e, nil
+}
+
+func (r *zipReader) Read(b []byte) (int, error) {
+	if r.rc == nil {
+		return 0, io.EOF
+	}
+	return r.rc.Read(b)
+}
+
+func (r *zipReader) Report() *safearchive.Report {
+	return r.r.Report()
+}
+
+func (r *zipReader) closeEntry() error {
+	if r.rc == nil {
+		return nil
+	}
+	err := r.rc.Close()
+	r.rc = nil
+	return err
+}
+
+func (r *zipReader) Close() error {
+	return r.closeEntry()
+}
+
+type isoReader struct {
+	*iso.Reader
+}
+
+func (r *isoReader) Format() safearchive.Format {
+	return safearchive.FormatISO
+}
+
+func (r *isoReader) Next() (*Entry, error) {
+	h, err := r.Reader.Next()
+	if err != nil {
+		return nil, err
+	}
+	return &Entry{Entry: iso.EntryOf(h)}, nil
+}
+
+func (r *isoReader) Close() error {
+	return nil
+}
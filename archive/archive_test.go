@@ -0,0 +1,445 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/decompress"
+	sgzip "github.com/google/safearchive/gzip"
+	"github.com/google/safearchive/internal/archivetest"
+	star "github.com/google/safearchive/tar"
+)
+
+var testEntries = []archivetest.Entry{
+	{Name: "a.txt", Content: []byte("hello")},
+	{Name: "link", Linkname: "a.txt"},
+	{Name: "../evil.txt", Content: []byte("evil")},
+}
+
+// wantEntries is what the readers return of testEntries with their default settings.
+var wantEntries = []string{"a.txt:hello", "link->a.txt", "evil.txt:evil"}
+
+// isoBytes returns an ISO 9660 image of testEntries, named after their Rock Ridge names.
+func isoBytes(t *testing.T) []byte {
+	t.Helper()
+
+	const sector = 2048
+	img := make([]byte, (19+len(testEntries))*sector)
+	record := func(id []byte, lba, size int, flags byte, su []byte) []byte {
+		rec := make([]byte, 33+len(id)+1-len(id)%2, 256)
+		binary.LittleEndian.PutUint32(rec[2:], uint32(lba))
+		binary.BigEndian.PutUint32(rec[6:], uint32(lba))
+		binary.LittleEndian.PutUint32(rec[10:], uint32(size))
+		binary.BigEndian.PutUint32(rec[14:], uint32(size))
+		rec[25], rec[32] = flags, byte(len(id))
+		copy(rec[33:], id)
+		rec = append(rec, su...)
+		if len(rec)%2 == 1 {
+			rec = append(rec, 0)
+		}
+		rec[0] = byte(len(rec))
+		return rec
+	}
+	for i, typ := range []byte{1, 255} {
+		d := img[(16+i)*sector:]
+		d[0] = typ
+		copy(d[1:], "CD001\x01")
+		binary.LittleEndian.PutUint16(d[128:], sector)
+		binary.BigEndian.PutUint16(d[130:], sector)
+		copy(d[156:], record([]byte{0}, 18, sector, 0x02, nil))
+	}
+	dir := append(record([]byte{0}, 18, sector, 0x02, []byte("SP\x07\x01\xbe\xef\x00")), record([]byte{1}, 18, sector, 0x02, nil)...)
+	for i, e := range testEntries {
+		su := append([]byte{'N', 'M', byte(5 + len(e.Name)), 1, 0}, e.Name...)
+		if e.Linkname != "" {
+			su = append(su, 'S', 'L', byte(7+len(e.Linkname)), 1, 0, 0, byte(len(e.Linkname)))
+			su = append(su, e.Linkname...)
+		}
+		dir = append(dir, record([]byte(fmt.Sprintf("F%d.;1", i)), 19+i, len(e.Content), 0, su)...)
+		copy(img[(19+i)*sector:], e.Content)
+	}
+	copy(img[18*sector:], dir)
+	return img
+}
+
+// readEntries returns the entries of ar as name:content or name->linkname.
+func readEntries(t *testing.T, ar ArchiveReader) []string {
+	t.Helper()
+
+	var re []string
+	for {
+		e, err := ar.Next()
+		if err == io.EOF {
+			return re
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		if e.Mode&fs.ModeSymlink != 0 {
+			re = append(re, e.Name+"->"+e.Linkname)
+			continue
+		}
+		b, err := io.ReadAll(ar)
+		if err != nil {
+			t.Fatalf("Read(%q) error = %v", e.Name, err)
+		}
+		re = append(re, e.Name+":"+string(b))
+	}
+}
+
+func TestOpen(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       []byte
+		wantFormat safearchive.Format
+	}{
+		{"tar", archivetest.Tar(t, testEntries), safearchive.FormatTar},
+		{"tar+gzip", archivetest.Gzip(t, archivetest.Tar(t, testEntries)), safearchive.FormatTarGzip},
+		{"zip", archivetest.Zip(t, testEntries), safearchive.FormatZip},
+		{"zip with leading data", append([]byte("#!/bin/sh\nexit 0\n"), archivetest.Zip(t, testEntries)...), safearchive.FormatZip},
+		{"iso", isoBytes(t), safearchive.FormatISO},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ar, err := Open(bytes.NewReader(tc.data), int64(len(tc.data)))
+			if err != nil {
+				t.Fatalf("Open() error = %v", err)
+			}
+			defer ar.Close()
+			if got := ar.Format(); got != tc.wantFormat {
+				t.Errorf("Format() = %v, want %v", got, tc.wantFormat)
+			}
+			if got := readEntries(t, ar); !reflect.DeepEqual(got, wantEntries) {
+				t.Errorf("entries = %q, want %q", got, wantEntries)
+			}
+			findings := ar.Report().Findings
+			if len(findings) != 1 || findings[0].Reason != safearchive.ReasonPathTraversal {
+				t.Errorf("Report() = %+v, want a path traversal", findings)
+			}
+		})
+	}
+}
+
+func TestOpenUnsupported(t *testing.T) {
+	for _, data := range [][]byte{[]byte("not an archive"), archivetest.Gzip(t, []byte("not an archive"))} {
+		if _, err := Open(bytes.NewReader(data), int64(len(data))); !errors.Is(err, ErrUnsupportedFormat) {
+			t.Errorf("Open(%q) error = %v, want %v", data, err, ErrUnsupportedFormat)
+		}
+	}
+}
+
+func TestOpenReader(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "upload")
+	if err := os.WriteFile(name, archivetest.Zip(t, testEntries), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	ar, err := OpenReader(name)
+	if err != nil {
+		t.Fatalf("OpenReader() error = %v", err)
+	}
+	if got := readEntries(t, ar); !reflect.DeepEqual(got, wantEntries) {
+		t.Errorf("entries = %q, want %q", got, wantEntries)
+	}
+	if err := ar.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+
+	if _, err := OpenReader(filepath.Join(t.TempDir(), "missing")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("OpenReader() error = %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestOpenGzipLimits(t *testing.T) {
+	data := archivetest.Gzip(t, archivetest.Tar(t, testEntries))
+	ar, err := OpenWithOptions(bytes.NewReader(data), int64(len(data)), Options{GzipLimits: &sgzip.Limits{MaxOutputSize: 1024}})
+	if err != nil {
+		t.Fatalf("OpenWithOptions() error = %v", err)
+	}
+	for err == nil {
+		_, err = ar.Next()
+	}
+	if !errors.Is(err, safearchive.ErrLimitExceeded) {
+		t.Errorf("Next() error = %v, want %v", err, safearchive.ErrLimitExceeded)
+	}
+}
+
+func TestOpenMultiMemberGzip(t *testing.T) {
+	// the tar archive split into gzip members at arbitrary boundaries, as pigz and bgzf do
+	tb := archivetest.Tar(t, testEntries)
+	var data []byte
+	for len(tb) > 0 {
+		n := 700
+		if n > len(tb) {
+			n = len(tb)
+		}
+		data = append(data, archivetest.Gzip(t, tb[:n])...)
+		tb = tb[n:]
+	}
+
+	ar, err := Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if got := ar.Format(); got != safearchive.FormatTarGzip {
+		t.Errorf("Format() = %v, want %v", got, safearchive.FormatTarGzip)
+	}
+	if got := readEntries(t, ar); !reflect.DeepEqual(got, wantEntries) {
+		t.Errorf("entries = %q, want %q", got, wantEntries)
+	}
+
+	// the limits apply to all the members: the first member alone is within the limit
+	ar, err = OpenWithOptions(bytes.NewReader(data), int64(len(data)), Options{GzipLimits: &sgzip.Limits{MaxOutputSize: 1024}})
+	if err != nil {
+		t.Fatalf("OpenWithOptions() error = %v", err)
+	}
+	for err == nil {
+		_, err = ar.Next()
+	}
+	if !errors.Is(err, safearchive.ErrLimitExceeded) {
+		t.Errorf("Next() error = %v, want %v", err, safearchive.ErrLimitExceeded)
+	}
+}
+
+// tarBzip2 is traverse.tar of the corpus, compressed with bzip2 -9.
+const tarBzip2 = "425a6839314159265359c92edb120000925b90c8804001f584030066c2de400401000820007223d540347a9a000f487a822927aa7941a01ea07a9a0ab861c8fc244829bf6e78753660760d1b0a40843f73c5bc4cd5e0c00d9e6d044eb7896ec2bc6b055808c9a5e681117538c5b26e64c90942d2e7f871c5e8714cc43f177245385090c92edb12"
+
+func TestOpenCompressed(t *testing.T) {
+	bz, err := hex.DecodeString(tarBzip2)
+	if err != nil {
+		t.Fatalf("DecodeString() error = %v", err)
+	}
+	ar, err := Open(bytes.NewReader(bz), int64(len(bz)))
+	if err != nil {
+		t.Fatalf("Open(tar.bz2) error = %v", err)
+	}
+	if got := ar.Format(); got != safearchive.FormatTarBzip2 {
+		t.Errorf("Format() = %v, want %v", got, safearchive.FormatTarBzip2)
+	}
+	var names []string
+	for {
+		e, err := ar.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		names = append(names, e.Name)
+	}
+	if want := []string{"readme.txt", "gopher.txt", "todo.txt"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("entries = %q, want %q", names, want)
+	}
+
+	xz := append(append([]byte{}, decompress.XzMagic...), archivetest.Tar(t, testEntries)...)
+	if _, err := Open(bytes.NewReader(xz), int64(len(xz))); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Open(tar.xz) without a codec error = %v, want %v", err, ErrUnsupportedFormat)
+	}
+	// a fake codec, stripping the magic bytes
+	decompress.Register(decompress.Codec{Name: "xz", Magic: decompress.XzMagic, NewReader: func(r io.Reader) (io.ReadCloser, error) {
+		if _, err := io.ReadFull(r, make([]byte, len(decompress.XzMagic))); err != nil {
+			return nil, err
+		}
+		return io.NopCloser(r), nil
+	}})
+	if safearchive.Hardened {
+		if _, err := Open(bytes.NewReader(xz), int64(len(xz))); !errors.Is(err, ErrUnsupportedFormat) {
+			t.Errorf("Open(tar.xz) with a codec registered in the hardened profile error = %v, want %v", err, ErrUnsupportedFormat)
+		}
+		return
+	}
+	ar, err = Open(bytes.NewReader(xz), int64(len(xz)))
+	if err != nil {
+		t.Fatalf("Open(tar.xz) error = %v", err)
+	}
+	if got := ar.Format(); got != safearchive.FormatTarXz {
+		t.Errorf("Format() = %v, want %v", got, safearchive.FormatTarXz)
+	}
+	if got := readEntries(t, ar); !reflect.DeepEqual(got, wantEntries) {
+		t.Errorf("entries = %q, want %q", got, wantEntries)
+	}
+
+	notTar := append(append([]byte{}, decompress.XzMagic...), make([]byte, 1024)...)
+	if _, err := Open(bytes.NewReader(notTar), int64(len(notTar))); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Open(xz) error = %v, want %v", err, ErrUnsupportedFormat)
+	}
+}
+
+// tarBzip2Bomb is a tar archive holding 4MiB of zeros compressed with bzip2 to 105 bytes.
+const tarBzip2Bomb = "425a6839314159265359f5c2be450080c2df80c880400055801000000862009e100008200075094d141a1ea07a9ea054a81900341f5a97a4840176042200adb4acce944220000816ce33a18e5f09a129508c4e709aae7dafaeaef7924200fc5dc914e14243d70af914"
+
+func TestDecompressLimits(t *testing.T) {
+	bomb, err := hex.DecodeString(tarBzip2Bomb)
+	if err != nil {
+		t.Fatalf("DecodeString() error = %v", err)
+	}
+	read := func(opts Options) error {
+		ar, err := OpenWithOptions(bytes.NewReader(bomb), int64(len(bomb)), opts)
+		if err != nil {
+			return err
+		}
+		defer ar.Close()
+		if _, err := ar.Next(); err != nil {
+			return err
+		}
+		_, err = io.Copy(io.Discard, ar)
+		return err
+	}
+	if err := read(Options{}); !errors.Is(err, decompress.ErrLimitExceeded) {
+		t.Errorf("reading a bzip2 bomb error = %v, want %v", err, decompress.ErrLimitExceeded)
+	}
+	if err := read(Options{DecompressLimits: &decompress.Limits{}}); err != nil {
+		t.Errorf("reading a bzip2 bomb without limits error = %v", err)
+	}
+}
+
+func TestWriteListing(t *testing.T) {
+	open := func(t *testing.T, data []byte) ArchiveReader {
+		t.Helper()
+		ar, err := Open(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatalf("Open() error = %v", err)
+		}
+		t.Cleanup(func() { ar.Close() })
+		return ar
+	}
+	wantNames := []string{"a.txt", "link", "evil.txt"}
+	wantTypes := []string{"file", "symlink", "file"}
+
+	for _, data := range [][]byte{archivetest.Tar(t, testEntries), archivetest.Zip(t, testEntries)} {
+		var out bytes.Buffer
+		if err := WriteListing(&out, open(t, data), ListingNDJSON); err != nil {
+			t.Fatalf("WriteListing(NDJSON) error = %v", err)
+		}
+		dec := json.NewDecoder(&out)
+		for i := 0; dec.More(); i++ {
+			var rec listingRecord
+			if err := dec.Decode(&rec); err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if i >= len(wantNames) || rec.Index != int64(i) || rec.Name != wantNames[i] || rec.Type != wantTypes[i] {
+				t.Errorf("NDJSON record %d = %+v", i, rec)
+			}
+		}
+
+		out.Reset()
+		if err := WriteListing(&out, open(t, data), ListingCSV); err != nil {
+			t.Fatalf("WriteListing(CSV) error = %v", err)
+		}
+		rows, err := csv.NewReader(&out).ReadAll()
+		if err != nil {
+			t.Fatalf("csv.Reader.ReadAll() error = %v", err)
+		}
+		if len(rows) != len(wantNames)+1 || !reflect.DeepEqual(rows[0], listingColumns) {
+			t.Fatalf("CSV listing = %q", rows)
+		}
+		for i, row := range rows[1:] {
+			if row[0] != strconv.Itoa(i) || row[1] != wantNames[i] || row[2] != wantTypes[i] {
+				t.Errorf("CSV row %d = %q", i, row)
+			}
+		}
+	}
+
+	if err := WriteListing(io.Discard, open(t, archivetest.Tar(t, testEntries)), ListingFormat(-1)); err == nil {
+		t.Errorf("WriteListing(-1) error = nil, want an error")
+	}
+}
+
+func TestFidelity(t *testing.T) {
+	src := archivetest.Tar(t, testEntries)
+	open := func(b []byte) ArchiveReader {
+		ar, err := Open(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			t.Fatalf("Open() error = %v", err)
+		}
+		return ar
+	}
+
+	var repacked bytes.Buffer
+	if err := star.Sanitize(&repacked, bytes.NewReader(src), star.DefaultSecurityMode); err != nil {
+		t.Fatalf("tar.Sanitize() error = %v", err)
+	}
+	report, err := Fidelity(open(src), open(repacked.Bytes()), safearchive.DefaultComparer)
+	if err != nil {
+		t.Fatalf("Fidelity() error = %v", err)
+	}
+	if len(report.Findings) != 0 {
+		t.Errorf("Fidelity() of a sanitized archive = %+v, want no findings", report.Findings)
+	}
+
+	tampered := archivetest.Tar(t, []archivetest.Entry{{Name: "evil.txt", Content: []byte("evil")}, {Name: "a.txt", Content: []byte("HELLO")}, {Name: "extra.txt"}})
+	report, err = Fidelity(open(src), open(tampered), safearchive.DefaultComparer)
+	if err != nil {
+		t.Fatalf("Fidelity() error = %v", err)
+	}
+	var got []string
+	for _, f := range report.Findings {
+		if f.Reason != ReasonFidelity {
+			t.Errorf("finding %+v has reason %q, want %q", f, f.Reason, ReasonFidelity)
+		}
+		got = append(got, f.Name+": "+f.Detail)
+	}
+	want := []string{
+		"a.txt: repacked entry differs in content",
+		"link: missing from the repacked archive",
+		"evil.txt: out of order in the repacked archive",
+		"extra.txt: not in the source archive",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Fidelity() findings = %q, want %q", got, want)
+	}
+
+	// duplicated names are matched in order
+	dup := func(contents ...string) []byte {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, c := range contents {
+			tw.WriteHeader(&tar.Header{Name: "dup.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(c))})
+			tw.Write([]byte(c))
+		}
+		tw.Close()
+		return buf.Bytes()
+	}
+	report, err = Fidelity(open(dup("one", "two")), open(dup("one", "two")), safearchive.DefaultComparer)
+	if err != nil || len(report.Findings) != 0 {
+		t.Errorf("Fidelity() of duplicated entries = %+v, %v, want no findings", report, err)
+	}
+	report, err = Fidelity(open(dup("one", "two")), open(dup("two")), safearchive.DefaultComparer)
+	if err != nil {
+		t.Fatalf("Fidelity() error = %v", err)
+	}
+	got = nil
+	for _, f := range report.Findings {
+		got = append(got, f.Detail)
+	}
+	if want := []string{"repacked entry differs in content", "missing from the repacked archive"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Fidelity() findings of a dropped duplicate = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"crypto/sha256"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/safearchive"
+)
+
+// ReasonFidelity is the reason of the findings of Fidelity about entries the repacked archive does
+// not reproduce faithfully.
+const ReasonFidelity safearchive.Reason = "fidelity"
+
+// fieldNames are the names of the fields of the entries in the details of the findings.
+var fieldNames = []struct {
+	field safearchive.Field
+	name  string
+}{
+	{safearchive.FieldSize, "size"},
+	{safearchive.FieldModTime, "modification time"},
+	{safearchive.FieldMode, "mode"},
+	{safearchive.FieldDigest, "content"},
+	{safearchive.FieldLinkname, "link target"},
+}
+
+// fidelityEntry is an entry read by Fidelity, with the digest of its data and its position in
+// its archive.
+type fidelityEntry struct {
+	Entry
+	index int
+}
+
+// Fidelity verifies that repacked is a faithful copy of src, as read by the safearchive readers:
+// the sanitize-and-repack workflows (e.g. tar.Sanitize) are expected to change only what the
+// security features of the reader of src change (names, modes, dropped entries), which src
+// returns already. Fidelity reads both archives to their end, and reports with ReasonFidelity the
+// entries missing from repacked or added to it, the entries out of order, and the entries
+// differing in any of the fields compared by c (the contents are compared with FieldDigest, and
+// timestamps can be excluded, e.g. if the repacking normalizes them). Entries sharing a name are
+// matched in order: the n-th of them in src with the n-th of them in repacked. An empty report
+// means the repacking preserved the archive.
+func Fidelity(src, repacked ArchiveReader, c safearchive.Comparer) (*safearchive.Report, error) {
+	want, err := readFidelityEntries(src)
+	if err != nil {
+		return nil, err
+	}
+	got, err := readFidelityEntries(repacked)
+	if err != nil {
+		return nil, err
+	}
+	// the entries of repacked by name, in order, since names may be duplicated
+	byName := map[string][]*fidelityEntry{}
+	for i := range got {
+		name := fidelityName(got[i].Name)
+		byName[name] = append(byName[name], &got[i])
+	}
+
+	re := &safearchive.Report{}
+	flag := func(e *fidelityEntry, detail string) {
+		re.Add(safearchive.Finding{Name: e.Name, Offset: -1, Reason: ReasonFidelity, Detail: detail})
+	}
+	last := -1
+	for i := range want {
+		w := &want[i]
+		name := fidelityName(w.Name)
+		if len(byName[name]) == 0 {
+			flag(w, "missing from the repacked archive")
+			continue
+		}
+		g := byName[name][0]
+		byName[name] = byName[name][1:]
+		if g.index < last {
+			flag(w, "out of order in the repacked archive")
+		}
+		last = g.index
+		var diffs []string
+		d := c.Diff(w.Entry.Entry, g.Entry.Entry)
+		for _, f := range fieldNames {
+			if d&f.field != 0 {
+				diffs = append(diffs, f.name)
+			}
+		}
+		if w.HardLink != g.HardLink {
+			diffs = append(diffs, "link type")
+		}
+		if len(diffs) > 0 {
+			flag(w, "repacked entry differs in "+strings.Join(diffs, ", "))
+		}
+	}
+	var extra []*fidelityEntry
+	for _, es := range byName {
+		extra = append(extra, es...)
+	}
+	sort.Slice(extra, func(i, j int) bool { return extra[i].index < extra[j].index })
+	for _, e := range extra {
+		flag(e, "not in the source archive")
+	}
+	return re, nil
+}
+
+// readFidelityEntries reads the entries of r, along with the digests of their data.
+func readFidelityEntries(r ArchiveReader) ([]fidelityEntry, error) {
+	var re []fidelityEntry
+	for i := 0; ; i++ {
+		e, err := r.Next()
+		if err == io.EOF {
+			return re, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, r); err != nil {
+			return nil, safearchive.NewEntryError(e.Name, "", err)
+		}
+		e.Digest = h.Sum(nil)
+		re = append(re, fidelityEntry{Entry: *e, index: i})
+	}
+}
+
+// fidelityName is the name entries are matched by: tar and zip archives differ in their use of
+// trailing slashes.
+func fidelityName(name string) string {
+	return strings.TrimSuffix(filepath.ToSlash(name), "/")
+}
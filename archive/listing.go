@@ -0,0 +1,116 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"time"
+)
+
+// ListingFormat is the serialization of the listings of WriteListing.
+type ListingFormat int
+
+const (
+	// ListingNDJSON writes a JSON object per entry, one per line:
+	//	{"index":0,"name":"a.txt","type":"file","size":5,"mode":"-rw-r--r--","modTime":"2024-01-01T00:00:00Z"}
+	ListingNDJSON ListingFormat = iota
+	// ListingCSV writes a header row and a row per entry, with the columns of ListingNDJSON.
+	ListingCSV
+)
+
+// listingColumns are the columns of the CSV listings.
+var listingColumns = []string{"index", "name", "type", "size", "mode", "modTime", "linkname"}
+
+// listingRecord is a line of the NDJSON listings.
+type listingRecord struct {
+	Index    int64     `json:"index"`
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Size     int64     `json:"size"`
+	Mode     string    `json:"mode"`
+	ModTime  time.Time `json:"modTime"`
+	Linkname string    `json:"linkname,omitempty"`
+}
+
+// WriteListing writes a listing of the entries of r, as returned by r (so sanitized), to w in the
+// given format. The entries are written as they are read, without buffering the metadata of the
+// whole archive, so listings of archives with millions of entries can be piped into data
+// pipelines. The data of the entries is not read. The index of an entry is its position among the
+// entries returned by r.
+func WriteListing(w io.Writer, r ArchiveReader, format ListingFormat) error {
+	if format != ListingNDJSON && format != ListingCSV {
+		return fmt.Errorf("archive: unknown listing format %d", format)
+	}
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	cw := csv.NewWriter(bw)
+	if format == ListingCSV {
+		if err := cw.Write(listingColumns); err != nil {
+			return err
+		}
+	}
+	for i := int64(0); ; i++ {
+		e, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		rec := listingRecord{
+			Index:    i,
+			Name:     e.Name,
+			Type:     entryType(e),
+			Size:     e.Size,
+			Mode:     e.Mode.String(),
+			ModTime:  e.ModTime.UTC(),
+			Linkname: e.Linkname,
+		}
+		if format == ListingNDJSON {
+			err = enc.Encode(rec)
+		} else {
+			err = cw.Write([]string{strconv.FormatInt(rec.Index, 10), rec.Name, rec.Type, strconv.FormatInt(rec.Size, 10), rec.Mode, rec.ModTime.Format(time.RFC3339Nano), rec.Linkname})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// entryType returns the type of e in the listings.
+func entryType(e *Entry) string {
+	switch {
+	case e.HardLink:
+		return "hardlink"
+	case e.Mode.IsRegular():
+		return "file"
+	case e.Mode.IsDir():
+		return "dir"
+	case e.Mode&fs.ModeSymlink != 0:
+		return "symlink"
+	}
+	return "other"
+}
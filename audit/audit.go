@@ -0,0 +1,176 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package audit inspects archives held in memory and reports what the safearchive readers would
+// do with them.
+//
+// The inspection path uses no operating system facilities, so it works the same in a backend
+// service and in a browser (GOOS=js) or WASI (GOOS=wasip1) build. Web frontends can pre-audit a
+// user archive before uploading it, applying exactly the rules the backend will apply:
+//
+//	res, err := audit.Inspect(data, audit.Options{})
+//	if err != nil {
+//		// not an archive
+//	}
+//	if res.Health != safearchive.HealthClean.String() {
+//		// warn the user
+//	}
+package audit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/tar"
+	"github.com/google/safearchive/zip"
+)
+
+// ErrUnsupportedFormat is returned when the data is not an archive the safearchive readers can
+// read.
+var ErrUnsupportedFormat = errors.New("audit: unsupported archive format")
+
+// Options configures the readers used for the inspection. The zero value uses the default
+// settings of the readers.
+type Options struct {
+	// TarSecurityMode is the security mode of the tar reader. tar.DefaultSecurityMode is used if
+	// not set.
+	TarSecurityMode tar.SecurityMode
+	// ZipSecurityMode is the security mode of the zip reader. zip.DefaultSecurityMode is used if
+	// not set.
+	ZipSecurityMode zip.SecurityMode
+	// MaxChildren limits the number of children per directory. No limit is applied if not set.
+	MaxChildren int
+	// ZipTolerant reads zip archives in tolerant mode, see zip.Options.
+	ZipTolerant bool
+}
+
+// Result is the outcome of an inspection. It is meant to be serialized as JSON.
+type Result struct {
+	// Format is the detected format of the archive.
+	Format string `json:"format"`
+	// Entries is the number of entries returned by the reader.
+	Entries int `json:"entries"`
+	// Health is the classification of the archive, as in safearchive.Summary.
+	Health string `json:"health"`
+	// Reasons lists the distinct reasons that contributed to Health.
+	Reasons []safearchive.Reason `json:"reasons,omitempty"`
+	// Findings lists every finding of the readers.
+	Findings []safearchive.BundleFinding `json:"findings,omitempty"`
+	// Error is the error the reader failed with, if any. A rejected entry is reported here.
+	Error string `json:"error,omitempty"`
+}
+
+// Inspect reads the archive in data the way the safearchive readers would and reports their
+// findings. Errors of the readers are reported in the Result, the returned error is only set if
+// the format of the archive is not supported.
+func Inspect(data []byte, opts Options) (*Result, error) {
+	format, confidence := safearchive.DetectFormat(data)
+	if format == safearchive.FormatUnknown || format == safearchive.FormatGzip || format == safearchive.Format7z {
+		// zip archives with leading data are only recognized by their end record
+		f, c, err := safearchive.DetectFormatAt(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		format, confidence = f, c
+	}
+	if confidence < safearchive.ConfidenceMedium {
+		return nil, ErrUnsupportedFormat
+	}
+
+	res := &Result{Format: format.String()}
+	var report *safearchive.Report
+	var err error
+	switch format {
+	case safearchive.FormatZip:
+		report, err = inspectZip(data, opts, res)
+	case safearchive.FormatTar, safearchive.FormatTarGzip:
+		report, err = inspectTar(data, format == safearchive.FormatTarGzip, opts, res)
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+
+	s := safearchive.Summarize(report)
+	res.Health = s.Health.String()
+	res.Reasons = s.Reasons
+	if report != nil {
+		for _, f := range report.Findings {
+			res.Findings = append(res.Findings, safearchive.BundleFinding{
+				Name:     f.Name,
+				NewName:  f.NewName,
+				Offset:   f.Offset,
+				Reason:   f.Reason,
+				Action:   f.Action.String(),
+				Severity: f.EffectiveSeverity().String(),
+				Detail:   f.Detail,
+			})
+		}
+	}
+	return res, nil
+}
+
+func inspectZip(data []byte, opts Options, res *Result) (*safearchive.Report, error) {
+	zr, err := zip.NewReaderWithOptions(bytes.NewReader(data), int64(len(data)), zip.Options{Tolerant: opts.ZipTolerant})
+	if err != nil {
+		return nil, err
+	}
+	zr.SetSecurityMode(opts.securityModeZip())
+	zr.SetMaxChildren(opts.MaxChildren)
+	res.Entries = len(zr.File)
+	return zr.Report(), zr.Err()
+}
+
+func inspectTar(data []byte, compressed bool, opts Options, res *Result) (*safearchive.Report, error) {
+	var r io.Reader = bytes.NewReader(data)
+	if compressed {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		r = gr
+	}
+	tr := tar.NewReader(r)
+	tr.SetSecurityMode(opts.securityModeTar())
+	tr.SetMaxChildren(opts.MaxChildren)
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			return tr.Report(), nil
+		}
+		if err != nil {
+			return tr.Report(), err
+		}
+		res.Entries++
+	}
+}
+
+func (o Options) securityModeTar() tar.SecurityMode {
+	if o.TarSecurityMode != 0 {
+		return o.TarSecurityMode
+	}
+	return tar.DefaultSecurityMode
+}
+
+func (o Options) securityModeZip() zip.SecurityMode {
+	if o.ZipSecurityMode != 0 {
+		return o.ZipSecurityMode
+	}
+	return zip.DefaultSecurityMode
+}
@@ -0,0 +1,134 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/corpus"
+	"github.com/google/safearchive/internal/archivetest"
+	"github.com/google/safearchive/tar"
+)
+
+func TestInspect(t *testing.T) {
+	traverse := corpus.Bytes("traverse.tar")
+	tests := []struct {
+		name        string
+		data        []byte
+		opts        Options
+		wantFormat  string
+		wantEntries int
+		wantHealth  string
+		wantReasons []safearchive.Reason
+	}{
+		{
+			name:        "tar",
+			data:        traverse,
+			wantFormat:  "tar",
+			wantEntries: 3,
+			wantHealth:  "malicious",
+			wantReasons: []safearchive.Reason{safearchive.ReasonAbsolutePath, safearchive.ReasonPathTraversal},
+		},
+		{
+			name:        "tar+gzip",
+			data:        archivetest.Gzip(t, traverse),
+			wantFormat:  "tar+gzip",
+			wantEntries: 3,
+			wantHealth:  "malicious",
+			wantReasons: []safearchive.Reason{safearchive.ReasonAbsolutePath, safearchive.ReasonPathTraversal},
+		},
+		{
+			name:        "tar without sanitization",
+			data:        traverse,
+			opts:        Options{TarSecurityMode: tar.SkipSpecialFiles},
+			wantFormat:  "tar",
+			wantEntries: 3,
+			wantHealth:  "clean",
+		},
+		{
+			name:        "zip",
+			data:        corpus.Bytes("archive.zip"),
+			wantFormat:  "zip",
+			wantEntries: 2,
+			wantHealth:  "malicious",
+			wantReasons: []safearchive.Reason{safearchive.ReasonPathTraversal, safearchive.ReasonAbsolutePath},
+		},
+		{
+			name:        "zip with fan-out limit",
+			data:        corpus.Bytes("archive.zip"),
+			opts:        Options{MaxChildren: 1},
+			wantFormat:  "zip",
+			wantEntries: 1,
+			wantHealth:  "malicious",
+			wantReasons: []safearchive.Reason{safearchive.ReasonPathTraversal, safearchive.ReasonAbsolutePath, safearchive.ReasonFanOut},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Inspect(tc.data, tc.opts)
+			if err != nil {
+				t.Fatalf("Inspect() error = %v", err)
+			}
+			if got.Format != tc.wantFormat || got.Entries != tc.wantEntries || got.Health != tc.wantHealth || got.Error != "" {
+				t.Errorf("Inspect() = %+v, want format %q, %d entries, health %q and no error", got, tc.wantFormat, tc.wantEntries, tc.wantHealth)
+			}
+			if !reflect.DeepEqual(got.Reasons, tc.wantReasons) {
+				t.Errorf("Inspect().Reasons = %v, want %v", got.Reasons, tc.wantReasons)
+			}
+		})
+	}
+}
+
+func TestInspectUnsupported(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("hello"), archivetest.Gzip(t, []byte("hello"))} {
+		if _, err := Inspect(data, Options{}); err != ErrUnsupportedFormat {
+			t.Errorf("Inspect(%q) error = %v, want %v", data, err, ErrUnsupportedFormat)
+		}
+	}
+}
+
+func TestInspectReaderError(t *testing.T) {
+	data := corpus.Bytes("traverse.tar")
+	got, err := Inspect(data[:1024+100], Options{})
+	if err != nil {
+		t.Fatalf("Inspect() error = %v", err)
+	}
+	if got.Error == "" {
+		t.Errorf("Inspect(truncated archive).Error is empty")
+	}
+}
+
+func TestResultJSON(t *testing.T) {
+	res, err := Inspect(corpus.Bytes("traverse.tar"), Options{})
+	if err != nil {
+		t.Fatalf("Inspect() error = %v", err)
+	}
+	b, err := json.Marshal(res)
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	for _, key := range []string{"format", "entries", "health", "reasons", "findings"} {
+		if _, ok := got[key]; !ok {
+			t.Errorf("JSON result %s has no %q property", b, key)
+		}
+	}
+}
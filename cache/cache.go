@@ -0,0 +1,273 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cache retains the parsed and sanitized indexes of archives across repeated opens of the
+// same artifact, which is common in registry and scanner workloads.
+//
+// Archives are identified by the SHA-256 digest of their contents, so the same artifact is parsed
+// once regardless of where it is read from:
+//
+//	c := cache.New(64<<20, archive.Options{})
+//	ix, err := c.Open(f, size)
+//	if err != nil {
+//		return err
+//	}
+//	for _, e := range ix.Entries {
+//		// e.Name is sanitized
+//	}
+//
+// The cache is bounded by the estimated memory usage of the indexes. The least recently used
+// indexes are evicted first, and the archives whose index could not fit are not indexed at all.
+//
+// Computing the digest reads the whole archive on every Open, cache hits included. Callers that
+// know the digest of the archive already (e.g. content-addressed registries) should pass it to
+// OpenKey instead.
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/archive"
+)
+
+// ErrTooLarge is returned when the index of an archive would exceed the memory it is allowed.
+var ErrTooLarge = fmt.Errorf("%w: index too large", safearchive.ErrLimitExceeded)
+
+// Key identifies an archive: the SHA-256 digest of its contents.
+type Key [sha256.Size]byte
+
+// Digest returns the key of the archive in r, which is size bytes long.
+func Digest(r io.ReaderAt, size int64) (Key, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, size)); err != nil {
+		return Key{}, err
+	}
+	var k Key
+	h.Sum(k[:0])
+	return k, nil
+}
+
+// Index is the parsed and sanitized listing of an archive. Indexes are shared by the users of the
+// cache, they must not be modified.
+type Index struct {
+	// Format is the format of the archive.
+	Format safearchive.Format
+	// Entries are the entries of the archive, as returned by its reader.
+	Entries []archive.Entry
+	// Report are the findings of the security features of the reader about the entries.
+	Report *safearchive.Report
+}
+
+// Build reads the index of the archive in r, which is size bytes long, with the readers
+// configured by opts. It fails with ErrTooLarge as soon as the estimated memory usage of the index
+// exceeds maxBytes, unless maxBytes is zero.
+func Build(r io.ReaderAt, size int64, opts archive.Options, maxBytes int64) (*Index, error) {
+	ar, err := archive.OpenWithOptions(r, size, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer ar.Close()
+	ix := &Index{Format: ar.Format()}
+	n := int64(indexOverhead)
+	for {
+		e, err := ar.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n += entrySize(e); maxBytes > 0 && n > maxBytes {
+			return nil, ErrTooLarge
+		}
+		ix.Entries = append(ix.Entries, *e)
+	}
+	ix.Report = ar.Report()
+	for _, f := range ix.Report.Findings {
+		if n += findingSize(f); maxBytes > 0 && n > maxBytes {
+			return nil, ErrTooLarge
+		}
+	}
+	return ix, nil
+}
+
+// Estimated memory usage of the parts of an Index, beyond their strings.
+const (
+	indexOverhead   = 64
+	entryOverhead   = 128
+	findingOverhead = 96
+)
+
+// size estimates the memory usage of ix.
+func (ix *Index) size() int64 {
+	n := int64(indexOverhead)
+	for i := range ix.Entries {
+		n += entrySize(&ix.Entries[i])
+	}
+	if ix.Report != nil {
+		for _, f := range ix.Report.Findings {
+			n += findingSize(f)
+		}
+	}
+	return n
+}
+
+// entrySize estimates the memory usage of e in an Index.
+func entrySize(e *archive.Entry) int64 {
+	return entryOverhead + int64(len(e.Name)+len(e.Linkname)+len(e.Digest))
+}
+
+// findingSize estimates the memory usage of f in an Index.
+func findingSize(f safearchive.Finding) int64 {
+	return findingOverhead + int64(len(f.Name)+len(f.NewName)+len(f.Detail)+len(f.Raw))
+}
+
+type item struct {
+	key  Key
+	ix   *Index
+	size int64
+}
+
+// Cache is a least recently used cache of the indexes of archives, bounded by their estimated
+// memory usage. It is safe for concurrent use. The zero value is not usable, see New.
+type Cache struct {
+	opts     archive.Options
+	maxBytes int64
+
+	mu      sync.Mutex
+	used    int64
+	lru     *list.List
+	items   map[Key]*list.Element
+	onEvict func(Key, *Index)
+}
+
+// New returns a cache of at most maxBytes of indexes (as estimated), built by Open with the
+// readers configured by opts. Indexes larger than maxBytes are not cached.
+func New(maxBytes int64, opts archive.Options) *Cache {
+	return &Cache{opts: opts, maxBytes: maxBytes, lru: list.New(), items: map[Key]*list.Element{}}
+}
+
+// OnEvict sets a function called with the indexes leaving the cache, because they were evicted to
+// make room for others or removed by Remove or Purge. It is called with the lock of the cache
+// held, so it must not call the cache.
+func (c *Cache) OnEvict(f func(Key, *Index)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onEvict = f
+}
+
+// Open returns the index of the archive in r, which is size bytes long, from the cache, or builds
+// and caches it. Concurrent opens of an archive missing from the cache may build its index more
+// than once. Errors are not cached. Archives whose index would be larger than the cache fail with
+// ErrTooLarge; Build lists them regardless.
+//
+// Open reads the whole archive to compute its key (see Digest) on every call, see OpenKey.
+func (c *Cache) Open(r io.ReaderAt, size int64) (*Index, error) {
+	k, err := Digest(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return c.OpenKey(k, r, size)
+}
+
+// OpenKey is like Open, with k the key of the archive in r, e.g. a digest computed earlier. r is
+// only read on cache misses.
+func (c *Cache) OpenKey(k Key, r io.ReaderAt, size int64) (*Index, error) {
+	if ix, ok := c.Get(k); ok {
+		return ix, nil
+	}
+	ix, err := Build(r, size, c.opts, c.maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	c.Add(k, ix)
+	return ix, nil
+}
+
+// Get returns the index of the archive with key k, if it is in the cache.
+func (c *Cache) Get(k Key) (*Index, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[k]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*item).ix, true
+}
+
+// Add caches ix as the index of the archive with key k, evicting the least recently used indexes
+// as needed. ix must have been built with the options of the cache.
+func (c *Cache) Add(k Key, ix *Index) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[k]; ok {
+		c.remove(el)
+	}
+	it := &item{key: k, ix: ix, size: ix.size()}
+	if it.size > c.maxBytes {
+		return
+	}
+	c.items[k] = c.lru.PushFront(it)
+	c.used += it.size
+	for c.used > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Remove invalidates the index of the archive with key k.
+func (c *Cache) Remove(k Key) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[k]; ok {
+		c.remove(el)
+	}
+}
+
+// Purge invalidates all the indexes.
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Len returns the number of indexes in the cache.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Size returns the estimated memory usage of the indexes in the cache.
+func (c *Cache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.used
+}
+
+func (c *Cache) remove(el *list.Element) {
+	it := c.lru.Remove(el).(*item)
+	delete(c.items, it.key)
+	c.used -= it.size
+	if c.onEvict != nil {
+		c.onEvict(it.key, it.ix)
+	}
+}
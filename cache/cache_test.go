@@ -0,0 +1,175 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/archive"
+	"github.com/google/safearchive/internal/archivetest"
+)
+
+func zipBytes(t *testing.T, names ...string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := archivetest.NewZipWriter(&buf)
+	for _, name := range names {
+		if _, err := w.Create(name); err != nil {
+			t.Fatalf("zip.Writer.Create(%q) error = %v", name, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("zip.Writer.Close() error = %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestOpen(t *testing.T) {
+	c := New(1<<20, archive.Options{})
+	data := zipBytes(t, "a.txt", "../evil.txt")
+	ix, err := c.Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if ix.Format != safearchive.FormatZip || len(ix.Entries) != 2 || ix.Entries[1].Name != "evil.txt" {
+		t.Errorf("Open() = %+v, want the sanitized zip entries", ix)
+	}
+	if len(ix.Report.Findings) != 1 {
+		t.Errorf("Report has %d findings, want 1", len(ix.Report.Findings))
+	}
+
+	// the same contents, read from elsewhere
+	again, err := c.Open(bytes.NewReader(append([]byte{}, data...)), int64(len(data)))
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if again != ix {
+		t.Errorf("Open() of the same archive built a new index")
+	}
+	if c.Len() != 1 || c.Size() != ix.size() {
+		t.Errorf("Len(), Size() = %d, %d, want 1, %d", c.Len(), c.Size(), ix.size())
+	}
+
+	if _, err := c.Open(bytes.NewReader([]byte("not an archive")), 14); err == nil {
+		t.Errorf("Open() of a non-archive error = nil")
+	}
+	if c.Len() != 1 {
+		t.Errorf("Len() = %d after a failed Open, want 1", c.Len())
+	}
+}
+
+func TestEviction(t *testing.T) {
+	archives := [][]byte{zipBytes(t, "a"), zipBytes(t, "b"), zipBytes(t, "c")}
+	var keys []Key
+	for _, data := range archives {
+		k, err := Digest(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatalf("Digest() error = %v", err)
+		}
+		keys = append(keys, k)
+	}
+	ix, err := Build(bytes.NewReader(archives[0]), int64(len(archives[0])), archive.Options{}, 0)
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+
+	// room for two indexes
+	c := New(2*ix.size(), archive.Options{})
+	var evicted []Key
+	c.OnEvict(func(k Key, _ *Index) { evicted = append(evicted, k) })
+	for _, i := range []int{0, 1} {
+		if _, err := c.Open(bytes.NewReader(archives[i]), int64(len(archives[i]))); err != nil {
+			t.Fatalf("Open() error = %v", err)
+		}
+	}
+	// touching the first makes the second the least recently used
+	if _, ok := c.Get(keys[0]); !ok {
+		t.Fatalf("Get() missed the first archive")
+	}
+	if _, err := c.Open(bytes.NewReader(archives[2]), int64(len(archives[2]))); err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if len(evicted) != 1 || evicted[0] != keys[1] {
+		t.Errorf("evicted %d indexes, want the second archive only", len(evicted))
+	}
+	if _, ok := c.Get(keys[1]); ok {
+		t.Errorf("Get() found the evicted archive")
+	}
+
+	c.Remove(keys[0])
+	if _, ok := c.Get(keys[0]); ok {
+		t.Errorf("Get() found the removed archive")
+	}
+	c.Purge()
+	if c.Len() != 0 || c.Size() != 0 || len(evicted) != 3 {
+		t.Errorf("after Purge() Len(), Size() = %d, %d, evicted %d, want 0, 0, 3", c.Len(), c.Size(), len(evicted))
+	}
+
+	small := New(1, archive.Options{})
+	small.Add(keys[0], ix)
+	if small.Len() != 0 {
+		t.Errorf("Add() cached an index larger than the cache")
+	}
+}
+
+// failingReaderAt fails every read.
+type failingReaderAt struct{}
+
+func (failingReaderAt) ReadAt([]byte, int64) (int, error) {
+	return 0, errors.New("read")
+}
+
+func TestOpenKey(t *testing.T) {
+	c := New(1<<20, archive.Options{})
+	data := zipBytes(t, "a.txt")
+	k, err := Digest(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("Digest() error = %v", err)
+	}
+	ix, err := c.OpenKey(k, bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("OpenKey() error = %v", err)
+	}
+	// hits do not read the archive
+	if again, err := c.OpenKey(k, failingReaderAt{}, int64(len(data))); err != nil || again != ix {
+		t.Errorf("OpenKey() of a cached archive = %p, %v, want %p, nil", again, err, ix)
+	}
+	if again, err := c.Open(bytes.NewReader(data), int64(len(data))); err != nil || again != ix {
+		t.Errorf("Open() of an archive cached by OpenKey = %p, %v, want %p, nil", again, err, ix)
+	}
+}
+
+func TestTooLarge(t *testing.T) {
+	data := zipBytes(t, "a.txt", "b.txt", "c.txt")
+	ix, err := Build(bytes.NewReader(data), int64(len(data)), archive.Options{}, 0)
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	if _, err := Build(bytes.NewReader(data), int64(len(data)), archive.Options{}, ix.size()); err != nil {
+		t.Errorf("Build(maxBytes: %d) error = %v", ix.size(), err)
+	}
+	if _, err := Build(bytes.NewReader(data), int64(len(data)), archive.Options{}, ix.size()-1); !errors.Is(err, ErrTooLarge) || !errors.Is(err, safearchive.ErrLimitExceeded) {
+		t.Errorf("Build(maxBytes: %d) error = %v, want %v", ix.size()-1, err, ErrTooLarge)
+	}
+
+	c := New(ix.size()-1, archive.Options{})
+	if _, err := c.Open(bytes.NewReader(data), int64(len(data))); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Open() of an archive larger than the cache error = %v, want %v", err, ErrTooLarge)
+	}
+}
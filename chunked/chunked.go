@@ -0,0 +1,228 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package chunked reassembles archives arriving as a sequence of chunks (e.g. gRPC or websocket
+// streams) into readers the safearchive packages can consume.
+//
+// Tar archives are read sequentially, so NewReader is enough:
+//
+//	tr := tar.NewReader(chunked.NewReader(src, maxSize))
+//
+// Zip archives need random access, Buffer collects the chunks in memory up to a threshold and
+// spills them to a temporary file beyond that:
+//
+//	b := chunked.NewBuffer(maxSize, maxMemory)
+//	defer b.Close()
+//	if err := b.Fill(src); err != nil {
+//		return err
+//	}
+//	zr, err := zip.NewReader(b, b.Size())
+package chunked
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/google/safearchive/tempspace"
+)
+
+// ErrTooLarge is returned when the reassembled stream exceeds its size limit.
+var ErrTooLarge = errors.New("chunked: stream too large")
+
+// Source returns the next chunk of a stream, or io.EOF at the end of the stream. The last chunk may
+// be returned along with io.EOF or an error, like the data of io.Reader.
+// The Recv method of a gRPC stream can be adapted into a Source with a short closure.
+type Source func() ([]byte, error)
+
+type reader struct {
+	src     Source
+	chunk   []byte
+	read    int64
+	maxSize int64
+	err     error
+}
+
+// NewReader returns a reader of the concatenation of the chunks returned by src.
+// Reading fails with ErrTooLarge once more than maxSize bytes arrived. A maxSize of 0 means no limit.
+func NewReader(src Source, maxSize int64) io.Reader {
+	return &reader{src: src, maxSize: maxSize}
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.chunk, r.err = r.src()
+		if r.err == nil && len(r.chunk) == 0 {
+			continue
+		}
+		r.read += int64(len(r.chunk))
+		if r.maxSize > 0 && r.read > r.maxSize {
+			r.chunk, r.err = nil, ErrTooLarge
+		}
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+// Buffer reassembles a stream for random access. Up to maxMemory bytes are kept in memory, larger
+// streams are spilled to a temporary file that is removed by Close.
+type Buffer struct {
+	// TempDir is the directory of the spill file, os.TempDir is used if empty.
+	TempDir string
+	// Space, if set, hosts the spill file instead of TempDir, accounting it against the budget of
+	// the space.
+	Space *tempspace.Space
+
+	maxSize   int64
+	maxMemory int64
+	mem       []byte
+	f         spillFile
+	size      int64
+}
+
+// spillFile is the temporary file of a Buffer.
+type spillFile interface {
+	io.Writer
+	io.WriterAt
+	io.ReaderAt
+	Name() string
+	// Remove closes and removes the file.
+	Remove() error
+}
+
+// osFile is a spill file created in TempDir.
+type osFile struct {
+	*os.File
+}
+
+func (f osFile) Remove() error {
+	err := f.Close()
+	if rerr := os.Remove(f.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// NewBuffer returns an empty Buffer accepting at most maxSize bytes (0 means no limit) and keeping
+// up to maxMemory bytes in memory.
+func NewBuffer(maxSize, maxMemory int64) *Buffer {
+	return &Buffer{maxSize: maxSize, maxMemory: maxMemory}
+}
+
+// Write appends p to the buffer.
+func (b *Buffer) Write(p []byte) (int, error) {
+	if b.maxSize > 0 && b.size+int64(len(p)) > b.maxSize {
+		return 0, ErrTooLarge
+	}
+	if b.f == nil && b.size+int64(len(p)) > b.maxMemory {
+		if err := b.spill(); err != nil {
+			return 0, err
+		}
+	}
+	if b.f != nil {
+		n, err := b.f.WriteAt(p, b.size)
+		b.size += int64(n)
+		return n, err
+	}
+	b.mem = append(b.mem, p...)
+	b.size += int64(len(p))
+	return len(p), nil
+}
+
+func (b *Buffer) spill() error {
+	var f spillFile
+	if b.Space != nil {
+		tf, err := b.Space.CreateFile("safearchive-chunked-*")
+		if err != nil {
+			return err
+		}
+		f = tf
+	} else {
+		of, err := os.CreateTemp(b.TempDir, "safearchive-chunked-*")
+		if err != nil {
+			return err
+		}
+		f = osFile{of}
+	}
+	if _, err := f.Write(b.mem); err != nil {
+		f.Remove()
+		return err
+	}
+	b.f = f
+	b.mem = nil
+	return nil
+}
+
+// Fill appends every chunk of src to the buffer.
+func (b *Buffer) Fill(src Source) error {
+	for {
+		chunk, err := src()
+		if len(chunk) > 0 {
+			if _, err := b.Write(chunk); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ReadAt implements io.ReaderAt.
+func (b *Buffer) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("chunked: negative offset")
+	}
+	if off >= b.size {
+		return 0, io.EOF
+	}
+	if b.f != nil {
+		if rem := b.size - off; int64(len(p)) > rem {
+			n, err := b.f.ReadAt(p[:rem], off)
+			if err == nil {
+				err = io.EOF
+			}
+			return n, err
+		}
+		return b.f.ReadAt(p, off)
+	}
+	n := copy(p, b.mem[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Size returns the number of bytes in the buffer.
+func (b *Buffer) Size() int64 {
+	return b.size
+}
+
+// Close releases the memory and removes the spill file of the buffer.
+func (b *Buffer) Close() error {
+	b.mem = nil
+	if b.f == nil {
+		return nil
+	}
+	err := b.f.Remove()
+	b.f = nil
+	return err
+}
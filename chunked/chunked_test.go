@@ -0,0 +1,172 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunked
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/google/safearchive/internal/archivetest"
+	"github.com/google/safearchive/tar"
+	"github.com/google/safearchive/tempspace"
+	"github.com/google/safearchive/zip"
+)
+
+// chunks returns a Source returning b in chunks of size n.
+func chunks(b []byte, n int) Source {
+	return func() ([]byte, error) {
+		if len(b) == 0 {
+			return nil, io.EOF
+		}
+		if n > len(b) {
+			n = len(b)
+		}
+		c := b[:n]
+		b = b[n:]
+		return c, nil
+	}
+}
+
+// chunksEOF is like chunks, but returns the last chunk along with io.EOF.
+func chunksEOF(b []byte, n int) Source {
+	return func() ([]byte, error) {
+		if n >= len(b) {
+			c := b
+			b = nil
+			return c, io.EOF
+		}
+		c := b[:n]
+		b = b[n:]
+		return c, nil
+	}
+}
+
+func TestNewReader(t *testing.T) {
+	archive := archivetest.Tar(t, []archivetest.Entry{{Name: "/abs.txt", Content: []byte("abc")}})
+	tr := tar.NewReader(NewReader(chunks(archive, 7), 0))
+	h, err := tr.Next()
+	if err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	if h.Name != "abs.txt" {
+		t.Errorf("Next().Name = %q, want %q", h.Name, "abs.txt")
+	}
+	if b, _ := io.ReadAll(tr); string(b) != "abc" {
+		t.Errorf("content = %q, want %q", b, "abc")
+	}
+}
+
+func TestNewReaderTooLarge(t *testing.T) {
+	r := NewReader(chunks(make([]byte, 100), 10), 50)
+	if _, err := io.ReadAll(r); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("io.ReadAll() error = %v, want %v", err, ErrTooLarge)
+	}
+}
+
+func TestBuffer(t *testing.T) {
+	archive := archivetest.Zip(t, []archivetest.Entry{
+		{Name: "../a.txt", Content: bytes.Repeat([]byte("../a.txt"), 100)},
+		{Name: "b.txt", Content: bytes.Repeat([]byte("b.txt"), 100)},
+	})
+	for _, maxMemory := range []int64{0, 100, 1 << 20} {
+		b := NewBuffer(0, maxMemory)
+		b.TempDir = t.TempDir()
+		if err := b.Fill(chunks(archive, 13)); err != nil {
+			t.Fatalf("Fill() error = %v", err)
+		}
+		spilled := b.f != nil
+		if want := int64(len(archive)) > maxMemory; spilled != want {
+			t.Errorf("maxMemory %d: spilled = %v, want %v", maxMemory, spilled, want)
+		}
+
+		zr, err := zip.NewReader(b, b.Size())
+		if err != nil {
+			t.Fatalf("zip.NewReader() error = %v", err)
+		}
+		if len(zr.File) != 2 || zr.File[0].Name != "a.txt" {
+			t.Errorf("maxMemory %d: unexpected entries in the reassembled archive", maxMemory)
+		}
+		if n, err := b.ReadAt(make([]byte, 1), -1); n != 0 || err == nil {
+			t.Errorf("maxMemory %d: ReadAt(-1) = %d, %v, want an error", maxMemory, n, err)
+		}
+
+		var name string
+		if spilled {
+			name = b.f.Name()
+		}
+		if err := b.Close(); err != nil {
+			t.Errorf("Close() error = %v", err)
+		}
+		if spilled {
+			if _, err := os.Stat(name); !os.IsNotExist(err) {
+				t.Errorf("spill file %q still exists after Close()", name)
+			}
+		}
+	}
+}
+
+func TestLastChunkWithEOF(t *testing.T) {
+	data := []byte("hello, world")
+	if got, err := io.ReadAll(NewReader(chunksEOF(data, 5), 0)); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("io.ReadAll(NewReader()) = %q, %v, want %q", got, err, data)
+	}
+	b := NewBuffer(0, 1<<20)
+	defer b.Close()
+	if err := b.Fill(chunksEOF(data, 5)); err != nil {
+		t.Fatalf("Fill() error = %v", err)
+	}
+	got := make([]byte, b.Size())
+	if _, err := b.ReadAt(got, 0); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("ReadAt() after Fill() = %q, %v, want %q", got, err, data)
+	}
+}
+
+func TestBufferTooLarge(t *testing.T) {
+	b := NewBuffer(50, 10)
+	defer b.Close()
+	if err := b.Fill(chunks(make([]byte, 100), 10)); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Fill() error = %v, want %v", err, ErrTooLarge)
+	}
+}
+
+func TestBufferSpace(t *testing.T) {
+	budget := tempspace.NewBudget(150)
+	err := tempspace.Do(context.Background(), t.TempDir(), budget, func(s *tempspace.Space) error {
+		b := NewBuffer(0, 10)
+		b.Space = s
+		defer b.Close()
+		if err := b.Fill(chunks(make([]byte, 100), 10)); err != nil {
+			t.Fatalf("Fill() error = %v", err)
+		}
+		if s.Used() != 100 {
+			t.Errorf("Space.Used() = %d, want 100", s.Used())
+		}
+
+		b2 := NewBuffer(0, 10)
+		b2.Space = s
+		defer b2.Close()
+		return b2.Fill(chunks(make([]byte, 100), 10))
+	})
+	if !errors.Is(err, tempspace.ErrBudgetExceeded) {
+		t.Errorf("Fill() error = %v, want %v", err, tempspace.ErrBudgetExceeded)
+	}
+	if budget.Used() != 0 {
+		t.Errorf("Budget.Used() = %d, want 0", budget.Used())
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package corpus is a collection of hostile archives along with the outcome the safearchive
+// readers produce for them.
+//
+// The archives are the same ones the safearchive packages are tested with. Integrators can run
+// them through their own end-to-end extraction paths to verify that the protections are in place:
+//
+//	for _, f := range corpus.All() {
+//		got := extractAndList(f.Data) // names of the extracted files, using forward slashes
+//		if !slices.Equal(got, f.WantDefault) {
+//			t.Errorf("%s: extracted %q, want %q", f.Name, got, f.WantDefault)
+//		}
+//	}
+package corpus
+
+import (
+	"embed"
+
+	"github.com/google/safearchive"
+)
+
+//go:embed *.tar *.zip
+var files embed.FS
+
+// Fixture is a hostile archive and its expected sanitized outcome.
+type Fixture struct {
+	// Name is the file name of the archive, e.g. traverse.tar.
+	Name string
+	// Format is the format of the archive.
+	Format safearchive.Format
+	// Description explains what the archive attempts.
+	Description string
+	// Data is the archive itself.
+	Data []byte
+	// WantDefault lists the names of the entries a safearchive reader emits with the default
+	// security mode of Linux (and other Unix, but not macOS) builds. Names use forward slashes.
+	WantDefault []string
+	// WantMaximum lists the names of the entries a safearchive reader emits with the maximum
+	// security mode. Names use forward slashes.
+	WantMaximum []string
+}
+
+var fixtures = []Fixture{
+	{
+		Name:        "traverse.tar",
+		Format:      safearchive.FormatTar,
+		Description: "Entries readme.txt, /gopher.txt and ../todo.txt attempting to escape the destination directory.",
+		WantDefault: []string{"readme.txt", "gopher.txt", "todo.txt"},
+		WantMaximum: []string{"readme.txt", "gopher.txt", "todo.txt"},
+	},
+	{
+		Name:        "traverse-via-links.tar",
+		Format:      safearchive.FormatTar,
+		Description: "Symbolic links to / and ../outside.txt followed by entries written through them.",
+		WantDefault: []string{"linktoroot", "linktoescape"},
+		WantMaximum: []string{"linktoroot", "linktoescape"},
+	},
+	{
+		Name:        "traverse-slash-at-the-end.tar",
+		Format:      safearchive.FormatTar,
+		Description: "A symbolic link named linktoroot/ (with a trailing slash) to / and an entry written through it.",
+		WantDefault: []string{"linktoroot/"},
+		WantMaximum: []string{"linktoroot/"},
+	},
+	{
+		Name:        "case-insensitive.tar",
+		Format:      safearchive.FormatTar,
+		Description: "A symbolic link tmp to / and an entry written through it as Tmp/test-file, targeting case insensitive file systems.",
+		WantDefault: []string{"tmp", "Tmp/test-file"},
+		WantMaximum: []string{"tmp"},
+	},
+	{
+		Name:        "specialfiles.tar",
+		Format:      safearchive.FormatTar,
+		Description: "A fifo, character and block devices, a directory, a regular file, a symbolic and a hard link.",
+		WantDefault: []string{"fifo", "null", "sda", "dir/", "regular.txt", "symlink", "hardlink"},
+		WantMaximum: []string{"dir/", "regular.txt", "symlink"},
+	},
+	{
+		Name:        "specialmodes.tar",
+		Format:      safearchive.FormatTar,
+		Description: "Entries with the setuid, setgid and sticky bits set.",
+		WantDefault: []string{"setuidstuff.txt", "setuidstuff2.txt", "tmpstuff.txt", "somedir/"},
+		WantMaximum: []string{"setuidstuff.txt", "setuidstuff2.txt", "tmpstuff.txt", "somedir/"},
+	},
+	{
+		Name:        "xattr.tar",
+		Format:      safearchive.FormatTar,
+		Description: "An entry with the user.hello extended attribute.",
+		WantDefault: []string{"something.txt"},
+		WantMaximum: []string{"something.txt"},
+	},
+	{
+		Name:        "winshort.tar",
+		Format:      safearchive.FormatTar,
+		Description: "Entries with path components looking like Windows short filenames (e.g. ANDROI~2).",
+		WantDefault: []string{"3D Objects", "Androi~2", "ANDROI~2", "foo/", "foo/ANDROI~2/", "foo/ANDROI~2/bar", "foo/FOOOOO~1.JPG/", "foo/FOOOOO~1.JPG/bar", "foo/Androi~2/", "foo/Androi~2/bar", "FOOOOO~1.JPG", "Some~Stuff"},
+		WantMaximum: []string{"3D Objects", "foo/", "Some~Stuff"},
+	},
+	{
+		Name:        "archive.zip",
+		Format:      safearchive.FormatZip,
+		Description: "Entries ../traverse and /absolute attempting to escape the destination directory.",
+		WantDefault: []string{"traverse", "absolute"},
+		WantMaximum: []string{"traverse", "absolute"},
+	},
+	{
+		Name:        "symlinks.zip",
+		Format:      safearchive.FormatZip,
+		Description: "A symbolic link entry.",
+		WantDefault: []string{"thisisalink.txt"},
+		WantMaximum: []string{"thisisalink.txt"},
+	},
+	{
+		Name:        "symlinks2.zip",
+		Format:      safearchive.FormatZip,
+		Description: "A symbolic link root to /root and an entry written through it.",
+		WantDefault: []string{"root"},
+		WantMaximum: []string{"root"},
+	},
+	{
+		Name:        "symlinks3.zip",
+		Format:      safearchive.FormatZip,
+		Description: "A symbolic link root/ (with a trailing slash) to /root and an entry written through it.",
+		WantDefault: []string{"root/"},
+		WantMaximum: []string{"root/"},
+	},
+	{
+		Name:        "case-insensitive.zip",
+		Format:      safearchive.FormatZip,
+		Description: "A symbolic link tmp and an entry written through it as Tmp/some-file, targeting case insensitive file systems.",
+		WantDefault: []string{"tmp", "Tmp/some-file"},
+		WantMaximum: []string{"tmp"},
+	},
+	{
+		Name:        "specialmodes.zip",
+		Format:      safearchive.FormatZip,
+		Description: "Entries with the setuid, setgid and sticky bits set.",
+		WantDefault: []string{"setuidstuff.txt", "setuidstuff2.txt", "tmpstuff.txt", "somedir/"},
+		WantMaximum: []string{"setuidstuff.txt", "setuidstuff2.txt", "tmpstuff.txt", "somedir/"},
+	},
+	{
+		Name:        "winshort.zip",
+		Format:      safearchive.FormatZip,
+		Description: "Entries with path components looking like Windows short filenames (e.g. ANDROI~2).",
+		WantDefault: []string{"3D Objects", "Androi~2", "ANDROI~2", "foo/", "FOOOOO~1.JPG", "Some~Stuff", "foo/ANDROI~2/", "foo/ANDROI~2/bar", "foo/FOOOOO~1.JPG/", "foo/FOOOOO~1.JPG/bar", "foo/Androi~2/", "foo/Androi~2/bar"},
+		WantMaximum: []string{"3D Objects", "foo/", "Some~Stuff"},
+	},
+}
+
+// All returns every fixture of the corpus.
+func All() []Fixture {
+	re := make([]Fixture, 0, len(fixtures))
+	for _, f := range fixtures {
+		f.Data = Bytes(f.Name)
+		re = append(re, f)
+	}
+	return re
+}
+
+// Get returns the fixture with the given name.
+func Get(name string) (Fixture, bool) {
+	for _, f := range fixtures {
+		if f.Name == name {
+			f.Data = Bytes(f.Name)
+			return f, true
+		}
+	}
+	return Fixture{}, false
+}
+
+// Bytes returns the contents of the named archive. It panics if there is no such archive.
+func Bytes(name string) []byte {
+	b, err := files.ReadFile(name)
+	if err != nil {
+		panic("corpus: " + err.Error())
+	}
+	return b
+}
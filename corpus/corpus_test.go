@@ -0,0 +1,96 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package corpus_test
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/corpus"
+	"github.com/google/safearchive/tar"
+	"github.com/google/safearchive/zip"
+)
+
+func tarNames(t *testing.T, data []byte, mode tar.SecurityMode) []string {
+	t.Helper()
+
+	tr := tar.NewReader(bytes.NewReader(data))
+	tr.SetSecurityMode(mode)
+	var names []string
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return names
+		}
+		if err != nil {
+			t.Fatalf("tar.Reader.Next() error = %v", err)
+		}
+		names = append(names, filepath.ToSlash(h.Name))
+	}
+}
+
+func zipNames(t *testing.T, data []byte, mode zip.SecurityMode) []string {
+	t.Helper()
+
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("zip.NewReader() error = %v", err)
+	}
+	r.SetSecurityMode(mode)
+	var names []string
+	for _, f := range r.File {
+		names = append(names, filepath.ToSlash(f.Name))
+	}
+	return names
+}
+
+func TestCorpus(t *testing.T) {
+	for _, f := range corpus.All() {
+		var gotDefault, gotMaximum []string
+		switch f.Format {
+		case safearchive.FormatTar:
+			gotDefault = tarNames(t, f.Data, tar.SanitizeFilenames|tar.PreventSymlinkTraversal)
+			gotMaximum = tarNames(t, f.Data, tar.MaximumSecurityMode)
+		case safearchive.FormatZip:
+			gotDefault = zipNames(t, f.Data, zip.SanitizeFilenames|zip.PreventSymlinkTraversal)
+			gotMaximum = zipNames(t, f.Data, zip.MaximumSecurityMode)
+		default:
+			t.Fatalf("%s: unexpected format %v", f.Name, f.Format)
+		}
+		if !reflect.DeepEqual(gotDefault, f.WantDefault) {
+			t.Errorf("%s with default security mode: got %q, want %q", f.Name, gotDefault, f.WantDefault)
+		}
+		if !reflect.DeepEqual(gotMaximum, f.WantMaximum) {
+			t.Errorf("%s with maximum security mode: got %q, want %q", f.Name, gotMaximum, f.WantMaximum)
+		}
+		if format, _ := safearchive.DetectFormat(f.Data); format != f.Format {
+			t.Errorf("%s: DetectFormat() = %v, want %v", f.Name, format, f.Format)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	f, ok := corpus.Get("traverse.tar")
+	if !ok || len(f.Data) == 0 {
+		t.Errorf("Get(traverse.tar) = %v, %v, want the fixture", f.Name, ok)
+	}
+	if _, ok := corpus.Get("missing.tar"); ok {
+		t.Errorf("Get(missing.tar) found a fixture")
+	}
+}
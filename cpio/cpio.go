@@ -0,0 +1,577 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cpio reads cpio archives in the "new" portable format (newc, also written with
+// checksums as "crc"), e.g. the payload of RPM packages and Linux initramfs images, with the
+// security focus of the tar and zip packages.
+//
+// The names of the entries are sanitized like the names of the entries of the other formats
+// (dropping .. path components and turning absolute names into relative ones), the entries
+// written through the symbolic links of the archive are skipped, and the sizes of the entries may
+// be limited:
+//
+//	r := cpio.NewReader(f)
+//	r.SetMaxTotalSize(1 << 30)
+//	for {
+//		h, err := r.Next()
+//		if err == io.EOF {
+//			break
+//		}
+//		...
+//	}
+//
+// The targets of symbolic links, stored as the data of their entries, are returned in
+// Header.Linkname. The entries of the hard links of a file share the inode number of the file,
+// and only the last one of them has the data.
+package cpio
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/sanitizer"
+)
+
+const (
+	// Magic is the signature of the headers of the newc format, and CRCMagic the one of the crc
+	// format, whose headers have a checksum of the data.
+	Magic    = "070701"
+	CRCMagic = "070702"
+	// headerLen is the length of a header, including the magic.
+	headerLen = 110
+	// trailer is the name of the entry terminating the archive.
+	trailer = "TRAILER!!!"
+	// maxNameLen is the maximum length of the names and of the targets of the symbolic links.
+	maxNameLen = 4096
+)
+
+// The types of the entries, in the format bits of Header.Mode.
+const (
+	TypeMask    = 0170000
+	TypeSocket  = 0140000
+	TypeSymlink = 0120000
+	TypeReg     = 0100000
+	TypeBlock   = 0060000
+	TypeDir     = 0040000
+	TypeChar    = 0020000
+	TypeFifo    = 0010000
+)
+
+var (
+	// ErrHeader is wrapped by the errors of reading an invalid header, or a file that is not a
+	// cpio archive in a supported format.
+	ErrHeader = errors.New("cpio: invalid header")
+	// ErrLimitExceeded is wrapped by the errors of Next when the archive exceeds a limit of the
+	// Reader.
+	ErrLimitExceeded = safearchive.ErrLimitExceeded
+)
+
+// Header describes an entry of a cpio archive.
+type Header struct {
+	Name string
+	// Linkname is the target of a symbolic link.
+	Linkname string
+	// Mode holds the permission and the format bits (see TypeMask) of the entry.
+	Mode    int64
+	Uid     int
+	Gid     int
+	Nlink   int
+	Inode   int64
+	ModTime time.Time
+	// Size is the length of the data of the entry, zero for symbolic links.
+	Size int64
+	// Devmajor and Devminor are the device numbers of device nodes.
+	Devmajor int64
+	Devminor int64
+	// Checksum is the sum of the bytes of the data in the crc format.
+	Checksum uint32
+}
+
+// FileMode returns the permission and the type of the entry as an fs.FileMode.
+func (h *Header) FileMode() fs.FileMode {
+	m := fs.FileMode(h.Mode & 0777)
+	if h.Mode&04000 != 0 {
+		m |= fs.ModeSetuid
+	}
+	if h.Mode&02000 != 0 {
+		m |= fs.ModeSetgid
+	}
+	if h.Mode&01000 != 0 {
+		m |= fs.ModeSticky
+	}
+	switch h.Mode & TypeMask {
+	case TypeSocket:
+		m |= fs.ModeSocket
+	case TypeSymlink:
+		m |= fs.ModeSymlink
+	case TypeBlock:
+		m |= fs.ModeDevice
+	case TypeDir:
+		m |= fs.ModeDir
+	case TypeChar:
+		m |= fs.ModeDevice | fs.ModeCharDevice
+	case TypeFifo:
+		m |= fs.ModeNamedPipe
+	}
+	return m
+}
+
+// SecurityMode controls security features to enforce
+type SecurityMode int
+
+const (
+	// SanitizeFilenames will sanitize filenames (dropping .. path components and turning entries
+	// into relative). Entries with nothing left of their name are skipped.
+	// This feature is enabled by default.
+	SanitizeFilenames SecurityMode = 1
+	// PreventSymlinkTraversal skips the entries that would be written through a symbolic link
+	// of the archive.
+	// This feature is enabled by default.
+	PreventSymlinkTraversal SecurityMode = 2
+	// SanitizeFileMode will drop special file modes (e.g. setuid and the sticky bit).
+	// This feature is not enabled by default.
+	SanitizeFileMode SecurityMode = 4
+	// SkipSpecialFiles skips the device nodes, fifos and sockets.
+	// This feature is part of MaximumSecurityMode.
+	SkipSpecialFiles SecurityMode = 8
+	// SanitizeSymlinkTargets skips the symbolic links whose target is absolute or escapes the
+	// root of the archive, see sanitizer.SanitizeLinkTarget, or through the links seen before, see
+	// safearchive.SymlinkSet.AddLink.
+	// This feature is part of MaximumSecurityMode.
+	SanitizeSymlinkTargets SecurityMode = 16
+	// SanitizeUnicode strips the characters used to disguise names in listings from the names of
+	// the entries, see sanitizer.IsUnsafeRune.
+	// This feature is part of MaximumSecurityMode.
+	SanitizeUnicode SecurityMode = 32
+	// ValidateNameEncoding checks that the names of the entries are valid UTF-8 without NUL
+	// bytes, as set by the NameEncodingPolicy of the Reader (see SetNameEncodingPolicy).
+	// This feature is part of MaximumSecurityMode.
+	ValidateNameEncoding SecurityMode = 64
+	// StrictMode makes Next fail with a typed error (e.g. ErrPathTraversal) instead of silently
+	// skipping or rewriting entries flagged by the other security features.
+	// This feature is not enabled by default, nor is it part of MaximumSecurityMode.
+	StrictMode SecurityMode = 128
+)
+
+// MaximumSecurityMode enables all features for maximum security.
+const MaximumSecurityMode = SanitizeFilenames | PreventSymlinkTraversal | SanitizeFileMode | SkipSpecialFiles | SanitizeSymlinkTargets | SanitizeUnicode | ValidateNameEncoding
+
+var securityModeNames = []struct {
+	mode SecurityMode
+	name string
+}{
+	{SanitizeFilenames, "SanitizeFilenames"},
+	{PreventSymlinkTraversal, "PreventSymlinkTraversal"},
+	{SanitizeFileMode, "SanitizeFileMode"},
+	{SkipSpecialFiles, "SkipSpecialFiles"},
+	{SanitizeSymlinkTargets, "SanitizeSymlinkTargets"},
+	{SanitizeUnicode, "SanitizeUnicode"},
+	{ValidateNameEncoding, "ValidateNameEncoding"},
+	{StrictMode, "StrictMode"},
+}
+
+// options are the names of the configurable behaviors of the Reader, registered as features.
+var options = []string{
+	"MaxEntries",
+	"MaxEntrySize",
+	"MaxTotalSize",
+	"NameEncodingPolicy",
+}
+
+func init() {
+	safearchive.RegisterFeatures(safearchive.Feature{Package: "cpio", Kind: safearchive.FeatureFormat, Name: "cpio"})
+	for _, m := range securityModeNames {
+		safearchive.RegisterFeatures(safearchive.Feature{Package: "cpio", Kind: safearchive.FeatureRule, Name: m.name})
+	}
+	for _, o := range options {
+		safearchive.RegisterFeatures(safearchive.Feature{Package: "cpio", Kind: safearchive.FeatureOption, Name: o})
+	}
+}
+
+// String returns the names of the enabled features separated by |.
+func (s SecurityMode) String() string {
+	var names []string
+	for _, m := range securityModeNames {
+		if s&m.mode != 0 {
+			names = append(names, m.name)
+			s &^= m.mode
+		}
+	}
+	if s != 0 {
+		names = append(names, fmt.Sprintf("%#x", int(s)))
+	}
+	if len(names) == 0 {
+		return "0"
+	}
+	return strings.Join(names, "|")
+}
+
+// Reader provides sequential access to the entries of a cpio archive. Reader.Next advances to the
+// next entry (including the first), and then Reader can be treated as an io.Reader to access the
+// data of the entry.
+type Reader struct {
+	r            io.Reader
+	securityMode SecurityMode
+	encoding     safearchive.NameEncodingPolicy
+	maxEntrySize int64
+	maxTotalSize int64
+	maxEntries   int
+
+	// err is the sticky error of an invalid header, an exceeded limit or the end of the archive.
+	err error
+	// entries and totalSize are the number and the total size of the entries read so far,
+	// including the skipped ones.
+	entries   int
+	totalSize int64
+	symlinks  safearchive.SymlinkSet
+	targets   safearchive.SymlinkSet
+
+	// pos is the position in the archive, and remaining and pad the number of bytes of the data
+	// and of the padding of the current entry not read yet.
+	pos, remaining, pad int64
+	// offset and name are the position and the original name of the current entry.
+	offset int64
+	name   string
+
+	findings []safearchive.Finding
+}
+
+// NewReader creates a new Reader reading from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r, securityMode: DefaultSecurityMode}
+}
+
+// SetSecurityMode controls the security features applied when reading this archive
+func (cr *Reader) SetSecurityMode(s SecurityMode) {
+	cr.securityMode = s
+}
+
+// GetSecurityMode returns the currently enabled security features
+func (cr *Reader) GetSecurityMode() SecurityMode {
+	return cr.securityMode
+}
+
+// SetNameEncodingPolicy controls what ValidateNameEncoding does with the names that are not valid
+// UTF-8 or have NUL bytes. By default (safearchive.NameEncodingReplace) the invalid bytes are
+// replaced with U+FFFD.
+func (cr *Reader) SetNameEncodingPolicy(p safearchive.NameEncodingPolicy) {
+	cr.encoding = p
+}
+
+// SetMaxEntrySize limits the size of the entries of the archive. Next fails with an error wrapping
+// ErrLimitExceeded when an entry declares a larger size. Zero (the default) means no limit.
+func (cr *Reader) SetMaxEntrySize(n int64) {
+	cr.maxEntrySize = n
+}
+
+// SetMaxTotalSize limits the total size of the entries of the archive, including the ones skipped
+// by the security features. Next fails with an error wrapping ErrLimitExceeded when an entry would
+// exceed the limit. Zero (the default) means no limit.
+func (cr *Reader) SetMaxTotalSize(n int64) {
+	cr.maxTotalSize = n
+}
+
+// SetMaxEntries limits the number of entries of the archive, including the ones skipped by the
+// security features. Next fails with an error wrapping ErrLimitExceeded when the archive has more
+// entries. Zero (the default) means no limit.
+func (cr *Reader) SetMaxEntries(n int) {
+	cr.maxEntries = n
+}
+
+// Report returns the findings about the entries read so far: every entry that was renamed,
+// sanitized or dropped, along with the reason code of the security feature that flagged it.
+func (cr *Reader) Report() *safearchive.Report {
+	return &safearchive.Report{Findings: append([]safearchive.Finding{}, cr.findings...)}
+}
+
+// flag records a finding about the current entry.
+func (cr *Reader) flag(v safearchive.Verdict) safearchive.Finding {
+	f := safearchive.Finding{Name: cr.name, Offset: cr.offset, Reason: v.Reason, Action: v.Action, Detail: v.Detail}
+	cr.findings = append(cr.findings, f)
+	return f
+}
+
+// Next advances to the next entry of the archive. io.EOF is returned at the trailer of the
+// archive; the data following it is not read. Other errors are *safearchive.EntryError values
+// telling which entry failed (e.g. wrapping ErrHeader, ErrLimitExceeded or a rejection of
+// StrictMode). Once the archive had an invalid header or exceeded a limit, Next keeps returning
+// the same error.
+func (cr *Reader) Next() (*Header, error) {
+	if cr.err != nil {
+		return nil, cr.err
+	}
+	h, err := cr.next()
+	if err != nil {
+		if _, ok := err.(*safearchive.EntryError); !ok && err != io.EOF {
+			err = &safearchive.EntryError{Name: cr.name, Offset: cr.offset, Err: err}
+		}
+		cr.remaining, cr.pad = 0, 0
+		cr.err = err
+	}
+	return h, err
+}
+
+func (cr *Reader) next() (*Header, error) {
+	for {
+		if err := cr.skip(cr.remaining + cr.pad); err != nil {
+			return nil, err
+		}
+		cr.remaining, cr.pad = 0, 0
+		cr.offset, cr.name = cr.pos, ""
+		var b [headerLen]byte
+		if _, err := io.ReadFull(cr.r, b[:]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		cr.pos += headerLen
+		h, nameLen, err := parseHeader(b[:])
+		if err != nil {
+			return nil, err
+		}
+		name := make([]byte, nameLen+pad4(headerLen+nameLen))
+		if _, err := io.ReadFull(cr.r, name); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		cr.pos += int64(len(name))
+		if name[nameLen-1] != 0 {
+			return nil, fmt.Errorf("%w: unterminated name", ErrHeader)
+		}
+		h.Name = string(name[:nameLen-1])
+		cr.name = h.Name
+		if h.Name == trailer {
+			return nil, io.EOF
+		}
+		if h.Name == "" {
+			return nil, fmt.Errorf("%w: empty name", ErrHeader)
+		}
+		cr.remaining, cr.pad = h.Size, pad4(h.Size)
+		if err := cr.checkLimits(h); err != nil {
+			return nil, err
+		}
+		if h.Mode&TypeMask == TypeSymlink {
+			if err := cr.readLinkname(h); err != nil {
+				return nil, err
+			}
+		}
+		if (h.Name == "." || h.Name == "./") && cr.securityMode&SanitizeFilenames != 0 {
+			// the root directory, skipped without a finding
+			continue
+		}
+		start := len(cr.findings)
+		keep, err := cr.applyRules(h)
+		if err != nil {
+			return nil, err
+		}
+		if !keep {
+			continue
+		}
+		if h.Name != cr.name {
+			for i := start; i < len(cr.findings); i++ {
+				cr.findings[i].NewName = h.Name
+			}
+		}
+		return h, nil
+	}
+}
+
+// parseHeader parses a header, and returns it along with the length of the name following it,
+// including the terminating NUL.
+func parseHeader(b []byte) (*Header, int64, error) {
+	switch magic := string(b[:6]); magic {
+	case Magic, CRCMagic:
+	case "070707":
+		return nil, 0, fmt.Errorf("%w: unsupported odc format", ErrHeader)
+	default:
+		return nil, 0, fmt.Errorf("%w: bad magic %q", ErrHeader, magic)
+	}
+	var fields [13]int64
+	for i := range fields {
+		s := string(b[6+8*i : 14+8*i])
+		n, err := strconv.ParseUint(s, 16, 32)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: bad number %q", ErrHeader, s)
+		}
+		fields[i] = int64(n)
+	}
+	h := &Header{
+		Inode:    fields[0],
+		Mode:     fields[1],
+		Uid:      int(fields[2]),
+		Gid:      int(fields[3]),
+		Nlink:    int(fields[4]),
+		ModTime:  time.Unix(fields[5], 0),
+		Size:     fields[6],
+		Devmajor: fields[9],
+		Devminor: fields[10],
+		Checksum: uint32(fields[12]),
+	}
+	nameLen := fields[11]
+	if nameLen == 0 || nameLen > maxNameLen {
+		return nil, 0, fmt.Errorf("%w: name of %d bytes", ErrHeader, nameLen)
+	}
+	return h, nameLen, nil
+}
+
+// readLinkname reads the target of the symbolic link h from its data.
+func (cr *Reader) readLinkname(h *Header) error {
+	if h.Size == 0 || h.Size > maxNameLen {
+		return fmt.Errorf("%w: symbolic link target of %d bytes", ErrHeader, h.Size)
+	}
+	b := make([]byte, h.Size)
+	if _, err := io.ReadFull(cr, b); err != nil {
+		return unexpectedEOF(err)
+	}
+	h.Linkname, h.Size = string(b), 0
+	return nil
+}
+
+// checkLimits accounts h against the limits of the reader, and returns the error to fail Next with
+// if it exceeds one of them.
+func (cr *Reader) checkLimits(h *Header) error {
+	cr.entries++
+	var detail string
+	switch {
+	case cr.maxEntries > 0 && cr.entries > cr.maxEntries:
+		detail = fmt.Sprintf("archive has more than %d entries", cr.maxEntries)
+	case cr.maxEntrySize > 0 && h.Size > cr.maxEntrySize:
+		detail = fmt.Sprintf("entry declares %d bytes, the limit is %d", h.Size, cr.maxEntrySize)
+	case cr.maxTotalSize > 0 && h.Size > cr.maxTotalSize-cr.totalSize:
+		detail = fmt.Sprintf("entries declare more than %d bytes in total", cr.maxTotalSize)
+	}
+	cr.totalSize += h.Size
+	if detail == "" {
+		return nil
+	}
+	f := cr.flag(safearchive.Verdict{Action: safearchive.ActionRejected, Reason: safearchive.ReasonLimitExceeded, Detail: detail})
+	return f.Err(ErrLimitExceeded)
+}
+
+// applyRules applies the security features on h, until one of them drops or rejects it. It
+// reports whether the entry is to be kept.
+func (cr *Reader) applyRules(h *Header) (bool, error) {
+	names := safearchive.NameChecks{
+		ValidateEncoding: cr.securityMode&ValidateNameEncoding != 0,
+		Encoding:         cr.encoding,
+		SanitizeUnicode:  cr.securityMode&SanitizeUnicode != 0,
+		SanitizePath:     cr.securityMode&SanitizeFilenames != 0,
+	}
+	rules := append(names.Rules(&h.Name),
+		func() safearchive.Verdict { return cr.preventSymlinkTraversal(h) },
+		func() safearchive.Verdict { return cr.sanitizeSymlinkTargets(h) },
+		func() safearchive.Verdict { return cr.skipSpecialFiles(h) },
+		func() safearchive.Verdict { return cr.sanitizeFileMode(h) },
+	)
+	return safearchive.ApplyRules(rules, cr.securityMode&StrictMode != 0, cr.flag)
+}
+
+func (cr *Reader) preventSymlinkTraversal(h *Header) safearchive.Verdict {
+	if cr.securityMode&PreventSymlinkTraversal == 0 {
+		return safearchive.Pass
+	}
+	name := strings.TrimSuffix(filepath.ToSlash(sanitizer.SanitizePath(h.Name)), "/")
+	if cr.symlinks.Covers(name) {
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonSymlinkTraversal}
+	}
+	if h.Mode&TypeMask == TypeSymlink {
+		cr.symlinks.Add(name)
+	}
+	return safearchive.Pass
+}
+
+func (cr *Reader) sanitizeSymlinkTargets(h *Header) safearchive.Verdict {
+	if cr.securityMode&SanitizeSymlinkTargets == 0 || h.Mode&TypeMask != TypeSymlink {
+		return safearchive.Pass
+	}
+	if sanitizer.SanitizeLinkTarget(h.Name, h.Linkname) != h.Linkname {
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonSymlinkTarget, Detail: "target " + h.Linkname}
+	}
+	name := strings.TrimSuffix(filepath.ToSlash(sanitizer.SanitizePath(h.Name)), "/")
+	if !cr.targets.AddLink(name, filepath.ToSlash(h.Linkname)) {
+		// the target escapes through the links seen before, or makes one of them escape
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonSymlinkTarget, Detail: "target " + h.Linkname + " escapes through other links"}
+	}
+	return safearchive.Pass
+}
+
+func (cr *Reader) skipSpecialFiles(h *Header) safearchive.Verdict {
+	if cr.securityMode&SkipSpecialFiles == 0 {
+		return safearchive.Pass
+	}
+	switch h.Mode & TypeMask {
+	case TypeBlock, TypeChar, TypeFifo, TypeSocket:
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonSpecialFile}
+	}
+	return safearchive.Pass
+}
+
+func (cr *Reader) sanitizeFileMode(h *Header) safearchive.Verdict {
+	const special = 07000
+	if cr.securityMode&SanitizeFileMode == 0 || h.Mode&special == 0 {
+		return safearchive.Pass
+	}
+	v := safearchive.Verdict{Action: safearchive.ActionModified, Reason: safearchive.ReasonSpecialMode, Detail: fmt.Sprintf("mode %o changed to %o", h.Mode, h.Mode&^special)}
+	h.Mode &^= special
+	return v
+}
+
+// Read reads from the current entry of the archive. It returns (0, io.EOF) when it reaches the end
+// of that entry, until Next is called to advance to the next entry.
+//
+// Errors other than io.EOF are *safearchive.EntryError values about the current entry.
+func (cr *Reader) Read(b []byte) (int, error) {
+	if cr.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > cr.remaining {
+		b = b[:cr.remaining]
+	}
+	n, err := cr.r.Read(b)
+	cr.remaining -= int64(n)
+	cr.pos += int64(n)
+	if err == io.EOF && cr.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil && err != io.EOF {
+		err = &safearchive.EntryError{Name: cr.name, Offset: cr.offset, Err: err}
+	}
+	return n, err
+}
+
+// skip discards n bytes of the archive.
+func (cr *Reader) skip(n int64) error {
+	if n == 0 {
+		return nil
+	}
+	k, err := io.CopyN(io.Discard, cr.r, n)
+	cr.pos += k
+	return unexpectedEOF(err)
+}
+
+// pad4 returns the number of bytes padding n bytes to a multiple of 4.
+func pad4(n int64) int64 {
+	return -n & 3
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
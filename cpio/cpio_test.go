@@ -0,0 +1,229 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cpio
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/safearchive"
+)
+
+type entry struct {
+	name string
+	mode int64
+	data string
+}
+
+// archive returns a newc archive of the entries, terminated by a trailer.
+func archive(entries ...entry) []byte {
+	var buf bytes.Buffer
+	for i, e := range append(entries, entry{name: trailer}) {
+		mode := e.mode
+		if mode == 0 {
+			mode = TypeReg | 0644
+		}
+		fmt.Fprintf(&buf, "%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x", Magic, i+1, mode, 1000, 1000, 1, 1700000000, len(e.data), 0, 0, 0, 0, len(e.name)+1, 0)
+		buf.WriteString(e.name + "\x00")
+		buf.Write(make([]byte, pad4(int64(buf.Len()))))
+		buf.WriteString(e.data)
+		buf.Write(make([]byte, pad4(int64(buf.Len()))))
+	}
+	return buf.Bytes()
+}
+
+// read returns the names and contents (or link targets) of the entries of the archive.
+func read(t *testing.T, r *Reader) (map[string]string, error) {
+	t.Helper()
+	re := map[string]string{}
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			return re, nil
+		}
+		if err != nil {
+			return re, err
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return re, err
+		}
+		if int64(len(b)) != h.Size {
+			t.Errorf("%q has %d bytes, want %d", h.Name, len(b), h.Size)
+		}
+		if h.Linkname != "" {
+			b = []byte("-> " + h.Linkname)
+		}
+		re[h.Name] = string(b)
+	}
+}
+
+func TestReader(t *testing.T) {
+	a := archive(
+		entry{name: ".", mode: TypeDir | 0755},
+		entry{name: "./usr", mode: TypeDir | 0755},
+		entry{name: "./usr/bin/hello", mode: TypeReg | 0755, data: "hello"},
+		entry{name: "./usr/bin/hi", mode: TypeSymlink | 0777, data: "hello"},
+		entry{name: "./usr/share/doc/hello/README", data: "read me"},
+	)
+	r := NewReader(bytes.NewReader(append(a, "garbage after the trailer"...)))
+	r.SetSecurityMode(SanitizeFilenames | PreventSymlinkTraversal)
+	got, err := read(t, r)
+	if err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	want := map[string]string{
+		"usr":                        "",
+		"usr/bin/hello":              "hello",
+		"usr/bin/hi":                 "-> hello",
+		"usr/share/doc/hello/README": "read me",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %q, want %q", got, want)
+	}
+	if f := r.Report().Findings; len(f) != 0 {
+		t.Errorf("Report() = %v, want no findings", f)
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("Next() after the trailer error = %v, want %v", err, io.EOF)
+	}
+}
+
+func TestSecurityModes(t *testing.T) {
+	a := archive(
+		entry{name: "../../etc/cron.d/evil", data: "evil"},
+		entry{name: "/abs", data: "abs"},
+		entry{name: "link", mode: TypeSymlink | 0777, data: "/etc"},
+		entry{name: "link/passwd", data: "through the link"},
+		entry{name: "dev/null", mode: TypeChar | 0666},
+		entry{name: "suid", mode: TypeReg | 04755, data: "suid"},
+		entry{name: "bidi‮.txt", data: "bidi"},
+	)
+
+	r := NewReader(bytes.NewReader(a))
+	r.SetSecurityMode(SanitizeFilenames | PreventSymlinkTraversal)
+	got, err := read(t, r)
+	if err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	want := map[string]string{"etc/cron.d/evil": "evil", "abs": "abs", "link": "-> /etc", "dev/null": "", "suid": "suid", "bidi‮.txt": "bidi"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %q, want %q", got, want)
+	}
+	var reasons []safearchive.Reason
+	for _, f := range r.Report().Findings {
+		reasons = append(reasons, f.Reason)
+	}
+	wantReasons := []safearchive.Reason{safearchive.ReasonPathTraversal, safearchive.ReasonAbsolutePath, safearchive.ReasonSymlinkTraversal}
+	if !reflect.DeepEqual(reasons, wantReasons) {
+		t.Errorf("Report() reasons = %q, want %q", reasons, wantReasons)
+	}
+
+	r = NewReader(bytes.NewReader(a))
+	r.SetSecurityMode(MaximumSecurityMode)
+	if got, err = read(t, r); err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	// the link is skipped, and the entries below it as well
+	want = map[string]string{"etc/cron.d/evil": "evil", "abs": "abs", "suid": "suid", "bidi.txt": "bidi"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("entries in MaximumSecurityMode = %q, want %q", got, want)
+	}
+
+	r = NewReader(bytes.NewReader(a))
+	r.SetSecurityMode(MaximumSecurityMode | StrictMode)
+	if _, err := read(t, r); !errors.Is(err, safearchive.ErrPathTraversal) {
+		t.Errorf("Next() in StrictMode error = %v, want %v", err, safearchive.ErrPathTraversal)
+	}
+
+	r = NewReader(bytes.NewReader(archive(entry{name: "suid", mode: TypeReg | 04755, data: "suid"})))
+	r.SetSecurityMode(SanitizeFileMode)
+	h, err := r.Next()
+	if err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	if h.Mode != TypeReg|0755 {
+		t.Errorf("Mode = %o, want %o", h.Mode, TypeReg|0755)
+	}
+}
+
+func TestSanitizeUnicodeTraversal(t *testing.T) {
+	r := NewReader(bytes.NewReader(archive(entry{name: ".\u200b./.\u200b./etc/passwd", data: "evil"})))
+	r.SetSecurityMode(MaximumSecurityMode)
+	got, err := read(t, r)
+	if err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	if want := map[string]string{"etc/passwd": "evil"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %q, want %q", got, want)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	a := archive(entry{name: "a", data: "aaaa"}, entry{name: "b", data: "bbbb"}, entry{name: "c", data: "cccc"})
+	tests := []struct {
+		name string
+		set  func(r *Reader)
+	}{
+		{name: "entries", set: func(r *Reader) { r.SetMaxEntries(2) }},
+		{name: "entry size", set: func(r *Reader) { r.SetMaxEntrySize(3) }},
+		{name: "total size", set: func(r *Reader) { r.SetMaxTotalSize(10) }},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := NewReader(bytes.NewReader(a))
+			tc.set(r)
+			_, err := read(t, r)
+			if !errors.Is(err, ErrLimitExceeded) {
+				t.Errorf("Next() error = %v, want %v", err, ErrLimitExceeded)
+			}
+			if _, again := r.Next(); again != err {
+				t.Errorf("Next() after a failure error = %v, want %v", again, err)
+			}
+		})
+	}
+}
+
+func TestInvalidArchives(t *testing.T) {
+	valid := archive(entry{name: "a", data: "aaaa"})
+	tests := []struct {
+		name    string
+		archive []byte
+		wantErr error
+	}{
+		{name: "empty", archive: nil, wantErr: io.ErrUnexpectedEOF},
+		{name: "not cpio", archive: []byte(strings.Repeat("PK\x03\x04", 40)), wantErr: ErrHeader},
+		{name: "odc", archive: []byte("070707" + strings.Repeat("0", 120)), wantErr: ErrHeader},
+		{name: "bad number", archive: []byte(strings.Replace(string(valid), "00000001", "0000000g", 1)), wantErr: ErrHeader},
+		{name: "unterminated name", archive: []byte(strings.Replace(string(valid), "a\x00", "ab", 1)), wantErr: ErrHeader},
+		{name: "symlink without target", archive: archive(entry{name: "link", mode: TypeSymlink | 0777}), wantErr: ErrHeader},
+		{name: "no trailer", archive: valid[:112+4], wantErr: io.ErrUnexpectedEOF},
+		{name: "truncated header", archive: valid[:50], wantErr: io.ErrUnexpectedEOF},
+		{name: "truncated data", archive: valid[:114], wantErr: io.ErrUnexpectedEOF},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := read(t, NewReader(bytes.NewReader(tc.archive)))
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("Next() error = %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
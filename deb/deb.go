@@ -0,0 +1,258 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package deb reads Debian binary packages (.deb), so package inspection services do not need to
+// shell out to dpkg-deb.
+//
+// A package is an ar archive (read with the ar package) holding the version of the format (debian-binary), the control
+// tarball (the control file and the maintainer scripts) and the data tarball (the files installed
+// by the package), in this order. Their members are exposed through the safearchive tar readers,
+// so their security features apply, after being decompressed with the limits of the Options:
+//
+//	r, err := deb.NewReader(f, deb.Options{})
+//	if err != nil {
+//		return err
+//	}
+//	defer r.Close()
+//	control, err := r.Control()
+//	...
+//	data, err := r.Data()
+//
+// The package is read sequentially, so the control tarball must be read before the data tarball.
+package deb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/ar"
+	"github.com/google/safearchive/decompress"
+	"github.com/google/safearchive/tar"
+)
+
+// ErrFormat is wrapped by the errors of reading a file that is not a valid Debian binary package.
+var ErrFormat = errors.New("deb: invalid package")
+
+// maxVersionLen is the maximum size of the debian-binary member.
+const maxVersionLen = 64
+
+// codecs are the names of the decompress codecs of the extensions of the tarballs. The codecs of
+// xz, zstd and lzma need to be registered with the decompress package.
+var codecs = map[string]string{
+	"":      "",
+	".gz":   "gzip",
+	".bz2":  "bzip2",
+	".xz":   "xz",
+	".zst":  "zstd",
+	".lzma": "lzma",
+}
+
+func init() {
+	safearchive.RegisterFeatures(safearchive.Feature{Package: "deb", Kind: safearchive.FeatureFormat, Name: "deb"})
+}
+
+// Default limits of the readers of the tarballs, see Options. Legitimate packages stay far below
+// them.
+const (
+	DefaultMaxEntries   = 1 << 20
+	DefaultMaxEntrySize = 16 << 30
+	DefaultMaxTotalSize = 64 << 30
+)
+
+// Options configures the readers of the tarballs of a package. The zero value uses the default
+// settings of the readers, and the default limits.
+type Options struct {
+	// TarSecurityMode is the security mode of the tar readers. tar.DefaultSecurityMode is used if
+	// not set.
+	TarSecurityMode tar.SecurityMode
+	// MaxChildren limits the number of children per directory. No limit is applied if not set.
+	MaxChildren int
+	// MaxEntries, MaxEntrySize and MaxTotalSize are the limits of each tar reader, see
+	// tar.Reader.SetMaxEntries. DefaultMaxEntries, DefaultMaxEntrySize and DefaultMaxTotalSize are
+	// used if not set; negative values apply no limit.
+	MaxEntries   int
+	MaxEntrySize int64
+	MaxTotalSize int64
+	// DecompressLimits are the limits of the decompression of each tarball.
+	// decompress.DefaultLimits are used if not set; &decompress.Limits{} applies no limits.
+	DecompressLimits *decompress.Limits
+}
+
+// Reader reads the members of a Debian binary package.
+type Reader struct {
+	ar      *ar.Reader
+	opts    Options
+	version string
+	// next is the prefix of the name of the next tarball to read, or empty once both were read.
+	next string
+	// closer closes the decompressor of the current tarball, if any.
+	closer io.Closer
+}
+
+// NewReader returns a reader of the package read from r. It reads the version of the format,
+// which must be 2.x.
+func NewReader(r io.Reader, opts Options) (*Reader, error) {
+	a := ar.NewReader(r)
+	h, err := a.Next()
+	if err == io.EOF || err == nil && h.Name != "debian-binary" {
+		return nil, fmt.Errorf("%w: debian-binary is not the first member", ErrFormat)
+	}
+	if err != nil {
+		return nil, formatError(err)
+	}
+	if h.Size > maxVersionLen {
+		return nil, fmt.Errorf("%w: debian-binary of %d bytes", ErrFormat, h.Size)
+	}
+	b, err := io.ReadAll(a)
+	if err != nil {
+		return nil, err
+	}
+	version := strings.TrimSuffix(string(b), "\n")
+	if !strings.HasPrefix(version, "2.") {
+		return nil, fmt.Errorf("%w: unsupported format version %q", ErrFormat, version)
+	}
+	return &Reader{ar: a, opts: opts, version: version, next: "control.tar"}, nil
+}
+
+// Version returns the version of the format of the package, e.g. "2.0".
+func (r *Reader) Version() string {
+	return r.version
+}
+
+// Control returns a reader of the control tarball. It fails once Data was called.
+func (r *Reader) Control() (*tar.Reader, error) {
+	if r.next != "control.tar" {
+		return nil, errors.New("deb: the control tarball was skipped already")
+	}
+	return r.tarball()
+}
+
+// Data returns a reader of the data tarball, skipping the control tarball if it was not read. It
+// fails if it was called already.
+func (r *Reader) Data() (*tar.Reader, error) {
+	switch r.next {
+	case "control.tar":
+		if _, err := r.member("control.tar"); err != nil {
+			return nil, err
+		}
+		r.next = "data.tar"
+	case "":
+		return nil, errors.New("deb: the data tarball was read already")
+	}
+	return r.tarball()
+}
+
+// tarball returns a reader of the next tarball.
+func (r *Reader) tarball() (*tar.Reader, error) {
+	name, err := r.member(r.next)
+	if err != nil {
+		return nil, err
+	}
+	codec, ok := codecs[strings.TrimPrefix(name, r.next)]
+	if !ok {
+		return nil, fmt.Errorf("%w: unexpected member %q", ErrFormat, name)
+	}
+	if r.next == "control.tar" {
+		r.next = "data.tar"
+	} else {
+		r.next = ""
+	}
+	var tr *tar.Reader
+	if codec == "" {
+		tr = tar.NewReader(r.ar)
+	} else {
+		c, ok := decompress.Lookup(codec)
+		if !ok {
+			return nil, fmt.Errorf("%w %q of %s", decompress.ErrUnknownCodec, codec, name)
+		}
+		l := decompress.DefaultLimits
+		if r.opts.DecompressLimits != nil {
+			l = *r.opts.DecompressLimits
+		}
+		d, err := decompress.NewReader(r.ar, c, l)
+		if err != nil {
+			return nil, err
+		}
+		r.closer = d
+		tr = tar.NewReader(d)
+	}
+	if r.opts.TarSecurityMode != 0 {
+		tr.SetSecurityMode(r.opts.TarSecurityMode)
+	}
+	tr.SetMaxChildren(r.opts.MaxChildren)
+	tr.SetMaxEntries(orDefault(r.opts.MaxEntries, DefaultMaxEntries))
+	tr.SetMaxEntrySize(orDefault64(r.opts.MaxEntrySize, DefaultMaxEntrySize))
+	tr.SetMaxTotalSize(orDefault64(r.opts.MaxTotalSize, DefaultMaxTotalSize))
+	return tr, nil
+}
+
+// orDefault returns n, or def if n is not set.
+func orDefault(n, def int) int {
+	if n == 0 {
+		return def
+	}
+	return n
+}
+
+// orDefault64 returns n, or def if n is not set.
+func orDefault64(n, def int64) int64 {
+	if n == 0 {
+		return def
+	}
+	return n
+}
+
+// member advances to the member whose name starts with prefix, skipping the members whose name
+// starts with an underscore (e.g. signatures), and returns its name.
+func (r *Reader) member(prefix string) (string, error) {
+	if err := r.Close(); err != nil {
+		return "", err
+	}
+	for {
+		h, err := r.ar.Next()
+		if err == io.EOF {
+			return "", fmt.Errorf("%w: no %s member", ErrFormat, prefix)
+		}
+		if err != nil {
+			return "", formatError(err)
+		}
+		if strings.HasPrefix(h.Name, prefix) {
+			return h.Name, nil
+		}
+		if !strings.HasPrefix(h.Name, "_") {
+			return "", fmt.Errorf("%w: unexpected member %q", ErrFormat, h.Name)
+		}
+	}
+}
+
+// formatError returns err, wrapping ErrFormat as well if the ar archive is invalid.
+func formatError(err error) error {
+	if errors.Is(err, ar.ErrHeader) {
+		return fmt.Errorf("%w: %w", ErrFormat, err)
+	}
+	return err
+}
+
+// Close closes the decompressor of the current tarball. It does not close the underlying reader.
+func (r *Reader) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	err := r.closer.Close()
+	r.closer = nil
+	return err
+}
@@ -0,0 +1,221 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deb
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/google/safearchive/ar"
+	"github.com/google/safearchive/decompress"
+	"github.com/google/safearchive/internal/archivetest"
+	star "github.com/google/safearchive/tar"
+)
+
+type member struct {
+	name string
+	data []byte
+}
+
+// arArchive returns an ar archive of the members.
+func arArchive(members ...member) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(ar.Magic)
+	for _, m := range members {
+		fmt.Fprintf(&buf, "%-16s%-12d%-6d%-6d%-8o%-10d`\n", m.name+"/", 0, 0, 0, 0644, len(m.data))
+		buf.Write(m.data)
+		if len(m.data)%2 == 1 {
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+// tarball returns a tarball of regular files named after their content, gzip compressed if gz is
+// set.
+func tarball(t *testing.T, gz bool, names ...string) []byte {
+	t.Helper()
+	var entries []archivetest.Entry
+	for _, name := range names {
+		entries = append(entries, archivetest.Entry{Name: name, Content: []byte(name)})
+	}
+	b := archivetest.Tar(t, entries)
+	if gz {
+		b = archivetest.Gzip(t, b)
+	}
+	return b
+}
+
+// names returns the names of the entries of tr, checking their contents.
+func names(t *testing.T, tr *star.Reader) []string {
+	t.Helper()
+	var re []string
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return re
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		re = append(re, h.Name)
+		if b, err := io.ReadAll(tr); err != nil || len(b) != int(h.Size) {
+			t.Errorf("ReadAll(%q) = %q, %v", h.Name, b, err)
+		}
+	}
+}
+
+func TestReader(t *testing.T) {
+	pkg := arArchive(
+		member{"debian-binary", []byte("2.0\n")},
+		member{"control.tar.gz", tarball(t, true, "./control", "./postinst")},
+		member{"_gpgbuilder", []byte("signature")},
+		member{"data.tar", tarball(t, false, "./usr/bin/hello", "../../etc/passwd")},
+	)
+
+	r, err := NewReader(bytes.NewReader(pkg), Options{})
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	if got, want := r.Version(), "2.0"; got != want {
+		t.Errorf("Version() = %q, want %q", got, want)
+	}
+	control, err := r.Control()
+	if err != nil {
+		t.Fatalf("Control() error = %v", err)
+	}
+	if got, want := names(t, control), []string{"control", "postinst"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Control() entries = %q, want %q", got, want)
+	}
+	data, err := r.Data()
+	if err != nil {
+		t.Fatalf("Data() error = %v", err)
+	}
+	if got, want := names(t, data), []string{"usr/bin/hello", "etc/passwd"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Data() entries = %q, want %q", got, want)
+	}
+	if _, err := r.Data(); err == nil {
+		t.Errorf("Data() called twice succeeded, want error")
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+
+	// skipping the control tarball
+	r, err = NewReader(bytes.NewReader(pkg), Options{})
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	if data, err = r.Data(); err != nil {
+		t.Fatalf("Data() error = %v", err)
+	}
+	if got := names(t, data); len(got) != 2 {
+		t.Errorf("Data() entries = %q, want 2", got)
+	}
+	if _, err := r.Control(); err == nil {
+		t.Errorf("Control() after Data() succeeded, want error")
+	}
+}
+
+func TestDecompressLimits(t *testing.T) {
+	pkg := arArchive(
+		member{"debian-binary", []byte("2.0\n")},
+		member{"control.tar.gz", tarball(t, true, "./control")},
+		member{"data.tar.gz", tarball(t, true, "./usr/share/big")},
+	)
+	r, err := NewReader(bytes.NewReader(pkg), Options{DecompressLimits: &decompress.Limits{MaxOutputSize: 1024}})
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	data, err := r.Data()
+	if err != nil {
+		t.Fatalf("Data() error = %v", err)
+	}
+	for err == nil {
+		_, err = data.Next()
+	}
+	if !errors.Is(err, decompress.ErrLimitExceeded) {
+		t.Errorf("Next() error = %v, want %v", err, decompress.ErrLimitExceeded)
+	}
+}
+
+func TestDefaultLimits(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	// only the header of the entry, declaring more than DefaultMaxEntrySize
+	tw.WriteHeader(&tar.Header{Name: "./huge", Typeflag: tar.TypeReg, Mode: 0644, Size: DefaultMaxEntrySize + 1})
+	pkg := arArchive(
+		member{"debian-binary", []byte("2.0\n")},
+		member{"control.tar", tarball(t, false, "./control")},
+		member{"data.tar", buf.Bytes()},
+	)
+	for _, tc := range []struct {
+		opts    Options
+		limited bool
+	}{
+		{Options{}, true},
+		{Options{MaxEntrySize: -1}, false},
+	} {
+		r, err := NewReader(bytes.NewReader(pkg), tc.opts)
+		if err != nil {
+			t.Fatalf("NewReader() error = %v", err)
+		}
+		data, err := r.Data()
+		if err != nil {
+			t.Fatalf("Data() error = %v", err)
+		}
+		_, err = data.Next()
+		if limited := errors.Is(err, star.ErrLimitExceeded); limited != tc.limited {
+			t.Errorf("Next() with MaxEntrySize %d error = %v, want limit exceeded %v", tc.opts.MaxEntrySize, err, tc.limited)
+		}
+	}
+}
+
+func TestInvalidPackages(t *testing.T) {
+	version := member{"debian-binary", []byte("2.0\n")}
+	control := member{"control.tar", tarball(t, false, "./control")}
+	data := member{"data.tar", tarball(t, false, "./a")}
+	tests := []struct {
+		name    string
+		pkg     []byte
+		wantErr error
+	}{
+		{name: "not ar", pkg: []byte("not an ar archive"), wantErr: ErrFormat},
+		{name: "no version", pkg: arArchive(control, data), wantErr: ErrFormat},
+		{name: "version 3", pkg: arArchive(member{"debian-binary", []byte("3.0\n")}, control, data), wantErr: ErrFormat},
+		{name: "no control", pkg: arArchive(version, data), wantErr: ErrFormat},
+		{name: "no data", pkg: arArchive(version, control), wantErr: ErrFormat},
+		{name: "unexpected member", pkg: arArchive(version, control, member{"evil", nil}, data), wantErr: ErrFormat},
+		{name: "unknown compression", pkg: arArchive(version, control, member{"data.tar.rar", nil}), wantErr: ErrFormat},
+		{name: "unregistered codec", pkg: arArchive(version, control, member{"data.tar.lzma", nil}), wantErr: decompress.ErrUnknownCodec},
+		{name: "truncated", pkg: arArchive(version, control, data)[:200], wantErr: io.ErrUnexpectedEOF},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewReader(bytes.NewReader(tc.pkg), Options{})
+			if err == nil {
+				_, err = r.Data()
+			}
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("Data() error = %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
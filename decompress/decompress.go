@@ -0,0 +1,300 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package decompress wraps decompressors with protection against decompression bombs.
+//
+// Codecs are looked up by name or detected from the magic bytes of a stream. gzip and bzip2 are
+// built in; codecs of other formats (e.g. zstd or xz, which the standard library does not
+// implement) are plugged in by registering them, so safearchive does not depend on any particular
+// implementation:
+//
+//	decompress.Register(decompress.Codec{
+//		Name:  "zstd",
+//		Magic: decompress.ZstdMagic,
+//		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+//			zr, err := zstd.NewReader(r)
+//			if err != nil {
+//				return nil, err
+//			}
+//			return zr.IOReadCloser(), nil
+//		},
+//	})
+//
+// Readers created by NewReader enforce the same output size and expansion ratio limits regardless
+// of the codec. Reading a stream exceeding a limit fails with an error wrapping ErrLimitExceeded.
+// The zero Limits apply no limit: pass DefaultLimits unless the streams are trusted. The packages
+// decompressing archives (e.g. archive, deb, rpm and ocilayer) use DefaultLimits when their options
+// do not set limits; setting them to the zero Limits lifts the budget.
+//
+// The built-in codecs decompress concatenated streams (e.g. the multi-member gzip streams of pigz
+// and bgzf, or the bzip2 streams of pbzip2) as a single logical stream, rather than stopping at the
+// end of the first member. The limits apply to the whole logical stream.
+package decompress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/internal/limits"
+)
+
+// Magic bytes of the compression formats.
+var (
+	GzipMagic  = []byte("\x1f\x8b\x08")
+	Bzip2Magic = []byte("BZh")
+	XzMagic    = []byte("\xfd7zXZ\x00")
+	ZstdMagic  = []byte("\x28\xb5\x2f\xfd")
+)
+
+// maxMagicLen is the length of the longest magic of the registered codecs.
+var maxMagicLen int
+
+// ErrUnknownCodec is returned when no codec is registered for a name or a stream.
+var ErrUnknownCodec = errors.New("decompress: unknown codec")
+
+// Errors of streams exceeding the limits of a Reader. All of them wrap ErrLimitExceeded.
+var (
+	ErrLimitExceeded = safearchive.ErrLimitExceeded
+	ErrOutputSize    = fmt.Errorf("%w: decompressed size", ErrLimitExceeded)
+	ErrRatio         = fmt.Errorf("%w: expansion ratio", ErrLimitExceeded)
+)
+
+// Limits are the limits of decompressed data. Zero values mean no limit.
+type Limits struct {
+	// MaxOutputSize is the maximum size of the decompressed data.
+	MaxOutputSize int64
+	// MaxRatio is the maximum ratio of the decompressed and the compressed sizes. Streams
+	// decompressing to less than 1MiB are exempt.
+	MaxRatio float64
+}
+
+// DefaultLimits is the budget of the decompression of untrusted streams. Unlike DEFLATE (see
+// gzip.MaxDeflateRatio), bzip2, xz and zstd reach expansion ratios of millions, so both the ratio
+// and the decompressed size are bounded. The ratio is above the one of DEFLATE, so it does not
+// reject gzip streams. Streams above the budget need explicit, larger Limits.
+var DefaultLimits = Limits{MaxOutputSize: 16 << 30, MaxRatio: 1100}
+
+// Check returns the error of out bytes decompressed from in bytes exceeding the limits, or nil.
+func (l Limits) Check(out, in int64) error {
+	switch {
+	case l.MaxOutputSize > 0 && out > l.MaxOutputSize:
+		return fmt.Errorf("%w: more than %d bytes", ErrOutputSize, l.MaxOutputSize)
+	case l.MaxRatio > 0 && out >= limits.MinRatioSize && float64(out) > l.MaxRatio*float64(in):
+		return fmt.Errorf("%w: %d bytes decompressed from %d, the limit is %g", ErrRatio, out, in, l.MaxRatio)
+	}
+	return nil
+}
+
+// Codec is a decompressor of a compression format.
+type Codec struct {
+	// Name identifies the codec, e.g. "zstd".
+	Name string
+	// Magic are the leading bytes of the streams of the format.
+	Magic []byte
+	// NewReader returns a reader of the decompressed data of r.
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{}
+)
+
+func init() {
+	register(Codec{Name: "gzip", Magic: GzipMagic, NewReader: func(r io.Reader) (io.ReadCloser, error) {
+		// gzip.Reader reads all the members of multi-member streams (e.g. pigz and bgzf output) as
+		// one by default
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr, nil
+	}})
+	register(Codec{Name: "bzip2", Magic: Bzip2Magic, NewReader: func(r io.Reader) (io.ReadCloser, error) {
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	}})
+}
+
+// Register makes a codec available by its name and magic bytes, replacing any codec registered
+// with the same name. It also registers the codec as a safearchive.Feature.
+// In the hardened profile (see safearchive.Hardened) Register does nothing: only the built-in,
+// standard library backed codecs are available.
+func Register(c Codec) {
+	if safearchive.Hardened {
+		return
+	}
+	register(c)
+}
+
+func register(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[c.Name] = c
+	if len(c.Magic) > maxMagicLen {
+		maxMagicLen = len(c.Magic)
+	}
+	safearchive.RegisterFeatures(safearchive.Feature{Package: "decompress", Kind: safearchive.FeatureFormat, Name: c.Name})
+}
+
+// Lookup returns the codec registered with name.
+func Lookup(name string) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// Detect returns the codec whose magic bytes prefix starts with. The codec with the longest
+// matching magic wins.
+func Detect(prefix []byte) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	var names []string
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var re Codec
+	for _, name := range names {
+		c := codecs[name]
+		if len(c.Magic) > len(re.Magic) && bytes.HasPrefix(prefix, c.Magic) {
+			re = c
+		}
+	}
+	return re, re.NewReader != nil
+}
+
+// Meter enforces Limits on a decompressor. The decompressor reads the compressed data through the
+// Meter, and the decompressed data is read from the decompressor with Meter.Read.
+type Meter struct {
+	r      io.Reader
+	limits Limits
+	in     int64
+	out    int64
+	// err is the sticky error of an exceeded limit.
+	err error
+}
+
+// NewMeter returns a Meter of the compressed data of r, enforcing l.
+func NewMeter(r io.Reader, l Limits) *Meter {
+	return &Meter{r: r, limits: l}
+}
+
+// Limits returns the limits of the Meter.
+func (m *Meter) Limits() Limits {
+	return m.limits
+}
+
+// Reset discards the counts of the Meter and makes it read the compressed data from r.
+func (m *Meter) Reset(r io.Reader) {
+	m.r, m.in, m.out, m.err = r, 0, 0, nil
+}
+
+// Read reads decompressed data from d into p, enforcing the limits. Data above MaxOutputSize is
+// not returned. Once a limit was exceeded, Read keeps returning the same error.
+func (m *Meter) Read(d io.Reader, p []byte) (int, error) {
+	if m.err != nil {
+		return 0, m.err
+	}
+	if max := m.limits.MaxOutputSize; max > 0 && int64(len(p)) > max-m.out+1 {
+		// reading a single byte more than the limit is enough to tell it was exceeded
+		p = p[:max-m.out+1]
+	}
+	n, err := d.Read(p)
+	m.out += int64(n)
+	if m.err = m.limits.Check(m.out, m.in); m.err != nil {
+		if max := m.limits.MaxOutputSize; max > 0 && m.out > max {
+			n -= int(m.out - max)
+			m.out = max
+		}
+		return n, m.err
+	}
+	return n, err
+}
+
+// compressedReader is the io.Reader of the compressed data of a Meter.
+type compressedReader struct {
+	m *Meter
+}
+
+func (c compressedReader) Read(b []byte) (int, error) {
+	n, err := c.m.r.Read(b)
+	c.m.in += int64(n)
+	return n, err
+}
+
+// Compressed returns the io.Reader of the compressed data the decompressor reads from.
+func (m *Meter) Compressed() io.Reader {
+	return compressedReader{m}
+}
+
+// Reader reads decompressed data, enforcing its Limits.
+type Reader struct {
+	codec Codec
+	rc    io.ReadCloser
+	meter *Meter
+}
+
+// NewReader returns a reader of the data of r decompressed by c, with the given limits.
+func NewReader(r io.Reader, c Codec, l Limits) (*Reader, error) {
+	m := NewMeter(r, l)
+	rc, err := c.NewReader(m.Compressed())
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{codec: c, rc: rc, meter: m}, nil
+}
+
+// Open detects the codec of the data of r from its magic bytes and returns a reader of the
+// decompressed data, with the given limits. ErrUnknownCodec is returned if no registered codec
+// matches.
+func Open(r io.Reader, l Limits) (*Reader, error) {
+	codecsMu.RLock()
+	n := maxMagicLen
+	codecsMu.RUnlock()
+	br := bufio.NewReader(r)
+	prefix, err := br.Peek(n)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	c, ok := Detect(prefix)
+	if !ok {
+		return nil, ErrUnknownCodec
+	}
+	return NewReader(br, c, l)
+}
+
+// Codec returns the codec of the Reader.
+func (z *Reader) Codec() Codec {
+	return z.codec
+}
+
+// Read implements io.Reader. Once the stream exceeded a limit, Read keeps returning the same
+// error.
+func (z *Reader) Read(p []byte) (int, error) {
+	return z.meter.Read(z.rc, p)
+}
+
+// Close closes the decompressor. It does not close the underlying reader.
+func (z *Reader) Close() error {
+	return z.rc.Close()
+}
@@ -0,0 +1,181 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package decompress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/google/safearchive"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("DecodeString() error = %v", err)
+	}
+	return b
+}
+
+// "hello, world" and 10MiB of zeros, compressed with bzip2 -9.
+const (
+	helloBzip2 = "425a683931415926535942f7dd4a0000021180400406449080200031064c41007a2501c96c31f8bb9229c2848217beea50"
+	bombBzip2  = "425a6839314159265359335453790050504020c00000040008200030cc0529a60481362090278bb9229c284819aa29bc80"
+)
+
+func TestReader(t *testing.T) {
+	bzip2, ok := Lookup("bzip2")
+	if !ok {
+		t.Fatalf("Lookup(bzip2) found no codec")
+	}
+	tests := []struct {
+		name    string
+		data    string
+		limits  Limits
+		want    string
+		wantErr error
+	}{
+		{name: "no limits", data: helloBzip2, want: "hello, world"},
+		{name: "output size", data: helloBzip2, limits: Limits{MaxOutputSize: 5}, want: "hello", wantErr: ErrOutputSize},
+		{name: "exact output size", data: helloBzip2, limits: Limits{MaxOutputSize: 12}, want: "hello, world"},
+		{name: "ratio", data: bombBzip2, limits: Limits{MaxRatio: 1000}, wantErr: ErrRatio},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			zr, err := NewReader(bytes.NewReader(unhex(t, tc.data)), bzip2, tc.limits)
+			if err != nil {
+				t.Fatalf("NewReader() error = %v", err)
+			}
+			defer zr.Close()
+			got, err := io.ReadAll(zr)
+			if tc.wantErr == nil && err != nil {
+				t.Fatalf("Read() error = %v", err)
+			}
+			if tc.wantErr != nil && (!errors.Is(err, tc.wantErr) || !errors.Is(err, safearchive.ErrLimitExceeded)) {
+				t.Fatalf("Read() error = %v, want %v", err, tc.wantErr)
+			}
+			if tc.want != "" && string(got) != tc.want {
+				t.Errorf("Read() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOpen(t *testing.T) {
+	zr, err := Open(bytes.NewReader(unhex(t, helloBzip2)), Limits{})
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if got := zr.Codec().Name; got != "bzip2" {
+		t.Errorf("Codec() = %q, want bzip2", got)
+	}
+	if got, err := io.ReadAll(zr); err != nil || string(got) != "hello, world" {
+		t.Errorf("Read() = %q, %v, want %q", got, err, "hello, world")
+	}
+
+	if _, err := Open(strings.NewReader("plain text"), Limits{}); !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("Open() error = %v, want %v", err, ErrUnknownCodec)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	stream := append(append([]byte{}, ZstdMagic...), "payload"...)
+	if _, ok := Detect(stream); ok {
+		t.Fatalf("Detect() found a zstd codec before it was registered")
+	}
+	// a fake codec, stripping the magic bytes
+	Register(Codec{Name: "zstd", Magic: ZstdMagic, NewReader: func(r io.Reader) (io.ReadCloser, error) {
+		if _, err := io.ReadFull(r, make([]byte, len(ZstdMagic))); err != nil {
+			return nil, err
+		}
+		return io.NopCloser(r), nil
+	}})
+	if safearchive.Hardened {
+		if _, ok := Detect(stream); ok {
+			t.Errorf("Detect() found a zstd codec registered in the hardened profile")
+		}
+		return
+	}
+	zr, err := Open(bytes.NewReader(stream), Limits{MaxOutputSize: 3})
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	got, err := io.ReadAll(zr)
+	if string(got) != "pay" || !errors.Is(err, ErrOutputSize) {
+		t.Errorf("Read() = %q, %v, want %q, %v", got, err, "pay", ErrOutputSize)
+	}
+	if err := safearchive.RequireFeatures(safearchive.Feature{Package: "decompress", Kind: safearchive.FeatureFormat, Name: "zstd"}); err != nil {
+		t.Errorf("RequireFeatures() error = %v", err)
+	}
+}
+
+// bgzfMember returns data compressed as a gzip member with the extra field of bgzf.
+func bgzfMember(t *testing.T, data string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	// BC subfield, the size of the block is not checked by the readers
+	zw.Extra = []byte{'B', 'C', 2, 0, 0, 0}
+	zw.Write([]byte(data))
+	if err := zw.Close(); err != nil {
+		t.Fatalf("gzip.Writer.Close() error = %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestConcatenatedStreams(t *testing.T) {
+	// bgzf streams end with an empty member
+	var bgzf []byte
+	for _, m := range []string{"hello, ", "world", ""} {
+		bgzf = append(bgzf, bgzfMember(t, m)...)
+	}
+	hello := unhex(t, helloBzip2)
+	tests := []struct {
+		name    string
+		data    []byte
+		limits  Limits
+		want    string
+		wantErr error
+	}{
+		{name: "gzip members", data: bgzf, want: "hello, world"},
+		{name: "gzip limit in the second member", data: bgzf, limits: Limits{MaxOutputSize: 9}, want: "hello, wo", wantErr: ErrOutputSize},
+		{name: "bzip2 streams", data: append(append([]byte{}, hello...), hello...), want: "hello, worldhello, world"},
+		{name: "bzip2 limit in the second stream", data: append(append([]byte{}, hello...), hello...), limits: Limits{MaxOutputSize: 20}, want: "hello, worldhello, w", wantErr: ErrOutputSize},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			zr, err := Open(bytes.NewReader(tc.data), tc.limits)
+			if err != nil {
+				t.Fatalf("Open() error = %v", err)
+			}
+			defer zr.Close()
+			got, err := io.ReadAll(zr)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Read() error = %v, want %v", err, tc.wantErr)
+			}
+			if string(got) != tc.want {
+				t.Errorf("Read() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
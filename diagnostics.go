@@ -0,0 +1,133 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// modulePath is the path of this module, used to look up its version in the build information.
+const modulePath = "github.com/google/safearchive"
+
+// MaxBundleFindings is the maximum number of findings included in a diagnostic Bundle. The last
+// findings are kept, since they are the closest to the failure.
+const MaxBundleFindings = 100
+
+// Bundle is a compact diagnostic snapshot of a failure, meant to be attached to bug reports and
+// support tickets about rejected archives. It is serialized as JSON.
+type Bundle struct {
+	// Library is the version of the safearchive module, or "(devel)" if unknown.
+	Library string `json:"library"`
+	// GoVersion is the version of the Go runtime.
+	GoVersion string `json:"goVersion"`
+	// Platform is the operating system and architecture, e.g. linux/amd64.
+	Platform string `json:"platform"`
+	// Time is when the bundle was created.
+	Time time.Time `json:"time"`
+	// Error is the error that caused the failure.
+	Error string `json:"error,omitempty"`
+	// Entry describes the offending entry, if the error is (or wraps) an EntryError.
+	Entry *BundleEntry `json:"entry,omitempty"`
+	// Config is a snapshot of the configuration of the reader (or extractor).
+	Config map[string]string `json:"config,omitempty"`
+	// Findings are the last findings collected before the failure.
+	Findings []BundleFinding `json:"findings,omitempty"`
+	// OmittedFindings is the number of findings not included in Findings.
+	OmittedFindings int `json:"omittedFindings,omitempty"`
+}
+
+// BundleEntry describes the entry an error is about.
+type BundleEntry struct {
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+	Reason Reason `json:"reason,omitempty"`
+}
+
+// BundleFinding is the serialized form of a Finding.
+type BundleFinding struct {
+	Name     string `json:"name"`
+	NewName  string `json:"newName,omitempty"`
+	Offset   int64  `json:"offset"`
+	Reason   Reason `json:"reason"`
+	Action   string `json:"action"`
+	Severity string `json:"severity"`
+	Detail   string `json:"detail,omitempty"`
+	Raw      []byte `json:"raw,omitempty"`
+}
+
+// LibraryVersion returns the version of the safearchive module linked into the binary, or
+// "(devel)" if it is unknown (e.g. when the module itself is being built).
+func LibraryVersion() string {
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if bi.Main.Path == modulePath && bi.Main.Version != "" {
+			return bi.Main.Version
+		}
+		for _, d := range bi.Deps {
+			if d.Path == modulePath {
+				return d.Version
+			}
+		}
+	}
+	return "(devel)"
+}
+
+// NewBundle returns the diagnostic bundle of a failure caused by err. report and config may be
+// nil.
+func NewBundle(err error, report *Report, config map[string]string) *Bundle {
+	b := &Bundle{
+		Library:   LibraryVersion(),
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Time:      time.Now().UTC(),
+		Config:    config,
+	}
+	if err != nil {
+		b.Error = err.Error()
+		var ee *EntryError
+		if errors.As(err, &ee) {
+			b.Entry = &BundleEntry{Name: ee.Name, Offset: ee.Offset, Reason: ee.Reason}
+		}
+	}
+	if report != nil {
+		findings := report.Findings
+		if len(findings) > MaxBundleFindings {
+			b.OmittedFindings = len(findings) - MaxBundleFindings
+			findings = findings[b.OmittedFindings:]
+		}
+		for _, f := range findings {
+			b.Findings = append(b.Findings, BundleFinding{
+				Name:     f.Name,
+				NewName:  f.NewName,
+				Offset:   f.Offset,
+				Reason:   f.Reason,
+				Action:   f.Action.String(),
+				Severity: f.EffectiveSeverity().String(),
+				Detail:   f.Detail,
+				Raw:      f.Raw,
+			})
+		}
+	}
+	return b
+}
+
+// WriteJSON writes the bundle to w as a single line of JSON.
+func (b *Bundle) WriteJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(b)
+}
@@ -0,0 +1,53 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestNewBundle(t *testing.T) {
+	report := &Report{}
+	for i := 0; i < MaxBundleFindings+50; i++ {
+		report.Add(Finding{Name: fmt.Sprint(i), Offset: int64(i), Reason: ReasonSpecialFile, Action: ActionDropped})
+	}
+	err := fmt.Errorf("extracting: %w", &EntryError{Name: "../evil", Offset: 1024, Reason: ReasonPathTraversal, Err: errors.New("rejected")})
+	b := NewBundle(err, report, map[string]string{"securityMode": "SanitizeFilenames"})
+
+	if b.Entry == nil || b.Entry.Name != "../evil" || b.Entry.Offset != 1024 || b.Entry.Reason != ReasonPathTraversal {
+		t.Errorf("NewBundle().Entry = %+v, want the offending entry", b.Entry)
+	}
+	if len(b.Findings) != MaxBundleFindings || b.OmittedFindings != 50 || b.Findings[0].Name != "50" {
+		t.Errorf("NewBundle() has %d findings starting with %q, omitted %d, want the last %d", len(b.Findings), b.Findings[0].Name, b.OmittedFindings, MaxBundleFindings)
+	}
+
+	var buf bytes.Buffer
+	if err := b.WriteJSON(&buf); err != nil {
+		t.Fatalf("WriteJSON() error = %v", err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	for _, k := range []string{"library", "goVersion", "platform", "time", "error", "entry", "config", "findings"} {
+		if _, ok := got[k]; !ok {
+			t.Errorf("WriteJSON() = %s, want key %q", buf.Bytes(), k)
+		}
+	}
+}
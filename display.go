@@ -0,0 +1,76 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxDisplayNameLength is the maximum number of characters DisplayName renders before it
+// truncates the name.
+const MaxDisplayNameLength = 256
+
+// DisplayName returns a rendering of the name of the entry that is safe to be printed to a
+// terminal or embedded into HTML, even if the name is hostile.
+//
+// Control characters, bidirectional overrides and isolates, zero-width and other invisible
+// characters, invalid UTF-8 sequences, and characters with special meaning in HTML are replaced by
+// Go-style escape sequences (e.g. \x1b, \u202e or \u003c). Backslashes are escaped as well, so the
+// rendering is unambiguous. Names longer than MaxDisplayNameLength characters are truncated in the
+// middle, keeping the (often decisive) file extension visible.
+func (e Entry) DisplayName() string {
+	var parts []string
+	for i := 0; i < len(e.Name); {
+		r, size := utf8.DecodeRuneInString(e.Name[i:])
+		if r == utf8.RuneError && size == 1 {
+			parts = append(parts, fmt.Sprintf(`\x%02x`, e.Name[i]))
+		} else {
+			parts = append(parts, displayRune(r))
+		}
+		i += size
+	}
+
+	if len(parts) > MaxDisplayNameLength {
+		head := MaxDisplayNameLength / 2
+		tail := MaxDisplayNameLength - head - 1
+		parts = append(append(parts[:head:head], "…"), parts[len(parts)-tail:]...)
+	}
+	return strings.Join(parts, "")
+}
+
+func displayRune(r rune) string {
+	switch r {
+	case '\\':
+		return `\\`
+	case '<', '>', '&', '"', '\'':
+		return fmt.Sprintf(`\u%04x`, r)
+	}
+	if r < utf8.RuneSelf && unicode.IsPrint(r) {
+		return string(r)
+	}
+	if !unicode.IsPrint(r) || unicode.Is(unicode.Bidi_Control, r) || unicode.Is(unicode.Other_Default_Ignorable_Code_Point, r) {
+		if r < 0x100 {
+			return fmt.Sprintf(`\x%02x`, r)
+		}
+		if r > 0xffff {
+			return fmt.Sprintf(`\U%08x`, r)
+		}
+		return fmt.Sprintf(`\u%04x`, r)
+	}
+	return string(r)
+}
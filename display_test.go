@@ -0,0 +1,56 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestDisplayName(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "readme.txt", want: "readme.txt"},
+		{in: "árvíztűrő tükörfúrógép.txt", want: "árvíztűrő tükörfúrógép.txt"},
+		{in: "evil\u202etxt.exe", want: `evil\u202etxt.exe`},
+		{in: "zero\u200bwidth", want: `zero\u200bwidth`},
+		{in: "esc\x1b[31mred", want: `esc\x1b[31mred`},
+		{in: "new\nline", want: `new\x0aline`},
+		{in: "c1\u0085", want: `c1\x85`},
+		{in: "bad\xffutf8", want: `bad\xffutf8`},
+		{in: `<script>alert("x")</script>`, want: `\u003cscript\u003ealert(\u0022x\u0022)\u003c/script\u003e`},
+		{in: `back\slash`, want: `back\\slash`},
+		{in: "hangul\u3164filler", want: `hangul\u3164filler`},
+	}
+	for _, tc := range tests {
+		if got := (Entry{Name: tc.in}).DisplayName(); got != tc.want {
+			t.Errorf("DisplayName(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestDisplayNameTruncation(t *testing.T) {
+	name := strings.Repeat("a", 1000) + ".exe"
+	got := (Entry{Name: name}).DisplayName()
+	if n := utf8.RuneCountInString(got); n != MaxDisplayNameLength {
+		t.Errorf("DisplayName() has %d characters, want %d", n, MaxDisplayNameLength)
+	}
+	if !strings.HasSuffix(got, ".exe") || !strings.Contains(got, "…") {
+		t.Errorf("DisplayName() = %q, want a name truncated in the middle", got)
+	}
+}
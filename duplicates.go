@@ -0,0 +1,138 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/google/safearchive/sanitizer"
+)
+
+// DuplicatePolicy is what the readers do with the entries whose name is already taken by an
+// earlier entry of the archive. Extractors usually let the last of them win, so duplicates may
+// shadow the entries a content inspection has seen.
+type DuplicatePolicy int
+
+const (
+	// DuplicatesAllow does not look for duplicates. This is the default.
+	DuplicatesAllow DuplicatePolicy = iota
+	// DuplicatesKeepFirst drops the duplicates, so the first entry of a name wins.
+	DuplicatesKeepFirst
+	// DuplicatesReject rejects the archive at the first duplicate.
+	DuplicatesReject
+	// DuplicatesKeepLast keeps and reports the duplicates, which replace the earlier entries of
+	// their name when extracted.
+	DuplicatesKeepLast
+	// DuplicatesRename renames the duplicates to the first free name made by inserting a counter
+	// before the extension, e.g. a.1.txt for a.txt, so no entry is lost. A free name is neither
+	// the name of an earlier entry nor one of its directories.
+	DuplicatesRename
+)
+
+// DuplicateChecker detects the entries whose name is already taken by an earlier entry. Repeated
+// directories are not duplicates, a directory and a file of the same name are.
+// The zero value allows everything.
+type DuplicateChecker struct {
+	Policy DuplicatePolicy
+	// Fold makes the checker detect collisions instead: entries whose name differs from the one of
+	// an earlier entry, but is the same on case-insensitive or normalization-insensitive file
+	// systems (see sanitizer.FoldName), e.g. README and readme. Exact duplicates are left alone.
+	Fold bool
+
+	// seen are the names seen so far, by their keys, and parents the keys of their parent
+	// directories, which renamed entries must not take either.
+	seen    map[string]seenName
+	parents map[string]bool
+}
+
+type seenName struct {
+	name string
+	dir  bool
+}
+
+// key returns the key of a clean name.
+func (c *DuplicateChecker) key(name string) string {
+	if c.Fold {
+		return sanitizer.FoldName(name)
+	}
+	return name
+}
+
+// Check returns the verdict of the policy about the entry name (a sanitized, forward slash
+// separated path) along with the name the entry is to be given, which differs from name only if
+// the policy renamed it, and records it unless it is dropped.
+func (c *DuplicateChecker) Check(name string, dir bool) (Verdict, string) {
+	if c.Policy == DuplicatesAllow {
+		return Pass, name
+	}
+	if c.seen == nil {
+		c.seen, c.parents = map[string]seenName{}, map[string]bool{}
+	}
+	clean := path.Clean(strings.TrimPrefix(name, "/"))
+	key := c.key(clean)
+	s, ok := c.seen[key]
+	if !ok || (dir && s.dir) || (c.Fold && s.name == clean) {
+		if !ok {
+			c.record(clean, dir)
+		}
+		return Pass, name
+	}
+	v := Verdict{Action: ActionDropped, Reason: ReasonDuplicate, Detail: "name taken by an earlier entry"}
+	if c.Fold {
+		v.Reason, v.Detail = ReasonCollision, fmt.Sprintf("collides with %q", s.name)
+	}
+	switch c.Policy {
+	case DuplicatesReject:
+		v.Action = ActionRejected
+	case DuplicatesKeepLast:
+		v.Action = ActionNone
+	case DuplicatesRename:
+		renamed := c.free(clean)
+		c.record(renamed, dir)
+		v.Action, v.Detail = ActionModified, "renamed to "+renamed
+		if dir {
+			renamed += "/"
+		}
+		return v, renamed
+	}
+	return v, name
+}
+
+// record records the clean name and its parent directories.
+func (c *DuplicateChecker) record(name string, dir bool) {
+	c.seen[c.key(name)] = seenName{name, dir}
+	for d := path.Dir(name); d != "." && d != "/"; d = path.Dir(d) {
+		c.parents[c.key(d)] = true
+	}
+}
+
+// free returns the first name neither seen yet nor the parent directory of one, made by inserting
+// a counter before the extension of name.
+func (c *DuplicateChecker) free(name string) string {
+	ext := path.Ext(name)
+	if ext == name[strings.LastIndex(name, "/")+1:] {
+		// a dot file such as .bashrc has no extension
+		ext = ""
+	}
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		n := fmt.Sprintf("%s.%d%s", base, i, ext)
+		if _, ok := c.seen[c.key(n)]; !ok && !c.parents[c.key(n)] {
+			return n
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDuplicateChecker(t *testing.T) {
+	entries := []string{"a", "dir/", "./a", "dir/", "b", "dir", "/b"}
+	for _, tc := range []struct {
+		policy DuplicatePolicy
+		want   []Action
+	}{
+		{DuplicatesAllow, []Action{ActionNone, ActionNone, ActionNone, ActionNone, ActionNone, ActionNone, ActionNone}},
+		{DuplicatesKeepFirst, []Action{ActionNone, ActionNone, ActionDropped, ActionNone, ActionNone, ActionDropped, ActionDropped}},
+		{DuplicatesReject, []Action{ActionNone, ActionNone, ActionRejected, ActionNone, ActionNone, ActionRejected, ActionRejected}},
+		{DuplicatesKeepLast, []Action{ActionNone, ActionNone, ActionNone, ActionNone, ActionNone, ActionNone, ActionNone}},
+		{DuplicatesRename, []Action{ActionNone, ActionNone, ActionModified, ActionNone, ActionNone, ActionModified, ActionModified}},
+	} {
+		c := DuplicateChecker{Policy: tc.policy}
+		var got []Action
+		for _, e := range entries {
+			// directories end with a slash
+			v, _ := c.Check(e, strings.HasSuffix(e, "/"))
+			got = append(got, v.Action)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("policy %d: actions = %v, want %v", tc.policy, got, tc.want)
+		}
+	}
+}
+
+func TestDuplicateCheckerRename(t *testing.T) {
+	c := DuplicateChecker{Policy: DuplicatesRename}
+	var got []string
+	for _, e := range []string{"a.txt", "a.txt", "a.1.txt", "a.txt", "d/.bashrc", "d/.bashrc", "dir", "dir/", "b.1/x", "b", "b"} {
+		_, name := c.Check(e, strings.HasSuffix(e, "/"))
+		got = append(got, name)
+	}
+	want := []string{"a.txt", "a.1.txt", "a.1.1.txt", "a.2.txt", "d/.bashrc", "d/.bashrc.1", "dir", "dir.1/", "b.1/x", "b", "b.2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("names = %q, want %q", got, want)
+	}
+}
+
+func TestDuplicateCheckerFold(t *testing.T) {
+	c := DuplicateChecker{Policy: DuplicatesRename, Fold: true}
+	var got []string
+	var reasons []Reason
+	for _, e := range []string{"README", "dir/", "readme", "README", "DIR/", "Readme.1"} {
+		v, name := c.Check(e, strings.HasSuffix(e, "/"))
+		got = append(got, name)
+		reasons = append(reasons, v.Reason)
+	}
+	want := []string{"README", "dir/", "readme.1", "README", "DIR/", "Readme.1.1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("names = %q, want %q", got, want)
+	}
+	wantReasons := []Reason{"", "", ReasonCollision, "", "", ReasonCollision}
+	if !reflect.DeepEqual(reasons, wantReasons) {
+		t.Errorf("reasons = %q, want %q", reasons, wantReasons)
+	}
+}
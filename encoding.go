@@ -0,0 +1,52 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"fmt"
+
+	"github.com/google/safearchive/sanitizer"
+)
+
+// NameEncodingPolicy is what the readers do with the entries whose name is not valid UTF-8 or has
+// NUL bytes (see sanitizer.IsValidName). Such names are decoded or truncated differently by other
+// tools, which confuses later comparisons of the paths.
+type NameEncodingPolicy int
+
+const (
+	// NameEncodingReplace replaces the invalid bytes with the replacement character U+FFFD. This is
+	// the default.
+	NameEncodingReplace NameEncodingPolicy = iota
+	// NameEncodingPercent replaces the invalid bytes with their percent-encoding, e.g. %FF.
+	NameEncodingPercent
+	// NameEncodingReject rejects the archive at the first invalid name.
+	NameEncodingReject
+)
+
+// Check applies p to the name of an entry, returning the name to use and the verdict about it.
+func (p NameEncodingPolicy) Check(name string) (string, Verdict) {
+	if sanitizer.IsValidName(name) {
+		return name, Pass
+	}
+	v := Verdict{Action: ActionModified, Reason: ReasonInvalidEncoding, Detail: fmt.Sprintf("invalid bytes in %q", name)}
+	switch p {
+	case NameEncodingPercent:
+		return sanitizer.PercentEncodeInvalid(name), v
+	case NameEncodingReject:
+		v.Action = ActionRejected
+		return name, v
+	}
+	return sanitizer.ReplaceInvalidEncoding(name), v
+}
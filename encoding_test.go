@@ -0,0 +1,47 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNameEncodingPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy NameEncodingPolicy
+		in     string
+		want   string
+		action Action
+	}{
+		{NameEncodingReplace, "dir/file.txt", "dir/file.txt", ActionNone},
+		{NameEncodingReplace, "dir/caf\xe9.txt", "dir/caf�.txt", ActionModified},
+		{NameEncodingPercent, "dir/caf\xe9.txt", "dir/caf%E9.txt", ActionModified},
+		{NameEncodingPercent, "a\x00b", "a%00b", ActionModified},
+		{NameEncodingReject, "dir/caf\xe9.txt", "dir/caf\xe9.txt", ActionRejected},
+		{NameEncodingReject, "dir/café.txt", "dir/café.txt", ActionNone},
+	} {
+		got, v := tc.policy.Check(tc.in)
+		if got != tc.want || v.Action != tc.action {
+			t.Errorf("NameEncodingPolicy(%d).Check(%q) = %q, %v, want %q, %v", tc.policy, tc.in, got, v.Action, tc.want, tc.action)
+		}
+		if v.Action != ActionNone && v.Reason != ReasonInvalidEncoding {
+			t.Errorf("NameEncodingPolicy(%d).Check(%q) reason = %q, want %q", tc.policy, tc.in, v.Reason, ReasonInvalidEncoding)
+		}
+	}
+	if err := RejectionError(ReasonInvalidEncoding); !errors.Is(err, ErrInvalidEncoding) {
+		t.Errorf("RejectionError(%q) = %v, want %v", ReasonInvalidEncoding, err, ErrInvalidEncoding)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"bytes"
+	"io/fs"
+	"time"
+)
+
+// Entry is a format independent description of an archive entry.
+// The safearchive/tar and safearchive/zip packages can produce Entries from their (sanitized)
+// headers, so tools comparing entries across formats work with consistent metadata.
+type Entry struct {
+	// Name is the name of the entry. Entries are matched by name, it is not compared.
+	Name string
+	// Linkname is the target of a link entry.
+	Linkname string
+	// Size is the uncompressed size of the entry in bytes.
+	Size int64
+	// Mode is the file mode (including the type bits) of the entry.
+	Mode fs.FileMode
+	// ModTime is the modification time of the entry.
+	ModTime time.Time
+	// Digest is an optional digest of the contents of the entry.
+	Digest []byte
+}
+
+// Field selects attributes of an Entry to be compared.
+type Field int
+
+const (
+	// FieldSize compares the size of the entries.
+	FieldSize Field = 1 << iota
+	// FieldModTime compares the modification time of the entries.
+	FieldModTime
+	// FieldMode compares the file mode of the entries.
+	FieldMode
+	// FieldDigest compares the content digest of the entries. The digests are compared only if both
+	// entries have one.
+	FieldDigest
+	// FieldLinkname compares the link targets of the entries.
+	FieldLinkname
+)
+
+// DefaultFields is the set of fields compared by Changed.
+const DefaultFields = FieldSize | FieldModTime | FieldMode | FieldDigest | FieldLinkname
+
+// Change is the outcome of a three-way comparison.
+type Change int
+
+const (
+	// Unchanged means neither side differs from the base.
+	Unchanged Change = iota
+	// ChangedA means only the first side differs from the base.
+	ChangedA
+	// ChangedB means only the second side differs from the base.
+	ChangedB
+	// ChangedBoth means both sides differ from the base, but they agree with each other.
+	ChangedBoth
+	// Conflict means both sides differ from the base and from each other.
+	Conflict
+)
+
+// Comparer compares entries on a configurable set of fields.
+// The zero value compares nothing; use DefaultComparer for a sensible default.
+type Comparer struct {
+	// Fields selects the attributes to be compared.
+	Fields Field
+	// ModTimePrecision truncates modification times before they are compared. Zip archives store
+	// timestamps with a precision of two seconds, so comparing them with file system timestamps
+	// requires a coarser precision.
+	ModTimePrecision time.Duration
+}
+
+// DefaultComparer compares DefaultFields with a precision of one second.
+var DefaultComparer = Comparer{Fields: DefaultFields, ModTimePrecision: time.Second}
+
+// Changed reports whether a and b differ according to DefaultComparer.
+func Changed(a, b Entry) bool {
+	return DefaultComparer.Changed(a, b)
+}
+
+// Changed reports whether a and b differ in any of the compared fields.
+func (c Comparer) Changed(a, b Entry) bool {
+	return c.Diff(a, b) != 0
+}
+
+// Diff returns the set of compared fields in which a and b differ.
+func (c Comparer) Diff(a, b Entry) Field {
+	var re Field
+	if c.Fields&FieldSize != 0 && a.Size != b.Size {
+		re |= FieldSize
+	}
+	if c.Fields&FieldModTime != 0 && !a.ModTime.Truncate(c.ModTimePrecision).Equal(b.ModTime.Truncate(c.ModTimePrecision)) {
+		re |= FieldModTime
+	}
+	if c.Fields&FieldMode != 0 && a.Mode != b.Mode {
+		re |= FieldMode
+	}
+	if c.Fields&FieldDigest != 0 && a.Digest != nil && b.Digest != nil && !bytes.Equal(a.Digest, b.Digest) {
+		re |= FieldDigest
+	}
+	if c.Fields&FieldLinkname != 0 && a.Linkname != b.Linkname {
+		re |= FieldLinkname
+	}
+	return re
+}
+
+// Compare3 compares a and b against their common base, e.g. the entry in the last backup, the
+// current state of the file and the entry in a concurrently produced archive.
+// A nil Entry means the entry does not exist on that side.
+func (c Comparer) Compare3(base, a, b *Entry) Change {
+	changedA := c.differ(base, a)
+	changedB := c.differ(base, b)
+	switch {
+	case changedA && changedB:
+		if c.differ(a, b) {
+			return Conflict
+		}
+		return ChangedBoth
+	case changedA:
+		return ChangedA
+	case changedB:
+		return ChangedB
+	}
+	return Unchanged
+}
+
+func (c Comparer) differ(a, b *Entry) bool {
+	if a == nil || b == nil {
+		return a != b
+	}
+	return c.Changed(*a, *b)
+}
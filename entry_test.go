@@ -0,0 +1,83 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChanged(t *testing.T) {
+	now := time.Date(2024, 3, 8, 9, 43, 0, 0, time.UTC)
+	base := Entry{Name: "a.txt", Size: 5, Mode: 0644, ModTime: now, Digest: []byte{1}}
+
+	tests := []struct {
+		name   string
+		modify func(e *Entry)
+		want   bool
+	}{
+		{name: "identical", modify: func(e *Entry) {}, want: false},
+		{name: "sub-second mtime", modify: func(e *Entry) { e.ModTime = now.Add(500 * time.Millisecond) }, want: false},
+		{name: "size", modify: func(e *Entry) { e.Size = 6 }, want: true},
+		{name: "mtime", modify: func(e *Entry) { e.ModTime = now.Add(time.Hour) }, want: true},
+		{name: "mode", modify: func(e *Entry) { e.Mode = 0600 }, want: true},
+		{name: "digest", modify: func(e *Entry) { e.Digest = []byte{2} }, want: true},
+		{name: "missing digest", modify: func(e *Entry) { e.Digest = nil }, want: false},
+		{name: "linkname", modify: func(e *Entry) { e.Linkname = "b.txt" }, want: true},
+	}
+	for _, tc := range tests {
+		other := base
+		tc.modify(&other)
+		if got := Changed(base, other); got != tc.want {
+			t.Errorf("Changed() for %s = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCompareFields(t *testing.T) {
+	a := Entry{Size: 1, Mode: 0644}
+	b := Entry{Size: 2, Mode: 0600}
+	c := Comparer{Fields: FieldMode}
+	if got := c.Diff(a, b); got != FieldMode {
+		t.Errorf("Comparer{FieldMode}.Diff() = %v, want %v", got, FieldMode)
+	}
+}
+
+func TestCompare3(t *testing.T) {
+	base := &Entry{Size: 1}
+	same := &Entry{Size: 1}
+	other := &Entry{Size: 2}
+	third := &Entry{Size: 3}
+
+	tests := []struct {
+		name       string
+		base, a, b *Entry
+		want       Change
+	}{
+		{name: "unchanged", base: base, a: same, b: same, want: Unchanged},
+		{name: "a changed", base: base, a: other, b: same, want: ChangedA},
+		{name: "b changed", base: base, a: same, b: other, want: ChangedB},
+		{name: "both changed identically", base: base, a: other, b: other, want: ChangedBoth},
+		{name: "conflict", base: base, a: other, b: third, want: Conflict},
+		{name: "added on a", base: nil, a: other, b: nil, want: ChangedA},
+		{name: "deleted on b", base: base, a: same, b: nil, want: ChangedB},
+		{name: "deleted on both", base: base, a: nil, b: nil, want: ChangedBoth},
+	}
+	for _, tc := range tests {
+		if got := DefaultComparer.Compare3(tc.base, tc.a, tc.b); got != tc.want {
+			t.Errorf("Compare3() for %s = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// ErrLimitExceeded is wrapped (into an EntryError) by the errors of readers rejecting an archive
+// because it exceeds one of their limits (e.g. the maximum size of the entries), which is the
+// telltale sign of a decompression bomb.
+var ErrLimitExceeded = errors.New("safearchive: limit exceeded")
+
+// EntryError is an error about a specific entry of an archive.
+// The metadata of the error is carried in fields rather than in the formatted message, so callers
+// can produce their own (e.g. localized) messages and can match errors with errors.As.
+type EntryError struct {
+	// Name is the original (unsanitized) name of the entry, or empty if its header could not be
+	// parsed.
+	Name string
+	// Offset is the byte offset of the header of the entry in the archive, or -1 if unknown.
+	Offset int64
+	// Reason is the reason code of the security feature that flagged the entry, if any.
+	Reason Reason
+	// Err is the underlying error.
+	Err error
+}
+
+// NewEntryError returns an EntryError with an unknown offset.
+func NewEntryError(name string, reason Reason, err error) *EntryError {
+	return &EntryError{Name: name, Offset: -1, Reason: reason, Err: err}
+}
+
+func (e *EntryError) Error() string {
+	msg := "entry"
+	if e.Name != "" {
+		msg += " " + strconv.Quote(e.Name)
+	}
+	if e.Offset >= 0 {
+		msg += fmt.Sprintf(" at offset %d", e.Offset)
+	}
+	if e.Reason != "" {
+		msg += " (" + string(e.Reason) + ")"
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the underlying error.
+func (e *EntryError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,47 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+)
+
+func TestEntryError(t *testing.T) {
+	tests := []struct {
+		err  *EntryError
+		want string
+	}{
+		{err: NewEntryError("a.txt", "", fs.ErrNotExist), want: `entry "a.txt": file does not exist`},
+		{err: &EntryError{Name: "../a", Offset: 1024, Reason: ReasonPathTraversal}, want: `entry "../a" at offset 1024 (path-traversal)`},
+		{err: &EntryError{Offset: 1536, Err: fs.ErrInvalid}, want: `entry at offset 1536: invalid argument`},
+		{err: Finding{Name: "fifo", Offset: 512, Reason: ReasonSpecialFile}.Err(fs.ErrInvalid), want: `entry "fifo" at offset 512 (special-file): invalid argument`},
+	}
+	for _, tc := range tests {
+		if got := tc.err.Error(); got != tc.want {
+			t.Errorf("Error() = %q, want %q", got, tc.want)
+		}
+	}
+
+	var err error = NewEntryError("a.txt", ReasonSpecialFile, fs.ErrNotExist)
+	var ee *EntryError
+	if !errors.As(err, &ee) || ee.Name != "a.txt" || ee.Reason != ReasonSpecialFile {
+		t.Errorf("errors.As(%v) did not yield the entry metadata", err)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("errors.Is(%v, fs.ErrNotExist) = false, want true", err)
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+// SanitizeEvent describes a decision of a security feature or a rule of a reader about an entry.
+// Readers pass it to their OnSanitize hook at the moment the decision is made.
+type SanitizeEvent struct {
+	// Finding is the finding the reader records about the entry.
+	Finding Finding
+
+	vetoed *bool
+}
+
+// Veto rejects the archive instead of applying the decision: the reader fails with an EntryError
+// wrapping ErrRejected, and the finding is recorded with ActionRejected.
+func (ev SanitizeEvent) Veto() {
+	if ev.vetoed != nil {
+		*ev.vetoed = true
+	}
+}
+
+// SanitizeHook is the type of the OnSanitize hooks of the readers.
+type SanitizeHook func(ev SanitizeEvent)
+
+// Call passes the event about f to the hook and returns f with the decision of the hook applied.
+// A nil hook keeps f as it is.
+func (h SanitizeHook) Call(f Finding) Finding {
+	if h == nil {
+		return f
+	}
+	var vetoed bool
+	h(SanitizeEvent{Finding: f, vetoed: &vetoed})
+	if vetoed {
+		f.Action = ActionRejected
+	}
+	return f
+}
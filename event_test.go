@@ -0,0 +1,48 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSanitizeHook(t *testing.T) {
+	f := Finding{Name: "../a", Reason: ReasonPathTraversal, Action: ActionModified}
+
+	var nilHook SanitizeHook
+	if got := nilHook.Call(f); !reflect.DeepEqual(got, f) {
+		t.Errorf("nil hook Call() = %+v, want %+v", got, f)
+	}
+
+	var events []SanitizeEvent
+	var h SanitizeHook = func(ev SanitizeEvent) {
+		events = append(events, ev)
+	}
+	if got := h.Call(f); !reflect.DeepEqual(got, f) {
+		t.Errorf("Call() = %+v, want %+v", got, f)
+	}
+	if len(events) != 1 || !reflect.DeepEqual(events[0].Finding, f) {
+		t.Errorf("hook received %+v, want one event about %+v", events, f)
+	}
+
+	h = func(ev SanitizeEvent) {
+		ev.Veto()
+	}
+	if got := h.Call(f); got.Action != ActionRejected {
+		t.Errorf("Call() with a veto = %+v, want ActionRejected", got)
+	}
+	(SanitizeEvent{}).Veto()
+}
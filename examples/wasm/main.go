@@ -0,0 +1,94 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build js && wasm
+// +build js,wasm
+
+// Command wasm exposes the safearchive audit to JavaScript, so web frontends can pre-audit user
+// archives before uploading them, with the same rules as the backend.
+//
+// Build it with:
+//
+//	GOOS=js GOARCH=wasm go build -o safearchive.wasm ./examples/wasm
+//
+// and load it with the wasm_exec.js shipped with Go:
+//
+//	const go = new Go();
+//	const {instance} = await WebAssembly.instantiateStreaming(fetch("safearchive.wasm"), go.importObject);
+//	go.run(instance);
+//	const result = JSON.parse(safearchiveInspect(new Uint8Array(await file.arrayBuffer())));
+//	if (result.health !== "clean") {
+//	  // warn the user
+//	}
+//
+// safearchiveInspect takes the archive as a Uint8Array and optionally the options of the audit as
+// an object with the tarSecurityMode, zipSecurityMode, maxChildren and zipTolerant properties. It
+// returns the JSON encoded audit.Result, or a JSON object with a single error property if the
+// archive could not be inspected.
+package main
+
+import (
+	"encoding/json"
+	"syscall/js"
+
+	"github.com/google/safearchive/audit"
+	"github.com/google/safearchive/tar"
+	"github.com/google/safearchive/zip"
+)
+
+func main() {
+	js.Global().Set("safearchiveInspect", js.FuncOf(inspect))
+	// keep the exported function alive
+	select {}
+}
+
+func inspect(this js.Value, args []js.Value) any {
+	if len(args) < 1 || args[0].Type() != js.TypeObject {
+		return errorJSON("safearchiveInspect: expected a Uint8Array")
+	}
+	data := make([]byte, args[0].Get("length").Int())
+	js.CopyBytesToGo(data, args[0])
+
+	var opts audit.Options
+	if len(args) > 1 && args[1].Type() == js.TypeObject {
+		o := args[1]
+		if v := o.Get("tarSecurityMode"); v.Type() == js.TypeNumber {
+			opts.TarSecurityMode = tar.SecurityMode(v.Int())
+		}
+		if v := o.Get("zipSecurityMode"); v.Type() == js.TypeNumber {
+			opts.ZipSecurityMode = zip.SecurityMode(v.Int())
+		}
+		if v := o.Get("maxChildren"); v.Type() == js.TypeNumber {
+			opts.MaxChildren = v.Int()
+		}
+		if v := o.Get("zipTolerant"); v.Type() == js.TypeBoolean {
+			opts.ZipTolerant = v.Bool()
+		}
+	}
+
+	res, err := audit.Inspect(data, opts)
+	if err != nil {
+		return errorJSON(err.Error())
+	}
+	b, err := json.Marshal(res)
+	if err != nil {
+		return errorJSON(err.Error())
+	}
+	return string(b)
+}
+
+func errorJSON(msg string) string {
+	b, _ := json.Marshal(map[string]string{"error": msg})
+	return string(b)
+}
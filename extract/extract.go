@@ -0,0 +1,466 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package extract writes the entries of the safearchive readers to a file system.
+//
+// The destination is a WriteFS and the current time comes from a Clock, so extraction flows can be
+// unit tested deterministically, including file system failures in the middle of an extraction:
+//
+//	dst := extract.NewMemFS()
+//	dst.Fail = func(op, name string) error {
+//		if op == "write" && name == "big.bin" {
+//			return syscall.ENOSPC
+//		}
+//		return nil
+//	}
+//	err := extract.Tar(dst, tr, extract.Options{Clock: fixedClock})
+//	// err wraps syscall.ENOSPC, and dst.Files is empty again
+//
+// Entries are extracted with the names and modes the readers return, so the security features of
+// the readers apply. Hard links and special files are not extracted.
+//
+// Destinations may not permit every operation (e.g. creating symbolic links on Windows without
+// developer mode). Options.Privileges chooses between failing the extraction and skipping the
+// affected entries, which are then reported in Options.Report.
+//
+// Options.Paranoid adds a final defense in depth: every entry is sanitized and checked again right
+// before it is written, so the extraction stays contained even if fed unsanitized entries.
+//
+// Options.Digests collects the digests of the contents of the regular files as they are written,
+// so integrity attestations and deduplication do not need a second pass over the archive.
+//
+// Options.Concurrency decompresses the regular files of zip archives on multiple goroutines,
+// taking advantage of their random access.
+package extract
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/internal/limits"
+	"github.com/google/safearchive/sanitizer"
+	"github.com/google/safearchive/tar"
+	"github.com/google/safearchive/zip"
+)
+
+// ErrInvalidName is wrapped (into a safearchive.EntryError) by the errors of extracting an entry
+// whose name is not a valid relative path, e.g. because the reader did not sanitize file names.
+var ErrInvalidName = errors.New("extract: invalid entry name")
+
+// Clock tells the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// SystemClock is the Clock of the operating system.
+var SystemClock Clock = systemClock{}
+
+// Options configures an extraction.
+type Options struct {
+	// Clock provides the current time, which is the modification time of the entries without one.
+	// Modification times in the future are clamped to it. SystemClock is used if not set.
+	Clock Clock
+	// KeepPartial keeps the files and directories created before a failure. By default, they are
+	// removed, rolling back the extraction.
+	KeepPartial bool
+	// Subtree restricts the extraction to an entry and the entries below it (e.g. "usr/lib"), as
+	// matched by sanitizer.InSubtree. The entries keep their full names; the directories leading to
+	// the subtree are created as needed. The data of the other entries is not decompressed.
+	Subtree string
+	// Privileges controls the extraction of the entries needing an operation the destination does
+	// not permit, e.g. symbolic links on Windows without developer mode. By default
+	// (FailNotPermitted) the extraction fails.
+	Privileges PrivilegePolicy
+	// Report, if set, receives the findings about the entries the extraction degraded, e.g. the
+	// ones skipped because of SkipNotPermitted.
+	Report *safearchive.Report
+	// Concurrency is the number of goroutines decompressing the regular files of zip archives at
+	// once. Above 1, the directories are created first, in the order of the archive, then the
+	// regular files in parallel, then the symbolic links, so no file is written through a
+	// symbolic link of the archive. The calls to the WriteFS are serialized regardless. The
+	// entries of tar archives are always extracted sequentially.
+	Concurrency int
+	// Paranoid re-checks every entry right before writing it, in case the reader was not
+	// configured to sanitize names or the entries were tampered with: the name must be a
+	// sanitized relative path (or the extraction fails with ErrInvalidName), and it must not be
+	// written through a symbolic link (or it fails with safearchive.ErrSymlinkTraversal). The
+	// targets of the symbolic links must resolve within the destination (or the extraction fails
+	// with safearchive.ErrSymlinkTarget). The symbolic links of the destination are only detected
+	// if it implements Lstater.
+	Paranoid bool
+	// Digests, if set, receives the digests of the contents of the regular files extracted, by the
+	// name they were written to (with forward slashes). The digests are computed while the files
+	// are written. Files removed by a rollback are removed from Digests as well.
+	Digests map[string][]byte
+	// Hash is the hash function of Digests. SHA-256 is used if not set.
+	Hash func() hash.Hash
+}
+
+// extraction is the state of an extraction in progress.
+type extraction struct {
+	ctx context.Context
+	// mu serializes the calls to dst (and the updates of created) of parallel extractions, see
+	// Options.Concurrency.
+	mu    sync.Mutex
+	dst   WriteFS
+	clock Clock
+	// created lists the files and directories created so far, in order of creation.
+	created []string
+	// dirs are the modification times of the extracted directories, set once all the entries are
+	// written.
+	dirs []dirTime
+	// denied are the operations the destination does not permit, see NotPermitted.
+	denied     map[string]error
+	privileges PrivilegePolicy
+	report     *safearchive.Report
+	paranoid   bool
+	// links are the symbolic links created so far, and targets their targets for paranoid
+	// extractions, see verify.
+	links   map[string]bool
+	targets safearchive.SymlinkSet
+	// digests receives the digests of the regular files computed with hash, see Options.Digests.
+	digests map[string][]byte
+	hash    func() hash.Hash
+}
+
+type dirTime struct {
+	name  string
+	mtime time.Time
+}
+
+func newExtraction(ctx context.Context, dst WriteFS, opts Options) *extraction {
+	x := &extraction{ctx: ctx, dst: dst, clock: opts.Clock, denied: NotPermitted(dst), privileges: opts.Privileges, report: opts.Report, paranoid: opts.Paranoid, links: map[string]bool{}, digests: opts.Digests, hash: opts.Hash}
+	if x.clock == nil {
+		x.clock = SystemClock
+	}
+	if x.hash == nil {
+		x.hash = sha256.New
+	}
+	return x
+}
+
+// Tar extracts the remaining entries of tr to dst.
+func Tar(dst WriteFS, tr *tar.Reader, opts Options) error {
+	return TarContext(context.Background(), dst, tr, opts)
+}
+
+// TarContext is Tar, failing with the error of ctx once it is done. Like other failures, this
+// rolls the extraction back unless Options.KeepPartial is set.
+func TarContext(ctx context.Context, dst WriteFS, tr *tar.Reader, opts Options) error {
+	x := newExtraction(ctx, dst, opts)
+	err := func() error {
+		for {
+			h, err := tr.NextContext(ctx)
+			if err == io.EOF {
+				return x.finish()
+			}
+			if err != nil {
+				return err
+			}
+			if !sanitizer.InSubtree(h.Name, opts.Subtree) {
+				continue
+			}
+			if err := x.entry(tar.EntryOf(h), h.Typeflag == tar.TypeLink, tr); err != nil {
+				return err
+			}
+		}
+	}()
+	return x.done(err, opts)
+}
+
+// Zip extracts the entries of r to dst.
+func Zip(dst WriteFS, r *zip.Reader, opts Options) error {
+	return ZipContext(context.Background(), dst, r, opts)
+}
+
+// ZipContext is Zip, failing with the error of ctx once it is done, see TarContext.
+func ZipContext(ctx context.Context, dst WriteFS, r *zip.Reader, opts Options) error {
+	x := newExtraction(ctx, dst, opts)
+	err := func() error {
+		if err := r.Err(); err != nil {
+			return err
+		}
+		if err := x.preflight(r, opts); err != nil {
+			return err
+		}
+		if opts.Concurrency > 1 {
+			return x.zipParallel(r, opts)
+		}
+		for _, f := range r.File {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !sanitizer.InSubtree(f.Name, opts.Subtree) {
+				continue
+			}
+			if err := x.zipEntry(f); err != nil {
+				return err
+			}
+		}
+		return x.finish()
+	}()
+	return x.done(err, opts)
+}
+
+func (x *extraction) zipEntry(f *zip.File) error {
+	e, rc, err := openZipEntry(f)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return x.entry(e, false, rc)
+}
+
+// openZipEntry opens the data of f, reading the target of symbolic links.
+func openZipEntry(f *zip.File) (safearchive.Entry, io.ReadCloser, error) {
+	e := zip.EntryOf(f)
+	rc, err := f.Open()
+	if err != nil {
+		return e, nil, safearchive.NewEntryError(f.Name, "", err)
+	}
+	if e.Mode&fs.ModeSymlink != 0 {
+		target, err := io.ReadAll(io.LimitReader(rc, limits.MaxLinknameLen))
+		if err != nil {
+			rc.Close()
+			return e, nil, safearchive.NewEntryError(f.Name, "", err)
+		}
+		e.Linkname = string(target)
+	}
+	return e, rc, nil
+}
+
+// preflight fails a zip extraction before extracting anything if an entry needs an operation the
+// destination does not permit, see FailNotPermitted.
+func (x *extraction) preflight(r *zip.Reader, opts Options) error {
+	cause, ok := x.denied[OpSymlink]
+	if !ok || x.privileges != FailNotPermitted {
+		return nil
+	}
+	for _, f := range r.File {
+		if f.Mode()&fs.ModeSymlink != 0 && sanitizer.InSubtree(f.Name, opts.Subtree) {
+			return x.notPermitted(zip.EntryOf(f), OpSymlink, cause)
+		}
+	}
+	return nil
+}
+
+// done rolls back a failed extraction, unless the options ask to keep the partial results.
+func (x *extraction) done(err error, opts Options) error {
+	if err != nil && !opts.KeepPartial {
+		x.rollback()
+	}
+	return err
+}
+
+// entry extracts a single entry. content is the data of regular files.
+func (x *extraction) entry(e safearchive.Entry, hardLink bool, content io.Reader) error {
+	name, err := x.prepare(e)
+	if err != nil {
+		return err
+	}
+	switch {
+	case hardLink:
+		return nil
+	case e.Mode.IsDir():
+		err = x.mkdir(name, e.Mode.Perm()|0700)
+		if err == nil {
+			x.dirs = append(x.dirs, dirTime{name, x.modTime(e.ModTime)})
+		}
+	case e.Mode.IsRegular():
+		return x.file(e, name, content)
+	case e.Mode&fs.ModeSymlink != 0:
+		return x.symlink(e, name)
+	default:
+		return nil
+	}
+	if err != nil {
+		return safearchive.NewEntryError(e.Name, "", err)
+	}
+	return nil
+}
+
+// prepare checks the name of the entry e and creates its parent directories. It returns the name
+// to write the entry to.
+func (x *extraction) prepare(e safearchive.Entry) (string, error) {
+	name := strings.TrimSuffix(filepath.ToSlash(e.Name), "/")
+	if !fs.ValidPath(name) || name == "." {
+		return "", safearchive.NewEntryError(e.Name, safearchive.NameReason(e.Name), ErrInvalidName)
+	}
+	if x.paranoid {
+		if err := x.verify(e, name); err != nil {
+			return "", err
+		}
+	}
+	if err := x.mkdirAll(path.Dir(name)); err != nil {
+		return "", safearchive.NewEntryError(e.Name, "", err)
+	}
+	return name, nil
+}
+
+// file writes the regular file e to name.
+func (x *extraction) file(e safearchive.Entry, name string, content io.Reader) error {
+	err := x.create(name, e.Mode.Perm(), content)
+	if err == nil {
+		x.mu.Lock()
+		err = x.dst.Chtimes(name, x.modTime(e.ModTime))
+		x.mu.Unlock()
+	}
+	if err != nil {
+		return safearchive.NewEntryError(e.Name, "", err)
+	}
+	return nil
+}
+
+// modTime returns the modification time of an entry, clamped to the current time.
+func (x *extraction) modTime(t time.Time) time.Time {
+	now := x.clock.Now()
+	if t.IsZero() || t.After(now) {
+		return now
+	}
+	return t
+}
+
+// mkdir creates a directory unless it exists already. A symbolic link or a file found in its place
+// is refused rather than taken for the directory, so nothing is written through it; the ones of the
+// destination are only detected if it implements Lstater.
+func (x *extraction) mkdir(name string, perm fs.FileMode) error {
+	err := x.dst.Mkdir(name, perm)
+	if err == nil {
+		x.created = append(x.created, name)
+		return nil
+	}
+	if !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	if x.links[name] {
+		return fmt.Errorf("%w: %s", safearchive.ErrSymlinkTraversal, name)
+	}
+	l, ok := x.dst.(Lstater)
+	if !ok {
+		return nil
+	}
+	fi, lerr := l.Lstat(name)
+	switch {
+	case lerr != nil:
+		return lerr
+	case fi.Mode()&fs.ModeSymlink != 0:
+		return fmt.Errorf("%w: %s", safearchive.ErrSymlinkTraversal, name)
+	case !fi.IsDir():
+		return err
+	}
+	return nil
+}
+
+// mkdirAll creates the directory dir along with its missing parents.
+func (x *extraction) mkdirAll(dir string) error {
+	if dir == "." {
+		return nil
+	}
+	if err := x.mkdirAll(path.Dir(dir)); err != nil {
+		return err
+	}
+	return x.mkdir(dir, 0755)
+}
+
+// create creates the regular file name with the data of content. Only the reads of content run
+// concurrently with the other calls of parallel extractions.
+func (x *extraction) create(name string, perm fs.FileMode, content io.Reader) error {
+	x.mu.Lock()
+	w, err := x.dst.Create(name, perm)
+	if err == nil {
+		x.created = append(x.created, name)
+	}
+	x.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	var h hash.Hash
+	if x.digests != nil {
+		h = x.hash()
+		content = io.TeeReader(content, h)
+	}
+	_, err = io.Copy(lockedWriter{&x.mu, w}, contextReader{x.ctx, content})
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && h != nil {
+		x.digests[name] = h.Sum(nil)
+	}
+	return err
+}
+
+// lockedWriter holds mu while writing to w.
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (l lockedWriter) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(b)
+}
+
+// contextReader fails the reads of r once ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(b []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
+
+// finish sets the modification times of the directories, which were changed by writing their
+// entries.
+func (x *extraction) finish() error {
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		if err := x.dst.Chtimes(x.dirs[i].name, x.dirs[i].mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollback removes everything the extraction created, in reverse order. Errors are ignored, as
+// the extraction is failing already.
+func (x *extraction) rollback() {
+	for i := len(x.created) - 1; i >= 0; i-- {
+		x.dst.Remove(x.created[i])
+		delete(x.digests, x.created[i])
+	}
+	x.created = nil
+}
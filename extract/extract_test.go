@@ -0,0 +1,636 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extract
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/internal/archivetest"
+	"github.com/google/safearchive/tar"
+	szip "github.com/google/safearchive/zip"
+)
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+var (
+	now   = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	past  = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock = fixedClock(now)
+)
+
+func names(m *MemFS) []string {
+	var re []string
+	for n := range m.Files {
+		re = append(re, n)
+	}
+	sort.Strings(re)
+	return re
+}
+
+func TestTar(t *testing.T) {
+	archive := archivetest.Tar(t, []archivetest.Entry{
+		{Name: "dir/", Type: tar.TypeDir, ModTime: past},
+		{Name: "dir/a.txt", Type: tar.TypeReg, Content: []byte("hello"), ModTime: past},
+		{Name: "deep/er/b.txt", Type: tar.TypeReg, Content: []byte("future"), ModTime: now.Add(time.Hour)},
+		{Name: "link", Type: tar.TypeSymlink, Linkname: "dir/a.txt"},
+		{Name: "hard", Type: tar.TypeLink, Linkname: "dir/a.txt"},
+		{Name: "fifo", Type: tar.TypeFifo},
+	})
+
+	dst := NewMemFS()
+	tr := tar.NewReader(bytes.NewReader(archive))
+	tr.SetSecurityMode(tr.GetSecurityMode() &^ tar.SkipSpecialFiles)
+	if err := Tar(dst, tr, Options{Clock: clock}); err != nil {
+		t.Fatalf("Tar() error = %v", err)
+	}
+
+	if want := []string{"deep", "deep/er", "deep/er/b.txt", "dir", "dir/a.txt", "link"}; !reflect.DeepEqual(names(dst), want) {
+		t.Errorf("extracted %q, want %q", names(dst), want)
+	}
+	if got := string(dst.Files["dir/a.txt"].Data); got != "hello" {
+		t.Errorf("dir/a.txt = %q, want %q", got, "hello")
+	}
+	if f := dst.Files["link"]; f.Mode&fs.ModeSymlink == 0 || string(f.Data) != "dir/a.txt" {
+		t.Errorf("link = %v %q, want a symbolic link to dir/a.txt", f.Mode, f.Data)
+	}
+	for name, want := range map[string]time.Time{"dir": past, "dir/a.txt": past, "deep/er/b.txt": now} {
+		if got := dst.Files[name].ModTime; !got.Equal(want) {
+			t.Errorf("modification time of %s = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestZip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	files := []struct {
+		name    string
+		mode    fs.FileMode
+		content string
+	}{
+		{"dir/", fs.ModeDir | 0755, ""},
+		{"dir/a.txt", 0644, "hello"},
+		{"link", fs.ModeSymlink | 0777, "dir/a.txt"},
+	}
+	for _, f := range files {
+		h := &zip.FileHeader{Name: f.name, Method: zip.Deflate, Modified: past}
+		h.SetMode(f.mode)
+		w, err := zw.CreateHeader(h)
+		if err != nil {
+			t.Fatalf("CreateHeader(%q) error = %v", f.name, err)
+		}
+		w.Write([]byte(f.content))
+	}
+	zw.Close()
+
+	r, err := szip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	r.SetSecurityMode(szip.SanitizeFilenames)
+	dst := NewMemFS()
+	if err := Zip(dst, r, Options{Clock: clock}); err != nil {
+		t.Fatalf("Zip() error = %v", err)
+	}
+	if want := []string{"dir", "dir/a.txt", "link"}; !reflect.DeepEqual(names(dst), want) {
+		t.Errorf("extracted %q, want %q", names(dst), want)
+	}
+	if got := string(dst.Files["link"].Data); got != "dir/a.txt" {
+		t.Errorf("target of link = %q, want %q", got, "dir/a.txt")
+	}
+	if got := dst.Files["dir/a.txt"].ModTime; !got.Equal(past) {
+		t.Errorf("modification time of dir/a.txt = %v, want %v", got, past)
+	}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestSubtree(t *testing.T) {
+	archive := archivetest.Tar(t, []archivetest.Entry{
+		{Name: "usr/", Type: tar.TypeDir, ModTime: past},
+		{Name: "usr/lib/a.so", Type: tar.TypeReg, Content: []byte("a"), ModTime: past},
+		{Name: "usr/lib64/b.so", Type: tar.TypeReg, Content: []byte("b"), ModTime: past},
+		{Name: "../usr/lib/x/c.so", Type: tar.TypeReg, Content: []byte("c"), ModTime: past},
+		{Name: "etc/passwd", Type: tar.TypeReg, Content: []byte("root"), ModTime: past},
+	})
+	dst := NewMemFS()
+	if err := Tar(dst, tar.NewReader(bytes.NewReader(archive)), Options{Clock: clock, Subtree: "usr/lib"}); err != nil {
+		t.Fatalf("Tar() error = %v", err)
+	}
+	if want := []string{"usr", "usr/lib", "usr/lib/a.so", "usr/lib/x", "usr/lib/x/c.so"}; !reflect.DeepEqual(names(dst), want) {
+		t.Errorf("extracted %q, want %q", names(dst), want)
+	}
+
+	// Entries outside of the subtree are not opened, so they may even use unsupported compression
+	// methods.
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	zw.RegisterCompressor(99, func(w io.Writer) (io.WriteCloser, error) { return nopWriteCloser{w}, nil })
+	for _, f := range []struct {
+		name   string
+		method uint16
+	}{
+		{"usr/lib/a.so", zip.Deflate},
+		{"opt/blob", 99},
+	} {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: f.method, Modified: past})
+		if err != nil {
+			t.Fatalf("CreateHeader(%q) error = %v", f.name, err)
+		}
+		w.Write([]byte("data"))
+	}
+	zw.Close()
+	r, err := szip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	dst = NewMemFS()
+	if err := Zip(dst, r, Options{Clock: clock, Subtree: "usr/lib"}); err != nil {
+		t.Fatalf("Zip() error = %v", err)
+	}
+	if want := []string{"usr", "usr/lib", "usr/lib/a.so"}; !reflect.DeepEqual(names(dst), want) {
+		t.Errorf("extracted %q, want %q", names(dst), want)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	archive := archivetest.Tar(t, []archivetest.Entry{
+		{Name: "a.txt", Type: tar.TypeReg, Content: []byte("a")},
+		{Name: "dir/b.txt", Type: tar.TypeReg, Content: []byte("b")},
+		{Name: "dir/c.txt", Type: tar.TypeReg, Content: []byte("c")},
+	})
+	tests := []struct {
+		name        string
+		op, file    string
+		err         error
+		keepPartial bool
+		wantEntry   string
+		want        []string
+	}{
+		{name: "disk full", op: "write", file: "dir/b.txt", err: syscall.ENOSPC, wantEntry: "dir/b.txt"},
+		{name: "permission denied", op: "create", file: "dir/c.txt", err: syscall.EPERM, wantEntry: "dir/c.txt"},
+		{name: "directory", op: "mkdir", file: "dir", err: syscall.EPERM, wantEntry: "dir/b.txt"},
+		{name: "keep partial", op: "write", file: "dir/c.txt", err: syscall.ENOSPC, keepPartial: true, wantEntry: "dir/c.txt", want: []string{"a.txt", "dir", "dir/b.txt", "dir/c.txt"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dst := NewMemFS()
+			dst.Fail = func(op, name string) error {
+				if op == tc.op && name == tc.file {
+					return tc.err
+				}
+				return nil
+			}
+			err := Tar(dst, tar.NewReader(bytes.NewReader(archive)), Options{Clock: clock, KeepPartial: tc.keepPartial})
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("Tar() error = %v, want %v", err, tc.err)
+			}
+			var ee *safearchive.EntryError
+			if !errors.As(err, &ee) || ee.Name != tc.wantEntry {
+				t.Errorf("Tar() error = %v, want an EntryError about %s", err, tc.wantEntry)
+			}
+			if got := names(dst); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("after the failure the file system has %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestContext(t *testing.T) {
+	archive := archivetest.Tar(t, []archivetest.Entry{
+		{Name: "a.txt", Type: tar.TypeReg, Content: []byte("a")},
+		{Name: "b.txt", Type: tar.TypeReg, Content: []byte("b")},
+		{Name: "c.txt", Type: tar.TypeReg, Content: []byte("c")},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dst := NewMemFS()
+	dst.Fail = func(op, name string) error {
+		if op == "create" && name == "b.txt" {
+			cancel()
+		}
+		return nil
+	}
+	err := TarContext(ctx, dst, tar.NewReader(bytes.NewReader(archive)), Options{Clock: clock})
+	var ee *safearchive.EntryError
+	if !errors.Is(err, context.Canceled) || !errors.As(err, &ee) || ee.Name != "b.txt" {
+		t.Errorf("TarContext() error = %v, want an EntryError about b.txt wrapping %v", err, context.Canceled)
+	}
+	if got := names(dst); len(got) != 0 {
+		t.Errorf("after the cancellation the file system has %q, want nothing", got)
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	zw.Create("a.txt")
+	zw.Close()
+	r, err := szip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	if err := ZipContext(ctx, NewMemFS(), r, Options{Clock: clock}); !errors.Is(err, context.Canceled) {
+		t.Errorf("ZipContext() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	type file struct {
+		name    string
+		mode    fs.FileMode
+		content string
+	}
+	files := []file{{"dir/", fs.ModeDir | 0755, ""}, {"link", fs.ModeSymlink | 0777, "dir"}}
+	for i := 0; i < 50; i++ {
+		files = append(files, file{fmt.Sprintf("dir/sub%d/f%d.txt", i%5, i), 0644, strings.Repeat(fmt.Sprint(i), 1000)})
+	}
+	for _, f := range files {
+		h := &zip.FileHeader{Name: f.name, Method: zip.Deflate, Modified: past}
+		h.SetMode(f.mode)
+		w, err := zw.CreateHeader(h)
+		if err != nil {
+			t.Fatalf("CreateHeader(%q) error = %v", f.name, err)
+		}
+		w.Write([]byte(f.content))
+	}
+	zw.Close()
+	r, err := szip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+
+	sequential, parallel := NewMemFS(), NewMemFS()
+	sequentialDigests, parallelDigests := map[string][]byte{}, map[string][]byte{}
+	if err := Zip(sequential, r, Options{Clock: clock, Digests: sequentialDigests}); err != nil {
+		t.Fatalf("Zip() error = %v", err)
+	}
+	if err := Zip(parallel, r, Options{Clock: clock, Concurrency: 4, Digests: parallelDigests}); err != nil {
+		t.Fatalf("Zip() with Concurrency error = %v", err)
+	}
+	if !reflect.DeepEqual(parallel.Files, sequential.Files) {
+		t.Errorf("parallel extraction = %q, want %q", names(parallel), names(sequential))
+	}
+	if len(parallelDigests) != 50 || !reflect.DeepEqual(parallelDigests, sequentialDigests) {
+		t.Errorf("parallel extraction digests = %x, want %x", parallelDigests, sequentialDigests)
+	}
+
+	dst := NewMemFS()
+	dst.Fail = func(op, name string) error {
+		if op == "write" && name == "dir/sub3/f23.txt" {
+			return syscall.ENOSPC
+		}
+		return nil
+	}
+	err = Zip(dst, r, Options{Clock: clock, Concurrency: 4})
+	var ee *safearchive.EntryError
+	if !errors.Is(err, syscall.ENOSPC) || !errors.As(err, &ee) || ee.Name != "dir/sub3/f23.txt" {
+		t.Errorf("Zip() error = %v, want an EntryError about dir/sub3/f23.txt wrapping %v", err, syscall.ENOSPC)
+	}
+	if got := names(dst); len(got) != 0 {
+		t.Errorf("after the failure the file system has %q, want nothing", got)
+	}
+
+	// the entries written through a symbolic link of the archive fail the paranoid checks, even
+	// though the links are created last
+	buf.Reset()
+	zw = zip.NewWriter(&buf)
+	h := &zip.FileHeader{Name: "link"}
+	h.SetMode(fs.ModeSymlink | 0777)
+	w, _ := zw.CreateHeader(h)
+	w.Write([]byte("etc"))
+	zw.Create("link/passwd")
+	zw.Close()
+	r, err = szip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	r.SetSecurityMode(szip.SanitizeFilenames)
+	if err := Zip(NewMemFS(), r, Options{Clock: clock, Concurrency: 4, Paranoid: true}); !errors.Is(err, safearchive.ErrSymlinkTraversal) {
+		t.Errorf("paranoid Zip() with Concurrency error = %v, want %v", err, safearchive.ErrSymlinkTraversal)
+	}
+
+	// and so do their targets
+	buf.Reset()
+	zw = zip.NewWriter(&buf)
+	w, _ = zw.CreateHeader(h)
+	w.Write([]byte("/etc"))
+	zw.Close()
+	r, err = szip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	r.SetSecurityMode(szip.SanitizeFilenames)
+	if err := Zip(NewMemFS(), r, Options{Clock: clock, Concurrency: 4, Paranoid: true}); !errors.Is(err, safearchive.ErrSymlinkTarget) {
+		t.Errorf("paranoid Zip() with Concurrency error = %v, want %v", err, safearchive.ErrSymlinkTarget)
+	}
+}
+
+func TestDigests(t *testing.T) {
+	archive := archivetest.Tar(t, []archivetest.Entry{
+		{Name: "dir/", Type: tar.TypeDir},
+		{Name: "dir/a.txt", Type: tar.TypeReg, Content: []byte("hello")},
+		{Name: "empty", Type: tar.TypeReg},
+		{Name: "link", Type: tar.TypeSymlink, Linkname: "dir/a.txt"},
+	})
+	sum := func(s string) []byte {
+		d := sha256.Sum256([]byte(s))
+		return d[:]
+	}
+
+	digests := map[string][]byte{}
+	if err := Tar(NewMemFS(), tar.NewReader(bytes.NewReader(archive)), Options{Clock: clock, Digests: digests}); err != nil {
+		t.Fatalf("Tar() error = %v", err)
+	}
+	if want := map[string][]byte{"dir/a.txt": sum("hello"), "empty": sum("")}; !reflect.DeepEqual(digests, want) {
+		t.Errorf("Tar() digests = %x, want %x", digests, want)
+	}
+
+	md5s := map[string][]byte{}
+	if err := Tar(NewMemFS(), tar.NewReader(bytes.NewReader(archive)), Options{Clock: clock, Digests: md5s, Hash: md5.New}); err != nil {
+		t.Fatalf("Tar() with Hash error = %v", err)
+	}
+	if want := md5.Sum([]byte("hello")); !bytes.Equal(md5s["dir/a.txt"], want[:]) {
+		t.Errorf("Tar() with Hash digest of dir/a.txt = %x, want %x", md5s["dir/a.txt"], want)
+	}
+
+	dst := NewMemFS()
+	dst.Fail = func(op, name string) error {
+		if op == "create" && name == "empty" {
+			return syscall.ENOSPC
+		}
+		return nil
+	}
+	rolledBack := map[string][]byte{}
+	if err := Tar(dst, tar.NewReader(bytes.NewReader(archive)), Options{Clock: clock, Digests: rolledBack}); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("Tar() error = %v, want %v", err, syscall.ENOSPC)
+	}
+	if len(rolledBack) != 0 {
+		t.Errorf("Tar() rolled back digests = %x, want none", rolledBack)
+	}
+}
+
+func TestInvalidName(t *testing.T) {
+	archive := archivetest.Tar(t, []archivetest.Entry{{Name: "../evil.txt", Type: tar.TypeReg}})
+	tr := tar.NewReader(bytes.NewReader(archive))
+	tr.SetSecurityMode(0)
+	dst := NewMemFS()
+	if err := Tar(dst, tr, Options{Clock: clock}); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("Tar() error = %v, want %v", err, ErrInvalidName)
+	}
+	if len(dst.Files) != 0 {
+		t.Errorf("Tar() extracted %q", names(dst))
+	}
+}
+
+func TestDirFS(t *testing.T) {
+	entries := []archivetest.Entry{
+		{Name: "dir/a.txt", Type: tar.TypeReg, Content: []byte("hello"), ModTime: past},
+		{Name: "b.txt", Type: tar.TypeReg, Content: []byte("world"), ModTime: now.Add(time.Hour)},
+	}
+	if runtime.GOOS != "windows" {
+		entries = append(entries, archivetest.Entry{Name: "link", Type: tar.TypeSymlink, Linkname: "b.txt"})
+	}
+	dir := t.TempDir()
+	if err := Tar(DirFS(dir), tar.NewReader(bytes.NewReader(archivetest.Tar(t, entries))), Options{Clock: clock}); err != nil {
+		t.Fatalf("Tar() error = %v", err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "dir", "a.txt"))
+	if err != nil || string(b) != "hello" {
+		t.Errorf("ReadFile(dir/a.txt) = %q, %v, want %q", b, err, "hello")
+	}
+	fi, err := os.Stat(filepath.Join(dir, "b.txt"))
+	if err != nil {
+		t.Fatalf("Stat(b.txt) error = %v", err)
+	}
+	if !fi.ModTime().Equal(now) {
+		t.Errorf("modification time of b.txt = %v, want %v", fi.ModTime(), now)
+	}
+	if runtime.GOOS != "windows" {
+		if target, err := os.Readlink(filepath.Join(dir, "link")); err != nil || target != "b.txt" {
+			t.Errorf("Readlink(link) = %q, %v, want %q", target, err, "b.txt")
+		}
+	}
+
+	// existing files are never overwritten
+	err = Tar(DirFS(dir), tar.NewReader(bytes.NewReader(archivetest.Tar(t, entries[1:2]))), Options{Clock: clock})
+	if !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Tar() over an existing file error = %v, want %v", err, fs.ErrExist)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b.txt")); err != nil {
+		t.Errorf("Tar() rolled back a file it did not create: %v", err)
+	}
+}
+
+func TestExistingNonDirectory(t *testing.T) {
+	archive := archivetest.Tar(t, []archivetest.Entry{{Name: "dir/a.txt", Type: tar.TypeReg, Content: []byte("hello")}})
+	for _, tc := range []struct {
+		name    string
+		file    *MemFile
+		wantErr error
+	}{
+		{name: "symlink", file: &MemFile{Mode: fs.ModeSymlink | 0777, Data: []byte("/etc")}, wantErr: safearchive.ErrSymlinkTraversal},
+		{name: "file", file: &MemFile{Mode: 0644}, wantErr: fs.ErrExist},
+	} {
+		dst := NewMemFS()
+		dst.Files["dir"] = tc.file
+		if err := Tar(dst, tar.NewReader(bytes.NewReader(archive)), Options{Clock: clock}); !errors.Is(err, tc.wantErr) {
+			t.Errorf("Tar() over a %s error = %v, want %v", tc.name, err, tc.wantErr)
+		}
+		if got := names(dst); !reflect.DeepEqual(got, []string{"dir"}) {
+			t.Errorf("Tar() over a %s left %q, want [dir]", tc.name, got)
+		}
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	dir, outside := t.TempDir(), t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dir, "dir")); err != nil {
+		t.Fatal(err)
+	}
+	if err := Tar(DirFS(dir), tar.NewReader(bytes.NewReader(archive)), Options{Clock: clock}); !errors.Is(err, safearchive.ErrSymlinkTraversal) {
+		t.Errorf("Tar() through a symbolic link of the destination error = %v, want %v", err, safearchive.ErrSymlinkTraversal)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "a.txt")); err == nil {
+		t.Errorf("Tar() wrote through a symbolic link of the destination")
+	}
+}
+
+func TestPrivileges(t *testing.T) {
+	archive := archivetest.Tar(t, []archivetest.Entry{
+		{Name: "a.txt", Type: tar.TypeReg, Content: []byte("a")},
+		{Name: "link", Type: tar.TypeSymlink, Linkname: "a.txt"},
+		{Name: "b.txt", Type: tar.TypeReg, Content: []byte("b")},
+	})
+	noSymlinks := func(op, name string) error {
+		if op == OpSymlink {
+			return syscall.EPERM
+		}
+		return nil
+	}
+
+	dst := NewMemFS()
+	dst.Fail = noSymlinks
+	if got := NotPermitted(dst); len(got) != 1 || got[OpSymlink] == nil {
+		t.Errorf("NotPermitted() = %v, want %s", got, OpSymlink)
+	}
+	err := Tar(dst, tar.NewReader(bytes.NewReader(archive)), Options{Clock: clock})
+	var ee *safearchive.EntryError
+	if !errors.Is(err, ErrNotPermitted) || !errors.As(err, &ee) || ee.Name != "link" {
+		t.Errorf("Tar() error = %v, want an EntryError about link wrapping %v", err, ErrNotPermitted)
+	}
+	if len(dst.Files) != 0 {
+		t.Errorf("Tar() left %q behind", names(dst))
+	}
+
+	dst = NewMemFS()
+	dst.Fail = noSymlinks
+	report := &safearchive.Report{}
+	if err := Tar(dst, tar.NewReader(bytes.NewReader(archive)), Options{Clock: clock, Privileges: SkipNotPermitted, Report: report}); err != nil {
+		t.Fatalf("Tar() error = %v", err)
+	}
+	if want := []string{"a.txt", "b.txt"}; !reflect.DeepEqual(names(dst), want) {
+		t.Errorf("extracted %q, want %q", names(dst), want)
+	}
+	if len(report.Findings) != 1 || report.Findings[0].Name != "link" || report.Findings[0].Reason != ReasonNotPermitted {
+		t.Errorf("Report = %+v, want a finding about link", report.Findings)
+	}
+	if s := safearchive.Summarize(report); s.Health != safearchive.HealthClean || s.Counts[ReasonNotPermitted] != 1 {
+		t.Errorf("Summarize() = %+v, want a clean archive with a degraded entry", s)
+	}
+
+	// zip extractions fail before extracting anything
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range []struct {
+		name string
+		mode fs.FileMode
+	}{{"a.txt", 0644}, {"link", fs.ModeSymlink | 0777}} {
+		h := &zip.FileHeader{Name: f.name, Modified: past}
+		h.SetMode(f.mode)
+		w, err := zw.CreateHeader(h)
+		if err != nil {
+			t.Fatalf("CreateHeader(%q) error = %v", f.name, err)
+		}
+		w.Write([]byte("a.txt"))
+	}
+	zw.Close()
+	r, err := szip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	dst = NewMemFS()
+	dst.Fail = func(op, name string) error {
+		if op == "create" {
+			t.Errorf("Zip() created %s before failing", name)
+		}
+		return noSymlinks(op, name)
+	}
+	if err := Zip(dst, r, Options{Clock: clock, KeepPartial: true}); !errors.Is(err, ErrNotPermitted) {
+		t.Errorf("Zip() error = %v, want %v", err, ErrNotPermitted)
+	}
+}
+
+func TestParanoid(t *testing.T) {
+	tests := []struct {
+		name     string
+		entries  []archivetest.Entry
+		existing string
+		want     error
+	}{
+		{
+			name:    "link in the archive",
+			entries: []archivetest.Entry{{Name: "link", Type: tar.TypeSymlink, Linkname: "etc"}, {Name: "link/passwd", Type: tar.TypeReg, Content: []byte("x")}},
+			want:    safearchive.ErrSymlinkTraversal,
+		},
+		{
+			name:    "absolute target",
+			entries: []archivetest.Entry{{Name: "link", Type: tar.TypeSymlink, Linkname: "/etc"}},
+			want:    safearchive.ErrSymlinkTarget,
+		},
+		{
+			name:    "escaping target",
+			entries: []archivetest.Entry{{Name: "dir/link", Type: tar.TypeSymlink, Linkname: "../.."}},
+			want:    safearchive.ErrSymlinkTarget,
+		},
+		{
+			name:    "target escaping through a link",
+			entries: []archivetest.Entry{{Name: "d/l1", Type: tar.TypeSymlink, Linkname: ".."}, {Name: "d/l2", Type: tar.TypeSymlink, Linkname: "l1/.."}},
+			want:    safearchive.ErrSymlinkTarget,
+		},
+		{
+			name:     "target through a link of the destination",
+			entries:  []archivetest.Entry{{Name: "link", Type: tar.TypeSymlink, Linkname: "out/passwd"}},
+			existing: "out",
+			want:     safearchive.ErrSymlinkTarget,
+		},
+		{
+			name:     "link in the destination",
+			entries:  []archivetest.Entry{{Name: "out/a.txt", Type: tar.TypeReg, Content: []byte("x")}},
+			existing: "out",
+			want:     safearchive.ErrSymlinkTraversal,
+		},
+		{
+			name:     "directory over a link",
+			entries:  []archivetest.Entry{{Name: "out/", Type: tar.TypeDir}},
+			existing: "out",
+			want:     safearchive.ErrSymlinkTraversal,
+		},
+		{
+			name:    "safe",
+			entries: []archivetest.Entry{{Name: "dir/a.txt", Type: tar.TypeReg, Content: []byte("x")}, {Name: "link", Type: tar.TypeSymlink, Linkname: "dir"}},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dst := NewMemFS()
+			if tc.existing != "" {
+				dst.Files[tc.existing] = &MemFile{Mode: fs.ModeSymlink | 0777, Data: []byte("/tmp")}
+			}
+			tr := tar.NewReader(bytes.NewReader(archivetest.Tar(t, tc.entries)))
+			tr.SetSecurityMode(0)
+			err := Tar(dst, tr, Options{Clock: clock, Paranoid: true})
+			if !errors.Is(err, tc.want) {
+				t.Errorf("Tar() error = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package extract
+
+import (
+	"path/filepath"
+
+	"github.com/google/safearchive/sanitizer"
+)
+
+// osPath returns the path of the operating system to use for p: paths longer than MAX_PATH get the
+// extended-length prefix, so deep archive trees extract reliably.
+func osPath(p string) string {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return p
+	}
+	return sanitizer.ExtendedLengthPath(abs)
+}
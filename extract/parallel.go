@@ -0,0 +1,147 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extract
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"sync"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/sanitizer"
+	"github.com/google/safearchive/zip"
+)
+
+// zipFile is a regular file or a symbolic link of a parallel extraction, to be written to name.
+type zipFile struct {
+	f    *zip.File
+	name string
+	// e is the entry of the symbolic links, with their target
+	e safearchive.Entry
+}
+
+// zipParallel extracts the entries of r with opts.Concurrency goroutines, see Options.Concurrency.
+func (x *extraction) zipParallel(r *zip.Reader, opts Options) error {
+	// the directories and the checks of the names, in the order of the archive
+	var files, links []zipFile
+	for _, f := range r.File {
+		if err := x.ctx.Err(); err != nil {
+			return err
+		}
+		if !sanitizer.InSubtree(f.Name, opts.Subtree) {
+			continue
+		}
+		e := zip.EntryOf(f)
+		switch {
+		case e.Mode.IsDir(), e.Mode.IsRegular(), e.Mode&fs.ModeSymlink != 0:
+		default:
+			continue
+		}
+		if e.Mode&fs.ModeSymlink != 0 {
+			// the target is checked by paranoid extractions
+			var rc io.ReadCloser
+			var err error
+			if e, rc, err = openZipEntry(f); err != nil {
+				return err
+			}
+			rc.Close()
+		}
+		name, err := x.prepare(e)
+		if err != nil {
+			return err
+		}
+		switch {
+		case e.Mode.IsDir():
+			if err := x.mkdir(name, e.Mode.Perm()|0700); err != nil {
+				return safearchive.NewEntryError(e.Name, "", err)
+			}
+			x.dirs = append(x.dirs, dirTime{name, x.modTime(e.ModTime)})
+		case e.Mode.IsRegular():
+			files = append(files, zipFile{f: f, name: name})
+		default:
+			links = append(links, zipFile{f: f, name: name, e: e})
+			if x.paranoid {
+				// so the entries written through the link fail as in sequential extractions
+				x.links[name] = true
+			}
+		}
+	}
+
+	if err := x.zipFiles(files, opts.Concurrency); err != nil {
+		return err
+	}
+
+	for _, l := range links {
+		if err := x.ctx.Err(); err != nil {
+			return err
+		}
+		if err := x.symlink(l.e, l.name); err != nil {
+			return err
+		}
+	}
+	return x.finish()
+}
+
+// zipFiles writes files with n goroutines. It returns the first error, which stops the others.
+func (x *extraction) zipFiles(files []zipFile, n int) error {
+	ctx, cancel := context.WithCancel(x.ctx)
+	defer cancel()
+	parent := x.ctx
+	x.ctx = ctx
+	defer func() { x.ctx = parent }()
+
+	var (
+		once     sync.Once
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	work := make(chan zipFile)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for zf := range work {
+				if err := x.zipFile(zf); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+	for _, zf := range files {
+		if ctx.Err() != nil {
+			break
+		}
+		work <- zf
+	}
+	close(work)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return parent.Err()
+}
+
+func (x *extraction) zipFile(zf zipFile) error {
+	e, rc, err := openZipEntry(zf.f)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return x.file(e, zf.name, rc)
+}
@@ -0,0 +1,97 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extract
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/sanitizer"
+)
+
+// Lstater is implemented by the WriteFS that can describe a file without following symbolic
+// links. Extractions use it to refuse creating directories through the symbolic links of the
+// destination, and paranoid extractions to refuse writing anything through them, including the
+// ones that existed before the extraction.
+type Lstater interface {
+	// Lstat returns a FileInfo describing name. If name is a symbolic link, it describes the link.
+	Lstat(name string) (fs.FileInfo, error)
+}
+
+// verify is the final check of a paranoid extraction, right before writing the entry e to name.
+// It does not trust the reader: name must be left unchanged by sanitizer.SanitizePath, and neither
+// name nor its parents may be symbolic links, whether created by the extraction or found in the
+// destination. The target of a symbolic link must resolve within the destination, following the
+// links created before, and must not go through the links found in the destination.
+func (x *extraction) verify(e safearchive.Entry, name string) error {
+	if filepath.ToSlash(strings.TrimSuffix(sanitizer.SanitizePath(name), string(filepath.Separator))) != name {
+		return safearchive.NewEntryError(e.Name, safearchive.NameReason(e.Name), ErrInvalidName)
+	}
+	p, err := x.linkOn(name, true)
+	if err != nil {
+		return safearchive.NewEntryError(e.Name, "", err)
+	}
+	if p != "" {
+		return safearchive.NewEntryError(e.Name, safearchive.ReasonSymlinkTraversal, fmt.Errorf("%w: %s", safearchive.ErrSymlinkTraversal, p))
+	}
+	if e.Mode&fs.ModeSymlink == 0 {
+		return nil
+	}
+	target := filepath.ToSlash(e.Linkname)
+	if sanitizer.SanitizeLinkTarget(name, e.Linkname) != e.Linkname || !x.targets.AddLink(name, target) {
+		return safearchive.NewEntryError(e.Name, safearchive.ReasonSymlinkTarget, fmt.Errorf("%w: %s", safearchive.ErrSymlinkTarget, e.Linkname))
+	}
+	p, err = x.linkOn(path.Join(path.Dir(name), target), false)
+	if err != nil {
+		return safearchive.NewEntryError(e.Name, "", err)
+	}
+	if p != "" {
+		return safearchive.NewEntryError(e.Name, safearchive.ReasonSymlinkTarget, fmt.Errorf("%w: %s through %s", safearchive.ErrSymlinkTarget, e.Linkname, p))
+	}
+	return nil
+}
+
+// linkOn returns the first of name and its parents that is a symbolic link of the destination, or
+// "" if there are none. The links created by the extraction count only if created is set.
+func (x *extraction) linkOn(name string, created bool) (string, error) {
+	l, _ := x.dst.(Lstater)
+	parts := strings.Split(name, "/")
+	for i := 1; i <= len(parts); i++ {
+		p := strings.Join(parts[:i], "/")
+		if x.links[p] {
+			if created {
+				return p, nil
+			}
+			// the links of the archive were checked when they were created
+			continue
+		}
+		if l == nil {
+			continue
+		}
+		fi, err := l.Lstat(p)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		if err == nil && fi.Mode()&fs.ModeSymlink != 0 {
+			return p, nil
+		}
+	}
+	return "", nil
+}
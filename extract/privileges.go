@@ -0,0 +1,111 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extract
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/google/safearchive"
+)
+
+// OpSymlink is the operation of creating a symbolic link, which needs privileges on some
+// platforms (e.g. Windows without developer mode).
+const OpSymlink = "symlink"
+
+// privilegedOps are the operations of an extraction that may need privileges.
+var privilegedOps = []string{OpSymlink}
+
+// ErrNotPermitted is wrapped (into a safearchive.EntryError) by the errors of extracting an entry
+// that needs an operation the destination does not permit.
+var ErrNotPermitted = errors.New("extract: operation not permitted")
+
+// ReasonNotPermitted is the reason of the findings about entries skipped because the destination
+// does not permit the operation extracting them, see SkipNotPermitted.
+const ReasonNotPermitted safearchive.Reason = "not-permitted"
+
+// Prober is implemented by the WriteFS that can tell in advance whether they permit an operation
+// needing privileges, so extractions can decide before writing anything.
+type Prober interface {
+	// Probe returns a non-nil error if the operation op (e.g. OpSymlink) is not permitted.
+	Probe(op string) error
+}
+
+// PrivilegePolicy is what an extraction does with the entries needing an operation the
+// destination does not permit.
+type PrivilegePolicy int
+
+const (
+	// FailNotPermitted fails the extraction with an error wrapping ErrNotPermitted. Zip
+	// extractions fail before extracting anything; tar extractions fail at the first such entry,
+	// as the entries are not known in advance, and are rolled back unless KeepPartial is set.
+	FailNotPermitted PrivilegePolicy = iota
+	// SkipNotPermitted skips the entries and reports them in Options.Report with
+	// ReasonNotPermitted, so the extraction degrades gracefully.
+	SkipNotPermitted
+)
+
+// NotPermitted returns the operations needing privileges that dst does not permit, along with the
+// errors of probing them. A WriteFS that does not implement Prober is assumed to permit every
+// operation; an extraction still degrades if an operation then fails with fs.ErrPermission.
+func NotPermitted(dst WriteFS) map[string]error {
+	re := map[string]error{}
+	p, ok := dst.(Prober)
+	if !ok {
+		return re
+	}
+	for _, op := range privilegedOps {
+		if err := p.Probe(op); err != nil {
+			re[op] = err
+		}
+	}
+	return re
+}
+
+// notPermitted handles an entry needing the operation op, which the destination does not permit.
+func (x *extraction) notPermitted(e safearchive.Entry, op string, cause error) error {
+	if x.privileges == SkipNotPermitted {
+		if x.report != nil {
+			x.report.Add(safearchive.Finding{
+				Name:     e.Name,
+				Offset:   -1,
+				Reason:   ReasonNotPermitted,
+				Action:   safearchive.ActionDropped,
+				Severity: safearchive.SeverityInfo,
+				Detail:   fmt.Sprintf("%s not permitted: %v", op, cause),
+			})
+		}
+		return nil
+	}
+	return safearchive.NewEntryError(e.Name, ReasonNotPermitted, fmt.Errorf("%w: %s: %v", ErrNotPermitted, op, cause))
+}
+
+// symlink creates a symbolic link, unless the destination does not permit it.
+func (x *extraction) symlink(e safearchive.Entry, name string) error {
+	if cause, ok := x.denied[OpSymlink]; ok {
+		return x.notPermitted(e, OpSymlink, cause)
+	}
+	err := x.dst.Symlink(e.Linkname, name)
+	if errors.Is(err, fs.ErrPermission) {
+		return x.notPermitted(e, OpSymlink, err)
+	}
+	if err != nil {
+		return safearchive.NewEntryError(e.Name, "", err)
+	}
+	x.created = append(x.created, name)
+	x.links[name] = true
+	return nil
+}
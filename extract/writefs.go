@@ -0,0 +1,272 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extract
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// WriteFS is the file system an extraction writes to. Names are slash separated paths relative to
+// the root of the file system, as in io/fs.
+// Implementations need not be safe for concurrent use.
+type WriteFS interface {
+	// Mkdir creates a directory. It fails with an error wrapping fs.ErrExist if name exists.
+	Mkdir(name string, perm fs.FileMode) error
+	// Create creates a regular file for writing. It fails with an error wrapping fs.ErrExist if
+	// name exists.
+	Create(name string, perm fs.FileMode) (io.WriteCloser, error)
+	// Symlink creates name as a symbolic link to oldname.
+	Symlink(oldname, name string) error
+	// Remove removes a file or an empty directory.
+	Remove(name string) error
+	// Chtimes changes the modification time of a file or directory.
+	Chtimes(name string, mtime time.Time) error
+}
+
+// dirFS is a WriteFS rooted at a directory of the operating system.
+type dirFS string
+
+// DirFS returns a WriteFS writing to the directory dir of the operating system. On Windows, the
+// paths longer than MAX_PATH are used with the extended-length prefix \\?\.
+func DirFS(dir string) WriteFS {
+	return dirFS(dir)
+}
+
+// join returns the path of the operating system of name. fs.ValidPath alone would accept the
+// backslashes and volume names that Windows interprets, e.g. ..\evil or C:evil.
+func (d dirFS) join(op, name string) (string, error) {
+	if !fs.ValidPath(name) || !filepath.IsLocal(filepath.FromSlash(name)) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return osPath(filepath.Join(string(d), filepath.FromSlash(name))), nil
+}
+
+func (d dirFS) Mkdir(name string, perm fs.FileMode) error {
+	p, err := d.join("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(p, perm)
+}
+
+func (d dirFS) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	p, err := d.join("create", name)
+	if err != nil {
+		return nil, err
+	}
+	// O_EXCL also refuses to follow a symbolic link planted at name
+	return os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+}
+
+func (d dirFS) Symlink(oldname, name string) error {
+	p, err := d.join("symlink", name)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(filepath.FromSlash(oldname), p)
+}
+
+func (d dirFS) Remove(name string) error {
+	p, err := d.join("remove", name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func (d dirFS) Chtimes(name string, mtime time.Time) error {
+	p, err := d.join("chtimes", name)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(p, mtime, mtime)
+}
+
+func (d dirFS) Lstat(name string) (fs.FileInfo, error) {
+	p, err := d.join("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Lstat(p)
+}
+
+// Probe tries the operation op in a temporary directory created in the directory.
+func (d dirFS) Probe(op string) error {
+	if op != OpSymlink {
+		return nil
+	}
+	tmp, err := os.MkdirTemp(string(d), ".probe")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	return os.Symlink("target", filepath.Join(tmp, "link"))
+}
+
+// MemFS is an in-memory WriteFS for testing extraction flows deterministically, including file
+// system failures in the middle of an extraction.
+type MemFS struct {
+	// Files is the content of the file system, indexed by the names of the files.
+	Files map[string]*MemFile
+	// Fail, if set, is called before every operation with the name of the operation ("mkdir",
+	// "create", "write", "symlink", "remove" or "chtimes") and the name of the file. A non-nil
+	// return value fails the operation, e.g. syscall.ENOSPC to simulate a full disk. Probe calls it
+	// with an empty name.
+	Fail func(op, name string) error
+}
+
+// MemFile is a file of a MemFS. Directories have fs.ModeDir set, symbolic links have
+// fs.ModeSymlink set and their target as Data.
+type MemFile struct {
+	Data    []byte
+	Mode    fs.FileMode
+	ModTime time.Time
+}
+
+// NewMemFS returns an empty MemFS.
+func NewMemFS() *MemFS {
+	return &MemFS{Files: map[string]*MemFile{}}
+}
+
+// check validates an operation on name, which must not exist if create is set.
+func (m *MemFS) check(op, name string, create bool) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if m.Fail != nil {
+		if err := m.Fail(op, name); err != nil {
+			return &fs.PathError{Op: op, Path: name, Err: err}
+		}
+	}
+	if !create {
+		if _, ok := m.Files[name]; !ok {
+			return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		return nil
+	}
+	if _, ok := m.Files[name]; ok {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrExist}
+	}
+	if dir := path.Dir(name); dir != "." {
+		if f, ok := m.Files[dir]; !ok || !f.Mode.IsDir() {
+			return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+	}
+	return nil
+}
+
+// Probe reports whether Fail permits the operation op.
+func (m *MemFS) Probe(op string) error {
+	if m.Fail != nil {
+		return m.Fail(op, "")
+	}
+	return nil
+}
+
+func (m *MemFS) Mkdir(name string, perm fs.FileMode) error {
+	if err := m.check("mkdir", name, true); err != nil {
+		return err
+	}
+	m.Files[name] = &MemFile{Mode: fs.ModeDir | perm.Perm()}
+	return nil
+}
+
+func (m *MemFS) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	if err := m.check("create", name, true); err != nil {
+		return nil, err
+	}
+	f := &MemFile{Mode: perm.Perm()}
+	m.Files[name] = f
+	return &memFile{fs: m, name: name, f: f}, nil
+}
+
+func (m *MemFS) Symlink(oldname, name string) error {
+	if err := m.check("symlink", name, true); err != nil {
+		return err
+	}
+	m.Files[name] = &MemFile{Mode: fs.ModeSymlink | 0777, Data: []byte(oldname)}
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	if err := m.check("remove", name, false); err != nil {
+		return err
+	}
+	prefix := name + "/"
+	for n := range m.Files {
+		if strings.HasPrefix(n, prefix) {
+			return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrExist}
+		}
+	}
+	delete(m.Files, name)
+	return nil
+}
+
+// Lstat describes name without following symbolic links. It does not call Fail.
+func (m *MemFS) Lstat(name string) (fs.FileInfo, error) {
+	f, ok := m.Files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: fs.ErrNotExist}
+	}
+	return memInfo{name: path.Base(name), f: f}, nil
+}
+
+func (m *MemFS) Chtimes(name string, mtime time.Time) error {
+	if err := m.check("chtimes", name, false); err != nil {
+		return err
+	}
+	m.Files[name].ModTime = mtime
+	return nil
+}
+
+// memFile is a regular file of a MemFS open for writing.
+type memFile struct {
+	fs   *MemFS
+	name string
+	f    *MemFile
+}
+
+func (w *memFile) Write(b []byte) (int, error) {
+	if w.fs.Fail != nil {
+		if err := w.fs.Fail("write", w.name); err != nil {
+			return 0, &fs.PathError{Op: "write", Path: w.name, Err: err}
+		}
+	}
+	w.f.Data = append(w.f.Data, b...)
+	return len(b), nil
+}
+
+func (w *memFile) Close() error {
+	return nil
+}
+
+// memInfo describes a file of a MemFS.
+type memInfo struct {
+	name string
+	f    *MemFile
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return int64(len(i.f.Data)) }
+func (i memInfo) Mode() fs.FileMode  { return i.f.Mode }
+func (i memInfo) ModTime() time.Time { return i.f.ModTime }
+func (i memInfo) IsDir() bool        { return i.f.Mode.IsDir() }
+func (i memInfo) Sys() any           { return nil }
@@ -0,0 +1,65 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package extract
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDirFSWindowsNames(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "a", "b")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	dst := DirFS(dir)
+	for _, name := range []string{`..\..\evil`, `..\evil`, `x\..\..\evil`, `C:evil`, `C:\evil`, `\\host\share\evil`, `NUL`} {
+		if w, err := dst.Create(name, 0644); !errors.Is(err, fs.ErrInvalid) {
+			if err == nil {
+				w.Close()
+			}
+			t.Errorf("Create(%q) error = %v, want %v", name, err, fs.ErrInvalid)
+		}
+		if err := dst.Mkdir(name, 0755); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("Mkdir(%q) error = %v, want %v", name, err, fs.ErrInvalid)
+		}
+		if err := dst.Symlink("target", name); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("Symlink(%q) error = %v, want %v", name, err, fs.ErrInvalid)
+		}
+		if err := dst.Remove(name); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("Remove(%q) error = %v, want %v", name, err, fs.ErrInvalid)
+		}
+		if err := dst.Chtimes(name, time.Now()); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("Chtimes(%q) error = %v, want %v", name, err, fs.ErrInvalid)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "evil")); err == nil {
+		t.Errorf("DirFS wrote outside of its directory")
+	}
+
+	w, err := dst.Create("ok.txt", 0644)
+	if err != nil {
+		t.Fatalf("Create(ok.txt) error = %v", err)
+	}
+	w.Close()
+}
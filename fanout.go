@@ -0,0 +1,66 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"path"
+	"strings"
+)
+
+// FanOutLimiter limits the number of direct children of the directories of an archive. Archives
+// with millions of files in a single directory degrade many file systems and the processes
+// indexing them.
+// The zero value allows everything.
+type FanOutLimiter struct {
+	// Max is the maximum number of direct children of a directory. Zero means no limit.
+	Max int
+
+	seen     map[string]bool
+	children map[string]int
+}
+
+// Allow reports whether the entry name (a sanitized, forward slash separated path) fits within
+// the limit, and if so, records it along with its parent directories. Entries with the same name
+// are counted once.
+func (l *FanOutLimiter) Allow(name string) bool {
+	if l.Max <= 0 {
+		return true
+	}
+	if l.seen == nil {
+		l.seen = map[string]bool{}
+		l.children = map[string]int{}
+	}
+	name = path.Clean(strings.TrimPrefix(name, "/"))
+	if name == "." {
+		return true
+	}
+	var added []string
+	for p := name; p != "."; p = path.Dir(p) {
+		if l.seen[p] {
+			break
+		}
+		added = append(added, p)
+	}
+	for _, p := range added {
+		if l.children[path.Dir(p)] >= l.Max {
+			return false
+		}
+	}
+	for _, p := range added {
+		l.seen[p] = true
+		l.children[path.Dir(p)]++
+	}
+	return true
+}
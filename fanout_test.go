@@ -0,0 +1,45 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import "testing"
+
+func TestFanOutLimiter(t *testing.T) {
+	l := FanOutLimiter{Max: 2}
+	for _, tc := range []struct {
+		name string
+		want bool
+	}{
+		{"a/1", true},
+		{"a/2", true},
+		{"a/2", true},
+		{"a/3", false},
+		{"b", true},
+		{"c/x", false},
+		{"a/1/deep", true},
+		{"./b/", true},
+	} {
+		if got := l.Allow(tc.name); got != tc.want {
+			t.Errorf("Allow(%q) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	var unlimited FanOutLimiter
+	for _, name := range []string{"1", "2", "3"} {
+		if !unlimited.Allow(name) {
+			t.Errorf("zero FanOutLimiter rejected %q", name)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FeatureKind is the kind of a capability of the safearchive packages.
+type FeatureKind string
+
+const (
+	// FeatureFormat is an archive or compression format a package can read.
+	FeatureFormat FeatureKind = "format"
+	// FeatureRule is a security feature of a reader (e.g. a bit of its SecurityMode).
+	FeatureRule FeatureKind = "rule"
+	// FeatureOption is a configurable behavior of a reader (e.g. a limit).
+	FeatureOption FeatureKind = "option"
+)
+
+// Feature is a capability compiled into the binary.
+type Feature struct {
+	// Package is the name of the package providing the feature, e.g. "tar".
+	Package string `json:"package"`
+	// Kind is the kind of the feature.
+	Kind FeatureKind `json:"kind"`
+	// Name identifies the feature within the package and kind, e.g. "StrictMode".
+	Name string `json:"name"`
+}
+
+func (f Feature) String() string {
+	return f.Package + ":" + string(f.Kind) + ":" + f.Name
+}
+
+// ErrMissingFeature is wrapped by the errors of RequireFeatures.
+var ErrMissingFeature = errors.New("safearchive: missing feature")
+
+var (
+	featuresMu sync.Mutex
+	features   = map[Feature]bool{}
+)
+
+// RegisterFeatures records features as compiled into the binary. The safearchive packages call it
+// from their init functions, including the ones that depend on build tags.
+func RegisterFeatures(fs ...Feature) {
+	featuresMu.Lock()
+	defer featuresMu.Unlock()
+	for _, f := range fs {
+		features[f] = true
+	}
+}
+
+// Features returns the formats, rules and options of the safearchive packages compiled into the
+// binary, sorted by package, kind and name. Only the packages linked into the binary contribute
+// their features, so orchestration layers can verify at startup that a deployment has the
+// protections its policy requires (see RequireFeatures).
+func Features() []Feature {
+	featuresMu.Lock()
+	defer featuresMu.Unlock()
+	re := make([]Feature, 0, len(features))
+	for f := range features {
+		re = append(re, f)
+	}
+	sort.Slice(re, func(i, j int) bool {
+		a, b := re[i], re[j]
+		if a.Package != b.Package {
+			return a.Package < b.Package
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Name < b.Name
+	})
+	return re
+}
+
+// RequireFeatures returns an error wrapping ErrMissingFeature listing the required features that
+// are not compiled into the binary, or nil if all of them are.
+func RequireFeatures(required ...Feature) error {
+	featuresMu.Lock()
+	defer featuresMu.Unlock()
+	var missing []string
+	for _, f := range required {
+		if !features[f] {
+			missing = append(missing, f.String())
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s", ErrMissingFeature, strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFeatures(t *testing.T) {
+	a := Feature{Package: "test", Kind: FeatureRule, Name: "B"}
+	b := Feature{Package: "test", Kind: FeatureFormat, Name: "test"}
+	c := Feature{Package: "test", Kind: FeatureRule, Name: "A"}
+	RegisterFeatures(a, b)
+	RegisterFeatures(c, a)
+
+	var got []Feature
+	for _, f := range Features() {
+		if f.Package == "test" {
+			got = append(got, f)
+		}
+	}
+	want := []Feature{b, c, a}
+	if len(got) != len(want) {
+		t.Fatalf("Features() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Features()[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	if err := RequireFeatures(a, b); err != nil {
+		t.Errorf("RequireFeatures(%v, %v) error = %v", a, b, err)
+	}
+	missing := Feature{Package: "test", Kind: FeatureOption, Name: "Missing"}
+	err := RequireFeatures(a, missing)
+	if !errors.Is(err, ErrMissingFeature) || err.Error() != "safearchive: missing feature: test:option:Missing" {
+		t.Errorf("RequireFeatures(%v, %v) error = %v, want an error about %v", a, missing, err, missing)
+	}
+}
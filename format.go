@@ -0,0 +1,275 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Format is an archive format recognized by DetectFormat.
+type Format int
+
+const (
+	// FormatUnknown means the format was not recognized.
+	FormatUnknown Format = iota
+	// FormatTar is an uncompressed tar archive.
+	FormatTar
+	// FormatTarGzip is a gzip compressed tar archive.
+	FormatTarGzip
+	// FormatGzip is a gzip compressed stream that does not look like a tar archive.
+	FormatGzip
+	// FormatZip is a zip archive.
+	FormatZip
+	// Format7z is a 7-Zip archive. The safearchive packages cannot read it.
+	Format7z
+	// FormatTarBzip2 is a bzip2 compressed tar archive.
+	FormatTarBzip2
+	// FormatBzip2 is a bzip2 compressed stream that does not look like a tar archive.
+	FormatBzip2
+	// FormatXz is an xz compressed stream. DetectFormat cannot decompress it to tell if it is a tar
+	// archive.
+	FormatXz
+	// FormatZstd is a zstd compressed stream. DetectFormat cannot decompress it to tell if it is a
+	// tar archive.
+	FormatZstd
+	// FormatTarXz is an xz compressed tar archive. It is only reported by readers that decompressed
+	// the stream, e.g. the safearchive/archive package.
+	FormatTarXz
+	// FormatTarZstd is a zstd compressed tar archive. It is only reported by readers that
+	// decompressed the stream, e.g. the safearchive/archive package.
+	FormatTarZstd
+	// FormatISO is an ISO 9660 or UDF disk image. It is only recognized by DetectFormatAt, as its
+	// magic bytes are beyond DetectLen.
+	FormatISO
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatTar:
+		return "tar"
+	case FormatTarGzip:
+		return "tar+gzip"
+	case FormatGzip:
+		return "gzip"
+	case FormatZip:
+		return "zip"
+	case Format7z:
+		return "7z"
+	case FormatTarBzip2:
+		return "tar+bzip2"
+	case FormatBzip2:
+		return "bzip2"
+	case FormatXz:
+		return "xz"
+	case FormatZstd:
+		return "zstd"
+	case FormatTarXz:
+		return "tar+xz"
+	case FormatTarZstd:
+		return "tar+zstd"
+	case FormatISO:
+		return "iso"
+	}
+	return "unknown"
+}
+
+// Confidence tells how certain DetectFormat is about its verdict.
+type Confidence int
+
+const (
+	// ConfidenceNone accompanies FormatUnknown.
+	ConfidenceNone Confidence = iota
+	// ConfidenceLow means some, but not all the structural checks passed.
+	ConfidenceLow
+	// ConfidenceMedium means the format was recognized by heuristics, e.g. a tar header without the
+	// ustar magic but with a valid checksum.
+	ConfidenceMedium
+	// ConfidenceHigh means the magic bytes and the structural checks matched.
+	ConfidenceHigh
+)
+
+// DetectLen is the number of leading bytes DetectFormat needs to recognize every format.
+// Compressed formats are recognized with fewer bytes too, but the format of the compressed payload
+// may remain undetected.
+const DetectLen = 4096
+
+const tarBlockSize = 512
+
+var (
+	zipLocalMagic = []byte("PK\x03\x04")
+	zipEndMagic   = []byte("PK\x05\x06")
+	zipSpanMagic  = []byte("PK\x07\x08")
+	gzipMagic     = []byte("\x1f\x8b\x08")
+	sevenZipMagic = []byte("7z\xbc\xaf\x27\x1c")
+	bzip2Magic    = []byte("BZh")
+	xzMagic       = []byte("\xfd7zXZ\x00")
+	zstdMagic     = []byte("\x28\xb5\x2f\xfd")
+	// isoMagic is the identifier of the first volume descriptor of an ISO 9660 image, at
+	// isoMagicOffset.
+	isoMagic = []byte("CD001")
+	// udfMagic is the identifier of the first descriptor of the volume recognition sequence of the
+	// UDF images without an ISO 9660 file system, at isoMagicOffset. The descriptor of the UDF
+	// revision follows it.
+	udfMagic = []byte("BEA01")
+)
+
+const isoMagicOffset = 16*2048 + 1
+
+// DetectFormat detects the format of an archive based on its first bytes, which should be at
+// least DetectLen long (or the whole archive, if shorter).
+// Tar archives without the ustar magic (e.g. Unix V7 archives) are recognized by validating the
+// header checksum.
+func DetectFormat(prefix []byte) (Format, Confidence) {
+	switch {
+	case bytes.HasPrefix(prefix, zipLocalMagic), bytes.HasPrefix(prefix, zipEndMagic):
+		return FormatZip, ConfidenceHigh
+	case bytes.HasPrefix(prefix, zipSpanMagic):
+		return FormatZip, ConfidenceMedium
+	case bytes.HasPrefix(prefix, sevenZipMagic):
+		return Format7z, ConfidenceHigh
+	case bytes.HasPrefix(prefix, gzipMagic):
+		return detectGzip(prefix)
+	case bytes.HasPrefix(prefix, xzMagic):
+		return FormatXz, ConfidenceHigh
+	case bytes.HasPrefix(prefix, zstdMagic):
+		return FormatZstd, ConfidenceHigh
+	case len(prefix) > 3 && bytes.HasPrefix(prefix, bzip2Magic) && prefix[3] >= '1' && prefix[3] <= '9':
+		return detectBzip2(prefix)
+	}
+	if c := detectTar(prefix); c != ConfidenceNone {
+		return FormatTar, c
+	}
+	return FormatUnknown, ConfidenceNone
+}
+
+// DetectFormatAt is like DetectFormat, but reads the archive from r. Zip archives with leading data
+// (e.g. self-extracting executables) are recognized by their end of central directory record, and
+// ISO 9660 and UDF images by their first volume descriptors.
+func DetectFormatAt(r io.ReaderAt, size int64) (Format, Confidence, error) {
+	n := int64(DetectLen)
+	if n > size {
+		n = size
+	}
+	prefix := make([]byte, n)
+	if _, err := r.ReadAt(prefix, 0); err != nil && err != io.EOF {
+		return FormatUnknown, ConfidenceNone, err
+	}
+	if f, c := DetectFormat(prefix); f != FormatUnknown {
+		return f, c, nil
+	}
+	if size >= isoMagicOffset+int64(len(isoMagic)) {
+		magic := make([]byte, len(isoMagic))
+		if _, err := r.ReadAt(magic, isoMagicOffset); err != nil && err != io.EOF {
+			return FormatUnknown, ConfidenceNone, err
+		}
+		if bytes.Equal(magic, isoMagic) {
+			return FormatISO, ConfidenceHigh, nil
+		}
+		if bytes.Equal(magic, udfMagic) {
+			if _, err := r.ReadAt(magic, isoMagicOffset+2048); err == nil && (string(magic) == "NSR02" || string(magic) == "NSR03") {
+				return FormatISO, ConfidenceHigh, nil
+			}
+		}
+	}
+
+	// The end of central directory record is 22 bytes long, followed by a comment of at most 64KiB.
+	n = 22 + 0xffff
+	if n > size {
+		n = size
+	}
+	tail := make([]byte, n)
+	if _, err := r.ReadAt(tail, size-n); err != nil && err != io.EOF {
+		return FormatUnknown, ConfidenceNone, err
+	}
+	if i := bytes.LastIndex(tail, zipEndMagic); i >= 0 && len(tail)-i >= 22 {
+		commentLen := int(binary.LittleEndian.Uint16(tail[i+20:]))
+		if i+22+commentLen == len(tail) {
+			return FormatZip, ConfidenceMedium, nil
+		}
+	}
+	return FormatUnknown, ConfidenceNone, nil
+}
+
+func detectGzip(prefix []byte) (Format, Confidence) {
+	zr, err := gzip.NewReader(bytes.NewReader(prefix))
+	if err != nil {
+		return FormatGzip, ConfidenceLow
+	}
+	block := make([]byte, tarBlockSize)
+	n, _ := io.ReadFull(zr, block)
+	if c := detectTar(block[:n]); c != ConfidenceNone {
+		return FormatTarGzip, c
+	}
+	return FormatGzip, ConfidenceHigh
+}
+
+func detectBzip2(prefix []byte) (Format, Confidence) {
+	block := make([]byte, tarBlockSize)
+	n, err := io.ReadFull(bzip2.NewReader(bytes.NewReader(prefix)), block)
+	if c := detectTar(block[:n]); c != ConfidenceNone {
+		return FormatTarBzip2, c
+	}
+	if n == 0 && err != io.EOF {
+		// bzip2 decompresses whole blocks of up to 900kB, so the first one may be truncated
+		return FormatBzip2, ConfidenceLow
+	}
+	return FormatBzip2, ConfidenceHigh
+}
+
+// detectTar reports how much the first block of prefix looks like a tar header.
+func detectTar(prefix []byte) Confidence {
+	if len(prefix) < tarBlockSize {
+		return ConfidenceNone
+	}
+	block := prefix[:tarBlockSize]
+	magic := block[257:265]
+	hasMagic := bytes.Equal(magic[:6], []byte("ustar\x00")) || bytes.Equal(magic, []byte("ustar  \x00"))
+	validChecksum := tarChecksumValid(block)
+	switch {
+	case hasMagic && validChecksum:
+		return ConfidenceHigh
+	case validChecksum && block[0] != 0:
+		// V7 header: no magic, but a non-empty name and a valid checksum
+		return ConfidenceMedium
+	case hasMagic:
+		return ConfidenceLow
+	}
+	return ConfidenceNone
+}
+
+// tarChecksumValid verifies the checksum of a tar header block. Historic implementations summed
+// signed bytes, both variants are accepted.
+func tarChecksumValid(block []byte) bool {
+	field := strings.Trim(string(block[148:156]), " \x00")
+	want, err := strconv.ParseInt(field, 8, 64)
+	if err != nil {
+		return false
+	}
+	var unsigned, signed int64
+	for i, b := range block {
+		if i >= 148 && i < 156 {
+			b = ' '
+		}
+		unsigned += int64(b)
+		signed += int64(int8(b))
+	}
+	return want == unsigned || want == signed
+}
@@ -0,0 +1,143 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"archive/tar" // NOLINT
+	"archive/zip" // NOLINT
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+func makeTar(t *testing.T) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "a.txt", Mode: 0644, Size: 1, Typeflag: tar.TypeReg, Format: tar.FormatUSTAR}); err != nil {
+		t.Fatalf("WriteHeader() error = %v", err)
+	}
+	tw.Write([]byte("a"))
+	tw.Close()
+	return buf.Bytes()
+}
+
+// makeV7Tar turns the first header of a ustar archive into a V7 one by clearing the magic.
+func makeV7Tar(t *testing.T) []byte {
+	b := makeTar(t)
+	for i := 257; i < 345; i++ {
+		b[i] = 0
+	}
+	for i := 148; i < 156; i++ {
+		b[i] = ' '
+	}
+	var sum int
+	for _, c := range b[:512] {
+		sum += int(c)
+	}
+	copy(b[148:], fmt.Sprintf("%06o\x00 ", sum))
+	return b
+}
+
+func gzipped(b []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(b)
+	zw.Close()
+	return buf.Bytes()
+}
+
+func makeZip(t *testing.T) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	fw, _ := zw.Create("a.txt")
+	fw.Write([]byte("a"))
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	return buf.Bytes()
+}
+
+// bzip2 -9 compressed streams of traverse.tar (from the corpus) and of "hello".
+var (
+	tarBzip2, _   = hex.DecodeString("425a6839314159265359c92edb120000925b90c8804001f584030066c2de400401000820007223d540347a9a000f487a822927aa7941a01ea07a9a0ab861c8fc244829bf6e78753660760d1b0a40843f73c5bc4cd5e0c00d9e6d044eb7896ec2bc6b055808c9a5e681117538c5b26e64c90942d2e7f871c5e8714cc43f177245385090c92edb12")
+	helloBzip2, _ = hex.DecodeString("425a68393141592653591931653d00000081000244a000219a68334d07338bb9229c28480c98b29e80")
+)
+
+func TestDetectFormat(t *testing.T) {
+	corruptedTar := makeTar(t)
+	corruptedTar[0] = 'b'
+
+	tests := []struct {
+		name           string
+		in             []byte
+		wantFormat     Format
+		wantConfidence Confidence
+	}{
+		{name: "tar", in: makeTar(t), wantFormat: FormatTar, wantConfidence: ConfidenceHigh},
+		{name: "v7 tar", in: makeV7Tar(t), wantFormat: FormatTar, wantConfidence: ConfidenceMedium},
+		{name: "tar with bad checksum", in: corruptedTar, wantFormat: FormatTar, wantConfidence: ConfidenceLow},
+		{name: "tar.gz", in: gzipped(makeTar(t)), wantFormat: FormatTarGzip, wantConfidence: ConfidenceHigh},
+		{name: "gzip", in: gzipped([]byte("hello")), wantFormat: FormatGzip, wantConfidence: ConfidenceHigh},
+		{name: "zip", in: makeZip(t), wantFormat: FormatZip, wantConfidence: ConfidenceHigh},
+		{name: "7z", in: []byte("7z\xbc\xaf\x27\x1c\x00\x04"), wantFormat: Format7z, wantConfidence: ConfidenceHigh},
+		{name: "tar.bz2", in: tarBzip2, wantFormat: FormatTarBzip2, wantConfidence: ConfidenceHigh},
+		{name: "bzip2", in: helloBzip2, wantFormat: FormatBzip2, wantConfidence: ConfidenceHigh},
+		{name: "truncated bzip2", in: tarBzip2[:64], wantFormat: FormatBzip2, wantConfidence: ConfidenceLow},
+		{name: "xz", in: []byte("\xfd7zXZ\x00\x00\x04"), wantFormat: FormatXz, wantConfidence: ConfidenceHigh},
+		{name: "zstd", in: []byte("\x28\xb5\x2f\xfd\x04\x00"), wantFormat: FormatZstd, wantConfidence: ConfidenceHigh},
+		{name: "text", in: bytes.Repeat([]byte("hello world "), 100), wantFormat: FormatUnknown, wantConfidence: ConfidenceNone},
+		{name: "zeros", in: make([]byte, 1024), wantFormat: FormatUnknown, wantConfidence: ConfidenceNone},
+	}
+	for _, tc := range tests {
+		f, c := DetectFormat(tc.in)
+		if f != tc.wantFormat || c != tc.wantConfidence {
+			t.Errorf("DetectFormat(%s) = %v, %v, want %v, %v", tc.name, f, c, tc.wantFormat, tc.wantConfidence)
+		}
+	}
+}
+
+func TestDetectFormatAtSelfExtracting(t *testing.T) {
+	in := append(bytes.Repeat([]byte("MZ stub "), 1000), makeZip(t)...)
+	f, c, err := DetectFormatAt(bytes.NewReader(in), int64(len(in)))
+	if err != nil {
+		t.Fatalf("DetectFormatAt() error = %v", err)
+	}
+	if f != FormatZip || c != ConfidenceMedium {
+		t.Errorf("DetectFormatAt() = %v, %v, want %v, %v", f, c, FormatZip, ConfidenceMedium)
+	}
+}
+
+func TestDetectFormatAtISO(t *testing.T) {
+	iso := make([]byte, 20*2048)
+	copy(iso[16*2048:], "\x01CD001\x01")
+	udf := make([]byte, 20*2048)
+	copy(udf[16*2048:], "\x00BEA01\x01")
+	copy(udf[17*2048:], "\x00NSR02\x01")
+	for _, in := range [][]byte{iso, udf} {
+		f, c, err := DetectFormatAt(bytes.NewReader(in), int64(len(in)))
+		if err != nil {
+			t.Fatalf("DetectFormatAt() error = %v", err)
+		}
+		if f != FormatISO || c != ConfidenceHigh {
+			t.Errorf("DetectFormatAt() = %v, %v, want %v, %v", f, c, FormatISO, ConfidenceHigh)
+		}
+	}
+}
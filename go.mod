@@ -2,4 +2,4 @@ module github.com/google/safearchive
 
 go 1.21
 
-require github.com/google/go-cmp v0.6.0 // indirect
+require github.com/google/go-cmp v0.6.0
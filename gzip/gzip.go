@@ -0,0 +1,114 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gzip is a drop-in replacement for the reader of compress/gzip with protection against
+// decompression bombs.
+//
+// The Reader limits the size of the decompressed data and the ratio of the decompressed and
+// compressed sizes, over all the members of multi-member (concatenated) streams, so pipelines like
+//
+//	zr, err := gzip.NewReader(r)
+//	if err != nil {
+//		return err
+//	}
+//	tr := tar.NewReader(zr)
+//
+// are protected end to end. By default, only the expansion ratio is limited, to the maximum ratio
+// of DEFLATE, which no legitimate stream exceeds. Reading a stream exceeding a limit fails with an
+// error wrapping ErrLimitExceeded.
+package gzip
+
+import (
+	"compress/gzip" // NOLINT
+	"io"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/decompress"
+)
+
+// MaxDeflateRatio is the maximum ratio of the decompressed and compressed sizes of DEFLATE data.
+const MaxDeflateRatio = 1032
+
+// Header is the gzip file header.
+type Header = gzip.Header
+
+var (
+	// ErrChecksum is returned when reading GZIP data that has an invalid checksum.
+	ErrChecksum = gzip.ErrChecksum
+	// ErrHeader is returned when reading GZIP data that has an invalid header.
+	ErrHeader = gzip.ErrHeader
+)
+
+// Errors of streams exceeding the limits of the Reader. All of them wrap ErrLimitExceeded.
+var (
+	ErrLimitExceeded = decompress.ErrLimitExceeded
+	ErrOutputSize    = decompress.ErrOutputSize
+	ErrRatio         = decompress.ErrRatio
+)
+
+// Limits are the limits of the decompressed data of a Reader, over all the members of the stream.
+// Zero values mean no limit.
+type Limits = decompress.Limits
+
+// DefaultLimits are the limits of the readers created by NewReader.
+var DefaultLimits = Limits{MaxRatio: MaxDeflateRatio}
+
+func init() {
+	safearchive.RegisterFeatures(
+		safearchive.Feature{Package: "gzip", Kind: safearchive.FeatureFormat, Name: "gzip"},
+		safearchive.Feature{Package: "gzip", Kind: safearchive.FeatureOption, Name: "MaxOutputSize"},
+		safearchive.Feature{Package: "gzip", Kind: safearchive.FeatureOption, Name: "MaxRatio"},
+	)
+}
+
+// A Reader is an io.Reader that can be read to retrieve uncompressed data from a gzip-format
+// compressed file, enforcing its Limits. See compress/gzip for the details of the format, of
+// multi-member streams and of the Header of the Reader.
+type Reader struct {
+	*gzip.Reader
+	meter *decompress.Meter
+}
+
+// NewReader creates a new Reader reading the given reader, with DefaultLimits.
+func NewReader(r io.Reader) (*Reader, error) {
+	return NewReaderWithLimits(r, DefaultLimits)
+}
+
+// NewReaderWithLimits creates a new Reader reading the given reader, with the given limits.
+func NewReaderWithLimits(r io.Reader, l Limits) (*Reader, error) {
+	m := decompress.NewMeter(r, l)
+	zr, err := gzip.NewReader(m.Compressed())
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{Reader: zr, meter: m}, nil
+}
+
+// Limits returns the limits of the Reader.
+func (z *Reader) Limits() Limits {
+	return z.meter.Limits()
+}
+
+// Reset discards the state of the Reader and makes it equivalent to the result of its original
+// state from NewReaderWithLimits, but reading from r instead. The limits are kept.
+func (z *Reader) Reset(r io.Reader) error {
+	z.meter.Reset(r)
+	return z.Reader.Reset(z.meter.Compressed())
+}
+
+// Read implements io.Reader, reading uncompressed bytes from its underlying reader. Once the
+// stream exceeded a limit, Read keeps returning the same error.
+func (z *Reader) Read(p []byte) (int, error) {
+	return z.meter.Read(z.Reader, p)
+}
@@ -0,0 +1,158 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gzip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/tar"
+)
+
+func gzipBytes(t *testing.T, members ...string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	for _, m := range members {
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(m))
+		if err := zw.Close(); err != nil {
+			t.Fatalf("gzip.Writer.Close() error = %v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestReader(t *testing.T) {
+	bomb := strings.Repeat("\x00", 10<<20)
+	tests := []struct {
+		name    string
+		members []string
+		limits  Limits
+		want    string
+		wantErr error
+	}{
+		{
+			name:    "multi-member",
+			members: []string{"hello, ", "world"},
+			limits:  DefaultLimits,
+			want:    "hello, world",
+		},
+		{
+			name:    "output size",
+			members: []string{"hello, ", "world"},
+			limits:  Limits{MaxOutputSize: 10},
+			want:    "hello, wor",
+			wantErr: ErrOutputSize,
+		},
+		{
+			name:    "exact output size",
+			members: []string{"hello, ", "world"},
+			limits:  Limits{MaxOutputSize: 12},
+			want:    "hello, world",
+		},
+		{
+			name:    "ratio",
+			members: []string{bomb},
+			limits:  Limits{MaxRatio: 100},
+			wantErr: ErrRatio,
+		},
+		{
+			name:    "ratio within deflate limits",
+			members: []string{bomb},
+			limits:  DefaultLimits,
+			want:    bomb,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			zr, err := NewReaderWithLimits(bytes.NewReader(gzipBytes(t, tc.members...)), tc.limits)
+			if err != nil {
+				t.Fatalf("NewReaderWithLimits() error = %v", err)
+			}
+			got, err := io.ReadAll(zr)
+			if tc.wantErr == nil {
+				if err != nil {
+					t.Fatalf("Read() error = %v", err)
+				}
+				if string(got) != tc.want {
+					t.Errorf("Read() = %q, want %q", got, tc.want)
+				}
+				return
+			}
+			if !errors.Is(err, tc.wantErr) || !errors.Is(err, safearchive.ErrLimitExceeded) {
+				t.Fatalf("Read() error = %v, want %v", err, tc.wantErr)
+			}
+			if tc.want != "" && string(got) != tc.want {
+				t.Errorf("Read() = %q, want %q", got, tc.want)
+			}
+			if _, err := zr.Read(make([]byte, 1)); !errors.Is(err, tc.wantErr) {
+				t.Errorf("Read() after the limit error = %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestReset(t *testing.T) {
+	data := gzipBytes(t, "hello")
+	zr, err := NewReaderWithLimits(bytes.NewReader(data), Limits{MaxOutputSize: 5})
+	if err != nil {
+		t.Fatalf("NewReaderWithLimits() error = %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if got, err := io.ReadAll(zr); err != nil || string(got) != "hello" {
+			t.Errorf("Read() = %q, %v, want %q", got, err, "hello")
+		}
+		if err := zr.Reset(bytes.NewReader(data)); err != nil {
+			t.Fatalf("Reset() error = %v", err)
+		}
+	}
+	if _, err := NewReader(strings.NewReader("not a gzip stream")); !errors.Is(err, ErrHeader) {
+		t.Errorf("NewReader() error = %v, want %v", err, ErrHeader)
+	}
+}
+
+func TestTarPipeline(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	tw.WriteHeader(&tar.Header{Name: "big", Typeflag: tar.TypeReg, Mode: 0644, Size: 100})
+	tw.Write(make([]byte, 100))
+	tw.Close()
+	zw.Close()
+
+	zr, err := NewReaderWithLimits(&buf, Limits{MaxOutputSize: 512})
+	if err != nil {
+		t.Fatalf("NewReaderWithLimits() error = %v", err)
+	}
+	tr := tar.NewReader(zr)
+	var lastErr error
+	for {
+		if _, lastErr = tr.Next(); lastErr != nil {
+			break
+		}
+		if _, lastErr = io.Copy(io.Discard, tr); lastErr != nil {
+			break
+		}
+	}
+	if !errors.Is(lastErr, ErrOutputSize) {
+		t.Errorf("reading the tar archive error = %v, want %v", lastErr, ErrOutputSize)
+	}
+}
@@ -0,0 +1,388 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !safearchive_hardened
+// +build !safearchive_hardened
+
+// Package httpupload glues the safearchive readers to net/http file uploads.
+//
+// Web services accepting user supplied archives all need to do the same: check the size of the
+// upload, figure out what kind of archive it is, make sure it matches what the client claimed and
+// hand it over to a reader with the desired security features enabled. This package does exactly
+// that:
+//
+//	u, err := httpupload.FormFile(req, "archive", httpupload.Policy{MaxSize: 10 << 20})
+//	if err != nil {
+//		// reject the upload
+//	}
+//	defer u.Close()
+//	if u.Zip != nil {
+//		// iterate u.Zip.File
+//	} else {
+//		// iterate u.Tar.Next()
+//	}
+//
+// Setting Policy.Inspect also reports the entries of the upload and their findings in
+// Upload.Report, e.g. to store an audit record of the uploads along with them.
+//
+// The package is not available in the hardened profile, see safearchive.Hardened.
+package httpupload
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/inspect"
+	"github.com/google/safearchive/tar"
+	"github.com/google/safearchive/zip"
+)
+
+const (
+	// DefaultMaxSize is the maximum size of an upload if Policy.MaxSize is not set.
+	DefaultMaxSize = 32 << 20
+	// DefaultMaxRatio is the maximum compression ratio of the entries of zip uploads if
+	// Policy.MaxRatio is not set.
+	DefaultMaxRatio = 100
+)
+
+var (
+	// ErrTooLarge is returned when the upload (or its decompressed form, or the sizes declared by
+	// its entries) exceeds the limits of the Policy.
+	ErrTooLarge = errors.New("httpupload: upload too large")
+	// ErrUnsupportedFormat is returned when the upload is not an archive of an allowed format.
+	ErrUnsupportedFormat = errors.New("httpupload: unsupported archive format")
+	// ErrContentTypeMismatch is returned when the declared content type of the upload does not
+	// match its actual format.
+	ErrContentTypeMismatch = errors.New("httpupload: content type does not match the archive format")
+)
+
+// Format is the format of an uploaded archive.
+type Format string
+
+const (
+	// FormatTar is an uncompressed tar archive.
+	FormatTar Format = "tar"
+	// FormatTarGzip is a gzip compressed tar archive.
+	FormatTarGzip Format = "tar+gzip"
+	// FormatZip is a zip archive.
+	FormatZip Format = "zip"
+)
+
+// formats maps the detected formats to the supported upload formats.
+var formats = map[safearchive.Format]Format{
+	safearchive.FormatTar:     FormatTar,
+	safearchive.FormatTarGzip: FormatTarGzip,
+	safearchive.FormatZip:     FormatZip,
+}
+
+// contentTypes maps declared content types to the formats they may carry.
+var contentTypes = map[string][]Format{
+	"application/zip":              {FormatZip},
+	"application/x-zip":            {FormatZip},
+	"application/x-zip-compressed": {FormatZip},
+	"application/x-tar":            {FormatTar},
+	"application/gzip":             {FormatTarGzip},
+	"application/x-gzip":           {FormatTarGzip},
+	"application/x-gtar":           {FormatTarGzip},
+	"application/x-tgz":            {FormatTarGzip},
+	"application/x-compressed-tar": {FormatTarGzip},
+	"application/octet-stream":     {FormatTar, FormatTarGzip, FormatZip},
+}
+
+// Policy controls which uploads are accepted and how they are read.
+type Policy struct {
+	// MaxSize is the maximum size of the upload in bytes. DefaultMaxSize is used if not set.
+	MaxSize int64
+	// MaxUncompressedSize is the maximum size of the decompressed stream of compressed tar
+	// archives, and of the total size declared by the entries of zip archives. Four times MaxSize
+	// is used if not set.
+	MaxUncompressedSize int64
+	// MaxRatio is the maximum ratio of the uncompressed and compressed sizes declared by the
+	// entries of zip archives, see zip.Limits. DefaultMaxRatio is used if not set.
+	MaxRatio float64
+	// AllowedFormats lists the accepted formats. All formats are accepted if empty.
+	AllowedFormats []Format
+	// IgnoreContentType disables verifying the declared content type against the actual format.
+	IgnoreContentType bool
+	// TarSecurityMode is the security mode of the returned tar reader. tar.DefaultSecurityMode is
+	// used if not set.
+	TarSecurityMode tar.SecurityMode
+	// ZipSecurityMode is the security mode of the returned zip reader. zip.DefaultSecurityMode is
+	// used if not set.
+	ZipSecurityMode zip.SecurityMode
+	// Inspect, if set, inspects the upload with these options and sets Upload.Report. Uploads
+	// that do not support random access are then buffered in memory (up to MaxSize).
+	Inspect *inspect.Options
+}
+
+func (p Policy) maxSize() int64 {
+	if p.MaxSize > 0 {
+		return p.MaxSize
+	}
+	return DefaultMaxSize
+}
+
+func (p Policy) maxUncompressedSize() int64 {
+	if p.MaxUncompressedSize > 0 {
+		return p.MaxUncompressedSize
+	}
+	return 4 * p.maxSize()
+}
+
+func (p Policy) maxRatio() float64 {
+	if p.MaxRatio > 0 {
+		return p.MaxRatio
+	}
+	return DefaultMaxRatio
+}
+
+func (p Policy) allowed(f Format) bool {
+	if len(p.AllowedFormats) == 0 {
+		return true
+	}
+	for _, a := range p.AllowedFormats {
+		if a == f {
+			return true
+		}
+	}
+	return false
+}
+
+// Upload is an accepted archive. Exactly one of Tar and Zip is set, depending on Format.
+type Upload struct {
+	// Format is the detected format of the archive.
+	Format Format
+	// Tar reads tar and compressed tar archives.
+	Tar *tar.Reader
+	// Zip reads zip archives.
+	Zip *zip.Reader
+	// Report is the inspection of the archive, set if Policy.Inspect is.
+	Report *inspect.Report
+
+	closer io.Closer
+}
+
+// Close releases the resources associated with the upload.
+func (u *Upload) Close() error {
+	if u.closer == nil {
+		return nil
+	}
+	return u.closer.Close()
+}
+
+// FormFile opens the archive uploaded in the multipart form field key of req.
+// The content type declared for the form field is verified against the format of the archive.
+func FormFile(req *http.Request, key string, p Policy) (*Upload, error) {
+	f, fh, err := req.FormFile(key)
+	if err != nil {
+		return nil, err
+	}
+	u, err := Open(f, fh.Header.Get("Content-Type"), p)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	u.closer = f
+	return u, nil
+}
+
+// Open sniffs the format of the archive read from r, verifies it against contentType and the
+// Policy, and returns a reader with the security mode of the Policy.
+// If r implements io.ReaderAt and io.Seeker (like multipart.File), zip archives are read in place,
+// otherwise they are buffered in memory (up to the MaxSize of the Policy).
+func Open(r io.Reader, contentType string, p Policy) (*Upload, error) {
+	ra, size, err := readerAt(r, p.maxSize())
+	if err != nil {
+		return nil, err
+	}
+	if ra == nil && p.Inspect != nil {
+		// the inspection and the returned reader both read the upload, buffering it
+		b, err := io.ReadAll(&limitedReader{r: r, n: p.maxSize()})
+		if err != nil {
+			return nil, err
+		}
+		ra, size = bytes.NewReader(b), int64(len(b))
+	}
+
+	var detected safearchive.Format
+	var confidence safearchive.Confidence
+	var br *bufio.Reader
+	if ra != nil {
+		detected, confidence, err = safearchive.DetectFormatAt(ra, size)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		br = bufio.NewReaderSize(&limitedReader{r: r, n: p.maxSize()}, safearchive.DetectLen)
+		prefix, err := br.Peek(safearchive.DetectLen)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		detected, confidence = safearchive.DetectFormat(prefix)
+	}
+
+	format, ok := formats[detected]
+	if !ok || confidence < safearchive.ConfidenceMedium || !p.allowed(format) {
+		return nil, ErrUnsupportedFormat
+	}
+	if !p.IgnoreContentType {
+		if err := checkContentType(contentType, format); err != nil {
+			return nil, err
+		}
+	}
+
+	if format == FormatZip {
+		if ra == nil {
+			// zip needs random access, buffering the upload
+			b, err := io.ReadAll(br)
+			if err != nil {
+				return nil, err
+			}
+			ra, size = bytes.NewReader(b), int64(len(b))
+		}
+		zr, err := zip.NewReader(ra, size)
+		if err != nil {
+			return nil, err
+		}
+		if p.ZipSecurityMode != 0 {
+			zr.SetSecurityMode(p.ZipSecurityMode)
+		}
+		if err := zr.SetLimits(zip.Limits{MaxTotalUncompressed: p.maxUncompressedSize(), MaxRatio: p.maxRatio()}); err != nil {
+			if errors.Is(err, safearchive.ErrLimitExceeded) {
+				return nil, fmt.Errorf("%w: %w", ErrTooLarge, err)
+			}
+			return nil, err
+		}
+		report, err := p.inspect(ra, size)
+		if err != nil {
+			return nil, err
+		}
+		return &Upload{Format: format, Zip: zr, Report: report}, nil
+	}
+
+	report, err := p.inspect(ra, size)
+	if err != nil {
+		return nil, err
+	}
+
+	var stream io.Reader = br
+	if ra != nil {
+		stream = io.NewSectionReader(ra, 0, size)
+	}
+	var closer io.Closer
+	if format == FormatTarGzip {
+		gr, err := gzip.NewReader(stream)
+		if err != nil {
+			return nil, err
+		}
+		stream = &limitedReader{r: gr, n: p.maxUncompressedSize()}
+		closer = gr
+	}
+	tr := tar.NewReader(stream)
+	if p.TarSecurityMode != 0 {
+		tr.SetSecurityMode(p.TarSecurityMode)
+	}
+	return &Upload{Format: format, Tar: tr, Report: report, closer: closer}, nil
+}
+
+// inspect returns the inspection of the upload in ra, which is size bytes long, or nil if the
+// Policy does not inspect the uploads.
+func (p Policy) inspect(ra io.ReaderAt, size int64) (*inspect.Report, error) {
+	if p.Inspect == nil {
+		return nil, nil
+	}
+	return inspect.InspectWithOptions(io.NewSectionReader(ra, 0, size), *p.Inspect)
+}
+
+// readerAt returns r as an io.ReaderAt along with its size if r supports random access.
+func readerAt(r io.Reader, maxSize int64) (io.ReaderAt, int64, error) {
+	ra, ok := r.(io.ReaderAt)
+	if !ok {
+		return nil, 0, nil
+	}
+	s, ok := r.(io.Seeker)
+	if !ok {
+		return nil, 0, nil
+	}
+	size, err := s.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, 0, err
+	}
+	if size > maxSize {
+		return nil, 0, ErrTooLarge
+	}
+	return ra, size, nil
+}
+
+// ContentTypeError describes a content type mismatch. It unwraps to ErrContentTypeMismatch.
+type ContentTypeError struct {
+	// Declared is the content type declared by the client.
+	Declared string
+	// Detected is the actual format of the archive.
+	Detected Format
+}
+
+func (e *ContentTypeError) Error() string {
+	return fmt.Sprintf("httpupload: content type %q declared for a %s archive", e.Declared, e.Detected)
+}
+
+// Unwrap returns ErrContentTypeMismatch.
+func (e *ContentTypeError) Unwrap() error {
+	return ErrContentTypeMismatch
+}
+
+func checkContentType(contentType string, format Format) error {
+	if contentType == "" {
+		return nil
+	}
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return &ContentTypeError{Declared: contentType, Detected: format}
+	}
+	for _, f := range contentTypes[mt] {
+		if f == format {
+			return nil
+		}
+	}
+	return &ContentTypeError{Declared: mt, Detected: format}
+}
+
+// limitedReader is like io.LimitedReader, but fails with ErrTooLarge when the limit is exceeded
+// instead of silently truncating the stream.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, ErrTooLarge
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, ErrTooLarge
+	}
+	return n, err
+}
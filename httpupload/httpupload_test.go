@@ -0,0 +1,240 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !safearchive_hardened
+// +build !safearchive_hardened
+
+package httpupload
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/inspect"
+	"github.com/google/safearchive/internal/archivetest"
+	"github.com/google/safearchive/zip"
+)
+
+// makeRawZip returns a zip archive with an entry named name declaring size bytes compressed to the
+// data of the archive.
+func makeRawZip(t *testing.T, name string, method uint16, size uint64) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := archivetest.NewZipWriter(&buf)
+	fw, err := zw.CreateRaw(&zip.FileHeader{Name: name, Method: method, CompressedSize64: 5, UncompressedSize64: size})
+	if err != nil {
+		t.Fatalf("CreateRaw() error = %v", err)
+	}
+	if _, err := fw.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	return buf.Bytes()
+}
+
+// streamOnly hides the io.ReaderAt and io.Seeker implementations of the wrapped reader.
+type streamOnly struct{ io.Reader }
+
+func firstName(t *testing.T, u *Upload) string {
+	t.Helper()
+
+	if u.Zip != nil {
+		if len(u.Zip.File) == 0 {
+			t.Fatalf("zip upload has no entries")
+		}
+		return u.Zip.File[0].Name
+	}
+	h, err := u.Tar.Next()
+	if err != nil {
+		t.Fatalf("tar Next() error = %v", err)
+	}
+	return h.Name
+}
+
+func TestOpen(t *testing.T) {
+	tests := []struct {
+		name        string
+		archive     []byte
+		contentType string
+		want        Format
+	}{
+		{name: "tar", archive: archivetest.Tar(t, []archivetest.Entry{{Name: "../evil.txt", Content: []byte("x")}}), contentType: "application/x-tar", want: FormatTar},
+		{name: "tar.gz", archive: archivetest.Gzip(t, archivetest.Tar(t, []archivetest.Entry{{Name: "../evil.txt", Content: []byte("x")}})), contentType: "application/gzip", want: FormatTarGzip},
+		{name: "zip", archive: archivetest.Zip(t, []archivetest.Entry{{Name: "../evil.txt", Content: []byte("x")}}), contentType: "application/zip", want: FormatZip},
+		{name: "octet-stream", archive: archivetest.Zip(t, []archivetest.Entry{{Name: "../evil.txt", Content: []byte("x")}}), contentType: "application/octet-stream", want: FormatZip},
+	}
+	for _, tc := range tests {
+		for _, r := range []io.Reader{bytes.NewReader(tc.archive), streamOnly{bytes.NewReader(tc.archive)}} {
+			u, err := Open(r, tc.contentType, Policy{})
+			if err != nil {
+				t.Fatalf("Open(%s) error = %v", tc.name, err)
+			}
+			if u.Format != tc.want {
+				t.Errorf("Open(%s).Format = %q, want %q", tc.name, u.Format, tc.want)
+			}
+			if got := firstName(t, u); got != "evil.txt" {
+				t.Errorf("Open(%s) first entry = %q, want sanitized %q", tc.name, got, "evil.txt")
+			}
+			u.Close()
+		}
+	}
+}
+
+func TestOpenRejects(t *testing.T) {
+	archive := archivetest.Zip(t, []archivetest.Entry{{Name: "a", Content: []byte("a")}})
+	tests := []struct {
+		name        string
+		r           io.Reader
+		contentType string
+		p           Policy
+		want        error
+	}{
+		{name: "not an archive", r: bytes.NewReader([]byte("hello world")), want: ErrUnsupportedFormat},
+		{name: "format not allowed", r: bytes.NewReader(archive), p: Policy{AllowedFormats: []Format{FormatTar}}, want: ErrUnsupportedFormat},
+		{name: "content type mismatch", r: bytes.NewReader(archive), contentType: "application/x-tar", want: ErrContentTypeMismatch},
+		{name: "too large", r: bytes.NewReader(archive), p: Policy{MaxSize: 10}, want: ErrTooLarge},
+		{name: "too large stream", r: streamOnly{bytes.NewReader(archive)}, p: Policy{MaxSize: 10}, want: ErrTooLarge},
+	}
+	for _, tc := range tests {
+		_, err := Open(tc.r, tc.contentType, tc.p)
+		if !errors.Is(err, tc.want) {
+			t.Errorf("Open(%s) error = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestOpenGzipLimit(t *testing.T) {
+	archive := archivetest.Gzip(t, archivetest.Tar(t, []archivetest.Entry{{Name: "big.txt", Content: make([]byte, 1<<20)}}))
+	u, err := Open(bytes.NewReader(archive), "", Policy{MaxUncompressedSize: 1 << 10})
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer u.Close()
+	if _, err := u.Tar.Next(); err != nil {
+		t.Fatalf("tar Next() error = %v", err)
+	}
+	if _, err = io.Copy(io.Discard, u.Tar); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("reading the entry error = %v, want %v", err, ErrTooLarge)
+	}
+}
+
+func TestOpenZipLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		archive []byte
+		p       Policy
+	}{
+		{name: "declared size", archive: makeRawZip(t, "huge.txt", zip.Store, 1<<40)},
+		{name: "declared size limit", archive: makeRawZip(t, "big.txt", zip.Store, 1<<20), p: Policy{MaxUncompressedSize: 1 << 10}},
+		{name: "ratio", archive: makeRawZip(t, "bomb.txt", zip.Deflate, 2<<20)},
+		{name: "ratio limit", archive: makeRawZip(t, "bomb.txt", zip.Deflate, 2<<20), p: Policy{MaxRatio: 1000}},
+	}
+	for _, tc := range tests {
+		for _, r := range []io.Reader{bytes.NewReader(tc.archive), streamOnly{bytes.NewReader(tc.archive)}} {
+			_, err := Open(r, "application/zip", tc.p)
+			if !errors.Is(err, ErrTooLarge) || !errors.Is(err, safearchive.ErrLimitExceeded) {
+				t.Errorf("Open(%s) error = %v, want %v and %v", tc.name, err, ErrTooLarge, safearchive.ErrLimitExceeded)
+			}
+		}
+	}
+	u, err := Open(bytes.NewReader(makeRawZip(t, "bomb.txt", zip.Deflate, 2<<20)), "application/zip", Policy{MaxRatio: 1 << 20})
+	if err != nil {
+		t.Fatalf("Open() with a higher ratio limit error = %v", err)
+	}
+	u.Close()
+}
+
+func TestOpenInspect(t *testing.T) {
+	tests := []struct {
+		name    string
+		archive []byte
+		want    Format
+	}{
+		{name: "tar", archive: archivetest.Tar(t, []archivetest.Entry{{Name: "../evil.txt", Content: []byte("x")}}), want: FormatTar},
+		{name: "tar.gz", archive: archivetest.Gzip(t, archivetest.Tar(t, []archivetest.Entry{{Name: "../evil.txt", Content: []byte("x")}})), want: FormatTarGzip},
+		{name: "zip", archive: archivetest.Zip(t, []archivetest.Entry{{Name: "../evil.txt", Content: []byte("x")}}), want: FormatZip},
+	}
+	for _, tc := range tests {
+		for _, r := range []io.Reader{bytes.NewReader(tc.archive), streamOnly{bytes.NewReader(tc.archive)}} {
+			u, err := Open(r, "", Policy{Inspect: &inspect.Options{}})
+			if err != nil {
+				t.Fatalf("Open(%s) error = %v", tc.name, err)
+			}
+			if u.Report == nil || len(u.Report.Entries) != 1 || u.Report.Entries[0].Name != "../evil.txt" {
+				t.Fatalf("Open(%s).Report = %+v, want the entry ../evil.txt", tc.name, u.Report)
+			}
+			if u.Report.Health == safearchive.HealthClean.String() {
+				t.Errorf("Open(%s).Report.Health = %q, want the traversal reported", tc.name, u.Report.Health)
+			}
+			// the reader still reads the whole upload
+			if got := firstName(t, u); got != "evil.txt" {
+				t.Errorf("Open(%s) first entry = %q, want sanitized %q", tc.name, got, "evil.txt")
+			}
+			u.Close()
+		}
+	}
+	u, err := Open(bytes.NewReader(archivetest.Zip(t, []archivetest.Entry{{Name: "a", Content: []byte("a")}})), "", Policy{})
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if u.Report != nil {
+		t.Errorf("Open() without Inspect Report = %+v, want nil", u.Report)
+	}
+}
+
+func TestFormFile(t *testing.T) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Disposition", `form-data; name="archive"; filename="upload.zip"`)
+	h.Set("Content-Type", "application/zip")
+	pw, err := mw.CreatePart(h)
+	if err != nil {
+		t.Fatalf("CreatePart() error = %v", err)
+	}
+	pw.Write(archivetest.Zip(t, []archivetest.Entry{{Name: "/etc/passwd", Content: []byte("x")}}))
+	mw.Close()
+
+	req := httptest.NewRequest("POST", "/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	u, err := FormFile(req, "archive", Policy{})
+	if err != nil {
+		t.Fatalf("FormFile() error = %v", err)
+	}
+	defer u.Close()
+	if got := firstName(t, u); got != "etc/passwd" {
+		t.Errorf("FormFile() first entry = %q, want %q", got, "etc/passwd")
+	}
+}
+
+func TestContentTypeError(t *testing.T) {
+	_, err := Open(bytes.NewReader(archivetest.Zip(t, []archivetest.Entry{{Name: "a", Content: []byte("a")}})), "application/x-tar; charset=binary", Policy{})
+	var cte *ContentTypeError
+	if !errors.As(err, &cte) {
+		t.Fatalf("Open() error = %v, want *ContentTypeError", err)
+	}
+	if cte.Declared != "application/x-tar" || cte.Detected != FormatZip {
+		t.Errorf("ContentTypeError = %+v, want application/x-tar declared for zip", cte)
+	}
+}
@@ -0,0 +1,594 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package inspect enumerates the entries of archives and reports their security findings without
+// extracting them, for services scanning uploads that never write the archives to disk:
+//
+//	rep, err := inspect.Inspect(upload)
+//	if err != nil {
+//		// not an archive
+//	}
+//	json.NewEncoder(w).Encode(rep)
+//
+// Unlike the safearchive readers, which sanitize the entries as they read them, Inspect reads the
+// entries as they are stored and reports everything an extraction would have to deal with:
+// traversal attempts, symbolic link tricks, compression bombs, reserved names, special files,
+// encrypted entries and nested archives.
+//
+// Nested archives (e.g. a zip archive within a tar archive) are only reported by default. Setting
+// Options.MaxDepth scans them recursively, within budgets on the size and the number of entries of
+// the nested archives, so pipelines can catch the recursive bombs made of archives nested many
+// times.
+package inspect
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/decompress"
+	"github.com/google/safearchive/internal/limits"
+	"github.com/google/safearchive/sanitizer"
+	"github.com/google/safearchive/tar"
+	"github.com/google/safearchive/zip"
+)
+
+// ErrUnsupportedFormat is returned when the data is not an archive the safearchive readers can
+// read.
+var ErrUnsupportedFormat = errors.New("inspect: unsupported archive format")
+
+// Reasons of the findings only reported by Inspect.
+const (
+	// ReasonReservedName is an entry named after a Windows reserved device name (e.g. NUL or
+	// LPT1), which Windows opens instead of creating a file.
+	ReasonReservedName safearchive.Reason = "reserved-name"
+	// ReasonCompressionRatio is an entry or an archive expanding beyond the maximum compression
+	// ratio, e.g. a compression bomb.
+	ReasonCompressionRatio safearchive.Reason = "compression-ratio"
+	// ReasonNestedArchive is an entry whose content is itself an archive or a compressed stream,
+	// which a scan that does not recurse into it would miss.
+	ReasonNestedArchive safearchive.Reason = "nested-archive"
+)
+
+const (
+	// DefaultMaxSize is the default maximum size of the archives read into memory, see Options.
+	DefaultMaxSize = 1 << 30
+	// DefaultMaxRatio is the default maximum compression ratio, see Options.
+	DefaultMaxRatio = 100
+	// DefaultMaxNestedSize is the default size budget of the nested archives, see Options.
+	DefaultMaxNestedSize = 64 << 20
+	// DefaultMaxNestedEntries is the default entry budget of the nested archives, see Options.
+	DefaultMaxNestedEntries = 10000
+	// DefaultMaxEntries is the default maximum number of entries of the archives, see Options.
+	DefaultMaxEntries = 100000
+)
+
+// sniffLen is the length of the content of the entries read to detect nested archives.
+const sniffLen = 4096
+
+// Options configures the inspection. The zero value uses the defaults.
+type Options struct {
+	// MaxSize is the maximum size of the archives read into memory, which Inspect does when the
+	// io.Reader is not also an io.ReaderAt and an io.Seeker. DefaultMaxSize is used if not set.
+	MaxSize int64
+	// MaxEntries is the maximum number of entries of the inspected archive, which are kept in
+	// memory along with their findings. The inspection stops with an error at the entry exceeding
+	// it, which is reported as ReasonLimitExceeded. DefaultMaxEntries is used if not set.
+	MaxEntries int
+	// MaxRatio is the compression ratio above which compressed tar archives and zip entries are
+	// reported as compression bombs. The inspection of compressed tar archives stops there.
+	// DefaultMaxRatio is used if not set.
+	MaxRatio float64
+	// MaxDepth is the maximum depth of the nested archives scanned recursively: 1 scans the
+	// archives within the archive, 2 the archives within them as well, and so on. Nested archives
+	// beyond it are reported as ReasonLimitExceeded. Nested archives are not scanned if not set.
+	MaxDepth int
+	// MaxNestedSize is the budget of the sizes of all the nested archives scanned, which are read
+	// into memory, and of the decompressed data of the nested compressed tar archives. The nested
+	// archives exceeding it are reported as ReasonLimitExceeded and not scanned, or not further.
+	// DefaultMaxNestedSize is used if not set.
+	MaxNestedSize int64
+	// MaxNestedEntries is the budget of the number of entries of all the nested archives scanned.
+	// The scan of the nested archive exceeding it stops with an error. DefaultMaxNestedEntries is
+	// used if not set.
+	MaxNestedEntries int
+}
+
+// Report is the outcome of an inspection. It is meant to be serialized as JSON.
+type Report struct {
+	// Format is the detected format of the archive.
+	Format string `json:"format"`
+	// Health is the classification of the archive, as in safearchive.Summary.
+	Health string `json:"health"`
+	// Reasons lists the distinct reasons that contributed to Health.
+	Reasons []safearchive.Reason `json:"reasons,omitempty"`
+	// Entries lists the entries of the archive, as they are stored.
+	Entries []Entry `json:"entries"`
+	// Findings lists the findings about the entries, and about the archive itself for the
+	// findings without a name. Their action is always "none".
+	Findings []safearchive.BundleFinding `json:"findings,omitempty"`
+	// Error is the error the reader failed with, if any. The entries before it are reported.
+	Error string `json:"error,omitempty"`
+}
+
+// Entry is an entry of an inspected archive.
+type Entry struct {
+	Name string `json:"name"`
+	// Type is one of "file", "dir", "symlink", "hardlink" and "other".
+	Type           string `json:"type"`
+	Size           int64  `json:"size"`
+	CompressedSize int64  `json:"compressedSize,omitempty"`
+	Mode           string `json:"mode"`
+	Linkname       string `json:"linkname,omitempty"`
+	Encrypted      bool   `json:"encrypted,omitempty"`
+	// Nested is the report of the nested archive of the entry, if it was scanned. The Health of
+	// the report of the enclosing archive accounts for its findings.
+	Nested *Report `json:"nested,omitempty"`
+
+	mode fs.FileMode
+}
+
+// Inspect reads the archive in r and reports its entries and their findings with the default
+// Options.
+func Inspect(r io.Reader) (*Report, error) {
+	return InspectWithOptions(r, Options{})
+}
+
+// InspectWithOptions reads the archive in r and reports its entries and their findings. Archives
+// are read in place if r is an io.ReaderAt and an io.Seeker (e.g. an *os.File), and read into
+// memory otherwise. Errors of the readers are reported in the Report, the returned error is only
+// set if the archive could not be read or its format is not supported.
+func InspectWithOptions(r io.Reader, opts Options) (*Report, error) {
+	ra, size, err := readerAt(r, opts.maxSize())
+	if err != nil {
+		return nil, err
+	}
+	b := &budget{size: opts.maxNestedSize(), entries: opts.maxNestedEntries()}
+	return newInspector(opts, b, 0).inspect(ra, size)
+}
+
+// inspect inspects the archive in ra, which is size bytes long.
+func (in *inspector) inspect(ra io.ReaderAt, size int64) (*Report, error) {
+	format, confidence, err := safearchive.DetectFormatAt(ra, size)
+	if err != nil {
+		return nil, err
+	}
+	if confidence < safearchive.ConfidenceMedium {
+		return nil, ErrUnsupportedFormat
+	}
+
+	rep := &Report{Entries: []Entry{}}
+	switch format {
+	case safearchive.FormatZip:
+		err = in.inspectZip(ra, size)
+	case safearchive.FormatTar:
+		err = in.inspectTar(io.NewSectionReader(ra, 0, size))
+	default:
+		tf, ok := compressedTar[format]
+		if !ok {
+			return nil, ErrUnsupportedFormat
+		}
+		format = tf
+		err = in.inspectCompressedTar(io.NewSectionReader(ra, 0, size))
+		if errors.Is(err, ErrUnsupportedFormat) {
+			return nil, err
+		}
+	}
+	if err != nil {
+		rep.Error = err.Error()
+	}
+
+	rep.Format = format.String()
+	rep.Entries = append(rep.Entries, in.entries...)
+	s := safearchive.Summarize(in.tree)
+	rep.Health = s.Health.String()
+	rep.Reasons = s.Reasons
+	for _, f := range in.report.Findings {
+		rep.Findings = append(rep.Findings, safearchive.BundleFinding{
+			Name:     f.Name,
+			Reason:   f.Reason,
+			Action:   f.Action.String(),
+			Severity: f.EffectiveSeverity().String(),
+			Detail:   f.Detail,
+		})
+	}
+	return rep, nil
+}
+
+// readerAt returns r as an io.ReaderAt along with its size, reading it into memory if needed.
+func readerAt(r io.Reader, max int64) (io.ReaderAt, int64, error) {
+	if ra, ok := r.(io.ReaderAt); ok {
+		if s, ok := r.(io.Seeker); ok {
+			size, err := s.Seek(0, io.SeekEnd)
+			if err != nil {
+				return nil, 0, err
+			}
+			return ra, size, nil
+		}
+	}
+	data, err := io.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, 0, err
+	}
+	if int64(len(data)) > max {
+		return nil, 0, fmt.Errorf("%w: archive larger than %d bytes", safearchive.ErrLimitExceeded, max)
+	}
+	return bytes.NewReader(data), int64(len(data)), nil
+}
+
+// compressedTar maps the formats of compressed streams to the format of the tar archives
+// compressed with them.
+var compressedTar = map[safearchive.Format]safearchive.Format{
+	safearchive.FormatTarGzip:  safearchive.FormatTarGzip,
+	safearchive.FormatTarBzip2: safearchive.FormatTarBzip2,
+	safearchive.FormatBzip2:    safearchive.FormatTarBzip2,
+	safearchive.FormatXz:       safearchive.FormatTarXz,
+	safearchive.FormatZstd:     safearchive.FormatTarZstd,
+}
+
+// budget is what remains of the budgets of the nested archives, shared by the inspections of an
+// archive and of its nested archives.
+type budget struct {
+	size    int64
+	entries int
+}
+
+// inspector is the state of the inspection of an archive.
+type inspector struct {
+	opts Options
+	// depth is the nesting depth of the archive, 0 for the inspected archive.
+	depth   int
+	budget  *budget
+	entries []Entry
+	// report has the findings about the archive, tree those about its nested archives as well.
+	report *safearchive.Report
+	tree   *safearchive.Report
+
+	symlinks   safearchive.SymlinkSet
+	links      safearchive.LinkChecker
+	duplicates safearchive.DuplicateChecker
+	collisions safearchive.DuplicateChecker
+}
+
+func newInspector(opts Options, b *budget, depth int) *inspector {
+	return &inspector{opts: opts, depth: depth, budget: b, report: &safearchive.Report{}, tree: &safearchive.Report{}}
+}
+
+// flag records a finding about the entry name, or about the archive if name is empty.
+func (in *inspector) flag(name string, reason safearchive.Reason, detail string) {
+	f := safearchive.Finding{Name: name, Reason: reason, Detail: detail}
+	if reason == ReasonNestedArchive {
+		f.Severity = safearchive.SeverityInfo
+	}
+	in.report.Add(f)
+	in.tree.Add(f)
+}
+
+func (in *inspector) inspectZip(ra io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return err
+	}
+	zr.SetSecurityMode(0)
+	var total uint64
+	for _, f := range zr.File {
+		e := Entry{
+			Name:           f.Name,
+			Size:           int64(f.UncompressedSize64),
+			CompressedSize: int64(f.CompressedSize64),
+			Encrypted:      zip.IsEncrypted(f),
+			mode:           f.Mode(),
+		}
+		total += f.UncompressedSize64
+		if err := in.checkZip(f, &e); err != nil {
+			return err
+		}
+		if e.Encrypted {
+			detail := "traditional PKWARE encryption"
+			if f.Method == zip.AES {
+				detail = "AES encryption"
+			}
+			in.flag(e.Name, safearchive.ReasonEncrypted, detail)
+		}
+		if f.UncompressedSize64 >= limits.MinRatioSize && float64(f.UncompressedSize64) > in.opts.maxRatio()*float64(f.CompressedSize64) {
+			in.flag(e.Name, ReasonCompressionRatio, fmt.Sprintf("%d bytes compressed to %d", f.UncompressedSize64, f.CompressedSize64))
+		}
+	}
+	if total >= limits.MinRatioSize && float64(total) > in.opts.maxRatio()*float64(size) {
+		in.flag("", ReasonCompressionRatio, fmt.Sprintf("entries declare %d bytes in an archive of %d bytes", total, size))
+	}
+	return nil
+}
+
+// checkZip reads the beginning of the content of f, or the target of the symbolic link, and checks
+// e, the entry of f.
+func (in *inspector) checkZip(f *zip.File, e *Entry) error {
+	if e.Encrypted || (e.mode&fs.ModeSymlink == 0 && (!e.mode.IsRegular() || e.Size == 0)) {
+		return in.check(e, nil, nil)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		// entries whose content cannot be read are still reported
+		return in.check(e, nil, nil)
+	}
+	defer rc.Close()
+	if e.mode&fs.ModeSymlink != 0 {
+		target, _ := io.ReadAll(io.LimitReader(rc, limits.MaxLinknameLen))
+		e.Linkname = string(target)
+		return in.check(e, nil, nil)
+	}
+	content, _ := io.ReadAll(io.LimitReader(rc, sniffLen))
+	return in.check(e, content, rc)
+}
+
+func (in *inspector) inspectCompressedTar(r io.Reader) error {
+	limits := decompress.Limits{MaxRatio: in.opts.maxRatio()}
+	if in.depth > 0 {
+		// the decompressed data of the nested archives is charged to their size budget as well
+		if in.budget.size <= 0 {
+			err := fmt.Errorf("%w: nested archives larger than %d bytes", safearchive.ErrLimitExceeded, in.opts.maxNestedSize())
+			in.flag("", safearchive.ReasonLimitExceeded, err.Error())
+			return err
+		}
+		limits.MaxOutputSize = in.budget.size
+	}
+	zr, err := decompress.Open(r, limits)
+	if errors.Is(err, decompress.ErrUnknownCodec) {
+		return fmt.Errorf("%w: %v", ErrUnsupportedFormat, err)
+	}
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	cr := &countingReader{r: zr}
+	if in.depth > 0 {
+		defer func() { in.budget.size -= cr.n }()
+	}
+	br := bufio.NewReader(cr)
+	blk, err := br.Peek(512)
+	if f, c := safearchive.DetectFormat(blk); f != safearchive.FormatTar || c < safearchive.ConfidenceMedium {
+		if err != nil && err != io.EOF {
+			return err
+		}
+		return ErrUnsupportedFormat
+	}
+	err = in.inspectTar(br)
+	switch {
+	case errors.Is(err, decompress.ErrRatio):
+		in.flag("", ReasonCompressionRatio, err.Error())
+	case errors.Is(err, decompress.ErrOutputSize):
+		in.flag("", safearchive.ReasonLimitExceeded, fmt.Sprintf("nested archives larger than %d bytes", in.opts.maxNestedSize()))
+	}
+	return err
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (in *inspector) inspectTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	tr.SetSecurityMode(0)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		e := Entry{
+			Name:     h.Name,
+			Size:     h.Size,
+			Linkname: h.Linkname,
+			mode:     h.FileInfo().Mode(),
+		}
+		if h.Typeflag == tar.TypeLink {
+			e.Type = "hardlink"
+		}
+		var content []byte
+		if e.Type == "" && e.mode.IsRegular() && e.Size > 0 {
+			if content, err = io.ReadAll(io.LimitReader(tr, sniffLen)); err != nil {
+				in.check(&e, nil, nil)
+				return err
+			}
+		}
+		if err := in.check(&e, content, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// describe fills the fields of e derived from its mode.
+func (in *inspector) describe(e Entry) Entry {
+	e.Mode = e.mode.String()
+	if e.Type != "" {
+		return e
+	}
+	switch {
+	case e.mode.IsRegular():
+		e.Type = "file"
+	case e.mode.IsDir():
+		e.Type = "dir"
+	case e.mode&fs.ModeSymlink != 0:
+		e.Type = "symlink"
+	default:
+		e.Type = "other"
+	}
+	return e
+}
+
+// check records e and its findings. content is the beginning of the content of regular files, and
+// rest reads the remainder of their content. It fails if the entry exceeds the maximum number of
+// entries of the archive or the entry budget of the nested archives.
+func (in *inspector) check(e *Entry, content []byte, rest io.Reader) error {
+	if in.depth == 0 && len(in.entries) >= in.opts.maxEntries() {
+		err := fmt.Errorf("%w: more than %d entries", safearchive.ErrLimitExceeded, in.opts.maxEntries())
+		in.flag("", safearchive.ReasonLimitExceeded, err.Error())
+		return err
+	}
+	if in.depth > 0 {
+		if in.budget.entries--; in.budget.entries < 0 {
+			err := fmt.Errorf("%w: more than %d entries in the nested archives", safearchive.ErrLimitExceeded, in.opts.maxNestedEntries())
+			in.flag("", safearchive.ReasonLimitExceeded, err.Error())
+			return err
+		}
+	}
+	*e = in.describe(*e)
+
+	sanitized, changes := sanitizer.AnalyzeWithPolicy(e.Name, sanitizer.Policy{Windows: true, Separator: '/'})
+	for _, c := range changes {
+		switch c.Kind {
+		case sanitizer.ChangeDotDot:
+			in.flag(e.Name, safearchive.ReasonPathTraversal, c.String())
+		case sanitizer.ChangeAbsolute, sanitizer.ChangeDriveLetter:
+			in.flag(e.Name, safearchive.ReasonAbsolutePath, c.String())
+		case sanitizer.ChangeReservedName:
+			in.flag(e.Name, ReasonReservedName, c.String())
+		case sanitizer.ChangeDataStream, sanitizer.ChangeInvalidCharacter, sanitizer.ChangeTrailingDotSpace:
+			in.flag(e.Name, safearchive.ReasonPathNormalized, c.String())
+		}
+	}
+	if !sanitizer.IsValidName(e.Name) {
+		in.flag(e.Name, safearchive.ReasonInvalidEncoding, "")
+	}
+	if sanitizer.HasUnsafeRunes(e.Name) {
+		in.flag(e.Name, safearchive.ReasonUnsafeUnicode, "")
+	}
+	if sanitizer.HasWindowsShortFilenames(e.Name) {
+		in.flag(e.Name, safearchive.ReasonWindowsShortFilename, "")
+	}
+
+	clean := strings.Trim(path.Clean("/"+sanitized), "/")
+	if in.symlinks.Covers(clean) {
+		in.flag(e.Name, safearchive.ReasonSymlinkTraversal, "")
+	}
+	switch e.Type {
+	case "symlink":
+		in.symlinks.Add(clean)
+		if sanitizer.SanitizeLinkTarget(clean, e.Linkname) != e.Linkname {
+			in.flag(e.Name, safearchive.ReasonSymlinkTarget, "target "+e.Linkname)
+		}
+		if detail, ok := in.links.Check(clean, e.Linkname); !ok {
+			in.flag(e.Name, safearchive.ReasonSymlinkLoop, detail)
+		}
+	case "hardlink":
+		if reason := safearchive.NameReason(e.Linkname); reason != safearchive.ReasonPathNormalized {
+			in.flag(e.Name, reason, "hard link to "+e.Linkname)
+		}
+	case "other":
+		in.flag(e.Name, safearchive.ReasonSpecialFile, "mode "+e.Mode)
+	}
+	if e.mode&(fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky) != 0 {
+		in.flag(e.Name, safearchive.ReasonSpecialMode, "mode "+e.Mode)
+	}
+
+	in.duplicates.Policy = safearchive.DuplicatesKeepLast
+	in.collisions.Policy, in.collisions.Fold = safearchive.DuplicatesKeepLast, true
+	for _, c := range []*safearchive.DuplicateChecker{&in.duplicates, &in.collisions} {
+		if v, _ := c.Check(clean, e.Type == "dir"); v.Reason != "" {
+			in.flag(e.Name, v.Reason, v.Detail)
+		}
+	}
+
+	if f, c := safearchive.DetectFormat(content); f != safearchive.FormatUnknown && c >= safearchive.ConfidenceMedium {
+		in.flag(e.Name, ReasonNestedArchive, f.String())
+		if in.opts.MaxDepth > 0 {
+			in.scanNested(e, content, rest)
+		}
+	}
+	in.entries = append(in.entries, *e)
+	return nil
+}
+
+// scanNested scans the nested archive of e, whose content starts with prefix and continues in
+// rest, within the budgets.
+func (in *inspector) scanNested(e *Entry, prefix []byte, rest io.Reader) {
+	if in.depth >= in.opts.MaxDepth {
+		in.flag(e.Name, safearchive.ReasonLimitExceeded, fmt.Sprintf("archive nested deeper than %d archives", in.opts.MaxDepth))
+		return
+	}
+	exceeded := fmt.Sprintf("nested archives larger than %d bytes", in.opts.maxNestedSize())
+	if e.Size > in.budget.size {
+		in.flag(e.Name, safearchive.ReasonLimitExceeded, exceeded)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(io.MultiReader(bytes.NewReader(prefix), rest), in.budget.size+1))
+	if err != nil {
+		// the error is reported by the reader of the enclosing archive if it matters
+		return
+	}
+	if int64(len(data)) > in.budget.size {
+		in.flag(e.Name, safearchive.ReasonLimitExceeded, exceeded)
+		return
+	}
+	in.budget.size -= int64(len(data))
+	child := newInspector(in.opts, in.budget, in.depth+1)
+	rep, err := child.inspect(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		// e.g. a compressed file rather than an archive
+		return
+	}
+	e.Nested = rep
+	in.tree.Findings = append(in.tree.Findings, child.tree.Findings...)
+}
+
+func (o Options) maxSize() int64 {
+	if o.MaxSize > 0 {
+		return o.MaxSize
+	}
+	return DefaultMaxSize
+}
+
+func (o Options) maxEntries() int {
+	if o.MaxEntries > 0 {
+		return o.MaxEntries
+	}
+	return DefaultMaxEntries
+}
+
+func (o Options) maxNestedSize() int64 {
+	if o.MaxNestedSize > 0 {
+		return o.MaxNestedSize
+	}
+	return DefaultMaxNestedSize
+}
+
+func (o Options) maxNestedEntries() int {
+	if o.MaxNestedEntries > 0 {
+		return o.MaxNestedEntries
+	}
+	return DefaultMaxNestedEntries
+}
+
+func (o Options) maxRatio() float64 {
+	if o.MaxRatio > 0 {
+		return o.MaxRatio
+	}
+	return DefaultMaxRatio
+}
@@ -0,0 +1,336 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inspect
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/corpus"
+	"github.com/google/safearchive/internal/archivetest"
+	"github.com/google/safearchive/tar"
+)
+
+// finding is the part of the findings compared by the tests.
+type finding struct {
+	name   string
+	reason safearchive.Reason
+}
+
+func TestInspect(t *testing.T) {
+	zeros := make([]byte, 2<<20)
+	nested := archivetest.Zip(t, []archivetest.Entry{{Name: "inner.txt", Content: []byte("hello")}})
+	tests := []struct {
+		name         string
+		data         []byte
+		opts         Options
+		wantFormat   string
+		wantEntries  int
+		wantHealth   string
+		wantFindings []finding
+		wantError    bool
+	}{
+		{
+			name:        "traversal",
+			data:        corpus.Bytes("traverse.tar"),
+			wantFormat:  "tar",
+			wantEntries: 3,
+			wantHealth:  "malicious",
+			wantFindings: []finding{
+				{"/gopher.txt", safearchive.ReasonAbsolutePath},
+				{"../todo.txt", safearchive.ReasonPathTraversal},
+			},
+		},
+		{
+			name: "symlink tricks",
+			data: archivetest.Tar(t, []archivetest.Entry{
+				{Name: "link", Linkname: "../../etc", Type: tar.TypeSymlink},
+				{Name: "link/passwd", Type: tar.TypeReg, Content: []byte("x")},
+				{Name: "hard", Linkname: "../secret", Type: tar.TypeLink},
+				{Name: "a", Linkname: "b", Type: tar.TypeSymlink},
+				{Name: "b", Linkname: "a", Type: tar.TypeSymlink},
+			}),
+			wantFormat:  "tar",
+			wantEntries: 5,
+			wantHealth:  "malicious",
+			wantFindings: []finding{
+				{"link", safearchive.ReasonSymlinkTarget},
+				{"link/passwd", safearchive.ReasonSymlinkTraversal},
+				{"hard", safearchive.ReasonPathTraversal},
+				{"b", safearchive.ReasonSymlinkLoop},
+			},
+		},
+		{
+			name: "names and modes",
+			data: archivetest.Tar(t, []archivetest.Entry{
+				{Name: "dir/NUL.txt", Type: tar.TypeReg},
+				{Name: "fifo", Type: tar.TypeFifo},
+				{Name: "suid", Type: tar.TypeReg, Mode: fs.ModeSetuid | 0o755},
+				{Name: "README", Type: tar.TypeReg},
+				{Name: "readme", Type: tar.TypeReg},
+				{Name: "readme", Type: tar.TypeReg},
+			}),
+			wantFormat:  "tar",
+			wantEntries: 6,
+			wantHealth:  "suspicious",
+			wantFindings: []finding{
+				{"dir/NUL.txt", ReasonReservedName},
+				{"fifo", safearchive.ReasonSpecialFile},
+				{"suid", safearchive.ReasonSpecialMode},
+				{"readme", safearchive.ReasonCollision},
+				{"readme", safearchive.ReasonDuplicate},
+				{"readme", safearchive.ReasonCollision},
+			},
+		},
+		{
+			name: "nested archive",
+			data: archivetest.Gzip(t, archivetest.Tar(t, []archivetest.Entry{
+				{Name: "inner.zip", Type: tar.TypeReg, Content: nested},
+				{Name: "plain.txt", Type: tar.TypeReg, Content: []byte("text")},
+			})),
+			wantFormat:   "tar+gzip",
+			wantEntries:  2,
+			wantHealth:   "clean",
+			wantFindings: []finding{{"inner.zip", ReasonNestedArchive}},
+		},
+		{
+			name:        "compressed tar bomb",
+			data:        archivetest.Gzip(t, archivetest.Tar(t, []archivetest.Entry{{Name: "zeros", Type: tar.TypeReg, Content: zeros}})),
+			wantFormat:  "tar+gzip",
+			wantEntries: 1,
+			wantHealth:  "suspicious",
+			wantFindings: []finding{
+				{"", ReasonCompressionRatio},
+			},
+			wantError: true,
+		},
+		{
+			name:        "compressed tar below the ratio",
+			data:        archivetest.Gzip(t, archivetest.Tar(t, []archivetest.Entry{{Name: "zeros", Type: tar.TypeReg, Content: zeros}})),
+			opts:        Options{MaxRatio: 10000},
+			wantFormat:  "tar+gzip",
+			wantEntries: 1,
+			wantHealth:  "clean",
+		},
+		{
+			name: "zip",
+			data: archivetest.Zip(t, []archivetest.Entry{
+				{Name: "zeros", Content: zeros},
+				{Name: "secret", Flags: 0x1, Content: []byte("not really encrypted")},
+				{Name: "..\\evil", Content: []byte("x")},
+			}),
+			wantFormat:  "zip",
+			wantEntries: 3,
+			wantHealth:  "malicious",
+			wantFindings: []finding{
+				{"zeros", ReasonCompressionRatio},
+				{"secret", safearchive.ReasonEncrypted},
+				{"..\\evil", safearchive.ReasonPathTraversal},
+				{"", ReasonCompressionRatio},
+			},
+		},
+		{
+			name:        "clean zip",
+			data:        archivetest.Zip(t, []archivetest.Entry{{Name: "dir/"}, {Name: "dir/file.txt", Content: []byte("hello")}}),
+			wantFormat:  "zip",
+			wantEntries: 2,
+			wantHealth:  "clean",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// a reader without ReadAt, read into memory
+			rep, err := InspectWithOptions(io.MultiReader(bytes.NewReader(tc.data)), tc.opts)
+			if err != nil {
+				t.Fatalf("InspectWithOptions() error = %v", err)
+			}
+			if rep.Format != tc.wantFormat || len(rep.Entries) != tc.wantEntries || rep.Health != tc.wantHealth {
+				t.Errorf("InspectWithOptions() = (format %q, %d entries, health %q), want (%q, %d, %q)", rep.Format, len(rep.Entries), rep.Health, tc.wantFormat, tc.wantEntries, tc.wantHealth)
+			}
+			if (rep.Error != "") != tc.wantError {
+				t.Errorf("InspectWithOptions() Error = %q, want error: %t", rep.Error, tc.wantError)
+			}
+			var got []finding
+			for _, f := range rep.Findings {
+				got = append(got, finding{f.Name, f.Reason})
+				if f.Action != safearchive.ActionNone.String() {
+					t.Errorf("InspectWithOptions() finding %+v has action %q, want %q", f, f.Action, safearchive.ActionNone)
+				}
+			}
+			if !reflect.DeepEqual(got, tc.wantFindings) {
+				t.Errorf("InspectWithOptions() findings = %v, want %v", got, tc.wantFindings)
+			}
+
+			// a reader with ReadAt, read in place
+			again, err := InspectWithOptions(bytes.NewReader(tc.data), tc.opts)
+			if err != nil {
+				t.Fatalf("InspectWithOptions(*bytes.Reader) error = %v", err)
+			}
+			if !reflect.DeepEqual(again, rep) {
+				t.Errorf("InspectWithOptions(*bytes.Reader) = %+v, want %+v", again, rep)
+			}
+		})
+	}
+}
+
+func TestInspectEntries(t *testing.T) {
+	data := archivetest.Tar(t, []archivetest.Entry{
+		{Name: "dir/", Type: tar.TypeDir, Mode: 0o755},
+		{Name: "dir/file", Type: tar.TypeReg, Content: []byte("data")},
+		{Name: "dir/link", Linkname: "file", Type: tar.TypeSymlink, Mode: 0o777},
+		{Name: "dir/hard", Linkname: "dir/file", Type: tar.TypeLink},
+	})
+	rep, err := Inspect(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Inspect() error = %v", err)
+	}
+	b, err := json.Marshal(rep)
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	want := `{"format":"tar","health":"clean","entries":[` +
+		`{"name":"dir/","type":"dir","size":0,"mode":"drwxr-xr-x"},` +
+		`{"name":"dir/file","type":"file","size":4,"mode":"-rw-r--r--"},` +
+		`{"name":"dir/link","type":"symlink","size":0,"mode":"Lrwxrwxrwx","linkname":"file"},` +
+		`{"name":"dir/hard","type":"hardlink","size":0,"mode":"-rw-r--r--","linkname":"dir/file"}]}`
+	if string(b) != want {
+		t.Errorf("json.Marshal(Inspect()) = %s, want %s", b, want)
+	}
+}
+
+func TestInspectErrors(t *testing.T) {
+	if _, err := Inspect(strings.NewReader("not an archive")); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Inspect(text) error = %v, want %v", err, ErrUnsupportedFormat)
+	}
+	data := archivetest.Tar(t, []archivetest.Entry{{Name: "file", Type: tar.TypeReg, Content: make([]byte, 4096)}})
+	if _, err := InspectWithOptions(io.MultiReader(bytes.NewReader(data)), Options{MaxSize: 1024}); !errors.Is(err, safearchive.ErrLimitExceeded) {
+		t.Errorf("InspectWithOptions(MaxSize: 1024) error = %v, want %v", err, safearchive.ErrLimitExceeded)
+	}
+	if _, err := InspectWithOptions(bytes.NewReader(data), Options{MaxSize: 1024}); err != nil {
+		t.Errorf("InspectWithOptions(*bytes.Reader, MaxSize: 1024) error = %v, want nil", err)
+	}
+
+	many := archivetest.Tar(t, []archivetest.Entry{{Name: "a", Type: tar.TypeReg}, {Name: "b", Type: tar.TypeReg}, {Name: "c", Type: tar.TypeReg}})
+	rep, err := InspectWithOptions(bytes.NewReader(many), Options{MaxEntries: 2})
+	if err != nil {
+		t.Fatalf("InspectWithOptions(MaxEntries: 2) error = %v", err)
+	}
+	if len(rep.Entries) != 2 || rep.Error == "" || !reflect.DeepEqual(rep.Reasons, []safearchive.Reason{safearchive.ReasonLimitExceeded}) {
+		t.Errorf("InspectWithOptions(MaxEntries: 2) = %d entries, error %q, reasons %v, want 2 entries and %v", len(rep.Entries), rep.Error, rep.Reasons, safearchive.ReasonLimitExceeded)
+	}
+}
+
+func TestNestedArchives(t *testing.T) {
+	inner := archivetest.Zip(t, []archivetest.Entry{{Name: "../evil", Content: []byte("x")}, {Name: "ok", Content: []byte("y")}})
+	zipInTar := archivetest.Tar(t, []archivetest.Entry{{Name: "inner.zip", Type: tar.TypeReg, Content: inner}})
+	tgzInZip := archivetest.Zip(t, []archivetest.Entry{{Name: "inner.tar.gz", Content: archivetest.Gzip(t, zipInTar)}})
+	// small compressed archives expanding to more than the size budget together
+	tgz := archivetest.Gzip(t, archivetest.Tar(t, []archivetest.Entry{{Name: "zeros", Type: tar.TypeReg, Content: make([]byte, 40000)}}))
+	tgzsInZip := archivetest.Zip(t, []archivetest.Entry{{Name: "a.tar.gz", Content: tgz}, {Name: "b.tar.gz", Content: tgz}})
+	tests := []struct {
+		name        string
+		data        []byte
+		opts        Options
+		wantHealth  string
+		wantReasons []safearchive.Reason
+		// wantDepth is the depth of the nested reports
+		wantDepth int
+		wantError bool
+	}{
+		{
+			name:       "not scanned",
+			data:       zipInTar,
+			wantHealth: "clean",
+		},
+		{
+			name:        "zip in tar",
+			data:        zipInTar,
+			opts:        Options{MaxDepth: 1},
+			wantHealth:  "malicious",
+			wantReasons: []safearchive.Reason{safearchive.ReasonPathTraversal},
+			wantDepth:   1,
+		},
+		{
+			name:        "zip in tar.gz in zip",
+			data:        tgzInZip,
+			opts:        Options{MaxDepth: 2},
+			wantHealth:  "malicious",
+			wantReasons: []safearchive.Reason{safearchive.ReasonPathTraversal},
+			wantDepth:   2,
+		},
+		{
+			name:        "deeper than MaxDepth",
+			data:        tgzInZip,
+			opts:        Options{MaxDepth: 1},
+			wantHealth:  "suspicious",
+			wantReasons: []safearchive.Reason{safearchive.ReasonLimitExceeded},
+			wantDepth:   1,
+		},
+		{
+			name:        "size budget",
+			data:        zipInTar,
+			opts:        Options{MaxDepth: 1, MaxNestedSize: int64(len(inner)) - 1},
+			wantHealth:  "suspicious",
+			wantReasons: []safearchive.Reason{safearchive.ReasonLimitExceeded},
+		},
+		{
+			name:        "decompressed size budget",
+			data:        tgzsInZip,
+			opts:        Options{MaxDepth: 1, MaxNestedSize: 64 << 10},
+			wantHealth:  "suspicious",
+			wantReasons: []safearchive.Reason{safearchive.ReasonLimitExceeded},
+			wantDepth:   1,
+		},
+		{
+			name:        "entry budget",
+			data:        zipInTar,
+			opts:        Options{MaxDepth: 1, MaxNestedEntries: 1},
+			wantHealth:  "malicious",
+			wantReasons: []safearchive.Reason{safearchive.ReasonPathTraversal, safearchive.ReasonLimitExceeded},
+			wantDepth:   1,
+			wantError:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rep, err := InspectWithOptions(bytes.NewReader(tc.data), tc.opts)
+			if err != nil {
+				t.Fatalf("InspectWithOptions() error = %v", err)
+			}
+			if rep.Health != tc.wantHealth || !reflect.DeepEqual(rep.Reasons, tc.wantReasons) {
+				t.Errorf("InspectWithOptions() = (health %q, reasons %v), want (%q, %v)", rep.Health, rep.Reasons, tc.wantHealth, tc.wantReasons)
+			}
+			depth, nested := 0, rep
+			for len(nested.Entries) > 0 && nested.Entries[0].Nested != nil {
+				depth, nested = depth+1, nested.Entries[0].Nested
+			}
+			if depth != tc.wantDepth {
+				t.Errorf("InspectWithOptions() nested reports depth = %d, want %d", depth, tc.wantDepth)
+			}
+			if (nested.Error != "") != tc.wantError {
+				t.Errorf("InspectWithOptions() innermost Error = %q, want error: %t", nested.Error, tc.wantError)
+			}
+		})
+	}
+}
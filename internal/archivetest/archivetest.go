@@ -0,0 +1,164 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package archivetest builds the archives the tests of the safearchive packages read. The tests of
+// the packages it depends on (the root package, tar, zip and the packages they use) cannot use it.
+package archivetest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/google/safearchive/tar"
+	"github.com/google/safearchive/zip"
+)
+
+// Entry is an entry of the archives built by Tar and Zip. Its name is stored as is.
+type Entry struct {
+	Name string
+	// Content is the content of the regular files.
+	Content []byte
+	// Linkname is the target of the links. The entries with a Linkname are symbolic links unless
+	// Type says otherwise.
+	Linkname string
+	// Type is the type flag of the tar entries, tar.TypeReg (or tar.TypeSymlink) if not set.
+	Type byte
+	// Mode is the permission bits of the entry, and of its setuid, setgid and sticky bits. It is
+	// 0755 for the directories and 0644 for the other entries if not set.
+	Mode    fs.FileMode
+	ModTime time.Time
+	// Flags are the general purpose bit flags of the zip entries.
+	Flags uint16
+}
+
+func (e Entry) typeflag() byte {
+	switch {
+	case e.Type != 0:
+		return e.Type
+	case e.Linkname != "":
+		return tar.TypeSymlink
+	}
+	return tar.TypeReg
+}
+
+func (e Entry) mode() fs.FileMode {
+	switch {
+	case e.Mode != 0:
+		return e.Mode
+	case e.typeflag() == tar.TypeDir:
+		return 0755
+	}
+	return 0644
+}
+
+// NewTarWriter returns a tar Writer writing to w without any security feature, since the readers
+// are tested on malicious archives.
+func NewTarWriter(w io.Writer) *tar.Writer {
+	tw := tar.NewWriter(w)
+	tw.SetSecurityMode(0)
+	return tw
+}
+
+// NewZipWriter returns a zip Writer writing to w without any security feature, since the readers
+// are tested on malicious archives.
+func NewZipWriter(w io.Writer) *zip.Writer {
+	zw := zip.NewWriter(w)
+	zw.SetSecurityMode(0)
+	return zw
+}
+
+// unixMode returns the permission bits of the Unix mode of m.
+func unixMode(m fs.FileMode) int64 {
+	mode := int64(m.Perm())
+	if m&fs.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if m&fs.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if m&fs.ModeSticky != 0 {
+		mode |= 01000
+	}
+	return mode
+}
+
+// Tar returns a tar archive of entries, written by NewTarWriter.
+func Tar(t testing.TB, entries []Entry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := NewTarWriter(&buf)
+	for _, e := range entries {
+		h := &tar.Header{Name: e.Name, Typeflag: e.typeflag(), Linkname: e.Linkname, Mode: unixMode(e.mode()), Size: int64(len(e.Content)), ModTime: e.ModTime}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf("tar.Writer.WriteHeader(%q) error = %v", e.Name, err)
+		}
+		if _, err := tw.Write(e.Content); err != nil {
+			t.Fatalf("tar.Writer.Write(%q) error = %v", e.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tar.Writer.Close() error = %v", err)
+	}
+	return buf.Bytes()
+}
+
+// Zip returns a zip archive of entries, written by NewZipWriter with the Deflate method. The
+// entries with a Linkname are symbolic links, storing their target as content.
+func Zip(t testing.TB, entries []Entry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := NewZipWriter(&buf)
+	for _, e := range entries {
+		h := &zip.FileHeader{Name: e.Name, Method: zip.Deflate, Flags: e.Flags, Modified: e.ModTime}
+		content := e.Content
+		if e.Linkname != "" {
+			h.SetMode(fs.ModeSymlink | 0777)
+			content = []byte(e.Linkname)
+		} else if e.Mode != 0 {
+			h.SetMode(e.Mode)
+		}
+		w, err := zw.CreateHeader(h)
+		if err != nil {
+			t.Fatalf("zip.Writer.CreateHeader(%q) error = %v", e.Name, err)
+		}
+		if _, err := w.Write(content); err != nil {
+			t.Fatalf("zip.Writer.Write(%q) error = %v", e.Name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zip.Writer.Close() error = %v", err)
+	}
+	return buf.Bytes()
+}
+
+// Gzip returns data compressed with gzip.
+func Gzip(t testing.TB, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatalf("gzip.Writer.Write() error = %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("gzip.Writer.Close() error = %v", err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,225 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fstree implements the read-only file systems of the archives (see tar.FS and zip.FS):
+// trees of the regular files and directories of the sanitized entries of an archive.
+package fstree
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Node is a file or a directory of a Tree. It implements fs.FileInfo and fs.DirEntry.
+type Node struct {
+	name    string
+	mode    fs.FileMode
+	size    int64
+	modTime time.Time
+	// data is what the file system opens the regular file with, e.g. its entry.
+	data     any
+	children map[string]*Node
+}
+
+// NewNode returns a node of the given mode, to be added to a Tree. data is passed back to the
+// function opening the node, if it is a regular file.
+func NewNode(mode fs.FileMode, size int64, modTime time.Time, data any) *Node {
+	return &Node{mode: mode, size: size, modTime: modTime, data: data}
+}
+
+func (n *Node) Name() string               { return n.name }
+func (n *Node) Size() int64                { return n.size }
+func (n *Node) Mode() fs.FileMode          { return n.mode }
+func (n *Node) ModTime() time.Time         { return n.modTime }
+func (n *Node) IsDir() bool                { return n.mode.IsDir() }
+func (n *Node) Sys() any                   { return nil }
+func (n *Node) Type() fs.FileMode          { return n.mode.Type() }
+func (n *Node) Info() (fs.FileInfo, error) { return n, nil }
+
+// Data returns the data the node was created with.
+func (n *Node) Data() any { return n.data }
+
+// entries returns the children of a directory in the order of their names.
+func (n *Node) entries() []fs.DirEntry {
+	re := make([]fs.DirEntry, 0, len(n.children))
+	for _, c := range n.children {
+		re = append(re, c)
+	}
+	sort.Slice(re, func(i, j int) bool { return re[i].Name() < re[j].Name() })
+	return re
+}
+
+// Tree is the tree of the files and directories of a file system. A Tree must not be modified once
+// it is served; it is then safe for concurrent use.
+type Tree struct {
+	root *Node
+	// open opens the regular files.
+	open func(n *Node) (io.ReadCloser, error)
+}
+
+// New returns an empty Tree, whose regular files are opened with open.
+func New(open func(n *Node) (io.ReadCloser, error)) *Tree {
+	return &Tree{root: &Node{name: ".", mode: fs.ModeDir | 0755, children: map[string]*Node{}}, open: open}
+}
+
+// Name returns the name of an entry as a path of the file system, or "." if it has none.
+func Name(name string) string {
+	name = path.Clean(strings.TrimPrefix(filepath.ToSlash(name), "/"))
+	if !fs.ValidPath(name) {
+		return "."
+	}
+	return name
+}
+
+// Add adds the node n named after the entry name to the tree. Directories are created for the
+// missing parents. Later entries replace the earlier ones with the same name; entries below a file
+// and entries without a name are skipped.
+func (t *Tree) Add(name string, n *Node) {
+	name = Name(name)
+	if name == "." {
+		return
+	}
+	dir := t.root
+	parts := strings.Split(name, "/")
+	for _, p := range parts[:len(parts)-1] {
+		c, ok := dir.children[p]
+		if !ok {
+			c = &Node{name: p, mode: fs.ModeDir | 0755, modTime: n.modTime, children: map[string]*Node{}}
+			dir.children[p] = c
+		}
+		if !c.IsDir() {
+			return
+		}
+		dir = c
+	}
+	n.name = parts[len(parts)-1]
+	if n.IsDir() {
+		if c, ok := dir.children[n.name]; ok && c.IsDir() {
+			c.mode, c.modTime = n.mode, n.modTime
+			return
+		}
+		n.children = map[string]*Node{}
+	}
+	dir.children[n.name] = n
+}
+
+// Remove removes the node named after the entry name and the nodes below it from the tree.
+func (t *Tree) Remove(name string) {
+	dir, base := path.Split(Name(name))
+	if parent, err := t.Lookup(path.Clean(dir)); err == nil && parent.IsDir() {
+		delete(parent.children, base)
+	}
+}
+
+// Lookup returns the node of the path name of the file system.
+func (t *Tree) Lookup(name string) (*Node, error) {
+	if !fs.ValidPath(name) {
+		return nil, fs.ErrInvalid
+	}
+	n := t.root
+	if name == "." {
+		return n, nil
+	}
+	for _, p := range strings.Split(name, "/") {
+		c, ok := n.children[p]
+		if !ok || !n.IsDir() {
+			return nil, fs.ErrNotExist
+		}
+		n = c
+	}
+	return n, nil
+}
+
+// Open opens the named file.
+func (t *Tree) Open(name string) (fs.File, error) {
+	n, err := t.Lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if n.IsDir() {
+		return &dir{node: n, entries: n.entries()}, nil
+	}
+	rc, err := t.open(n)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &file{node: n, rc: rc}, nil
+}
+
+// ReadDir reads the named directory and returns its entries sorted by name.
+func (t *Tree) ReadDir(name string) ([]fs.DirEntry, error) {
+	n, err := t.Lookup(name)
+	if err == nil && !n.IsDir() {
+		err = errors.New("not a directory")
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return n.entries(), nil
+}
+
+// Stat returns a FileInfo describing the named file.
+func (t *Tree) Stat(name string) (fs.FileInfo, error) {
+	n, err := t.Lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return n, nil
+}
+
+// file is an open regular file of a Tree.
+type file struct {
+	node *Node
+	rc   io.ReadCloser
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.node, nil }
+func (f *file) Read(b []byte) (int, error) { return f.rc.Read(b) }
+func (f *file) Close() error               { return f.rc.Close() }
+
+// dir is an open directory of a Tree.
+type dir struct {
+	node    *Node
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) { return d.node, nil }
+func (d *dir) Close() error               { return nil }
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.node.name, Err: errors.New("is a directory")}
+}
+
+func (d *dir) ReadDir(count int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if count <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(rest) {
+		count = len(rest)
+	}
+	d.offset += count
+	return rest[:count], nil
+}
@@ -0,0 +1,26 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package limits holds the limits shared by the readers of the archives.
+package limits
+
+// MinRatioSize is the uncompressed size below which the compression ratio limits are not enforced:
+// small entries and streams cannot do harm, but legitimately compress extremely well sometimes
+// (e.g. zero filled files), and the overhead of the headers makes the ratios of short streams
+// meaningless.
+const MinRatioSize = 1 << 20
+
+// MaxLinknameLen is the maximum length of the target of a symbolic link stored as the content of an
+// entry.
+const MaxLinknameLen = 4096
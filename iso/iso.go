@@ -0,0 +1,971 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package iso reads ISO 9660 disk images, with the names and symbolic links of their Rock Ridge
+// and Joliet extensions, with the security focus of the tar and zip packages. Disk images are
+// mounted as drives by some operating systems, which makes them a vector for smuggling files past
+// the scanners of archives.
+//
+// The names of the entries are sanitized like the names of the entries of the other formats, the
+// entries written through the symbolic links of the image are skipped, and the sizes of the
+// entries may be limited:
+//
+//	r, err := iso.NewReader(f, size)
+//	if err != nil {
+//		return err
+//	}
+//	for {
+//		h, err := r.Next()
+//		if err == io.EOF {
+//			break
+//		}
+//		...
+//	}
+//
+// The entries are named after the Rock Ridge names of the image if it has them, or else after the
+// Joliet names, or else after the ISO 9660 names (without their ";1" version). The directories of
+// the image are walked depth first, each one once: directory loops are invalid.
+//
+// UDF images are read through their ISO 9660 file system if they have one (UDF bridge images), or
+// else through their UDF file system, with its names, permissions and symbolic links. The UDF
+// partitions other than the physical ones, e.g. the metadata partitions of UDF 2.50, are not
+// supported (ErrUDF).
+package iso
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/sanitizer"
+)
+
+const (
+	// Magic is the identifier of the volume descriptors of ISO 9660 images.
+	Magic = "CD001"
+	// sectorSize is the size of the sectors holding the volume descriptors.
+	sectorSize = 2048
+	// firstDescriptor is the sector of the first volume descriptor, after the system area.
+	firstDescriptor = 16
+	// maxDescriptors is the maximum number of volume descriptors read.
+	maxDescriptors = 64
+	// maxDepth is the maximum depth of the directories.
+	maxDepth = 64
+	// maxDirectorySize is the maximum size of the records of a directory.
+	maxDirectorySize = 16 << 20
+	// maxContinuations is the maximum number of continuation areas of the system use area of a
+	// directory record.
+	maxContinuations = 16
+)
+
+var (
+	// ErrHeader is wrapped by the errors of reading an invalid image, or a file that is not an
+	// ISO 9660 image.
+	ErrHeader = errors.New("iso: invalid image")
+	// ErrUDF is wrapped by the errors of NewReader for the UDF file systems whose partitions are
+	// not supported: the virtual, sparable and metadata partitions of the later revisions of UDF.
+	ErrUDF = errors.New("iso: unsupported UDF file system")
+	// ErrLimitExceeded is wrapped by the errors of Next when the image exceeds a limit of the
+	// Reader.
+	ErrLimitExceeded = safearchive.ErrLimitExceeded
+)
+
+// Extension is the extension of ISO 9660 whose names are read, or UDF for the images read through
+// their UDF file system.
+type Extension int
+
+const (
+	// NoExtension means the ISO 9660 names are read.
+	NoExtension Extension = iota
+	// RockRidge means the Rock Ridge names, modes and symbolic links are read.
+	RockRidge
+	// Joliet means the Joliet (Unicode) names are read.
+	Joliet
+	// UDF means the image has no ISO 9660 file system, and its UDF names, permissions and
+	// symbolic links are read.
+	UDF
+)
+
+// Header describes an entry of an image.
+type Header struct {
+	// Name is the path of the entry, with forward slashes.
+	Name string
+	// Linkname is the target of a Rock Ridge or UDF symbolic link.
+	Linkname string
+	// Mode is the Rock Ridge or UDF mode of the entry, or 0755 for directories and 0644 for files
+	// for the other images.
+	Mode    fs.FileMode
+	ModTime time.Time
+	// Size is the size of the data of the entry, zero for directories.
+	Size int64
+	// Hidden is set for the entries flagged hidden.
+	Hidden bool
+}
+
+// EntryOf returns the format independent description of h.
+func EntryOf(h *Header) safearchive.Entry {
+	return safearchive.Entry{
+		Name:     h.Name,
+		Linkname: h.Linkname,
+		Size:     h.Size,
+		Mode:     h.Mode,
+		ModTime:  h.ModTime,
+	}
+}
+
+// SecurityMode controls security features to enforce
+type SecurityMode int
+
+const (
+	// SanitizeFilenames will sanitize filenames (dropping .. path components and turning entries
+	// into relative). Entries with nothing left of their name are skipped, along with their
+	// children.
+	// This feature is enabled by default.
+	SanitizeFilenames SecurityMode = 1
+	// PreventSymlinkTraversal skips the entries that would be written through a symbolic link
+	// of the image.
+	// This feature is enabled by default.
+	PreventSymlinkTraversal SecurityMode = 2
+	// SanitizeSymlinkTargets skips the symbolic links whose target is absolute or escapes the
+	// root of the image, see sanitizer.SanitizeLinkTarget, or through the links seen before, see
+	// safearchive.SymlinkSet.AddLink.
+	// This feature is part of MaximumSecurityMode.
+	SanitizeSymlinkTargets SecurityMode = 4
+	// SkipSpecialFiles skips the Rock Ridge device nodes, fifos and sockets.
+	// This feature is part of MaximumSecurityMode.
+	SkipSpecialFiles SecurityMode = 8
+	// SanitizeFileMode will drop special file modes (e.g. setuid and the sticky bit).
+	// This feature is part of MaximumSecurityMode.
+	SanitizeFileMode SecurityMode = 16
+	// SanitizeUnicode strips the characters used to disguise names in listings from the names of
+	// the entries, see sanitizer.IsUnsafeRune.
+	// This feature is part of MaximumSecurityMode.
+	SanitizeUnicode SecurityMode = 32
+	// ValidateNameEncoding checks that the names of the entries are valid UTF-8 without NUL
+	// bytes, as set by the NameEncodingPolicy of the Reader (see SetNameEncodingPolicy).
+	// This feature is part of MaximumSecurityMode.
+	ValidateNameEncoding SecurityMode = 64
+	// StrictMode makes Next fail with a typed error (e.g. ErrPathTraversal) instead of silently
+	// skipping or rewriting entries flagged by the other security features.
+	// This feature is not enabled by default, nor is it part of MaximumSecurityMode.
+	StrictMode SecurityMode = 128
+)
+
+// MaximumSecurityMode enables all features for maximum security.
+const MaximumSecurityMode = SanitizeFilenames | PreventSymlinkTraversal | SanitizeSymlinkTargets | SkipSpecialFiles | SanitizeFileMode | SanitizeUnicode | ValidateNameEncoding
+
+var securityModeNames = []struct {
+	mode SecurityMode
+	name string
+}{
+	{SanitizeFilenames, "SanitizeFilenames"},
+	{PreventSymlinkTraversal, "PreventSymlinkTraversal"},
+	{SanitizeSymlinkTargets, "SanitizeSymlinkTargets"},
+	{SkipSpecialFiles, "SkipSpecialFiles"},
+	{SanitizeFileMode, "SanitizeFileMode"},
+	{SanitizeUnicode, "SanitizeUnicode"},
+	{ValidateNameEncoding, "ValidateNameEncoding"},
+	{StrictMode, "StrictMode"},
+}
+
+// options are the names of the configurable behaviors of the Reader, registered as features.
+var options = []string{
+	"MaxEntries",
+	"MaxEntrySize",
+	"MaxTotalSize",
+	"NameEncodingPolicy",
+}
+
+func init() {
+	safearchive.RegisterFeatures(safearchive.Feature{Package: "iso", Kind: safearchive.FeatureFormat, Name: "iso"})
+	for _, m := range securityModeNames {
+		safearchive.RegisterFeatures(safearchive.Feature{Package: "iso", Kind: safearchive.FeatureRule, Name: m.name})
+	}
+	for _, o := range options {
+		safearchive.RegisterFeatures(safearchive.Feature{Package: "iso", Kind: safearchive.FeatureOption, Name: o})
+	}
+}
+
+// String returns the names of the enabled features separated by |.
+func (s SecurityMode) String() string {
+	var names []string
+	for _, m := range securityModeNames {
+		if s&m.mode != 0 {
+			names = append(names, m.name)
+			s &^= m.mode
+		}
+	}
+	if s != 0 {
+		names = append(names, fmt.Sprintf("%#x", int(s)))
+	}
+	if len(names) == 0 {
+		return "0"
+	}
+	return strings.Join(names, "|")
+}
+
+// extent is a contiguous range of bytes of the image.
+type extent struct {
+	start, size int64
+}
+
+// record is an entry of the image, as read from its directory records.
+type record struct {
+	// path is the path of the entry in the image, before sanitization.
+	path    string
+	dir     bool
+	extents []extent
+	mode    fs.FileMode
+	modTime time.Time
+	// linkname is the target of a symbolic link.
+	linkname string
+	hidden   bool
+	// multiExtent is set while the next directory record continues the entry.
+	multiExtent bool
+	// offset is the position of the directory record in the image.
+	offset int64
+	depth  int
+}
+
+// Reader provides sequential access to the entries of an ISO 9660 image. Reader.Next advances to
+// the next entry (including the first), and then Reader can be treated as an io.Reader to access
+// the data of the entry.
+type Reader struct {
+	r            io.ReaderAt
+	size         int64
+	blockSize    int64
+	extension    Extension
+	securityMode SecurityMode
+	encoding     safearchive.NameEncodingPolicy
+	maxEntrySize int64
+	maxTotalSize int64
+	maxEntries   int
+
+	// skip is the number of bytes skipped at the start of the system use areas of the directory
+	// records, as set by the SUSP indicator of the Rock Ridge images.
+	skip int
+	// partitions are the extents of the partitions of the UDF images, by partition reference.
+	partitions []extent
+	// pending are the entries to read, the next one last.
+	pending []*record
+	// visited are the starts of the extents of the directories read so far.
+	visited map[int64]bool
+	// err is the sticky error of an invalid image, an exceeded limit or the end of the image.
+	err error
+	// entries and totalSize are the number and the total size of the entries read so far,
+	// including the skipped ones.
+	entries   int
+	totalSize int64
+	symlinks  safearchive.SymlinkSet
+	targets   safearchive.SymlinkSet
+
+	// data is the data of the current entry.
+	data io.Reader
+	// offset and name are the position and the original name of the current entry.
+	offset int64
+	name   string
+
+	findings []safearchive.Finding
+}
+
+// NewReader creates a new Reader reading the image from r, which is size bytes long, and reads
+// the volume descriptors and the root directory of the image.
+func NewReader(r io.ReaderAt, size int64) (*Reader, error) {
+	ir := &Reader{r: r, size: size, securityMode: DefaultSecurityMode, visited: map[int64]bool{}}
+	var primary, joliet []byte
+	udf := false
+	for i := int64(0); i < maxDescriptors; i++ {
+		d := make([]byte, sectorSize)
+		if _, err := r.ReadAt(d, (firstDescriptor+i)*sectorSize); err != nil {
+			break
+		}
+		switch id := string(d[1:6]); {
+		case id == Magic && d[0] == 1 && primary == nil:
+			primary = d
+		case id == Magic && d[0] == 2 && isJoliet(d):
+			joliet = d
+		case id == Magic && d[0] == 255:
+			// the terminator, followed by the UDF volume recognition sequence
+		case id == "NSR02" || id == "NSR03":
+			udf = true
+		case id != Magic && id != "BEA01" && id != "TEA01":
+			i = maxDescriptors
+		}
+	}
+	var root *record
+	var err error
+	switch {
+	case primary != nil:
+		root, err = ir.readISO(primary, joliet)
+	case udf:
+		root, err = ir.readUDF()
+		ir.extension = UDF
+	default:
+		err = fmt.Errorf("%w: no primary volume descriptor", ErrHeader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	children, err := ir.readDir(root)
+	if err != nil {
+		return nil, err
+	}
+	ir.push(children)
+	return ir, nil
+}
+
+// readISO reads the primary volume descriptor of the ISO 9660 file system, and the Joliet one if
+// any, and returns the root directory of the names read.
+func (ir *Reader) readISO(primary, joliet []byte) (*record, error) {
+	ir.blockSize = int64(binary.LittleEndian.Uint16(primary[128:]))
+	if ir.blockSize != 512 && ir.blockSize != 1024 && ir.blockSize != 2048 {
+		return nil, fmt.Errorf("%w: logical block size of %d bytes", ErrHeader, ir.blockSize)
+	}
+	root, err := ir.rootRecord(primary)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ir.readExtent(root.extents[0], sectorSize)
+	if err != nil {
+		return nil, err
+	}
+	// the system use area of the first record of the root directory starts with the SUSP
+	// indicator in the Rock Ridge images
+	if len(b) > 34 && b[0] >= 34+7 && b[32] == 1 {
+		if su := b[34:b[0]]; len(su) >= 7 && string(su[:2]) == "SP" && su[4] == 0xbe && su[5] == 0xef {
+			ir.extension, ir.skip = RockRidge, int(su[6])
+		}
+	}
+	if ir.extension != RockRidge && joliet != nil {
+		if root, err = ir.rootRecord(joliet); err != nil {
+			return nil, err
+		}
+		ir.extension = Joliet
+	}
+	return root, nil
+}
+
+// isJoliet reports whether the supplementary volume descriptor d is the one of the Joliet names,
+// flagged by the escape sequences of the UCS-2 levels.
+func isJoliet(d []byte) bool {
+	esc := d[88:120]
+	return bytes.HasPrefix(esc, []byte("%/@")) || bytes.HasPrefix(esc, []byte("%/C")) || bytes.HasPrefix(esc, []byte("%/E"))
+}
+
+// rootRecord returns the root directory of the volume descriptor d.
+func (ir *Reader) rootRecord(d []byte) (*record, error) {
+	rec := d[156 : 156+34]
+	e, err := ir.extent(rec)
+	if err != nil {
+		return nil, err
+	}
+	return &record{dir: true, extents: []extent{e}, offset: e.start}, nil
+}
+
+// extent returns the extent of the directory record rec, checking that it is within the image.
+func (ir *Reader) extent(rec []byte) (extent, error) {
+	e := extent{start: int64(binary.LittleEndian.Uint32(rec[2:])) * ir.blockSize, size: int64(binary.LittleEndian.Uint32(rec[10:]))}
+	if e.start > ir.size || e.size > ir.size-e.start {
+		return e, fmt.Errorf("%w: extent of %d bytes at %d beyond the image", ErrHeader, e.size, e.start)
+	}
+	return e, nil
+}
+
+// readExtent reads at most max bytes of e.
+func (ir *Reader) readExtent(e extent, max int64) ([]byte, error) {
+	if e.size < max {
+		max = e.size
+	}
+	b := make([]byte, max)
+	if _, err := ir.r.ReadAt(b, e.start); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return b, nil
+}
+
+// push adds the records to the entries to read, in order.
+func (ir *Reader) push(records []*record) {
+	for i := len(records) - 1; i >= 0; i-- {
+		ir.pending = append(ir.pending, records[i])
+	}
+}
+
+// readDir reads the records of the directory dir, or its FIDs in the UDF images.
+func (ir *Reader) readDir(dir *record) ([]*record, error) {
+	if len(dir.extents) == 0 {
+		return nil, nil
+	}
+	e := dir.extents[0]
+	if ir.visited[e.start] {
+		return nil, fmt.Errorf("%w: directory loop", ErrHeader)
+	}
+	ir.visited[e.start] = true
+	if dir.depth >= maxDepth {
+		return nil, fmt.Errorf("%w: directories nested deeper than %d", ErrHeader, maxDepth)
+	}
+	if ir.extension == UDF {
+		return ir.readUDFDir(dir)
+	}
+	if e.size > maxDirectorySize {
+		return nil, fmt.Errorf("%w: directory of %d bytes", ErrLimitExceeded, e.size)
+	}
+	b, err := ir.readExtent(e, e.size)
+	if err != nil {
+		return nil, err
+	}
+	var children []*record
+	for pos := 0; pos < len(b); {
+		n := int(b[pos])
+		if n == 0 {
+			// the records do not cross the boundaries of the logical blocks
+			pos = (pos/int(ir.blockSize) + 1) * int(ir.blockSize)
+			continue
+		}
+		if n < 34 || pos+n > len(b) || 33+int(b[pos+32]) > n {
+			return nil, fmt.Errorf("%w: bad directory record at %d", ErrHeader, e.start+int64(pos))
+		}
+		rec := b[pos : pos+n]
+		offset := e.start + int64(pos)
+		pos += n
+		if last := len(children) - 1; last >= 0 && children[last].multiExtent {
+			// a section of a file split across extents
+			x, err := ir.extent(rec)
+			if err != nil {
+				return nil, err
+			}
+			children[last].extents = append(children[last].extents, x)
+			children[last].multiExtent = rec[25]&0x80 != 0
+			continue
+		}
+		child, err := ir.parseRecord(dir, rec, offset)
+		if err != nil {
+			return nil, err
+		}
+		if child != nil {
+			children = append(children, child)
+		}
+	}
+	return children, nil
+}
+
+// parseRecord parses a directory record of dir. It returns nil for the records to skip: the
+// records of the directory itself and of its parent, the associated files and the Rock Ridge
+// relocated directories.
+func (ir *Reader) parseRecord(dir *record, rec []byte, offset int64) (*record, error) {
+	const (
+		flagHidden      = 0x01
+		flagDirectory   = 0x02
+		flagAssociated  = 0x04
+		flagMultiExtent = 0x80
+	)
+	idLen := int(rec[32])
+	id := rec[33 : 33+idLen]
+	flags := rec[25]
+	if idLen == 1 && (id[0] == 0 || id[0] == 1) || flags&flagAssociated != 0 {
+		return nil, nil
+	}
+	e, err := ir.extent(rec)
+	if err != nil {
+		return nil, err
+	}
+	r := &record{
+		dir:         flags&flagDirectory != 0,
+		extents:     []extent{e},
+		modTime:     recordTime(rec[18:25]),
+		hidden:      flags&flagHidden != 0,
+		multiExtent: flags&flagMultiExtent != 0,
+		offset:      offset,
+		depth:       dir.depth + 1,
+	}
+	name := isoName(id)
+	if ir.extension == Joliet {
+		name = jolietName(id)
+	}
+	if ir.extension == RockRidge {
+		// the system use area follows the identifier, padded to an even length
+		su := rec[33+idLen+(idLen+1)%2:]
+		if ir.skip > len(su) {
+			return nil, fmt.Errorf("%w: bad system use area at %d", ErrHeader, offset)
+		}
+		rr, err := ir.parseSUSP(su[ir.skip:])
+		if err != nil {
+			return nil, fmt.Errorf("%w at %d", err, offset)
+		}
+		if rr.relocated {
+			return nil, nil
+		}
+		if rr.name != "" {
+			name = rr.name
+		}
+		if rr.mode != nil {
+			r.mode = *rr.mode
+		}
+		if rr.child != nil {
+			// a directory relocated for its depth, whose data is read from its own record
+			r.dir, r.extents[0] = true, *rr.child
+		}
+		if rr.symlink {
+			if rr.mode == nil {
+				r.mode = 0777
+			}
+			r.mode |= fs.ModeSymlink
+			r.linkname = rr.linkname
+		}
+		if !rr.modTime.IsZero() {
+			r.modTime = rr.modTime
+		}
+	}
+	if r.mode == 0 {
+		r.mode = 0644
+		if r.dir {
+			r.mode = fs.ModeDir | 0755
+		}
+	}
+	if r.dir {
+		r.mode = r.mode&^fs.ModeType | fs.ModeDir
+	}
+	r.path = name
+	if dir.path != "" {
+		r.path = dir.path + "/" + name
+	}
+	return r, nil
+}
+
+// isoName returns the name of the ISO 9660 identifier id, without its version.
+func isoName(id []byte) string {
+	name := string(id)
+	if i := strings.LastIndexByte(name, ';'); i >= 0 {
+		name = name[:i]
+	}
+	if n := strings.TrimSuffix(name, "."); n != "" {
+		name = n
+	}
+	return name
+}
+
+// jolietName returns the name of the Joliet identifier id, in UCS-2 big endian.
+func jolietName(id []byte) string {
+	u := make([]uint16, len(id)/2)
+	for i := range u {
+		u[i] = binary.BigEndian.Uint16(id[2*i:])
+	}
+	name := string(utf16.Decode(u))
+	if i := strings.LastIndexByte(name, ';'); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// recordTime returns the time of the 7 bytes recording date and time of a directory record.
+func recordTime(b []byte) time.Time {
+	if b[1] == 0 {
+		return time.Time{}
+	}
+	zone := time.FixedZone("", int(int8(b[6]))*15*60)
+	return time.Date(1900+int(b[0]), time.Month(b[1]), int(b[2]), int(b[3]), int(b[4]), int(b[5]), 0, zone)
+}
+
+// rockRidge is the Rock Ridge description of a directory record.
+type rockRidge struct {
+	name     string
+	mode     *fs.FileMode
+	symlink  bool
+	linkname string
+	modTime  time.Time
+	// child is the extent of a relocated directory, and relocated is set for the record of the
+	// relocated directory in the directory it was moved to.
+	child     *extent
+	relocated bool
+}
+
+// parseSUSP parses the system use entries of a directory record.
+func (ir *Reader) parseSUSP(su []byte) (*rockRidge, error) {
+	rr := &rockRidge{}
+	var name, link strings.Builder
+	// linkContinues is set while the last component of the target of the link continues
+	linkContinues := true
+	for hops := 0; ; hops++ {
+		var next *extent
+		for len(su) >= 4 {
+			n := int(su[2])
+			if n < 4 || n > len(su) {
+				return nil, fmt.Errorf("%w: bad system use entry", ErrHeader)
+			}
+			entry, data := su[:n], su[4:n]
+			su = su[n:]
+			switch string(entry[:2]) {
+			case "ST":
+				su = nil
+			case "CE":
+				if len(data) < 24 {
+					return nil, fmt.Errorf("%w: bad continuation area", ErrHeader)
+				}
+				next = &extent{
+					start: int64(binary.LittleEndian.Uint32(data[0:]))*ir.blockSize + int64(binary.LittleEndian.Uint32(data[8:])),
+					size:  int64(binary.LittleEndian.Uint32(data[16:])),
+				}
+			case "NM":
+				if len(data) >= 1 && data[0]&0x06 == 0 {
+					name.Write(data[1:])
+				}
+			case "PX":
+				if len(data) >= 4 {
+					m := unixMode(binary.LittleEndian.Uint32(data))
+					rr.mode = &m
+				}
+			case "SL":
+				if len(data) < 1 {
+					continue
+				}
+				rr.symlink = true
+				for c := data[1:]; len(c) >= 2 && 2+int(c[1]) <= len(c); c = c[2+int(c[1]):] {
+					var s string
+					switch {
+					case c[0]&0x02 != 0:
+						s = "."
+					case c[0]&0x04 != 0:
+						s = ".."
+					case c[0]&0x08 != 0:
+						s = "/"
+					default:
+						s = string(c[2 : 2+int(c[1])])
+					}
+					if !linkContinues && !strings.HasSuffix(link.String(), "/") {
+						link.WriteByte('/')
+					}
+					link.WriteString(s)
+					linkContinues = c[0]&0x01 != 0
+				}
+			case "TF":
+				rr.modTime = tfModTime(data)
+			case "CL":
+				if len(data) < 4 {
+					return nil, fmt.Errorf("%w: bad child link", ErrHeader)
+				}
+				child, err := ir.relocatedDir(int64(binary.LittleEndian.Uint32(data)) * ir.blockSize)
+				if err != nil {
+					return nil, err
+				}
+				rr.child = &child
+			case "RE":
+				rr.relocated = true
+			}
+		}
+		if next == nil {
+			break
+		}
+		if hops == maxContinuations || next.start > ir.size || next.size > ir.size-next.start || next.size > sectorSize {
+			return nil, fmt.Errorf("%w: bad continuation area", ErrHeader)
+		}
+		b, err := ir.readExtent(*next, next.size)
+		if err != nil {
+			return nil, err
+		}
+		su = b
+	}
+	rr.name, rr.linkname = name.String(), link.String()
+	return rr, nil
+}
+
+// relocatedDir returns the extent of the directory at start, read from the record of the
+// directory itself.
+func (ir *Reader) relocatedDir(start int64) (extent, error) {
+	b, err := ir.readExtent(extent{start: start, size: ir.size - start}, 34)
+	if err != nil || len(b) < 34 || b[0] < 34 {
+		return extent{}, fmt.Errorf("%w: bad relocated directory", ErrHeader)
+	}
+	return ir.extent(b)
+}
+
+// tfModTime returns the modification time of the data of a TF entry, or the zero time.
+func tfModTime(data []byte) time.Time {
+	const (
+		flagCreation = 0x01
+		flagModify   = 0x02
+		flagLongForm = 0x80
+	)
+	if len(data) < 1 || data[0]&flagModify == 0 || data[0]&flagLongForm != 0 {
+		return time.Time{}
+	}
+	off := 1
+	if data[0]&flagCreation != 0 {
+		off += 7
+	}
+	if off+7 > len(data) {
+		return time.Time{}
+	}
+	return recordTime(data[off : off+7])
+}
+
+// unixMode returns the fs.FileMode of the POSIX mode m.
+func unixMode(m uint32) fs.FileMode {
+	mode := fs.FileMode(m & 0777)
+	if m&04000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if m&02000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if m&01000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	switch m & 0170000 {
+	case 0140000:
+		mode |= fs.ModeSocket
+	case 0120000:
+		mode |= fs.ModeSymlink
+	case 0060000:
+		mode |= fs.ModeDevice
+	case 0040000:
+		mode |= fs.ModeDir
+	case 0020000:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case 0010000:
+		mode |= fs.ModeNamedPipe
+	}
+	return mode
+}
+
+// Extension returns the extension of ISO 9660 whose names are read.
+func (ir *Reader) Extension() Extension {
+	return ir.extension
+}
+
+// SetSecurityMode controls the security features applied when reading this image
+func (ir *Reader) SetSecurityMode(s SecurityMode) {
+	ir.securityMode = s
+}
+
+// GetSecurityMode returns the currently enabled security features
+func (ir *Reader) GetSecurityMode() SecurityMode {
+	return ir.securityMode
+}
+
+// SetNameEncodingPolicy controls what ValidateNameEncoding does with the names that are not valid
+// UTF-8 or have NUL bytes. By default (safearchive.NameEncodingReplace) the invalid bytes are
+// replaced with U+FFFD.
+func (ir *Reader) SetNameEncodingPolicy(p safearchive.NameEncodingPolicy) {
+	ir.encoding = p
+}
+
+// SetMaxEntrySize limits the size of the entries of the image. Next fails with an error wrapping
+// ErrLimitExceeded when an entry declares a larger size. Zero (the default) means no limit.
+func (ir *Reader) SetMaxEntrySize(n int64) {
+	ir.maxEntrySize = n
+}
+
+// SetMaxTotalSize limits the total size of the entries of the image, including the ones skipped
+// by the security features. The extents of the entries of an image may overlap, so the total size
+// of the entries may exceed the size of the image by far. Next fails with an error wrapping
+// ErrLimitExceeded when an entry would exceed the limit. Zero (the default) means no limit.
+func (ir *Reader) SetMaxTotalSize(n int64) {
+	ir.maxTotalSize = n
+}
+
+// SetMaxEntries limits the number of entries of the image, including the ones skipped by the
+// security features. Next fails with an error wrapping ErrLimitExceeded when the image has more
+// entries. Zero (the default) means no limit.
+func (ir *Reader) SetMaxEntries(n int) {
+	ir.maxEntries = n
+}
+
+// Report returns the findings about the entries read so far: every entry that was renamed,
+// sanitized or dropped, along with the reason code of the security feature that flagged it.
+func (ir *Reader) Report() *safearchive.Report {
+	return &safearchive.Report{Findings: append([]safearchive.Finding{}, ir.findings...)}
+}
+
+// flag records a finding about the current entry.
+func (ir *Reader) flag(v safearchive.Verdict) safearchive.Finding {
+	f := safearchive.Finding{Name: ir.name, Offset: ir.offset, Reason: v.Reason, Action: v.Action, Detail: v.Detail}
+	ir.findings = append(ir.findings, f)
+	return f
+}
+
+// Next advances to the next entry of the image. io.EOF is returned at the end of the image. Other
+// errors are *safearchive.EntryError values telling which entry failed (e.g. wrapping ErrHeader,
+// ErrLimitExceeded or a rejection of StrictMode). Once the image had an invalid directory or
+// exceeded a limit, Next keeps returning the same error.
+func (ir *Reader) Next() (*Header, error) {
+	if ir.err != nil {
+		return nil, ir.err
+	}
+	h, err := ir.next()
+	if err != nil {
+		if _, ok := err.(*safearchive.EntryError); !ok && err != io.EOF {
+			err = &safearchive.EntryError{Name: ir.name, Offset: ir.offset, Err: err}
+		}
+		ir.data = nil
+		ir.err = err
+	}
+	return h, err
+}
+
+func (ir *Reader) next() (*Header, error) {
+	for {
+		ir.data = nil
+		if len(ir.pending) == 0 {
+			return nil, io.EOF
+		}
+		r := ir.pending[len(ir.pending)-1]
+		ir.pending = ir.pending[:len(ir.pending)-1]
+		ir.offset, ir.name = r.offset, r.path
+		h := &Header{Name: r.path, Linkname: r.linkname, Mode: r.mode, ModTime: r.modTime, Hidden: r.hidden}
+		if !r.dir && r.linkname == "" {
+			for _, e := range r.extents {
+				h.Size += e.size
+			}
+		}
+		if err := ir.checkLimits(h); err != nil {
+			return nil, err
+		}
+		start := len(ir.findings)
+		keep, err := ir.applyRules(h)
+		if err != nil {
+			return nil, err
+		}
+		if !keep {
+			// the children of the directories are skipped as well
+			continue
+		}
+		if r.dir {
+			children, err := ir.readDir(r)
+			if err != nil {
+				return nil, err
+			}
+			ir.push(children)
+		} else if h.Size > 0 {
+			readers := make([]io.Reader, len(r.extents))
+			for i, e := range r.extents {
+				readers[i] = ir.extentReader(e)
+			}
+			ir.data = io.MultiReader(readers...)
+		}
+		if h.Name != ir.name {
+			for i := start; i < len(ir.findings); i++ {
+				ir.findings[i].NewName = h.Name
+			}
+		}
+		return h, nil
+	}
+}
+
+// checkLimits accounts h against the limits of the reader, and returns the error to fail Next with
+// if it exceeds one of them.
+func (ir *Reader) checkLimits(h *Header) error {
+	ir.entries++
+	var detail string
+	switch {
+	case ir.maxEntries > 0 && ir.entries > ir.maxEntries:
+		detail = fmt.Sprintf("image has more than %d entries", ir.maxEntries)
+	case ir.maxEntrySize > 0 && h.Size > ir.maxEntrySize:
+		detail = fmt.Sprintf("entry declares %d bytes, the limit is %d", h.Size, ir.maxEntrySize)
+	case ir.maxTotalSize > 0 && h.Size > ir.maxTotalSize-ir.totalSize:
+		detail = fmt.Sprintf("entries declare more than %d bytes in total", ir.maxTotalSize)
+	}
+	ir.totalSize += h.Size
+	if detail == "" {
+		return nil
+	}
+	f := ir.flag(safearchive.Verdict{Action: safearchive.ActionRejected, Reason: safearchive.ReasonLimitExceeded, Detail: detail})
+	return f.Err(ErrLimitExceeded)
+}
+
+// applyRules applies the security features on h, until one of them drops or rejects it. It
+// reports whether the entry is to be kept.
+func (ir *Reader) applyRules(h *Header) (bool, error) {
+	names := safearchive.NameChecks{
+		ValidateEncoding: ir.securityMode&ValidateNameEncoding != 0,
+		Encoding:         ir.encoding,
+		SanitizeUnicode:  ir.securityMode&SanitizeUnicode != 0,
+		SanitizePath:     ir.securityMode&SanitizeFilenames != 0,
+	}
+	rules := append(names.Rules(&h.Name),
+		func() safearchive.Verdict { return ir.preventSymlinkTraversal(h) },
+		func() safearchive.Verdict { return ir.sanitizeSymlinkTargets(h) },
+		func() safearchive.Verdict { return ir.skipSpecialFiles(h) },
+		func() safearchive.Verdict { return ir.sanitizeFileMode(h) },
+	)
+	return safearchive.ApplyRules(rules, ir.securityMode&StrictMode != 0, ir.flag)
+}
+
+func (ir *Reader) preventSymlinkTraversal(h *Header) safearchive.Verdict {
+	if ir.securityMode&PreventSymlinkTraversal == 0 {
+		return safearchive.Pass
+	}
+	name := path.Clean(filepath.ToSlash(sanitizer.SanitizePath(h.Name)))
+	if ir.symlinks.Covers(name) {
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonSymlinkTraversal}
+	}
+	if h.Mode&fs.ModeSymlink != 0 {
+		ir.symlinks.Add(name)
+	}
+	return safearchive.Pass
+}
+
+func (ir *Reader) sanitizeSymlinkTargets(h *Header) safearchive.Verdict {
+	if ir.securityMode&SanitizeSymlinkTargets == 0 || h.Mode&fs.ModeSymlink == 0 {
+		return safearchive.Pass
+	}
+	if sanitizer.SanitizeLinkTarget(h.Name, h.Linkname) != h.Linkname {
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonSymlinkTarget, Detail: "target " + h.Linkname}
+	}
+	name := path.Clean(filepath.ToSlash(sanitizer.SanitizePath(h.Name)))
+	if !ir.targets.AddLink(name, filepath.ToSlash(h.Linkname)) {
+		// the target escapes through the links seen before, or makes one of them escape
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonSymlinkTarget, Detail: "target " + h.Linkname + " escapes through other links"}
+	}
+	return safearchive.Pass
+}
+
+func (ir *Reader) skipSpecialFiles(h *Header) safearchive.Verdict {
+	if ir.securityMode&SkipSpecialFiles != 0 && h.Mode&(fs.ModeDevice|fs.ModeNamedPipe|fs.ModeSocket) != 0 {
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonSpecialFile}
+	}
+	return safearchive.Pass
+}
+
+func (ir *Reader) sanitizeFileMode(h *Header) safearchive.Verdict {
+	const special = fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+	if ir.securityMode&SanitizeFileMode == 0 || h.Mode&special == 0 {
+		return safearchive.Pass
+	}
+	v := safearchive.Verdict{Action: safearchive.ActionModified, Reason: safearchive.ReasonSpecialMode, Detail: fmt.Sprintf("mode %v changed to %v", h.Mode, h.Mode&^special)}
+	h.Mode &^= special
+	return v
+}
+
+// Read reads from the current entry of the image. It returns (0, io.EOF) when it reaches the end
+// of that entry, until Next is called to advance to the next entry.
+//
+// Errors other than io.EOF are *safearchive.EntryError values about the current entry.
+func (ir *Reader) Read(b []byte) (int, error) {
+	if ir.data == nil {
+		return 0, io.EOF
+	}
+	n, err := ir.data.Read(b)
+	if err != nil && err != io.EOF {
+		err = &safearchive.EntryError{Name: ir.name, Offset: ir.offset, Err: err}
+	}
+	return n, err
+}
@@ -0,0 +1,461 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iso
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/google/safearchive"
+)
+
+type file struct {
+	path string
+	data string
+	dir  bool
+	// mode and link are the Rock Ridge mode and symbolic link target.
+	mode uint32
+	link string
+	// relocated is the path of the directory of a Rock Ridge child link, and moved flags a
+	// relocated directory.
+	relocated string
+	moved     bool
+	// split is the size of the first extent of a file recorded in two extents.
+	split int
+	// nm overrides the Rock Ridge name of the file.
+	nm string
+}
+
+type node struct {
+	file
+	name     string
+	children []*node
+	// dir is the sector of the directory in the ISO 9660 and in the Joliet trees.
+	dir [2]int
+	// data is the sector of the data of a file.
+	data int
+}
+
+// su returns a system use entry.
+func su(sig string, data ...byte) []byte {
+	return append([]byte{sig[0], sig[1], byte(4 + len(data)), 1}, data...)
+}
+
+// dirRecord returns a directory record.
+func dirRecord(id []byte, lba, size int, flags byte, sysUse []byte) []byte {
+	n := 33 + len(id)
+	if len(id)%2 == 0 {
+		n++
+	}
+	rec := make([]byte, n, n+len(sysUse)+1)
+	binary.LittleEndian.PutUint32(rec[2:], uint32(lba))
+	binary.BigEndian.PutUint32(rec[6:], uint32(lba))
+	binary.LittleEndian.PutUint32(rec[10:], uint32(size))
+	binary.BigEndian.PutUint32(rec[14:], uint32(size))
+	copy(rec[18:], []byte{124, 1, 2, 3, 4, 5, 0})
+	rec[25] = flags
+	rec[32] = byte(len(id))
+	copy(rec[33:], id)
+	rec = append(rec, sysUse...)
+	if len(rec)%2 == 1 {
+		rec = append(rec, 0)
+	}
+	rec[0] = byte(len(rec))
+	return rec
+}
+
+// image returns an ISO 9660 image of the files, with the Rock Ridge names and the Joliet names if
+// set.
+func image(rockRidge, joliet bool, files ...file) []byte {
+	root := &node{file: file{dir: true}}
+	nodes := map[string]*node{".": root}
+	for _, f := range files {
+		n := &node{file: f, name: path.Base(f.path)}
+		if f.nm != "" {
+			n.name = f.nm
+		}
+		parent := nodes[path.Dir(f.path)]
+		parent.children = append(parent.children, n)
+		nodes[f.path] = n
+	}
+	next := 19
+	var dirs []*node
+	var walk func(n *node)
+	walk = func(n *node) {
+		if n.file.dir {
+			dirs = append(dirs, n)
+			n.dir[0], n.dir[1] = next, next+1
+			next += 2
+		} else if n.file.data != "" {
+			n.data = next
+			next += (len(n.file.data) + sectorSize - 1) / sectorSize
+		}
+		for _, c := range n.children {
+			walk(c)
+		}
+	}
+	walk(root)
+	img := make([]byte, next*sectorSize)
+	descriptor := func(sector int, typ byte, root int) []byte {
+		d := img[sector*sectorSize : (sector+1)*sectorSize]
+		d[0] = typ
+		copy(d[1:], Magic+"\x01")
+		binary.LittleEndian.PutUint16(d[128:], sectorSize)
+		binary.BigEndian.PutUint16(d[130:], sectorSize)
+		if typ != 255 {
+			copy(d[156:], dirRecord([]byte{0}, root, sectorSize, 0x02, nil))
+		}
+		return d
+	}
+	descriptor(16, 1, root.dir[0])
+	if joliet {
+		copy(descriptor(17, 2, root.dir[1])[88:], "%/E")
+	}
+	descriptor(18, 255, 0)
+	for _, n := range dirs {
+		for tree := 0; tree < 2; tree++ {
+			var self []byte
+			if tree == 0 && rockRidge && n == root {
+				self = su("SP", 0xbe, 0xef, 0)
+			}
+			b := append(dirRecord([]byte{0}, n.dir[tree], sectorSize, 0x02, self), dirRecord([]byte{1}, root.dir[tree], sectorSize, 0x02, nil)...)
+			for _, c := range n.children {
+				id := []byte(strings.ToUpper(c.name))
+				if !c.file.dir {
+					id = append(id, ";1"...)
+				}
+				var sysUse []byte
+				if tree == 1 {
+					id = nil
+					for _, u := range utf16.Encode([]rune(c.name)) {
+						id = binary.BigEndian.AppendUint16(id, u)
+					}
+				} else if rockRidge {
+					sysUse = append(su("NM", 0), c.name...)
+					sysUse[2] = byte(len(sysUse))
+					if c.mode != 0 {
+						sysUse = append(sysUse, su("PX", binary.LittleEndian.AppendUint32(make([]byte, 0, 32), c.mode)...)...)
+					}
+					if c.link != "" {
+						var comps []byte
+						for _, comp := range strings.Split(c.link, "/") {
+							switch comp {
+							case "":
+								comps = append(comps, 0x08, 0)
+							case "..":
+								comps = append(comps, 0x04, 0)
+							default:
+								comps = append(append(comps, 0, byte(len(comp))), comp...)
+							}
+						}
+						sysUse = append(sysUse, su("SL", append([]byte{0}, comps...)...)...)
+					}
+					if c.relocated != "" {
+						sysUse = append(sysUse, su("CL", binary.LittleEndian.AppendUint32(nil, uint32(nodes[c.relocated].dir[0]))...)...)
+					}
+					if c.moved {
+						sysUse = append(sysUse, su("RE")...)
+					}
+				}
+				switch {
+				case c.relocated != "" && tree == 0:
+					b = append(b, dirRecord(id, 0, 0, 0, sysUse)...)
+				case c.file.dir:
+					b = append(b, dirRecord(id, c.dir[tree], sectorSize, 0x02, sysUse)...)
+				case c.split > 0:
+					b = append(b, dirRecord(id, c.data, c.split, 0x80, sysUse)...)
+					b = append(b, dirRecord(id, c.data+c.split/sectorSize, len(c.file.data)-c.split, 0, sysUse)...)
+				default:
+					b = append(b, dirRecord(id, c.data, len(c.file.data), 0, sysUse)...)
+				}
+			}
+			copy(img[n.dir[tree]*sectorSize:], b)
+		}
+	}
+	for _, n := range nodes {
+		copy(img[n.data*sectorSize:], n.file.data)
+	}
+	return img
+}
+
+// read returns the names and contents (or link targets) of the entries of the image.
+func read(t *testing.T, r *Reader) (map[string]string, error) {
+	t.Helper()
+	re := map[string]string{}
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			return re, nil
+		}
+		if err != nil {
+			return re, err
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return re, err
+		}
+		if int64(len(b)) != h.Size {
+			t.Errorf("%q has %d bytes, want %d", h.Name, len(b), h.Size)
+		}
+		if h.Linkname != "" {
+			b = []byte("-> " + h.Linkname)
+		}
+		if h.Mode.IsDir() {
+			b = []byte("dir")
+		}
+		re[h.Name] = string(b)
+	}
+}
+
+func newReader(t *testing.T, img []byte, mode SecurityMode) *Reader {
+	t.Helper()
+	r, err := NewReader(bytes.NewReader(img), int64(len(img)))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	r.SetSecurityMode(mode)
+	return r
+}
+
+func TestExtensions(t *testing.T) {
+	files := []file{
+		{path: "Docs", dir: true},
+		{path: "Docs/Read me.txt", data: "read me"},
+		{path: "Ünïcode.txt", data: "unicode"},
+	}
+	tests := []struct {
+		name      string
+		rockRidge bool
+		joliet    bool
+		want      Extension
+		names     []string
+	}{
+		{name: "ISO 9660", want: NoExtension, names: []string{"DOCS", "DOCS/READ ME.TXT", "ÜÏCODE.TXT"}},
+		{name: "Joliet", joliet: true, want: Joliet, names: []string{"Docs", "Docs/Read me.txt", "Ünïcode.txt"}},
+		{name: "Rock Ridge", rockRidge: true, joliet: true, want: RockRidge, names: []string{"Docs", "Docs/Read me.txt", "Ünïcode.txt"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newReader(t, image(tc.rockRidge, tc.joliet, files...), SanitizeFilenames|PreventSymlinkTraversal)
+			if got := r.Extension(); got != tc.want {
+				t.Errorf("Extension() = %v, want %v", got, tc.want)
+			}
+			var names []string
+			for {
+				h, err := r.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Next() error = %v", err)
+				}
+				names = append(names, h.Name)
+			}
+			if tc.name == "ISO 9660" {
+				// the test image has the upper case UTF-8 names in its ISO 9660 names
+				tc.names[2] = strings.ToUpper("Ünïcode.txt")
+			}
+			if !reflect.DeepEqual(names, tc.names) {
+				t.Errorf("entries = %q, want %q", names, tc.names)
+			}
+		})
+	}
+}
+
+func TestRockRidge(t *testing.T) {
+	img := image(true, false,
+		file{path: "bin", dir: true, mode: 040755},
+		file{path: "bin/tool", mode: 0100755, data: "#!/bin/sh"},
+		file{path: "bin/link", mode: 0120777, link: "tool"},
+		file{path: "a", relocated: "rr_moved/a"},
+		file{path: "rr_moved", dir: true},
+		file{path: "rr_moved/a", dir: true, moved: true},
+		file{path: "rr_moved/a/deep.txt", data: "deep"},
+		file{path: "big.bin", data: strings.Repeat("x", 3*sectorSize+10), split: 2 * sectorSize},
+	)
+	r := newReader(t, img, SanitizeFilenames|PreventSymlinkTraversal)
+	modes := map[string]fs.FileMode{}
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		modes[h.Name] = h.Mode
+	}
+	wantModes := map[string]fs.FileMode{
+		"bin":        fs.ModeDir | 0755,
+		"bin/tool":   0755,
+		"bin/link":   fs.ModeSymlink | 0777,
+		"a":          fs.ModeDir | 0755,
+		"a/deep.txt": 0644,
+		"rr_moved":   fs.ModeDir | 0755,
+		"big.bin":    0644,
+	}
+	if !reflect.DeepEqual(modes, wantModes) {
+		t.Errorf("modes = %v, want %v", modes, wantModes)
+	}
+
+	got, err := read(t, newReader(t, img, SanitizeFilenames|PreventSymlinkTraversal))
+	if err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	want := map[string]string{
+		"bin":        "dir",
+		"bin/tool":   "#!/bin/sh",
+		"bin/link":   "-> tool",
+		"a":          "dir",
+		"a/deep.txt": "deep",
+		"rr_moved":   "dir",
+		"big.bin":    strings.Repeat("x", 3*sectorSize+10),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %.80q, want %.80q", got, want)
+	}
+}
+
+func TestSecurityModes(t *testing.T) {
+	img := image(true, false,
+		file{path: "evil", nm: "../../etc/cron.d/evil", data: "evil"},
+		file{path: "link", mode: 0120777, link: "/etc"},
+		file{path: "dir", nm: "link", dir: true},
+		file{path: "dir/passwd", data: "through the link"},
+		file{path: "null", mode: 0020666},
+		file{path: "suid", mode: 0104755, data: "suid"},
+		file{path: "bidi‮.txt", data: "bidi"},
+	)
+
+	got, err := read(t, newReader(t, img, SanitizeFilenames|PreventSymlinkTraversal))
+	if err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	want := map[string]string{"etc/cron.d/evil": "evil", "link": "-> /etc", "null": "", "suid": "suid", "bidi‮.txt": "bidi"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %q, want %q", got, want)
+	}
+
+	r := newReader(t, img, MaximumSecurityMode)
+	if got, err = read(t, r); err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	want = map[string]string{"etc/cron.d/evil": "evil", "suid": "suid", "bidi.txt": "bidi"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("entries in MaximumSecurityMode = %q, want %q", got, want)
+	}
+	var reasons []safearchive.Reason
+	for _, f := range r.Report().Findings {
+		reasons = append(reasons, f.Reason)
+	}
+	wantReasons := []safearchive.Reason{
+		safearchive.ReasonPathTraversal,
+		safearchive.ReasonSymlinkTarget,
+		safearchive.ReasonSymlinkTraversal,
+		safearchive.ReasonSpecialFile,
+		safearchive.ReasonSpecialMode,
+		safearchive.ReasonUnsafeUnicode,
+	}
+	if !reflect.DeepEqual(reasons, wantReasons) {
+		t.Errorf("Report() reasons = %q, want %q", reasons, wantReasons)
+	}
+
+	if _, err := read(t, newReader(t, img, MaximumSecurityMode|StrictMode)); !errors.Is(err, safearchive.ErrPathTraversal) {
+		t.Errorf("Next() in StrictMode error = %v, want %v", err, safearchive.ErrPathTraversal)
+	}
+}
+
+func TestSanitizeUnicodeTraversal(t *testing.T) {
+	img := image(true, true, file{path: "evil", nm: ".\u200b./.\u200b./etc/passwd", data: "evil"})
+	got, err := read(t, newReader(t, img, MaximumSecurityMode))
+	if err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	if want := map[string]string{"etc/passwd": "evil"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %q, want %q", got, want)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	img := image(false, false, file{path: "a", data: "aaaa"}, file{path: "b", data: "bbbb"}, file{path: "c", data: "cccc"})
+	tests := []struct {
+		name string
+		set  func(r *Reader)
+	}{
+		{name: "entries", set: func(r *Reader) { r.SetMaxEntries(2) }},
+		{name: "entry size", set: func(r *Reader) { r.SetMaxEntrySize(3) }},
+		{name: "total size", set: func(r *Reader) { r.SetMaxTotalSize(10) }},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newReader(t, img, SanitizeFilenames)
+			tc.set(r)
+			_, err := read(t, r)
+			if !errors.Is(err, ErrLimitExceeded) {
+				t.Errorf("Next() error = %v, want %v", err, ErrLimitExceeded)
+			}
+			if _, again := r.Next(); again != err {
+				t.Errorf("Next() after a failure error = %v, want %v", again, err)
+			}
+		})
+	}
+}
+
+func TestInvalidImages(t *testing.T) {
+	valid := image(false, false, file{path: "dir", dir: true}, file{path: "dir/a", data: "aaaa"})
+	// the sectors of the root and of the directory, and the offset of their third records
+	root, dir, rec := 19*sectorSize, 21*sectorSize, 34+34
+	patch := func(off int, b ...byte) []byte {
+		img := append([]byte{}, valid...)
+		copy(img[off:], b)
+		return img
+	}
+	udf := make([]byte, 20*sectorSize)
+	copy(udf[16*sectorSize+1:], "BEA01")
+	copy(udf[17*sectorSize+1:], "NSR02")
+	copy(udf[18*sectorSize+1:], "TEA01")
+	tests := []struct {
+		name    string
+		img     []byte
+		wantErr error
+	}{
+		{name: "empty", img: nil, wantErr: ErrHeader},
+		{name: "not iso", img: make([]byte, 40*sectorSize), wantErr: ErrHeader},
+		{name: "UDF without anchor", img: udf, wantErr: ErrHeader},
+		{name: "block size", img: patch(16*sectorSize+128, 0, 3), wantErr: ErrHeader},
+		{name: "extent beyond the image", img: patch(dir+rec+10, 0xff, 0xff, 0xff), wantErr: ErrHeader},
+		{name: "directory loop", img: patch(root+rec+2, 19), wantErr: ErrHeader},
+		{name: "bad record", img: patch(dir+rec, 20), wantErr: ErrHeader},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewReader(bytes.NewReader(tc.img), int64(len(tc.img)))
+			if err == nil {
+				_, err = read(t, r)
+			}
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("Next() error = %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
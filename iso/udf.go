@@ -0,0 +1,541 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iso
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/google/safearchive/internal/limits"
+)
+
+// The UDF file system (ECMA-167 and the OSTA UDF specification) of the images without an ISO 9660
+// one. Its descriptors are found from the anchor at the sector 256: the volume descriptor sequence
+// describes the partitions and the logical volume, whose file set descriptor points to the root
+// directory. The directories hold file identifier descriptors (FIDs) naming the file entries (FEs)
+// of their children, which describe the extents of their data.
+
+const (
+	// anchorSector is the sector of the anchor volume descriptor pointer.
+	anchorSector = 256
+	// maxAllocationExtents is the maximum number of extents of allocation descriptors of a file.
+	maxAllocationExtents = 1024
+)
+
+// The identifiers of the descriptor tags.
+const (
+	tagAnchor            = 2
+	tagPointer           = 3
+	tagPartition         = 5
+	tagLogicalVolume     = 6
+	tagTerminating       = 8
+	tagFileSet           = 256
+	tagFileIdentifier    = 257
+	tagAllocationExtent  = 258
+	tagFileEntry         = 261
+	tagExtendedFileEntry = 266
+)
+
+// lbAddr is the address of a logical block of a partition of a UDF volume.
+type lbAddr struct {
+	block     uint32
+	partition uint16
+}
+
+// longAD returns the address of the long allocation descriptor b.
+func longAD(b []byte) lbAddr {
+	return lbAddr{block: binary.LittleEndian.Uint32(b[4:]), partition: binary.LittleEndian.Uint16(b[8:])}
+}
+
+// readUDF reads the volume descriptors of the UDF file system, and returns its root directory.
+func (ir *Reader) readUDF() (*record, error) {
+	anchor, err := ir.readTag(anchorSector*sectorSize, tagAnchor)
+	if err != nil {
+		return nil, err
+	}
+	// the main volume descriptor sequence, whose prevailing descriptors have the highest
+	// sequence numbers
+	loc, n := int64(binary.LittleEndian.Uint32(anchor[20:])), int64(binary.LittleEndian.Uint32(anchor[16:]))
+	var lvd []byte
+	partitions := map[uint16][]byte{}
+	for i := 0; n >= sectorSize && i < maxDescriptors; i++ {
+		d, err := ir.readTag(loc*sectorSize, 0)
+		if err != nil {
+			return nil, err
+		}
+		loc, n = loc+1, n-sectorSize
+		switch binary.LittleEndian.Uint16(d) {
+		case tagPointer:
+			loc, n = int64(binary.LittleEndian.Uint32(d[24:])), int64(binary.LittleEndian.Uint32(d[20:]))
+		case tagPartition:
+			number := binary.LittleEndian.Uint16(d[22:])
+			if p := partitions[number]; p == nil || sequenceNumber(d) >= sequenceNumber(p) {
+				partitions[number] = d
+			}
+		case tagLogicalVolume:
+			if lvd == nil || sequenceNumber(d) >= sequenceNumber(lvd) {
+				lvd = d
+			}
+		case tagTerminating:
+			n = 0
+		}
+	}
+	if lvd == nil {
+		return nil, fmt.Errorf("%w: no UDF logical volume descriptor", ErrHeader)
+	}
+	if bs := binary.LittleEndian.Uint32(lvd[212:]); bs != sectorSize {
+		return nil, fmt.Errorf("%w: UDF logical block size of %d bytes", ErrHeader, bs)
+	}
+	ir.blockSize = sectorSize
+	// the partition maps, whose indexes are the partition references of the addresses
+	maps := lvd[440:]
+	if l := binary.LittleEndian.Uint32(lvd[264:]); l <= uint32(len(maps)) {
+		maps = maps[:l]
+	}
+	for i := binary.LittleEndian.Uint32(lvd[268:]); i > 0; i-- {
+		if len(maps) < 2 || int(maps[1]) < 2 || int(maps[1]) > len(maps) {
+			return nil, fmt.Errorf("%w: bad UDF partition map", ErrHeader)
+		}
+		m := maps[:maps[1]]
+		maps = maps[len(m):]
+		if m[0] != 1 || len(m) < 6 {
+			// the virtual, sparable and metadata partitions of the later revisions
+			id := ""
+			if len(m) >= 28 {
+				id = strings.TrimRight(string(m[5:28]), "\x00")
+			}
+			return nil, fmt.Errorf("%w: partition map of type %d %q", ErrUDF, m[0], id)
+		}
+		pd := partitions[binary.LittleEndian.Uint16(m[4:])]
+		if pd == nil {
+			return nil, fmt.Errorf("%w: no UDF partition %d", ErrHeader, binary.LittleEndian.Uint16(m[4:]))
+		}
+		e := extent{start: int64(binary.LittleEndian.Uint32(pd[188:])) * sectorSize, size: int64(binary.LittleEndian.Uint32(pd[192:])) * sectorSize}
+		if e.start > ir.size || e.size > ir.size-e.start {
+			return nil, fmt.Errorf("%w: UDF partition of %d bytes at %d beyond the image", ErrHeader, e.size, e.start)
+		}
+		ir.partitions = append(ir.partitions, e)
+	}
+	// the file set descriptor is in the contents use of the logical volume descriptor
+	pos, err := ir.udfBlock(longAD(lvd[248:]), sectorSize)
+	if err != nil {
+		return nil, err
+	}
+	fsd, err := ir.readTag(pos, tagFileSet)
+	if err != nil {
+		return nil, err
+	}
+	root, err := ir.udfEntry(&record{depth: -1}, "", longAD(fsd[400:]), false)
+	if err != nil {
+		return nil, err
+	}
+	if !root.dir {
+		return nil, fmt.Errorf("%w: UDF root is not a directory", ErrHeader)
+	}
+	return root, nil
+}
+
+// sequenceNumber returns the volume descriptor sequence number of the descriptor d.
+func sequenceNumber(d []byte) uint32 {
+	return binary.LittleEndian.Uint32(d[16:])
+}
+
+// readTag reads the descriptor at pos, checking the checksum of its tag and its identifier if id
+// is not zero.
+func (ir *Reader) readTag(pos int64, id uint16) ([]byte, error) {
+	d := make([]byte, sectorSize)
+	if _, err := ir.r.ReadAt(d, pos); err != nil {
+		return nil, fmt.Errorf("%w: no UDF descriptor at %d", ErrHeader, pos)
+	}
+	if err := checkTag(d, id); err != nil {
+		return nil, fmt.Errorf("%w at %d", err, pos)
+	}
+	return d, nil
+}
+
+// checkTag checks the checksum of the tag of the descriptor d, and its identifier if id is not
+// zero.
+func checkTag(d []byte, id uint16) error {
+	if len(d) < 16 {
+		return fmt.Errorf("%w: truncated UDF descriptor", ErrHeader)
+	}
+	var sum byte
+	for i, c := range d[:16] {
+		if i != 4 {
+			sum += c
+		}
+	}
+	if sum != d[4] {
+		return fmt.Errorf("%w: bad UDF descriptor tag", ErrHeader)
+	}
+	if got := binary.LittleEndian.Uint16(d); id != 0 && got != id {
+		return fmt.Errorf("%w: UDF descriptor %d, want %d", ErrHeader, got, id)
+	}
+	return nil
+}
+
+// udfBlock returns the position in the image of the n bytes at the address a, checking that they
+// are within their partition.
+func (ir *Reader) udfBlock(a lbAddr, n int64) (int64, error) {
+	if int(a.partition) >= len(ir.partitions) {
+		return 0, fmt.Errorf("%w: no UDF partition %d", ErrHeader, a.partition)
+	}
+	p := ir.partitions[a.partition]
+	off := int64(a.block) * ir.blockSize
+	if off > p.size || n > p.size-off {
+		return 0, fmt.Errorf("%w: extent of %d bytes at block %d beyond its UDF partition", ErrHeader, n, a.block)
+	}
+	return p.start + off, nil
+}
+
+// readUDFDir reads the FIDs of the directory dir.
+func (ir *Reader) readUDFDir(dir *record) ([]*record, error) {
+	const (
+		fidHidden    = 0x01
+		fidDeleted   = 0x04
+		fidParent    = 0x08
+		fidMetadata  = 0x10
+		fidHeaderLen = 38
+	)
+	b, err := ir.readExtents(dir.extents)
+	if err != nil {
+		return nil, err
+	}
+	var children []*record
+	for pos := 0; pos < len(b); {
+		fid := b[pos:]
+		if len(fid) < fidHeaderLen {
+			return nil, fmt.Errorf("%w: truncated FID in the directory at %d", ErrHeader, dir.offset)
+		}
+		if err := checkTag(fid, tagFileIdentifier); err != nil {
+			return nil, fmt.Errorf("%w in the directory at %d", err, dir.offset)
+		}
+		chars, idLen, iuLen := fid[18], int(fid[19]), int(binary.LittleEndian.Uint16(fid[36:]))
+		if fidHeaderLen+iuLen+idLen > len(fid) {
+			return nil, fmt.Errorf("%w: truncated FID in the directory at %d", ErrHeader, dir.offset)
+		}
+		id := fid[fidHeaderLen+iuLen : fidHeaderLen+iuLen+idLen]
+		// the FIDs are padded to a multiple of 4 bytes
+		pos += (fidHeaderLen + iuLen + idLen + 3) &^ 3
+		if chars&(fidDeleted|fidParent|fidMetadata) != 0 {
+			continue
+		}
+		name, err := udfName(id)
+		if err != nil || name == "" {
+			return nil, fmt.Errorf("%w: bad name of a FID in the directory at %d", ErrHeader, dir.offset)
+		}
+		child, err := ir.udfEntry(dir, name, longAD(fid[20:]), chars&fidHidden != 0)
+		if err != nil {
+			return nil, err
+		}
+		if child != nil {
+			children = append(children, child)
+		}
+	}
+	return children, nil
+}
+
+// udfEntry returns the entry name of dir described by the FE at the address a. It returns nil for
+// the entries to skip, e.g. the stream directories.
+func (ir *Reader) udfEntry(dir *record, name string, a lbAddr, hidden bool) (*record, error) {
+	const (
+		typeDirectory   = 4
+		typeFile        = 5
+		typeBlockDevice = 6
+		typeCharDevice  = 7
+		typeFIFO        = 9
+		typeSocket      = 10
+		typeSymlink     = 12
+	)
+	pos, err := ir.udfBlock(a, sectorSize)
+	if err != nil {
+		return nil, err
+	}
+	fe, err := ir.readTag(pos, 0)
+	if err != nil {
+		return nil, err
+	}
+	// the offsets of the modification time and of the lengths of the extended attributes and
+	// allocation descriptors
+	var mtime, lengths int
+	switch binary.LittleEndian.Uint16(fe) {
+	case tagFileEntry:
+		mtime, lengths = 84, 168
+	case tagExtendedFileEntry:
+		mtime, lengths = 92, 208
+	default:
+		return nil, fmt.Errorf("%w: no UDF file entry at %d", ErrHeader, pos)
+	}
+	eaLen, adLen := int64(binary.LittleEndian.Uint32(fe[lengths:])), int64(binary.LittleEndian.Uint32(fe[lengths+4:]))
+	adStart := int64(lengths+8) + eaLen
+	if eaLen > sectorSize || adLen > sectorSize-adStart {
+		return nil, fmt.Errorf("%w: bad UDF file entry at %d", ErrHeader, pos)
+	}
+	flags := binary.LittleEndian.Uint16(fe[34:])
+	size := int64(binary.LittleEndian.Uint64(fe[56:]))
+	if size < 0 {
+		return nil, fmt.Errorf("%w: bad UDF file entry at %d", ErrHeader, pos)
+	}
+	extents, err := ir.udfExtents(fe[adStart:adStart+adLen], pos+adStart, int(flags&7), a.partition, size)
+	if err != nil {
+		return nil, fmt.Errorf("%w in the file entry at %d", err, pos)
+	}
+	r := &record{
+		extents: extents,
+		mode:    udfMode(binary.LittleEndian.Uint32(fe[44:]), flags),
+		modTime: udfTime(fe[mtime : mtime+12]),
+		hidden:  hidden,
+		offset:  pos,
+		depth:   dir.depth + 1,
+	}
+	switch fe[27] {
+	case typeDirectory:
+		r.dir = true
+		r.mode |= fs.ModeDir
+	case typeFile:
+	case typeSymlink:
+		if size > limits.MaxLinknameLen {
+			return nil, fmt.Errorf("%w: symbolic link target of %d bytes at %d", ErrHeader, size, pos)
+		}
+		b, err := ir.readExtents(extents)
+		if err != nil {
+			return nil, err
+		}
+		if r.linkname, err = udfLinkname(b); err != nil {
+			return nil, fmt.Errorf("%w at %d", err, pos)
+		}
+		r.mode |= fs.ModeSymlink
+	case typeBlockDevice:
+		r.mode |= fs.ModeDevice
+	case typeCharDevice:
+		r.mode |= fs.ModeDevice | fs.ModeCharDevice
+	case typeFIFO:
+		r.mode |= fs.ModeNamedPipe
+	case typeSocket:
+		r.mode |= fs.ModeSocket
+	default:
+		return nil, nil
+	}
+	r.path = name
+	if dir.path != "" {
+		r.path = dir.path + "/" + name
+	}
+	return r, nil
+}
+
+// udfExtents returns the extents of the size bytes of data described by the allocation
+// descriptors ads of the type typ, at pos in the image, of a file of the partition.
+func (ir *Reader) udfExtents(ads []byte, pos int64, typ int, partition uint16, size int64) ([]extent, error) {
+	const (
+		adShort    = 0
+		adLong     = 1
+		adEmbedded = 3
+	)
+	if typ == adEmbedded {
+		if size > int64(len(ads)) {
+			return nil, fmt.Errorf("%w: embedded data of %d bytes", ErrHeader, size)
+		}
+		return []extent{{start: pos, size: size}}, nil
+	}
+	var extents []extent
+	left := size
+	for hops := 0; left > 0; {
+		var length uint32
+		a := lbAddr{partition: partition}
+		switch {
+		case typ == adShort && len(ads) >= 8:
+			length, a.block = binary.LittleEndian.Uint32(ads), binary.LittleEndian.Uint32(ads[4:])
+			ads = ads[8:]
+		case typ == adLong && len(ads) >= 16:
+			length, a = binary.LittleEndian.Uint32(ads), longAD(ads)
+			ads = ads[16:]
+		case typ != adShort && typ != adLong:
+			return nil, fmt.Errorf("%w: allocation descriptors of type %d", ErrHeader, typ)
+		default:
+			return nil, fmt.Errorf("%w: %d bytes of data beyond the allocation descriptors", ErrHeader, left)
+		}
+		n := int64(length & 0x3fffffff)
+		if n == 0 {
+			return nil, fmt.Errorf("%w: %d bytes of data beyond the allocation descriptors", ErrHeader, left)
+		}
+		if length>>30 == 3 {
+			// the next extent of allocation descriptors
+			if hops++; hops > maxAllocationExtents || n > sectorSize {
+				return nil, fmt.Errorf("%w: bad extent of allocation descriptors", ErrHeader)
+			}
+			p, err := ir.udfBlock(a, n)
+			if err != nil {
+				return nil, err
+			}
+			b, err := ir.readTag(p, tagAllocationExtent)
+			if err != nil {
+				return nil, err
+			}
+			l := int(binary.LittleEndian.Uint32(b[20:]))
+			if l > int(n)-24 {
+				return nil, fmt.Errorf("%w: bad extent of allocation descriptors", ErrHeader)
+			}
+			ads = b[24 : 24+l]
+			continue
+		}
+		e := extent{start: -1, size: min(n, left)}
+		if length>>30 == 0 {
+			// recorded, unlike the extents reading as zeros
+			p, err := ir.udfBlock(a, e.size)
+			if err != nil {
+				return nil, err
+			}
+			e.start = p
+		}
+		extents = append(extents, e)
+		left -= e.size
+	}
+	return extents, nil
+}
+
+// readExtents reads the extents of a directory or of the target of a symbolic link.
+func (ir *Reader) readExtents(extents []extent) ([]byte, error) {
+	var size int64
+	for _, e := range extents {
+		size += e.size
+	}
+	if size > maxDirectorySize {
+		return nil, fmt.Errorf("%w: directory of %d bytes", ErrLimitExceeded, size)
+	}
+	b := make([]byte, 0, size)
+	for _, e := range extents {
+		if e.start < 0 {
+			b = append(b, make([]byte, e.size)...)
+			continue
+		}
+		x, err := ir.readExtent(e, e.size)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, x...)
+	}
+	return b, nil
+}
+
+// zeros reads the extents of the UDF images that are allocated but not recorded.
+type zeros struct{}
+
+func (zeros) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
+
+// extentReader returns a reader of the data of e.
+func (ir *Reader) extentReader(e extent) io.Reader {
+	if e.start < 0 {
+		return io.LimitReader(zeros{}, e.size)
+	}
+	return io.NewSectionReader(ir.r, e.start, e.size)
+}
+
+// udfName returns the name of the OSTA compressed Unicode identifier id.
+func udfName(id []byte) (string, error) {
+	if len(id) == 0 {
+		return "", nil
+	}
+	switch id[0] {
+	case 8, 254:
+		r := make([]rune, len(id)-1)
+		for i, c := range id[1:] {
+			r[i] = rune(c)
+		}
+		return string(r), nil
+	case 16, 255:
+		if len(id)%2 != 1 {
+			break
+		}
+		u := make([]uint16, len(id)/2)
+		for i := range u {
+			u[i] = binary.BigEndian.Uint16(id[1+2*i:])
+		}
+		return string(utf16.Decode(u)), nil
+	}
+	return "", fmt.Errorf("%w: bad UDF identifier", ErrHeader)
+}
+
+// udfLinkname returns the target of the path components b of a UDF symbolic link.
+func udfLinkname(b []byte) (string, error) {
+	var comps []string
+	abs := false
+	for len(b) > 0 {
+		if len(b) < 4 || 4+int(b[1]) > len(b) {
+			return "", fmt.Errorf("%w: bad UDF symbolic link", ErrHeader)
+		}
+		typ, id := b[0], b[4:4+int(b[1])]
+		b = b[4+len(id):]
+		switch typ {
+		case 1, 2:
+			comps, abs = nil, true
+		case 3:
+			comps = append(comps, "..")
+		case 4:
+			comps = append(comps, ".")
+		case 5:
+			name, err := udfName(id)
+			if err != nil {
+				return "", err
+			}
+			comps = append(comps, name)
+		default:
+			return "", fmt.Errorf("%w: bad UDF symbolic link", ErrHeader)
+		}
+	}
+	link := strings.Join(comps, "/")
+	if abs {
+		link = "/" + link
+	}
+	return link, nil
+}
+
+// udfMode returns the fs.FileMode of the UDF permissions and ICB flags, without the type.
+func udfMode(perm uint32, flags uint16) fs.FileMode {
+	mode := fs.FileMode(perm>>10&7<<6 | perm>>5&7<<3 | perm&7)
+	if flags&0x40 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if flags&0x80 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if flags&0x100 != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
+
+// udfTime returns the time of the 12 bytes UDF timestamp b, or the zero time.
+func udfTime(b []byte) time.Time {
+	if b[4] == 0 {
+		return time.Time{}
+	}
+	tz := binary.LittleEndian.Uint16(b)
+	loc := time.UTC
+	// the type 1 timestamps are in local time, at the offset of their 12 bits signed timezone
+	// (-2047 if unspecified)
+	if offset := int(int16(tz<<4) >> 4); tz>>12 == 1 && offset != -2047 {
+		loc = time.FixedZone("", offset*60)
+	}
+	usec := int(b[9])*10000 + int(b[10])*100 + int(b[11])
+	return time.Date(int(int16(binary.LittleEndian.Uint16(b[2:]))), time.Month(b[4]), int(b[5]), int(b[6]), int(b[7]), int(b[8]), usec*1000, loc)
+}
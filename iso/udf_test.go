@@ -0,0 +1,430 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iso
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+type udfFile struct {
+	path string
+	data string
+	dir  bool
+	link string
+	// mode is the mode of the entry, 0644 or 0755 if zero, and fileType overrides its UDF file type.
+	mode     fs.FileMode
+	fileType byte
+	hidden   bool
+	// name overrides the identifier of the entry.
+	name []byte
+	// embedded records the data in the file entry, extended in an extended file entry, long with
+	// long allocation descriptors. sparse is the size of the unrecorded extent before the data,
+	// and split the size of the first extent, the next ones being described by an allocation
+	// extent descriptor.
+	embedded, extended, long bool
+	sparse, split            int
+}
+
+// udfPartition is the sector of the partition of the test images.
+const udfPartition = 257
+
+// udfTag sets the tag of the descriptor d.
+func udfTag(d []byte, id uint16, loc int) {
+	binary.LittleEndian.PutUint16(d, id)
+	binary.LittleEndian.PutUint16(d[2:], 2)
+	binary.LittleEndian.PutUint32(d[12:], uint32(loc))
+	d[4] = 0
+	var sum byte
+	for _, c := range d[:16] {
+		sum += c
+	}
+	d[4] = sum
+}
+
+// udfIdentifier returns the OSTA compressed Unicode identifier of name.
+func udfIdentifier(name string) []byte {
+	for _, r := range name {
+		if r > 0xff {
+			id := []byte{16}
+			for _, u := range utf16.Encode([]rune(name)) {
+				id = binary.BigEndian.AppendUint16(id, u)
+			}
+			return id
+		}
+	}
+	id := []byte{8}
+	for _, r := range name {
+		id = append(id, byte(r))
+	}
+	return id
+}
+
+// udfImage returns a UDF image of the files, without an ISO 9660 file system.
+func udfImage(files ...udfFile) []byte {
+	type node struct {
+		udfFile
+		children []*node
+		// fe is the block of the file entry
+		fe int
+	}
+	// the blocks of the partition: the file set descriptor, and then the file entries and the
+	// data
+	var blocks [][]byte
+	alloc := func(n int) int {
+		for i := 0; i < n; i++ {
+			blocks = append(blocks, make([]byte, sectorSize))
+		}
+		return len(blocks) - n
+	}
+	alloc(1)
+	root := &node{udfFile: udfFile{dir: true}}
+	nodes := map[string]*node{".": root}
+	all := []*node{root}
+	root.fe = alloc(1)
+	for _, f := range files {
+		n := &node{udfFile: f, fe: alloc(1)}
+		parent := nodes[path.Dir(f.path)]
+		parent.children = append(parent.children, n)
+		nodes[f.path] = n
+		all = append(all, n)
+	}
+	write := func(b []byte) int {
+		k := (len(b) + sectorSize - 1) / sectorSize
+		first := alloc(k)
+		for i := 0; i < k; i++ {
+			copy(blocks[first+i], b[i*sectorSize:])
+		}
+		return first
+	}
+	for _, n := range all {
+		var data []byte
+		fileType := byte(5)
+		switch {
+		case n.dir:
+			fileType = 4
+			parent := make([]byte, 40)
+			parent[18] = 0x0a
+			binary.LittleEndian.PutUint32(parent[20:], sectorSize)
+			binary.LittleEndian.PutUint32(parent[24:], uint32(root.fe))
+			udfTag(parent, tagFileIdentifier, 0)
+			data = append(data, parent...)
+			for _, c := range n.children {
+				id := c.name
+				if id == nil {
+					id = udfIdentifier(path.Base(c.path))
+				}
+				fid := make([]byte, (38+len(id)+3)&^3)
+				if c.dir {
+					fid[18] |= 0x02
+				}
+				if c.hidden {
+					fid[18] |= 0x01
+				}
+				fid[19] = byte(len(id))
+				binary.LittleEndian.PutUint32(fid[20:], sectorSize)
+				binary.LittleEndian.PutUint32(fid[24:], uint32(c.fe))
+				copy(fid[38:], id)
+				udfTag(fid, tagFileIdentifier, 0)
+				data = append(data, fid...)
+			}
+		case n.link != "":
+			fileType = 12
+			for i, comp := range strings.Split(n.link, "/") {
+				switch {
+				case comp == "" && i == 0:
+					data = append(data, 2, 0, 0, 0)
+				case comp == "..":
+					data = append(data, 3, 0, 0, 0)
+				case comp == ".":
+					data = append(data, 4, 0, 0, 0)
+				default:
+					id := udfIdentifier(comp)
+					data = append(append(data, 5, byte(len(id)), 0, 0), id...)
+				}
+			}
+		default:
+			data = []byte(n.data)
+		}
+		if n.fileType != 0 {
+			fileType = n.fileType
+		}
+
+		fe := blocks[n.fe]
+		mtime, lengths, id := 84, 168, uint16(tagFileEntry)
+		if n.extended {
+			mtime, lengths, id = 92, 208, tagExtendedFileEntry
+		}
+		fe[27] = fileType
+		mode := n.mode
+		if mode == 0 {
+			mode = 0644
+			if n.dir {
+				mode = 0755
+			}
+		}
+		perm := uint32(mode&7 | mode>>3&7<<5 | mode>>6&7<<10)
+		binary.LittleEndian.PutUint32(fe[44:], perm)
+		var flags uint16
+		if mode&fs.ModeSetuid != 0 {
+			flags |= 0x40
+		}
+		binary.LittleEndian.PutUint64(fe[56:], uint64(n.sparse+len(data)))
+		// 2024-05-06 07:08:09 at UTC+2
+		copy(fe[mtime:], []byte{0x78, 0x10, 0xe8, 0x07, 5, 6, 7, 8, 9, 0, 0, 0})
+		var ads []byte
+		ad := func(length, block int) {
+			ads = binary.LittleEndian.AppendUint32(ads, uint32(length))
+			ads = binary.LittleEndian.AppendUint32(ads, uint32(block))
+			if n.long {
+				ads = append(ads, make([]byte, 8)...)
+			}
+		}
+		switch {
+		case n.embedded:
+			flags |= 3
+			ads = data
+		case len(data) == 0:
+		default:
+			if n.long {
+				flags |= 1
+			}
+			if n.sparse > 0 {
+				ad(n.sparse|1<<30, 0)
+			}
+			first := data
+			if n.split > 0 {
+				first = data[:n.split]
+			}
+			ad(len(first), write(first))
+			if n.split > 0 {
+				rest := data[n.split:]
+				aed := alloc(1)
+				start := len(ads)
+				ad(len(rest), write(rest))
+				next := bytes.Clone(ads[start:])
+				ads = ads[:start]
+				ad(24+len(next)|3<<30, aed)
+				b := blocks[aed]
+				binary.LittleEndian.PutUint32(b[20:], uint32(len(next)))
+				copy(b[24:], next)
+				udfTag(b, tagAllocationExtent, aed)
+			}
+		}
+		binary.LittleEndian.PutUint16(fe[34:], flags)
+		binary.LittleEndian.PutUint32(fe[lengths+4:], uint32(len(ads)))
+		copy(fe[lengths+8:], ads)
+		udfTag(fe, id, n.fe)
+	}
+	fsd := blocks[0]
+	binary.LittleEndian.PutUint32(fsd[400:], sectorSize)
+	binary.LittleEndian.PutUint32(fsd[404:], uint32(root.fe))
+	udfTag(fsd, tagFileSet, 0)
+
+	img := make([]byte, (udfPartition+len(blocks))*sectorSize)
+	for i, s := range []string{"BEA01", "NSR02", "TEA01"} {
+		copy(img[(16+i)*sectorSize+1:], s+"\x01")
+	}
+	sector := func(i int) []byte { return img[i*sectorSize : (i+1)*sectorSize] }
+	pd := sector(32)
+	binary.LittleEndian.PutUint32(pd[188:], udfPartition)
+	binary.LittleEndian.PutUint32(pd[192:], uint32(len(blocks)))
+	udfTag(pd, tagPartition, 32)
+	lvd := sector(33)
+	binary.LittleEndian.PutUint32(lvd[212:], sectorSize)
+	binary.LittleEndian.PutUint32(lvd[248:], sectorSize)
+	binary.LittleEndian.PutUint32(lvd[264:], 6)
+	binary.LittleEndian.PutUint32(lvd[268:], 1)
+	copy(lvd[440:], []byte{1, 6, 1, 0, 0, 0})
+	udfTag(lvd, tagLogicalVolume, 33)
+	udfTag(sector(34), tagTerminating, 34)
+	anchor := sector(anchorSector)
+	binary.LittleEndian.PutUint32(anchor[16:], 3*sectorSize)
+	binary.LittleEndian.PutUint32(anchor[20:], 32)
+	udfTag(anchor, tagAnchor, anchorSector)
+	for i, b := range blocks {
+		copy(sector(udfPartition+i), b)
+	}
+	return img
+}
+
+func TestUDF(t *testing.T) {
+	big := strings.Repeat("0123456789", 1000)
+	img := udfImage(
+		udfFile{path: "docs", dir: true},
+		udfFile{path: "docs/read me.txt", data: "read me"},
+		udfFile{path: "docs/Ünïcode ☃.txt", data: "unicode", extended: true},
+		udfFile{path: "empty", data: ""},
+		udfFile{path: "embedded", data: "embedded", embedded: true},
+		udfFile{path: "hidden", data: "hidden", hidden: true},
+		udfFile{path: "big", data: big, long: true, split: 2 * sectorSize},
+		udfFile{path: "sparse", data: "sparse", sparse: 2 * sectorSize},
+		udfFile{path: "tool", data: "#!/bin/sh", mode: 0755 | fs.ModeSetuid},
+		udfFile{path: "link", link: "docs/read me.txt"},
+		udfFile{path: "fifo", fileType: 9},
+	)
+	r := newReader(t, img, SanitizeFilenames|PreventSymlinkTraversal)
+	if got := r.Extension(); got != UDF {
+		t.Errorf("Extension() = %v, want %v", got, UDF)
+	}
+	headers := map[string]*Header{}
+	contents := map[string]string{}
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Read(%q) error = %v", h.Name, err)
+		}
+		if int64(len(b)) != h.Size {
+			t.Errorf("%q has %d bytes, want %d", h.Name, len(b), h.Size)
+		}
+		headers[h.Name], contents[h.Name] = h, string(b)
+	}
+	want := map[string]string{
+		"docs":               "",
+		"docs/read me.txt":   "read me",
+		"docs/Ünïcode ☃.txt": "unicode",
+		"empty":              "",
+		"embedded":           "embedded",
+		"hidden":             "hidden",
+		"big":                big,
+		"sparse":             string(make([]byte, 2*sectorSize)) + "sparse",
+		"tool":               "#!/bin/sh",
+		"link":               "",
+		"fifo":               "",
+	}
+	if !reflect.DeepEqual(contents, want) {
+		for name := range want {
+			if contents[name] != want[name] {
+				t.Errorf("%q = %.20q, want %.20q", name, contents[name], want[name])
+			}
+		}
+		t.Errorf("entries = %d, want %d", len(contents), len(want))
+	}
+	modes := map[string]fs.FileMode{
+		"docs":     fs.ModeDir | 0755,
+		"tool":     fs.ModeSetuid | 0755,
+		"hidden":   0644,
+		"link":     fs.ModeSymlink | 0644,
+		"fifo":     fs.ModeNamedPipe | 0644,
+		"embedded": 0644,
+	}
+	for name, mode := range modes {
+		if h := headers[name]; h != nil && h.Mode != mode {
+			t.Errorf("%q mode = %v, want %v", name, h.Mode, mode)
+		}
+	}
+	if h := headers["link"]; h != nil && h.Linkname != "docs/read me.txt" {
+		t.Errorf("link target = %q, want %q", h.Linkname, "docs/read me.txt")
+	}
+	if h := headers["hidden"]; h != nil && !h.Hidden {
+		t.Errorf("hidden is not hidden")
+	}
+	if h := headers["tool"]; h != nil && !h.ModTime.Equal(time.Date(2024, 5, 6, 7, 8, 9, 0, time.FixedZone("", 2*3600))) {
+		t.Errorf("tool modified at %v", h.ModTime)
+	}
+}
+
+func TestUDFSecurity(t *testing.T) {
+	img := udfImage(
+		udfFile{path: "dotdot", data: "evil", name: udfIdentifier("../../evil")},
+		udfFile{path: "etc", link: "/etc"},
+		udfFile{path: "up", link: "../.."},
+		// a directory named after the link etc
+		udfFile{path: "dir", dir: true, name: udfIdentifier("etc")},
+		udfFile{path: "dir/passwd", data: "passwd"},
+		udfFile{path: "fifo", fileType: 9},
+		udfFile{path: "suid", data: "suid", mode: 0755 | fs.ModeSetuid},
+	)
+	r := newReader(t, img, MaximumSecurityMode)
+	modes := map[string]fs.FileMode{}
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		modes[h.Name] = h.Mode
+	}
+	want := map[string]fs.FileMode{"evil": 0644, "suid": 0755}
+	if !reflect.DeepEqual(modes, want) {
+		t.Errorf("entries = %v, want %v", modes, want)
+	}
+}
+
+func TestInvalidUDF(t *testing.T) {
+	valid := udfImage(udfFile{path: "dir", dir: true}, udfFile{path: "dir/a", data: "aaaa"})
+	// the file entry of dir, and the FIDs of the root, after the file set descriptor and the file
+	// entries of the partition
+	fe, fids := (udfPartition+2)*sectorSize, (udfPartition+4)*sectorSize
+	patch := func(off int, b ...byte) []byte {
+		img := append([]byte{}, valid...)
+		copy(img[off:], b)
+		// the checksum of the tag of the descriptor patched
+		d := img[off/sectorSize*sectorSize:]
+		if off >= fids && off < fids+sectorSize {
+			d = img[fids+40:]
+		}
+		udfTag(d, binary.LittleEndian.Uint16(d), 0)
+		return img
+	}
+	// a partition map of type 2
+	typ2 := patch(33*sectorSize+264, 64)
+	copy(typ2[33*sectorSize+440:], []byte{2, 64})
+	udfTag(typ2[33*sectorSize:], tagLogicalVolume, 33)
+	tests := []struct {
+		name    string
+		img     []byte
+		wantErr error
+	}{
+		{name: "no anchor", img: valid[:anchorSector*sectorSize], wantErr: ErrHeader},
+		{name: "checksum", img: append(append([]byte{}, valid[:fe+5]...), valid[fe+6:]...), wantErr: ErrHeader},
+		{name: "partition map", img: typ2, wantErr: ErrUDF},
+		{name: "block size", img: patch(33*sectorSize+212, 0, 1), wantErr: ErrHeader},
+		{name: "extent beyond the partition", img: patch(fe+176+4, 0xff, 0xff), wantErr: ErrHeader},
+		{name: "file size", img: patch(fe+56, 0xff, 0xff), wantErr: ErrHeader},
+		// the FID of dir pointing at the file entry of the root
+		{name: "directory loop", img: patch(fids+40+24, 1), wantErr: ErrHeader},
+		{name: "bad FID", img: patch(fids+40+19, 200), wantErr: ErrHeader},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewReader(bytes.NewReader(tc.img), int64(len(tc.img)))
+			if err == nil {
+				_, err = read(t, r)
+			}
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("Next() error = %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manifest
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/tar"
+	"github.com/google/safearchive/zip"
+)
+
+// Drift lists the differences between an archive and a directory.
+type Drift struct {
+	// Missing lists the entries of the archive that are not present in the directory.
+	Missing []string
+	// Extra lists the files of the directory that are not present in the archive, in lexical order.
+	// Parents of archive entries are not reported even if the archive has no entry for them.
+	Extra []string
+	// Modified lists the entries that differ.
+	Modified []Modification
+}
+
+// Clean reports if the directory matches the archive.
+func (d *Drift) Clean() bool {
+	return len(d.Missing) == 0 && len(d.Extra) == 0 && len(d.Modified) == 0
+}
+
+// Modification describes an entry that differs between the archive and the directory.
+type Modification struct {
+	// Name is the name of the entry, using forward slashes.
+	Name string
+	// Fields are the attributes that differ.
+	Fields safearchive.Field
+	// Archive and Directory are the two sides of the comparison.
+	Archive, Directory safearchive.Entry
+}
+
+// CompareOptions controls how an archive is compared with a directory.
+type CompareOptions struct {
+	// Comparer selects the attributes to compare. Defaults to safearchive.DefaultComparer.
+	// Sizes are compared for regular files only, and link targets only if the archive records them
+	// (zip archives do not).
+	Comparer *safearchive.Comparer
+	// IgnoreExtra disables reporting the files of the directory that are not in the archive.
+	IgnoreExtra bool
+}
+
+// Compare checks whether the contents of dir match the manifest. The digests of the files in dir
+// are computed with the algorithm of the manifest.
+// Symbolic links in dir are not followed, so they are compared as links.
+func (m *Manifest) Compare(dir string, opts CompareOptions) (*Drift, error) {
+	c := safearchive.DefaultComparer
+	if opts.Comparer != nil {
+		c = *opts.Comparer
+	}
+
+	found := map[string]fs.FileInfo{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		found[filepath.ToSlash(rel)] = fi
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Later entries of an archive overwrite the earlier ones with the same name when extracted.
+	last := map[string]int{}
+	parents := map[string]bool{}
+	for i, e := range m.Entries {
+		name := entryName(e.Name)
+		last[name] = i
+		for p := path.Dir(name); p != "." && p != "/"; p = path.Dir(p) {
+			parents[p] = true
+		}
+	}
+
+	d := &Drift{}
+	for i, e := range m.Entries {
+		name := entryName(e.Name)
+		if name == "." || last[name] != i {
+			continue
+		}
+		fi, ok := found[name]
+		if !ok {
+			d.Missing = append(d.Missing, name)
+			continue
+		}
+		a := e.ArchiveEntry()
+		a.Name = name
+		b, err := dirEntry(filepath.Join(dir, filepath.FromSlash(name)), name, fi, a, m.Options())
+		if err != nil {
+			return nil, err
+		}
+		if !a.Mode.IsRegular() {
+			a.Size, b.Size = 0, 0
+		}
+		if a.Linkname == "" {
+			b.Linkname = ""
+		}
+		if f := c.Diff(a, b); f != 0 {
+			d.Modified = append(d.Modified, Modification{Name: name, Fields: f, Archive: a, Directory: b})
+		}
+	}
+	if !opts.IgnoreExtra {
+		for name := range found {
+			if _, ok := last[name]; !ok && !parents[name] {
+				d.Extra = append(d.Extra, name)
+			}
+		}
+		sort.Strings(d.Extra)
+	}
+	return d, nil
+}
+
+// entryName returns the name of an entry in the form used by Drift.
+func entryName(name string) string {
+	return path.Clean(filepath.ToSlash(name))
+}
+
+// dirEntry describes the file at p. The digest is computed only if the archive entry a has one
+// and the sizes match.
+func dirEntry(p, name string, fi fs.FileInfo, a safearchive.Entry, opts Options) (safearchive.Entry, error) {
+	re := safearchive.Entry{Name: name, Mode: fi.Mode(), ModTime: fi.ModTime()}
+	switch {
+	case fi.Mode()&fs.ModeSymlink != 0:
+		target, err := os.Readlink(p)
+		if err != nil {
+			return re, err
+		}
+		re.Linkname = target
+	case fi.Mode().IsRegular():
+		re.Size = fi.Size()
+		if a.Digest == nil || !a.Mode.IsRegular() || a.Size != re.Size {
+			break
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return re, err
+		}
+		defer f.Close()
+		re.Digest, err = Digest(f, opts)
+		if err != nil {
+			return re, err
+		}
+	}
+	return re, nil
+}
+
+// CompareTar checks whether the contents of dir match the remaining entries of tr, as exposed by
+// tr (so with its security features applied).
+func CompareTar(tr *tar.Reader, dir string, opts CompareOptions) (*Drift, error) {
+	m, err := FromTar(tr, Options{})
+	if err != nil {
+		return nil, err
+	}
+	return m.Compare(dir, opts)
+}
+
+// CompareZip checks whether the contents of dir match the entries of r, as exposed by r (so with
+// its security features applied).
+func CompareZip(r *zip.Reader, dir string, opts CompareOptions) (*Drift, error) {
+	m, err := FromZip(r, Options{})
+	if err != nil {
+		return nil, err
+	}
+	return m.Compare(dir, opts)
+}
@@ -0,0 +1,134 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manifest
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// Algorithm identifies how the digests of a manifest were computed.
+type Algorithm string
+
+const (
+	// SHA256 is the plain SHA-256 digest of the contents. This is the default.
+	SHA256 Algorithm = "sha256"
+	// SHA256Tree is a two-level hash tree over fixed size chunks of the contents, so the chunks of
+	// large entries can be hashed in parallel. Every chunk is hashed as SHA-256(0x00 || chunk) and
+	// the digest is SHA-256(0x01 || digest of chunk 1 || digest of chunk 2 || ...). Only the last
+	// chunk may be shorter than the chunk size; empty contents consist of a single empty chunk.
+	SHA256Tree Algorithm = "sha256-tree"
+)
+
+// DefaultChunkSize is the chunk size of SHA256Tree if Options.ChunkSize is not set.
+const DefaultChunkSize = 4 << 20
+
+// ErrUnknownAlgorithm is returned when the digest algorithm is not supported.
+var ErrUnknownAlgorithm = errors.New("manifest: unknown digest algorithm")
+
+// Options controls how digests are computed.
+type Options struct {
+	// Algorithm is the digest algorithm. Defaults to SHA256.
+	Algorithm Algorithm
+	// ChunkSize is the chunk size of SHA256Tree. Defaults to DefaultChunkSize.
+	ChunkSize int64
+	// Parallelism is the maximum number of chunks hashed at the same time by SHA256Tree, which is
+	// also the number of chunk sized buffers in use. Defaults to runtime.GOMAXPROCS(0).
+	Parallelism int
+}
+
+func (o Options) withDefaults() Options {
+	if o.Algorithm == "" {
+		o.Algorithm = SHA256
+	}
+	if o.ChunkSize <= 0 {
+		o.ChunkSize = DefaultChunkSize
+	}
+	if o.Parallelism <= 0 {
+		o.Parallelism = runtime.GOMAXPROCS(0)
+	}
+	return o
+}
+
+// Digest returns the digest of the contents of r.
+func Digest(r io.Reader, opts Options) ([]byte, error) {
+	opts = opts.withDefaults()
+	switch opts.Algorithm {
+	case SHA256:
+		h := sha256.New()
+		if _, err := io.Copy(h, r); err != nil {
+			return nil, err
+		}
+		return h.Sum(nil), nil
+	case SHA256Tree:
+		return treeDigest(r, opts.ChunkSize, opts.Parallelism)
+	}
+	return nil, ErrUnknownAlgorithm
+}
+
+// treeDigest computes the SHA256Tree digest of r. Chunks are read sequentially and hashed by at
+// most parallelism goroutines.
+func treeDigest(r io.Reader, chunkSize int64, parallelism int) ([]byte, error) {
+	free := make(chan []byte, parallelism)
+	for i := 0; i < parallelism; i++ {
+		free <- nil
+	}
+	var wg sync.WaitGroup
+	var leaves []*[sha256.Size]byte
+	for {
+		buf := <-free
+		if buf == nil {
+			buf = make([]byte, chunkSize)
+		}
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF && len(leaves) > 0 {
+			break
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			wg.Wait()
+			return nil, err
+		}
+		leaf := new([sha256.Size]byte)
+		leaves = append(leaves, leaf)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sumPrefixed(leaf, 0x00, buf[:n])
+			free <- buf
+		}()
+		if n < len(buf) {
+			break
+		}
+	}
+	wg.Wait()
+
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	for _, leaf := range leaves {
+		h.Write(leaf[:])
+	}
+	return h.Sum(nil), nil
+}
+
+// sumPrefixed stores the SHA-256 digest of prefix || b in dst.
+func sumPrefixed(dst *[sha256.Size]byte, prefix byte, b []byte) {
+	h := sha256.New()
+	h.Write([]byte{prefix})
+	h.Write(b)
+	h.Sum(dst[:0])
+}
@@ -0,0 +1,150 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package manifest generates manifests of archives: the entries as exposed by the safearchive
+// readers (so with the security features applied), along with the digests of their contents.
+//
+// Manifests are serialized as JSON:
+//
+//	{
+//	  "version": 1,
+//	  "algorithm": "sha256-tree",
+//	  "chunkSize": 4194304,
+//	  "entries": [
+//	    {"name": "a.txt", "size": 5, "mode": 420, "modTime": "2024-01-01T00:00:00Z", "digest": "..."}
+//	  ]
+//	}
+//
+// The digest algorithm (and the chunk size of tree hashing) is recorded in the manifest, so it can
+// be verified later without knowing the options it was generated with. Tree hashing (SHA256Tree)
+// hashes multi-GB entries on all cores instead of one.
+package manifest
+
+import (
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"time"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/tar"
+	"github.com/google/safearchive/zip"
+)
+
+// Version is the version of the manifest schema.
+const Version = 1
+
+// Manifest lists the entries of an archive.
+type Manifest struct {
+	// Version is the version of the schema, see Version.
+	Version int `json:"version"`
+	// Algorithm is the algorithm of the digests of the entries.
+	Algorithm Algorithm `json:"algorithm"`
+	// ChunkSize is the chunk size of SHA256Tree digests.
+	ChunkSize int64 `json:"chunkSize,omitempty"`
+	// Entries are the entries in the order of the archive.
+	Entries []Entry `json:"entries"`
+}
+
+// Entry describes a single entry of an archive.
+type Entry struct {
+	Name     string      `json:"name"`
+	Linkname string      `json:"linkname,omitempty"`
+	Size     int64       `json:"size"`
+	Mode     fs.FileMode `json:"mode"`
+	ModTime  time.Time   `json:"modTime"`
+	// Digest is the hex encoded digest of the contents of regular files.
+	Digest string `json:"digest,omitempty"`
+}
+
+// ArchiveEntry returns the format independent description of e, e.g. to compare it with the
+// entries of an archive.
+func (e Entry) ArchiveEntry() safearchive.Entry {
+	re := safearchive.Entry{Name: e.Name, Linkname: e.Linkname, Size: e.Size, Mode: e.Mode, ModTime: e.ModTime}
+	if e.Digest != "" {
+		re.Digest, _ = hex.DecodeString(e.Digest)
+	}
+	return re
+}
+
+// Options returns the options the digests of m can be verified with.
+func (m *Manifest) Options() Options {
+	return Options{Algorithm: m.Algorithm, ChunkSize: m.ChunkSize}
+}
+
+func newManifest(opts Options) *Manifest {
+	m := &Manifest{Version: Version, Algorithm: opts.Algorithm, Entries: []Entry{}}
+	if opts.Algorithm == SHA256Tree {
+		m.ChunkSize = opts.ChunkSize
+	}
+	return m
+}
+
+func newEntry(e safearchive.Entry, contents io.Reader, opts Options) (Entry, error) {
+	re := Entry{Name: e.Name, Linkname: e.Linkname, Size: e.Size, Mode: e.Mode, ModTime: e.ModTime}
+	if !e.Mode.IsRegular() {
+		return re, nil
+	}
+	d, err := Digest(contents, opts)
+	if err != nil {
+		return re, safearchive.NewEntryError(e.Name, "", err)
+	}
+	re.Digest = hex.EncodeToString(d)
+	return re, nil
+}
+
+// FromTar generates the manifest of the remaining entries of tr.
+func FromTar(tr *tar.Reader, opts Options) (*Manifest, error) {
+	opts = opts.withDefaults()
+	m := newManifest(opts)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return m, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		e, err := newEntry(tar.EntryOf(h), tr, opts)
+		if err != nil {
+			return nil, err
+		}
+		m.Entries = append(m.Entries, e)
+	}
+}
+
+// FromZip generates the manifest of the entries of r.
+func FromZip(r *zip.Reader, opts Options) (*Manifest, error) {
+	opts = opts.withDefaults()
+	m := newManifest(opts)
+	for _, f := range r.File {
+		var contents io.ReadCloser
+		if f.Mode().IsRegular() {
+			rc, err := f.Open()
+			if err != nil {
+				return nil, safearchive.NewEntryError(f.Name, "", err)
+			}
+			contents = rc
+		}
+		e, err := newEntry(zip.EntryOf(f), contents, opts)
+		if contents != nil {
+			contents.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		m.Entries = append(m.Entries, e)
+	}
+	return m, nil
+}
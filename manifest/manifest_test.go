@@ -0,0 +1,205 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manifest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/internal/archivetest"
+	"github.com/google/safearchive/tar"
+	"github.com/google/safearchive/zip"
+)
+
+func TestDigestSHA256(t *testing.T) {
+	got, err := Digest(strings.NewReader("hello"), Options{})
+	if err != nil {
+		t.Fatalf("Digest() error = %v", err)
+	}
+	if want := sha256.Sum256([]byte("hello")); !bytes.Equal(got, want[:]) {
+		t.Errorf("Digest() = %x, want %x", got, want)
+	}
+}
+
+func treeDigestForTest(data []byte, chunkSize int) []byte {
+	root := []byte{0x01}
+	for i := 0; i == 0 || i < len(data); i += chunkSize {
+		end := i + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		leaf := sha256.Sum256(append([]byte{0x00}, data[i:end]...))
+		root = append(root, leaf[:]...)
+	}
+	sum := sha256.Sum256(root)
+	return sum[:]
+}
+
+func TestDigestSHA256Tree(t *testing.T) {
+	for _, size := range []int{0, 1, 4, 8, 10, 1000} {
+		data := bytes.Repeat([]byte("0123456789"), 100)[:size]
+		want := treeDigestForTest(data, 4)
+		for _, parallelism := range []int{1, 3, 16} {
+			got, err := Digest(bytes.NewReader(data), Options{Algorithm: SHA256Tree, ChunkSize: 4, Parallelism: parallelism})
+			if err != nil {
+				t.Fatalf("Digest() error = %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("Digest(%d bytes, parallelism %d) = %x, want %x", size, parallelism, got, want)
+			}
+		}
+	}
+}
+
+func TestDigestUnknownAlgorithm(t *testing.T) {
+	if _, err := Digest(strings.NewReader(""), Options{Algorithm: "md5"}); err != ErrUnknownAlgorithm {
+		t.Errorf("Digest() error = %v, want %v", err, ErrUnknownAlgorithm)
+	}
+}
+
+func TestFromTar(t *testing.T) {
+	var buf bytes.Buffer
+	tw := archivetest.NewTarWriter(&buf)
+	mtime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, h := range []*tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: mtime},
+		{Name: "../dir/a.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 5, ModTime: mtime},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf("WriteHeader() error = %v", err)
+		}
+	}
+	tw.Write([]byte("hello"))
+	tw.Close()
+
+	m, err := FromTar(tar.NewReader(&buf), Options{Algorithm: SHA256Tree, ChunkSize: 2})
+	if err != nil {
+		t.Fatalf("FromTar() error = %v", err)
+	}
+	if m.Algorithm != SHA256Tree || m.ChunkSize != 2 || len(m.Entries) != 2 {
+		t.Fatalf("FromTar() = %+v, want two entries hashed with sha256-tree in 2 byte chunks", m)
+	}
+	if m.Entries[0].Digest != "" {
+		t.Errorf("directory digest = %q, want none", m.Entries[0].Digest)
+	}
+	a := m.Entries[1]
+	if want := hex.EncodeToString(treeDigestForTest([]byte("hello"), 2)); a.Name != "dir/a.txt" || a.Digest != want {
+		t.Errorf("entry = %q with digest %s, want dir/a.txt with digest %s", a.Name, a.Digest, want)
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	if !bytes.Contains(b, []byte(`"algorithm":"sha256-tree","chunkSize":2`)) {
+		t.Errorf("json.Marshal() = %s, want the algorithm and the chunk size", b)
+	}
+	var back Manifest
+	if err := json.Unmarshal(b, &back); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	d, err := Digest(strings.NewReader("hello"), back.Options())
+	if err != nil || hex.EncodeToString(d) != a.Digest {
+		t.Errorf("Digest() with the options of the manifest = %x, %v, want %s", d, err, a.Digest)
+	}
+}
+
+func TestFromZip(t *testing.T) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	fw, _ := w.Create("a.txt")
+	fw.Write([]byte("hello"))
+	w.Create("dir/")
+	w.Close()
+
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("zip.NewReader() error = %v", err)
+	}
+	m, err := FromZip(r, Options{})
+	if err != nil {
+		t.Fatalf("FromZip() error = %v", err)
+	}
+	sum := sha256.Sum256([]byte("hello"))
+	if m.Algorithm != SHA256 || m.ChunkSize != 0 || len(m.Entries) != 2 || m.Entries[0].Digest != hex.EncodeToString(sum[:]) || m.Entries[1].Digest != "" {
+		t.Errorf("FromZip() = %+v, want a.txt with its sha256 digest and dir/ without digest", m)
+	}
+	if e := m.Entries[0].ArchiveEntry(); !bytes.Equal(e.Digest, sum[:]) {
+		t.Errorf("ArchiveEntry().Digest = %x, want %x", e.Digest, sum)
+	}
+}
+
+func TestCompareTar(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes and symbolic links are not comparable on Windows")
+	}
+
+	var buf bytes.Buffer
+	tw := archivetest.NewTarWriter(&buf)
+	for _, e := range []struct {
+		h       *tar.Header
+		content string
+	}{
+		{h: &tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{h: &tar.Header{Name: "dir/a.txt", Typeflag: tar.TypeReg, Mode: 0644}, content: "hello"},
+		{h: &tar.Header{Name: "b.txt", Typeflag: tar.TypeReg, Mode: 0644}, content: "world"},
+		{h: &tar.Header{Name: "../c.txt", Typeflag: tar.TypeReg, Mode: 0644}, content: "c"},
+		{h: &tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "dir/a.txt", Mode: 0777}},
+	} {
+		e.h.Size = int64(len(e.content))
+		tw.WriteHeader(e.h)
+		tw.Write([]byte(e.content))
+	}
+	tw.Close()
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{"dir/a.txt": "hello", "b.txt": "WORLD", "extra.txt": "extra"} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+		os.Chmod(p, 0644)
+	}
+	os.Chmod(filepath.Join(dir, "dir"), 0755)
+	if err := os.Symlink("dir/a.txt", filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("Symlink() error = %v", err)
+	}
+
+	c := safearchive.Comparer{Fields: safearchive.FieldSize | safearchive.FieldMode | safearchive.FieldDigest | safearchive.FieldLinkname}
+	d, err := CompareTar(tar.NewReader(&buf), dir, CompareOptions{Comparer: &c})
+	if err != nil {
+		t.Fatalf("CompareTar() error = %v", err)
+	}
+	if !reflect.DeepEqual(d.Missing, []string{"c.txt"}) || !reflect.DeepEqual(d.Extra, []string{"extra.txt"}) {
+		t.Errorf("CompareTar() missing = %q, extra = %q, want [c.txt] and [extra.txt]", d.Missing, d.Extra)
+	}
+	if len(d.Modified) != 1 || d.Modified[0].Name != "b.txt" || d.Modified[0].Fields != safearchive.FieldDigest {
+		t.Errorf("CompareTar() modified = %+v, want the digest of b.txt", d.Modified)
+	}
+	if d.Clean() {
+		t.Errorf("Drift.Clean() = true, want false")
+	}
+}
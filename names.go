@@ -0,0 +1,99 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/google/safearchive/sanitizer"
+)
+
+// NameChecks are the checks of the names of the entries shared by the readers of the archive
+// formats, so they are applied the same way (and in the same order) by all of them.
+type NameChecks struct {
+	// ValidateEncoding applies Encoding on the names that are not valid UTF-8 or have NUL bytes.
+	ValidateEncoding bool
+	Encoding         NameEncodingPolicy
+	// SanitizeUnicode strips the characters used to disguise names (see
+	// sanitizer.StripUnsafeRunes).
+	SanitizeUnicode bool
+	// SanitizePath sanitizes the names with sanitizer.SanitizePath, using forward slashes. Names
+	// left empty are dropped. Removing a leading "./" is not worth a finding.
+	SanitizePath bool
+}
+
+// Rules returns the enabled checks as rules on the name pointed to by name, in the order they are
+// to be applied: the names are sanitized after the characters that disguise them were dealt with,
+// as e.g. ".\u200b." becomes ".." once its zero-width space is stripped.
+func (c NameChecks) Rules(name *string) []func() Verdict {
+	var rules []func() Verdict
+	if c.ValidateEncoding {
+		rules = append(rules, func() Verdict {
+			n, v := c.Encoding.Check(*name)
+			if v.Action == ActionModified {
+				*name = n
+			}
+			return v
+		})
+	}
+	if c.SanitizeUnicode {
+		rules = append(rules, func() Verdict {
+			if !sanitizer.HasUnsafeRunes(*name) {
+				return Pass
+			}
+			*name = sanitizer.StripUnsafeRunes(*name)
+			return Verdict{Action: ActionModified, Reason: ReasonUnsafeUnicode}
+		})
+	}
+	if c.SanitizePath {
+		rules = append(rules, func() Verdict {
+			old, n := *name, filepath.ToSlash(sanitizer.SanitizePath(*name))
+			*name = n
+			switch {
+			case n == strings.TrimPrefix(old, "./"):
+				return Pass
+			case n == "" || n == ".":
+				return Verdict{Action: ActionDropped, Reason: NameReason(old)}
+			}
+			return Verdict{Action: ActionModified, Reason: NameReason(old)}
+		})
+	}
+	return rules
+}
+
+// ApplyRules applies rules in order, until one of them drops or rejects the entry. The verdicts
+// with a reason are made strict if strict is set (see Verdict.Strict) and recorded with flag. It
+// reports whether the entry is to be kept, or returns the error rejecting it, which wraps
+// RejectionError of the reason.
+func ApplyRules(rules []func() Verdict, strict bool, flag func(Verdict) Finding) (bool, error) {
+	for _, rule := range rules {
+		v := rule()
+		if v.Reason == "" {
+			continue
+		}
+		if strict {
+			v = v.Strict()
+		}
+		f := flag(v)
+		switch f.Action {
+		case ActionDropped:
+			return false, nil
+		case ActionRejected:
+			return false, f.Err(RejectionError(v.Reason))
+		}
+	}
+	return true, nil
+}
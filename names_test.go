@@ -0,0 +1,61 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNameChecks(t *testing.T) {
+	all := NameChecks{ValidateEncoding: true, SanitizeUnicode: true, SanitizePath: true}
+	for _, tc := range []struct {
+		checks  NameChecks
+		in      string
+		want    string
+		reasons []Reason
+		keep    bool
+	}{
+		{all, "dir/file.txt", "dir/file.txt", nil, true},
+		{all, "./dir/file.txt", "dir/file.txt", nil, true},
+		{all, ".\u200b./.\u200b./etc/passwd", "etc/passwd", []Reason{ReasonUnsafeUnicode, ReasonPathTraversal}, true},
+		{all, "caf\xe9/../../x", "x", []Reason{ReasonInvalidEncoding, ReasonPathTraversal}, true},
+		{all, "/..", "", []Reason{ReasonPathTraversal}, false},
+		{NameChecks{SanitizePath: true}, ".\u200b./x", ".\u200b./x", nil, true},
+		{NameChecks{}, "../x", "../x", nil, true},
+	} {
+		name := tc.in
+		var reasons []Reason
+		keep, err := ApplyRules(tc.checks.Rules(&name), false, func(v Verdict) Finding {
+			reasons = append(reasons, v.Reason)
+			return Finding{Reason: v.Reason, Action: v.Action}
+		})
+		if err != nil || keep != tc.keep || keep && name != tc.want || len(reasons) != len(tc.reasons) {
+			t.Errorf("%+v.Rules(%q) = %q, %v, %v, %v, want %q, %v, %v", tc.checks, tc.in, name, reasons, keep, err, tc.want, tc.reasons, tc.keep)
+			continue
+		}
+		for i := range reasons {
+			if reasons[i] != tc.reasons[i] {
+				t.Errorf("%+v.Rules(%q) reasons = %v, want %v", tc.checks, tc.in, reasons, tc.reasons)
+			}
+		}
+	}
+
+	name := "../x"
+	_, err := ApplyRules(all.Rules(&name), true, func(v Verdict) Finding { return Finding{Reason: v.Reason, Action: v.Action} })
+	if !errors.Is(err, ErrPathTraversal) {
+		t.Errorf("ApplyRules() in strict mode error = %v, want %v", err, ErrPathTraversal)
+	}
+}
@@ -0,0 +1,396 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ocilayer applies the layers of OCI and Docker container images to a directory, with the
+// semantics of overlay file systems: the entries of the layer replace the files of the directory
+// (the lower layers), and its whiteouts delete them (see tar.Reader.OnWhiteout).
+//
+//	for _, layer := range layers {
+//		if err := ocilayer.ApplyLayer("/var/lib/rootfs", layer, ocilayer.Options{}); err != nil {
+//			return err
+//		}
+//	}
+//
+// The layer is read with the safearchive tar reader, so its security features apply. On top of
+// them, nothing is written or deleted through a symbolic link of the directory, including the
+// links created by the lower layers: the layers of legitimate images record the files at their
+// actual location. Hard links must point to the files of the directory, which makes them safe
+// regardless of where the links were written.
+//
+// Ownership and special files (e.g. device nodes) are not applied, and the file modes are limited
+// to their permission bits, so layers can be applied without privileges.
+package ocilayer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/decompress"
+	"github.com/google/safearchive/tar"
+)
+
+// ErrInvalidName is wrapped (into a safearchive.EntryError) by the errors of applying an entry or
+// a whiteout whose name (or the target of a hard link) is not a valid relative path, e.g. because
+// the security mode does not sanitize file names.
+var ErrInvalidName = errors.New("ocilayer: invalid entry name")
+
+// ErrNotDirectory is wrapped (into a safearchive.EntryError) by the errors of applying an entry
+// whose parent exists in the directory but is not a directory.
+var ErrNotDirectory = errors.New("ocilayer: parent is not a directory")
+
+// Default limits of the application of a layer, see Options. Layers of legitimate images stay
+// far below them.
+const (
+	DefaultMaxEntries   = 1 << 20
+	DefaultMaxEntrySize = 16 << 30
+	DefaultMaxTotalSize = 64 << 30
+)
+
+// Options configures the application of a layer. The zero value uses the default settings of the
+// tar reader, and the default limits.
+type Options struct {
+	// SecurityMode is the security mode of the tar reader. tar.DefaultSecurityMode is used if not
+	// set.
+	SecurityMode tar.SecurityMode
+	// MaxEntries, MaxEntrySize and MaxTotalSize are the limits of the tar reader, see
+	// tar.Reader.SetMaxEntries. DefaultMaxEntries, DefaultMaxEntrySize and DefaultMaxTotalSize are
+	// used if not set; negative values apply no limit.
+	MaxEntries   int
+	MaxEntrySize int64
+	MaxTotalSize int64
+	// DecompressLimits are the limits of the decompression of compressed layers (e.g. gzip or
+	// zstd, if its codec is registered with the decompress package). decompress.DefaultLimits are
+	// used if not set; &decompress.Limits{} applies no limits.
+	DecompressLimits *decompress.Limits
+	// Report, if set, receives the findings of the tar reader and the special files that were not
+	// applied, whether the application succeeded or not.
+	Report *safearchive.Report
+}
+
+// ApplyLayer applies the layer tarball read from layer to the directory destDir, which holds the
+// lower layers. Compressed layers are decompressed, if a codec of the decompress package detects
+// them.
+//
+// The directory must not be modified concurrently, as the symbolic links are looked for before
+// each operation. A failed application leaves the directory partially modified.
+func ApplyLayer(destDir string, layer io.Reader, opts Options) error {
+	br := bufio.NewReader(layer)
+	r := io.Reader(br)
+	if prefix, err := br.Peek(16); err != nil && err != io.EOF {
+		return err
+	} else if c, ok := decompress.Detect(prefix); ok {
+		l := decompress.DefaultLimits
+		if opts.DecompressLimits != nil {
+			l = *opts.DecompressLimits
+		}
+		d, err := decompress.NewReader(br, c, l)
+		if err != nil {
+			return err
+		}
+		defer d.Close()
+		r = d
+	}
+
+	tr := tar.NewReader(r)
+	if opts.SecurityMode != 0 {
+		tr.SetSecurityMode(opts.SecurityMode)
+	}
+	if opts.MaxEntries == 0 {
+		opts.MaxEntries = DefaultMaxEntries
+	}
+	if opts.MaxEntrySize == 0 {
+		opts.MaxEntrySize = DefaultMaxEntrySize
+	}
+	if opts.MaxTotalSize == 0 {
+		opts.MaxTotalSize = DefaultMaxTotalSize
+	}
+	tr.SetMaxEntries(opts.MaxEntries)
+	tr.SetMaxEntrySize(opts.MaxEntrySize)
+	tr.SetMaxTotalSize(opts.MaxTotalSize)
+	a := &applier{root: destDir, written: map[string]bool{}}
+	tr.OnWhiteout(a.whiteout)
+	err := a.apply(tr)
+	if opts.Report != nil {
+		opts.Report.Findings = append(opts.Report.Findings, tr.Report().Findings...)
+		opts.Report.Findings = append(opts.Report.Findings, a.findings...)
+	}
+	return err
+}
+
+// applier is the state of the application of a layer.
+type applier struct {
+	root string
+	// written are the files and directories written by the layer, including the parent directories
+	// it created. Its whiteouts only delete the files of the lower layers.
+	written map[string]bool
+	// dirs are the modification times of the directories of the layer, set once all the entries
+	// are written.
+	dirs     []dirTime
+	findings []safearchive.Finding
+}
+
+type dirTime struct {
+	name  string
+	mtime time.Time
+}
+
+func (a *applier) apply(tr *tar.Reader) error {
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := a.entry(h, tr); err != nil {
+			return err
+		}
+	}
+	for i := len(a.dirs) - 1; i >= 0; i-- {
+		if a.dirs[i].mtime.IsZero() {
+			continue
+		}
+		if err := os.Chtimes(a.path(a.dirs[i].name), a.dirs[i].mtime, a.dirs[i].mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// path returns the path of name in the directory of the operating system.
+func (a *applier) path(name string) string {
+	return filepath.Join(a.root, filepath.FromSlash(name))
+}
+
+// entry applies the entry h, whose data is read from content.
+func (a *applier) entry(h *tar.Header, content io.Reader) error {
+	name := strings.TrimSuffix(filepath.ToSlash(h.Name), "/")
+	if name == "" || name == "." {
+		// the root of the layer
+		return nil
+	}
+	if !fs.ValidPath(name) {
+		return a.entryError(h.Name, ErrInvalidName)
+	}
+	switch h.Typeflag {
+	case tar.TypeDir, tar.TypeReg, tar.TypeSymlink, tar.TypeLink:
+	default:
+		a.findings = append(a.findings, safearchive.Finding{Name: h.Name, Reason: safearchive.ReasonSpecialFile, Action: safearchive.ActionDropped})
+		return nil
+	}
+	if err := a.mkdirAll(path.Dir(name)); err != nil {
+		return a.entryError(h.Name, err)
+	}
+	p := a.path(name)
+	fi, err := os.Lstat(p)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return a.entryError(h.Name, err)
+	}
+	exists := err == nil
+	if h.Typeflag == tar.TypeDir && exists && fi.IsDir() {
+		// directories are merged
+		a.written[name] = true
+		a.dirs = append(a.dirs, dirTime{name, h.ModTime})
+		if err := os.Chmod(p, h.FileInfo().Mode().Perm()|0700); err != nil {
+			return a.entryError(h.Name, err)
+		}
+		return nil
+	}
+	var target string
+	if h.Typeflag == tar.TypeLink {
+		if target, err = a.linkTarget(h); err != nil {
+			return a.entryError(h.Name, err)
+		}
+		if target == name {
+			a.written[name] = true
+			return nil
+		}
+	}
+	if exists {
+		// the file of the lower layers is replaced, and a directory with everything below it
+		if err := os.RemoveAll(p); err != nil {
+			return a.entryError(h.Name, err)
+		}
+	}
+	a.written[name] = true
+	switch h.Typeflag {
+	case tar.TypeDir:
+		err = os.Mkdir(p, h.FileInfo().Mode().Perm()|0700)
+		a.dirs = append(a.dirs, dirTime{name, h.ModTime})
+	case tar.TypeReg:
+		err = create(p, h.FileInfo().Mode().Perm(), content)
+		if err == nil && !h.ModTime.IsZero() {
+			err = os.Chtimes(p, h.ModTime, h.ModTime)
+		}
+	case tar.TypeSymlink:
+		err = os.Symlink(filepath.FromSlash(h.Linkname), p)
+	case tar.TypeLink:
+		err = os.Link(a.path(target), p)
+	}
+	if err != nil {
+		return a.entryError(h.Name, err)
+	}
+	return nil
+}
+
+// create creates the regular file p with the data of content.
+func create(p string, perm fs.FileMode, content io.Reader) error {
+	// O_EXCL also refuses to follow a symbolic link planted at p
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// linkTarget returns the name of the target of the hard link h, which must be a file of the
+// directory other than a directory.
+func (a *applier) linkTarget(h *tar.Header) (string, error) {
+	target := strings.TrimSuffix(filepath.ToSlash(h.Linkname), "/")
+	if !fs.ValidPath(target) || target == "." {
+		return "", ErrInvalidName
+	}
+	if err := a.checkPath(target); err != nil {
+		return "", err
+	}
+	fi, err := os.Lstat(a.path(target))
+	if err != nil {
+		return "", err
+	}
+	if fi.IsDir() {
+		return "", fmt.Errorf("ocilayer: hard link to the directory %s", target)
+	}
+	return target, nil
+}
+
+// checkPath fails if a parent of name in the directory is a symbolic link or not a directory. The
+// missing parents are not checked further.
+func (a *applier) checkPath(name string) error {
+	parts := strings.Split(name, "/")
+	for i := 1; i < len(parts); i++ {
+		p := strings.Join(parts[:i], "/")
+		fi, err := os.Lstat(a.path(p))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("%w: %s", safearchive.ErrSymlinkTraversal, p)
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("%w: %s", ErrNotDirectory, p)
+		}
+	}
+	return nil
+}
+
+// mkdirAll creates the directory dir along with its missing parents, failing if one of them is a
+// symbolic link or not a directory.
+func (a *applier) mkdirAll(dir string) error {
+	if dir == "." {
+		return nil
+	}
+	if err := a.checkPath(dir + "/"); err != nil {
+		return err
+	}
+	parts := strings.Split(dir, "/")
+	for i := 1; i <= len(parts); i++ {
+		p := strings.Join(parts[:i], "/")
+		err := os.Mkdir(a.path(p), 0755)
+		if err == nil {
+			a.written[p] = true
+		} else if !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// entryError returns the error of applying the entry name.
+func (a *applier) entryError(name string, err error) error {
+	switch {
+	case errors.Is(err, safearchive.ErrSymlinkTraversal):
+		return safearchive.NewEntryError(name, safearchive.ReasonSymlinkTraversal, err)
+	case errors.Is(err, ErrInvalidName):
+		return safearchive.NewEntryError(name, safearchive.NameReason(name), err)
+	}
+	return safearchive.NewEntryError(name, "", err)
+}
+
+// whiteout applies the deletion w of the files of the lower layers.
+func (a *applier) whiteout(w tar.Whiteout) error {
+	if !fs.ValidPath(w.Path) || w.Path == "." && !w.Opaque {
+		return ErrInvalidName
+	}
+	name := w.Path
+	if w.Opaque {
+		// the marker is in the directory
+		name += "/"
+	}
+	if err := a.checkPath(name); err != nil {
+		return err
+	}
+	fi, err := os.Lstat(a.path(w.Path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if w.Opaque || a.written[w.Path] {
+		if !fi.IsDir() {
+			return nil
+		}
+		return a.clear(w.Path)
+	}
+	return os.RemoveAll(a.path(w.Path))
+}
+
+// clear deletes the files of the lower layers from the directory dir, keeping the ones written by
+// the layer.
+func (a *applier) clear(dir string) error {
+	entries, err := os.ReadDir(a.path(dir))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := path.Join(dir, e.Name())
+		switch {
+		case !a.written[name]:
+			err = os.RemoveAll(a.path(name))
+		case e.IsDir():
+			err = a.clear(name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ocilayer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/safearchive"
+	star "github.com/google/safearchive/tar"
+)
+
+// opts are the options of the tests, which do not depend on the default security mode of the
+// build.
+var opts = Options{SecurityMode: star.SanitizeFilenames | star.PreventSymlinkTraversal}
+
+// layer returns a layer tarball with the entries hs. The content of the regular files is their
+// name, unless Linkname is set.
+func layer(t *testing.T, hs ...*tar.Header) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range hs {
+		content := ""
+		if h.Typeflag == tar.TypeReg {
+			content = h.Name
+			if h.Linkname != "" {
+				content, h.Linkname = h.Linkname, ""
+			}
+			h.Size = int64(len(content))
+		}
+		if h.Mode == 0 {
+			h.Mode = 0644
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf("WriteHeader(%q) error = %v", h.Name, err)
+		}
+		tw.Write([]byte(content))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// tree returns the files of dir, with the content of the regular files and the targets of the
+// symbolic links.
+func tree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	re := map[string]string{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		name := filepath.ToSlash(strings.TrimPrefix(p, dir+string(filepath.Separator)))
+		switch {
+		case d.IsDir():
+			re[name+"/"] = ""
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			re[name] = "-> " + filepath.ToSlash(target)
+		default:
+			b, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			re[name] = string(b)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WalkDir() error = %v", err)
+	}
+	return re
+}
+
+func reg(name string) *tar.Header {
+	return &tar.Header{Name: name, Typeflag: tar.TypeReg}
+}
+
+func dir(name string) *tar.Header {
+	return &tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755}
+}
+
+func TestApplyLayer(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links need privileges on Windows")
+	}
+	root := t.TempDir()
+	lower := layer(t,
+		dir("etc/"), reg("etc/passwd"), reg("etc/group"),
+		dir("var/lib/a/"), reg("var/lib/a/old"), reg("var/lib/b"),
+		reg("usr/bin/x"), reg("home/user"), reg("opt/app/old"),
+	)
+	if err := ApplyLayer(root, bytes.NewReader(lower), opts); err != nil {
+		t.Fatalf("ApplyLayer(lower) error = %v", err)
+	}
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(layer(t,
+		reg("etc/.wh.passwd"),
+		reg("var/lib/.wh..wh..opq"),
+		reg("var/lib/new"),
+		&tar.Header{Name: "usr/bin/x", Typeflag: tar.TypeReg, Linkname: "replaced"},
+		&tar.Header{Name: "usr/bin/y", Typeflag: tar.TypeLink, Linkname: "usr/bin/x"},
+		&tar.Header{Name: "usr/lib", Typeflag: tar.TypeSymlink, Linkname: "../lib"},
+		&tar.Header{Name: "home", Typeflag: tar.TypeSymlink, Linkname: "/var/home"},
+		reg("opt/app/new"),
+		reg("opt/app/.wh..wh..opq"),
+		reg(".wh.missing"),
+		&tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3},
+	))
+	zw.Close()
+	report := &safearchive.Report{}
+	if err := ApplyLayer(root, &gz, Options{SecurityMode: opts.SecurityMode, Report: report}); err != nil {
+		t.Fatalf("ApplyLayer(upper) error = %v", err)
+	}
+	want := map[string]string{
+		"etc/":        "",
+		"etc/group":   "etc/group",
+		"var/":        "",
+		"var/lib/":    "",
+		"var/lib/new": "var/lib/new",
+		"usr/":        "",
+		"usr/bin/":    "",
+		"usr/bin/x":   "replaced",
+		"usr/bin/y":   "replaced",
+		"usr/lib":     "-> ../lib",
+		"home":        "-> /var/home",
+		"opt/":        "",
+		"opt/app/":    "",
+		"opt/app/new": "opt/app/new",
+	}
+	if got := tree(t, root); !reflect.DeepEqual(got, want) {
+		t.Errorf("ApplyLayer() tree = %q, want %q", got, want)
+	}
+	x, _ := os.Stat(filepath.Join(root, "usr/bin/x"))
+	y, _ := os.Stat(filepath.Join(root, "usr/bin/y"))
+	if !os.SameFile(x, y) {
+		t.Errorf("usr/bin/y is not a hard link to usr/bin/x")
+	}
+	var reasons []safearchive.Reason
+	for _, f := range report.Findings {
+		reasons = append(reasons, f.Reason)
+	}
+	if want := []safearchive.Reason{safearchive.ReasonSpecialFile}; !reflect.DeepEqual(reasons, want) {
+		t.Errorf("Report reasons = %q, want %q", reasons, want)
+	}
+}
+
+func TestApplyLayerSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symbolic links need privileges on Windows")
+	}
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	if err := ApplyLayer(root, bytes.NewReader(layer(t,
+		&tar.Header{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: outside},
+		dir("dir/"),
+	)), opts); err != nil {
+		t.Fatalf("ApplyLayer(lower) error = %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		entry *tar.Header
+	}{
+		{name: "write", entry: reg("escape/pwned")},
+		{name: "nested write", entry: reg("escape/sub/pwned")},
+		{name: "whiteout", entry: reg("escape/.wh.secret")},
+		{name: "opaque", entry: reg("escape/.wh..wh..opq")},
+		{name: "hard link", entry: &tar.Header{Name: "dir/secret", Typeflag: tar.TypeLink, Linkname: "escape/secret"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ApplyLayer(root, bytes.NewReader(layer(t, tc.entry)), opts)
+			if !errors.Is(err, safearchive.ErrSymlinkTraversal) {
+				t.Errorf("ApplyLayer() error = %v, want %v", err, safearchive.ErrSymlinkTraversal)
+			}
+			var names []string
+			for name := range tree(t, outside) {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			if want := []string{"secret"}; !reflect.DeepEqual(names, want) {
+				t.Errorf("outside directory = %q, want %q", names, want)
+			}
+		})
+	}
+
+	// replacing the link itself is fine
+	if err := ApplyLayer(root, bytes.NewReader(layer(t, reg(".wh.escape"), reg("escape"))), opts); err != nil {
+		t.Fatalf("ApplyLayer() error = %v", err)
+	}
+	if got, want := tree(t, root), map[string]string{"dir/": "", "escape": "escape"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ApplyLayer() tree = %q, want %q", got, want)
+	}
+}
+
+func TestApplyLayerNotDirectory(t *testing.T) {
+	root := t.TempDir()
+	if err := ApplyLayer(root, bytes.NewReader(layer(t, reg("file"))), opts); err != nil {
+		t.Fatalf("ApplyLayer(lower) error = %v", err)
+	}
+	if err := ApplyLayer(root, bytes.NewReader(layer(t, reg("file/child"))), opts); !errors.Is(err, ErrNotDirectory) {
+		t.Errorf("ApplyLayer() error = %v, want %v", err, ErrNotDirectory)
+	}
+}
+
+func TestApplyLayerDefaultLimits(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	// only the header of the entry, declaring more than DefaultMaxEntrySize
+	tw.WriteHeader(&tar.Header{Name: "huge", Typeflag: tar.TypeReg, Mode: 0644, Size: DefaultMaxEntrySize + 1})
+	huge := buf.Bytes()
+
+	if err := ApplyLayer(t.TempDir(), bytes.NewReader(huge), opts); !errors.Is(err, star.ErrLimitExceeded) {
+		t.Errorf("ApplyLayer() error = %v, want %v", err, star.ErrLimitExceeded)
+	}
+	lifted := opts
+	lifted.MaxEntrySize = -1
+	if err := ApplyLayer(t.TempDir(), bytes.NewReader(huge), lifted); err == nil || errors.Is(err, star.ErrLimitExceeded) {
+		t.Errorf("ApplyLayer() without limits error = %v, want a truncated layer", err)
+	}
+}
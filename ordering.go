@@ -0,0 +1,72 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// OrderChecker detects entries whose extraction depends on the order of the entries of an
+// archive: entries replacing a directory of earlier entries, entries written through a symbolic
+// link of an earlier entry, and entries other than symbolic links following a symbolic link.
+// Defensive consumers prefer to refuse such archives outright rather than to rely on the order
+// they are extracted in.
+// The zero value is ready to use.
+type OrderChecker struct {
+	dirs     map[string]bool
+	symlinks map[string]bool
+	// symlink is the name of the first symbolic link.
+	symlink string
+}
+
+// Check reports whether the entry name (a sanitized, forward slash separated path) of the given
+// kind may be extracted regardless of the order of the entries, and records it. If not, it
+// returns an explanation.
+func (c *OrderChecker) Check(name string, dir, symlink bool) (string, bool) {
+	if c.dirs == nil {
+		c.dirs = map[string]bool{}
+		c.symlinks = map[string]bool{}
+	}
+	name = path.Clean(strings.TrimPrefix(name, "/"))
+	if name == "." {
+		return "", true
+	}
+	for p := path.Dir(name); p != "."; p = path.Dir(p) {
+		if c.symlinks[p] {
+			return fmt.Sprintf("written through the symbolic link %s", p), false
+		}
+	}
+	if !dir && c.dirs[name] {
+		return "replaces a directory of earlier entries", false
+	}
+	if c.symlink != "" && !symlink {
+		return fmt.Sprintf("follows the symbolic link %s", c.symlink), false
+	}
+	if dir {
+		c.dirs[name] = true
+	}
+	for p := path.Dir(name); p != "."; p = path.Dir(p) {
+		c.dirs[p] = true
+	}
+	if symlink {
+		c.symlinks[name] = true
+		if c.symlink == "" {
+			c.symlink = name
+		}
+	}
+	return "", true
+}
@@ -0,0 +1,53 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOrderChecker(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		entries []string
+		// want is the index of the first entry rejected, or -1.
+		want int
+	}{
+		{name: "regular", entries: []string{"a/", "a/1", "b", "l@"}, want: -1},
+		{name: "symlinks last", entries: []string{"a/1", "l@", "m@", "a/l@"}, want: -1},
+		{name: "content after symlink", entries: []string{"l@", "a/1"}, want: 1},
+		{name: "directory replaced by file", entries: []string{"a/1", "a"}, want: 1},
+		{name: "directory replaced by symlink", entries: []string{"a/", "a@"}, want: 1},
+		{name: "through symlink", entries: []string{"a@", "a/b@"}, want: 1},
+		{name: "directory twice", entries: []string{"a/", "./a/"}, want: -1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var c OrderChecker
+			got := -1
+			for i, e := range tc.entries {
+				// directories end with a slash, symbolic links with an @
+				dir, symlink := strings.HasSuffix(e, "/"), strings.HasSuffix(e, "@")
+				if _, ok := c.Check(strings.TrimSuffix(e, "@"), dir, symlink); !ok {
+					got = i
+					break
+				}
+			}
+			if got != tc.want {
+				t.Errorf("first rejected entry = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
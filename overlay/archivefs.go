@@ -0,0 +1,229 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package overlay
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/safearchive/tar"
+	"github.com/google/safearchive/zip"
+)
+
+// ErrTooLarge is returned by FromTar when the contents of the archive exceed the limit.
+var ErrTooLarge = errors.New("overlay: archive too large")
+
+// node is a file or a directory of an archiveFS.
+type node struct {
+	name     string
+	mode     fs.FileMode
+	size     int64
+	modTime  time.Time
+	open     func() (io.ReadCloser, error)
+	children map[string]*node
+}
+
+func (n *node) Name() string               { return n.name }
+func (n *node) Size() int64                { return n.size }
+func (n *node) Mode() fs.FileMode          { return n.mode }
+func (n *node) ModTime() time.Time         { return n.modTime }
+func (n *node) IsDir() bool                { return n.mode.IsDir() }
+func (n *node) Sys() any                   { return nil }
+func (n *node) Type() fs.FileMode          { return n.mode.Type() }
+func (n *node) Info() (fs.FileInfo, error) { return n, nil }
+
+// archiveFS is a read-only file system of the regular files and directories of an archive.
+type archiveFS struct {
+	root *node
+}
+
+func newArchiveFS() *archiveFS {
+	return &archiveFS{root: &node{name: ".", mode: fs.ModeDir | 0755, children: map[string]*node{}}}
+}
+
+// add adds an entry to the file system. Directories are created for the missing parents. Later
+// entries replace the earlier ones with the same name; entries below a file are skipped.
+func (a *archiveFS) add(name string, mode fs.FileMode, size int64, modTime time.Time, open func() (io.ReadCloser, error)) {
+	name = path.Clean(strings.TrimPrefix(filepath.ToSlash(name), "/"))
+	if name == "." || !fs.ValidPath(name) {
+		return
+	}
+	dir := a.root
+	parts := strings.Split(name, "/")
+	for _, p := range parts[:len(parts)-1] {
+		c, ok := dir.children[p]
+		if !ok {
+			c = &node{name: p, mode: fs.ModeDir | 0755, modTime: modTime, children: map[string]*node{}}
+			dir.children[p] = c
+		}
+		if !c.IsDir() {
+			return
+		}
+		dir = c
+	}
+	base := parts[len(parts)-1]
+	if mode.IsDir() {
+		if c, ok := dir.children[base]; ok && c.IsDir() {
+			c.mode, c.modTime = mode, modTime
+			return
+		}
+		dir.children[base] = &node{name: base, mode: mode, modTime: modTime, children: map[string]*node{}}
+		return
+	}
+	dir.children[base] = &node{name: base, mode: mode, size: size, modTime: modTime, open: open}
+}
+
+func (a *archiveFS) lookup(name string) (*node, error) {
+	if !fs.ValidPath(name) {
+		return nil, fs.ErrInvalid
+	}
+	n := a.root
+	if name == "." {
+		return n, nil
+	}
+	for _, p := range strings.Split(name, "/") {
+		c, ok := n.children[p]
+		if !ok || !n.IsDir() {
+			return nil, fs.ErrNotExist
+		}
+		n = c
+	}
+	return n, nil
+}
+
+// Open opens the named file.
+func (a *archiveFS) Open(name string) (fs.File, error) {
+	n, err := a.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if n.IsDir() {
+		var entries []fs.DirEntry
+		for _, c := range n.children {
+			entries = append(entries, c)
+		}
+		return newDirFile(n, entries), nil
+	}
+	rc, err := n.open()
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &file{info: n, ReadCloser: rc}, nil
+}
+
+// file is an open regular file.
+type file struct {
+	io.ReadCloser
+	info fs.FileInfo
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+// dirFile is an open directory.
+type dirFile struct {
+	info    fs.FileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+// newDirFile returns an open directory listing entries in the order of their names.
+func newDirFile(info fs.FileInfo, entries []fs.DirEntry) *dirFile {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return &dirFile{info: info, entries: entries}
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *dirFile) Close() error               { return nil }
+
+func (d *dirFile) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: errors.New("is a directory")}
+}
+
+func (d *dirFile) ReadDir(count int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if count <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(rest) {
+		count = len(rest)
+	}
+	d.offset += count
+	return rest[:count], nil
+}
+
+// FromZip returns a read-only file system of the regular files and directories of r, as exposed
+// by r (so with its security features applied). Symbolic links and special files are left out.
+func FromZip(r *zip.Reader) fs.FS {
+	a := newArchiveFS()
+	for _, f := range r.File {
+		mode := f.Mode()
+		if !mode.IsRegular() && !mode.IsDir() {
+			continue
+		}
+		a.add(f.Name, mode, int64(f.UncompressedSize64), f.Modified, f.Open)
+	}
+	return a
+}
+
+// FromTar reads the remaining entries of tr into memory and returns a read-only file system of its
+// regular files and directories, as exposed by tr (so with its security features applied).
+// Symbolic links, hard links and special files are left out. ErrTooLarge is returned if the total
+// size of the regular files exceeds maxSize.
+func FromTar(tr *tar.Reader, maxSize int64) (fs.FS, error) {
+	a := newArchiveFS()
+	var total int64
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return a, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch h.Typeflag {
+		case tar.TypeDir:
+			a.add(h.Name, h.FileInfo().Mode(), 0, h.ModTime, nil)
+			continue
+		case tar.TypeReg, tar.TypeGNUSparse:
+		default:
+			continue
+		}
+		if h.Size > maxSize-total {
+			return nil, ErrTooLarge
+		}
+		data, err := io.ReadAll(io.LimitReader(tr, maxSize-total+1))
+		if err != nil {
+			return nil, err
+		}
+		total += int64(len(data))
+		if total > maxSize {
+			return nil, ErrTooLarge
+		}
+		a.add(h.Name, h.FileInfo().Mode(), int64(len(data)), h.ModTime, func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		})
+	}
+}
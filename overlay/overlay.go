@@ -0,0 +1,155 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package overlay presents the contents of an archive on top of an existing directory as a single
+// read-only fs.FS, without writing anything to disk.
+//
+// This is useful for previewing what an extraction would result in, for diffing and for serving
+// patched content:
+//
+//	r, _ := zip.OpenReader("patch.zip")
+//	defer r.Close()
+//	fsys := overlay.New(overlay.FromZip(&r.Reader), os.DirFS("/srv/www"), overlay.ArchiveWins)
+//	http.Handle("/", http.FileServer(http.FS(fsys)))
+//
+// The archive side is built from the entries exposed by the safearchive readers, so their security
+// features apply.
+package overlay
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+)
+
+// Precedence tells which layer wins when both the archive and the directory have a file with the
+// same name.
+type Precedence int
+
+const (
+	// ArchiveWins serves the files of the archive over the files of the directory.
+	ArchiveWins Precedence = iota
+	// DirectoryWins serves the files of the directory over the files of the archive.
+	DirectoryWins
+)
+
+// FS is the merged view of an archive and a directory. Directories present in both layers are
+// merged; in every other case the file of the winning layer hides the file of the other layer,
+// including everything below it.
+type FS struct {
+	upper, lower fs.FS
+}
+
+// New returns the merged view of the archive and dir file systems.
+func New(archive, dir fs.FS, p Precedence) *FS {
+	if p == DirectoryWins {
+		return &FS{upper: dir, lower: archive}
+	}
+	return &FS{upper: archive, lower: dir}
+}
+
+// hiddenInLower reports if name in the lower layer is hidden by a file (not a directory) of the
+// upper layer at name or at any of its parents.
+func (o *FS) hiddenInLower(name string) bool {
+	for p := name; p != "."; p = path.Dir(p) {
+		if fi, err := fs.Stat(o.upper, p); err == nil && !fi.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// Open opens the named file.
+func (o *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	uf, uerr := o.upper.Open(name)
+	if uerr != nil && !errors.Is(uerr, fs.ErrNotExist) {
+		return nil, uerr
+	}
+	if uf != nil {
+		fi, err := uf.Stat()
+		if err != nil {
+			uf.Close()
+			return nil, err
+		}
+		if !fi.IsDir() {
+			return uf, nil
+		}
+	}
+	if o.hiddenInLower(name) {
+		if uf != nil {
+			return uf, nil
+		}
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	lf, lerr := o.lower.Open(name)
+	if lerr != nil {
+		if uf != nil {
+			return o.mergeDir(name, uf, nil)
+		}
+		return nil, lerr
+	}
+	if uf == nil {
+		return lf, nil
+	}
+	lfi, err := lf.Stat()
+	if err != nil || !lfi.IsDir() {
+		lf.Close()
+		return o.mergeDir(name, uf, nil)
+	}
+	return o.mergeDir(name, uf, lf)
+}
+
+// mergeDir returns the open directory name listing the entries of the upper directory and the
+// entries of the lower directory (if any) not hidden by them. Both directories are closed.
+func (o *FS) mergeDir(name string, upper, lower fs.File) (fs.File, error) {
+	defer upper.Close()
+	if lower != nil {
+		defer lower.Close()
+	}
+	info, err := upper.Stat()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := readDir(name, upper)
+	if err != nil {
+		return nil, err
+	}
+	if lower != nil {
+		lentries, err := readDir(name, lower)
+		if err != nil {
+			return nil, err
+		}
+		seen := map[string]bool{}
+		for _, e := range entries {
+			seen[e.Name()] = true
+		}
+		for _, e := range lentries {
+			if !seen[e.Name()] {
+				entries = append(entries, e)
+			}
+		}
+	}
+	return newDirFile(info, entries), nil
+}
+
+func readDir(name string, f fs.File) ([]fs.DirEntry, error) {
+	d, ok := f.(fs.ReadDirFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not implemented")}
+	}
+	return d.ReadDir(-1)
+}
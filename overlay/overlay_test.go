@@ -0,0 +1,95 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package overlay
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/google/safearchive/internal/archivetest"
+	"github.com/google/safearchive/tar"
+	"github.com/google/safearchive/zip"
+)
+
+func testLayers(t *testing.T) (fs.FS, fs.FS) {
+	b := archivetest.Zip(t, []archivetest.Entry{
+		{Name: "a.txt", Content: []byte("archive")},
+		{Name: "dir/x.txt", Content: []byte("x")},
+		{Name: "../evil.txt", Content: []byte("evil")},
+		{Name: "shadow", Content: []byte("file in the archive")},
+	})
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatalf("zip.NewReader() error = %v", err)
+	}
+	archive := FromZip(zr)
+	dir := fstest.MapFS{
+		"a.txt":            {Data: []byte("directory")},
+		"dir/y.txt":        {Data: []byte("y")},
+		"shadow/inner.txt": {Data: []byte("inner")},
+		"only.txt":         {Data: []byte("only")},
+	}
+	return archive, dir
+}
+
+func TestArchiveWins(t *testing.T) {
+	archive, dir := testLayers(t)
+	fsys := New(archive, dir, ArchiveWins)
+	if err := fstest.TestFS(fsys, "a.txt", "dir/x.txt", "dir/y.txt", "evil.txt", "shadow", "only.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := fs.ReadFile(fsys, "a.txt"); string(b) != "archive" {
+		t.Errorf("a.txt = %q, want the file of the archive", b)
+	}
+	if _, err := fs.Stat(fsys, "shadow/inner.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat(shadow/inner.txt) error = %v, want it hidden by the file of the archive", err)
+	}
+}
+
+func TestDirectoryWins(t *testing.T) {
+	archive, dir := testLayers(t)
+	fsys := New(archive, dir, DirectoryWins)
+	if err := fstest.TestFS(fsys, "a.txt", "dir/x.txt", "dir/y.txt", "evil.txt", "shadow/inner.txt", "only.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := fs.ReadFile(fsys, "a.txt"); string(b) != "directory" {
+		t.Errorf("a.txt = %q, want the file of the directory", b)
+	}
+}
+
+func TestFromTar(t *testing.T) {
+	archive := archivetest.Tar(t, []archivetest.Entry{
+		{Name: "/abs/a.txt", Content: []byte("hello")},
+		{Name: "link", Linkname: "/etc/passwd"},
+	})
+
+	fsys, err := FromTar(tar.NewReader(bytes.NewReader(archive)), 1024)
+	if err != nil {
+		t.Fatalf("FromTar() error = %v", err)
+	}
+	if err := fstest.TestFS(fsys, "abs/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(fsys, "link"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat(link) error = %v, want symbolic links left out", err)
+	}
+
+	if _, err := FromTar(tar.NewReader(bytes.NewReader(archive)), 4); err != ErrTooLarge {
+		t.Errorf("FromTar() with a small limit error = %v, want %v", err, ErrTooLarge)
+	}
+}
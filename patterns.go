@@ -0,0 +1,69 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"path"
+	"strings"
+)
+
+// Patterns filters the entries of an archive by name with glob patterns (see path.Match), like the
+// --wildcards of tar: a pattern matches a name if it matches the name or one of its parent
+// directories, so "docs" and "docs/*" both match "docs/a/b.txt". Names are forward slash
+// separated paths, compared in their sanitized form. The zero value matches everything.
+type Patterns struct {
+	// Include, if not empty, restricts the matched names to the ones matched by one of its patterns.
+	Include []string
+	// Exclude are the patterns of the names that are not matched, even if included.
+	Exclude []string
+}
+
+// Validate returns path.ErrBadPattern if one of the patterns is malformed.
+func (p Patterns) Validate() error {
+	for _, patterns := range [][]string{p.Include, p.Exclude} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(cleanPattern(pattern), ""); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Match reports whether name is included and not excluded. Malformed patterns match nothing.
+func (p Patterns) Match(name string) bool {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if len(p.Include) > 0 && !matchAny(p.Include, name) {
+		return false
+	}
+	return !matchAny(p.Exclude, name)
+}
+
+// matchAny reports whether one of patterns matches name or one of its parent directories.
+func matchAny(patterns []string, name string) bool {
+	for ; name != "" && name != "."; name = path.Dir(name) {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(cleanPattern(pattern), name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cleanPattern removes the leading and trailing separators and the "." path elements of pattern.
+func cleanPattern(pattern string) string {
+	return strings.TrimPrefix(path.Clean("/"+pattern), "/")
+}
@@ -0,0 +1,57 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"errors"
+	"path"
+	"testing"
+)
+
+func TestPatterns(t *testing.T) {
+	tests := []struct {
+		p     Patterns
+		name  string
+		match bool
+	}{
+		{Patterns{}, "a/b.txt", true},
+		{Patterns{Include: []string{"*.txt"}}, "b.txt", true},
+		{Patterns{Include: []string{"*.txt"}}, "a/b.txt", false},
+		{Patterns{Include: []string{"*/*.txt"}}, "a/b.txt", true},
+		{Patterns{Include: []string{"docs"}}, "docs/a/b.txt", true},
+		{Patterns{Include: []string{"./docs/*"}}, "docs/a/b.txt", true},
+		{Patterns{Include: []string{"docs/"}}, "docs/", true},
+		{Patterns{Include: []string{"docs"}}, "docsx/a", false},
+		{Patterns{Exclude: []string{"*.exe"}}, "a.exe", false},
+		{Patterns{Exclude: []string{"*.exe"}}, "a.txt", true},
+		{Patterns{Exclude: []string{"*.exe"}}, "bin.exe/readme", false},
+		{Patterns{Exclude: []string{"*/*.exe"}}, "bin/a.exe", false},
+		{Patterns{Include: []string{"src"}, Exclude: []string{"src/vendor"}}, "src/main.go", true},
+		{Patterns{Include: []string{"src"}, Exclude: []string{"src/vendor"}}, "src/vendor/x.go", false},
+		{Patterns{Include: []string{"[a-"}}, "a", false},
+	}
+	for _, tc := range tests {
+		if got := tc.p.Match(tc.name); got != tc.match {
+			t.Errorf("%+v.Match(%q) = %v, want %v", tc.p, tc.name, got, tc.match)
+		}
+	}
+
+	if err := (Patterns{Include: []string{"*.txt"}, Exclude: []string{"[a-"}}).Validate(); !errors.Is(err, path.ErrBadPattern) {
+		t.Errorf("Validate() = %v, want %v", err, path.ErrBadPattern)
+	}
+	if err := (Patterns{Include: []string{"*.txt"}}).Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+}
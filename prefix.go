@@ -0,0 +1,33 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import "github.com/google/safearchive/sanitizer"
+
+// RequirePrefixes returns a rule enforcing the layout of archive formats with fixed top-level
+// directories (e.g. "package" for npm tarballs): the entries whose name does not lie under one of
+// prefixes get action (ActionDropped or ActionRejected), with ReasonUnexpectedPrefix. Names and
+// prefixes are compared in their sanitized form (see sanitizer.InSubtree). Directories leading to a
+// prefix (e.g. "a/" for the prefix "a/b") are allowed, as archivers add them.
+func RequirePrefixes(action Action, prefixes ...string) Rule {
+	return RuleFunc(func(e *Entry) Verdict {
+		for _, p := range prefixes {
+			if sanitizer.InSubtree(e.Name, p) || e.Mode.IsDir() && sanitizer.InSubtree(p, e.Name) {
+				return Pass
+			}
+		}
+		return Verdict{Action: action, Reason: ReasonUnexpectedPrefix}
+	})
+}
@@ -0,0 +1,48 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"io/fs"
+	"testing"
+)
+
+func TestRequirePrefixes(t *testing.T) {
+	r := RequirePrefixes(ActionDropped, "package", "docs/api/")
+	for _, tc := range []struct {
+		name string
+		mode fs.FileMode
+		want Action
+	}{
+		{name: "package/index.js", want: ActionNone},
+		{name: "package", mode: fs.ModeDir, want: ActionNone},
+		{name: "./package/lib/a.js", want: ActionNone},
+		{name: "docs/api/x.md", want: ActionNone},
+		{name: "docs/", mode: fs.ModeDir, want: ActionNone},
+		{name: "docs/readme.md", want: ActionDropped},
+		{name: "docs", want: ActionDropped},
+		{name: "packages/evil.js", want: ActionDropped},
+		{name: "install.sh", want: ActionDropped},
+	} {
+		e := Entry{Name: tc.name, Mode: tc.mode}
+		v := r.Check(&e)
+		if v.Action != tc.want || (v.Action != ActionNone) != (v.Reason == ReasonUnexpectedPrefix) {
+			t.Errorf("Check(%q) = %+v, want action %v", tc.name, v, tc.want)
+		}
+	}
+	if err := RejectionError(ReasonUnexpectedPrefix); err != ErrUnexpectedPrefix {
+		t.Errorf("RejectionError(%q) = %v, want %v", ReasonUnexpectedPrefix, err, ErrUnexpectedPrefix)
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !safearchive_hardened
+// +build !safearchive_hardened
+
+package safearchive
+
+// Hardened reports whether the binary was built with the hardened profile, enabled by the
+// safearchive_hardened build tag. The profile is meant for regulated environments that need a
+// minimal, auditable surface:
+//   - the readers of the tar, zip, ar, cpio, rar and iso packages default to their
+//     MaximumSecurityMode
+//   - the decompress package keeps its standard library backed codecs (gzip and bzip2) only, and
+//     ignores the registration of any other codec
+//   - the zip package ignores the registration of custom compressors and decompressors
+//   - the network facing httpupload package is not available
+const Hardened = false
@@ -0,0 +1,454 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rar
+
+import (
+	"fmt"
+	"io"
+)
+
+// The bits of the compressed data are read most significant bit first by both algorithms.
+
+// maxPadding is the number of zero bytes read past the end of the compressed data before the data
+// is deemed truncated: the decoders of RAR look ahead of the codes they decode.
+const maxPadding = 16
+
+// bitReader reads the bits of the compressed data of an entry.
+type bitReader struct {
+	r io.ByteReader
+	// v holds the n buffered bits in its low bits.
+	v uint64
+	n uint
+	// read is the number of bytes read, and padding the number of zero bytes past the end of the
+	// data.
+	read, padding int64
+	err           error
+}
+
+func newBitReader(r io.ByteReader) *bitReader {
+	return &bitReader{r: r}
+}
+
+// fill buffers at least 57 bits, padding the data with zero bytes past its end.
+func (br *bitReader) fill() {
+	for br.n <= 56 {
+		c, err := br.r.ReadByte()
+		if err != nil {
+			if err != io.EOF && br.err == nil {
+				br.err = err
+			}
+			if br.padding++; br.padding > maxPadding && br.err == nil {
+				br.err = io.ErrUnexpectedEOF
+			}
+			c = 0
+		}
+		br.v = br.v<<8 | uint64(c)
+		br.n += 8
+		br.read++
+	}
+}
+
+// peek returns the next n bits, n <= 32, without consuming them.
+func (br *bitReader) peek(n uint) uint32 {
+	if br.n < n {
+		br.fill()
+	}
+	return uint32(br.v>>(br.n-n)) & (1<<n - 1)
+}
+
+// skip consumes n bits, n <= 32.
+func (br *bitReader) skip(n uint) {
+	if br.n < n {
+		br.fill()
+	}
+	br.n -= n
+	br.v &= 1<<br.n - 1
+}
+
+// bits reads n bits, n <= 32.
+func (br *bitReader) bits(n uint) uint32 {
+	v := br.peek(n)
+	br.skip(n)
+	return v
+}
+
+// longBits reads n bits, n <= 64.
+func (br *bitReader) longBits(n uint) uint64 {
+	if n <= 32 {
+		return uint64(br.bits(n))
+	}
+	hi := uint64(br.bits(n - 32))
+	return hi<<32 | uint64(br.bits(32))
+}
+
+// align skips the bits up to the next byte boundary.
+func (br *bitReader) align() {
+	br.skip(br.n % 8)
+}
+
+// readByte reads the next byte, the reader being aligned.
+func (br *bitReader) readByte() byte {
+	return byte(br.bits(8))
+}
+
+// offset returns the number of bits consumed.
+func (br *bitReader) offset() int64 {
+	return br.read*8 - int64(br.n)
+}
+
+// Err returns the error of reading the compressed data, if any.
+func (br *bitReader) Err() error {
+	return br.err
+}
+
+// maxCodeLen is the maximum length of the Huffman codes.
+const maxCodeLen = 15
+
+// fastBits is the number of bits looked up at once by the Huffman decoders.
+const fastBits = 9
+
+// huffman decodes a canonical Huffman code: the codes are assigned in the order of their lengths,
+// and of their symbols for the same length.
+type huffman struct {
+	// fast maps the next fastBits bits to the symbol<<4 | length of the codes no longer than
+	// fastBits, or to zero.
+	fast [1 << fastBits]uint16
+	// limit[l] is the first code longer than l bits, left aligned on maxCodeLen bits, and first[l]
+	// the index in symbols of the first code of l bits.
+	limit   [maxCodeLen + 1]uint32
+	first   [maxCodeLen + 1]uint32
+	symbols []uint16
+}
+
+// build makes the code of the code lengths of the symbols, zero for the unused ones. Incomplete
+// codes are valid, until one of their missing codes is read.
+func (h *huffman) build(lengths []byte) error {
+	var count [maxCodeLen + 1]int
+	for _, l := range lengths {
+		count[l]++
+	}
+	count[0] = 0
+	left := 1
+	for l := 1; l <= maxCodeLen; l++ {
+		left = left<<1 - count[l]
+		if left < 0 {
+			return fmt.Errorf("%w: oversubscribed Huffman code", ErrCorrupt)
+		}
+	}
+	var next [maxCodeLen + 2]uint32
+	code, index := uint32(0), uint32(0)
+	for l := 1; l <= maxCodeLen; l++ {
+		h.first[l] = index
+		next[l] = index
+		index += uint32(count[l])
+		code = (code + uint32(count[l])) << 1
+		h.limit[l] = code << (maxCodeLen - l) >> 1
+	}
+	if cap(h.symbols) < int(index) {
+		h.symbols = make([]uint16, index)
+	}
+	h.symbols = h.symbols[:index]
+	for s, l := range lengths {
+		if l != 0 {
+			h.symbols[next[l]] = uint16(s)
+			next[l]++
+		}
+	}
+	h.fast = [1 << fastBits]uint16{}
+	code = 0
+	for l := 1; l <= fastBits; l++ {
+		for i := h.first[l]; i < h.first[l]+uint32(count[l]); i++ {
+			// the codes of l bits are followed by all the values of the next bits
+			start := code << (fastBits - l)
+			for j := start; j < start+1<<(fastBits-l); j++ {
+				h.fast[j] = h.symbols[i]<<4 | uint16(l)
+			}
+			code++
+		}
+		code <<= 1
+	}
+	return nil
+}
+
+// decode reads a symbol, or fails on the missing codes of incomplete codes.
+func (h *huffman) decode(br *bitReader) (int, error) {
+	v := br.peek(maxCodeLen)
+	if e := h.fast[v>>(maxCodeLen-fastBits)]; e != 0 {
+		br.skip(uint(e & 0xf))
+		return int(e >> 4), nil
+	}
+	for l := fastBits + 1; l <= maxCodeLen; l++ {
+		if v < h.limit[l] {
+			br.skip(uint(l))
+			base := h.limit[l-1]
+			return int(h.symbols[h.first[l]+(v-base)>>(maxCodeLen-l)]), nil
+		}
+	}
+	return 0, fmt.Errorf("%w: invalid Huffman code", ErrCorrupt)
+}
+
+const (
+	// minWindow is the minimum size of the windows, which hold the blocks of data waiting for
+	// their filters besides the dictionary.
+	minWindow = 0x40000
+	// maxMatch is an upper bound of the length of the matches of both algorithms, the room the
+	// decoders keep in the window.
+	maxMatch = 0x2000
+	// maxFilters is the maximum number of filters pending on the data.
+	maxFilters = 8192
+)
+
+// window is the sliding dictionary of the LZ decoders, kept across the entries of solid archives.
+// Its buffer grows with the data up to the dictionary size, so the memory of the small entries is
+// not the one they declare.
+type window struct {
+	buf  []byte
+	size int64
+	// pos is the number of bytes decompressed, since the first entry of a solid archive. start is
+	// the position of the first byte of the current entry, and end the one after its last byte, or
+	// -1 if its size is unknown.
+	pos, start, end int64
+	// out is the position of the next byte to return.
+	out int64
+	// filters are the filters pending on the data, by position, and filtered the output of the
+	// last one not returned yet.
+	filters  []filter
+	filtered []byte
+	// chain applies the filters of the same block to the output of the previous one, as the
+	// RAR 2.9 format does.
+	chain bool
+}
+
+// filter transforms a block of the data before it is returned, e.g. the x86 call addresses made
+// relative by the compressor. apply is called with the data of the block and its offset in the
+// entry.
+type filter struct {
+	start, length int64
+	apply         func(b []byte, offset int64) ([]byte, error)
+}
+
+func newWindow(size int64) *window {
+	return &window{size: max(size, minWindow)}
+}
+
+// reset starts an entry of size bytes, or of an unknown size if size is negative. The filters
+// pending on the previous entry are dropped.
+func (w *window) reset(size int64) {
+	w.start, w.out = w.pos, w.pos
+	w.end = -1
+	if size >= 0 {
+		w.end = w.pos + size
+	}
+	w.filters, w.filtered = w.filters[:0], nil
+}
+
+// resize grows the dictionary for an entry of a solid archive declaring a larger one.
+func (w *window) resize(size int64) {
+	if size <= w.size {
+		return
+	}
+	if w.pos > w.size {
+		// the data wrapped around the buffer: move it where the positions are in the new one
+		buf := make([]byte, size)
+		for p := w.pos - w.size; p < w.pos; p++ {
+			buf[p%size] = w.buf[p%w.size]
+		}
+		w.buf = buf
+	}
+	w.size = size
+}
+
+// done reports whether the entry was decompressed up to its size.
+func (w *window) done() bool {
+	return w.end >= 0 && w.pos >= w.end
+}
+
+// full reports whether the window has no room left for a match before the data not returned yet.
+func (w *window) full() bool {
+	return w.pos-w.out > w.size-maxMatch
+}
+
+// grow makes room in the buffer for n more bytes.
+func (w *window) grow(n int64) {
+	if l := int64(len(w.buf)); l < w.size && w.pos+n > l {
+		buf := make([]byte, min(w.size, max(2*l, w.pos+n, 1<<16)))
+		copy(buf, w.buf)
+		w.buf = buf
+	}
+}
+
+func (w *window) putByte(c byte) {
+	w.grow(1)
+	w.buf[w.pos%w.size] = c
+	w.pos++
+}
+
+// copyMatch copies length bytes from dist bytes back.
+func (w *window) copyMatch(dist int64, length int) error {
+	if dist <= 0 || dist > w.pos || dist > w.size {
+		return fmt.Errorf("%w: distance %d out of the dictionary", ErrCorrupt, dist)
+	}
+	w.grow(int64(length))
+	for n := int64(length); n > 0; {
+		src, dst := (w.pos-dist)%w.size, w.pos%w.size
+		// the bytes copied at once neither wrap around nor overlap
+		k := min(n, dist, w.size-src, w.size-dst)
+		copy(w.buf[dst:dst+k], w.buf[src:src+k])
+		w.pos += k
+		n -= k
+	}
+	return nil
+}
+
+// addFilter adds a filter on the data not decompressed yet.
+func (w *window) addFilter(f filter) error {
+	switch {
+	case len(w.filters) >= maxFilters:
+		return fmt.Errorf("%w: too many filters", ErrCorrupt)
+	case f.start < w.pos || len(w.filters) > 0 && f.start < w.filters[len(w.filters)-1].start:
+		return fmt.Errorf("%w: filter out of order", ErrCorrupt)
+	case f.length > w.size-maxMatch:
+		return fmt.Errorf("%w: filter of %d bytes larger than the window", ErrCorrupt, f.length)
+	}
+	w.filters = append(w.filters, f)
+	return nil
+}
+
+// bytes returns a copy of the n bytes at position p.
+func (w *window) bytes(p, n int64) []byte {
+	b := make([]byte, n)
+	for i := int64(0); i < n; {
+		k := copy(b[i:], w.buf[(p+i)%w.size:min(int64(len(w.buf)), w.size)])
+		i += int64(k)
+	}
+	return b
+}
+
+// read reads the data decompressed so far, filtered. It returns 0 when more data is needed.
+func (w *window) read(b []byte) (int, error) {
+	if len(w.filtered) > 0 {
+		n := copy(b, w.filtered)
+		w.filtered = w.filtered[n:]
+		return n, nil
+	}
+	end := w.pos
+	if len(w.filters) > 0 {
+		f := w.filters[0]
+		switch {
+		case f.start < w.out:
+			return 0, fmt.Errorf("%w: overlapping filters", ErrCorrupt)
+		case f.start == w.out:
+			if w.pos < f.start+f.length {
+				return 0, nil
+			}
+			return w.applyFilters(b)
+		}
+		end = min(end, f.start)
+	}
+	if end > w.out {
+		n := copy(b, w.bytes(w.out, min(end-w.out, int64(len(b)))))
+		w.out += int64(n)
+		return n, nil
+	}
+	return 0, nil
+}
+
+// applyFilters filters the block of the first pending filter, and reads its output.
+func (w *window) applyFilters(b []byte) (int, error) {
+	f := w.filters[0]
+	data, err := f.apply(w.bytes(f.start, f.length), f.start-w.start)
+	if err != nil {
+		return 0, err
+	}
+	n := 1
+	for ; w.chain && n < len(w.filters); n++ {
+		g := w.filters[n]
+		if g.start != f.start || g.length != int64(len(data)) {
+			break
+		}
+		if data, err = g.apply(data, f.start-w.start); err != nil {
+			return 0, err
+		}
+	}
+	w.filters = append(w.filters[:0], w.filters[n:]...)
+	w.out = f.start + f.length
+	w.filtered = data
+	return w.read(b)
+}
+
+// readCodeLengths reads the Huffman code of the code lengths of the tables of both algorithms: 20
+// lengths of 4 bits, 15 being followed by the number of zero lengths.
+func readCodeLengths(br *bitReader, h *huffman) error {
+	var lengths [20]byte
+	for i := 0; i < len(lengths); i++ {
+		l := byte(br.bits(4))
+		if l == 15 {
+			if n := int(br.bits(4)); n != 0 {
+				i += min(n+2, len(lengths)-i) - 1
+				continue
+			}
+		}
+		lengths[i] = l
+	}
+	return h.build(lengths[:])
+}
+
+// readLengths reads the code lengths of the tables, encoded with the code of the code lengths.
+// With delta, the lengths are added to the previous lengths (RAR 2.9).
+func readLengths(br *bitReader, h *huffman, lengths []byte, delta bool) error {
+	for i := 0; i < len(lengths); {
+		c, err := h.decode(br)
+		if err != nil {
+			return err
+		}
+		switch {
+		case c < 16:
+			if delta {
+				c = (c + int(lengths[i])) & 0xf
+			}
+			lengths[i] = byte(c)
+			i++
+		case c < 18 && i == 0:
+			return fmt.Errorf("%w: repeated length without a previous one", ErrCorrupt)
+		default:
+			var n int
+			if c%2 == 0 {
+				n = int(br.bits(3)) + 3
+			} else {
+				n = int(br.bits(7)) + 11
+			}
+			var l byte
+			if c < 18 {
+				l = lengths[i-1]
+			}
+			for ; n > 0 && i < len(lengths); n-- {
+				lengths[i] = l
+				i++
+			}
+		}
+	}
+	return br.Err()
+}
+
+// decoder decompresses the entries of one of the algorithms of RAR.
+type decoder interface {
+	io.Reader
+	// reset starts the entry of size bytes, or of an unknown size if size is negative, whose
+	// compressed data is read from r. The entries of solid archives keep the state of the
+	// previous ones.
+	reset(r io.ByteReader, size int64, solid bool)
+	// resize grows the dictionary for an entry of a solid archive.
+	resize(size int64)
+}
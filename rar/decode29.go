@@ -0,0 +1,715 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rar
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// The sizes of the Huffman codes of the RAR 2.9 format: the literals and lengths, the distances,
+// the low bits of the distances and the lengths of the repeated distances.
+const (
+	nc29  = 299
+	dc29  = 60
+	ldc29 = 17
+	rc29  = 28
+)
+
+// The bases and numbers of bits of the lengths and of the distances of the RAR 2.9 format.
+var (
+	lengthBase29 = [28]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 10, 12, 14, 16, 20, 24, 28, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224}
+	lengthBits29 = [28]uint{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5}
+
+	shortBase29 = [8]int64{0, 4, 8, 16, 32, 64, 128, 192}
+	shortBits29 = [8]uint{2, 2, 3, 4, 5, 6, 6, 6}
+
+	distBase29 [dc29]int64
+	distBits29 [dc29]uint
+)
+
+func init() {
+	// the number of distance slots of each number of bits
+	counts := []int{4, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 14, 0, 12}
+	var dist int64
+	slot := 0
+	for bits, n := range counts {
+		for ; n > 0; n-- {
+			distBase29[slot], distBits29[slot] = dist, uint(bits)
+			dist += 1 << bits
+			slot++
+		}
+	}
+}
+
+// decoder29 decompresses the entries of the RAR 2.9 format (the default one of RAR 2.9 to 4.x),
+// whose blocks are compressed by LZ or by PPMd, and filtered by the programs of the RAR virtual
+// machine. The standard filters of RAR are recognized by the checksum of their program, and run
+// natively: the other programs are refused.
+type decoder29 struct {
+	*window
+	br *bitReader
+	// maxMemory limits the memory of the PPMd models, or is -1 for no limit.
+	maxMemory int64
+
+	// tables is set once the Huffman codes were read, which the entries of solid archives
+	// inherit along with the lengths of the last codes, the base of the next ones.
+	tables                   bool
+	lengths                  [nc29 + dc29 + ldc29 + rc29]byte
+	main, dist, lowDist, rep huffman
+	oldDist                  [4]int64
+	lastLength               int
+	lowDistRep, prevLowDist  int
+
+	// ppm is set in the blocks compressed by PPMd, whose escape character escapes the LZ commands.
+	ppm    bool
+	model  *ppmModel
+	escape byte
+
+	// programs are the filters of the stream, and lengths of their blocks, referred to by the
+	// filters following, and last the index of the last one.
+	programs []*program29
+	last     int
+
+	eof bool
+	err error
+}
+
+// program29 is a filter program of the RAR 2.9 format.
+type program29 struct {
+	run    func(b []byte, r *[7]uint32, offset int64) ([]byte, error)
+	length uint32
+}
+
+func newDecoder29(dictionary, maxMemory int64) *decoder29 {
+	d := &decoder29{window: newWindow(dictionary), maxMemory: maxMemory}
+	d.window.chain = true
+	return d
+}
+
+func (d *decoder29) reset(r io.ByteReader, size int64, solid bool) {
+	d.window.reset(size)
+	d.br = newBitReader(r)
+	if !solid {
+		d.tables, d.ppm, d.escape = false, false, 2
+		d.lengths = [len(d.lengths)]byte{}
+		d.oldDist = [4]int64{}
+		d.lastLength = 0
+		d.programs, d.last = nil, 0
+	}
+	d.eof, d.err = false, nil
+	if d.ppm {
+		d.model.br = d.br
+	}
+	// the tables are set by the LZ blocks only: the entries following a PPMd block read the
+	// parameters of the model again, if not its memory
+	if !d.tables {
+		d.err = d.readTables()
+	}
+}
+
+func (d *decoder29) Read(b []byte) (int, error) {
+	for {
+		n, err := d.read(b)
+		if n > 0 || err != nil {
+			return n, err
+		}
+		switch {
+		case d.err != nil:
+			return 0, d.err
+		case d.eof || d.done():
+			return 0, io.EOF
+		case d.full():
+			return 0, fmt.Errorf("%w: filter larger than the window", ErrCorrupt)
+		}
+		d.err = d.decode()
+	}
+}
+
+// readTables reads the header of a block: the PPMd parameters, or the Huffman codes.
+func (d *decoder29) readTables() error {
+	br := d.br
+	br.align()
+	if br.peek(1) == 1 {
+		d.ppm = true
+		if d.model == nil {
+			d.model = &ppmModel{}
+		}
+		return d.model.init(br, &d.escape, d.maxMemory)
+	}
+	d.ppm = false
+	d.prevLowDist, d.lowDistRep = 0, 0
+	if br.bits(2)&1 == 0 {
+		d.lengths = [len(d.lengths)]byte{}
+	}
+	var bc huffman
+	if err := readCodeLengths(br, &bc); err != nil {
+		return err
+	}
+	if err := readLengths(br, &bc, d.lengths[:], true); err != nil {
+		return err
+	}
+	l := d.lengths[:]
+	for _, t := range []struct {
+		h *huffman
+		n int
+	}{{&d.main, nc29}, {&d.dist, dc29}, {&d.lowDist, ldc29}, {&d.rep, rc29}} {
+		if err := t.h.build(l[:t.n]); err != nil {
+			return err
+		}
+		l = l[t.n:]
+	}
+	d.tables = true
+	return nil
+}
+
+// decode decompresses the data of the entry until the window is full, or for a while.
+func (d *decoder29) decode() error {
+	for limit := d.pos + 1<<16; d.pos < limit && !d.full() && !d.done() && !d.eof; {
+		var err error
+		if d.ppm {
+			err = d.decodePPM()
+		} else {
+			err = d.decodeLZ()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if d.done() && !d.eof {
+		if err := d.endOfEntry(); err != nil {
+			return err
+		}
+	}
+	return d.br.Err()
+}
+
+// endOfEntry reads the end marker following the data of the entry, which tells whether the next
+// entry of a solid archive reads new tables. Other symbols are ignored: the data of an entry need
+// not end with a marker.
+func (d *decoder29) endOfEntry() error {
+	if !d.ppm {
+		if c, err := d.main.decode(d.br); err != nil || c != 256 {
+			return nil
+		}
+		return d.endOfBlock()
+	}
+	m := d.model
+	if c, err := m.decodeChar(); err != nil || c != d.escape {
+		return nil
+	}
+	switch c, err := m.decodeChar(); {
+	case err != nil:
+	case c == 0:
+		return d.readTables()
+	case c == 2:
+		d.eof = true
+	}
+	return nil
+}
+
+// decodeLZ decodes a symbol of an LZ block.
+func (d *decoder29) decodeLZ() error {
+	br := d.br
+	c, err := d.main.decode(br)
+	if err != nil {
+		return err
+	}
+	switch {
+	case c < 256:
+		d.putByte(byte(c))
+		return nil
+	case c >= 271:
+		c -= 271
+		length := lengthBase29[c] + 3 + int(br.bits(lengthBits29[c]))
+		dist, err := d.distance()
+		if err != nil {
+			return err
+		}
+		if dist >= 0x2000 {
+			length++
+			if dist >= 0x40000 {
+				length++
+			}
+		}
+		return d.match(dist, length)
+	case c == 256:
+		return d.endOfBlock()
+	case c == 257:
+		return d.readFilter(func() (byte, error) { return byte(br.bits(8)), nil })
+	case c == 258:
+		if d.lastLength == 0 {
+			return nil
+		}
+		return d.copyMatch(d.oldDist[0], d.lastLength)
+	case c < 263:
+		i := c - 259
+		dist := d.oldDist[i]
+		copy(d.oldDist[1:i+1], d.oldDist[:i])
+		d.oldDist[0] = dist
+		s, err := d.rep.decode(br)
+		if err != nil {
+			return err
+		}
+		d.lastLength = lengthBase29[s] + 2 + int(br.bits(lengthBits29[s]))
+		return d.copyMatch(dist, d.lastLength)
+	}
+	c -= 263
+	return d.match(shortBase29[c]+1+int64(br.bits(shortBits29[c])), 2)
+}
+
+// match copies a match of a new distance.
+func (d *decoder29) match(dist int64, length int) error {
+	copy(d.oldDist[1:], d.oldDist[:3])
+	d.oldDist[0] = dist
+	d.lastLength = length
+	return d.copyMatch(dist, length)
+}
+
+// distance reads the distance of a match.
+func (d *decoder29) distance() (int64, error) {
+	br := d.br
+	s, err := d.dist.decode(br)
+	if err != nil {
+		return 0, err
+	}
+	dist, n := distBase29[s]+1, distBits29[s]
+	if s <= 9 {
+		return dist + int64(br.bits(n)), nil
+	}
+	if n > 4 {
+		dist += int64(br.bits(n-4)) << 4
+	}
+	if d.lowDistRep > 0 {
+		d.lowDistRep--
+		return dist + int64(d.prevLowDist), nil
+	}
+	low, err := d.lowDist.decode(br)
+	if err != nil {
+		return 0, err
+	}
+	if low == 16 {
+		// the previous low bits, for the next 16 distances
+		d.lowDistRep = 15
+		return dist + int64(d.prevLowDist), nil
+	}
+	d.prevLowDist = low
+	return dist + int64(low), nil
+}
+
+// endOfBlock reads the end of an LZ block: the end of the entry, or new Huffman codes.
+func (d *decoder29) endOfBlock() error {
+	br := d.br
+	newTables := true
+	if br.bits(1) == 0 {
+		// the end of the entry, and whether the next entry reads new codes
+		newTables = br.bits(1) == 1
+		d.eof = true
+	}
+	d.tables = !newTables
+	if d.eof {
+		return nil
+	}
+	return d.readTables()
+}
+
+// decodePPM decodes a symbol of a PPMd block.
+func (d *decoder29) decodePPM() error {
+	m := d.model
+	c, err := m.decodeChar()
+	if err != nil {
+		return err
+	}
+	if c != d.escape {
+		d.putByte(c)
+		return nil
+	}
+	if c, err = m.decodeChar(); err != nil {
+		return err
+	}
+	switch c {
+	case 0:
+		// a new block
+		return d.readTables()
+	case 2:
+		d.eof = true
+		return nil
+	case 3:
+		return d.readFilter(m.decodeChar)
+	case 4:
+		var b [4]byte
+		for i := range b {
+			if b[i], err = m.decodeChar(); err != nil {
+				return err
+			}
+		}
+		dist := int64(b[0])<<16 | int64(b[1])<<8 | int64(b[2])
+		return d.copyMatch(dist+2, int(b[3])+32)
+	case 5:
+		if c, err = m.decodeChar(); err != nil {
+			return err
+		}
+		return d.copyMatch(1, int(c)+4)
+	}
+	// the escape character itself
+	d.putByte(d.escape)
+	return nil
+}
+
+// The standard filters of the RAR 2.9 format, recognized by the length and the CRC32 of their
+// program.
+var standardFilters29 = []struct {
+	length int
+	crc    uint32
+	run    func(b []byte, r *[7]uint32, offset int64) ([]byte, error)
+}{
+	{53, 0xad576887, func(b []byte, _ *[7]uint32, offset int64) ([]byte, error) {
+		return e8(b, uint32(offset), false, false), nil
+	}},
+	{57, 0x3cd7e57e, func(b []byte, _ *[7]uint32, offset int64) ([]byte, error) {
+		return e8(b, uint32(offset), true, false), nil
+	}},
+	{120, 0x3769893f, func(b []byte, _ *[7]uint32, offset int64) ([]byte, error) {
+		return itanium(b, uint32(offset)), nil
+	}},
+	{29, 0x0e06077d, func(b []byte, r *[7]uint32, _ int64) ([]byte, error) {
+		if r[0] == 0 || r[0] > maxChannels29 || len(b) > maxFilter29/2 {
+			return nil, fmt.Errorf("%w: delta filter of %d channels", ErrCorrupt, r[0])
+		}
+		return delta(b, int(r[0])), nil
+	}},
+	{149, 0x1c2c5dc8, func(b []byte, r *[7]uint32, _ int64) ([]byte, error) {
+		if len(b) > maxFilter29/2 {
+			return nil, fmt.Errorf("%w: RGB filter of %d bytes", ErrCorrupt, len(b))
+		}
+		return rgb(b, r[0], r[1])
+	}},
+	{216, 0xbc85e701, func(b []byte, r *[7]uint32, _ int64) ([]byte, error) {
+		if r[0] == 0 || r[0] > 128 || len(b) > maxFilter29/2 {
+			return nil, fmt.Errorf("%w: audio filter of %d channels", ErrCorrupt, r[0])
+		}
+		return audio(b, int(r[0])), nil
+	}},
+}
+
+const (
+	// maxPrograms29 is the maximum number of filter programs of a stream.
+	maxPrograms29 = 1024
+	// maxFilter29 is the size of the memory of the virtual machine, the maximum size of the
+	// filtered blocks.
+	maxFilter29 = 0x40000
+	// maxChannels29 is the maximum number of channels of the delta filter.
+	maxChannels29 = 1024
+)
+
+// readFilter reads a filter, whose bytes are read by next from the LZ or PPMd data.
+func (d *decoder29) readFilter(next func() (byte, error)) error {
+	flags, err := next()
+	if err != nil {
+		return err
+	}
+	n := int(flags&7) + 1
+	switch n {
+	case 7:
+		c, err := next()
+		if err != nil {
+			return err
+		}
+		n = int(c) + 7
+	case 8:
+		var b [2]byte
+		for i := range b {
+			if b[i], err = next(); err != nil {
+				return err
+			}
+		}
+		n = int(b[0])<<8 | int(b[1])
+	}
+	if n == 0 {
+		return fmt.Errorf("%w: empty filter", ErrCorrupt)
+	}
+	code := make([]byte, n)
+	for i := range code {
+		if code[i], err = next(); err != nil {
+			return err
+		}
+	}
+	if err := d.br.Err(); err != nil {
+		return err
+	}
+	return d.addFilter29(flags, code)
+}
+
+// addFilter29 adds the filter read from code.
+func (d *decoder29) addFilter29(flags byte, code []byte) error {
+	br := newBitReader(&byteReader{b: code})
+	i := d.last
+	if flags&0x80 != 0 {
+		i = int(vmNumber(br))
+		if i == 0 {
+			// a new set of programs, dropping the pending filters
+			d.programs = d.programs[:0]
+			d.filters = d.filters[:0]
+		} else {
+			i--
+		}
+	}
+	if i > len(d.programs) || i >= maxPrograms29 {
+		return fmt.Errorf("%w: bad filter program %d", ErrCorrupt, i)
+	}
+	d.last = i
+	newProgram := i == len(d.programs)
+	if newProgram {
+		d.programs = append(d.programs, &program29{})
+	}
+	p := d.programs[i]
+	start := int64(vmNumber(br))
+	if flags&0x40 != 0 {
+		start += 258
+	}
+	if flags&0x20 != 0 {
+		p.length = vmNumber(br)
+	}
+	length := p.length
+	var r [7]uint32
+	r[4] = length
+	if flags&0x10 != 0 {
+		mask := br.bits(7)
+		for j := uint(0); j < 7; j++ {
+			if mask&(1<<j) != 0 {
+				r[j] = vmNumber(br)
+			}
+		}
+	}
+	if newProgram {
+		n := vmNumber(br)
+		if n == 0 || n >= 0x10000 || int64(n) > int64(len(code))-br.offset()/8 {
+			return fmt.Errorf("%w: bad filter program size", ErrCorrupt)
+		}
+		prg := make([]byte, n)
+		for j := range prg {
+			prg[j] = byte(br.bits(8))
+		}
+		if p.run = standardFilter29(prg); p.run == nil {
+			return fmt.Errorf("%w: filter program of the RAR virtual machine", ErrAlgorithm)
+		}
+	}
+	if err := br.Err(); err != nil {
+		return fmt.Errorf("%w: truncated filter", ErrCorrupt)
+	}
+	if p.run == nil {
+		return fmt.Errorf("%w: filter without a program", ErrCorrupt)
+	}
+	if length > maxFilter29 {
+		return fmt.Errorf("%w: filter of %d bytes", ErrCorrupt, length)
+	}
+	run := p.run
+	return d.addFilter(filter{start: d.pos + start, length: int64(length), apply: func(b []byte, offset int64) ([]byte, error) {
+		return run(b, &r, offset)
+	}})
+}
+
+// standardFilter29 returns the function running the program of a standard filter, or nil.
+func standardFilter29(prg []byte) func(b []byte, r *[7]uint32, offset int64) ([]byte, error) {
+	// the first byte of the programs is the XOR of the others
+	var sum byte
+	for _, c := range prg[1:] {
+		sum ^= c
+	}
+	if sum != prg[0] {
+		return nil
+	}
+	crc := crc32.ChecksumIEEE(prg)
+	for _, f := range standardFilters29 {
+		if f.length == len(prg) && f.crc == crc {
+			return f.run
+		}
+	}
+	return nil
+}
+
+// vmNumber reads a number of the filters of the RAR 2.9 format.
+func vmNumber(br *bitReader) uint32 {
+	switch br.bits(2) {
+	case 0:
+		return br.bits(4)
+	case 1:
+		v := br.bits(8)
+		if v >= 16 {
+			return v
+		}
+		// a negative number of 8 bits
+		return 0xffffff00 | v<<4 | br.bits(4)
+	case 2:
+		return br.bits(16)
+	}
+	return br.bits(32)
+}
+
+// byteReader reads the bytes of a slice.
+type byteReader struct {
+	b []byte
+}
+
+func (r *byteReader) ReadByte() (byte, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	c := r.b[0]
+	r.b = r.b[1:]
+	return c, nil
+}
+
+// itanium restores the addresses of the branches of the IA-64 bundles.
+func itanium(b []byte, offset uint32) []byte {
+	masks := [16]byte{4, 4, 6, 6, 0, 0, 7, 7, 4, 4, 0, 0, 4, 4, 0, 0}
+	offset >>= 4
+	for i := 0; i+21 < len(b); i += 16 {
+		if t := int(b[i]&0x1f) - 0x10; t >= 0 {
+			for j := uint(0); j <= 2; j++ {
+				if masks[t]&(1<<j) == 0 {
+					continue
+				}
+				pos := j*41 + 5
+				if bundleBits(b[i:], pos+37, 4) == 5 {
+					addr := bundleBits(b[i:], pos+13, 20)
+					setBundleBits(b[i:], (addr-offset)&0xfffff, pos+13, 20)
+				}
+			}
+		}
+		offset++
+	}
+	return b
+}
+
+// bundleBits returns the n bits at the bit position pos of b.
+func bundleBits(b []byte, pos, n uint) uint32 {
+	v := binary.LittleEndian.Uint32(b[pos/8:])
+	return v >> (pos % 8) & (0xffffffff >> (32 - n))
+}
+
+// setBundleBits sets the n bits at the bit position pos of b to v.
+func setBundleBits(b []byte, v uint32, pos, n uint) {
+	mask := uint32(0xffffffff) >> (32 - n) << (pos % 8)
+	w := binary.LittleEndian.Uint32(b[pos/8:])
+	binary.LittleEndian.PutUint32(b[pos/8:], w&^mask|v<<(pos%8)&mask)
+}
+
+// rgb decodes the 24-bit pixels of b, of width-3 bytes per line, predicted from their left and
+// upper neighbors.
+func rgb(b []byte, width, posR uint32) ([]byte, error) {
+	n := uint32(len(b))
+	if n < 3 || width < 3 || width-3 > n || posR > 2 {
+		return nil, fmt.Errorf("%w: bad RGB filter", ErrCorrupt)
+	}
+	width -= 3
+	out := make([]byte, n)
+	src := 0
+	for c := uint32(0); c < 3; c++ {
+		var prev uint32
+		for i := c; i < n; i += 3 {
+			predicted := prev
+			if i >= width+3 {
+				upper, upperLeft := uint32(out[i-width]), uint32(out[i-width-3])
+				predicted = prev + upper - upperLeft
+				pa, pb, pc := absDiff(predicted, prev), absDiff(predicted, upper), absDiff(predicted, upperLeft)
+				switch {
+				case pa <= pb && pa <= pc:
+					predicted = prev
+				case pb <= pc:
+					predicted = upper
+				default:
+					predicted = upperLeft
+				}
+			}
+			prev = uint32(byte(predicted - uint32(b[src])))
+			out[i] = byte(prev)
+			src++
+		}
+	}
+	for i := posR; i+2 < n; i += 3 {
+		g := out[i+1]
+		out[i] += g
+		out[i+2] += g
+	}
+	return out, nil
+}
+
+func absDiff(a, b uint32) uint32 {
+	if d := int32(a - b); d < 0 {
+		return uint32(-d)
+	}
+	return a - b
+}
+
+// audio decodes the samples of b, interleaved from channels channels, predicted by an adaptive
+// linear filter.
+func audio(b []byte, channels int) []byte {
+	out := make([]byte, len(b))
+	src := 0
+	for c := 0; c < channels; c++ {
+		var prev, prevDelta uint32
+		var dif [7]uint32
+		var d1, d2, d3, k1, k2, k3 int32
+		for i, count := c, 0; i < len(out); i, count = i+channels, count+1 {
+			d3 = d2
+			d2 = int32(prevDelta) - d1
+			d1 = int32(prevDelta)
+			predicted := 8*prev + uint32(k1*d1+k2*d2+k3*d3)
+			predicted = predicted >> 3 & 0xff
+			cur := uint32(b[src])
+			src++
+			predicted -= cur
+			out[i] = byte(predicted)
+			prevDelta = uint32(int32(int8(predicted - prev)))
+			prev = uint32(byte(predicted))
+			d := int32(int8(cur)) * 8
+			for j, v := range []int32{d, d - d1, d + d1, d - d2, d + d2, d - d3, d + d3} {
+				if v < 0 {
+					v = -v
+				}
+				dif[j] += uint32(v)
+			}
+			if count&0x1f != 0 {
+				continue
+			}
+			minDif, k := dif[0], 0
+			dif[0] = 0
+			for j := 1; j < len(dif); j++ {
+				if dif[j] < minDif {
+					minDif, k = dif[j], j
+				}
+				dif[j] = 0
+			}
+			switch {
+			case k == 1 && k1 >= -16:
+				k1--
+			case k == 2 && k1 < 16:
+				k1++
+			case k == 3 && k2 >= -16:
+				k2--
+			case k == 4 && k2 < 16:
+				k2++
+			case k == 5 && k3 >= -16:
+				k3--
+			case k == 6 && k3 < 16:
+				k3++
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,508 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rar
+
+import (
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"io"
+	"testing"
+)
+
+// encoder29 compresses the entries of the RAR 2.9 format with LZ.
+type encoder29 struct {
+	matcher
+	oldDist    [4]int64
+	lastLength int
+	// lengths are the code lengths of the previous block, nil before the first one.
+	lengths []byte
+	// blockItems is the number of tokens of the blocks. Zero means one block.
+	blockItems int
+	// programs are the indexes of the programs of the filters sent, by index of the standard
+	// filters.
+	programs map[int]int
+}
+
+// op29 is a token of an LZ block, whose low distance bits low, if not -1, follow its items.
+type op29 struct {
+	items []item
+	low   int
+}
+
+// slot returns the slot of v among the slots of the bases and bits, and the extra bits.
+func slot[T int | int64](v T, base []T, nbits []uint) (int, item) {
+	for s := len(base) - 1; ; s-- {
+		if base[s] <= v {
+			return s, raw(uint64(v-base[s]), nbits[s])
+		}
+	}
+}
+
+func adjust29(dist int64) int {
+	switch {
+	case dist >= 0x40000:
+		return 2
+	case dist >= 0x2000:
+		return 1
+	}
+	return 0
+}
+
+func (e *encoder29) token(t token) op29 {
+	switch {
+	case t.length == 0:
+		return op29{items: []item{{code: 0, v: uint64(t.c)}}, low: -1}
+	case t.dist == e.oldDist[0] && t.length == e.lastLength:
+		return op29{items: []item{{code: 0, v: 258}}, low: -1}
+	}
+	for i, d := range e.oldDist {
+		if d == t.dist {
+			copy(e.oldDist[1:i+1], e.oldDist[:i])
+			e.oldDist[0] = d
+			e.lastLength = t.length
+			s, extra := slot(t.length-2, lengthBase29[:], lengthBits29[:])
+			return op29{items: []item{{code: 0, v: uint64(259 + i)}, {code: 3, v: uint64(s)}, extra}, low: -1}
+		}
+	}
+	copy(e.oldDist[1:], e.oldDist[:3])
+	e.oldDist[0] = t.dist
+	e.lastLength = t.length
+	if t.length == 2 {
+		s, extra := slot(t.dist-1, shortBase29[:], shortBits29[:])
+		return op29{items: []item{{code: 0, v: uint64(263 + s)}, extra}, low: -1}
+	}
+	s, extra := slot(t.length-adjust29(t.dist)-3, lengthBase29[:], lengthBits29[:])
+	op := op29{items: []item{{code: 0, v: uint64(271 + s)}, extra}, low: -1}
+	ds, dextra := slot(t.dist-1, distBase29[:], distBits29[:])
+	op.items = append(op.items, item{code: 1, v: uint64(ds)})
+	if ds <= 9 {
+		op.items = append(op.items, dextra)
+		return op
+	}
+	if dextra.n > 4 {
+		op.items = append(op.items, raw(dextra.v>>4, dextra.n-4))
+	}
+	op.low = int(dextra.v & 15)
+	return op
+}
+
+// vmNumbers writes the numbers of a filter.
+func vmNumbers(w *bitWriter, vs ...uint32) {
+	for _, v := range vs {
+		switch {
+		case v < 16:
+			w.bits(0, 2)
+			w.bits(uint64(v), 4)
+		case v < 256:
+			w.bits(1, 2)
+			w.bits(uint64(v), 8)
+		case v < 0x10000:
+			w.bits(2, 2)
+			w.bits(uint64(v), 16)
+		default:
+			w.bits(3, 2)
+			w.bits(uint64(v), 32)
+		}
+	}
+}
+
+// filter returns the record of the filter f, of a program of fakePrograms.
+func (e *encoder29) filter(f testFilter, start int) []byte {
+	if e.programs == nil {
+		e.programs = map[int]int{}
+	}
+	var w bitWriter
+	i, ok := e.programs[f.typ]
+	switch {
+	case !ok && len(e.programs) == 0:
+		// a new set of programs
+		vmNumbers(&w, 0)
+	case !ok:
+		vmNumbers(&w, uint32(len(e.programs)+1))
+	default:
+		vmNumbers(&w, uint32(i+1))
+	}
+	flags := byte(0x80 | 0x20 | 0x10)
+	vmNumbers(&w, uint32(start), uint32(f.length))
+	var mask uint64
+	var r []uint32
+	for j, v := range f.r {
+		if v != 0 {
+			mask |= 1 << j
+			r = append(r, v)
+		}
+	}
+	w.bits(mask, 7)
+	vmNumbers(&w, r...)
+	if !ok {
+		e.programs[f.typ] = len(e.programs)
+		prg := fakeProgram(f.typ)
+		vmNumbers(&w, uint32(len(prg)))
+		for _, c := range prg {
+			w.bits(uint64(c), 8)
+		}
+	}
+	code := w.buf
+	switch n := len(code); {
+	case n <= 6:
+		return append([]byte{flags | byte(n-1)}, code...)
+	case n < 7+256:
+		return append([]byte{flags | 6, byte(n - 7)}, code...)
+	default:
+		return append([]byte{flags | 7, byte(n >> 8), byte(n)}, code...)
+	}
+}
+
+// fakeProgram returns the made-up program of the standard filter i of fakePrograms.
+func fakeProgram(i int) []byte {
+	prg := []byte{0, byte(i), 'f', 'i', 'l', 't', 'e', 'r'}
+	for _, c := range prg[1:] {
+		prg[0] ^= c
+	}
+	return prg
+}
+
+// fakePrograms replaces the programs of the standard filters of RAR 2.9, which the tests do not
+// have, by made-up ones.
+func fakePrograms(t *testing.T) {
+	saved := standardFilters29
+	t.Cleanup(func() { standardFilters29 = saved })
+	standardFilters29 = append(saved[:0:0], saved...)
+	for i := range standardFilters29 {
+		prg := fakeProgram(i)
+		standardFilters29[i].length, standardFilters29[i].crc = len(prg), crc32.ChecksumIEEE(prg)
+	}
+}
+
+// compress returns the compressed data of the entry, the data being the output of the LZ
+// decompression before the filters.
+func (e *encoder29) compress(data []byte, filters ...testFilter) []byte {
+	var ops []op29
+	minLength := func(dist int64) int {
+		if dist <= 256 {
+			return 2
+		}
+		return 3 + adjust29(dist)
+	}
+	tokens := func(b []byte) {
+		for _, t := range e.tokens(b, 257, minLength) {
+			ops = append(ops, e.token(t))
+		}
+	}
+	pos := 0
+	for _, f := range filters {
+		tokens(data[pos:f.start])
+		pos = f.start
+		op := op29{items: []item{{code: 0, v: 257}}, low: -1}
+		for _, c := range e.filter(f, 0) {
+			op.items = append(op.items, raw(uint64(c), 8))
+		}
+		ops = append(ops, op)
+	}
+	tokens(data[pos:])
+
+	n := e.blockItems
+	if n == 0 {
+		n = len(ops)
+	}
+	var w bitWriter
+	for i := 0; i == 0 || i*n < len(ops); i++ {
+		block := ops[i*n : min(i*n+n, len(ops))]
+		items := lowDistances(block)
+		// the end of the block: new tables, or the end of the entry
+		items = append(items, item{code: 0, v: 256})
+		if (i+1)*n < len(ops) {
+			items = append(items, raw(1, 1))
+		} else {
+			items = append(items, raw(1, 2))
+		}
+		lengths := codeLengths(items, nc29, dc29, ldc29, rc29)
+		flat := bytes.Join(lengths, nil)
+		w.align()
+		w.bits(0, 1)
+		if e.lengths != nil {
+			// the lengths are the differences from the previous ones
+			w.bits(1, 1)
+		} else {
+			w.bits(0, 1)
+		}
+		writeLengths(&w, flat, e.lengths)
+		writeItems(&w, lengths, items)
+		e.lengths = flat
+	}
+	return w.buf
+}
+
+// lowDistances returns the items of the ops of a block, coding the low bits of the distances
+// shared by 16 distances in a row with one symbol.
+func lowDistances(ops []op29) []item {
+	var items []item
+	prev, rep := 0, 0
+	for i, op := range ops {
+		items = append(items, op.items...)
+		switch {
+		case op.low < 0:
+		case rep > 0:
+			rep--
+		case op.low == prev && sameLow(ops[i+1:], prev, 15):
+			items = append(items, item{code: 2, v: 16})
+			rep = 15
+		default:
+			items = append(items, item{code: 2, v: uint64(op.low)})
+			prev = op.low
+		}
+	}
+	return items
+}
+
+// sameLow reports whether the next n low distance bits of the ops are low.
+func sameLow(ops []op29, low, n int) bool {
+	for _, op := range ops {
+		if n == 0 {
+			break
+		}
+		if op.low >= 0 {
+			if op.low != low {
+				return false
+			}
+			n--
+		}
+	}
+	return n == 0
+}
+
+func TestDecompress29(t *testing.T) {
+	fakePrograms(t)
+	text := testData(1, 200<<10)
+	far := append(append(testData(2, 1000), testData(3, 0x50000)...), testData(2, 1000)...)
+	// distances of the same low bits
+	periodic := bytes.Repeat(testData(6, 4099), 40)
+	for i := 0; i < len(periodic); i += 61 {
+		periodic[i] = byte(i)
+	}
+
+	x86 := testData(4, 4096)
+	for i := 0; i+5 < len(x86); i += 97 {
+		x86[i] = 0xe8 + byte(i%2)
+	}
+	ia64 := testData(7, 4096)
+	for i := 0; i+16 <= len(ia64); i += 16 {
+		ia64[i] = ia64[i]&0xe0 | 0x10 | byte(i/16%16)
+	}
+	pixels := make([]byte, 3*40*30)
+	for i := range pixels {
+		pixels[i] = byte(i%120/3*4 + i/120*2 + i%3*60)
+	}
+	samples := make([]byte, 8000)
+	for i := range samples {
+		samples[i] = byte(100 + 50*((i/2)%40-20)/20 + i%2*30)
+	}
+
+	tests := []struct {
+		name       string
+		data       []byte
+		filters    []testFilter
+		blockItems int
+		dictionary uint64
+	}{
+		{name: "text", data: text},
+		{name: "blocks", data: text, blockItems: 1000},
+		{name: "far", data: far, dictionary: 4},
+		{name: "periodic", data: periodic},
+		{name: "E8", data: x86, filters: []testFilter{{start: 100, length: 3000, typ: 0}}},
+		{name: "E8E9", data: x86, filters: []testFilter{{start: 0, length: 4096, typ: 1}}},
+		{name: "itanium", data: ia64, filters: []testFilter{{start: 32, length: 4000, typ: 2}}},
+		{name: "delta", data: pixels, filters: []testFilter{{start: 0, length: 1800, typ: 3, r: [7]uint32{3}}, {start: 1800, length: 1800, typ: 3, r: [7]uint32{3}}}},
+		{name: "RGB", data: pixels, filters: []testFilter{{start: 0, length: len(pixels), typ: 4, r: [7]uint32{120 + 3, 1}}}},
+		{name: "audio", data: samples, filters: []testFilter{{start: 0, length: len(samples), typ: 5, r: [7]uint32{2}}}},
+		{name: "chained", data: x86, filters: []testFilter{{start: 0, length: 4096, typ: 0}, {start: 0, length: 4096, typ: 3, r: [7]uint32{4}}}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			e := &encoder29{blockItems: tc.blockItems}
+			packed := e.compress(filter29(tc.data, tc.filters), tc.filters...)
+			archive := rar4(entry{name: "a", data: string(tc.data), method: 3, packed: packed, dictionary: tc.dictionary})
+			data, errs := readAll(t, archive, nil)
+			if errs[0] != nil {
+				t.Fatalf("Read() error = %v", errs[0])
+			}
+			if !bytes.Equal(data[0], tc.data) {
+				t.Errorf("Read() = %d bytes differing from the %d bytes of the entry", len(data[0]), len(tc.data))
+			}
+		})
+	}
+}
+
+// filter29 returns the data before the standard filters of RAR 2.9, the filters of the same
+// start applying to the output of the previous one.
+func filter29(data []byte, filters []testFilter) []byte {
+	data = bytes.Clone(data)
+	for i := len(filters) - 1; i >= 0; i-- {
+		f := filters[i]
+		b := data[f.start : f.start+f.length]
+		switch f.typ {
+		case 0, 1:
+			unE8(b, uint32(f.start), f.typ == 1, false)
+		case 2:
+			offset := uint32(f.start) >> 4
+			masks := [16]byte{4, 4, 6, 6, 0, 0, 7, 7, 4, 4, 0, 0, 4, 4, 0, 0}
+			for i := 0; i+21 < len(b); i += 16 {
+				if t := int(b[i]&0x1f) - 0x10; t >= 0 {
+					for j := uint(0); j <= 2; j++ {
+						if pos := j*41 + 5; masks[t]&(1<<j) != 0 && bundleBits(b[i:], pos+37, 4) == 5 {
+							setBundleBits(b[i:], (bundleBits(b[i:], pos+13, 20)+offset)&0xfffff, pos+13, 20)
+						}
+					}
+				}
+				offset++
+			}
+		case 3:
+			copy(b, unDelta(b, int(f.r[0])))
+		case 4:
+			copy(b, unRGB(b, int(f.r[0])-3, int(f.r[1])))
+		case 5:
+			copy(b, unAudio(b, int(f.r[0])))
+		}
+	}
+	return data
+}
+
+// unRGB returns the differences of the pixels of b from their predictions.
+func unRGB(b []byte, width, posR int) []byte {
+	b = bytes.Clone(b)
+	for i := posR; i+2 < len(b); i += 3 {
+		b[i] -= b[i+1]
+		b[i+2] -= b[i+1]
+	}
+	var out []byte
+	for c := 0; c < 3; c++ {
+		for i := c; i < len(b); i += 3 {
+			var predicted byte
+			if i >= 3 {
+				predicted = b[i-3]
+			}
+			if i >= width+3 {
+				prev, upper, upperLeft := int(b[i-3]), int(b[i-width]), int(b[i-width-3])
+				p := prev + upper - upperLeft
+				pa, pb, pc := abs(p-prev), abs(p-upper), abs(p-upperLeft)
+				switch {
+				case pa <= pb && pa <= pc:
+					predicted = byte(prev)
+				case pb <= pc:
+					predicted = byte(upper)
+				default:
+					predicted = byte(upperLeft)
+				}
+			}
+			out = append(out, predicted-b[i])
+		}
+	}
+	return out
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// unAudio returns the differences of the samples of b from their predictions, running the
+// predictor of the decoder.
+func unAudio(b []byte, channels int) []byte {
+	var out []byte
+	for c := 0; c < channels; c++ {
+		var prev, prevDelta byte
+		var dif [7]int
+		var d1, d2, d3, k1, k2, k3 int
+		for i, count := c, 0; i < len(b); i, count = i+channels, count+1 {
+			d3 = d2
+			d2 = int(int8(prevDelta)) - d1
+			d1 = int(int8(prevDelta))
+			predicted := byte((8*int(prev) + k1*d1 + k2*d2 + k3*d3) >> 3)
+			cur := predicted - b[i]
+			out = append(out, cur)
+			prevDelta = b[i] - prev
+			prev = b[i]
+			d := int(int8(cur)) * 8
+			for j, v := range []int{d, d - d1, d + d1, d - d2, d + d2, d - d3, d + d3} {
+				dif[j] += abs(v)
+			}
+			if count&0x1f != 0 {
+				continue
+			}
+			k := 0
+			for j := 1; j < len(dif); j++ {
+				if dif[j] < dif[k] {
+					k = j
+				}
+			}
+			dif = [7]int{}
+			switch {
+			case k == 1 && k1 >= -16:
+				k1--
+			case k == 2 && k1 < 16:
+				k1++
+			case k == 3 && k2 >= -16:
+				k2--
+			case k == 4 && k2 < 16:
+				k2++
+			case k == 5 && k3 >= -16:
+				k3--
+			case k == 6 && k3 < 16:
+				k3++
+			}
+		}
+	}
+	return out
+}
+
+func TestDecompressErrors29(t *testing.T) {
+	fakePrograms(t)
+	text := testData(1, 10000)
+	e := &encoder29{}
+	packed := e.compress(text)
+
+	// a program of the virtual machine
+	e = &encoder29{}
+	vm := e.compress(text, testFilter{start: 0, length: 100, typ: len(standardFilters29)})
+
+	far := append(append(testData(2, 1000), testData(3, 0x50000)...), testData(2, 1000)...)
+	e = &encoder29{}
+	farPacked := e.compress(far)
+
+	tests := []struct {
+		name    string
+		entry   entry
+		wantErr error
+	}{
+		// the padding of the data decodes to matches, which the checksum catches
+		{name: "truncated", entry: entry{data: string(text), packed: packed[:len(packed)/2]}, wantErr: ErrChecksum},
+		{name: "tables", entry: entry{data: string(text), packed: packed[:20]}, wantErr: io.ErrUnexpectedEOF},
+		{name: "program", entry: entry{data: string(text), packed: vm}, wantErr: ErrAlgorithm},
+		{name: "far", entry: entry{data: string(far), packed: farPacked}, wantErr: ErrCorrupt},
+		{name: "version", entry: entry{data: string(text), packed: packed, version: 20}, wantErr: ErrAlgorithm},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.entry.name, tc.entry.method = "a", 3
+			_, errs := readAll(t, rar4(tc.entry), nil)
+			if !errors.Is(errs[0], tc.wantErr) {
+				t.Errorf("Read() error = %v, want %v", errs[0], tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,347 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rar
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// The sizes of the Huffman codes of the RAR 5.0 format: the literals and lengths, the distances
+// (more for the larger dictionaries of RAR 7), the low bits of the distances and the lengths of
+// the repeated distances.
+const (
+	nc50  = 306
+	dc50  = 64
+	dc70  = 80
+	ldc50 = 16
+	rc50  = 44
+)
+
+// The types of the filters of the RAR 5.0 format.
+const (
+	filter50Delta = iota
+	filter50E8
+	filter50E8E9
+	filter50ARM
+)
+
+// decoder50 decompresses the entries of the RAR 5.0 format (and of RAR 7, which has larger
+// dictionaries).
+type decoder50 struct {
+	*window
+	br *bitReader
+	// extended is set for the distances of RAR 7.
+	extended bool
+
+	// tables is set once the Huffman codes were read, which the entries of solid archives
+	// inherit.
+	tables                   bool
+	lengths                  []byte
+	main, dist, lowDist, rep huffman
+	oldDist                  [4]int64
+	lastLength               int
+
+	// blockEnd is the offset in bits of the end of the current block, and last is set for the last
+	// block of the entry.
+	blockEnd int64
+	last     bool
+	// eof is set at the end of the compressed data of the entry.
+	eof bool
+	err error
+}
+
+func newDecoder50(dictionary int64, extended bool) *decoder50 {
+	dc := dc50
+	if extended {
+		dc = dc70
+	}
+	return &decoder50{window: newWindow(dictionary), extended: extended, lengths: make([]byte, nc50+dc+ldc50+rc50)}
+}
+
+// reset starts the entry of size bytes whose compressed data is read from r. The entries of solid
+// archives keep the dictionary and the Huffman codes of the previous ones.
+func (d *decoder50) reset(r io.ByteReader, size int64, solid bool) {
+	d.window.reset(size)
+	d.br = newBitReader(r)
+	if !solid {
+		d.tables = false
+		d.oldDist = [4]int64{}
+		d.lastLength = 0
+	}
+	d.blockEnd, d.last, d.eof, d.err = 0, false, false, nil
+	if d.err = d.readBlock(); d.err == nil && !d.tables {
+		d.err = fmt.Errorf("%w: no Huffman tables", ErrCorrupt)
+	}
+}
+
+func (d *decoder50) Read(b []byte) (int, error) {
+	for {
+		n, err := d.read(b)
+		if n > 0 || err != nil {
+			return n, err
+		}
+		switch {
+		case d.err != nil:
+			return 0, d.err
+		case d.eof || d.done():
+			return 0, io.EOF
+		case d.full():
+			return 0, fmt.Errorf("%w: filter larger than the window", ErrCorrupt)
+		}
+		d.err = d.decode()
+	}
+}
+
+// readBlock reads the header of a block, and its Huffman tables if it has them.
+func (d *decoder50) readBlock() error {
+	br := d.br
+	br.align()
+	flags := br.readByte()
+	sum := br.readByte()
+	n := int(flags>>3&3) + 1
+	if n == 4 {
+		return fmt.Errorf("%w: bad block header", ErrCorrupt)
+	}
+	size := 0
+	for i := 0; i < n; i++ {
+		size |= int(br.readByte()) << (8 * i)
+	}
+	if sum != 0x5a^flags^byte(size)^byte(size>>8)^byte(size>>16) {
+		return fmt.Errorf("%w: block header checksum mismatch", ErrCorrupt)
+	}
+	if err := br.Err(); err != nil {
+		return err
+	}
+	d.blockEnd = br.offset() + max(int64(size-1)*8+int64(flags&7)+1, 0)
+	d.last = flags&0x40 != 0
+	if flags&0x80 != 0 {
+		return d.readTables()
+	}
+	return nil
+}
+
+func (d *decoder50) readTables() error {
+	var bc huffman
+	if err := readCodeLengths(d.br, &bc); err != nil {
+		return err
+	}
+	if err := readLengths(d.br, &bc, d.lengths, false); err != nil {
+		return err
+	}
+	dc := len(d.lengths) - nc50 - ldc50 - rc50
+	l := d.lengths
+	for _, t := range []struct {
+		h *huffman
+		n int
+	}{{&d.main, nc50}, {&d.dist, dc}, {&d.lowDist, ldc50}, {&d.rep, rc50}} {
+		if err := t.h.build(l[:t.n]); err != nil {
+			return err
+		}
+		l = l[t.n:]
+	}
+	d.tables = true
+	return nil
+}
+
+// decode decompresses the data of the entry until the window is full, or for a while.
+func (d *decoder50) decode() error {
+	br := d.br
+	for limit := d.pos + 1<<16; d.pos < limit && !d.full() && !d.done(); {
+		for br.offset() >= d.blockEnd {
+			if d.last {
+				d.eof = true
+				return nil
+			}
+			if err := d.readBlock(); err != nil {
+				return err
+			}
+		}
+		c, err := d.main.decode(br)
+		if err != nil {
+			return err
+		}
+		switch {
+		case c < 256:
+			d.putByte(byte(c))
+		case c >= 262:
+			err = d.match(c - 262)
+		case c == 256:
+			err = d.readFilter()
+		case c == 257:
+			if d.lastLength != 0 {
+				err = d.copyMatch(d.oldDist[0], d.lastLength)
+			}
+		default:
+			err = d.repeat(c - 258)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return br.Err()
+}
+
+// match copies a match of the length slot s, and of the distance following.
+func (d *decoder50) match(s int) error {
+	length := d.length(s)
+	dist, err := d.distance()
+	if err != nil {
+		return err
+	}
+	switch {
+	case dist > 0x40000:
+		length += 3
+	case dist > 0x2000:
+		length += 2
+	case dist > 0x100:
+		length++
+	}
+	copy(d.oldDist[1:], d.oldDist[:3])
+	d.oldDist[0] = dist
+	d.lastLength = length
+	return d.copyMatch(dist, length)
+}
+
+// repeat copies a match of the i-th last distance, and of the length following.
+func (d *decoder50) repeat(i int) error {
+	dist := d.oldDist[i]
+	copy(d.oldDist[1:i+1], d.oldDist[:i])
+	d.oldDist[0] = dist
+	s, err := d.rep.decode(d.br)
+	if err != nil {
+		return err
+	}
+	d.lastLength = d.length(s)
+	return d.copyMatch(dist, d.lastLength)
+}
+
+// length reads the length of a match of the length slot s.
+func (d *decoder50) length(s int) int {
+	if s < 8 {
+		return s + 2
+	}
+	n := uint(s/4 - 1)
+	return 2 + (4|s&3)<<n + int(d.br.bits(n))
+}
+
+// distance reads the distance of a match.
+func (d *decoder50) distance() (int64, error) {
+	s, err := d.dist.decode(d.br)
+	if err != nil {
+		return 0, err
+	}
+	if s < 4 {
+		return int64(s) + 1, nil
+	}
+	n := uint(s/2 - 1)
+	dist := int64(2|s&1)<<n + 1
+	if n < 4 {
+		return dist + int64(d.br.bits(n)), nil
+	}
+	if n > 4 {
+		dist += int64(d.br.longBits(n-4)) << 4
+	}
+	low, err := d.lowDist.decode(d.br)
+	return dist + int64(low), err
+}
+
+// readFilter reads a filter on the data following.
+func (d *decoder50) readFilter() error {
+	start := d.filterData()
+	length := d.filterData()
+	typ := d.br.bits(3)
+	f := filter{start: d.pos + int64(start), length: int64(length)}
+	switch typ {
+	case filter50Delta:
+		channels := int(d.br.bits(5)) + 1
+		f.apply = func(b []byte, _ int64) ([]byte, error) { return delta(b, channels), nil }
+	case filter50E8, filter50E8E9:
+		e9 := typ == filter50E8E9
+		f.apply = func(b []byte, offset int64) ([]byte, error) { return e8(b, uint32(offset), e9, true), nil }
+	case filter50ARM:
+		f.apply = func(b []byte, offset int64) ([]byte, error) { return arm(b, uint32(offset)), nil }
+	default:
+		return fmt.Errorf("%w: unknown filter %d", ErrCorrupt, typ)
+	}
+	return d.addFilter(f)
+}
+
+// filterData reads a number of 1 to 4 bytes of a filter.
+func (d *decoder50) filterData() uint32 {
+	n := d.br.bits(2) + 1
+	var v uint32
+	for i := uint32(0); i < n; i++ {
+		v |= d.br.bits(8) << (8 * i)
+	}
+	return v
+}
+
+// delta decodes the bytes of b, interleaved from channels channels, from their differences.
+func delta(b []byte, channels int) []byte {
+	out := make([]byte, len(b))
+	src := 0
+	for c := 0; c < channels; c++ {
+		var prev byte
+		for i := c; i < len(out); i += channels {
+			prev -= b[src]
+			out[i] = prev
+			src++
+		}
+	}
+	return out
+}
+
+// e8 restores the absolute addresses of the x86 CALL instructions (0xe8), and of the JMP ones
+// (0xe9) if e9 is set, which the compressor made relative to ease their compression. offset is
+// the position of b in the entry. RAR 5.0 wraps the positions on 24 bits.
+func e8(b []byte, offset uint32, e9 bool, wrap bool) []byte {
+	const fileSize = 0x1000000
+	for i := 0; i+4 < len(b); {
+		c := b[i]
+		i++
+		if c != 0xe8 && !(e9 && c == 0xe9) {
+			continue
+		}
+		pos := offset + uint32(i)
+		if wrap {
+			pos %= fileSize
+		}
+		addr := binary.LittleEndian.Uint32(b[i:])
+		if addr&0x80000000 != 0 {
+			if (addr+pos)&0x80000000 == 0 {
+				binary.LittleEndian.PutUint32(b[i:], addr+fileSize)
+			}
+		} else if (addr-fileSize)&0x80000000 != 0 {
+			binary.LittleEndian.PutUint32(b[i:], addr-pos)
+		}
+		i += 4
+	}
+	return b
+}
+
+// arm restores the absolute addresses of the ARM BL instructions.
+func arm(b []byte, offset uint32) []byte {
+	for i := 0; i+3 < len(b); i += 4 {
+		if b[i+3] != 0xeb {
+			continue
+		}
+		addr := uint32(b[i]) | uint32(b[i+1])<<8 | uint32(b[i+2])<<16
+		addr -= (offset + uint32(i)) / 4
+		b[i], b[i+1], b[i+2] = byte(addr), byte(addr>>8), byte(addr>>16)
+	}
+	return b
+}
@@ -0,0 +1,684 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rar
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/bits"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// The test encoders compress the data greedily, with Huffman codes of all the symbols used by an
+// entry: the tests need valid streams using all the codes of the formats, not small ones.
+
+// bitWriter writes compressed data, most significant bit first.
+type bitWriter struct {
+	buf []byte
+	// n is the number of bits used in the last byte, 0 if it is full.
+	n uint
+}
+
+func (w *bitWriter) bits(v uint64, n uint) {
+	for ; n > 0; n-- {
+		if w.n == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		w.buf[len(w.buf)-1] |= byte(v>>(n-1)&1) << (7 - w.n)
+		w.n = (w.n + 1) % 8
+	}
+}
+
+func (w *bitWriter) align() {
+	w.n = 0
+}
+
+// item is a symbol of one of the Huffman codes of a block, or n raw bits if code is -1.
+type item struct {
+	code int
+	v    uint64
+	n    uint
+}
+
+func raw(v uint64, n uint) item {
+	return item{code: -1, v: v, n: n}
+}
+
+// completeLengths returns the lengths of a complete prefix code of the n symbols, coding the used
+// ones (at least two).
+func completeLengths(used []bool) []byte {
+	var syms []int
+	for s, u := range used {
+		if u {
+			syms = append(syms, s)
+		}
+	}
+	for s := 0; len(syms) < 2; s++ {
+		if !used[s] {
+			syms = append(syms, s)
+		}
+	}
+	k := bits.Len(uint(len(syms) - 1))
+	short := 1<<k - len(syms)
+	lengths := make([]byte, len(used))
+	for i, s := range syms {
+		lengths[s] = byte(k)
+		if i < short {
+			lengths[s]--
+		}
+	}
+	return lengths
+}
+
+// canonical returns the canonical Huffman codes of the lengths.
+func canonical(lengths []byte) []uint64 {
+	codes := make([]uint64, len(lengths))
+	var code uint64
+	for l := byte(1); l <= maxCodeLen; l++ {
+		for s, n := range lengths {
+			if n == l {
+				codes[s] = code
+				code++
+			}
+		}
+		code <<= 1
+	}
+	return codes
+}
+
+// writeItems writes the items with the codes of the lengths of each code.
+func writeItems(w *bitWriter, lengths [][]byte, items []item) {
+	codes := make([][]uint64, len(lengths))
+	for i, l := range lengths {
+		codes[i] = canonical(l)
+	}
+	for _, it := range items {
+		if it.code < 0 {
+			w.bits(it.v, it.n)
+			continue
+		}
+		w.bits(codes[it.code][it.v], uint(lengths[it.code][it.v]))
+	}
+}
+
+// codeLengths returns the lengths of the codes of sizes n coding the items.
+func codeLengths(items []item, n ...int) [][]byte {
+	used := make([][]bool, len(n))
+	for i := range n {
+		used[i] = make([]bool, n[i])
+	}
+	for _, it := range items {
+		if it.code >= 0 {
+			used[it.code][it.v] = true
+		}
+	}
+	lengths := make([][]byte, len(n))
+	for i := range n {
+		lengths[i] = completeLengths(used[i])
+	}
+	return lengths
+}
+
+// writeLengths writes the code lengths of the tables, as differences from old if not nil (RAR 2.9),
+// with their runs.
+func writeLengths(w *bitWriter, lengths, old []byte) {
+	var items []item
+	for i := 0; i < len(lengths); {
+		l, n := lengths[i], 1
+		for i+n < len(lengths) && lengths[i+n] == l && n < 138 {
+			n++
+		}
+		switch {
+		case l == 0 && n >= 11:
+			items = append(items, item{code: 0, v: 19}, raw(uint64(n-11), 7))
+		case l == 0 && n >= 3:
+			n = min(n, 10)
+			items = append(items, item{code: 0, v: 18}, raw(uint64(n-3), 3))
+		case i > 0 && lengths[i-1] == l && n >= 11:
+			items = append(items, item{code: 0, v: 17}, raw(uint64(n-11), 7))
+		case i > 0 && lengths[i-1] == l && n >= 3:
+			n = min(n, 10)
+			items = append(items, item{code: 0, v: 16}, raw(uint64(n-3), 3))
+		default:
+			n = 1
+			if old != nil {
+				l = (l - old[i]) & 0xf
+			}
+			items = append(items, item{code: 0, v: uint64(l)})
+		}
+		i += n
+	}
+	bc := codeLengths(items, 20)
+	for _, l := range bc[0] {
+		w.bits(uint64(l), 4)
+	}
+	writeItems(w, bc, items)
+}
+
+// token is a literal if length is 0, or a match.
+type token struct {
+	c      byte
+	length int
+	dist   int64
+}
+
+// matcher finds the matches of the data of the entries, including the ones of the previous
+// entries of solid archives.
+type matcher struct {
+	hist  []byte
+	heads map[uint32]int
+	prev  []int
+	next  int
+}
+
+// tokens returns the tokens of data, whose matches are no longer than maxLength and at least
+// minLength(dist) long.
+func (m *matcher) tokens(data []byte, maxLength int, minLength func(dist int64) int) []token {
+	if m.heads == nil {
+		m.heads = map[uint32]int{}
+	}
+	key := func(p int) uint32 { return uint32(m.hist[p]) | uint32(m.hist[p+1])<<8 | uint32(m.hist[p+2])<<16 }
+	var ts []token
+	p := len(m.hist)
+	m.hist = append(m.hist, data...)
+	m.prev = append(m.prev, make([]int, len(data))...)
+	for p < len(m.hist) {
+		for ; m.next < p && m.next+3 <= len(m.hist); m.next++ {
+			k := key(m.next)
+			m.prev[m.next] = m.heads[k]
+			m.heads[k] = m.next + 1
+		}
+		t := token{c: m.hist[p]}
+		if p+3 <= len(m.hist) {
+			for q, n := m.heads[key(p)]-1, 0; q >= 0 && n < 32; q, n = m.prev[q]-1, n+1 {
+				l := 0
+				for p+l < len(m.hist) && l < maxLength && m.hist[q+l] == m.hist[p+l] {
+					l++
+				}
+				if dist := int64(p - q); l > t.length && l >= minLength(dist) {
+					t.length, t.dist = l, dist
+				}
+			}
+		}
+		ts = append(ts, t)
+		p += max(t.length, 1)
+	}
+	return ts
+}
+
+// testFilter is a filter of the test encoders, at start in the data of an entry.
+type testFilter struct {
+	start, length int
+	// typ is the type of the filters of RAR 5.0, or the index of the standard filter of RAR 2.9.
+	typ      int
+	channels int
+	// r are the registers of the filters of RAR 2.9.
+	r [7]uint32
+}
+
+// encoder50 compresses the entries of the RAR 5.0 format.
+type encoder50 struct {
+	matcher
+	extended   bool
+	oldDist    [4]int64
+	lastLength int
+	// blockItems is the number of tokens of the blocks, whose odd ones reuse the Huffman codes of
+	// the previous one. Zero means one block.
+	blockItems int
+}
+
+func length50(l int) (slot int, extra []item) {
+	v := l - 2
+	if v < 8 {
+		return v, nil
+	}
+	n := bits.Len(uint(v)) - 3
+	slot = 4*(n+1) + v>>n&3
+	return slot, []item{raw(uint64(v-(4|slot&3)<<n), uint(n))}
+}
+
+func (e *encoder50) distance(dist int64) []item {
+	v := dist - 1
+	if v < 4 {
+		return []item{{code: 1, v: uint64(v)}}
+	}
+	n := bits.Len64(uint64(v)) - 2
+	slot := 2*(n+1) + int(v>>n&1)
+	v -= int64(2|slot&1) << n
+	items := []item{{code: 1, v: uint64(slot)}}
+	if n < 4 {
+		return append(items, raw(uint64(v), uint(n)))
+	}
+	if n > 4 {
+		items = append(items, raw(uint64(v>>4), uint(n-4)))
+	}
+	return append(items, item{code: 2, v: uint64(v & 15)})
+}
+
+func adjust50(dist int64) int {
+	switch {
+	case dist > 0x40000:
+		return 3
+	case dist > 0x2000:
+		return 2
+	case dist > 0x100:
+		return 1
+	}
+	return 0
+}
+
+func (e *encoder50) token(t token) []item {
+	switch {
+	case t.length == 0:
+		return []item{{code: 0, v: uint64(t.c)}}
+	case t.dist == e.oldDist[0] && t.length == e.lastLength:
+		return []item{{code: 0, v: 257}}
+	}
+	for i, d := range e.oldDist {
+		if d == t.dist {
+			copy(e.oldDist[1:i+1], e.oldDist[:i])
+			e.oldDist[0] = d
+			e.lastLength = t.length
+			s, extra := length50(t.length)
+			return append([]item{{code: 0, v: uint64(258 + i)}, {code: 3, v: uint64(s)}}, extra...)
+		}
+	}
+	copy(e.oldDist[1:], e.oldDist[:3])
+	e.oldDist[0] = t.dist
+	e.lastLength = t.length
+	s, extra := length50(t.length - adjust50(t.dist))
+	items := append([]item{{code: 0, v: uint64(262 + s)}}, extra...)
+	return append(items, e.distance(t.dist)...)
+}
+
+// filterData returns the items of a number of a filter.
+func filterData(v int) []item {
+	n := max((bits.Len(uint(v))+7)/8, 1)
+	items := []item{raw(uint64(n-1), 2)}
+	for i := 0; i < n; i++ {
+		items = append(items, raw(uint64(v>>(8*i)&0xff), 8))
+	}
+	return items
+}
+
+// compress returns the compressed data of the entry, the data being the output of the LZ
+// decompression before the filters.
+func (e *encoder50) compress(data []byte, filters ...testFilter) []byte {
+	// the items of the tokens, which the blocks do not split
+	var ops [][]item
+	minLength := func(dist int64) int { return 2 + adjust50(dist) }
+	tokens := func(b []byte) {
+		for _, t := range e.tokens(b, 0x1000, minLength) {
+			ops = append(ops, e.token(t))
+		}
+	}
+	pos := 0
+	for _, f := range filters {
+		tokens(data[pos:f.start])
+		pos = f.start
+		op := []item{{code: 0, v: 256}}
+		op = append(op, filterData(0)...)
+		op = append(op, filterData(f.length)...)
+		op = append(op, raw(uint64(f.typ), 3))
+		if f.typ == filter50Delta {
+			op = append(op, raw(uint64(f.channels-1), 5))
+		}
+		ops = append(ops, op)
+	}
+	tokens(data[pos:])
+	items := concat(ops)
+
+	dc := dc50
+	if e.extended {
+		dc = dc70
+	}
+	lengths := codeLengths(items, nc50, dc, ldc50, rc50)
+	n := e.blockItems
+	if n == 0 {
+		n = len(ops)
+	}
+	var w bitWriter
+	for i := 0; i == 0 || i*n < len(ops); i++ {
+		var b bitWriter
+		flags := byte(0)
+		if i%2 == 0 {
+			flags |= 0x80
+			writeLengths(&b, bytes.Join(lengths, nil), nil)
+		}
+		writeItems(&b, lengths, concat(ops[i*n:min(i*n+n, len(ops))]))
+		if (i+1)*n >= len(ops) {
+			flags |= 0x40
+		}
+		size := len(b.buf)
+		last := b.n
+		if last == 0 {
+			last = 8
+		}
+		flags |= byte(last - 1)
+		sizeBytes := max((bits.Len(uint(size))+7)/8, 1)
+		flags |= byte(sizeBytes-1) << 3
+		w.align()
+		w.bits(uint64(flags), 8)
+		w.bits(uint64(0x5a^flags^byte(size)^byte(size>>8)^byte(size>>16)), 8)
+		for j := 0; j < sizeBytes; j++ {
+			w.bits(uint64(size>>(8*j)&0xff), 8)
+		}
+		w.buf = append(w.buf, b.buf...)
+	}
+	return w.buf
+}
+
+func concat(ops [][]item) []item {
+	var items []item
+	for _, op := range ops {
+		items = append(items, op...)
+	}
+	return items
+}
+
+// testData returns n bytes of data compressing well: words of a small vocabulary, with random
+// bytes.
+func testData(seed int64, n int) []byte {
+	rnd := rand.New(rand.NewSource(seed))
+	words := strings.Fields("the quick brown fox jumps over lazy dog archive entry solid dictionary filter")
+	var b []byte
+	for len(b) < n {
+		switch rnd.Intn(8) {
+		case 0:
+			for i := rnd.Intn(16); i > 0; i-- {
+				b = append(b, byte(rnd.Intn(256)))
+			}
+		default:
+			b = append(b, words[rnd.Intn(len(words))]...)
+			b = append(b, ' ')
+		}
+	}
+	return b[:n]
+}
+
+// readAll reads the entries of the archive, with the data and the error of each.
+func readAll(t *testing.T, archive []byte, setup func(r *Reader)) (data [][]byte, errs []error) {
+	t.Helper()
+	r, err := NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	r.SetSecurityMode(0)
+	if setup != nil {
+		setup(r)
+	}
+	for {
+		_, err := r.Next()
+		if err == io.EOF {
+			return data, errs
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		b, err := io.ReadAll(r)
+		data, errs = append(data, b), append(errs, err)
+	}
+}
+
+func TestDecompress50(t *testing.T) {
+	text := testData(1, 200<<10)
+	// a long distance
+	far := append(append(testData(2, 1000), testData(3, 0x50000)...), testData(2, 1000)...)
+
+	x86 := testData(4, 4096)
+	for i := 0; i+5 < len(x86); i += 97 {
+		x86[i] = 0xe8 + byte(i%2)
+	}
+	arm := testData(5, 4096)
+	for i := 3; i < len(arm); i += 28 {
+		arm[i] = 0xeb
+	}
+	table := make([]byte, 3000)
+	for i := range table {
+		table[i] = byte(i/3 + i%3*50)
+	}
+
+	tests := []struct {
+		name       string
+		data       []byte
+		filters    []testFilter
+		extended   bool
+		blockItems int
+		dictionary uint64
+	}{
+		{name: "text", data: text},
+		{name: "blocks", data: text, blockItems: 1000},
+		{name: "far", data: far, dictionary: 2},
+		{name: "extended", data: far, dictionary: 2, extended: true},
+		{name: "E8", data: x86, filters: []testFilter{{start: 100, length: 3000, typ: filter50E8}}},
+		{name: "E8E9", data: x86, filters: []testFilter{{start: 0, length: 4096, typ: filter50E8E9}}},
+		{name: "ARM", data: arm, filters: []testFilter{{start: 4, length: 4000, typ: filter50ARM}}},
+		{name: "delta", data: table, filters: []testFilter{{start: 0, length: 1500, typ: filter50Delta, channels: 3}, {start: 1500, length: 1500, typ: filter50Delta, channels: 3}}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			e := &encoder50{extended: tc.extended, blockItems: tc.blockItems}
+			version := 0
+			if tc.extended {
+				version = 1
+			}
+			packed := e.compress(filter50(tc.data, tc.filters), tc.filters...)
+			archive := rar5(entry{name: "a", data: string(tc.data), method: 3, packed: packed, version: version, dictionary: tc.dictionary})
+			data, errs := readAll(t, archive, nil)
+			if errs[0] != nil {
+				t.Fatalf("Read() error = %v", errs[0])
+			}
+			if !bytes.Equal(data[0], tc.data) {
+				t.Errorf("Read() = %d bytes differing from the %d bytes of the entry", len(data[0]), len(tc.data))
+			}
+		})
+	}
+}
+
+// filter50 returns the data before the filters of RAR 5.0.
+func filter50(data []byte, filters []testFilter) []byte {
+	data = bytes.Clone(data)
+	for _, f := range filters {
+		b := data[f.start : f.start+f.length]
+		switch f.typ {
+		case filter50Delta:
+			copy(b, unDelta(b, f.channels))
+		case filter50E8, filter50E8E9:
+			unE8(b, uint32(f.start), f.typ == filter50E8E9, true)
+		case filter50ARM:
+			for i := 0; i+3 < len(b); i += 4 {
+				if b[i+3] == 0xeb {
+					addr := uint32(b[i]) | uint32(b[i+1])<<8 | uint32(b[i+2])<<16
+					addr += (uint32(f.start) + uint32(i)) / 4
+					b[i], b[i+1], b[i+2] = byte(addr), byte(addr>>8), byte(addr>>16)
+				}
+			}
+		}
+	}
+	return data
+}
+
+// unDelta returns the differences of the bytes of each channel, in the order of the channels.
+func unDelta(b []byte, channels int) []byte {
+	var out []byte
+	for c := 0; c < channels; c++ {
+		var prev byte
+		for i := c; i < len(b); i += channels {
+			out = append(out, prev-b[i])
+			prev = b[i]
+		}
+	}
+	return out
+}
+
+// unE8 makes the addresses of the x86 CALL (and JMP if e9 is set) instructions relative.
+func unE8(b []byte, offset uint32, e9, wrap bool) {
+	const fileSize = 0x1000000
+	for i := 0; i+4 < len(b); {
+		c := b[i]
+		i++
+		if c != 0xe8 && !(e9 && c == 0xe9) {
+			continue
+		}
+		pos := offset + uint32(i)
+		if wrap {
+			pos %= fileSize
+		}
+		addr := int64(int32(b[i]) | int32(b[i+1])<<8 | int32(b[i+2])<<16 | int32(b[i+3])<<24)
+		switch {
+		case addr >= -int64(pos) && addr < fileSize-int64(pos):
+			addr += int64(pos)
+		case addr >= fileSize-int64(pos) && addr < fileSize:
+			addr -= fileSize
+		}
+		b[i], b[i+1], b[i+2], b[i+3] = byte(addr), byte(addr>>8), byte(addr>>16), byte(addr>>24)
+		i += 4
+	}
+}
+
+// sample50 is an archive compressed by RAR 5.0.
+const sample50 = "526172211a0701003392b5e50a0105060005010180800046cd35491c02029d0106bb01b483028000f35ab5ea0c23800301066173642e676fc5059a26544342f66044dd9385426a90164de83a974a08f054b664664164bc1c91cd08f7a52e4cdd9c5aecbfc7aaab93d9747ab455141f7dc7f106f807b8f10848c684711f533a4d722708b906ae0f84f0a765b462cbc3db9afc18f1db962ecd96b109441de926e8de951fe125e45bb0fd4fbb79ecc2f9885e54d02d048e47295f0093381701c91556eb30be342989d0dd073fe59027f54ad4fd54fe981d77565103050400"
+
+const sample50Data = `package main
+
+import (
+	"time"
+
+	"github.com/davecgh/go-spew/spew"
+)
+
+func main() {
+	loc, _ := time.LoadLocation("Indian/Cocos")
+
+	spew.Dump(time.Now().In(loc))
+	spew.Dump(time.Now())
+
+}
+`
+
+func TestDecompressSample50(t *testing.T) {
+	archive, err := hex.DecodeString(sample50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, errs := readAll(t, archive, nil)
+	if len(data) != 1 || errs[0] != nil {
+		t.Fatalf("entries = %d, Read() error = %v", len(data), errs)
+	}
+	if got := string(data[0]); got != sample50Data {
+		t.Errorf("Read() = %q, want %q", got, sample50Data)
+	}
+}
+
+func TestDecompressSolid(t *testing.T) {
+	texts := [][]byte{testData(1, 50000), testData(2, 30000), testData(1, 40000)}
+	for _, f := range []struct {
+		name     string
+		archive  func(entries ...entry) []byte
+		compress func() func(data []byte) []byte
+	}{
+		{"RAR4", rar4, func() func([]byte) []byte {
+			e := &encoder29{}
+			return func(data []byte) []byte { return e.compress(data) }
+		}},
+		{"RAR5", rar5, func() func([]byte) []byte {
+			e := &encoder50{}
+			return func(data []byte) []byte { return e.compress(data) }
+		}},
+	} {
+		t.Run(f.name, func(t *testing.T) {
+			compress := f.compress()
+			var entries []entry
+			for i, text := range texts {
+				entries = append(entries, entry{name: string(rune('a' + i)), data: string(text), method: 3, packed: compress(text), solid: i > 0})
+			}
+			archive := f.archive(entries...)
+
+			data, errs := readAll(t, archive, nil)
+			for i := range texts {
+				if errs[i] != nil || !bytes.Equal(data[i], texts[i]) {
+					t.Errorf("entry %d: Read() = %d bytes, %v, want %d bytes", i, len(data[i]), errs[i], len(texts[i]))
+				}
+			}
+
+			// the entries skipped are decompressed still
+			r, err := NewReader(bytes.NewReader(archive))
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.SetSecurityMode(0)
+			for i := range texts {
+				if _, err := r.Next(); err != nil {
+					t.Fatalf("Next() error = %v", err)
+				}
+				if i == len(texts)-1 {
+					if b, err := io.ReadAll(r); err != nil || !bytes.Equal(b, texts[i]) {
+						t.Errorf("Read() = %d bytes, %v, want %d bytes", len(b), err, len(texts[i]))
+					}
+				}
+			}
+
+			// a corrupt entry breaks the solid stream
+			entries[0].packed = entries[0].packed[:len(entries[0].packed)/2]
+			_, errs = readAll(t, f.archive(entries...), nil)
+			for i, err := range errs {
+				if err == nil {
+					t.Errorf("entry %d: Read() error = nil, want an error", i)
+				}
+			}
+			if !errors.Is(errs[2], ErrCorrupt) {
+				t.Errorf("Read() error = %v, want %v", errs[2], ErrCorrupt)
+			}
+		})
+	}
+}
+
+func TestDecompressErrors50(t *testing.T) {
+	text := testData(1, 10000)
+	e := &encoder50{}
+	packed := e.compress(text)
+	tests := []struct {
+		name    string
+		entry   entry
+		wantErr error
+	}{
+		// the data needs a dictionary of 128KiB at least
+		{name: "truncated", entry: entry{data: string(text), packed: packed[:len(packed)-100]}, wantErr: io.ErrUnexpectedEOF},
+		{name: "header checksum", entry: entry{data: string(text), packed: append([]byte{packed[0], packed[1] ^ 1}, packed[2:]...)}, wantErr: ErrCorrupt},
+		{name: "no tables", entry: entry{data: "a", packed: []byte{0x40 | 7, 0x5a ^ 0x47 ^ 1, 1, 0}}, wantErr: ErrCorrupt},
+		{name: "version", entry: entry{data: string(text), packed: packed, version: 2}, wantErr: ErrAlgorithm},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.entry.name, tc.entry.method = "a", 3
+			_, errs := readAll(t, rar5(tc.entry), nil)
+			if !errors.Is(errs[0], tc.wantErr) {
+				t.Errorf("Read() error = %v, want %v", errs[0], tc.wantErr)
+			}
+		})
+	}
+
+	// a match farther than the dictionary
+	far := append(append(testData(2, 1000), testData(3, 0x50000)...), testData(2, 1000)...)
+	e = &encoder50{}
+	a := rar5(entry{name: "a", data: string(far), method: 3, packed: e.compress(far)})
+	if _, errs := readAll(t, a, nil); !errors.Is(errs[0], ErrCorrupt) {
+		t.Errorf("Read() error = %v, want %v", errs[0], ErrCorrupt)
+	}
+}
@@ -0,0 +1,1037 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rar
+
+import (
+	"encoding/binary"
+	"fmt"
+	"runtime"
+)
+
+// The PPMd variant H of the RAR 2.9 format. The model must evolve exactly as the one of the
+// compressor, including when it runs out of memory, so it emulates the memory layout of the
+// reference implementation: a heap of 12-byte units addressed by offsets, where the contexts take
+// one unit and the states six bytes.
+//
+// The states are laid out as
+//
+//	symbol    byte   0
+//	freq      byte   1
+//	successor uint32 2
+//
+// and the contexts as
+//
+//	numStats uint16 0
+//	summFreq uint16 2  (or the only state at 2 when numStats is 1)
+//	stats    uint32 4
+//	suffix   uint32 8
+//
+// The offset 0 of the heap is the null reference.
+
+const (
+	unitSize  = 12
+	stateSize = 6
+	nIndexes  = 38
+	maxO      = 64
+	maxFreq   = 124
+	interval  = 128
+	binScale  = 1 << 14
+	periodBit = 7
+	rangeTop  = 1 << 24
+	rangeBot  = 1 << 15
+)
+
+var (
+	// indx2Units is the number of units of the blocks of each free list, and units2Indx the free
+	// list of the blocks of 1 to 128 units.
+	indx2Units [nIndexes]uint32
+	units2Indx [128]int
+
+	initBinEsc = [8]uint16{0x3cdd, 0x1f3f, 0x59bf, 0x48f3, 0x64a1, 0x5abc, 0x6632, 0x6051}
+	expEscape  = [16]int{25, 14, 9, 7, 5, 5, 4, 4, 4, 3, 3, 3, 2, 2, 2, 2}
+
+	errPPMData = fmt.Errorf("%w: invalid PPMd data", ErrCorrupt)
+)
+
+func init() {
+	i, k := 0, uint32(1)
+	for step, n := range []int{4, 4, 4, 26} {
+		for j := 0; j < n; j++ {
+			indx2Units[i] = k
+			i++
+			k += uint32(step + 1)
+		}
+		k++
+	}
+	i = 0
+	for k := range units2Indx {
+		if indx2Units[i] < uint32(k+1) {
+			i++
+		}
+		units2Indx[k] = i
+	}
+}
+
+// see2Context is an adaptive estimator of the escape frequency.
+type see2Context struct {
+	summ  uint16
+	shift byte
+	count byte
+}
+
+func (s *see2Context) init(v int) {
+	s.shift = periodBit - 4
+	s.summ = uint16(v << s.shift)
+	s.count = 4
+}
+
+func (s *see2Context) mean() uint32 {
+	r := s.summ >> s.shift
+	s.summ -= r
+	if r == 0 {
+		return 1
+	}
+	return uint32(r)
+}
+
+func (s *see2Context) update() {
+	if s.shift < periodBit {
+		if s.count--; s.count == 0 {
+			s.summ += s.summ
+			s.count = 3 << s.shift
+			s.shift++
+		}
+	}
+}
+
+// ppmModel decodes the PPMd blocks.
+type ppmModel struct {
+	br *bitReader
+
+	// The range decoder, and the range of the decoded symbol.
+	low, code, rng             uint32
+	scale, lowCount, highCount uint32
+
+	// The sub-allocator: the text area grows up from heapStart to unitsStart, the units are
+	// allocated up from loUnit and the contexts down from hiUnit.
+	heap                             []byte
+	size                             int64
+	heapStart, heapEnd               uint32
+	text, unitsStart, loUnit, hiUnit uint32
+	freeList                         [nIndexes]uint32
+	glueCount                        byte
+
+	// The model.
+	minContext, maxContext, foundState uint32
+	numMasked, initEsc, orderFall      int
+	maxOrder                           int
+	runLength, initRL                  int32
+	escCount                           byte
+	prevSuccess, hiBitsFlag            int
+	charMask                           [256]byte
+	ns2Indx, ns2BSIndx, hb2Flag        [256]byte
+	binSumm                            [128][64]uint16
+	see2                               [25][16]see2Context
+	dummySEE2                          see2Context
+}
+
+// init reads the parameters of a PPMd block, starting a new model if they say so.
+func (m *ppmModel) init(br *bitReader, escape *byte, maxMemory int64) error {
+	m.br = br
+	flags := br.readByte()
+	reset := flags&0x20 != 0
+	var mb byte
+	if reset {
+		mb = br.readByte()
+	} else if m.heap == nil {
+		return fmt.Errorf("%w: PPMd block without a model", ErrCorrupt)
+	}
+	if flags&0x40 != 0 {
+		*escape = br.readByte()
+	}
+	m.low, m.code, m.rng = 0, 0, 0xffffffff
+	for i := 0; i < 4; i++ {
+		m.code = m.code<<8 | uint32(br.readByte())
+	}
+	if err := br.Err(); err != nil {
+		return err
+	}
+	if !reset {
+		return nil
+	}
+	order := int(flags&0x1f) + 1
+	if order > 16 {
+		order = 16 + (order-16)*3
+	}
+	if order == 1 {
+		m.heap = nil
+		return fmt.Errorf("%w: PPMd model of order 1", ErrCorrupt)
+	}
+	size := (int64(mb) + 1) << 20
+	if maxMemory >= 0 && size > maxMemory {
+		m.heap = nil
+		return fmt.Errorf("%w: PPMd model of %d bytes", ErrLimitExceeded, size)
+	}
+	if m.heap == nil || m.size != size {
+		// the offset 0 is the null reference, and the unit past the end stops the gluing of the
+		// free blocks
+		m.heap = make([]byte, unitSize+size/unitSize*unitSize+unitSize)
+		m.size = size
+		m.heapStart = unitSize
+		m.heapEnd = m.heapStart + uint32(size/unitSize*unitSize)
+	}
+	m.startModel(order)
+	return nil
+}
+
+// decodeChar decodes the next byte.
+func (m *ppmModel) decodeChar() (c byte, err error) {
+	defer func() {
+		// the references of a corrupt model may point out of the heap
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); !ok {
+				panic(r)
+			}
+			err = fmt.Errorf("%w: invalid PPMd model", ErrCorrupt)
+		}
+	}()
+	if !m.valid(m.minContext) {
+		return 0, errPPMData
+	}
+	if m.numStats(m.minContext) != 1 {
+		if !m.valid(m.stats(m.minContext)) || !m.decodeSymbol1() {
+			return 0, errPPMData
+		}
+	} else {
+		m.decodeBinSymbol()
+	}
+	m.decode()
+	for m.foundState == 0 {
+		m.normalize()
+		for {
+			m.orderFall++
+			m.minContext = m.suffix(m.minContext)
+			if !m.valid(m.minContext) {
+				return 0, errPPMData
+			}
+			if int(m.numStats(m.minContext)) != m.numMasked {
+				break
+			}
+		}
+		if !m.decodeSymbol2() {
+			return 0, errPPMData
+		}
+		m.decode()
+	}
+	c = m.heap[m.foundState]
+	if s := m.successor(m.foundState); m.orderFall == 0 && s > m.text {
+		m.minContext, m.maxContext = s, s
+	} else {
+		m.updateModel()
+		if m.escCount == 0 {
+			m.clearMask()
+		}
+	}
+	m.normalize()
+	if err := m.br.Err(); err != nil {
+		return 0, err
+	}
+	return c, nil
+}
+
+// valid reports whether the context or states at p are in the units of the heap.
+func (m *ppmModel) valid(p uint32) bool {
+	return p > m.text && p <= m.heapEnd
+}
+
+// The range decoder.
+
+func (m *ppmModel) normalize() {
+	for {
+		if m.low^(m.low+m.rng) >= rangeTop {
+			if m.rng >= rangeBot {
+				return
+			}
+			m.rng = -m.low & (rangeBot - 1)
+		}
+		m.code = m.code<<8 | uint32(m.br.readByte())
+		m.rng <<= 8
+		m.low <<= 8
+	}
+}
+
+func (m *ppmModel) currentCount() int32 {
+	m.rng /= m.scale
+	return int32((m.code - m.low) / m.rng)
+}
+
+func (m *ppmModel) currentShiftCount(shift uint) uint32 {
+	m.rng >>= shift
+	return (m.code - m.low) / m.rng
+}
+
+func (m *ppmModel) decode() {
+	m.low += m.rng * m.lowCount
+	m.rng *= m.highCount - m.lowCount
+}
+
+// The heap.
+
+func (m *ppmModel) u16(p uint32) uint16 { return binary.LittleEndian.Uint16(m.heap[p:]) }
+func (m *ppmModel) u32(p uint32) uint32 { return binary.LittleEndian.Uint32(m.heap[p:]) }
+
+func (m *ppmModel) setU16(p uint32, v uint16) { binary.LittleEndian.PutUint16(m.heap[p:], v) }
+func (m *ppmModel) setU32(p uint32, v uint32) { binary.LittleEndian.PutUint32(m.heap[p:], v) }
+
+func (m *ppmModel) freq(s uint32) byte              { return m.heap[s+1] }
+func (m *ppmModel) setFreq(s uint32, f byte)        { m.heap[s+1] = f }
+func (m *ppmModel) successor(s uint32) uint32       { return m.u32(s + 2) }
+func (m *ppmModel) setSuccessor(s uint32, c uint32) { m.setU32(s+2, c) }
+func (m *ppmModel) numStats(c uint32) uint16        { return m.u16(c) }
+func (m *ppmModel) setNumStats(c uint32, n uint16)  { m.setU16(c, n) }
+func (m *ppmModel) summFreq(c uint32) uint16        { return m.u16(c + 2) }
+func (m *ppmModel) setSummFreq(c uint32, f uint16)  { m.setU16(c+2, f) }
+func (m *ppmModel) stats(c uint32) uint32           { return m.u32(c + 4) }
+func (m *ppmModel) setStats(c uint32, s uint32)     { m.setU32(c+4, s) }
+func (m *ppmModel) suffix(c uint32) uint32          { return m.u32(c + 8) }
+func (m *ppmModel) setSuffix(c uint32, s uint32)    { m.setU32(c+8, s) }
+func (m *ppmModel) copyState(dst, src uint32) {
+	copy(m.heap[dst:dst+stateSize], m.heap[src:src+stateSize])
+}
+func (m *ppmModel) addSummFreq(c uint32, n uint32) { m.setSummFreq(c, m.summFreq(c)+uint16(n)) }
+
+func (m *ppmModel) swapStates(a, b uint32) {
+	var t [stateSize]byte
+	copy(t[:], m.heap[a:a+stateSize])
+	copy(m.heap[a:a+stateSize], m.heap[b:b+stateSize])
+	copy(m.heap[b:b+stateSize], t[:])
+}
+
+// The sub-allocator.
+
+func (m *ppmModel) initSubAllocator() {
+	m.freeList = [nIndexes]uint32{}
+	size2 := uint32(m.size / 8 / unitSize * 7 * unitSize)
+	size1 := uint32(m.size) - size2
+	m.text = m.heapStart
+	m.unitsStart = m.heapStart + size1
+	m.loUnit = m.unitsStart
+	m.hiUnit = m.loUnit + size2
+	m.glueCount = 0
+}
+
+func (m *ppmModel) insertNode(p uint32, indx int) {
+	m.setU32(p, m.freeList[indx])
+	m.freeList[indx] = p
+}
+
+func (m *ppmModel) removeNode(indx int) uint32 {
+	p := m.freeList[indx]
+	m.freeList[indx] = m.u32(p)
+	return p
+}
+
+func (m *ppmModel) splitBlock(p uint32, oldIndx, newIndx int) {
+	diff := indx2Units[oldIndx] - indx2Units[newIndx]
+	p += unitSize * indx2Units[newIndx]
+	if i := units2Indx[diff-1]; indx2Units[i] != diff {
+		i--
+		m.insertNode(p, i)
+		p += unitSize * indx2Units[i]
+		diff -= indx2Units[i]
+	}
+	m.insertNode(p, units2Indx[diff-1])
+}
+
+// glueFreeBlocks merges the adjacent free blocks. The free blocks are linked through the sentinel
+// at the offset 0, with a stamp and their number of units at 0, and the links at 4 and 8.
+func (m *ppmModel) glueFreeBlocks() {
+	next := func(p uint32) uint32 { return m.u32(p + 4) }
+	prev := func(p uint32) uint32 { return m.u32(p + 8) }
+	remove := func(p uint32) {
+		m.setU32(prev(p)+4, next(p))
+		m.setU32(next(p)+8, prev(p))
+	}
+	if m.loUnit != m.hiUnit {
+		m.heap[m.loUnit] = 0
+	}
+	m.setU32(4, 0)
+	m.setU32(8, 0)
+	for i := range m.freeList {
+		for m.freeList[i] != 0 {
+			p := m.removeNode(i)
+			m.setU32(p+4, next(0))
+			m.setU32(p+8, 0)
+			m.setU32(next(0)+8, p)
+			m.setU32(4, p)
+			m.setU16(p, 0xffff)
+			m.setU16(p+2, uint16(indx2Units[i]))
+		}
+	}
+	for p := next(0); p != 0; p = next(p) {
+		for {
+			q := p + unitSize*uint32(m.u16(p+2))
+			if m.u16(q) != 0xffff || int(m.u16(p+2))+int(m.u16(q+2)) >= 0x10000 {
+				break
+			}
+			remove(q)
+			m.setU16(p+2, m.u16(p+2)+m.u16(q+2))
+		}
+	}
+	for p := next(0); p != 0; p = next(0) {
+		remove(p)
+		n := uint32(m.u16(p + 2))
+		for ; n > 128; n -= 128 {
+			m.insertNode(p, nIndexes-1)
+			p += unitSize * 128
+		}
+		i := units2Indx[n-1]
+		if indx2Units[i] != n {
+			i--
+			k := n - indx2Units[i]
+			m.insertNode(p+unitSize*(n-k), int(k-1))
+		}
+		m.insertNode(p, i)
+	}
+}
+
+func (m *ppmModel) allocUnitsRare(indx int) uint32 {
+	if m.glueCount == 0 {
+		m.glueCount = 255
+		m.glueFreeBlocks()
+		if m.freeList[indx] != 0 {
+			return m.removeNode(indx)
+		}
+	}
+	i := indx
+	for {
+		if i++; i == nIndexes {
+			// the units are taken from the text area
+			m.glueCount--
+			n := unitSize * indx2Units[indx]
+			if int64(m.unitsStart)-int64(m.text) > int64(n) {
+				m.unitsStart -= n
+				return m.unitsStart
+			}
+			return 0
+		}
+		if m.freeList[i] != 0 {
+			break
+		}
+	}
+	p := m.removeNode(i)
+	m.splitBlock(p, i, indx)
+	return p
+}
+
+func (m *ppmModel) allocUnits(n uint32) uint32 {
+	indx := units2Indx[n-1]
+	if m.freeList[indx] != 0 {
+		return m.removeNode(indx)
+	}
+	p := m.loUnit
+	m.loUnit += unitSize * indx2Units[indx]
+	if m.loUnit <= m.hiUnit {
+		return p
+	}
+	m.loUnit -= unitSize * indx2Units[indx]
+	return m.allocUnitsRare(indx)
+}
+
+func (m *ppmModel) allocContext() uint32 {
+	if m.hiUnit != m.loUnit {
+		m.hiUnit -= unitSize
+		return m.hiUnit
+	}
+	if m.freeList[0] != 0 {
+		return m.removeNode(0)
+	}
+	return m.allocUnitsRare(0)
+}
+
+func (m *ppmModel) expandUnits(old, n uint32) uint32 {
+	i0, i1 := units2Indx[n-1], units2Indx[n]
+	if i0 == i1 {
+		return old
+	}
+	p := m.allocUnits(n + 1)
+	if p != 0 {
+		copy(m.heap[p:p+unitSize*n], m.heap[old:old+unitSize*n])
+		m.insertNode(old, i0)
+	}
+	return p
+}
+
+func (m *ppmModel) shrinkUnits(old, n, newN uint32) uint32 {
+	i0, i1 := units2Indx[n-1], units2Indx[newN-1]
+	if i0 == i1 {
+		return old
+	}
+	if m.freeList[i1] != 0 {
+		p := m.removeNode(i1)
+		copy(m.heap[p:p+unitSize*newN], m.heap[old:old+unitSize*newN])
+		m.insertNode(old, i0)
+		return p
+	}
+	m.splitBlock(old, i0, i1)
+	return old
+}
+
+func (m *ppmModel) freeUnits(p, n uint32) {
+	m.insertNode(p, units2Indx[n-1])
+}
+
+// The model.
+
+func (m *ppmModel) startModel(order int) {
+	m.escCount = 1
+	m.maxOrder = order
+	m.restartModel()
+	m.ns2BSIndx[0], m.ns2BSIndx[1] = 0, 2
+	for i := 2; i < 256; i++ {
+		m.ns2BSIndx[i] = 6
+		if i < 11 {
+			m.ns2BSIndx[i] = 4
+		}
+	}
+	for i := 0; i < 3; i++ {
+		m.ns2Indx[i] = byte(i)
+	}
+	for i, n, k, step := 3, byte(3), 1, 1; i < 256; i++ {
+		m.ns2Indx[i] = n
+		if k--; k == 0 {
+			step++
+			k = step
+			n++
+		}
+	}
+	for i := range m.hb2Flag {
+		m.hb2Flag[i] = 0
+		if i >= 0x40 {
+			m.hb2Flag[i] = 8
+		}
+	}
+	m.dummySEE2.shift = periodBit
+}
+
+func (m *ppmModel) restartModel() {
+	m.charMask = [256]byte{}
+	m.initSubAllocator()
+	m.initRL = -int32(min(m.maxOrder, 12)) - 1
+	c := m.allocContext()
+	m.minContext, m.maxContext = c, c
+	m.setSuffix(c, 0)
+	m.orderFall = m.maxOrder
+	m.setNumStats(c, 256)
+	m.setSummFreq(c, 257)
+	s := m.allocUnits(256 / 2)
+	m.foundState = s
+	m.setStats(c, s)
+	m.runLength, m.prevSuccess = m.initRL, 0
+	for i := uint32(0); i < 256; i++ {
+		p := s + i*stateSize
+		m.heap[p] = byte(i)
+		m.setFreq(p, 1)
+		m.setSuccessor(p, 0)
+	}
+	for i := range m.binSumm {
+		for k, esc := range initBinEsc {
+			for j := 0; j < 64; j += 8 {
+				m.binSumm[i][k+j] = binScale - esc/uint16(i+2)
+			}
+		}
+	}
+	for i := range m.see2 {
+		for k := range m.see2[i] {
+			m.see2[i][k].init(5*i + 10)
+		}
+	}
+}
+
+func (m *ppmModel) clearMask() {
+	m.escCount = 1
+	m.charMask = [256]byte{}
+}
+
+func (m *ppmModel) decodeBinSymbol() {
+	c := m.minContext
+	s := c + 2
+	m.hiBitsFlag = int(m.hb2Flag[m.heap[m.foundState]])
+	bs := &m.binSumm[m.freq(s)-1][m.prevSuccess+int(m.ns2BSIndx[m.numStats(m.suffix(c))-1])+
+		m.hiBitsFlag+2*int(m.hb2Flag[m.heap[s]])+int(m.runLength>>26&0x20)]
+	if m.currentShiftCount(14) < uint32(*bs) {
+		m.foundState = s
+		if f := m.freq(s); f < 128 {
+			m.setFreq(s, f+1)
+		}
+		m.lowCount, m.highCount = 0, uint32(*bs)
+		*bs += interval - (*bs+32)>>periodBit
+		m.prevSuccess = 1
+		m.runLength++
+		return
+	}
+	m.lowCount = uint32(*bs)
+	*bs -= (*bs + 32) >> periodBit
+	m.highCount = binScale
+	m.initEsc = expEscape[*bs>>10]
+	m.numMasked = 1
+	m.charMask[m.heap[s]] = m.escCount
+	m.prevSuccess = 0
+	m.foundState = 0
+}
+
+func (m *ppmModel) decodeSymbol1() bool {
+	c := m.minContext
+	m.scale = uint32(m.summFreq(c))
+	p := m.stats(c)
+	count := m.currentCount()
+	if count >= int32(m.scale) {
+		return false
+	}
+	hi := int32(m.freq(p))
+	if count < hi {
+		m.highCount = uint32(hi)
+		m.prevSuccess = 0
+		if 2*m.highCount > m.scale {
+			m.prevSuccess = 1
+		}
+		m.runLength += int32(m.prevSuccess)
+		m.foundState = p
+		hi += 4
+		m.setFreq(p, byte(hi))
+		m.addSummFreq(c, 4)
+		if hi > maxFreq {
+			m.rescale(c)
+		}
+		m.lowCount = 0
+		return true
+	}
+	if m.foundState == 0 {
+		return false
+	}
+	m.prevSuccess = 0
+	for i := m.numStats(c) - 1; ; {
+		p += stateSize
+		if hi += int32(m.freq(p)); hi > count {
+			break
+		}
+		if i--; i == 0 {
+			// an escape: all the symbols of the context are masked
+			m.hiBitsFlag = int(m.hb2Flag[m.heap[m.foundState]])
+			m.lowCount = uint32(hi)
+			m.charMask[m.heap[p]] = m.escCount
+			m.numMasked = int(m.numStats(c))
+			for i := m.numMasked - 1; i > 0; i-- {
+				p -= stateSize
+				m.charMask[m.heap[p]] = m.escCount
+			}
+			m.foundState = 0
+			m.highCount = m.scale
+			return true
+		}
+	}
+	m.highCount = uint32(hi)
+	m.lowCount = m.highCount - uint32(m.freq(p))
+	m.update1(c, p)
+	return true
+}
+
+func (m *ppmModel) update1(c, p uint32) {
+	m.foundState = p
+	m.setFreq(p, m.freq(p)+4)
+	m.addSummFreq(c, 4)
+	if m.freq(p) > m.freq(p-stateSize) {
+		m.swapStates(p, p-stateSize)
+		p -= stateSize
+		m.foundState = p
+		if m.freq(p) > maxFreq {
+			m.rescale(c)
+		}
+	}
+}
+
+func (m *ppmModel) decodeSymbol2() bool {
+	c := m.minContext
+	ns := int(m.numStats(c))
+	see := m.makeEscFreq2(c, ns-m.numMasked)
+	var ps [256]uint32
+	n, hi := 0, int32(0)
+	p := m.stats(c) - stateSize
+	for i := ns - m.numMasked; ; {
+		for {
+			p += stateSize
+			if m.charMask[m.heap[p]] != m.escCount {
+				break
+			}
+		}
+		hi += int32(m.freq(p))
+		if n == len(ps) {
+			return false
+		}
+		ps[n] = p
+		n++
+		if i--; i == 0 {
+			break
+		}
+	}
+	m.scale += uint32(hi)
+	count := m.currentCount()
+	if count >= int32(m.scale) {
+		return false
+	}
+	if count >= hi {
+		// an escape
+		m.lowCount, m.highCount = uint32(hi), m.scale
+		for _, p := range ps[:ns-m.numMasked] {
+			m.charMask[m.heap[p]] = m.escCount
+		}
+		see.summ += uint16(m.scale)
+		m.numMasked = ns
+		return true
+	}
+	hi = 0
+	for i := 0; ; i++ {
+		if i == n {
+			return false
+		}
+		p = ps[i]
+		if hi += int32(m.freq(p)); hi > count {
+			break
+		}
+	}
+	m.highCount = uint32(hi)
+	m.lowCount = m.highCount - uint32(m.freq(p))
+	see.update()
+	m.update2(c, p)
+	return true
+}
+
+func (m *ppmModel) makeEscFreq2(c uint32, diff int) *see2Context {
+	ns := int(m.numStats(c))
+	if ns == 256 {
+		m.scale = 1
+		return &m.dummySEE2
+	}
+	i := m.hiBitsFlag
+	if diff < int(m.numStats(m.suffix(c)))-ns {
+		i++
+	}
+	if int(m.summFreq(c)) < 11*ns {
+		i += 2
+	}
+	if m.numMasked > diff {
+		i += 4
+	}
+	see := &m.see2[m.ns2Indx[diff-1]][i]
+	m.scale = see.mean()
+	return see
+}
+
+func (m *ppmModel) update2(c, p uint32) {
+	m.foundState = p
+	m.setFreq(p, m.freq(p)+4)
+	m.addSummFreq(c, 4)
+	if m.freq(p) > maxFreq {
+		m.rescale(c)
+	}
+	m.escCount++
+	m.runLength = m.initRL
+}
+
+func (m *ppmModel) rescale(c uint32) {
+	oldNS := uint32(m.numStats(c))
+	stats := m.stats(c)
+	for p := m.foundState; p != stats; p -= stateSize {
+		m.swapStates(p, p-stateSize)
+	}
+	m.setFreq(stats, m.freq(stats)+4)
+	m.addSummFreq(c, 4)
+	escFreq := int(m.summFreq(c)) - int(m.freq(stats))
+	adder := 0
+	if m.orderFall != 0 {
+		adder = 1
+	}
+	p := stats
+	m.setFreq(p, byte((int(m.freq(p))+adder)>>1))
+	sum := uint16(m.freq(p))
+	for i := oldNS - 1; i > 0; i-- {
+		p += stateSize
+		escFreq -= int(m.freq(p))
+		m.setFreq(p, byte((int(m.freq(p))+adder)>>1))
+		sum += uint16(m.freq(p))
+		if m.freq(p) > m.freq(p-stateSize) {
+			// keeps the states sorted by frequency
+			var t [stateSize]byte
+			copy(t[:], m.heap[p:p+stateSize])
+			q := p
+			for {
+				m.copyState(q, q-stateSize)
+				if q -= stateSize; q == stats || t[1] <= m.freq(q-stateSize) {
+					break
+				}
+			}
+			copy(m.heap[q:q+stateSize], t[:])
+		}
+	}
+	m.setSummFreq(c, sum)
+	if m.freq(p) == 0 {
+		i := 0
+		for {
+			i++
+			if p -= stateSize; m.freq(p) != 0 {
+				break
+			}
+		}
+		escFreq += i
+		m.setNumStats(c, uint16(int(oldNS)-i))
+		if m.numStats(c) == 1 {
+			var t [stateSize]byte
+			copy(t[:], m.heap[stats:stats+stateSize])
+			for {
+				t[1] -= t[1] >> 1
+				if escFreq >>= 1; escFreq <= 1 {
+					break
+				}
+			}
+			m.freeUnits(stats, (oldNS+1)>>1)
+			m.foundState = c + 2
+			copy(m.heap[c+2:c+2+stateSize], t[:])
+			return
+		}
+	}
+	escFreq -= escFreq >> 1
+	m.addSummFreq(c, uint32(escFreq))
+	n0, n1 := (oldNS+1)>>1, (uint32(m.numStats(c))+1)>>1
+	if n0 != n1 {
+		m.setStats(c, m.shrinkUnits(stats, n0, n1))
+	}
+	m.foundState = m.stats(c)
+}
+
+func (m *ppmModel) createChild(c, s uint32, symbol, freq byte, successor uint32) uint32 {
+	p := m.allocContext()
+	if p != 0 {
+		m.setNumStats(p, 1)
+		m.heap[p+2] = symbol
+		m.setFreq(p+2, freq)
+		m.setSuccessor(p+2, successor)
+		m.setSuffix(p, c)
+		m.setSuccessor(s, p)
+	}
+	return p
+}
+
+// createSuccessors creates the contexts following the found state, returning 0 when the memory is
+// exhausted.
+func (m *ppmModel) createSuccessors(skip bool, p1 uint32) uint32 {
+	c := m.minContext
+	up := m.successor(m.foundState)
+	symbol := m.heap[m.foundState]
+	var ps [maxO]uint32
+	n := 0
+	loop := true
+	if !skip {
+		ps[n] = m.foundState
+		n++
+		loop = m.suffix(c) != 0
+	}
+	for loop {
+		var p uint32
+		c = m.suffix(c)
+		switch {
+		case p1 != 0:
+			p, p1 = p1, 0
+		case m.numStats(c) != 1:
+			for p = m.stats(c); m.heap[p] != symbol; p += stateSize {
+			}
+		default:
+			p = c + 2
+		}
+		if m.successor(p) != up {
+			c = m.successor(p)
+			break
+		}
+		if n == len(ps) {
+			return 0
+		}
+		ps[n] = p
+		n++
+		loop = m.suffix(c) != 0
+	}
+	if n == 0 {
+		return c
+	}
+	// the successor in the text area is the symbol following the context
+	upSymbol, upSuccessor := m.heap[up], up+1
+	var upFreq byte
+	if m.numStats(c) != 1 {
+		if c <= m.text {
+			return 0
+		}
+		p := m.stats(c)
+		for m.heap[p] != upSymbol {
+			if p += stateSize; p >= m.heapEnd {
+				return 0
+			}
+		}
+		cf := uint32(m.freq(p)) - 1
+		s0 := uint32(m.summFreq(c)) - uint32(m.numStats(c)) - cf
+		if 2*cf <= s0 {
+			upFreq = 1
+			if 5*cf > s0 {
+				upFreq = 2
+			}
+		} else {
+			upFreq = byte(1 + (2*cf+3*s0-1)/(2*s0))
+		}
+	} else {
+		upFreq = m.freq(c + 2)
+	}
+	for n > 0 {
+		n--
+		if c = m.createChild(c, ps[n], upSymbol, upFreq, upSuccessor); c == 0 {
+			return 0
+		}
+	}
+	return c
+}
+
+// updateModel updates the model with the found state, restarting it when the memory is
+// exhausted.
+func (m *ppmModel) updateModel() {
+	if !m.update() {
+		m.restartModel()
+		m.escCount = 0
+	}
+}
+
+func (m *ppmModel) update() bool {
+	fs := m.foundState
+	symbol, freq, successor := m.heap[fs], m.freq(fs), m.successor(fs)
+	var p uint32
+	if c := m.suffix(m.minContext); freq < maxFreq/4 && c != 0 {
+		if m.numStats(c) != 1 {
+			if p = m.stats(c); m.heap[p] != symbol {
+				for {
+					if p += stateSize; m.heap[p] == symbol {
+						break
+					}
+				}
+				if m.freq(p) >= m.freq(p-stateSize) {
+					m.swapStates(p, p-stateSize)
+					p -= stateSize
+				}
+			}
+			if m.freq(p) < maxFreq-9 {
+				m.setFreq(p, m.freq(p)+2)
+				m.addSummFreq(c, 2)
+			}
+		} else {
+			p = c + 2
+			if m.freq(p) < 32 {
+				m.setFreq(p, m.freq(p)+1)
+			}
+		}
+	}
+	if m.orderFall == 0 {
+		c := m.createSuccessors(true, p)
+		m.minContext, m.maxContext = c, c
+		m.setSuccessor(m.foundState, c)
+		return c != 0
+	}
+	m.heap[m.text] = symbol
+	m.text++
+	next := m.text
+	if m.text >= m.unitsStart {
+		return false
+	}
+	if successor != 0 {
+		if successor <= m.text {
+			if successor = m.createSuccessors(false, p); successor == 0 {
+				return false
+			}
+		}
+		if m.orderFall--; m.orderFall == 0 {
+			next = successor
+			if m.maxContext != m.minContext {
+				m.text--
+			}
+		}
+	} else {
+		m.setSuccessor(m.foundState, next)
+		successor = m.minContext
+	}
+	ns := uint32(m.numStats(m.minContext))
+	s0 := uint32(m.summFreq(m.minContext)) - ns - (uint32(freq) - 1)
+	for c := m.maxContext; c != m.minContext; c = m.suffix(c) {
+		ns1 := uint32(m.numStats(c))
+		if ns1 != 1 {
+			if ns1&1 == 0 {
+				s := m.expandUnits(m.stats(c), ns1>>1)
+				if s == 0 {
+					return false
+				}
+				m.setStats(c, s)
+			}
+			sf := uint32(m.summFreq(c))
+			if 2*ns1 < ns {
+				m.addSummFreq(c, 1)
+			}
+			if 4*ns1 <= ns && sf <= 8*ns1 {
+				m.addSummFreq(c, 2)
+			}
+		} else {
+			s := m.allocUnits(1)
+			if s == 0 {
+				return false
+			}
+			m.copyState(s, c+2)
+			m.setStats(c, s)
+			if f := m.freq(s); f < maxFreq/4-1 {
+				m.setFreq(s, 2*f)
+			} else {
+				m.setFreq(s, maxFreq-4)
+			}
+			sf := uint32(m.freq(s)) + uint32(m.initEsc)
+			if ns > 3 {
+				sf++
+			}
+			m.setSummFreq(c, uint16(sf))
+		}
+		cf := 2 * uint32(freq) * (uint32(m.summFreq(c)) + 6)
+		sf := s0 + uint32(m.summFreq(c))
+		if cf < 6*sf {
+			cf = 1 + b2u(cf > sf) + b2u(cf >= 4*sf)
+			m.addSummFreq(c, 3)
+		} else {
+			cf = 4 + b2u(cf >= 9*sf) + b2u(cf >= 12*sf) + b2u(cf >= 15*sf)
+			m.addSummFreq(c, cf)
+		}
+		s := m.stats(c) + ns1*stateSize
+		m.heap[s] = symbol
+		m.setFreq(s, byte(cf))
+		m.setSuccessor(s, next)
+		m.setNumStats(c, uint16(ns1+1))
+	}
+	m.minContext, m.maxContext = successor, successor
+	return true
+}
+
+func b2u(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
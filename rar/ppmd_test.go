@@ -0,0 +1,299 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rar
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// ppmEncoder compresses the PPMd blocks of the RAR 2.9 format with the model of the decoder: the
+// state of its range decoder is set for the model to find the symbol to encode.
+type ppmEncoder struct {
+	m      ppmModel
+	escape byte
+	// the range encoder
+	low, rng uint32
+	out      []byte
+}
+
+// start writes the header of a block of the model of the order and of mb+1 MB, or continuing the
+// model if order is zero, and starts the range encoder.
+func (e *ppmEncoder) start(w *bitWriter, order, mb int, escape byte) {
+	w.align()
+	flags := byte(0x80 | 0x40)
+	hdr := []byte{flags}
+	if order != 0 {
+		if order > 16 {
+			order = 16 + (order-16+2)/3
+		}
+		hdr = append(hdr, byte(mb))
+		hdr[0] |= 0x20 | byte(order-1)
+	}
+	hdr = append(hdr, escape)
+	for _, c := range hdr {
+		w.bits(uint64(c), 8)
+	}
+	if err := e.m.init(newBitReader(bytes.NewReader(append(hdr, 0, 0, 0, 0))), &e.escape, -1); err != nil {
+		panic(err)
+	}
+	e.low, e.rng, e.out = 0, 0xffffffff, nil
+}
+
+// end encodes the escape code and flushes the range encoder.
+func (e *ppmEncoder) end(w *bitWriter, code byte) {
+	e.encodeChar(e.escape)
+	e.encodeChar(code)
+	for i := 0; i < 4; i++ {
+		e.out = append(e.out, byte(e.low>>24))
+		e.low <<= 8
+	}
+	for _, c := range e.out {
+		w.bits(uint64(c), 8)
+	}
+}
+
+// literals encodes the bytes of data, the repetitions of a byte as runs.
+func (e *ppmEncoder) literals(data []byte) {
+	for i := 0; i < len(data); {
+		c := data[i]
+		e.encodeChar(c)
+		if c == e.escape {
+			e.encodeChar(1)
+		}
+		i++
+		n := 0
+		for i+n < len(data) && data[i+n] == c && n < 255+4 {
+			n++
+		}
+		if n >= 4 {
+			e.encodeChar(e.escape)
+			e.encodeChar(5)
+			e.encodeChar(byte(n - 4))
+			i += n
+		}
+	}
+}
+
+// match encodes a match of dist >= 2 and length >= 32.
+func (e *ppmEncoder) match(dist, length int) {
+	dist -= 2
+	for _, c := range []byte{e.escape, 4, byte(dist >> 16), byte(dist >> 8), byte(dist), byte(length - 32)} {
+		e.encodeChar(c)
+	}
+}
+
+func (e *ppmEncoder) encode(lowCount, highCount, scale uint32) {
+	e.rng /= scale
+	e.low += lowCount * e.rng
+	e.rng *= highCount - lowCount
+	for {
+		if e.low^(e.low+e.rng) >= rangeTop {
+			if e.rng >= rangeBot {
+				return
+			}
+			e.rng = -e.low & (rangeBot - 1)
+		}
+		e.out = append(e.out, byte(e.low>>24))
+		e.rng <<= 8
+		e.low <<= 8
+	}
+}
+
+// encodeChar encodes c as decodeChar decodes it.
+func (e *ppmEncoder) encodeChar(c byte) {
+	m := &e.m
+	if ctx := m.minContext; m.numStats(ctx) != 1 {
+		count := uint32(0)
+		p := m.stats(ctx)
+		for i := 0; i < int(m.numStats(ctx)) && m.heap[p] != c; i++ {
+			count += uint32(m.freq(p))
+			p += stateSize
+		}
+		scale := uint32(m.summFreq(ctx))
+		m.low, m.rng, m.code = 0, scale, count
+		m.decodeSymbol1()
+		e.encode(m.lowCount, m.highCount, scale)
+	} else {
+		m.low, m.rng, m.code = 0, binScale, 0
+		if m.heap[ctx+2] != c {
+			m.code = binScale - 1
+		}
+		m.decodeBinSymbol()
+		e.encode(m.lowCount, m.highCount, binScale)
+	}
+	for m.foundState == 0 {
+		for {
+			m.orderFall++
+			m.minContext = m.suffix(m.minContext)
+			if int(m.numStats(m.minContext)) != m.numMasked {
+				break
+			}
+		}
+		ctx := m.minContext
+		var hi, count uint32
+		found := false
+		p := m.stats(ctx)
+		for i := 0; i < int(m.numStats(ctx)); i, p = i+1, p+stateSize {
+			if m.charMask[m.heap[p]] == m.escCount {
+				continue
+			}
+			if m.heap[p] == c {
+				count, found = hi, true
+			}
+			hi += uint32(m.freq(p))
+		}
+		if !found {
+			count = hi
+		}
+		see2, dummy := m.see2, m.dummySEE2
+		m.makeEscFreq2(ctx, int(m.numStats(ctx))-m.numMasked)
+		scale := m.scale + hi
+		m.see2, m.dummySEE2 = see2, dummy
+		m.low, m.rng, m.code = 0, scale, count
+		m.decodeSymbol2()
+		e.encode(m.lowCount, m.highCount, m.scale)
+	}
+	if s := m.successor(m.foundState); m.orderFall == 0 && s > m.text {
+		m.minContext, m.maxContext = s, s
+	} else {
+		m.updateModel()
+		if m.escCount == 0 {
+			m.clearMask()
+		}
+	}
+}
+
+// ppmData returns data compressing well with PPMd, with runs and the escape byte.
+func ppmData(seed int64, n int) []byte {
+	b := testData(seed, n)
+	for i := 0; i+300 < len(b); i += 5000 {
+		copy(b[i:], bytes.Repeat([]byte{b[i]}, i%300))
+		b[i+1] = 2
+	}
+	return b
+}
+
+func TestDecompressPPM(t *testing.T) {
+	text := ppmData(1, 200<<10)
+	random := testData(8, 300<<10)
+	rnd := random[:0]
+	for i, c := range random {
+		if i%3 != 0 {
+			rnd = append(rnd, c^byte(i*i>>5))
+		}
+	}
+	tests := []struct {
+		name   string
+		data   []byte
+		order  int
+		mb     int
+		escape byte
+	}{
+		{name: "order 2", data: text, order: 2, mb: 4, escape: 2},
+		{name: "order 6", data: text, order: 6, mb: 16, escape: 'e'},
+		{name: "order 64", data: text, order: 64, mb: 40, escape: 0},
+		// data exhausting the memory of the model, which restarts
+		{name: "restart", data: text, order: 64, mb: 0, escape: 2},
+		{name: "random", data: rnd, order: 16, mb: 0, escape: 2},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var w bitWriter
+			var e ppmEncoder
+			e.start(&w, tc.order, tc.mb, tc.escape)
+			e.literals(tc.data)
+			e.end(&w, 2)
+			archive := rar4(entry{name: "a", data: string(tc.data), method: 3, packed: w.buf})
+			data, errs := readAll(t, archive, nil)
+			if errs[0] != nil {
+				t.Fatalf("Read() error = %v", errs[0])
+			}
+			if !bytes.Equal(data[0], tc.data) {
+				t.Errorf("Read() = %d bytes differing from the %d bytes of the entry", len(data[0]), len(tc.data))
+			}
+		})
+	}
+}
+
+func TestDecompressPPMBlocks(t *testing.T) {
+	text := ppmData(1, 100<<10)
+	more := ppmData(2, 50<<10)
+	// an entry of PPMd and LZ blocks, with a match
+	var w bitWriter
+	var e ppmEncoder
+	e.start(&w, 8, 1, 2)
+	e.literals(text)
+	e.match(1000, 100)
+	e.end(&w, 0)
+	mixed := append(append(bytes.Clone(text), text[len(text)-1000:][:100]...), more...)
+	e29 := &encoder29{}
+	packed := append(w.buf, e29.compress(more)...)
+
+	// an entry continuing the model of the previous one
+	w = bitWriter{}
+	e.start(&w, 0, 0, 'x')
+	e.literals(more)
+	e.end(&w, 2)
+
+	archive := rar4(
+		entry{name: "a", data: string(mixed), method: 3, packed: packed},
+		entry{name: "b", data: string(more), method: 3, packed: w.buf, solid: true},
+	)
+	data, errs := readAll(t, archive, nil)
+	for i, want := range [][]byte{mixed, more} {
+		if errs[i] != nil {
+			t.Errorf("entry %d: Read() error = %v", i, errs[i])
+		} else if !bytes.Equal(data[i], want) {
+			t.Errorf("entry %d: Read() = %d bytes differing from the %d bytes of the entry", i, len(data[i]), len(want))
+		}
+	}
+}
+
+func TestDecompressPPMErrors(t *testing.T) {
+	text := ppmData(1, 10000)
+	packed := func(order, mb int) []byte {
+		var w bitWriter
+		var e ppmEncoder
+		e.start(&w, max(order, 2), mb, 2)
+		e.literals(text)
+		e.end(&w, 2)
+		if order == 1 {
+			w.buf[0] &^= 0x1f
+		}
+		return w.buf
+	}
+	tests := []struct {
+		name    string
+		packed  []byte
+		setup   func(r *Reader)
+		wantErr error
+	}{
+		{name: "memory", packed: packed(4, 8), setup: func(r *Reader) { r.SetMaxDictionarySize(8 << 20) }, wantErr: ErrLimitExceeded},
+		{name: "order 1", packed: packed(1, 0), wantErr: ErrCorrupt},
+		{name: "no model", packed: []byte{0x80, 0, 0, 0, 0}, wantErr: ErrCorrupt},
+		{name: "truncated", packed: packed(4, 0)[:2000], wantErr: ErrCorrupt},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			archive := rar4(entry{name: "a", data: string(text), method: 3, packed: tc.packed})
+			_, errs := readAll(t, archive, tc.setup)
+			if !errors.Is(errs[0], tc.wantErr) {
+				t.Errorf("Read() error = %v, want %v", errs[0], tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,879 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rar reads RAR archives (the RAR 1.5-4.x and the RAR 5.0 formats) with the security focus
+// of the tar and zip packages, so malware analysis and upload pipelines can inspect them without
+// shelling out to unrar.
+//
+// The names of the entries are sanitized like the names of the entries of the other formats, and
+// the security features control the links of the archive (symbolic links, Windows junctions, hard
+// links and file copies) and the NTFS alternate data streams, which the other formats do not
+// have. The dictionary size of the entries, which bounds the memory needed to decompress them (for
+// the whole archive if it is solid), may be limited along with their sizes:
+//
+//	r, err := rar.NewReader(f)
+//	if err != nil {
+//		return err
+//	}
+//	r.SetMaxDictionarySize(64 << 20)
+//	for {
+//		h, err := r.Next()
+//		if err == io.EOF {
+//			break
+//		}
+//		...
+//	}
+//
+// The data of the entries is decompressed (see Header.Method) and checked against its CRC32. The
+// algorithms of RAR 2.9 (LZ and PPMd, with the standard filters) and RAR 5.0 are implemented:
+// reading the entries compressed by the older versions fails with ErrAlgorithm, as does reading
+// the entries encrypted (ErrEncryptedEntry) or split across volumes (ErrMultiVolume). Their headers
+// are read and checked still. Archives with encrypted headers cannot be read.
+//
+// The decompression honors the dictionary size of the entries, which bounds the distances of its
+// matches, and the memory of the PPMd models is limited like the dictionary size. The entries of
+// the solid archives are decompressed in order, including the ones skipped by Next: reading an
+// entry whose solid stream was broken by an earlier entry fails with ErrCorrupt.
+package rar
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/internal/limits"
+	"github.com/google/safearchive/sanitizer"
+)
+
+const (
+	// Magic4 is the signature of the archives of the RAR 1.5-4.x format, and Magic5 the one of
+	// the RAR 5.0 format.
+	Magic4 = "Rar!\x1a\x07\x00"
+	Magic5 = "Rar!\x1a\x07\x01\x00"
+	// DefaultMaxDictionarySize is the limit of the dictionary size of the entries of the Readers
+	// whose limit was not set, see SetMaxDictionarySize.
+	DefaultMaxDictionarySize = 256 << 20
+)
+
+var (
+	// ErrHeader is wrapped by the errors of reading an invalid header, or a file that is not a RAR
+	// archive.
+	ErrHeader = errors.New("rar: invalid header")
+	// ErrAlgorithm is wrapped by the errors of reading an entry compressed by an unsupported
+	// algorithm, e.g. the ones of RAR 1.5-2.0 or the programs of the RAR virtual machine other
+	// than the standard filters.
+	ErrAlgorithm = errors.New("rar: unsupported compression algorithm")
+	// ErrChecksum is returned when reading an entry whose data does not match its CRC32.
+	ErrChecksum = errors.New("rar: checksum error")
+	// ErrCorrupt is wrapped by the errors of reading an entry whose compressed data is invalid.
+	ErrCorrupt = errors.New("rar: corrupt compressed data")
+	// ErrMultiVolume is returned when reading an entry split across the volumes of an archive.
+	ErrMultiVolume = errors.New("rar: entry split across volumes")
+	// ErrEncryptedEntry is returned when reading an encrypted entry, and by NewReader for the
+	// archives with encrypted headers.
+	ErrEncryptedEntry = safearchive.ErrEncryptedEntry
+	// ErrLimitExceeded is wrapped by the errors of Next when the archive exceeds a limit of the
+	// Reader.
+	ErrLimitExceeded = safearchive.ErrLimitExceeded
+)
+
+// ReasonNTFSStream is the reason of the findings about the NTFS alternate data streams dropped by
+// SkipNTFSStreams.
+const ReasonNTFSStream safearchive.Reason = "rar-ntfs-stream"
+
+// ReasonHardLink is the reason of the findings about the hard links and file copies dropped by
+// SkipHardLinks.
+const ReasonHardLink safearchive.Reason = "rar-hard-link"
+
+// LinkType is the type of the link entries.
+type LinkType int
+
+const (
+	// NotLink is the type of the entries that are not links.
+	NotLink LinkType = iota
+	// Symlink is a symbolic link, created on Unix or on Windows.
+	Symlink
+	// Junction is a Windows junction (a directory symbolic link with an absolute target).
+	Junction
+	// HardLink is a hard link to an earlier entry of the archive.
+	HardLink
+	// FileCopy is a copy of an earlier entry of the archive, stored once.
+	FileCopy
+)
+
+// Header describes an entry of a RAR archive.
+type Header struct {
+	// Name is the name of the entry, with forward slashes. For NTFS alternate data streams, it is
+	// the name of the file of the stream.
+	Name string
+	// Stream is the name of the NTFS alternate data stream, e.g. "Zone.Identifier", or empty for
+	// the other entries.
+	Stream string
+	// Link is the type of link of the entry, and Linkname its target. Linkname is empty for the
+	// symbolic links of the RAR 1.5-4.x format whose data, their target, cannot be read, e.g. the
+	// encrypted ones.
+	Link     LinkType
+	Linkname string
+	Mode     fs.FileMode
+	ModTime  time.Time
+	// Size is the size of the data of the entry, or -1 if the archive does not declare it.
+	// PackedSize is the size of the compressed data.
+	Size       int64
+	PackedSize int64
+	// Method is the compression method of the entry, 0 for the stored ones.
+	Method int
+	// DictionarySize is the size of the dictionary needed to decompress the entry.
+	DictionarySize int64
+	// Solid is set if decompressing the entry needs the data of the earlier entries.
+	Solid     bool
+	Encrypted bool
+}
+
+// SecurityMode controls security features to enforce
+type SecurityMode int
+
+const (
+	// SanitizeFilenames will sanitize filenames (dropping .. path components and turning entries
+	// into relative), and the targets of the hard links and file copies. Entries with nothing left
+	// of their name are skipped.
+	// This feature is enabled by default.
+	SanitizeFilenames SecurityMode = 1
+	// PreventSymlinkTraversal skips the entries that would be written through a symbolic link or
+	// a junction of the archive.
+	// This feature is enabled by default.
+	PreventSymlinkTraversal SecurityMode = 2
+	// SkipNTFSStreams skips the NTFS alternate data streams, which may e.g. replace the
+	// Zone.Identifier stream marking the files downloaded from the Internet.
+	// This feature is enabled by default.
+	SkipNTFSStreams SecurityMode = 4
+	// SanitizeSymlinkTargets skips the symbolic links whose target is absolute or escapes the
+	// root of the archive (see sanitizer.SanitizeLinkTarget) or escapes through the links seen
+	// before (see safearchive.SymlinkSet.AddLink), the junctions, and the symbolic links whose
+	// target cannot be read.
+	// This feature is part of MaximumSecurityMode.
+	SanitizeSymlinkTargets SecurityMode = 8
+	// SkipHardLinks skips the hard links and the file copies.
+	// This feature is part of MaximumSecurityMode.
+	SkipHardLinks SecurityMode = 16
+	// SanitizeFileMode will drop special file modes (e.g. setuid and the sticky bit).
+	// This feature is part of MaximumSecurityMode.
+	SanitizeFileMode SecurityMode = 32
+	// SanitizeUnicode strips the characters used to disguise names in listings from the names of
+	// the entries, see sanitizer.IsUnsafeRune.
+	// This feature is part of MaximumSecurityMode.
+	SanitizeUnicode SecurityMode = 64
+	// ValidateNameEncoding checks that the names of the entries are valid UTF-8 without NUL
+	// bytes, as set by the NameEncodingPolicy of the Reader (see SetNameEncodingPolicy).
+	// This feature is part of MaximumSecurityMode.
+	ValidateNameEncoding SecurityMode = 128
+	// StrictMode makes Next fail with a typed error (e.g. ErrPathTraversal) instead of silently
+	// skipping or rewriting entries flagged by the other security features.
+	// This feature is not enabled by default, nor is it part of MaximumSecurityMode.
+	StrictMode SecurityMode = 256
+)
+
+// MaximumSecurityMode enables all features for maximum security.
+const MaximumSecurityMode = SanitizeFilenames | PreventSymlinkTraversal | SkipNTFSStreams | SanitizeSymlinkTargets | SkipHardLinks | SanitizeFileMode | SanitizeUnicode | ValidateNameEncoding
+
+var securityModeNames = []struct {
+	mode SecurityMode
+	name string
+}{
+	{SanitizeFilenames, "SanitizeFilenames"},
+	{PreventSymlinkTraversal, "PreventSymlinkTraversal"},
+	{SkipNTFSStreams, "SkipNTFSStreams"},
+	{SanitizeSymlinkTargets, "SanitizeSymlinkTargets"},
+	{SkipHardLinks, "SkipHardLinks"},
+	{SanitizeFileMode, "SanitizeFileMode"},
+	{SanitizeUnicode, "SanitizeUnicode"},
+	{ValidateNameEncoding, "ValidateNameEncoding"},
+	{StrictMode, "StrictMode"},
+}
+
+// options are the names of the configurable behaviors of the Reader, registered as features.
+var options = []string{
+	"MaxEntries",
+	"MaxEntrySize",
+	"MaxTotalSize",
+	"MaxDictionarySize",
+	"NameEncodingPolicy",
+}
+
+func init() {
+	safearchive.RegisterFeatures(safearchive.Feature{Package: "rar", Kind: safearchive.FeatureFormat, Name: "rar"})
+	for _, m := range securityModeNames {
+		safearchive.RegisterFeatures(safearchive.Feature{Package: "rar", Kind: safearchive.FeatureRule, Name: m.name})
+	}
+	for _, o := range options {
+		safearchive.RegisterFeatures(safearchive.Feature{Package: "rar", Kind: safearchive.FeatureOption, Name: o})
+	}
+}
+
+// String returns the names of the enabled features separated by |.
+func (s SecurityMode) String() string {
+	var names []string
+	for _, m := range securityModeNames {
+		if s&m.mode != 0 {
+			names = append(names, m.name)
+			s &^= m.mode
+		}
+	}
+	if s != 0 {
+		names = append(names, fmt.Sprintf("%#x", int(s)))
+	}
+	if len(names) == 0 {
+		return "0"
+	}
+	return strings.Join(names, "|")
+}
+
+// block is a block of an archive, as read by the parsers of the formats.
+type block struct {
+	// h is the header of the entries, nil for the other blocks.
+	h *Header
+	// dataSize is the size of the data following the header.
+	dataSize int64
+	// crc is the CRC32 of the data of the entry, checked if hasCRC is set.
+	crc    uint32
+	hasCRC bool
+	// split is set for the entries split across volumes.
+	split bool
+	// version is the version of the compression algorithm of the entry, e.g. 29 for RAR 2.9 and
+	// 50 for RAR 5.0.
+	version int
+	// main is set for the main header of the archive, and end for the block terminating it.
+	main, end bool
+	// solid is set in the main header of the solid archives.
+	solid bool
+}
+
+// Reader provides sequential access to the entries of a RAR archive. Reader.Next advances to the
+// next entry (including the first), and then Reader can be treated as an io.Reader to access the
+// data of the entry.
+type Reader struct {
+	r io.Reader
+	// readBlock reads the next block of the format of the archive.
+	readBlock func() (*block, error)
+
+	securityMode      SecurityMode
+	encoding          safearchive.NameEncodingPolicy
+	maxEntrySize      int64
+	maxTotalSize      int64
+	maxEntries        int
+	maxDictionarySize int64
+
+	// file is the name of the last file, the file of the streams following it.
+	file string
+	// err is the sticky error of an invalid header, an exceeded limit or the end of the archive.
+	err error
+	// entries and totalSize are the number and the total size of the entries read so far,
+	// including the skipped ones.
+	entries   int
+	totalSize int64
+	symlinks  safearchive.SymlinkSet
+	targets   safearchive.SymlinkSet
+
+	// pos is the position in the archive, and remaining the number of bytes of the data of the
+	// current block not read yet.
+	pos, remaining int64
+	// solid is set for the solid archives, whose entries are decompressed even when skipped: the
+	// next ones need their data.
+	solid bool
+	// dec decompresses the current entry if unpacking is set, and keeps the state of the solid
+	// stream of the archive, compressed with the algorithm of the version. broken is set when an
+	// entry of the stream was not decompressed.
+	dec       decoder
+	version   int
+	unpacking bool
+	broken    bool
+	// left is the number of decompressed bytes of the current entry not read yet, or -1 if its
+	// size is unknown.
+	left int64
+	// readErr is the error of reading the current entry, e.g. ErrAlgorithm, or nil if its data can
+	// be read. crc is the running CRC32 of its data, checked against want.
+	readErr error
+	crc     hash.Hash32
+	want    *uint32
+	// offset and name are the position and the original name of the current entry.
+	offset int64
+	name   string
+
+	findings []safearchive.Finding
+}
+
+// NewReader creates a new Reader reading from r, and reads the signature and the main header of
+// the archive.
+func NewReader(r io.Reader) (*Reader, error) {
+	rr := &Reader{r: r, securityMode: DefaultSecurityMode}
+	magic := make([]byte, len(Magic5))
+	if err := rr.readFull(magic[:len(Magic4)]); err != nil {
+		return nil, fmt.Errorf("%w: not a RAR archive", ErrHeader)
+	}
+	switch {
+	case string(magic[:len(Magic4)]) == Magic4:
+		rr.readBlock = rr.readBlock4
+	case string(magic[:len(Magic4)]) == Magic5[:len(Magic4)]:
+		if err := rr.readFull(magic[len(Magic4):]); err != nil || string(magic) != Magic5 {
+			return nil, fmt.Errorf("%w: not a RAR archive", ErrHeader)
+		}
+		rr.readBlock = rr.readBlock5
+	default:
+		return nil, fmt.Errorf("%w: not a RAR archive", ErrHeader)
+	}
+	b, err := rr.readBlock()
+	if err != nil {
+		return nil, err
+	}
+	if !b.main {
+		return nil, fmt.Errorf("%w: no main header", ErrHeader)
+	}
+	rr.solid = b.solid
+	return rr, nil
+}
+
+// SetSecurityMode controls the security features applied when reading this archive
+func (rr *Reader) SetSecurityMode(s SecurityMode) {
+	rr.securityMode = s
+}
+
+// GetSecurityMode returns the currently enabled security features
+func (rr *Reader) GetSecurityMode() SecurityMode {
+	return rr.securityMode
+}
+
+// SetNameEncodingPolicy controls what ValidateNameEncoding does with the names that are not valid
+// UTF-8 or have NUL bytes. By default (safearchive.NameEncodingReplace) the invalid bytes are
+// replaced with U+FFFD.
+func (rr *Reader) SetNameEncodingPolicy(p safearchive.NameEncodingPolicy) {
+	rr.encoding = p
+}
+
+// SetMaxEntrySize limits the size of the entries of the archive. Next fails with an error wrapping
+// ErrLimitExceeded when an entry declares a larger size, or no size. Zero (the default) means no
+// limit.
+func (rr *Reader) SetMaxEntrySize(n int64) {
+	rr.maxEntrySize = n
+}
+
+// SetMaxTotalSize limits the total size of the entries of the archive, including the ones skipped
+// by the security features. Next fails with an error wrapping ErrLimitExceeded when an entry would
+// exceed the limit, or declares no size. Zero (the default) means no limit.
+func (rr *Reader) SetMaxTotalSize(n int64) {
+	rr.maxTotalSize = n
+}
+
+// SetMaxEntries limits the number of entries of the archive, including the ones skipped by the
+// security features. Next fails with an error wrapping ErrLimitExceeded when the archive has more
+// entries. Zero (the default) means no limit.
+func (rr *Reader) SetMaxEntries(n int) {
+	rr.maxEntries = n
+}
+
+// SetMaxDictionarySize limits the dictionary size of the entries of the archive, which RAR 5.0
+// allows up to 64GiB: decompressors allocate the dictionary of an entry up front, and keep it
+// across the entries of solid archives. Next fails with an error wrapping ErrLimitExceeded when
+// an entry declares a larger dictionary. The limit applies to the memory of the PPMd models of RAR
+// 2.9 too, which the compressed data declares: reading an entry whose model needs more fails with
+// an error wrapping ErrLimitExceeded. Zero (the default) means DefaultMaxDictionarySize, and a
+// negative value no limit.
+func (rr *Reader) SetMaxDictionarySize(n int64) {
+	rr.maxDictionarySize = n
+}
+
+// Report returns the findings about the entries read so far: every entry that was renamed,
+// sanitized or dropped, along with the reason code of the security feature that flagged it.
+func (rr *Reader) Report() *safearchive.Report {
+	return &safearchive.Report{Findings: append([]safearchive.Finding{}, rr.findings...)}
+}
+
+// flag records a finding about the current entry.
+func (rr *Reader) flag(v safearchive.Verdict) safearchive.Finding {
+	f := safearchive.Finding{Name: rr.name, Offset: rr.offset, Reason: v.Reason, Action: v.Action, Detail: v.Detail}
+	rr.findings = append(rr.findings, f)
+	return f
+}
+
+// Next advances to the next entry of the archive. io.EOF is returned at the end of the archive.
+// Other errors are *safearchive.EntryError values telling which entry failed (e.g. wrapping
+// ErrHeader, ErrLimitExceeded or a rejection of StrictMode). Once the archive had an invalid
+// header or exceeded a limit, Next keeps returning the same error.
+func (rr *Reader) Next() (*Header, error) {
+	if rr.err != nil {
+		return nil, rr.err
+	}
+	h, err := rr.next()
+	if err != nil {
+		if _, ok := err.(*safearchive.EntryError); !ok && err != io.EOF {
+			err = &safearchive.EntryError{Name: rr.name, Offset: rr.offset, Err: err}
+		}
+		rr.remaining, rr.readErr, rr.unpacking = 0, nil, false
+		rr.err = err
+	}
+	return h, err
+}
+
+func (rr *Reader) next() (*Header, error) {
+	for {
+		rr.finish()
+		if err := rr.skip(rr.remaining); err != nil {
+			return nil, err
+		}
+		rr.remaining, rr.readErr, rr.want = 0, nil, nil
+		rr.offset, rr.name = rr.pos, ""
+		b, err := rr.readBlock()
+		if err != nil {
+			return nil, err
+		}
+		if b.end {
+			return nil, io.EOF
+		}
+		rr.remaining = b.dataSize
+		h := b.h
+		if h == nil {
+			continue
+		}
+		rr.name = h.Name
+		if h.Stream == "" {
+			rr.file = h.Name
+		} else {
+			rr.name = h.Name + ":" + h.Stream
+		}
+		switch {
+		case h.Encrypted:
+			rr.readErr = ErrEncryptedEntry
+		case b.split:
+			rr.readErr = ErrMultiVolume
+		}
+		if b.hasCRC {
+			rr.crc, rr.want = crc32.NewIEEE(), &b.crc
+		}
+		if err := rr.checkLimits(h); err != nil {
+			return nil, err
+		}
+		if h.Method != 0 && rr.readErr == nil {
+			rr.readErr = rr.unpack(h, b.version)
+		}
+		if h.Link == Symlink && h.Linkname == "" && rr.readErr == nil {
+			// the target of a symbolic link of the RAR 1.5-4.x format is its data
+			if err := rr.readLinkname(h); err != nil {
+				return nil, err
+			}
+		}
+		start := len(rr.findings)
+		keep, err := rr.applyRules(h)
+		if err != nil {
+			return nil, err
+		}
+		if !keep {
+			continue
+		}
+		if name := rr.entryName(h); name != rr.name {
+			for i := start; i < len(rr.findings); i++ {
+				rr.findings[i].NewName = name
+			}
+		}
+		return h, nil
+	}
+}
+
+// unpack starts decompressing h, compressed with the algorithm of the version.
+func (rr *Reader) unpack(h *Header, version int) error {
+	var newDecoder func() decoder
+	switch version {
+	case 29, 36:
+		newDecoder = func() decoder { return newDecoder29(h.DictionarySize, rr.maxMemory()) }
+	case 50, 70:
+		newDecoder = func() decoder { return newDecoder50(h.DictionarySize, version == 70) }
+	default:
+		return fmt.Errorf("%w: version %d", ErrAlgorithm, version)
+	}
+	solid := h.Solid && rr.dec != nil && rr.version == version
+	switch {
+	case h.Solid && rr.broken:
+		return fmt.Errorf("%w: an earlier entry of the solid archive was not decompressed", ErrCorrupt)
+	case solid:
+		rr.dec.resize(h.DictionarySize)
+	default:
+		rr.dec, rr.version = newDecoder(), version
+	}
+	rr.broken = false
+	rr.dec.reset(bufio.NewReader(packedReader{rr}), h.Size, solid)
+	rr.unpacking, rr.left = true, h.Size
+	return nil
+}
+
+// maxMemory returns the memory the decoders may allocate besides the dictionary, or -1 for no
+// limit.
+func (rr *Reader) maxMemory() int64 {
+	switch {
+	case rr.maxDictionarySize == 0:
+		return DefaultMaxDictionarySize
+	case rr.maxDictionarySize < 0:
+		return -1
+	}
+	return rr.maxDictionarySize
+}
+
+// finish finishes the current entry before the next one: the entries of the solid archives are
+// decompressed to their end, for the next entries to be decompressed.
+func (rr *Reader) finish() {
+	if !rr.unpacking {
+		return
+	}
+	if rr.solid && rr.readErr == nil {
+		io.Copy(io.Discard, rr)
+	}
+	if rr.left != 0 || rr.readErr != nil {
+		rr.dec, rr.broken = nil, true
+	}
+	rr.unpacking = false
+}
+
+// packedReader reads the compressed data of the current entry.
+type packedReader struct {
+	rr *Reader
+}
+
+func (p packedReader) Read(b []byte) (int, error) {
+	rr := p.rr
+	if rr.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > rr.remaining {
+		b = b[:rr.remaining]
+	}
+	n, err := rr.r.Read(b)
+	rr.remaining -= int64(n)
+	rr.pos += int64(n)
+	if err == io.EOF && rr.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// entryName returns the name of h in the findings.
+func (rr *Reader) entryName(h *Header) string {
+	if h.Stream != "" {
+		return h.Name + ":" + h.Stream
+	}
+	return h.Name
+}
+
+// readLinkname reads the target of the symbolic link h from its data.
+func (rr *Reader) readLinkname(h *Header) error {
+	n := rr.remaining
+	if rr.unpacking {
+		n = rr.left
+	}
+	if n <= 0 || n > limits.MaxLinknameLen {
+		return fmt.Errorf("%w: symbolic link target of %d bytes", ErrHeader, n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rr, b); err != nil {
+		return unexpectedEOF(err)
+	}
+	h.Linkname, h.Size = strings.ReplaceAll(string(b), `\`, "/"), 0
+	return nil
+}
+
+// checkLimits accounts h against the limits of the reader, and returns the error to fail Next with
+// if it exceeds one of them.
+func (rr *Reader) checkLimits(h *Header) error {
+	rr.entries++
+	maxDictionary := rr.maxDictionarySize
+	if maxDictionary == 0 {
+		maxDictionary = DefaultMaxDictionarySize
+	}
+	var detail string
+	switch {
+	case rr.maxEntries > 0 && rr.entries > rr.maxEntries:
+		detail = fmt.Sprintf("archive has more than %d entries", rr.maxEntries)
+	case h.Size < 0 && (rr.maxEntrySize > 0 || rr.maxTotalSize > 0):
+		detail = "entry declares no size"
+	case rr.maxEntrySize > 0 && h.Size > rr.maxEntrySize:
+		detail = fmt.Sprintf("entry declares %d bytes, the limit is %d", h.Size, rr.maxEntrySize)
+	case rr.maxTotalSize > 0 && h.Size > rr.maxTotalSize-rr.totalSize:
+		detail = fmt.Sprintf("entries declare more than %d bytes in total", rr.maxTotalSize)
+	case maxDictionary > 0 && h.DictionarySize > maxDictionary:
+		detail = fmt.Sprintf("entry declares a dictionary of %d bytes, the limit is %d", h.DictionarySize, maxDictionary)
+	}
+	if h.Size > 0 {
+		rr.totalSize += h.Size
+	}
+	if detail == "" {
+		return nil
+	}
+	f := rr.flag(safearchive.Verdict{Action: safearchive.ActionRejected, Reason: safearchive.ReasonLimitExceeded, Detail: detail})
+	return f.Err(ErrLimitExceeded)
+}
+
+// applyRules applies the security features on h, until one of them drops or rejects it. It
+// reports whether the entry is to be kept.
+func (rr *Reader) applyRules(h *Header) (bool, error) {
+	names := safearchive.NameChecks{
+		ValidateEncoding: rr.securityMode&ValidateNameEncoding != 0,
+		Encoding:         rr.encoding,
+		SanitizeUnicode:  rr.securityMode&SanitizeUnicode != 0,
+		SanitizePath:     rr.securityMode&SanitizeFilenames != 0,
+	}
+	rules := append(names.Rules(&h.Name),
+		func() safearchive.Verdict { return rr.sanitizeStream(h) },
+		func() safearchive.Verdict { return rr.sanitizeLinkTarget(h) },
+		func() safearchive.Verdict { return rr.skipNTFSStreams(h) },
+		func() safearchive.Verdict { return rr.preventSymlinkTraversal(h) },
+		func() safearchive.Verdict { return rr.sanitizeSymlinkTargets(h) },
+		func() safearchive.Verdict { return rr.skipHardLinks(h) },
+		func() safearchive.Verdict { return rr.sanitizeFileMode(h) },
+		func() safearchive.Verdict { return rr.flagEncryption(h) },
+	)
+	return safearchive.ApplyRules(rules, rr.securityMode&StrictMode != 0, rr.flag)
+}
+
+// sanitizeStream strips the characters disguising the name of the NTFS stream of h.
+func (rr *Reader) sanitizeStream(h *Header) safearchive.Verdict {
+	if rr.securityMode&SanitizeUnicode == 0 || !sanitizer.HasUnsafeRunes(h.Stream) {
+		return safearchive.Pass
+	}
+	h.Stream = sanitizer.StripUnsafeRunes(h.Stream)
+	return safearchive.Verdict{Action: safearchive.ActionModified, Reason: safearchive.ReasonUnsafeUnicode}
+}
+
+// sanitizeLinkTarget sanitizes the targets of hard links and file copies, which are names of
+// entries of the archive.
+func (rr *Reader) sanitizeLinkTarget(h *Header) safearchive.Verdict {
+	if rr.securityMode&SanitizeFilenames == 0 || h.Link != HardLink && h.Link != FileCopy {
+		return safearchive.Pass
+	}
+	target := filepath.ToSlash(sanitizer.SanitizePath(h.Linkname))
+	if target == "" || target == "." {
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.NameReason(h.Linkname), Detail: "target " + h.Linkname}
+	}
+	if target == h.Linkname {
+		return safearchive.Pass
+	}
+	v := safearchive.Verdict{Action: safearchive.ActionModified, Reason: safearchive.NameReason(h.Linkname), Detail: "target " + h.Linkname}
+	h.Linkname = target
+	return v
+}
+
+func (rr *Reader) skipNTFSStreams(h *Header) safearchive.Verdict {
+	if rr.securityMode&SkipNTFSStreams == 0 || h.Stream == "" {
+		return safearchive.Pass
+	}
+	return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: ReasonNTFSStream, Detail: "stream " + h.Stream}
+}
+
+func (rr *Reader) preventSymlinkTraversal(h *Header) safearchive.Verdict {
+	if rr.securityMode&PreventSymlinkTraversal == 0 {
+		return safearchive.Pass
+	}
+	name := strings.TrimSuffix(filepath.ToSlash(sanitizer.SanitizePath(h.Name)), "/")
+	if rr.symlinks.Covers(name) {
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonSymlinkTraversal}
+	}
+	if (h.Link == Symlink || h.Link == Junction) && h.Stream == "" {
+		rr.symlinks.Add(name)
+	}
+	return safearchive.Pass
+}
+
+func (rr *Reader) sanitizeSymlinkTargets(h *Header) safearchive.Verdict {
+	if rr.securityMode&SanitizeSymlinkTargets == 0 {
+		return safearchive.Pass
+	}
+	switch {
+	case h.Link == Junction:
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonSymlinkTarget, Detail: "junction to " + h.Linkname}
+	case h.Link != Symlink:
+		return safearchive.Pass
+	case h.Linkname == "":
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonSymlinkTarget, Detail: "unreadable target"}
+	case sanitizer.SanitizeLinkTarget(h.Name, h.Linkname) != h.Linkname:
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonSymlinkTarget, Detail: "target " + h.Linkname}
+	case !rr.targets.AddLink(strings.TrimSuffix(filepath.ToSlash(sanitizer.SanitizePath(h.Name)), "/"), filepath.ToSlash(h.Linkname)):
+		// the target escapes through the links seen before, or makes one of them escape
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonSymlinkTarget, Detail: "target " + h.Linkname + " escapes through other links"}
+	}
+	return safearchive.Pass
+}
+
+func (rr *Reader) skipHardLinks(h *Header) safearchive.Verdict {
+	if rr.securityMode&SkipHardLinks == 0 || h.Link != HardLink && h.Link != FileCopy {
+		return safearchive.Pass
+	}
+	return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: ReasonHardLink, Detail: "target " + h.Linkname}
+}
+
+func (rr *Reader) sanitizeFileMode(h *Header) safearchive.Verdict {
+	const special = fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+	if rr.securityMode&SanitizeFileMode == 0 || h.Mode&special == 0 {
+		return safearchive.Pass
+	}
+	v := safearchive.Verdict{Action: safearchive.ActionModified, Reason: safearchive.ReasonSpecialMode, Detail: fmt.Sprintf("mode %v changed to %v", h.Mode, h.Mode&^special)}
+	h.Mode &^= special
+	return v
+}
+
+// flagEncryption reports the encrypted entries, whose contents cannot be checked.
+func (rr *Reader) flagEncryption(h *Header) safearchive.Verdict {
+	if !h.Encrypted {
+		return safearchive.Pass
+	}
+	return safearchive.Verdict{Reason: safearchive.ReasonEncrypted}
+}
+
+// Read reads from the current entry of the archive. It returns (0, io.EOF) when it reaches the end
+// of that entry, until Next is called to advance to the next entry.
+//
+// Errors other than io.EOF are *safearchive.EntryError values about the current entry, e.g.
+// wrapping ErrAlgorithm, ErrCorrupt or ErrChecksum.
+func (rr *Reader) Read(b []byte) (int, error) {
+	if rr.readErr != nil {
+		return 0, &safearchive.EntryError{Name: rr.name, Offset: rr.offset, Err: rr.readErr}
+	}
+	if rr.unpacking {
+		return rr.readUnpacked(b)
+	}
+	if rr.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > rr.remaining {
+		b = b[:rr.remaining]
+	}
+	n, err := rr.r.Read(b)
+	rr.remaining -= int64(n)
+	rr.pos += int64(n)
+	if rr.want != nil {
+		rr.crc.Write(b[:n])
+		if rr.remaining == 0 && rr.crc.Sum32() != *rr.want {
+			rr.readErr = ErrChecksum
+			err = ErrChecksum
+		}
+	}
+	if err == io.EOF && rr.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil && err != io.EOF {
+		err = &safearchive.EntryError{Name: rr.name, Offset: rr.offset, Err: err}
+	}
+	return n, err
+}
+
+// readUnpacked reads the decompressed data of the current entry.
+func (rr *Reader) readUnpacked(b []byte) (int, error) {
+	if rr.left == 0 {
+		return 0, io.EOF
+	}
+	if rr.left > 0 && int64(len(b)) > rr.left {
+		b = b[:rr.left]
+	}
+	n, err := rr.dec.Read(b)
+	if rr.left > 0 {
+		rr.left -= int64(n)
+	}
+	if rr.want != nil {
+		rr.crc.Write(b[:n])
+	}
+	switch {
+	case err == io.EOF && rr.left > 0:
+		err = io.ErrUnexpectedEOF
+	case err == io.EOF || err == nil && rr.left == 0:
+		rr.left = 0
+		if rr.want != nil && rr.crc.Sum32() != *rr.want {
+			err = ErrChecksum
+		}
+	}
+	if err != nil && err != io.EOF {
+		rr.readErr = err
+		err = &safearchive.EntryError{Name: rr.name, Offset: rr.offset, Err: err}
+	}
+	return n, err
+}
+
+// readFull reads len(b) bytes of the archive.
+func (rr *Reader) readFull(b []byte) error {
+	n, err := io.ReadFull(rr.r, b)
+	rr.pos += int64(n)
+	return err
+}
+
+// skip discards n bytes of the archive.
+func (rr *Reader) skip(n int64) error {
+	if n == 0 {
+		return nil
+	}
+	k, err := io.CopyN(io.Discard, rr.r, n)
+	rr.pos += k
+	return unexpectedEOF(err)
+}
+
+// unixMode returns the fs.FileMode of the Unix mode m.
+func unixMode(m uint64) fs.FileMode {
+	mode := fs.FileMode(m & 0777)
+	if m&04000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if m&02000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if m&01000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	switch m & 0170000 {
+	case 0140000:
+		mode |= fs.ModeSocket
+	case 0120000:
+		mode |= fs.ModeSymlink
+	case 0060000:
+		mode |= fs.ModeDevice
+	case 0040000:
+		mode |= fs.ModeDir
+	case 0020000:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case 0010000:
+		mode |= fs.ModeNamedPipe
+	}
+	return mode
+}
+
+// windowsMode returns the fs.FileMode of the Windows file attributes a.
+func windowsMode(a uint64, dir bool) fs.FileMode {
+	const (
+		readOnly  = 0x1
+		directory = 0x10
+	)
+	mode := fs.FileMode(0644)
+	if dir || a&directory != 0 {
+		mode = fs.ModeDir | 0755
+	}
+	if a&readOnly != 0 {
+		mode &^= 0222
+	}
+	return mode
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,246 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rar
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// The types of the blocks of the RAR 1.5-4.x format.
+const (
+	block4Main    = 0x73
+	block4File    = 0x74
+	block4Service = 0x7a
+	block4End     = 0x7b
+)
+
+// The flags of the blocks of the RAR 1.5-4.x format.
+const (
+	flag4EncryptedHeaders = 0x0080
+	flag4SolidArchive     = 0x0008
+	flag4SplitBefore      = 0x0001
+	flag4SplitAfter       = 0x0002
+	flag4Encrypted        = 0x0004
+	flag4Solid            = 0x0010
+	flag4Large            = 0x0100
+	flag4Unicode          = 0x0200
+	flag4Salt             = 0x0400
+	flag4LongBlock        = 0x8000
+)
+
+// The host operating systems of the RAR 1.5-4.x format whose file attributes are Unix modes.
+const host4Unix = 3
+
+// file4Len is the length of the fixed fields of the file headers.
+const file4Len = 32
+
+// readBlock4 reads a block of the RAR 1.5-4.x format.
+func (rr *Reader) readBlock4() (*block, error) {
+	var base [7]byte
+	if err := rr.readFull(base[:]); err != nil {
+		if err == io.EOF {
+			// the end of archive block is optional
+			return &block{end: true}, nil
+		}
+		return nil, unexpectedEOF(err)
+	}
+	typ := base[2]
+	flags := binary.LittleEndian.Uint16(base[3:])
+	size := binary.LittleEndian.Uint16(base[5:])
+	if size < 7 {
+		return nil, fmt.Errorf("%w: header of %d bytes", ErrHeader, size)
+	}
+	hdr := make([]byte, size)
+	copy(hdr, base[:])
+	if err := rr.readFull(hdr[7:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if uint16(crc32.ChecksumIEEE(hdr[2:])) != binary.LittleEndian.Uint16(hdr) {
+		return nil, fmt.Errorf("%w: header checksum mismatch", ErrHeader)
+	}
+	switch typ {
+	case block4Main:
+		if flags&flag4EncryptedHeaders != 0 {
+			return nil, fmt.Errorf("%w: encrypted headers", ErrEncryptedEntry)
+		}
+		return &block{main: true, solid: flags&flag4SolidArchive != 0}, nil
+	case block4File, block4Service:
+		return rr.fileBlock4(hdr, typ, flags)
+	case block4End:
+		return &block{end: true}, nil
+	}
+	b := &block{}
+	if flags&flag4LongBlock != 0 {
+		if size < 11 {
+			return nil, fmt.Errorf("%w: header of %d bytes", ErrHeader, size)
+		}
+		b.dataSize = int64(binary.LittleEndian.Uint32(hdr[7:]))
+	}
+	return b, nil
+}
+
+// fileBlock4 parses the header of a file, or of a service block (the NTFS streams).
+func (rr *Reader) fileBlock4(hdr []byte, typ byte, flags uint16) (*block, error) {
+	le32 := func(off int) int64 {
+		return int64(binary.LittleEndian.Uint32(hdr[off:]))
+	}
+	fixed := file4Len
+	if flags&flag4Large != 0 {
+		fixed += 8
+	}
+	if len(hdr) < fixed {
+		return nil, fmt.Errorf("%w: file header of %d bytes", ErrHeader, len(hdr))
+	}
+	packed, size := le32(7), le32(11)
+	if flags&flag4Large != 0 {
+		packed |= le32(32) << 32
+		size |= le32(36) << 32
+	}
+	if packed < 0 || size < 0 {
+		return nil, fmt.Errorf("%w: bad size", ErrHeader)
+	}
+	nameLen := int(binary.LittleEndian.Uint16(hdr[26:]))
+	if fixed+nameLen > len(hdr) || nameLen == 0 {
+		return nil, fmt.Errorf("%w: bad name length %d", ErrHeader, nameLen)
+	}
+	rawName := hdr[fixed : fixed+nameLen]
+	b := &block{dataSize: packed}
+	if typ == block4Service {
+		if string(rawName) != "STM" {
+			return b, nil
+		}
+		end := len(hdr)
+		if flags&flag4Salt != 0 {
+			end -= 8
+		}
+		if end <= fixed+nameLen {
+			return nil, fmt.Errorf("%w: stream without a name", ErrHeader)
+		}
+		stream := streamName(hdr[fixed+nameLen : end])
+		if stream == "" || rr.file == "" {
+			return nil, fmt.Errorf("%w: invalid stream", ErrHeader)
+		}
+		b.h = &Header{Name: rr.file, Stream: stream}
+	} else {
+		name := string(rawName)
+		if flags&flag4Unicode != 0 {
+			name = decodeName4(rawName)
+		}
+		b.h = &Header{Name: strings.ReplaceAll(name, `\`, "/")}
+	}
+	h := b.h
+	h.Size, h.PackedSize = size, packed
+	h.Method = int(hdr[25]) - 0x30
+	b.version = int(hdr[24])
+	h.ModTime = dosTime(uint32(le32(20)))
+	h.Solid = flags&flag4Solid != 0
+	h.Encrypted = flags&flag4Encrypted != 0
+	b.split = flags&(flag4SplitBefore|flag4SplitAfter) != 0
+	b.crc, b.hasCRC = uint32(le32(16)), true
+	dir := flags&0x00e0 == 0x00e0
+	if !dir {
+		h.DictionarySize = 64 << 10 << ((flags >> 5) & 7)
+	}
+	attr := uint64(le32(28))
+	if hdr[15] == host4Unix {
+		h.Mode = unixMode(attr)
+		if attr&0170000 == 0120000 {
+			h.Link = Symlink
+		}
+	} else {
+		h.Mode = windowsMode(attr, dir)
+	}
+	return b, nil
+}
+
+// decodeName4 decodes the name of a file header with the Unicode flag: the name in the legacy
+// encoding followed by a NUL and by the UTF-16 name, compressed using the legacy name.
+func decodeName4(b []byte) string {
+	i := bytes.IndexByte(b, 0)
+	if i < 0 {
+		// a UTF-8 name
+		return string(b)
+	}
+	name, enc := b[:i], b[i+1:]
+	if len(enc) == 0 {
+		return string(name)
+	}
+	var re []uint16
+	high := uint16(enc[0])
+	enc = enc[1:]
+	var flags byte
+	bits := 0
+	for len(enc) > 0 {
+		if bits == 0 {
+			flags, enc, bits = enc[0], enc[1:], 8
+			if len(enc) == 0 {
+				break
+			}
+		}
+		switch flags >> 6 {
+		case 0:
+			re, enc = append(re, uint16(enc[0])), enc[1:]
+		case 1:
+			re, enc = append(re, uint16(enc[0])|high<<8), enc[1:]
+		case 2:
+			if len(enc) < 2 {
+				enc = nil
+				break
+			}
+			re, enc = append(re, binary.LittleEndian.Uint16(enc)), enc[2:]
+		case 3:
+			n := int(enc[0])
+			enc = enc[1:]
+			var correction byte
+			copyHigh := n&0x80 != 0
+			if copyHigh {
+				if len(enc) == 0 {
+					break
+				}
+				correction, enc = enc[0], enc[1:]
+			}
+			for n = n&0x7f + 2; n > 0 && len(re) < len(name); n-- {
+				c := uint16(name[len(re)])
+				if copyHigh {
+					c = uint16(name[len(re)]+correction) | high<<8
+				}
+				re = append(re, c)
+			}
+		}
+		flags <<= 2
+		bits -= 2
+	}
+	if len(re) == 0 {
+		return string(name)
+	}
+	return string(utf16.Decode(re))
+}
+
+// streamName returns the name of an NTFS stream, stored as ":name" or ":name:$DATA".
+func streamName(b []byte) string {
+	return strings.TrimSuffix(strings.TrimPrefix(string(b), ":"), ":$DATA")
+}
+
+// dosTime returns the time of an MS-DOS date and time.
+func dosTime(t uint32) time.Time {
+	return time.Date(int(t>>25)+1980, time.Month(t>>21&0xf), int(t>>16&0x1f), int(t>>11&0x1f), int(t>>5&0x3f), int(t&0x1f)*2, 0, time.UTC)
+}
@@ -0,0 +1,278 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rar
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// The types of the headers of the RAR 5.0 format.
+const (
+	block5Main       = 1
+	block5File       = 2
+	block5Service    = 3
+	block5Encryption = 4
+	block5End        = 5
+)
+
+// The flags of the headers of the RAR 5.0 format.
+const (
+	flag5Extra       = 0x01
+	flag5Data        = 0x02
+	flag5SplitBefore = 0x08
+	flag5SplitAfter  = 0x10
+
+	file5Directory   = 0x01
+	file5Time        = 0x02
+	file5CRC         = 0x04
+	file5UnknownSize = 0x08
+
+	main5Solid = 0x04
+)
+
+// The types of the extra records of the file headers.
+const (
+	extra5Encryption  = 1
+	extra5Redirection = 5
+	extra5ServiceData = 7
+)
+
+// The host operating system of the RAR 5.0 format whose file attributes are Unix modes.
+const host5Unix = 1
+
+// maxHeader5Len is the maximum length of the headers of the RAR 5.0 format.
+const maxHeader5Len = 2 << 20
+
+// fields reads the fields of a header of the RAR 5.0 format.
+type fields struct {
+	b   []byte
+	err error
+}
+
+// vint reads a variable length integer.
+func (f *fields) vint() uint64 {
+	var v uint64
+	for i := 0; i < 10 && len(f.b) > 0; i++ {
+		c := f.b[0]
+		f.b = f.b[1:]
+		v |= uint64(c&0x7f) << (7 * i)
+		if c&0x80 == 0 {
+			return v
+		}
+	}
+	f.err = fmt.Errorf("%w: bad integer", ErrHeader)
+	return 0
+}
+
+func (f *fields) uint32() uint32 {
+	if len(f.b) < 4 {
+		f.err = fmt.Errorf("%w: truncated header", ErrHeader)
+		return 0
+	}
+	v := binary.LittleEndian.Uint32(f.b)
+	f.b = f.b[4:]
+	return v
+}
+
+func (f *fields) bytes(n uint64) []byte {
+	if n > uint64(len(f.b)) {
+		f.err = fmt.Errorf("%w: truncated header", ErrHeader)
+		return nil
+	}
+	v := f.b[:n]
+	f.b = f.b[n:]
+	return v
+}
+
+// readBlock5 reads a header of the RAR 5.0 format.
+func (rr *Reader) readBlock5() (*block, error) {
+	var crc [4]byte
+	if err := rr.readFull(crc[:]); err != nil {
+		if err == io.EOF {
+			// the end of archive header is optional
+			return &block{end: true}, nil
+		}
+		return nil, unexpectedEOF(err)
+	}
+	// the size of the header, a vint of at most 3 bytes
+	var size []byte
+	for len(size) == 0 || size[len(size)-1]&0x80 != 0 {
+		if len(size) == 3 {
+			return nil, fmt.Errorf("%w: bad header size", ErrHeader)
+		}
+		var c [1]byte
+		if err := rr.readFull(c[:]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		size = append(size, c[0])
+	}
+	n := (&fields{b: size}).vint()
+	if n == 0 || n > maxHeader5Len {
+		return nil, fmt.Errorf("%w: header of %d bytes", ErrHeader, n)
+	}
+	hdr := make([]byte, n)
+	if err := rr.readFull(hdr); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if crc32.Update(crc32.ChecksumIEEE(size), crc32.IEEETable, hdr) != binary.LittleEndian.Uint32(crc[:]) {
+		return nil, fmt.Errorf("%w: header checksum mismatch", ErrHeader)
+	}
+	f := &fields{b: hdr}
+	typ := f.vint()
+	flags := f.vint()
+	var extraSize, dataSize uint64
+	if flags&flag5Extra != 0 {
+		extraSize = f.vint()
+	}
+	if flags&flag5Data != 0 {
+		dataSize = f.vint()
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	if extraSize > uint64(len(f.b)) || dataSize > 1<<62 {
+		return nil, fmt.Errorf("%w: bad sizes", ErrHeader)
+	}
+	extra := f.b[uint64(len(f.b))-extraSize:]
+	f.b = f.b[:uint64(len(f.b))-extraSize]
+	b := &block{dataSize: int64(dataSize)}
+	switch typ {
+	case block5Main:
+		b.main = true
+		b.solid = f.vint()&main5Solid != 0
+		if f.err != nil {
+			return nil, f.err
+		}
+	case block5File, block5Service:
+		if err := rr.fileBlock5(b, f, typ, flags, extra); err != nil {
+			return nil, err
+		}
+	case block5Encryption:
+		return nil, fmt.Errorf("%w: encrypted headers", ErrEncryptedEntry)
+	case block5End:
+		b.end = true
+	}
+	return b, nil
+}
+
+// fileBlock5 parses the header of a file, or of a service header (the NTFS streams), into b.
+func (rr *Reader) fileBlock5(b *block, f *fields, typ, flags uint64, extra []byte) error {
+	fileFlags := f.vint()
+	size := f.vint()
+	attr := f.vint()
+	var mtime uint32
+	if fileFlags&file5Time != 0 {
+		mtime = f.uint32()
+	}
+	if fileFlags&file5CRC != 0 {
+		b.crc, b.hasCRC = f.uint32(), true
+	}
+	compression := f.vint()
+	host := f.vint()
+	name := string(f.bytes(f.vint()))
+	if f.err != nil {
+		return f.err
+	}
+	if name == "" || size > 1<<62 {
+		return fmt.Errorf("%w: bad file header", ErrHeader)
+	}
+	h := &Header{
+		Name:       strings.ReplaceAll(name, `\`, "/"),
+		Size:       int64(size),
+		PackedSize: b.dataSize,
+		Method:     int(compression >> 7 & 7),
+		Solid:      compression&0x40 != 0,
+	}
+	if v := compression & 0x3f; v <= 1 {
+		// the algorithm of RAR 5.0, with the larger dictionaries of RAR 7 in version 1
+		b.version = 50 + 20*int(v)
+	}
+	if fileFlags&file5UnknownSize != 0 {
+		h.Size = -1
+	}
+	if fileFlags&file5Time != 0 {
+		h.ModTime = time.Unix(int64(mtime), 0)
+	}
+	dir := fileFlags&file5Directory != 0
+	if !dir {
+		h.DictionarySize = 128 << 10 << (compression >> 10 & 0x1f)
+		if compression&0x3f == 1 {
+			// the fraction of the dictionary sizes of RAR 7
+			h.DictionarySize += h.DictionarySize / 32 * int64(compression>>15&0x1f)
+		}
+	}
+	if host == host5Unix {
+		h.Mode = unixMode(attr)
+	} else {
+		h.Mode = windowsMode(attr, dir)
+	}
+	b.split = flags&(flag5SplitBefore|flag5SplitAfter) != 0
+	var service []byte
+	for len(extra) > 0 {
+		e := &fields{b: extra}
+		n := e.vint()
+		record := e.bytes(n)
+		if e.err != nil {
+			return e.err
+		}
+		extra = e.b
+		r := &fields{b: record}
+		switch r.vint() {
+		case extra5Encryption:
+			h.Encrypted = true
+		case extra5Redirection:
+			link := r.vint()
+			r.vint()
+			target := string(r.bytes(r.vint()))
+			switch link {
+			case 1, 2:
+				h.Link = Symlink
+			case 3:
+				h.Link = Junction
+			case 4:
+				h.Link = HardLink
+			case 5:
+				h.Link = FileCopy
+			}
+			h.Linkname = strings.ReplaceAll(target, `\`, "/")
+		case extra5ServiceData:
+			service = r.b
+		}
+		if r.err != nil {
+			return r.err
+		}
+	}
+	if h.Link == Symlink || h.Link == Junction {
+		h.Mode |= 0777 | fs.ModeSymlink
+	}
+	if typ == block5Service {
+		if name != "STM" {
+			return nil
+		}
+		h.Stream = streamName(service)
+		if h.Stream == "" || rr.file == "" {
+			return fmt.Errorf("%w: invalid stream", ErrHeader)
+		}
+		h.Name = rr.file
+	}
+	b.h = h
+	return nil
+}
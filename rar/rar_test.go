@@ -0,0 +1,519 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rar
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"reflect"
+	"testing"
+
+	"github.com/google/safearchive"
+)
+
+type entry struct {
+	name string
+	data string
+	dir  bool
+	// unix is the mode of the entries created on Unix, zero for the ones created on Windows.
+	unix uint32
+	// method is the compression method, stored if zero.
+	method int
+	// link and target describe the links. In the RAR 1.5-4.x format, the symbolic links are
+	// entries of Unix mode 0120777 storing their target as data instead.
+	link   LinkType
+	target string
+	// stream is the name of an NTFS stream of the last file.
+	stream    string
+	encrypted bool
+	// dictionary is the exponent of the dictionary size.
+	dictionary uint64
+	// badCRC corrupts the CRC32 of the data.
+	badCRC bool
+	// packed is the compressed data of the entry, if not nil, and version the version of its
+	// algorithm: 29 (the default) or 36 in the RAR 1.5-4.x format, 0 or 1 in the RAR 5.0 one.
+	packed  []byte
+	version int
+	// solid marks the entry as needing the data of the previous ones, and the archive as solid.
+	solid bool
+}
+
+// packedData returns the data written for e.
+func (e entry) packedData() string {
+	if e.packed != nil {
+		return string(e.packed)
+	}
+	return e.data
+}
+
+// solidArchive reports whether the archive of the entries is solid.
+func solidArchive(entries []entry) bool {
+	for _, e := range entries {
+		if e.solid {
+			return true
+		}
+	}
+	return false
+}
+
+// block4 returns a block of the RAR 1.5-4.x format.
+func block4(typ byte, flags uint16, body []byte) []byte {
+	b := make([]byte, 7, 7+len(body))
+	b[2] = typ
+	binary.LittleEndian.PutUint16(b[3:], flags)
+	binary.LittleEndian.PutUint16(b[5:], uint16(7+len(body)))
+	b = append(b, body...)
+	binary.LittleEndian.PutUint16(b, uint16(crc32.ChecksumIEEE(b[2:])))
+	return b
+}
+
+// rar4 returns an archive of the RAR 1.5-4.x format.
+func rar4(entries ...entry) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(Magic4)
+	var mainFlags uint16
+	if solidArchive(entries) {
+		mainFlags = flag4SolidArchive
+	}
+	buf.Write(block4(block4Main, mainFlags, make([]byte, 6)))
+	for _, e := range entries {
+		typ, flags, name, data := byte(block4File), uint16(flag4LongBlock|e.dictionary<<5), e.name, e.data
+		if e.stream != "" {
+			typ, name = block4Service, "STM"
+		}
+		if e.dir {
+			flags |= 0x00e0
+		}
+		if e.encrypted {
+			flags |= flag4Encrypted
+		}
+		if e.solid {
+			flags |= flag4Solid
+		}
+		version := byte(29)
+		if e.version != 0 {
+			version = byte(e.version)
+		}
+		host, attr := byte(2), uint32(0x20)
+		if e.dir {
+			attr = 0x10
+		}
+		if e.unix != 0 {
+			host, attr = host4Unix, e.unix
+		}
+		crc := crc32.ChecksumIEEE([]byte(data))
+		if e.badCRC {
+			crc++
+		}
+		packed := e.packedData()
+		body := binary.LittleEndian.AppendUint32(nil, uint32(len(packed)))
+		body = binary.LittleEndian.AppendUint32(body, uint32(len(data)))
+		body = append(body, host)
+		body = binary.LittleEndian.AppendUint32(body, crc)
+		body = binary.LittleEndian.AppendUint32(body, 0x58000000)
+		body = append(body, version, byte(0x30+e.method))
+		body = binary.LittleEndian.AppendUint16(body, uint16(len(name)))
+		body = binary.LittleEndian.AppendUint32(body, attr)
+		body = append(body, name...)
+		if e.stream != "" {
+			body = append(body, ":"+e.stream...)
+		}
+		buf.Write(block4(typ, flags, body))
+		buf.WriteString(packed)
+	}
+	buf.Write(block4(block4End, 0x4000, nil))
+	return buf.Bytes()
+}
+
+// vint returns the variable length integer v.
+func vint(v uint64) []byte {
+	var b []byte
+	for ; v >= 0x80; v >>= 7 {
+		b = append(b, byte(v)|0x80)
+	}
+	return append(b, byte(v))
+}
+
+// block5 returns a header of the RAR 5.0 format.
+func block5(typ, flags uint64, body, extra []byte, dataSize int) []byte {
+	if len(extra) > 0 {
+		flags |= flag5Extra
+	}
+	if dataSize > 0 {
+		flags |= flag5Data
+	}
+	hdr := append(vint(typ), vint(flags)...)
+	if len(extra) > 0 {
+		hdr = append(hdr, vint(uint64(len(extra)))...)
+	}
+	if dataSize > 0 {
+		hdr = append(hdr, vint(uint64(dataSize))...)
+	}
+	hdr = append(append(hdr, body...), extra...)
+	hdr = append(vint(uint64(len(hdr))), hdr...)
+	return append(binary.LittleEndian.AppendUint32(nil, crc32.ChecksumIEEE(hdr)), hdr...)
+}
+
+// record returns an extra record of the RAR 5.0 format.
+func record(typ uint64, data []byte) []byte {
+	data = append(vint(typ), data...)
+	return append(vint(uint64(len(data))), data...)
+}
+
+// rar5 returns an archive of the RAR 5.0 format.
+func rar5(entries ...entry) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(Magic5)
+	var mainFlags uint64
+	if solidArchive(entries) {
+		mainFlags = main5Solid
+	}
+	buf.Write(block5(block5Main, 0, vint(mainFlags), nil, 0))
+	for _, e := range entries {
+		typ, name := uint64(block5File), e.name
+		var extra []byte
+		if e.stream != "" {
+			typ, name = block5Service, "STM"
+			extra = record(extra5ServiceData, []byte(":"+e.stream))
+		}
+		if e.encrypted {
+			extra = append(extra, record(extra5Encryption, make([]byte, 8))...)
+		}
+		if e.link != NotLink {
+			r := append(vint(map[LinkType]uint64{Symlink: 1, Junction: 3, HardLink: 4, FileCopy: 5}[e.link]), 0)
+			r = append(append(r, vint(uint64(len(e.target)))...), e.target...)
+			extra = append(extra, record(extra5Redirection, r)...)
+		}
+		fileFlags, host, attr := uint64(file5CRC), uint64(0), uint64(0x20)
+		if e.dir {
+			fileFlags, attr = fileFlags|file5Directory, 0x10
+		}
+		if e.unix != 0 {
+			host, attr = host5Unix, uint64(e.unix)
+		}
+		crc := crc32.ChecksumIEEE([]byte(e.data))
+		if e.badCRC {
+			crc++
+		}
+		body := append(vint(fileFlags), vint(uint64(len(e.data)))...)
+		body = append(body, vint(attr)...)
+		body = binary.LittleEndian.AppendUint32(body, crc)
+		compression := uint64(e.version) | uint64(e.method)<<7 | e.dictionary<<10
+		if e.solid {
+			compression |= 0x40
+		}
+		body = append(body, vint(compression)...)
+		body = append(body, vint(host)...)
+		body = append(append(body, vint(uint64(len(name)))...), name...)
+		packed := e.packedData()
+		buf.Write(block5(typ, 0, body, extra, len(packed)))
+		buf.WriteString(packed)
+	}
+	buf.Write(block5(block5End, 0, vint(0), nil, 0))
+	return buf.Bytes()
+}
+
+// formats are the writers of the archives of both formats.
+var formats = []struct {
+	name    string
+	archive func(entries ...entry) []byte
+}{
+	{"RAR4", rar4},
+	{"RAR5", rar5},
+}
+
+// read returns the names and contents of the entries of the archive, with the targets of the
+// links and the names of the streams.
+func read(t *testing.T, r *Reader) (map[string]string, error) {
+	t.Helper()
+	re := map[string]string{}
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			return re, nil
+		}
+		if err != nil {
+			return re, err
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return re, err
+		}
+		if int64(len(b)) != h.Size {
+			t.Errorf("%q has %d bytes, want %d", h.Name, len(b), h.Size)
+		}
+		name := h.Name
+		if h.Stream != "" {
+			name += ":" + h.Stream
+		}
+		if h.Linkname != "" {
+			b = []byte("-> " + h.Linkname)
+		}
+		re[name] = string(b)
+	}
+}
+
+func newReader(t *testing.T, archive []byte, mode SecurityMode) *Reader {
+	t.Helper()
+	r, err := NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	r.SetSecurityMode(mode)
+	return r
+}
+
+func TestFormats(t *testing.T) {
+	for _, f := range formats {
+		t.Run(f.name, func(t *testing.T) {
+			a := f.archive(
+				entry{name: "docs", dir: true},
+				entry{name: `docs\readme.txt`, data: "read me"},
+				entry{name: "bin/tool", unix: 0100755, data: "#!/bin/sh"},
+				entry{name: "bin/link", unix: 0120777, link: Symlink, target: "tool", data: "tool"},
+			)
+			r := newReader(t, a, SanitizeFilenames|PreventSymlinkTraversal)
+			var modes []fs.FileMode
+			for {
+				h, err := r.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Next() error = %v", err)
+				}
+				modes = append(modes, h.Mode)
+			}
+			if want := []fs.FileMode{fs.ModeDir | 0755, 0644, 0755, fs.ModeSymlink | 0777}; !reflect.DeepEqual(modes, want) {
+				t.Errorf("modes = %v, want %v", modes, want)
+			}
+
+			got, err := read(t, newReader(t, a, SanitizeFilenames|PreventSymlinkTraversal))
+			if err != nil {
+				t.Fatalf("Next() error = %v", err)
+			}
+			want := map[string]string{"docs": "", "docs/readme.txt": "read me", "bin/tool": "#!/bin/sh", "bin/link": "-> tool"}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("entries = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   entry
+		wantErr error
+	}{
+		{name: "compressed", entry: entry{name: "a", data: "compressed", method: 3, version: 20}, wantErr: ErrAlgorithm},
+		{name: "encrypted", entry: entry{name: "a", data: "encrypted", encrypted: true}, wantErr: ErrEncryptedEntry},
+		{name: "corrupt", entry: entry{name: "a", data: "corrupt", badCRC: true}, wantErr: ErrChecksum},
+	}
+	for _, f := range formats {
+		for _, tc := range tests {
+			t.Run(f.name+"/"+tc.name, func(t *testing.T) {
+				r := newReader(t, f.archive(tc.entry, entry{name: "b", data: "next"}), SanitizeFilenames)
+				if _, err := r.Next(); err != nil {
+					t.Fatalf("Next() error = %v", err)
+				}
+				if _, err := io.ReadAll(r); !errors.Is(err, tc.wantErr) {
+					t.Errorf("Read() error = %v, want %v", err, tc.wantErr)
+				}
+				// the next entries are read still
+				if h, err := r.Next(); err != nil || h.Name != "b" {
+					t.Errorf("Next() = %v, %v, want b", h, err)
+				}
+			})
+		}
+	}
+}
+
+func TestSecurityModes(t *testing.T) {
+	a := rar5(
+		entry{name: "../../etc/cron.d/evil", data: "evil"},
+		entry{name: "link", link: Symlink, target: "/etc"},
+		entry{name: "link/passwd", data: "through the link"},
+		entry{name: "junction", link: Junction, target: `\??\C:\Windows`},
+		entry{name: "hardlink", link: HardLink, target: "../../etc/shadow"},
+		entry{name: "setup.exe", data: "MZ"},
+		entry{stream: "Zone.Identifier", data: "[ZoneTransfer]"},
+		entry{name: "suid", unix: 0104755, data: "suid"},
+	)
+
+	r := newReader(t, a, DefaultSecurityMode)
+	if safearchive.Hardened {
+		r.SetSecurityMode(SanitizeFilenames | PreventSymlinkTraversal | SkipNTFSStreams)
+	}
+	got, err := read(t, r)
+	if err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	want := map[string]string{
+		"etc/cron.d/evil": "evil",
+		"link":            "-> /etc",
+		"junction":        "-> /??/C:/Windows",
+		"hardlink":        "-> etc/shadow",
+		"setup.exe":       "MZ",
+		"suid":            "suid",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %q, want %q", got, want)
+	}
+	var reasons []safearchive.Reason
+	for _, f := range r.Report().Findings {
+		reasons = append(reasons, f.Reason)
+	}
+	wantReasons := []safearchive.Reason{safearchive.ReasonPathTraversal, safearchive.ReasonSymlinkTraversal, safearchive.ReasonPathTraversal, ReasonNTFSStream}
+	if !reflect.DeepEqual(reasons, wantReasons) {
+		t.Errorf("Report() reasons = %q, want %q", reasons, wantReasons)
+	}
+
+	if got, err = read(t, newReader(t, a, SanitizeFilenames)); err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	if got["setup.exe:Zone.Identifier"] != "[ZoneTransfer]" || got["link/passwd"] != "through the link" {
+		t.Errorf("entries without SkipNTFSStreams and PreventSymlinkTraversal = %q", got)
+	}
+
+	if got, err = read(t, newReader(t, a, MaximumSecurityMode)); err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	want = map[string]string{"etc/cron.d/evil": "evil", "setup.exe": "MZ", "suid": "suid"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("entries in MaximumSecurityMode = %q, want %q", got, want)
+	}
+
+	if _, err := read(t, newReader(t, a, MaximumSecurityMode|StrictMode)); !errors.Is(err, safearchive.ErrPathTraversal) {
+		t.Errorf("Next() in StrictMode error = %v, want %v", err, safearchive.ErrPathTraversal)
+	}
+
+	r = newReader(t, rar4(entry{name: "link", unix: 0120777, data: "../../etc"}), SanitizeSymlinkTargets)
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("Next() on an escaping link error = %v, want %v", err, io.EOF)
+	}
+	if f := r.Report().Findings; len(f) != 1 || f[0].Reason != safearchive.ReasonSymlinkTarget {
+		t.Errorf("Report() = %v, want a %s finding", f, safearchive.ReasonSymlinkTarget)
+	}
+}
+
+func TestSanitizeUnicodeTraversal(t *testing.T) {
+	for _, a := range [][]byte{rar4(entry{name: ".\u200b./.\u200b./etc/passwd", data: "evil"}), rar5(entry{name: ".\u200b./.\u200b./etc/passwd", data: "evil"})} {
+		got, err := read(t, newReader(t, a, MaximumSecurityMode))
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		if want := map[string]string{"etc/passwd": "evil"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("entries = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	a := rar5(entry{name: "a", data: "aaaa"}, entry{name: "b", data: "bbbb"}, entry{name: "c", data: "cccc"})
+	tests := []struct {
+		name    string
+		archive []byte
+		set     func(r *Reader)
+	}{
+		{name: "entries", archive: a, set: func(r *Reader) { r.SetMaxEntries(2) }},
+		{name: "entry size", archive: a, set: func(r *Reader) { r.SetMaxEntrySize(3) }},
+		{name: "total size", archive: a, set: func(r *Reader) { r.SetMaxTotalSize(10) }},
+		{name: "dictionary", archive: rar5(entry{name: "a", data: "a", dictionary: 15}), set: func(r *Reader) {}},
+		{name: "dictionary limit", archive: rar4(entry{name: "a", data: "a", dictionary: 6}), set: func(r *Reader) { r.SetMaxDictionarySize(1 << 20) }},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newReader(t, tc.archive, SanitizeFilenames)
+			tc.set(r)
+			_, err := read(t, r)
+			if !errors.Is(err, ErrLimitExceeded) {
+				t.Errorf("Next() error = %v, want %v", err, ErrLimitExceeded)
+			}
+			if _, again := r.Next(); again != err {
+				t.Errorf("Next() after a failure error = %v, want %v", again, err)
+			}
+		})
+	}
+
+	r := newReader(t, rar5(entry{name: "a", data: "a", dictionary: 15}), SanitizeFilenames)
+	r.SetMaxDictionarySize(-1)
+	h, err := r.Next()
+	if err != nil {
+		t.Fatalf("Next() without a dictionary limit error = %v", err)
+	}
+	if h.DictionarySize != 4<<30 {
+		t.Errorf("DictionarySize = %d, want %d", h.DictionarySize, 4<<30)
+	}
+}
+
+func TestInvalidArchives(t *testing.T) {
+	valid4, valid5 := rar4(entry{name: "a", data: "aaaa"}), rar5(entry{name: "a", data: "aaaa"})
+	corrupt := func(b []byte, i int) []byte {
+		b = append([]byte{}, b...)
+		b[i] ^= 0xff
+		return b
+	}
+	tests := []struct {
+		name    string
+		archive []byte
+		wantErr error
+	}{
+		{name: "empty", archive: nil, wantErr: ErrHeader},
+		{name: "not rar", archive: []byte("PK\x03\x04 not a RAR archive"), wantErr: ErrHeader},
+		{name: "RAR4 header checksum", archive: corrupt(valid4, len(Magic4)+13+30), wantErr: ErrHeader},
+		{name: "RAR5 header checksum", archive: corrupt(valid5, len(Magic5)+7+10), wantErr: ErrHeader},
+		{name: "RAR4 no main header", archive: append([]byte(Magic4), valid4[len(Magic4)+13:]...), wantErr: ErrHeader},
+		{name: "RAR4 encrypted headers", archive: append([]byte(Magic4), block4(block4Main, flag4EncryptedHeaders, make([]byte, 6))...), wantErr: ErrEncryptedEntry},
+		{name: "RAR5 encrypted headers", archive: append(append([]byte(Magic5), block5(block5Main, 0, vint(0), nil, 0)...), block5(block5Encryption, 0, vint(0), nil, 0)...), wantErr: ErrEncryptedEntry},
+		{name: "RAR4 truncated", archive: valid4[:len(valid4)-12], wantErr: io.ErrUnexpectedEOF},
+		{name: "RAR5 truncated", archive: valid5[:len(Magic5)+7+5], wantErr: io.ErrUnexpectedEOF},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewReader(bytes.NewReader(tc.archive))
+			if err == nil {
+				_, err = read(t, r)
+			}
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("Next() error = %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeName4(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{name: "UTF-8", raw: "Жёлудь.txt", want: "Жёлудь.txt"},
+		{name: "high byte", raw: "?.txt\x00\x04\x70\x16\x02", want: "Ж.txt"},
+		{name: "UTF-16", raw: "?\x00\x00\x80\x3a\x26", want: "☺"},
+		{name: "truncated", raw: "abc\x00\x00", want: "abc"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := decodeName4([]byte(tc.raw)); got != tc.want {
+				t.Errorf("decodeName4(%q) = %q, want %q", tc.raw, got, tc.want)
+			}
+		})
+	}
+}
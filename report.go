@@ -0,0 +1,287 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import "strings"
+
+// Reason is a machine-readable code describing why an entry was flagged by a security feature.
+type Reason string
+
+const (
+	// ReasonPathTraversal means the name of the entry would have escaped the destination
+	// directory (e.g. ../something).
+	ReasonPathTraversal Reason = "path-traversal"
+	// ReasonAbsolutePath means the name of the entry was an absolute path.
+	ReasonAbsolutePath Reason = "absolute-path"
+	// ReasonPathNormalized means the name of the entry was rewritten in a cosmetic way (e.g. a
+	// redundant ./ or // was removed).
+	ReasonPathNormalized Reason = "path-normalized"
+	// ReasonSymlinkTraversal means the entry would have been extracted through a symbolic link.
+	ReasonSymlinkTraversal Reason = "symlink-traversal"
+	// ReasonSpecialFile means the entry is a special file (e.g. a device node or a fifo).
+	ReasonSpecialFile Reason = "special-file"
+	// ReasonSpecialMode means the entry had special mode bits (e.g. setuid).
+	ReasonSpecialMode Reason = "special-mode"
+	// ReasonXattrs means the entry had extended attributes.
+	ReasonXattrs Reason = "xattrs"
+	// ReasonExtraFields means the entry had zip extra fields (e.g. unix owners or NTFS
+	// timestamps).
+	ReasonExtraFields Reason = "extra-fields"
+	// ReasonWindowsShortFilename means a path component of the entry looks like a Windows short
+	// filename (e.g. GIT~1).
+	ReasonWindowsShortFilename Reason = "windows-short-filename"
+	// ReasonBackslash means the name of the entry contained a backslash.
+	ReasonBackslash Reason = "backslash"
+	// ReasonFanOut means the entry would have exceeded the maximum number of children of a
+	// directory.
+	ReasonFanOut Reason = "fan-out"
+	// ReasonLimitExceeded means the entry exceeded a size or count limit of the reader.
+	ReasonLimitExceeded Reason = "limit-exceeded"
+	// ReasonImplausibleSize means the entry declares sizes it cannot have (e.g. a directory with
+	// content, or more data than its archive could possibly decompress to).
+	ReasonImplausibleSize Reason = "implausible-size"
+	// ReasonOrderDependent means the extraction of the entry depends on the order of the entries
+	// of the archive (e.g. it replaces a directory of earlier entries), see OrderChecker.
+	ReasonOrderDependent Reason = "order-dependent"
+	// ReasonSymlinkTarget means the target of a symbolic link was absolute or escaped the root of
+	// the archive.
+	ReasonSymlinkTarget Reason = "symlink-target"
+	// ReasonUnexpectedPrefix means the entry was outside of the expected top-level directories
+	// of the archive, see RequirePrefixes.
+	ReasonUnexpectedPrefix Reason = "unexpected-prefix"
+	// ReasonDuplicate means the name of the entry was already taken by an earlier entry, see
+	// DuplicateChecker.
+	ReasonDuplicate Reason = "duplicate"
+	// ReasonCollision means the name of the entry differs from the one of an earlier entry, but is
+	// the same on case-insensitive or normalization-insensitive file systems.
+	ReasonCollision Reason = "name-collision"
+	// ReasonUnsafeUnicode means the name of the entry had characters used to disguise names in
+	// listings (control, bidirectional formatting or zero-width characters), see
+	// sanitizer.IsUnsafeRune.
+	ReasonUnsafeUnicode Reason = "unsafe-unicode"
+	// ReasonSymlinkLoop means the symbolic link of the entry closes a loop of symbolic links, or a
+	// chain of symbolic links too long to be resolved.
+	ReasonSymlinkLoop Reason = "symlink-loop"
+	// ReasonEncrypted means the entry was encrypted, so its contents could not be checked.
+	ReasonEncrypted Reason = "encrypted"
+	// ReasonInvalidEncoding means the name of the entry was not valid UTF-8 or had NUL bytes, see
+	// NameEncodingPolicy.
+	ReasonInvalidEncoding Reason = "invalid-encoding"
+)
+
+// Action is what a security feature did to a flagged entry.
+type Action int
+
+const (
+	// ActionNone means the entry was reported only.
+	ActionNone Action = iota
+	// ActionModified means the entry was emitted with some of its attributes sanitized.
+	ActionModified
+	// ActionDropped means the entry was skipped.
+	ActionDropped
+	// ActionRejected means the whole archive was rejected because of the entry.
+	ActionRejected
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionModified:
+		return "modified"
+	case ActionDropped:
+		return "dropped"
+	case ActionRejected:
+		return "rejected"
+	}
+	return "none"
+}
+
+// Severity tells how alarming a finding is.
+type Severity int
+
+const (
+	// SeverityDefault means the severity is derived from the reason of the finding.
+	SeverityDefault Severity = iota
+	// SeverityInfo findings are expected in legitimate archives.
+	SeverityInfo
+	// SeveritySuspicious findings are unusual, but not necessarily an attack.
+	SeveritySuspicious
+	// SeverityMalicious findings have no legitimate explanation.
+	SeverityMalicious
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityInfo:
+		return "info"
+	case SeveritySuspicious:
+		return "suspicious"
+	case SeverityMalicious:
+		return "malicious"
+	}
+	return "default"
+}
+
+// reasonSeverity is the default severity of the built-in reasons. Findings with other reasons
+// (e.g. custom rules) are considered suspicious.
+var reasonSeverity = map[Reason]Severity{
+	ReasonPathTraversal:        SeverityMalicious,
+	ReasonAbsolutePath:         SeveritySuspicious,
+	ReasonPathNormalized:       SeverityInfo,
+	ReasonSymlinkTraversal:     SeverityMalicious,
+	ReasonSpecialFile:          SeveritySuspicious,
+	ReasonSpecialMode:          SeveritySuspicious,
+	ReasonXattrs:               SeverityInfo,
+	ReasonExtraFields:          SeverityInfo,
+	ReasonWindowsShortFilename: SeveritySuspicious,
+	ReasonBackslash:            SeverityInfo,
+	ReasonFanOut:               SeveritySuspicious,
+	ReasonLimitExceeded:        SeveritySuspicious,
+	ReasonOrderDependent:       SeveritySuspicious,
+	ReasonSymlinkTarget:        SeveritySuspicious,
+	ReasonUnexpectedPrefix:     SeveritySuspicious,
+	ReasonDuplicate:            SeveritySuspicious,
+	ReasonCollision:            SeveritySuspicious,
+	ReasonUnsafeUnicode:        SeveritySuspicious,
+	ReasonSymlinkLoop:          SeveritySuspicious,
+	ReasonEncrypted:            SeverityInfo,
+	ReasonInvalidEncoding:      SeveritySuspicious,
+}
+
+// Finding describes an entry flagged by a security feature.
+type Finding struct {
+	// Name is the original (unsanitized) name of the entry.
+	Name string
+	// NewName is the name the reader returned the entry with, if it was kept under a different
+	// name (e.g. because of sanitization).
+	NewName string
+	// Offset is the byte offset of the header of the entry in the archive, or -1 if unknown.
+	Offset int64
+	// Reason tells why the entry was flagged.
+	Reason Reason
+	// Action tells what happened to the entry.
+	Action Action
+	// Severity overrides the default severity of Reason.
+	Severity Severity
+	// Detail is an optional human readable explanation.
+	Detail string
+	// Raw is the header of the entry exactly as it appears in the archive (e.g. the 512-byte tar
+	// header blocks or the zip central directory record). Readers populate it only if they were
+	// asked to retain raw headers.
+	Raw []byte
+}
+
+// NameReason returns the reason code for an entry whose name was changed by sanitization.
+func NameReason(name string) Reason {
+	name = strings.ReplaceAll(name, `\`, "/")
+	for _, c := range strings.Split(name, "/") {
+		if c == ".." {
+			return ReasonPathTraversal
+		}
+	}
+	if strings.HasPrefix(name, "/") || (len(name) >= 2 && name[1] == ':') {
+		return ReasonAbsolutePath
+	}
+	return ReasonPathNormalized
+}
+
+// EffectiveSeverity returns the severity of the finding, falling back to the default severity of
+// its reason.
+func (f Finding) EffectiveSeverity() Severity {
+	if f.Severity != SeverityDefault {
+		return f.Severity
+	}
+	if s, ok := reasonSeverity[f.Reason]; ok {
+		return s
+	}
+	return SeveritySuspicious
+}
+
+// Err returns the finding as an EntryError wrapping err.
+func (f Finding) Err(err error) *EntryError {
+	return &EntryError{Name: f.Name, Offset: f.Offset, Reason: f.Reason, Err: err}
+}
+
+// Report is a list of findings about an archive.
+type Report struct {
+	Findings []Finding
+}
+
+// Add appends a finding to the report.
+func (r *Report) Add(f Finding) {
+	r.Findings = append(r.Findings, f)
+}
+
+// Health is a coarse classification of an archive.
+type Health int
+
+const (
+	// HealthClean archives had no findings beyond informational ones. Accept them.
+	HealthClean Health = iota
+	// HealthSuspicious archives had unusual findings. Review them.
+	HealthSuspicious
+	// HealthMalicious archives had findings with no legitimate explanation. Reject them.
+	HealthMalicious
+)
+
+func (h Health) String() string {
+	switch h {
+	case HealthSuspicious:
+		return "suspicious"
+	case HealthMalicious:
+		return "malicious"
+	}
+	return "clean"
+}
+
+// Summary is the condensed form of a Report.
+type Summary struct {
+	// Health is the classification of the archive.
+	Health Health
+	// Reasons lists the distinct reasons that contributed to Health, in order of appearance.
+	Reasons []Reason
+	// Counts is the number of findings per reason, including informational ones.
+	Counts map[Reason]int
+}
+
+// Summarize condenses the findings of a report into a coarse health classification, so products
+// can make an accept/review/reject decision without interpreting every finding themselves.
+// A nil report is clean.
+func Summarize(r *Report) Summary {
+	s := Summary{Counts: map[Reason]int{}}
+	if r == nil {
+		return s
+	}
+	seen := map[Reason]bool{}
+	for _, f := range r.Findings {
+		s.Counts[f.Reason]++
+		var h Health
+		switch f.EffectiveSeverity() {
+		case SeverityMalicious:
+			h = HealthMalicious
+		case SeveritySuspicious:
+			h = HealthSuspicious
+		default:
+			continue
+		}
+		if h > s.Health {
+			s.Health = h
+		}
+		if !seen[f.Reason] {
+			seen[f.Reason] = true
+			s.Reasons = append(s.Reasons, f.Reason)
+		}
+	}
+	return s
+}
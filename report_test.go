@@ -0,0 +1,102 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSummarize(t *testing.T) {
+	tests := []struct {
+		name        string
+		findings    []Finding
+		wantHealth  Health
+		wantReasons []Reason
+	}{
+		{name: "empty", wantHealth: HealthClean},
+		{
+			name:       "informational only",
+			findings:   []Finding{{Name: "./a", Reason: ReasonPathNormalized, Action: ActionModified}},
+			wantHealth: HealthClean,
+		},
+		{
+			name: "suspicious",
+			findings: []Finding{
+				{Name: "fifo", Reason: ReasonSpecialFile, Action: ActionDropped},
+				{Name: "./a", Reason: ReasonPathNormalized, Action: ActionModified},
+			},
+			wantHealth:  HealthSuspicious,
+			wantReasons: []Reason{ReasonSpecialFile},
+		},
+		{
+			name: "malicious",
+			findings: []Finding{
+				{Name: "fifo", Reason: ReasonSpecialFile, Action: ActionDropped},
+				{Name: "../a", Reason: ReasonPathTraversal, Action: ActionModified},
+				{Name: "fifo2", Reason: ReasonSpecialFile, Action: ActionDropped},
+			},
+			wantHealth:  HealthMalicious,
+			wantReasons: []Reason{ReasonSpecialFile, ReasonPathTraversal},
+		},
+		{
+			name:        "custom reason",
+			findings:    []Finding{{Name: ".git/config", Reason: "no-git"}},
+			wantHealth:  HealthSuspicious,
+			wantReasons: []Reason{"no-git"},
+		},
+		{
+			name:       "severity override",
+			findings:   []Finding{{Name: ".git/config", Reason: "no-git", Severity: SeverityInfo}},
+			wantHealth: HealthClean,
+		},
+	}
+	for _, tc := range tests {
+		got := Summarize(&Report{Findings: tc.findings})
+		if got.Health != tc.wantHealth {
+			t.Errorf("Summarize(%s).Health = %v, want %v", tc.name, got.Health, tc.wantHealth)
+		}
+		if !reflect.DeepEqual(got.Reasons, tc.wantReasons) {
+			t.Errorf("Summarize(%s).Reasons = %v, want %v", tc.name, got.Reasons, tc.wantReasons)
+		}
+		if len(tc.findings) > 0 && got.Counts[tc.findings[0].Reason] == 0 {
+			t.Errorf("Summarize(%s).Counts misses %v", tc.name, tc.findings[0].Reason)
+		}
+	}
+}
+
+func TestSummarizeNil(t *testing.T) {
+	if got := Summarize(nil); got.Health != HealthClean {
+		t.Errorf("Summarize(nil).Health = %v, want %v", got.Health, HealthClean)
+	}
+}
+
+func TestNameReason(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Reason
+	}{
+		{in: "../etc/passwd", want: ReasonPathTraversal},
+		{in: `a\..\..\b`, want: ReasonPathTraversal},
+		{in: "/etc/passwd", want: ReasonAbsolutePath},
+		{in: `C:\Windows`, want: ReasonAbsolutePath},
+		{in: "./a//b", want: ReasonPathNormalized},
+	}
+	for _, tc := range tests {
+		if got := NameReason(tc.in); got != tc.want {
+			t.Errorf("NameReason(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
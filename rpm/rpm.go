@@ -0,0 +1,310 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rpm reads RPM packages, so artifact scanning and SBOM tooling do not need to shell out
+// to rpm2cpio.
+//
+// A package starts with a lead, a signature header and the header describing the package (its
+// name, version, and the format and compression of its payload). The payload is a compressed cpio
+// archive of the files installed by the package, whose entries are exposed through the safearchive
+// cpio reader, so its security features apply, after being decompressed with the limits of the
+// Options:
+//
+//	r, err := rpm.NewReader(f, rpm.Options{})
+//	if err != nil {
+//		return err
+//	}
+//	defer r.Close()
+//	fmt.Println(r.Package().Name)
+//	payload, err := r.Payload()
+//	...
+package rpm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/cpio"
+	"github.com/google/safearchive/decompress"
+)
+
+// ErrFormat is wrapped by the errors of reading a file that is not a valid RPM package.
+var ErrFormat = errors.New("rpm: invalid package")
+
+const (
+	// leadMagic and headerMagic are the signatures of the lead and of the headers.
+	leadMagic   = "\xed\xab\xee\xdb"
+	headerMagic = "\x8e\xad\xe8\x01"
+	leadLen     = 96
+	// sigHeaderStyle is the type of signature of the packages written since RPM 3.
+	sigHeaderStyle = 5
+	// maxHeaderEntries is the maximum number of tags of a header, as in RPM.
+	maxHeaderEntries = 0xffff
+	// DefaultMaxHeaderSize is the default limit of the size of each header.
+	DefaultMaxHeaderSize = 64 << 20
+)
+
+// The tags of the header read by the Reader, and the types of their values.
+const (
+	tagName              = 1000
+	tagVersion           = 1001
+	tagRelease           = 1002
+	tagArch              = 1022
+	tagPayloadFormat     = 1124
+	tagPayloadCompressor = 1125
+
+	typeString     = 6
+	typeI18NString = 9
+)
+
+// codecs are the names of the decompress codecs of the payload compressors. The codecs of xz,
+// zstd and lzma need to be registered with the decompress package.
+var codecs = map[string]string{
+	"gzip":  "gzip",
+	"bzip2": "bzip2",
+	"xz":    "xz",
+	"zstd":  "zstd",
+	"lzma":  "lzma",
+}
+
+func init() {
+	safearchive.RegisterFeatures(safearchive.Feature{Package: "rpm", Kind: safearchive.FeatureFormat, Name: "rpm"})
+}
+
+// Default limits of the cpio reader of the payload, see Options. Legitimate packages stay far
+// below them.
+const (
+	DefaultMaxEntries   = 1 << 20
+	DefaultMaxEntrySize = 16 << 30
+	DefaultMaxTotalSize = 64 << 30
+)
+
+// Options configures the reading of a package. The zero value uses the default settings of the
+// cpio reader, and the default limits.
+type Options struct {
+	// CpioSecurityMode is the security mode of the cpio reader of the payload.
+	// cpio.DefaultSecurityMode is used if not set.
+	CpioSecurityMode cpio.SecurityMode
+	// MaxEntries, MaxEntrySize and MaxTotalSize are the limits of the cpio reader, see
+	// cpio.Reader.SetMaxEntries. DefaultMaxEntries, DefaultMaxEntrySize and DefaultMaxTotalSize are
+	// used if not set; negative values apply no limit.
+	MaxEntries   int
+	MaxEntrySize int64
+	MaxTotalSize int64
+	// MaxHeaderSize limits the size of the data of the signature header and of the header.
+	// DefaultMaxHeaderSize is used if not set.
+	MaxHeaderSize int64
+	// DecompressLimits are the limits of the decompression of the payload.
+	// decompress.DefaultLimits are used if not set; &decompress.Limits{} applies no limits.
+	DecompressLimits *decompress.Limits
+}
+
+// Package describes an RPM package, as read from its header.
+type Package struct {
+	Name    string
+	Version string
+	Release string
+	Arch    string
+	// Source is set for source packages.
+	Source bool
+	// PayloadCompressor is the compression of the payload, e.g. "gzip" or "zstd".
+	PayloadCompressor string
+}
+
+// Reader reads an RPM package.
+type Reader struct {
+	r    io.Reader
+	opts Options
+	pkg  Package
+	// payload is set once Payload was called.
+	payload bool
+	// closer closes the decompressor of the payload, if any.
+	closer io.Closer
+}
+
+// NewReader returns a reader of the package read from r. It reads the lead and the headers of the
+// package, up to its payload.
+func NewReader(r io.Reader, opts Options) (*Reader, error) {
+	var lead [leadLen]byte
+	if _, err := io.ReadFull(r, lead[:]); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrFormat, unexpectedEOF(err))
+	}
+	if string(lead[:4]) != leadMagic {
+		return nil, fmt.Errorf("%w: not an RPM package", ErrFormat)
+	}
+	if t := binary.BigEndian.Uint16(lead[78:]); t != sigHeaderStyle {
+		return nil, fmt.Errorf("%w: unsupported signature type %d", ErrFormat, t)
+	}
+	maxSize := opts.MaxHeaderSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxHeaderSize
+	}
+	sig, err := readHeader(r, maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("signature: %w", err)
+	}
+	// the signature header is padded to a multiple of 8 bytes
+	if _, err := io.CopyN(io.Discard, r, int64(-len(sig.data)&7)); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrFormat, unexpectedEOF(err))
+	}
+	h, err := readHeader(r, maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("header: %w", err)
+	}
+	pkg := Package{
+		Name:              h.string(tagName),
+		Version:           h.string(tagVersion),
+		Release:           h.string(tagRelease),
+		Arch:              h.string(tagArch),
+		Source:            binary.BigEndian.Uint16(lead[6:]) == 1,
+		PayloadCompressor: h.string(tagPayloadCompressor),
+	}
+	if pkg.Name == "" {
+		return nil, fmt.Errorf("%w: no name", ErrFormat)
+	}
+	if f := h.string(tagPayloadFormat); f != "" && f != "cpio" {
+		return nil, fmt.Errorf("%w: unsupported payload format %q", ErrFormat, f)
+	}
+	if pkg.PayloadCompressor == "" {
+		// the default of the packages predating the tag
+		pkg.PayloadCompressor = "gzip"
+	}
+	return &Reader{r: r, opts: opts, pkg: pkg}, nil
+}
+
+// Package returns the description of the package.
+func (r *Reader) Package() Package {
+	return r.pkg
+}
+
+// Payload returns a reader of the entries of the payload. It may be called only once.
+func (r *Reader) Payload() (*cpio.Reader, error) {
+	if r.payload {
+		return nil, errors.New("rpm: the payload was read already")
+	}
+	r.payload = true
+	name, ok := codecs[r.pkg.PayloadCompressor]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown payload compressor %q", ErrFormat, r.pkg.PayloadCompressor)
+	}
+	c, ok := decompress.Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("%w %q of the payload", decompress.ErrUnknownCodec, name)
+	}
+	l := decompress.DefaultLimits
+	if r.opts.DecompressLimits != nil {
+		l = *r.opts.DecompressLimits
+	}
+	d, err := decompress.NewReader(r.r, c, l)
+	if err != nil {
+		return nil, err
+	}
+	r.closer = d
+	cr := cpio.NewReader(d)
+	if r.opts.CpioSecurityMode != 0 {
+		cr.SetSecurityMode(r.opts.CpioSecurityMode)
+	}
+	opts := r.opts
+	if opts.MaxEntries == 0 {
+		opts.MaxEntries = DefaultMaxEntries
+	}
+	if opts.MaxEntrySize == 0 {
+		opts.MaxEntrySize = DefaultMaxEntrySize
+	}
+	if opts.MaxTotalSize == 0 {
+		opts.MaxTotalSize = DefaultMaxTotalSize
+	}
+	cr.SetMaxEntries(opts.MaxEntries)
+	cr.SetMaxEntrySize(opts.MaxEntrySize)
+	cr.SetMaxTotalSize(opts.MaxTotalSize)
+	return cr, nil
+}
+
+// Close closes the decompressor of the payload. It does not close the underlying reader.
+func (r *Reader) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	err := r.closer.Close()
+	r.closer = nil
+	return err
+}
+
+// header is a header of a package: the index of its tags, and the data store of their values.
+type header struct {
+	index []byte
+	data  []byte
+}
+
+// readHeader reads a header whose data is at most maxSize bytes.
+func readHeader(r io.Reader, maxSize int64) (*header, error) {
+	var b [16]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrFormat, unexpectedEOF(err))
+	}
+	if string(b[:4]) != headerMagic {
+		return nil, fmt.Errorf("%w: bad header magic", ErrFormat)
+	}
+	entries := binary.BigEndian.Uint32(b[8:])
+	size := binary.BigEndian.Uint32(b[12:])
+	if entries > maxHeaderEntries {
+		return nil, fmt.Errorf("%w: header of %d tags", safearchive.ErrLimitExceeded, entries)
+	}
+	if int64(size) > maxSize {
+		return nil, fmt.Errorf("%w: header of %d bytes, the limit is %d", safearchive.ErrLimitExceeded, size, maxSize)
+	}
+	h := &header{index: make([]byte, 16*int(entries)), data: make([]byte, size)}
+	if _, err := io.ReadFull(r, h.index); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrFormat, unexpectedEOF(err))
+	}
+	if _, err := io.ReadFull(r, h.data); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrFormat, unexpectedEOF(err))
+	}
+	return h, nil
+}
+
+// string returns the value of the string tag, or the first value of the internationalized string
+// tag, or an empty string if the header has no such valid tag.
+func (h *header) string(tag uint32) string {
+	for i := 0; i < len(h.index); i += 16 {
+		e := h.index[i : i+16]
+		if binary.BigEndian.Uint32(e) != tag {
+			continue
+		}
+		if t := binary.BigEndian.Uint32(e[4:]); t != typeString && t != typeI18NString {
+			return ""
+		}
+		off := binary.BigEndian.Uint32(e[8:])
+		if off >= uint32(len(h.data)) {
+			return ""
+		}
+		end := bytes.IndexByte(h.data[off:], 0)
+		if end < 0 {
+			return ""
+		}
+		return string(h.data[off : off+uint32(end)])
+	}
+	return ""
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,240 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rpm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/cpio"
+	"github.com/google/safearchive/decompress"
+)
+
+// rawHeader returns a header of the string tags.
+func rawHeader(tags map[uint32]string) []byte {
+	var keys []uint32
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	var index, data bytes.Buffer
+	for _, k := range keys {
+		binary.Write(&index, binary.BigEndian, [4]uint32{k, typeString, uint32(data.Len()), 1})
+		data.WriteString(tags[k] + "\x00")
+	}
+	var buf bytes.Buffer
+	buf.WriteString(headerMagic + "\x00\x00\x00\x00")
+	binary.Write(&buf, binary.BigEndian, [2]uint32{uint32(len(keys)), uint32(data.Len())})
+	buf.Write(index.Bytes())
+	buf.Write(data.Bytes())
+	return buf.Bytes()
+}
+
+// payload returns a gzip compressed cpio archive of regular files named after their content.
+func payload(names ...string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	n := 0
+	write := func(s string) {
+		zw.Write([]byte(s))
+		n += len(s)
+		zw.Write(make([]byte, -n&3))
+		n += -n & 3
+	}
+	for i, name := range append(names, "TRAILER!!!") {
+		size := len(name)
+		if i == len(names) {
+			size = 0
+		}
+		write(fmt.Sprintf("%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%s\x00", cpio.Magic, i+1, cpio.TypeReg|0644, 0, 0, 1, 0, size, 0, 0, 0, 0, len(name)+1, 0, name))
+		write(name[:size])
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+// rpm returns a package of the header tags and the payload.
+func rpm(tags map[uint32]string, payload []byte) []byte {
+	var buf bytes.Buffer
+	lead := make([]byte, leadLen)
+	copy(lead, leadMagic+"\x03\x00")
+	copy(lead[10:], tags[tagName])
+	binary.BigEndian.PutUint16(lead[78:], sigHeaderStyle)
+	buf.Write(lead)
+	// a signature of 5 bytes, padded to 8
+	sig := rawHeader(map[uint32]string{1000: "sig!"})
+	buf.Write(sig)
+	buf.Write(make([]byte, 3))
+	buf.Write(rawHeader(tags))
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+var tags = map[uint32]string{
+	tagName:              "hello",
+	tagVersion:           "2.12",
+	tagRelease:           "1.fc40",
+	tagArch:              "x86_64",
+	tagPayloadFormat:     "cpio",
+	tagPayloadCompressor: "gzip",
+}
+
+func TestReader(t *testing.T) {
+	pkg := rpm(tags, payload("./usr/bin/hello", "./usr/share/doc/hello/README", "../../etc/passwd"))
+	r, err := NewReader(bytes.NewReader(pkg), Options{})
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	want := Package{Name: "hello", Version: "2.12", Release: "1.fc40", Arch: "x86_64", PayloadCompressor: "gzip"}
+	if got := r.Package(); got != want {
+		t.Errorf("Package() = %+v, want %+v", got, want)
+	}
+	payload, err := r.Payload()
+	if err != nil {
+		t.Fatalf("Payload() error = %v", err)
+	}
+	var names []string
+	for {
+		h, err := payload.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		names = append(names, h.Name)
+		if b, err := io.ReadAll(payload); err != nil || len(b) != int(h.Size) {
+			t.Errorf("ReadAll(%q) = %q, %v", h.Name, b, err)
+		}
+	}
+	if want := []string{"usr/bin/hello", "usr/share/doc/hello/README", "etc/passwd"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Payload() entries = %q, want %q", names, want)
+	}
+	if f := payload.Report().Findings; len(f) != 1 || f[0].Reason != safearchive.ReasonPathTraversal {
+		t.Errorf("Report() = %v, want a %s finding", f, safearchive.ReasonPathTraversal)
+	}
+	if _, err := r.Payload(); err == nil {
+		t.Errorf("Payload() called twice succeeded, want error")
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+}
+
+func TestDecompressLimits(t *testing.T) {
+	pkg := rpm(tags, payload("./usr/share/big"))
+	r, err := NewReader(bytes.NewReader(pkg), Options{DecompressLimits: &decompress.Limits{MaxOutputSize: 64}})
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	payload, err := r.Payload()
+	if err != nil {
+		t.Fatalf("Payload() error = %v", err)
+	}
+	for err == nil {
+		_, err = payload.Next()
+	}
+	if !errors.Is(err, decompress.ErrLimitExceeded) {
+		t.Errorf("Next() error = %v, want %v", err, decompress.ErrLimitExceeded)
+	}
+}
+
+// bzip2Bomb is a cpio archive holding 4MiB of zeros compressed with bzip2 to 122 bytes.
+const bzip2Bomb = "425a6839314159265359682842fc0080a1ff80cd0008082041fcc0a22414003200981000082000750c8a7a80d343080d002a9410d32680313d137aa71aa40801bd7080801d2a80400425870b6e2a4839195165145ac4c22076b9b0845ccd492813bc43ad294d72f3accef33d40801fc5dc914e14241a0a10bf00"
+
+func TestDefaultDecompressLimits(t *testing.T) {
+	bomb, err := hex.DecodeString(bzip2Bomb)
+	if err != nil {
+		t.Fatalf("DecodeString() error = %v", err)
+	}
+	bz := map[uint32]string{}
+	for k, v := range tags {
+		bz[k] = v
+	}
+	bz[tagPayloadCompressor] = "bzip2"
+	pkg := rpm(bz, bomb)
+	for _, tc := range []struct {
+		limits  *decompress.Limits
+		limited bool
+	}{
+		{nil, true},
+		{&decompress.Limits{}, false},
+	} {
+		r, err := NewReader(bytes.NewReader(pkg), Options{DecompressLimits: tc.limits})
+		if err != nil {
+			t.Fatalf("NewReader() error = %v", err)
+		}
+		payload, err := r.Payload()
+		if err != nil {
+			t.Fatalf("Payload() error = %v", err)
+		}
+		if _, err := payload.Next(); err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		_, err = io.Copy(io.Discard, payload)
+		if limited := errors.Is(err, decompress.ErrLimitExceeded); limited != tc.limited || !limited && err != nil {
+			t.Errorf("reading the payload with DecompressLimits %v error = %v, want limit exceeded %v", tc.limits, err, tc.limited)
+		}
+	}
+}
+
+func TestInvalidPackages(t *testing.T) {
+	with := func(tag uint32, value string) map[uint32]string {
+		re := map[uint32]string{}
+		for k, v := range tags {
+			re[k] = v
+		}
+		re[tag] = value
+		return re
+	}
+	valid := rpm(tags, payload("./a"))
+	tests := []struct {
+		name    string
+		pkg     []byte
+		opts    Options
+		wantErr error
+	}{
+		{name: "not rpm", pkg: []byte(strings.Repeat("not an rpm package", 10)), wantErr: ErrFormat},
+		{name: "old signature", pkg: append(append(append([]byte{}, valid[:78]...), 0, 1), valid[80:]...), wantErr: ErrFormat},
+		{name: "bad header magic", pkg: append(append([]byte{}, valid[:leadLen]...), strings.Repeat("x", 100)...), wantErr: ErrFormat},
+		{name: "no name", pkg: rpm(with(tagName, ""), payload("./a")), wantErr: ErrFormat},
+		{name: "delta rpm", pkg: rpm(with(tagPayloadFormat, "drpm"), payload("./a")), wantErr: ErrFormat},
+		{name: "unknown compressor", pkg: rpm(with(tagPayloadCompressor, "rar"), payload("./a")), wantErr: ErrFormat},
+		{name: "unregistered codec", pkg: rpm(with(tagPayloadCompressor, "lzma"), payload("./a")), wantErr: decompress.ErrUnknownCodec},
+		{name: "header too large", pkg: valid, opts: Options{MaxHeaderSize: 16}, wantErr: safearchive.ErrLimitExceeded},
+		{name: "truncated", pkg: valid[:150], wantErr: io.ErrUnexpectedEOF},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewReader(bytes.NewReader(tc.pkg), tc.opts)
+			if err == nil {
+				_, err = r.Payload()
+			}
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("Payload() error = %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
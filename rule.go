@@ -0,0 +1,132 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrRejected is wrapped (into an EntryError) by the errors of readers rejecting an archive
+// because a rule rejected one of its entries.
+var ErrRejected = errors.New("safearchive: entry rejected")
+
+// Errors of the entries rejected for the reasons of the built-in security features, e.g. by
+// readers in strict mode. All of them wrap ErrRejected.
+var (
+	ErrPathTraversal        = fmt.Errorf("%w: path traversal", ErrRejected)
+	ErrAbsolutePath         = fmt.Errorf("%w: absolute path", ErrRejected)
+	ErrSymlinkTraversal     = fmt.Errorf("%w: symlink traversal", ErrRejected)
+	ErrSpecialFile          = fmt.Errorf("%w: special file", ErrRejected)
+	ErrSpecialMode          = fmt.Errorf("%w: special file mode", ErrRejected)
+	ErrWindowsShortFilename = fmt.Errorf("%w: windows short filename", ErrRejected)
+	ErrBackslash            = fmt.Errorf("%w: backslash in name", ErrRejected)
+	ErrFanOut               = fmt.Errorf("%w: too many children", ErrRejected)
+	ErrOrderDependent       = fmt.Errorf("%w: depends on the order of the entries", ErrRejected)
+	ErrSymlinkTarget        = fmt.Errorf("%w: symlink target outside the archive", ErrRejected)
+	ErrUnexpectedPrefix     = fmt.Errorf("%w: outside of the expected prefixes", ErrRejected)
+	ErrDuplicate            = fmt.Errorf("%w: duplicate name", ErrRejected)
+	ErrCollision            = fmt.Errorf("%w: colliding names", ErrRejected)
+	ErrUnsafeUnicode        = fmt.Errorf("%w: unsafe characters in name", ErrRejected)
+	ErrSymlinkLoop          = fmt.Errorf("%w: symbolic link loop", ErrRejected)
+	ErrEncryptedEntry       = fmt.Errorf("%w: encrypted entry", ErrRejected)
+	ErrInvalidEncoding      = fmt.Errorf("%w: invalid name encoding", ErrRejected)
+)
+
+var reasonErrors = map[Reason]error{
+	ReasonPathTraversal:        ErrPathTraversal,
+	ReasonAbsolutePath:         ErrAbsolutePath,
+	ReasonSymlinkTraversal:     ErrSymlinkTraversal,
+	ReasonSpecialFile:          ErrSpecialFile,
+	ReasonSpecialMode:          ErrSpecialMode,
+	ReasonWindowsShortFilename: ErrWindowsShortFilename,
+	ReasonBackslash:            ErrBackslash,
+	ReasonFanOut:               ErrFanOut,
+	ReasonOrderDependent:       ErrOrderDependent,
+	ReasonSymlinkTarget:        ErrSymlinkTarget,
+	ReasonUnexpectedPrefix:     ErrUnexpectedPrefix,
+	ReasonDuplicate:            ErrDuplicate,
+	ReasonCollision:            ErrCollision,
+	ReasonUnsafeUnicode:        ErrUnsafeUnicode,
+	ReasonSymlinkLoop:          ErrSymlinkLoop,
+	ReasonEncrypted:            ErrEncryptedEntry,
+	ReasonInvalidEncoding:      ErrInvalidEncoding,
+}
+
+// RejectionError returns the error wrapped by the errors of readers rejecting an entry for reason:
+// the error specific to the reason (e.g. ErrPathTraversal), or ErrRejected.
+func RejectionError(reason Reason) error {
+	if err, ok := reasonErrors[reason]; ok {
+		return err
+	}
+	return ErrRejected
+}
+
+// ReasonCustomRule is the reason of the findings of custom rules that did not specify one.
+const ReasonCustomRule Reason = "custom-rule"
+
+// Verdict is the decision of a rule about an entry.
+type Verdict struct {
+	// Action is what happens to the entry:
+	//  - ActionNone keeps the entry as it is. If Reason is set, the entry is reported nevertheless.
+	//  - ActionModified keeps the entry with the changes the rule made.
+	//  - ActionDropped skips the entry.
+	//  - ActionRejected fails reading the archive with an error wrapping ErrRejected.
+	Action Action
+	// Reason is the reason code of the finding reported about the entry.
+	Reason Reason
+	// Detail is an optional human readable explanation.
+	Detail string
+}
+
+// Pass is the verdict of rules that have nothing to say about an entry.
+var Pass = Verdict{}
+
+// Strict returns the verdict in the strict mode of the readers, where entries are rejected
+// instead of being silently skipped or rewritten: dropped entries are rejected, and so are
+// modified entries unless their finding is informational only (e.g. a cosmetic normalization of
+// the name).
+func (v Verdict) Strict() Verdict {
+	switch v.Action {
+	case ActionDropped:
+		v.Action = ActionRejected
+	case ActionModified:
+		if (Finding{Reason: v.Reason}).EffectiveSeverity() > SeverityInfo {
+			v.Action = ActionRejected
+		}
+	}
+	return v
+}
+
+// Rule is a check the safearchive readers apply to every entry of an archive, after their
+// built-in sanitization of the entry. Rules are applied in the order they were added, until one of
+// them drops or rejects the entry. The changes they make are checked again by the built-in
+// features, and the features keeping track of the entries seen so far (e.g. duplicates or
+// symbolic links) see the entries after the rules. Their verdicts participate in the audit report
+// of the reader.
+type Rule interface {
+	// Check inspects e and returns the verdict about it. Rules may sanitize the entry by modifying
+	// e and returning ActionModified; changes of Name, Linkname and the permission bits (including
+	// setuid, setgid and sticky) of Mode are applied to the entry.
+	Check(e *Entry) Verdict
+}
+
+// RuleFunc adapts a function to the Rule interface.
+type RuleFunc func(e *Entry) Verdict
+
+// Check calls f(e).
+func (f RuleFunc) Check(e *Entry) Verdict {
+	return f(e)
+}
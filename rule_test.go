@@ -0,0 +1,54 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestVerdictStrict(t *testing.T) {
+	tests := []struct {
+		v    Verdict
+		want Action
+	}{
+		{Pass, ActionNone},
+		{Verdict{Action: ActionNone, Reason: ReasonCustomRule}, ActionNone},
+		{Verdict{Action: ActionModified, Reason: ReasonPathTraversal}, ActionRejected},
+		{Verdict{Action: ActionModified, Reason: ReasonSpecialMode}, ActionRejected},
+		{Verdict{Action: ActionModified, Reason: ReasonPathNormalized}, ActionModified},
+		{Verdict{Action: ActionModified, Reason: ReasonXattrs}, ActionModified},
+		{Verdict{Action: ActionDropped, Reason: ReasonSymlinkTraversal}, ActionRejected},
+		{Verdict{Action: ActionDropped, Reason: ReasonBackslash}, ActionRejected},
+		{Verdict{Action: ActionRejected, Reason: ReasonCustomRule}, ActionRejected},
+	}
+	for _, tc := range tests {
+		if got := tc.v.Strict(); got.Action != tc.want || got.Reason != tc.v.Reason {
+			t.Errorf("%+v.Strict() = %+v, want action %v", tc.v, got, tc.want)
+		}
+	}
+}
+
+func TestRejectionError(t *testing.T) {
+	for reason, want := range reasonErrors {
+		err := RejectionError(reason)
+		if err != want || !errors.Is(err, ErrRejected) {
+			t.Errorf("RejectionError(%q) = %v, want %v wrapping %v", reason, err, want, ErrRejected)
+		}
+	}
+	if err := RejectionError(ReasonCustomRule); err != ErrRejected {
+		t.Errorf("RejectionError(%q) = %v, want %v", ReasonCustomRule, err, ErrRejected)
+	}
+}
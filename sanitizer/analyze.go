@@ -0,0 +1,88 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sanitizer
+
+// ChangeKind is the kind of a change made by the sanitization of a path.
+type ChangeKind string
+
+const (
+	// ChangeSeparator is the normalization of backslashes into forward slashes, on the platforms
+	// where backslashes are not path separators.
+	ChangeSeparator ChangeKind = "separator"
+	// ChangeAbsolute is the removal of the leading separators of an absolute path (including UNC
+	// paths and the device prefixes of Windows, e.g. \\?\).
+	ChangeAbsolute ChangeKind = "absolute"
+	// ChangeDotDot is the removal of the ".." path elements escaping the path.
+	ChangeDotDot ChangeKind = "dot-dot"
+	// ChangeDriveLetter is the removal of a drive letter, or its conversion into a path component.
+	ChangeDriveLetter ChangeKind = "drive-letter"
+	// ChangeDataStream is the split of a name with an alternate data stream (file:stream) into
+	// path components.
+	ChangeDataStream ChangeKind = "data-stream"
+	// ChangeInvalidCharacter is the conversion of characters that are invalid in names into path
+	// separators or replacement characters.
+	ChangeInvalidCharacter ChangeKind = "invalid-character"
+	// ChangeTrailingDotSpace is the trimming of the trailing dots and spaces of a path component,
+	// which Windows strips silently.
+	ChangeTrailingDotSpace ChangeKind = "trailing-dot-space"
+	// ChangeReservedName is the suffixing of a reserved device name (e.g. LPT1).
+	ChangeReservedName ChangeKind = "reserved-name"
+	// ChangeTruncated is the truncation of a path component longer than the maximum length.
+	ChangeTruncated ChangeKind = "truncated"
+)
+
+// Change is a change made by the sanitization of a path.
+type Change struct {
+	Kind ChangeKind
+	// Component is the path component or the characters affected by the change, if any.
+	Component string
+}
+
+func (c Change) String() string {
+	if c.Component == "" {
+		return string(c.Kind)
+	}
+	return string(c.Kind) + " " + c.Component
+}
+
+// changeList records the changes of a sanitization. Its methods do nothing on a nil list.
+type changeList []Change
+
+func (l *changeList) add(kind ChangeKind, component string) {
+	if l == nil {
+		return
+	}
+	c := Change{Kind: kind, Component: component}
+	for _, o := range *l {
+		if o == c {
+			return
+		}
+	}
+	*l = append(*l, c)
+}
+
+// Analyze sanitizes the supplied path like SanitizePath and also returns the changes made to it, in
+// the order they were made, so security scanners can report what was wrong with the path. The
+// changes are empty if the path was already safe.
+func Analyze(in string) (sanitized string, changes []Change) {
+	return AnalyzeWithPolicy(in, defaultPolicy)
+}
+
+// AnalyzeWithPolicy is Analyze with the rules of p. Strict policies do not make it fail.
+func AnalyzeWithPolicy(in string, p Policy) (sanitized string, changes []Change) {
+	var l changeList
+	sanitized = sanitizeWithPolicy(in, p, &l)
+	return sanitized, l
+}
@@ -0,0 +1,396 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sanitizer
+
+// decompositions are the canonical decompositions of the characters of the Basic Multilingual
+// Plane, one level deep, taken from the Decomposition_Mapping field of UnicodeData.txt in the
+// Unicode Character Database 14.0.0 (without the compatibility decompositions, which are tagged).
+// The Hangul syllables are decomposed algorithmically instead.
+var decompositions = map[rune]string{
+	0x00C0: "\u0041\u0300", 0x00C1: "\u0041\u0301", 0x00C2: "\u0041\u0302", 0x00C3: "\u0041\u0303",
+	0x00C4: "\u0041\u0308", 0x00C5: "\u0041\u030A", 0x00C7: "\u0043\u0327", 0x00C8: "\u0045\u0300",
+	0x00C9: "\u0045\u0301", 0x00CA: "\u0045\u0302", 0x00CB: "\u0045\u0308", 0x00CC: "\u0049\u0300",
+	0x00CD: "\u0049\u0301", 0x00CE: "\u0049\u0302", 0x00CF: "\u0049\u0308", 0x00D1: "\u004E\u0303",
+	0x00D2: "\u004F\u0300", 0x00D3: "\u004F\u0301", 0x00D4: "\u004F\u0302", 0x00D5: "\u004F\u0303",
+	0x00D6: "\u004F\u0308", 0x00D9: "\u0055\u0300", 0x00DA: "\u0055\u0301", 0x00DB: "\u0055\u0302",
+	0x00DC: "\u0055\u0308", 0x00DD: "\u0059\u0301", 0x00E0: "\u0061\u0300", 0x00E1: "\u0061\u0301",
+	0x00E2: "\u0061\u0302", 0x00E3: "\u0061\u0303", 0x00E4: "\u0061\u0308", 0x00E5: "\u0061\u030A",
+	0x00E7: "\u0063\u0327", 0x00E8: "\u0065\u0300", 0x00E9: "\u0065\u0301", 0x00EA: "\u0065\u0302",
+	0x00EB: "\u0065\u0308", 0x00EC: "\u0069\u0300", 0x00ED: "\u0069\u0301", 0x00EE: "\u0069\u0302",
+	0x00EF: "\u0069\u0308", 0x00F1: "\u006E\u0303", 0x00F2: "\u006F\u0300", 0x00F3: "\u006F\u0301",
+	0x00F4: "\u006F\u0302", 0x00F5: "\u006F\u0303", 0x00F6: "\u006F\u0308", 0x00F9: "\u0075\u0300",
+	0x00FA: "\u0075\u0301", 0x00FB: "\u0075\u0302", 0x00FC: "\u0075\u0308", 0x00FD: "\u0079\u0301",
+	0x00FF: "\u0079\u0308", 0x0100: "\u0041\u0304", 0x0101: "\u0061\u0304", 0x0102: "\u0041\u0306",
+	0x0103: "\u0061\u0306", 0x0104: "\u0041\u0328", 0x0105: "\u0061\u0328", 0x0106: "\u0043\u0301",
+	0x0107: "\u0063\u0301", 0x0108: "\u0043\u0302", 0x0109: "\u0063\u0302", 0x010A: "\u0043\u0307",
+	0x010B: "\u0063\u0307", 0x010C: "\u0043\u030C", 0x010D: "\u0063\u030C", 0x010E: "\u0044\u030C",
+	0x010F: "\u0064\u030C", 0x0112: "\u0045\u0304", 0x0113: "\u0065\u0304", 0x0114: "\u0045\u0306",
+	0x0115: "\u0065\u0306", 0x0116: "\u0045\u0307", 0x0117: "\u0065\u0307", 0x0118: "\u0045\u0328",
+	0x0119: "\u0065\u0328", 0x011A: "\u0045\u030C", 0x011B: "\u0065\u030C", 0x011C: "\u0047\u0302",
+	0x011D: "\u0067\u0302", 0x011E: "\u0047\u0306", 0x011F: "\u0067\u0306", 0x0120: "\u0047\u0307",
+	0x0121: "\u0067\u0307", 0x0122: "\u0047\u0327", 0x0123: "\u0067\u0327", 0x0124: "\u0048\u0302",
+	0x0125: "\u0068\u0302", 0x0128: "\u0049\u0303", 0x0129: "\u0069\u0303", 0x012A: "\u0049\u0304",
+	0x012B: "\u0069\u0304", 0x012C: "\u0049\u0306", 0x012D: "\u0069\u0306", 0x012E: "\u0049\u0328",
+	0x012F: "\u0069\u0328", 0x0130: "\u0049\u0307", 0x0134: "\u004A\u0302", 0x0135: "\u006A\u0302",
+	0x0136: "\u004B\u0327", 0x0137: "\u006B\u0327", 0x0139: "\u004C\u0301", 0x013A: "\u006C\u0301",
+	0x013B: "\u004C\u0327", 0x013C: "\u006C\u0327", 0x013D: "\u004C\u030C", 0x013E: "\u006C\u030C",
+	0x0143: "\u004E\u0301", 0x0144: "\u006E\u0301", 0x0145: "\u004E\u0327", 0x0146: "\u006E\u0327",
+	0x0147: "\u004E\u030C", 0x0148: "\u006E\u030C", 0x014C: "\u004F\u0304", 0x014D: "\u006F\u0304",
+	0x014E: "\u004F\u0306", 0x014F: "\u006F\u0306", 0x0150: "\u004F\u030B", 0x0151: "\u006F\u030B",
+	0x0154: "\u0052\u0301", 0x0155: "\u0072\u0301", 0x0156: "\u0052\u0327", 0x0157: "\u0072\u0327",
+	0x0158: "\u0052\u030C", 0x0159: "\u0072\u030C", 0x015A: "\u0053\u0301", 0x015B: "\u0073\u0301",
+	0x015C: "\u0053\u0302", 0x015D: "\u0073\u0302", 0x015E: "\u0053\u0327", 0x015F: "\u0073\u0327",
+	0x0160: "\u0053\u030C", 0x0161: "\u0073\u030C", 0x0162: "\u0054\u0327", 0x0163: "\u0074\u0327",
+	0x0164: "\u0054\u030C", 0x0165: "\u0074\u030C", 0x0168: "\u0055\u0303", 0x0169: "\u0075\u0303",
+	0x016A: "\u0055\u0304", 0x016B: "\u0075\u0304", 0x016C: "\u0055\u0306", 0x016D: "\u0075\u0306",
+	0x016E: "\u0055\u030A", 0x016F: "\u0075\u030A", 0x0170: "\u0055\u030B", 0x0171: "\u0075\u030B",
+	0x0172: "\u0055\u0328", 0x0173: "\u0075\u0328", 0x0174: "\u0057\u0302", 0x0175: "\u0077\u0302",
+	0x0176: "\u0059\u0302", 0x0177: "\u0079\u0302", 0x0178: "\u0059\u0308", 0x0179: "\u005A\u0301",
+	0x017A: "\u007A\u0301", 0x017B: "\u005A\u0307", 0x017C: "\u007A\u0307", 0x017D: "\u005A\u030C",
+	0x017E: "\u007A\u030C", 0x01A0: "\u004F\u031B", 0x01A1: "\u006F\u031B", 0x01AF: "\u0055\u031B",
+	0x01B0: "\u0075\u031B", 0x01CD: "\u0041\u030C", 0x01CE: "\u0061\u030C", 0x01CF: "\u0049\u030C",
+	0x01D0: "\u0069\u030C", 0x01D1: "\u004F\u030C", 0x01D2: "\u006F\u030C", 0x01D3: "\u0055\u030C",
+	0x01D4: "\u0075\u030C", 0x01D5: "\u00DC\u0304", 0x01D6: "\u00FC\u0304", 0x01D7: "\u00DC\u0301",
+	0x01D8: "\u00FC\u0301", 0x01D9: "\u00DC\u030C", 0x01DA: "\u00FC\u030C", 0x01DB: "\u00DC\u0300",
+	0x01DC: "\u00FC\u0300", 0x01DE: "\u00C4\u0304", 0x01DF: "\u00E4\u0304", 0x01E0: "\u0226\u0304",
+	0x01E1: "\u0227\u0304", 0x01E2: "\u00C6\u0304", 0x01E3: "\u00E6\u0304", 0x01E6: "\u0047\u030C",
+	0x01E7: "\u0067\u030C", 0x01E8: "\u004B\u030C", 0x01E9: "\u006B\u030C", 0x01EA: "\u004F\u0328",
+	0x01EB: "\u006F\u0328", 0x01EC: "\u01EA\u0304", 0x01ED: "\u01EB\u0304", 0x01EE: "\u01B7\u030C",
+	0x01EF: "\u0292\u030C", 0x01F0: "\u006A\u030C", 0x01F4: "\u0047\u0301", 0x01F5: "\u0067\u0301",
+	0x01F8: "\u004E\u0300", 0x01F9: "\u006E\u0300", 0x01FA: "\u00C5\u0301", 0x01FB: "\u00E5\u0301",
+	0x01FC: "\u00C6\u0301", 0x01FD: "\u00E6\u0301", 0x01FE: "\u00D8\u0301", 0x01FF: "\u00F8\u0301",
+	0x0200: "\u0041\u030F", 0x0201: "\u0061\u030F", 0x0202: "\u0041\u0311", 0x0203: "\u0061\u0311",
+	0x0204: "\u0045\u030F", 0x0205: "\u0065\u030F", 0x0206: "\u0045\u0311", 0x0207: "\u0065\u0311",
+	0x0208: "\u0049\u030F", 0x0209: "\u0069\u030F", 0x020A: "\u0049\u0311", 0x020B: "\u0069\u0311",
+	0x020C: "\u004F\u030F", 0x020D: "\u006F\u030F", 0x020E: "\u004F\u0311", 0x020F: "\u006F\u0311",
+	0x0210: "\u0052\u030F", 0x0211: "\u0072\u030F", 0x0212: "\u0052\u0311", 0x0213: "\u0072\u0311",
+	0x0214: "\u0055\u030F", 0x0215: "\u0075\u030F", 0x0216: "\u0055\u0311", 0x0217: "\u0075\u0311",
+	0x0218: "\u0053\u0326", 0x0219: "\u0073\u0326", 0x021A: "\u0054\u0326", 0x021B: "\u0074\u0326",
+	0x021E: "\u0048\u030C", 0x021F: "\u0068\u030C", 0x0226: "\u0041\u0307", 0x0227: "\u0061\u0307",
+	0x0228: "\u0045\u0327", 0x0229: "\u0065\u0327", 0x022A: "\u00D6\u0304", 0x022B: "\u00F6\u0304",
+	0x022C: "\u00D5\u0304", 0x022D: "\u00F5\u0304", 0x022E: "\u004F\u0307", 0x022F: "\u006F\u0307",
+	0x0230: "\u022E\u0304", 0x0231: "\u022F\u0304", 0x0232: "\u0059\u0304", 0x0233: "\u0079\u0304",
+	0x0340: "\u0300", 0x0341: "\u0301", 0x0343: "\u0313", 0x0344: "\u0308\u0301",
+	0x0374: "\u02B9", 0x037E: "\u003B", 0x0385: "\u00A8\u0301", 0x0386: "\u0391\u0301",
+	0x0387: "\u00B7", 0x0388: "\u0395\u0301", 0x0389: "\u0397\u0301", 0x038A: "\u0399\u0301",
+	0x038C: "\u039F\u0301", 0x038E: "\u03A5\u0301", 0x038F: "\u03A9\u0301", 0x0390: "\u03CA\u0301",
+	0x03AA: "\u0399\u0308", 0x03AB: "\u03A5\u0308", 0x03AC: "\u03B1\u0301", 0x03AD: "\u03B5\u0301",
+	0x03AE: "\u03B7\u0301", 0x03AF: "\u03B9\u0301", 0x03B0: "\u03CB\u0301", 0x03CA: "\u03B9\u0308",
+	0x03CB: "\u03C5\u0308", 0x03CC: "\u03BF\u0301", 0x03CD: "\u03C5\u0301", 0x03CE: "\u03C9\u0301",
+	0x03D3: "\u03D2\u0301", 0x03D4: "\u03D2\u0308", 0x0400: "\u0415\u0300", 0x0401: "\u0415\u0308",
+	0x0403: "\u0413\u0301", 0x0407: "\u0406\u0308", 0x040C: "\u041A\u0301", 0x040D: "\u0418\u0300",
+	0x040E: "\u0423\u0306", 0x0419: "\u0418\u0306", 0x0439: "\u0438\u0306", 0x0450: "\u0435\u0300",
+	0x0451: "\u0435\u0308", 0x0453: "\u0433\u0301", 0x0457: "\u0456\u0308", 0x045C: "\u043A\u0301",
+	0x045D: "\u0438\u0300", 0x045E: "\u0443\u0306", 0x0476: "\u0474\u030F", 0x0477: "\u0475\u030F",
+	0x04C1: "\u0416\u0306", 0x04C2: "\u0436\u0306", 0x04D0: "\u0410\u0306", 0x04D1: "\u0430\u0306",
+	0x04D2: "\u0410\u0308", 0x04D3: "\u0430\u0308", 0x04D6: "\u0415\u0306", 0x04D7: "\u0435\u0306",
+	0x04DA: "\u04D8\u0308", 0x04DB: "\u04D9\u0308", 0x04DC: "\u0416\u0308", 0x04DD: "\u0436\u0308",
+	0x04DE: "\u0417\u0308", 0x04DF: "\u0437\u0308", 0x04E2: "\u0418\u0304", 0x04E3: "\u0438\u0304",
+	0x04E4: "\u0418\u0308", 0x04E5: "\u0438\u0308", 0x04E6: "\u041E\u0308", 0x04E7: "\u043E\u0308",
+	0x04EA: "\u04E8\u0308", 0x04EB: "\u04E9\u0308", 0x04EC: "\u042D\u0308", 0x04ED: "\u044D\u0308",
+	0x04EE: "\u0423\u0304", 0x04EF: "\u0443\u0304", 0x04F0: "\u0423\u0308", 0x04F1: "\u0443\u0308",
+	0x04F2: "\u0423\u030B", 0x04F3: "\u0443\u030B", 0x04F4: "\u0427\u0308", 0x04F5: "\u0447\u0308",
+	0x04F8: "\u042B\u0308", 0x04F9: "\u044B\u0308", 0x0622: "\u0627\u0653", 0x0623: "\u0627\u0654",
+	0x0624: "\u0648\u0654", 0x0625: "\u0627\u0655", 0x0626: "\u064A\u0654", 0x06C0: "\u06D5\u0654",
+	0x06C2: "\u06C1\u0654", 0x06D3: "\u06D2\u0654", 0x0929: "\u0928\u093C", 0x0931: "\u0930\u093C",
+	0x0934: "\u0933\u093C", 0x0958: "\u0915\u093C", 0x0959: "\u0916\u093C", 0x095A: "\u0917\u093C",
+	0x095B: "\u091C\u093C", 0x095C: "\u0921\u093C", 0x095D: "\u0922\u093C", 0x095E: "\u092B\u093C",
+	0x095F: "\u092F\u093C", 0x09CB: "\u09C7\u09BE", 0x09CC: "\u09C7\u09D7", 0x09DC: "\u09A1\u09BC",
+	0x09DD: "\u09A2\u09BC", 0x09DF: "\u09AF\u09BC", 0x0A33: "\u0A32\u0A3C", 0x0A36: "\u0A38\u0A3C",
+	0x0A59: "\u0A16\u0A3C", 0x0A5A: "\u0A17\u0A3C", 0x0A5B: "\u0A1C\u0A3C", 0x0A5E: "\u0A2B\u0A3C",
+	0x0B48: "\u0B47\u0B56", 0x0B4B: "\u0B47\u0B3E", 0x0B4C: "\u0B47\u0B57", 0x0B5C: "\u0B21\u0B3C",
+	0x0B5D: "\u0B22\u0B3C", 0x0B94: "\u0B92\u0BD7", 0x0BCA: "\u0BC6\u0BBE", 0x0BCB: "\u0BC7\u0BBE",
+	0x0BCC: "\u0BC6\u0BD7", 0x0C48: "\u0C46\u0C56", 0x0CC0: "\u0CBF\u0CD5", 0x0CC7: "\u0CC6\u0CD5",
+	0x0CC8: "\u0CC6\u0CD6", 0x0CCA: "\u0CC6\u0CC2", 0x0CCB: "\u0CCA\u0CD5", 0x0D4A: "\u0D46\u0D3E",
+	0x0D4B: "\u0D47\u0D3E", 0x0D4C: "\u0D46\u0D57", 0x0DDA: "\u0DD9\u0DCA", 0x0DDC: "\u0DD9\u0DCF",
+	0x0DDD: "\u0DDC\u0DCA", 0x0DDE: "\u0DD9\u0DDF", 0x0F43: "\u0F42\u0FB7", 0x0F4D: "\u0F4C\u0FB7",
+	0x0F52: "\u0F51\u0FB7", 0x0F57: "\u0F56\u0FB7", 0x0F5C: "\u0F5B\u0FB7", 0x0F69: "\u0F40\u0FB5",
+	0x0F73: "\u0F71\u0F72", 0x0F75: "\u0F71\u0F74", 0x0F76: "\u0FB2\u0F80", 0x0F78: "\u0FB3\u0F80",
+	0x0F81: "\u0F71\u0F80", 0x0F93: "\u0F92\u0FB7", 0x0F9D: "\u0F9C\u0FB7", 0x0FA2: "\u0FA1\u0FB7",
+	0x0FA7: "\u0FA6\u0FB7", 0x0FAC: "\u0FAB\u0FB7", 0x0FB9: "\u0F90\u0FB5", 0x1026: "\u1025\u102E",
+	0x1B06: "\u1B05\u1B35", 0x1B08: "\u1B07\u1B35", 0x1B0A: "\u1B09\u1B35", 0x1B0C: "\u1B0B\u1B35",
+	0x1B0E: "\u1B0D\u1B35", 0x1B12: "\u1B11\u1B35", 0x1B3B: "\u1B3A\u1B35", 0x1B3D: "\u1B3C\u1B35",
+	0x1B40: "\u1B3E\u1B35", 0x1B41: "\u1B3F\u1B35", 0x1B43: "\u1B42\u1B35", 0x1E00: "\u0041\u0325",
+	0x1E01: "\u0061\u0325", 0x1E02: "\u0042\u0307", 0x1E03: "\u0062\u0307", 0x1E04: "\u0042\u0323",
+	0x1E05: "\u0062\u0323", 0x1E06: "\u0042\u0331", 0x1E07: "\u0062\u0331", 0x1E08: "\u00C7\u0301",
+	0x1E09: "\u00E7\u0301", 0x1E0A: "\u0044\u0307", 0x1E0B: "\u0064\u0307", 0x1E0C: "\u0044\u0323",
+	0x1E0D: "\u0064\u0323", 0x1E0E: "\u0044\u0331", 0x1E0F: "\u0064\u0331", 0x1E10: "\u0044\u0327",
+	0x1E11: "\u0064\u0327", 0x1E12: "\u0044\u032D", 0x1E13: "\u0064\u032D", 0x1E14: "\u0112\u0300",
+	0x1E15: "\u0113\u0300", 0x1E16: "\u0112\u0301", 0x1E17: "\u0113\u0301", 0x1E18: "\u0045\u032D",
+	0x1E19: "\u0065\u032D", 0x1E1A: "\u0045\u0330", 0x1E1B: "\u0065\u0330", 0x1E1C: "\u0228\u0306",
+	0x1E1D: "\u0229\u0306", 0x1E1E: "\u0046\u0307", 0x1E1F: "\u0066\u0307", 0x1E20: "\u0047\u0304",
+	0x1E21: "\u0067\u0304", 0x1E22: "\u0048\u0307", 0x1E23: "\u0068\u0307", 0x1E24: "\u0048\u0323",
+	0x1E25: "\u0068\u0323", 0x1E26: "\u0048\u0308", 0x1E27: "\u0068\u0308", 0x1E28: "\u0048\u0327",
+	0x1E29: "\u0068\u0327", 0x1E2A: "\u0048\u032E", 0x1E2B: "\u0068\u032E", 0x1E2C: "\u0049\u0330",
+	0x1E2D: "\u0069\u0330", 0x1E2E: "\u00CF\u0301", 0x1E2F: "\u00EF\u0301", 0x1E30: "\u004B\u0301",
+	0x1E31: "\u006B\u0301", 0x1E32: "\u004B\u0323", 0x1E33: "\u006B\u0323", 0x1E34: "\u004B\u0331",
+	0x1E35: "\u006B\u0331", 0x1E36: "\u004C\u0323", 0x1E37: "\u006C\u0323", 0x1E38: "\u1E36\u0304",
+	0x1E39: "\u1E37\u0304", 0x1E3A: "\u004C\u0331", 0x1E3B: "\u006C\u0331", 0x1E3C: "\u004C\u032D",
+	0x1E3D: "\u006C\u032D", 0x1E3E: "\u004D\u0301", 0x1E3F: "\u006D\u0301", 0x1E40: "\u004D\u0307",
+	0x1E41: "\u006D\u0307", 0x1E42: "\u004D\u0323", 0x1E43: "\u006D\u0323", 0x1E44: "\u004E\u0307",
+	0x1E45: "\u006E\u0307", 0x1E46: "\u004E\u0323", 0x1E47: "\u006E\u0323", 0x1E48: "\u004E\u0331",
+	0x1E49: "\u006E\u0331", 0x1E4A: "\u004E\u032D", 0x1E4B: "\u006E\u032D", 0x1E4C: "\u00D5\u0301",
+	0x1E4D: "\u00F5\u0301", 0x1E4E: "\u00D5\u0308", 0x1E4F: "\u00F5\u0308", 0x1E50: "\u014C\u0300",
+	0x1E51: "\u014D\u0300", 0x1E52: "\u014C\u0301", 0x1E53: "\u014D\u0301", 0x1E54: "\u0050\u0301",
+	0x1E55: "\u0070\u0301", 0x1E56: "\u0050\u0307", 0x1E57: "\u0070\u0307", 0x1E58: "\u0052\u0307",
+	0x1E59: "\u0072\u0307", 0x1E5A: "\u0052\u0323", 0x1E5B: "\u0072\u0323", 0x1E5C: "\u1E5A\u0304",
+	0x1E5D: "\u1E5B\u0304", 0x1E5E: "\u0052\u0331", 0x1E5F: "\u0072\u0331", 0x1E60: "\u0053\u0307",
+	0x1E61: "\u0073\u0307", 0x1E62: "\u0053\u0323", 0x1E63: "\u0073\u0323", 0x1E64: "\u015A\u0307",
+	0x1E65: "\u015B\u0307", 0x1E66: "\u0160\u0307", 0x1E67: "\u0161\u0307", 0x1E68: "\u1E62\u0307",
+	0x1E69: "\u1E63\u0307", 0x1E6A: "\u0054\u0307", 0x1E6B: "\u0074\u0307", 0x1E6C: "\u0054\u0323",
+	0x1E6D: "\u0074\u0323", 0x1E6E: "\u0054\u0331", 0x1E6F: "\u0074\u0331", 0x1E70: "\u0054\u032D",
+	0x1E71: "\u0074\u032D", 0x1E72: "\u0055\u0324", 0x1E73: "\u0075\u0324", 0x1E74: "\u0055\u0330",
+	0x1E75: "\u0075\u0330", 0x1E76: "\u0055\u032D", 0x1E77: "\u0075\u032D", 0x1E78: "\u0168\u0301",
+	0x1E79: "\u0169\u0301", 0x1E7A: "\u016A\u0308", 0x1E7B: "\u016B\u0308", 0x1E7C: "\u0056\u0303",
+	0x1E7D: "\u0076\u0303", 0x1E7E: "\u0056\u0323", 0x1E7F: "\u0076\u0323", 0x1E80: "\u0057\u0300",
+	0x1E81: "\u0077\u0300", 0x1E82: "\u0057\u0301", 0x1E83: "\u0077\u0301", 0x1E84: "\u0057\u0308",
+	0x1E85: "\u0077\u0308", 0x1E86: "\u0057\u0307", 0x1E87: "\u0077\u0307", 0x1E88: "\u0057\u0323",
+	0x1E89: "\u0077\u0323", 0x1E8A: "\u0058\u0307", 0x1E8B: "\u0078\u0307", 0x1E8C: "\u0058\u0308",
+	0x1E8D: "\u0078\u0308", 0x1E8E: "\u0059\u0307", 0x1E8F: "\u0079\u0307", 0x1E90: "\u005A\u0302",
+	0x1E91: "\u007A\u0302", 0x1E92: "\u005A\u0323", 0x1E93: "\u007A\u0323", 0x1E94: "\u005A\u0331",
+	0x1E95: "\u007A\u0331", 0x1E96: "\u0068\u0331", 0x1E97: "\u0074\u0308", 0x1E98: "\u0077\u030A",
+	0x1E99: "\u0079\u030A", 0x1E9B: "\u017F\u0307", 0x1EA0: "\u0041\u0323", 0x1EA1: "\u0061\u0323",
+	0x1EA2: "\u0041\u0309", 0x1EA3: "\u0061\u0309", 0x1EA4: "\u00C2\u0301", 0x1EA5: "\u00E2\u0301",
+	0x1EA6: "\u00C2\u0300", 0x1EA7: "\u00E2\u0300", 0x1EA8: "\u00C2\u0309", 0x1EA9: "\u00E2\u0309",
+	0x1EAA: "\u00C2\u0303", 0x1EAB: "\u00E2\u0303", 0x1EAC: "\u1EA0\u0302", 0x1EAD: "\u1EA1\u0302",
+	0x1EAE: "\u0102\u0301", 0x1EAF: "\u0103\u0301", 0x1EB0: "\u0102\u0300", 0x1EB1: "\u0103\u0300",
+	0x1EB2: "\u0102\u0309", 0x1EB3: "\u0103\u0309", 0x1EB4: "\u0102\u0303", 0x1EB5: "\u0103\u0303",
+	0x1EB6: "\u1EA0\u0306", 0x1EB7: "\u1EA1\u0306", 0x1EB8: "\u0045\u0323", 0x1EB9: "\u0065\u0323",
+	0x1EBA: "\u0045\u0309", 0x1EBB: "\u0065\u0309", 0x1EBC: "\u0045\u0303", 0x1EBD: "\u0065\u0303",
+	0x1EBE: "\u00CA\u0301", 0x1EBF: "\u00EA\u0301", 0x1EC0: "\u00CA\u0300", 0x1EC1: "\u00EA\u0300",
+	0x1EC2: "\u00CA\u0309", 0x1EC3: "\u00EA\u0309", 0x1EC4: "\u00CA\u0303", 0x1EC5: "\u00EA\u0303",
+	0x1EC6: "\u1EB8\u0302", 0x1EC7: "\u1EB9\u0302", 0x1EC8: "\u0049\u0309", 0x1EC9: "\u0069\u0309",
+	0x1ECA: "\u0049\u0323", 0x1ECB: "\u0069\u0323", 0x1ECC: "\u004F\u0323", 0x1ECD: "\u006F\u0323",
+	0x1ECE: "\u004F\u0309", 0x1ECF: "\u006F\u0309", 0x1ED0: "\u00D4\u0301", 0x1ED1: "\u00F4\u0301",
+	0x1ED2: "\u00D4\u0300", 0x1ED3: "\u00F4\u0300", 0x1ED4: "\u00D4\u0309", 0x1ED5: "\u00F4\u0309",
+	0x1ED6: "\u00D4\u0303", 0x1ED7: "\u00F4\u0303", 0x1ED8: "\u1ECC\u0302", 0x1ED9: "\u1ECD\u0302",
+	0x1EDA: "\u01A0\u0301", 0x1EDB: "\u01A1\u0301", 0x1EDC: "\u01A0\u0300", 0x1EDD: "\u01A1\u0300",
+	0x1EDE: "\u01A0\u0309", 0x1EDF: "\u01A1\u0309", 0x1EE0: "\u01A0\u0303", 0x1EE1: "\u01A1\u0303",
+	0x1EE2: "\u01A0\u0323", 0x1EE3: "\u01A1\u0323", 0x1EE4: "\u0055\u0323", 0x1EE5: "\u0075\u0323",
+	0x1EE6: "\u0055\u0309", 0x1EE7: "\u0075\u0309", 0x1EE8: "\u01AF\u0301", 0x1EE9: "\u01B0\u0301",
+	0x1EEA: "\u01AF\u0300", 0x1EEB: "\u01B0\u0300", 0x1EEC: "\u01AF\u0309", 0x1EED: "\u01B0\u0309",
+	0x1EEE: "\u01AF\u0303", 0x1EEF: "\u01B0\u0303", 0x1EF0: "\u01AF\u0323", 0x1EF1: "\u01B0\u0323",
+	0x1EF2: "\u0059\u0300", 0x1EF3: "\u0079\u0300", 0x1EF4: "\u0059\u0323", 0x1EF5: "\u0079\u0323",
+	0x1EF6: "\u0059\u0309", 0x1EF7: "\u0079\u0309", 0x1EF8: "\u0059\u0303", 0x1EF9: "\u0079\u0303",
+	0x1F00: "\u03B1\u0313", 0x1F01: "\u03B1\u0314", 0x1F02: "\u1F00\u0300", 0x1F03: "\u1F01\u0300",
+	0x1F04: "\u1F00\u0301", 0x1F05: "\u1F01\u0301", 0x1F06: "\u1F00\u0342", 0x1F07: "\u1F01\u0342",
+	0x1F08: "\u0391\u0313", 0x1F09: "\u0391\u0314", 0x1F0A: "\u1F08\u0300", 0x1F0B: "\u1F09\u0300",
+	0x1F0C: "\u1F08\u0301", 0x1F0D: "\u1F09\u0301", 0x1F0E: "\u1F08\u0342", 0x1F0F: "\u1F09\u0342",
+	0x1F10: "\u03B5\u0313", 0x1F11: "\u03B5\u0314", 0x1F12: "\u1F10\u0300", 0x1F13: "\u1F11\u0300",
+	0x1F14: "\u1F10\u0301", 0x1F15: "\u1F11\u0301", 0x1F18: "\u0395\u0313", 0x1F19: "\u0395\u0314",
+	0x1F1A: "\u1F18\u0300", 0x1F1B: "\u1F19\u0300", 0x1F1C: "\u1F18\u0301", 0x1F1D: "\u1F19\u0301",
+	0x1F20: "\u03B7\u0313", 0x1F21: "\u03B7\u0314", 0x1F22: "\u1F20\u0300", 0x1F23: "\u1F21\u0300",
+	0x1F24: "\u1F20\u0301", 0x1F25: "\u1F21\u0301", 0x1F26: "\u1F20\u0342", 0x1F27: "\u1F21\u0342",
+	0x1F28: "\u0397\u0313", 0x1F29: "\u0397\u0314", 0x1F2A: "\u1F28\u0300", 0x1F2B: "\u1F29\u0300",
+	0x1F2C: "\u1F28\u0301", 0x1F2D: "\u1F29\u0301", 0x1F2E: "\u1F28\u0342", 0x1F2F: "\u1F29\u0342",
+	0x1F30: "\u03B9\u0313", 0x1F31: "\u03B9\u0314", 0x1F32: "\u1F30\u0300", 0x1F33: "\u1F31\u0300",
+	0x1F34: "\u1F30\u0301", 0x1F35: "\u1F31\u0301", 0x1F36: "\u1F30\u0342", 0x1F37: "\u1F31\u0342",
+	0x1F38: "\u0399\u0313", 0x1F39: "\u0399\u0314", 0x1F3A: "\u1F38\u0300", 0x1F3B: "\u1F39\u0300",
+	0x1F3C: "\u1F38\u0301", 0x1F3D: "\u1F39\u0301", 0x1F3E: "\u1F38\u0342", 0x1F3F: "\u1F39\u0342",
+	0x1F40: "\u03BF\u0313", 0x1F41: "\u03BF\u0314", 0x1F42: "\u1F40\u0300", 0x1F43: "\u1F41\u0300",
+	0x1F44: "\u1F40\u0301", 0x1F45: "\u1F41\u0301", 0x1F48: "\u039F\u0313", 0x1F49: "\u039F\u0314",
+	0x1F4A: "\u1F48\u0300", 0x1F4B: "\u1F49\u0300", 0x1F4C: "\u1F48\u0301", 0x1F4D: "\u1F49\u0301",
+	0x1F50: "\u03C5\u0313", 0x1F51: "\u03C5\u0314", 0x1F52: "\u1F50\u0300", 0x1F53: "\u1F51\u0300",
+	0x1F54: "\u1F50\u0301", 0x1F55: "\u1F51\u0301", 0x1F56: "\u1F50\u0342", 0x1F57: "\u1F51\u0342",
+	0x1F59: "\u03A5\u0314", 0x1F5B: "\u1F59\u0300", 0x1F5D: "\u1F59\u0301", 0x1F5F: "\u1F59\u0342",
+	0x1F60: "\u03C9\u0313", 0x1F61: "\u03C9\u0314", 0x1F62: "\u1F60\u0300", 0x1F63: "\u1F61\u0300",
+	0x1F64: "\u1F60\u0301", 0x1F65: "\u1F61\u0301", 0x1F66: "\u1F60\u0342", 0x1F67: "\u1F61\u0342",
+	0x1F68: "\u03A9\u0313", 0x1F69: "\u03A9\u0314", 0x1F6A: "\u1F68\u0300", 0x1F6B: "\u1F69\u0300",
+	0x1F6C: "\u1F68\u0301", 0x1F6D: "\u1F69\u0301", 0x1F6E: "\u1F68\u0342", 0x1F6F: "\u1F69\u0342",
+	0x1F70: "\u03B1\u0300", 0x1F71: "\u03AC", 0x1F72: "\u03B5\u0300", 0x1F73: "\u03AD",
+	0x1F74: "\u03B7\u0300", 0x1F75: "\u03AE", 0x1F76: "\u03B9\u0300", 0x1F77: "\u03AF",
+	0x1F78: "\u03BF\u0300", 0x1F79: "\u03CC", 0x1F7A: "\u03C5\u0300", 0x1F7B: "\u03CD",
+	0x1F7C: "\u03C9\u0300", 0x1F7D: "\u03CE", 0x1F80: "\u1F00\u0345", 0x1F81: "\u1F01\u0345",
+	0x1F82: "\u1F02\u0345", 0x1F83: "\u1F03\u0345", 0x1F84: "\u1F04\u0345", 0x1F85: "\u1F05\u0345",
+	0x1F86: "\u1F06\u0345", 0x1F87: "\u1F07\u0345", 0x1F88: "\u1F08\u0345", 0x1F89: "\u1F09\u0345",
+	0x1F8A: "\u1F0A\u0345", 0x1F8B: "\u1F0B\u0345", 0x1F8C: "\u1F0C\u0345", 0x1F8D: "\u1F0D\u0345",
+	0x1F8E: "\u1F0E\u0345", 0x1F8F: "\u1F0F\u0345", 0x1F90: "\u1F20\u0345", 0x1F91: "\u1F21\u0345",
+	0x1F92: "\u1F22\u0345", 0x1F93: "\u1F23\u0345", 0x1F94: "\u1F24\u0345", 0x1F95: "\u1F25\u0345",
+	0x1F96: "\u1F26\u0345", 0x1F97: "\u1F27\u0345", 0x1F98: "\u1F28\u0345", 0x1F99: "\u1F29\u0345",
+	0x1F9A: "\u1F2A\u0345", 0x1F9B: "\u1F2B\u0345", 0x1F9C: "\u1F2C\u0345", 0x1F9D: "\u1F2D\u0345",
+	0x1F9E: "\u1F2E\u0345", 0x1F9F: "\u1F2F\u0345", 0x1FA0: "\u1F60\u0345", 0x1FA1: "\u1F61\u0345",
+	0x1FA2: "\u1F62\u0345", 0x1FA3: "\u1F63\u0345", 0x1FA4: "\u1F64\u0345", 0x1FA5: "\u1F65\u0345",
+	0x1FA6: "\u1F66\u0345", 0x1FA7: "\u1F67\u0345", 0x1FA8: "\u1F68\u0345", 0x1FA9: "\u1F69\u0345",
+	0x1FAA: "\u1F6A\u0345", 0x1FAB: "\u1F6B\u0345", 0x1FAC: "\u1F6C\u0345", 0x1FAD: "\u1F6D\u0345",
+	0x1FAE: "\u1F6E\u0345", 0x1FAF: "\u1F6F\u0345", 0x1FB0: "\u03B1\u0306", 0x1FB1: "\u03B1\u0304",
+	0x1FB2: "\u1F70\u0345", 0x1FB3: "\u03B1\u0345", 0x1FB4: "\u03AC\u0345", 0x1FB6: "\u03B1\u0342",
+	0x1FB7: "\u1FB6\u0345", 0x1FB8: "\u0391\u0306", 0x1FB9: "\u0391\u0304", 0x1FBA: "\u0391\u0300",
+	0x1FBB: "\u0386", 0x1FBC: "\u0391\u0345", 0x1FBE: "\u03B9", 0x1FC1: "\u00A8\u0342",
+	0x1FC2: "\u1F74\u0345", 0x1FC3: "\u03B7\u0345", 0x1FC4: "\u03AE\u0345", 0x1FC6: "\u03B7\u0342",
+	0x1FC7: "\u1FC6\u0345", 0x1FC8: "\u0395\u0300", 0x1FC9: "\u0388", 0x1FCA: "\u0397\u0300",
+	0x1FCB: "\u0389", 0x1FCC: "\u0397\u0345", 0x1FCD: "\u1FBF\u0300", 0x1FCE: "\u1FBF\u0301",
+	0x1FCF: "\u1FBF\u0342", 0x1FD0: "\u03B9\u0306", 0x1FD1: "\u03B9\u0304", 0x1FD2: "\u03CA\u0300",
+	0x1FD3: "\u0390", 0x1FD6: "\u03B9\u0342", 0x1FD7: "\u03CA\u0342", 0x1FD8: "\u0399\u0306",
+	0x1FD9: "\u0399\u0304", 0x1FDA: "\u0399\u0300", 0x1FDB: "\u038A", 0x1FDD: "\u1FFE\u0300",
+	0x1FDE: "\u1FFE\u0301", 0x1FDF: "\u1FFE\u0342", 0x1FE0: "\u03C5\u0306", 0x1FE1: "\u03C5\u0304",
+	0x1FE2: "\u03CB\u0300", 0x1FE3: "\u03B0", 0x1FE4: "\u03C1\u0313", 0x1FE5: "\u03C1\u0314",
+	0x1FE6: "\u03C5\u0342", 0x1FE7: "\u03CB\u0342", 0x1FE8: "\u03A5\u0306", 0x1FE9: "\u03A5\u0304",
+	0x1FEA: "\u03A5\u0300", 0x1FEB: "\u038E", 0x1FEC: "\u03A1\u0314", 0x1FED: "\u00A8\u0300",
+	0x1FEE: "\u0385", 0x1FEF: "\u0060", 0x1FF2: "\u1F7C\u0345", 0x1FF3: "\u03C9\u0345",
+	0x1FF4: "\u03CE\u0345", 0x1FF6: "\u03C9\u0342", 0x1FF7: "\u1FF6\u0345", 0x1FF8: "\u039F\u0300",
+	0x1FF9: "\u038C", 0x1FFA: "\u03A9\u0300", 0x1FFB: "\u038F", 0x1FFC: "\u03A9\u0345",
+	0x1FFD: "\u00B4", 0x2000: "\u2002", 0x2001: "\u2003", 0x2126: "\u03A9",
+	0x212A: "\u004B", 0x212B: "\u00C5", 0x219A: "\u2190\u0338", 0x219B: "\u2192\u0338",
+	0x21AE: "\u2194\u0338", 0x21CD: "\u21D0\u0338", 0x21CE: "\u21D4\u0338", 0x21CF: "\u21D2\u0338",
+	0x2204: "\u2203\u0338", 0x2209: "\u2208\u0338", 0x220C: "\u220B\u0338", 0x2224: "\u2223\u0338",
+	0x2226: "\u2225\u0338", 0x2241: "\u223C\u0338", 0x2244: "\u2243\u0338", 0x2247: "\u2245\u0338",
+	0x2249: "\u2248\u0338", 0x2260: "\u003D\u0338", 0x2262: "\u2261\u0338", 0x226D: "\u224D\u0338",
+	0x226E: "\u003C\u0338", 0x226F: "\u003E\u0338", 0x2270: "\u2264\u0338", 0x2271: "\u2265\u0338",
+	0x2274: "\u2272\u0338", 0x2275: "\u2273\u0338", 0x2278: "\u2276\u0338", 0x2279: "\u2277\u0338",
+	0x2280: "\u227A\u0338", 0x2281: "\u227B\u0338", 0x2284: "\u2282\u0338", 0x2285: "\u2283\u0338",
+	0x2288: "\u2286\u0338", 0x2289: "\u2287\u0338", 0x22AC: "\u22A2\u0338", 0x22AD: "\u22A8\u0338",
+	0x22AE: "\u22A9\u0338", 0x22AF: "\u22AB\u0338", 0x22E0: "\u227C\u0338", 0x22E1: "\u227D\u0338",
+	0x22E2: "\u2291\u0338", 0x22E3: "\u2292\u0338", 0x22EA: "\u22B2\u0338", 0x22EB: "\u22B3\u0338",
+	0x22EC: "\u22B4\u0338", 0x22ED: "\u22B5\u0338", 0x2329: "\u3008", 0x232A: "\u3009",
+	0x2ADC: "\u2ADD\u0338", 0x304C: "\u304B\u3099", 0x304E: "\u304D\u3099", 0x3050: "\u304F\u3099",
+	0x3052: "\u3051\u3099", 0x3054: "\u3053\u3099", 0x3056: "\u3055\u3099", 0x3058: "\u3057\u3099",
+	0x305A: "\u3059\u3099", 0x305C: "\u305B\u3099", 0x305E: "\u305D\u3099", 0x3060: "\u305F\u3099",
+	0x3062: "\u3061\u3099", 0x3065: "\u3064\u3099", 0x3067: "\u3066\u3099", 0x3069: "\u3068\u3099",
+	0x3070: "\u306F\u3099", 0x3071: "\u306F\u309A", 0x3073: "\u3072\u3099", 0x3074: "\u3072\u309A",
+	0x3076: "\u3075\u3099", 0x3077: "\u3075\u309A", 0x3079: "\u3078\u3099", 0x307A: "\u3078\u309A",
+	0x307C: "\u307B\u3099", 0x307D: "\u307B\u309A", 0x3094: "\u3046\u3099", 0x309E: "\u309D\u3099",
+	0x30AC: "\u30AB\u3099", 0x30AE: "\u30AD\u3099", 0x30B0: "\u30AF\u3099", 0x30B2: "\u30B1\u3099",
+	0x30B4: "\u30B3\u3099", 0x30B6: "\u30B5\u3099", 0x30B8: "\u30B7\u3099", 0x30BA: "\u30B9\u3099",
+	0x30BC: "\u30BB\u3099", 0x30BE: "\u30BD\u3099", 0x30C0: "\u30BF\u3099", 0x30C2: "\u30C1\u3099",
+	0x30C5: "\u30C4\u3099", 0x30C7: "\u30C6\u3099", 0x30C9: "\u30C8\u3099", 0x30D0: "\u30CF\u3099",
+	0x30D1: "\u30CF\u309A", 0x30D3: "\u30D2\u3099", 0x30D4: "\u30D2\u309A", 0x30D6: "\u30D5\u3099",
+	0x30D7: "\u30D5\u309A", 0x30D9: "\u30D8\u3099", 0x30DA: "\u30D8\u309A", 0x30DC: "\u30DB\u3099",
+	0x30DD: "\u30DB\u309A", 0x30F4: "\u30A6\u3099", 0x30F7: "\u30EF\u3099", 0x30F8: "\u30F0\u3099",
+	0x30F9: "\u30F1\u3099", 0x30FA: "\u30F2\u3099", 0x30FE: "\u30FD\u3099", 0xF900: "\u8C48",
+	0xF901: "\u66F4", 0xF902: "\u8ECA", 0xF903: "\u8CC8", 0xF904: "\u6ED1",
+	0xF905: "\u4E32", 0xF906: "\u53E5", 0xF907: "\u9F9C", 0xF908: "\u9F9C",
+	0xF909: "\u5951", 0xF90A: "\u91D1", 0xF90B: "\u5587", 0xF90C: "\u5948",
+	0xF90D: "\u61F6", 0xF90E: "\u7669", 0xF90F: "\u7F85", 0xF910: "\u863F",
+	0xF911: "\u87BA", 0xF912: "\u88F8", 0xF913: "\u908F", 0xF914: "\u6A02",
+	0xF915: "\u6D1B", 0xF916: "\u70D9", 0xF917: "\u73DE", 0xF918: "\u843D",
+	0xF919: "\u916A", 0xF91A: "\u99F1", 0xF91B: "\u4E82", 0xF91C: "\u5375",
+	0xF91D: "\u6B04", 0xF91E: "\u721B", 0xF91F: "\u862D", 0xF920: "\u9E1E",
+	0xF921: "\u5D50", 0xF922: "\u6FEB", 0xF923: "\u85CD", 0xF924: "\u8964",
+	0xF925: "\u62C9", 0xF926: "\u81D8", 0xF927: "\u881F", 0xF928: "\u5ECA",
+	0xF929: "\u6717", 0xF92A: "\u6D6A", 0xF92B: "\u72FC", 0xF92C: "\u90CE",
+	0xF92D: "\u4F86", 0xF92E: "\u51B7", 0xF92F: "\u52DE", 0xF930: "\u64C4",
+	0xF931: "\u6AD3", 0xF932: "\u7210", 0xF933: "\u76E7", 0xF934: "\u8001",
+	0xF935: "\u8606", 0xF936: "\u865C", 0xF937: "\u8DEF", 0xF938: "\u9732",
+	0xF939: "\u9B6F", 0xF93A: "\u9DFA", 0xF93B: "\u788C", 0xF93C: "\u797F",
+	0xF93D: "\u7DA0", 0xF93E: "\u83C9", 0xF93F: "\u9304", 0xF940: "\u9E7F",
+	0xF941: "\u8AD6", 0xF942: "\u58DF", 0xF943: "\u5F04", 0xF944: "\u7C60",
+	0xF945: "\u807E", 0xF946: "\u7262", 0xF947: "\u78CA", 0xF948: "\u8CC2",
+	0xF949: "\u96F7", 0xF94A: "\u58D8", 0xF94B: "\u5C62", 0xF94C: "\u6A13",
+	0xF94D: "\u6DDA", 0xF94E: "\u6F0F", 0xF94F: "\u7D2F", 0xF950: "\u7E37",
+	0xF951: "\u964B", 0xF952: "\u52D2", 0xF953: "\u808B", 0xF954: "\u51DC",
+	0xF955: "\u51CC", 0xF956: "\u7A1C", 0xF957: "\u7DBE", 0xF958: "\u83F1",
+	0xF959: "\u9675", 0xF95A: "\u8B80", 0xF95B: "\u62CF", 0xF95C: "\u6A02",
+	0xF95D: "\u8AFE", 0xF95E: "\u4E39", 0xF95F: "\u5BE7", 0xF960: "\u6012",
+	0xF961: "\u7387", 0xF962: "\u7570", 0xF963: "\u5317", 0xF964: "\u78FB",
+	0xF965: "\u4FBF", 0xF966: "\u5FA9", 0xF967: "\u4E0D", 0xF968: "\u6CCC",
+	0xF969: "\u6578", 0xF96A: "\u7D22", 0xF96B: "\u53C3", 0xF96C: "\u585E",
+	0xF96D: "\u7701", 0xF96E: "\u8449", 0xF96F: "\u8AAA", 0xF970: "\u6BBA",
+	0xF971: "\u8FB0", 0xF972: "\u6C88", 0xF973: "\u62FE", 0xF974: "\u82E5",
+	0xF975: "\u63A0", 0xF976: "\u7565", 0xF977: "\u4EAE", 0xF978: "\u5169",
+	0xF979: "\u51C9", 0xF97A: "\u6881", 0xF97B: "\u7CE7", 0xF97C: "\u826F",
+	0xF97D: "\u8AD2", 0xF97E: "\u91CF", 0xF97F: "\u52F5", 0xF980: "\u5442",
+	0xF981: "\u5973", 0xF982: "\u5EEC", 0xF983: "\u65C5", 0xF984: "\u6FFE",
+	0xF985: "\u792A", 0xF986: "\u95AD", 0xF987: "\u9A6A", 0xF988: "\u9E97",
+	0xF989: "\u9ECE", 0xF98A: "\u529B", 0xF98B: "\u66C6", 0xF98C: "\u6B77",
+	0xF98D: "\u8F62", 0xF98E: "\u5E74", 0xF98F: "\u6190", 0xF990: "\u6200",
+	0xF991: "\u649A", 0xF992: "\u6F23", 0xF993: "\u7149", 0xF994: "\u7489",
+	0xF995: "\u79CA", 0xF996: "\u7DF4", 0xF997: "\u806F", 0xF998: "\u8F26",
+	0xF999: "\u84EE", 0xF99A: "\u9023", 0xF99B: "\u934A", 0xF99C: "\u5217",
+	0xF99D: "\u52A3", 0xF99E: "\u54BD", 0xF99F: "\u70C8", 0xF9A0: "\u88C2",
+	0xF9A1: "\u8AAA", 0xF9A2: "\u5EC9", 0xF9A3: "\u5FF5", 0xF9A4: "\u637B",
+	0xF9A5: "\u6BAE", 0xF9A6: "\u7C3E", 0xF9A7: "\u7375", 0xF9A8: "\u4EE4",
+	0xF9A9: "\u56F9", 0xF9AA: "\u5BE7", 0xF9AB: "\u5DBA", 0xF9AC: "\u601C",
+	0xF9AD: "\u73B2", 0xF9AE: "\u7469", 0xF9AF: "\u7F9A", 0xF9B0: "\u8046",
+	0xF9B1: "\u9234", 0xF9B2: "\u96F6", 0xF9B3: "\u9748", 0xF9B4: "\u9818",
+	0xF9B5: "\u4F8B", 0xF9B6: "\u79AE", 0xF9B7: "\u91B4", 0xF9B8: "\u96B8",
+	0xF9B9: "\u60E1", 0xF9BA: "\u4E86", 0xF9BB: "\u50DA", 0xF9BC: "\u5BEE",
+	0xF9BD: "\u5C3F", 0xF9BE: "\u6599", 0xF9BF: "\u6A02", 0xF9C0: "\u71CE",
+	0xF9C1: "\u7642", 0xF9C2: "\u84FC", 0xF9C3: "\u907C", 0xF9C4: "\u9F8D",
+	0xF9C5: "\u6688", 0xF9C6: "\u962E", 0xF9C7: "\u5289", 0xF9C8: "\u677B",
+	0xF9C9: "\u67F3", 0xF9CA: "\u6D41", 0xF9CB: "\u6E9C", 0xF9CC: "\u7409",
+	0xF9CD: "\u7559", 0xF9CE: "\u786B", 0xF9CF: "\u7D10", 0xF9D0: "\u985E",
+	0xF9D1: "\u516D", 0xF9D2: "\u622E", 0xF9D3: "\u9678", 0xF9D4: "\u502B",
+	0xF9D5: "\u5D19", 0xF9D6: "\u6DEA", 0xF9D7: "\u8F2A", 0xF9D8: "\u5F8B",
+	0xF9D9: "\u6144", 0xF9DA: "\u6817", 0xF9DB: "\u7387", 0xF9DC: "\u9686",
+	0xF9DD: "\u5229", 0xF9DE: "\u540F", 0xF9DF: "\u5C65", 0xF9E0: "\u6613",
+	0xF9E1: "\u674E", 0xF9E2: "\u68A8", 0xF9E3: "\u6CE5", 0xF9E4: "\u7406",
+	0xF9E5: "\u75E2", 0xF9E6: "\u7F79", 0xF9E7: "\u88CF", 0xF9E8: "\u88E1",
+	0xF9E9: "\u91CC", 0xF9EA: "\u96E2", 0xF9EB: "\u533F", 0xF9EC: "\u6EBA",
+	0xF9ED: "\u541D", 0xF9EE: "\u71D0", 0xF9EF: "\u7498", 0xF9F0: "\u85FA",
+	0xF9F1: "\u96A3", 0xF9F2: "\u9C57", 0xF9F3: "\u9E9F", 0xF9F4: "\u6797",
+	0xF9F5: "\u6DCB", 0xF9F6: "\u81E8", 0xF9F7: "\u7ACB", 0xF9F8: "\u7B20",
+	0xF9F9: "\u7C92", 0xF9FA: "\u72C0", 0xF9FB: "\u7099", 0xF9FC: "\u8B58",
+	0xF9FD: "\u4EC0", 0xF9FE: "\u8336", 0xF9FF: "\u523A", 0xFA00: "\u5207",
+	0xFA01: "\u5EA6", 0xFA02: "\u62D3", 0xFA03: "\u7CD6", 0xFA04: "\u5B85",
+	0xFA05: "\u6D1E", 0xFA06: "\u66B4", 0xFA07: "\u8F3B", 0xFA08: "\u884C",
+	0xFA09: "\u964D", 0xFA0A: "\u898B", 0xFA0B: "\u5ED3", 0xFA0C: "\u5140",
+	0xFA0D: "\u55C0", 0xFA10: "\u585A", 0xFA12: "\u6674", 0xFA15: "\u51DE",
+	0xFA16: "\u732A", 0xFA17: "\u76CA", 0xFA18: "\u793C", 0xFA19: "\u795E",
+	0xFA1A: "\u7965", 0xFA1B: "\u798F", 0xFA1C: "\u9756", 0xFA1D: "\u7CBE",
+	0xFA1E: "\u7FBD", 0xFA20: "\u8612", 0xFA22: "\u8AF8", 0xFA25: "\u9038",
+	0xFA26: "\u90FD", 0xFA2A: "\u98EF", 0xFA2B: "\u98FC", 0xFA2C: "\u9928",
+	0xFA2D: "\u9DB4", 0xFA2E: "\u90DE", 0xFA2F: "\u96B7", 0xFA30: "\u4FAE",
+	0xFA31: "\u50E7", 0xFA32: "\u514D", 0xFA33: "\u52C9", 0xFA34: "\u52E4",
+	0xFA35: "\u5351", 0xFA36: "\u559D", 0xFA37: "\u5606", 0xFA38: "\u5668",
+	0xFA39: "\u5840", 0xFA3A: "\u58A8", 0xFA3B: "\u5C64", 0xFA3C: "\u5C6E",
+	0xFA3D: "\u6094", 0xFA3E: "\u6168", 0xFA3F: "\u618E", 0xFA40: "\u61F2",
+	0xFA41: "\u654F", 0xFA42: "\u65E2", 0xFA43: "\u6691", 0xFA44: "\u6885",
+	0xFA45: "\u6D77", 0xFA46: "\u6E1A", 0xFA47: "\u6F22", 0xFA48: "\u716E",
+	0xFA49: "\u722B", 0xFA4A: "\u7422", 0xFA4B: "\u7891", 0xFA4C: "\u793E",
+	0xFA4D: "\u7949", 0xFA4E: "\u7948", 0xFA4F: "\u7950", 0xFA50: "\u7956",
+	0xFA51: "\u795D", 0xFA52: "\u798D", 0xFA53: "\u798E", 0xFA54: "\u7A40",
+	0xFA55: "\u7A81", 0xFA56: "\u7BC0", 0xFA57: "\u7DF4", 0xFA58: "\u7E09",
+	0xFA59: "\u7E41", 0xFA5A: "\u7F72", 0xFA5B: "\u8005", 0xFA5C: "\u81ED",
+	0xFA5D: "\u8279", 0xFA5E: "\u8279", 0xFA5F: "\u8457", 0xFA60: "\u8910",
+	0xFA61: "\u8996", 0xFA62: "\u8B01", 0xFA63: "\u8B39", 0xFA64: "\u8CD3",
+	0xFA65: "\u8D08", 0xFA66: "\u8FB6", 0xFA67: "\u9038", 0xFA68: "\u96E3",
+	0xFA69: "\u97FF", 0xFA6A: "\u983B", 0xFA6B: "\u6075", 0xFA6C: "\U000242EE",
+	0xFA6D: "\u8218", 0xFA70: "\u4E26", 0xFA71: "\u51B5", 0xFA72: "\u5168",
+	0xFA73: "\u4F80", 0xFA74: "\u5145", 0xFA75: "\u5180", 0xFA76: "\u52C7",
+	0xFA77: "\u52FA", 0xFA78: "\u559D", 0xFA79: "\u5555", 0xFA7A: "\u5599",
+	0xFA7B: "\u55E2", 0xFA7C: "\u585A", 0xFA7D: "\u58B3", 0xFA7E: "\u5944",
+	0xFA7F: "\u5954", 0xFA80: "\u5A62", 0xFA81: "\u5B28", 0xFA82: "\u5ED2",
+	0xFA83: "\u5ED9", 0xFA84: "\u5F69", 0xFA85: "\u5FAD", 0xFA86: "\u60D8",
+	0xFA87: "\u614E", 0xFA88: "\u6108", 0xFA89: "\u618E", 0xFA8A: "\u6160",
+	0xFA8B: "\u61F2", 0xFA8C: "\u6234", 0xFA8D: "\u63C4", 0xFA8E: "\u641C",
+	0xFA8F: "\u6452", 0xFA90: "\u6556", 0xFA91: "\u6674", 0xFA92: "\u6717",
+	0xFA93: "\u671B", 0xFA94: "\u6756", 0xFA95: "\u6B79", 0xFA96: "\u6BBA",
+	0xFA97: "\u6D41", 0xFA98: "\u6EDB", 0xFA99: "\u6ECB", 0xFA9A: "\u6F22",
+	0xFA9B: "\u701E", 0xFA9C: "\u716E", 0xFA9D: "\u77A7", 0xFA9E: "\u7235",
+	0xFA9F: "\u72AF", 0xFAA0: "\u732A", 0xFAA1: "\u7471", 0xFAA2: "\u7506",
+	0xFAA3: "\u753B", 0xFAA4: "\u761D", 0xFAA5: "\u761F", 0xFAA6: "\u76CA",
+	0xFAA7: "\u76DB", 0xFAA8: "\u76F4", 0xFAA9: "\u774A", 0xFAAA: "\u7740",
+	0xFAAB: "\u78CC", 0xFAAC: "\u7AB1", 0xFAAD: "\u7BC0", 0xFAAE: "\u7C7B",
+	0xFAAF: "\u7D5B", 0xFAB0: "\u7DF4", 0xFAB1: "\u7F3E", 0xFAB2: "\u8005",
+	0xFAB3: "\u8352", 0xFAB4: "\u83EF", 0xFAB5: "\u8779", 0xFAB6: "\u8941",
+	0xFAB7: "\u8986", 0xFAB8: "\u8996", 0xFAB9: "\u8ABF", 0xFABA: "\u8AF8",
+	0xFABB: "\u8ACB", 0xFABC: "\u8B01", 0xFABD: "\u8AFE", 0xFABE: "\u8AED",
+	0xFABF: "\u8B39", 0xFAC0: "\u8B8A", 0xFAC1: "\u8D08", 0xFAC2: "\u8F38",
+	0xFAC3: "\u9072", 0xFAC4: "\u9199", 0xFAC5: "\u9276", 0xFAC6: "\u967C",
+	0xFAC7: "\u96E3", 0xFAC8: "\u9756", 0xFAC9: "\u97DB", 0xFACA: "\u97FF",
+	0xFACB: "\u980B", 0xFACC: "\u983B", 0xFACD: "\u9B12", 0xFACE: "\u9F9C",
+	0xFACF: "\U0002284A", 0xFAD0: "\U00022844", 0xFAD1: "\U000233D5", 0xFAD2: "\u3B9D",
+	0xFAD3: "\u4018", 0xFAD4: "\u4039", 0xFAD5: "\U00025249", 0xFAD6: "\U00025CD0",
+	0xFAD7: "\U00027ED3", 0xFAD8: "\u9F43", 0xFAD9: "\u9F8E", 0xFB1D: "\u05D9\u05B4",
+	0xFB1F: "\u05F2\u05B7", 0xFB2A: "\u05E9\u05C1", 0xFB2B: "\u05E9\u05C2", 0xFB2C: "\uFB49\u05C1",
+	0xFB2D: "\uFB49\u05C2", 0xFB2E: "\u05D0\u05B7", 0xFB2F: "\u05D0\u05B8", 0xFB30: "\u05D0\u05BC",
+	0xFB31: "\u05D1\u05BC", 0xFB32: "\u05D2\u05BC", 0xFB33: "\u05D3\u05BC", 0xFB34: "\u05D4\u05BC",
+	0xFB35: "\u05D5\u05BC", 0xFB36: "\u05D6\u05BC", 0xFB38: "\u05D8\u05BC", 0xFB39: "\u05D9\u05BC",
+	0xFB3A: "\u05DA\u05BC", 0xFB3B: "\u05DB\u05BC", 0xFB3C: "\u05DC\u05BC", 0xFB3E: "\u05DE\u05BC",
+	0xFB40: "\u05E0\u05BC", 0xFB41: "\u05E1\u05BC", 0xFB43: "\u05E3\u05BC", 0xFB44: "\u05E4\u05BC",
+	0xFB46: "\u05E6\u05BC", 0xFB47: "\u05E7\u05BC", 0xFB48: "\u05E8\u05BC", 0xFB49: "\u05E9\u05BC",
+	0xFB4A: "\u05EA\u05BC", 0xFB4B: "\u05D5\u05B9", 0xFB4C: "\u05D1\u05BF", 0xFB4D: "\u05DB\u05BF",
+	0xFB4E: "\u05E4\u05BF",
+}
@@ -0,0 +1,58 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sanitizer
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// IsValidName reports whether in is valid UTF-8 without NUL bytes. Other names may be decoded or
+// truncated differently by the tools and file systems they are handed to, so two names comparing
+// different may designate the same file.
+func IsValidName(in string) bool {
+	return utf8.ValidString(in) && strings.IndexByte(in, 0) < 0
+}
+
+// ReplaceInvalidEncoding replaces every byte of the invalid UTF-8 sequences and every NUL byte of
+// in with the replacement character U+FFFD.
+func ReplaceInvalidEncoding(in string) string {
+	return mapInvalidBytes(in, func(b *strings.Builder, _ byte) { b.WriteRune(utf8.RuneError) })
+}
+
+// PercentEncodeInvalid replaces every byte of the invalid UTF-8 sequences and every NUL byte of in
+// with its percent-encoding, e.g. %FF, keeping the original bytes recognizable.
+func PercentEncodeInvalid(in string) string {
+	return mapInvalidBytes(in, func(b *strings.Builder, c byte) { fmt.Fprintf(b, "%%%02X", c) })
+}
+
+// mapInvalidBytes replaces the bytes of in for which IsValidName fails with the output of repl.
+func mapInvalidBytes(in string, repl func(b *strings.Builder, c byte)) string {
+	if IsValidName(in) {
+		return in
+	}
+	var b strings.Builder
+	for i := 0; i < len(in); {
+		r, n := utf8.DecodeRuneInString(in[i:])
+		if r == utf8.RuneError && n == 1 || r == 0 {
+			repl(&b, in[i])
+		} else {
+			b.WriteString(in[i : i+n])
+		}
+		i += n
+	}
+	return b.String()
+}
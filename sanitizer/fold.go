@@ -0,0 +1,75 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sanitizer
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Constants of the algorithmic decomposition of the Hangul syllables.
+const (
+	hangulBase  = 0xAC00
+	hangulCount = 11172
+	leadBase    = 0x1100
+	vowelBase   = 0x1161
+	trailBase   = 0x11A7
+	vowelCount  = 21
+	trailCount  = 28
+)
+
+// FoldName returns the form of name under which case-insensitive and normalization-insensitive
+// file systems (e.g. the defaults of macOS and Windows) consider names equal: its canonical
+// decomposition (NFD, without reordering combining marks) with the case folded. For example,
+// "README", "readme", "Café" in NFC and "café" fold to the same names pairwise.
+// Distinct entries whose names fold to the same name overwrite each other when extracted there.
+func FoldName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		decompose(&b, r)
+	}
+	return strings.Map(foldRune, b.String())
+}
+
+// decompose writes the canonical decomposition of r to b.
+func decompose(b *strings.Builder, r rune) {
+	if s := r - hangulBase; s >= 0 && s < hangulCount {
+		b.WriteRune(leadBase + s/(vowelCount*trailCount))
+		b.WriteRune(vowelBase + s%(vowelCount*trailCount)/trailCount)
+		if t := s % trailCount; t != 0 {
+			b.WriteRune(trailBase + t)
+		}
+		return
+	}
+	d, ok := decompositions[r]
+	if !ok {
+		b.WriteRune(r)
+		return
+	}
+	for _, c := range d {
+		decompose(b, c)
+	}
+}
+
+// foldRune returns the smallest rune equivalent to r under simple case folding.
+func foldRune(r rune) rune {
+	min := r
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		if f < min {
+			min = f
+		}
+	}
+	return min
+}
@@ -0,0 +1,74 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sanitizer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxPath is the MAX_PATH limit of the Windows API: longer paths (including their terminating NUL
+// character) cannot be used without the extended-length prefix \\?\, see ExtendedLengthPath.
+const MaxPath = 260
+
+const (
+	extendedLengthPrefix = `\\?\`
+	// hashSuffixLen is the length of the hash suffix of the truncated components: a dash and
+	// 8 hexadecimal digits.
+	hashSuffixLen = 9
+)
+
+// ExtendedLengthPath returns the Windows path p with the extended-length prefix \\?\ (or \\?\UNC\
+// for UNC paths) if it is too long for MAX_PATH, so it can be used with the Windows API whatever
+// its length. p must be absolute and clean, with backslashes: the extended-length paths are not
+// normalized by Windows. Other paths are returned unchanged.
+func ExtendedLengthPath(p string) string {
+	if len(p) < MaxPath || strings.HasPrefix(p, extendedLengthPrefix) || strings.HasPrefix(p, `\\.\`) {
+		return p
+	}
+	switch {
+	case strings.HasPrefix(p, `\\`):
+		return extendedLengthPrefix + `UNC\` + p[2:]
+	case len(p) >= 3 && isLetter(p[0]) && p[1] == ':' && p[2] == '\\':
+		return extendedLengthPrefix + p
+	}
+	return p
+}
+
+// truncateComponent truncates the path component name to max bytes, keeping its extension and
+// whole UTF-8 sequences, and ending it with a hash of name if hash is set. Zero means no limit.
+func truncateComponent(name string, max int, hash bool) string {
+	if max <= 0 || len(name) <= max {
+		return name
+	}
+	var suffix string
+	if hash && max >= hashSuffixLen {
+		h := fnv.New32a()
+		h.Write([]byte(name))
+		suffix = fmt.Sprintf("-%08x", h.Sum32())
+	}
+	ext := path.Ext(name)
+	if len(ext)+len(suffix) >= max || ext == name {
+		ext = ""
+	}
+	keep := max - len(ext) - len(suffix)
+	for keep > 0 && !utf8.RuneStart(name[keep]) {
+		keep--
+	}
+	return name[:keep] + suffix + ext
+}
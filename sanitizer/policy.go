@@ -0,0 +1,358 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sanitizer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// DefaultReservedSuffix is the suffix appended to the Windows reserved device names (e.g. LPT1
+// becomes LPT1-safe) by the policies that do not set one.
+const DefaultReservedSuffix = "-safe"
+
+// ErrUnsafePath is wrapped by the errors of SanitizePathWithPolicy for the paths a strict Policy
+// does not accept.
+var ErrUnsafePath = errors.New("sanitizer: unsafe path")
+
+// Policy configures SanitizePathWithPolicy. The zero Policy applies the rules of the Unix-like
+// platforms and uses the path separator of the running platform.
+type Policy struct {
+	// Windows applies the rules of the Windows file systems whatever the running platform: colons
+	// (drive letters and alternate data streams) and question marks are path separators, the
+	// trailing dots and spaces of the path components are trimmed, and the reserved device names
+	// are renamed, see ReservedSuffix.
+	Windows bool
+	// KeepDriveLetters keeps the letter of a leading drive letter as the first path component
+	// (C:\some\thing becomes C\some\thing), instead of dropping it. Only used with Windows.
+	KeepDriveLetters bool
+	// Separator is the path separator of the sanitized paths, '/' or '\\'. Zero means
+	// os.PathSeparator.
+	Separator byte
+	// ReservedPrefix and ReservedSuffix are added to the Windows reserved device names, the suffix
+	// before their extension. If both are empty, ReservedSuffix is DefaultReservedSuffix.
+	ReservedPrefix, ReservedSuffix string
+	// RenameReserved, if set, renames the reserved device names instead of ReservedPrefix and
+	// ReservedSuffix. It is called with the name without its extension (e.g. "LPT1"); the names it
+	// returns that are not valid path components (reserved, empty, "..", with separators, colons,
+	// reserved characters or trailing dots and spaces) get DefaultReservedSuffix instead.
+	RenameReserved func(base string) string
+	// ReservedTaken, if set, makes the renaming of the reserved device names collision-aware, as
+	// the renamed names may legitimately exist in the archive as well: it is called with the
+	// sanitized path (with forward slashes) of a renamed name, and the names it reports as taken
+	// get a counter (LPT1-safe-2, LPT1-safe-3, ...).
+	ReservedTaken func(name string) bool
+	// MaxComponentLength is the maximum length in bytes of a path component. Longer components
+	// are truncated, keeping their extension and whole UTF-8 sequences; reserved names renamed with
+	// ReservedSuffix may exceed it by the length of the suffix. The components truncated to
+	// nothing, "." or ".." are dropped. Zero means no limit.
+	MaxComponentLength int
+	// ReplaceReservedCharacters replaces the characters that Windows forbids in names (< > " | *
+	// and the control characters) with ReservedReplacement, so archives created on Unix extract
+	// deterministically on Windows. Only used with Windows.
+	ReplaceReservedCharacters bool
+	// ReservedReplacement is the replacement of the reserved characters. Zero means '_'; reserved
+	// characters and path separators are not valid replacements.
+	ReservedReplacement rune
+	// HashLongComponents ends the truncated components with a hash of their full name (e.g.
+	// "long-name-3b1f2a9c.txt"), so distinct long names stay distinct and are truncated the same
+	// way by every extraction.
+	HashLongComponents bool
+	// Strict makes SanitizePathWithPolicy fail with ErrUnsafePath instead of rewriting the paths
+	// that are absolute, escape with ".." path elements or are otherwise changed by the policy.
+	// Redundant separators and "." path elements are still cleaned up silently.
+	Strict bool
+}
+
+// DefaultPolicy returns the policy of SanitizePath on the running platform.
+func DefaultPolicy() Policy {
+	return defaultPolicy
+}
+
+func (p Policy) separator() string {
+	if p.Separator == 0 {
+		return string(os.PathSeparator)
+	}
+	return string(p.Separator)
+}
+
+func (p Policy) reservedReplacement() rune {
+	if r := p.ReservedReplacement; r != 0 && !isReservedChar(r) && r != '/' && r != '\\' && r != ':' && r != '?' {
+		return r
+	}
+	return '_'
+}
+
+// isReservedChar reports if r is forbidden in Windows names. The colon and the question mark,
+// also forbidden, are path separators for the sanitizer.
+func isReservedChar(r rune) bool {
+	return r < 32 || strings.ContainsRune(`<>"|*`, r)
+}
+
+// maxReservedCounter bounds the counters tried by renameReserved.
+const maxReservedCounter = 1000
+
+// validRenamed reports if the renamed reserved device name name is a valid Windows path component:
+// not empty or a dot segment, without path separators, colons, reserved characters or trailing
+// dots and spaces, and not reserved itself.
+func validRenamed(name string) bool {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\:?`) ||
+		strings.IndexFunc(name, isReservedChar) >= 0 || strings.TrimRight(name, ". ") != name {
+		return false
+	}
+	base, _, _ := strings.Cut(name, ".")
+	return base != "" && !isReservedName(base)
+}
+
+// renameReserved returns the new name of the reserved device name base, with the extension ext if
+// not empty, in the directory dir. Renamings that are not valid path components (see validRenamed)
+// fall back to DefaultReservedSuffix.
+func (p Policy) renameReserved(dir []string, base, ext string) string {
+	renamed := ""
+	switch {
+	case p.RenameReserved != nil:
+		renamed = p.RenameReserved(base)
+	case p.ReservedPrefix == "" && p.ReservedSuffix == "":
+		renamed = base + DefaultReservedSuffix
+	default:
+		renamed = p.ReservedPrefix + base + p.ReservedSuffix
+	}
+	if !validRenamed(renamed) {
+		renamed = base + DefaultReservedSuffix
+	}
+	name := func(n int) string {
+		re := renamed
+		if n > 1 {
+			re += fmt.Sprintf("-%d", n)
+		}
+		if ext != "" {
+			re += "." + ext
+		}
+		return re
+	}
+	if p.ReservedTaken == nil {
+		return name(1)
+	}
+	for n := 1; n < maxReservedCounter; n++ {
+		if !p.ReservedTaken(path.Join(append(append([]string{}, dir...), name(n))...)) {
+			return name(n)
+		}
+	}
+	return name(maxReservedCounter)
+}
+
+// SanitizePathWithPolicy sanitizes the supplied path by purely lexical processing, like
+// SanitizePath, with the rules of p. If the input path had a directory separator at the end, the
+// sanitized version will preserve that. It only fails if p is strict.
+func SanitizePathWithPolicy(in string, p Policy) (string, error) {
+	var changes changeList
+	sanitized := sanitizeWithPolicy(in, p, &changes)
+	if p.Strict {
+		for _, c := range changes {
+			if c.Kind != ChangeSeparator {
+				return "", fmt.Errorf("%w: %q: %v", ErrUnsafePath, in, c)
+			}
+		}
+	}
+	return sanitized, nil
+}
+
+// sanitizeWithPolicy sanitizes in with p, recording the changes into changes if not nil.
+func sanitizeWithPolicy(in string, p Policy, changes *changeList) string {
+	sanitized := strings.ReplaceAll(sanitizeComponents(in, p, changes), nixPathSeparator, p.separator())
+	// Add back trailing / if safe
+	if len(in) > 0 &&
+		(in[len(in)-1] == nixPathSeparator[0] || in[len(in)-1] == winPathSeparator[0]) &&
+		len(sanitized) > 0 {
+		sanitized = sanitized + p.separator()
+	}
+	return sanitized
+}
+
+// sanitizePath sanitizes in with the default policy, without the trailing separator.
+func sanitizePath(in string) string {
+	return strings.ReplaceAll(sanitizeComponents(in, defaultPolicy, nil), nixPathSeparator, defaultPolicy.separator())
+}
+
+// cleanPath returns the shortest path equivalent to in (see path.Clean), or "" instead of ".".
+func cleanPath(in string) string {
+	in = path.Clean(in)
+	if in == "." {
+		return ""
+	}
+	return in
+}
+
+// cleanRelative cleans the path in with forward slashes into a relative path, dropping its leading
+// separators and the ".." path elements escaping it.
+func cleanRelative(in string, changes *changeList) string {
+	if strings.HasPrefix(in, nixPathSeparator) {
+		changes.add(ChangeAbsolute, "")
+	}
+	if c := path.Clean(strings.TrimLeft(in, nixPathSeparator)); c == ".." || strings.HasPrefix(c, "../") {
+		changes.add(ChangeDotDot, "")
+	}
+	return strings.TrimPrefix(cleanPath(nixPathSeparator+in), nixPathSeparator)
+}
+
+var winReplacer = strings.NewReplacer(`\`, `/`, `?`, `/`)
+
+// sanitizeComponents returns the sanitized path of in with forward slashes and no trailing
+// separator.
+func sanitizeComponents(in string, p Policy, changes *changeList) string {
+	if !p.Windows {
+		if strings.Contains(in, winPathSeparator) {
+			changes.add(ChangeSeparator, "")
+		}
+		in = cleanRelative(strings.ReplaceAll(in, winPathSeparator, nixPathSeparator), changes)
+	} else {
+		if strings.Contains(in, "?") {
+			changes.add(ChangeInvalidCharacter, "?")
+		}
+		// note: cleaning before looking for the drive letter strips the prefixes of weird syntax like
+		// \\.\C:\something or \??\C:\something
+		in = cleanRelative(winReplacer.Replace(in), changes)
+		if len(in) >= 2 && in[1] == ':' && isLetter(in[0]) {
+			changes.add(ChangeDriveLetter, in[:2])
+			if !p.KeepDriveLetters {
+				in = strings.TrimLeft(in[2:], nixPathSeparator)
+			} else {
+				in = in[:1] + nixPathSeparator + in[2:]
+			}
+		}
+		// we get rid of : (ADS or drive letter specifier)
+		if strings.Contains(in, ":") {
+			changes.add(ChangeDataStream, "")
+			in = strings.ReplaceAll(in, ":", nixPathSeparator)
+		}
+		in = cleanRelative(in, changes)
+	}
+	if in == "" || (!p.Windows && p.MaxComponentLength <= 0) {
+		return in
+	}
+	var parts []string
+	for _, part := range strings.Split(in, nixPathSeparator) {
+		if t := truncateComponent(part, p.MaxComponentLength, p.HashLongComponents); t != part {
+			changes.add(ChangeTruncated, part)
+			// the path was cleaned before truncating, so the components truncated to nothing or
+			// to a dot segment (e.g. "..\u20ac" to 2 bytes) are dropped instead of being resolved
+			switch t {
+			case "", ".":
+				continue
+			case "..":
+				changes.add(ChangeDotDot, "")
+				continue
+			}
+			part = t
+		}
+		if !p.Windows {
+			parts = append(parts, part)
+			continue
+		}
+		if p.ReplaceReservedCharacters && strings.IndexFunc(part, isReservedChar) >= 0 {
+			changes.add(ChangeInvalidCharacter, part)
+			part = strings.Map(func(r rune) rune {
+				if isReservedChar(r) {
+					return p.reservedReplacement()
+				}
+				return r
+			}, part)
+		}
+		// Windows silently strips the trailing dots and spaces of names, so "foo. " would be
+		// written as "foo" (and "NUL." opens the device). Components made only of them are dropped.
+		if t := strings.TrimRight(part, ". "); t != part {
+			changes.add(ChangeTrailingDotSpace, part)
+			if part = t; part == "" {
+				continue
+			}
+		}
+		// Trim the extension and look for a reserved name.
+		if base, ext, _ := strings.Cut(part, "."); isReservedName(base) {
+			changes.add(ChangeReservedName, part)
+			part = p.renameReserved(parts, base, ext)
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, nixPathSeparator)
+}
+
+var (
+	ss1 = "\u00B9" // Superscript One https://www.compart.com/en/unicode/U+00B9
+	ss2 = "\u00B2" // Superscript Two https://www.compart.com/en/unicode/U+00B2
+	ss3 = "\u00B3" // Superscript Three https://www.compart.com/en/unicode/U+00B3
+)
+
+// isReservedName reports if name is a Windows reserved device name or a console handle.
+// It does not detect names with an extension, which are also reserved on some Windows versions.
+//
+// For details, search for PRN in
+// https://docs.microsoft.com/en-us/windows/desktop/fileio/naming-a-file.
+//
+// This is borrowed from https://github.com/golang/go/blob/master/src/path/filepath/path_windows.go
+// and fixed.
+func isReservedName(name string) bool {
+	nameLen := len(name)
+	if nameLen < 3 {
+		return false
+	}
+
+	reservedNameLen := 0
+	prefix := strings.ToUpper(name[0:3])
+	switch prefix {
+	case "CON":
+		reservedNameLen = 3
+
+		// Passing CONIN$ or CONOUT$ to CreateFile opens a console handle.
+		// https://learn.microsoft.com/en-us/windows/win32/api/fileapi/nf-fileapi-createfilea#consoles
+		//
+		// While CONIN$ and CONOUT$ aren't documented as being files,
+		// they behave the same as CON. For example, ./CONIN$ also opens the console input.
+
+		if nameLen >= 6 && name[5] == '$' && strings.EqualFold(name[3:6], "IN$") {
+			reservedNameLen += 3
+		}
+		if nameLen >= 7 && name[6] == '$' && strings.EqualFold(name[3:7], "OUT$") {
+			reservedNameLen += 4
+		}
+
+	case "PRN", "AUX", "NUL":
+		reservedNameLen = 3
+	case "COM", "LPT":
+		// these two reserved names must be followed by a digit or a SUPERSCRIPT
+		if nameLen >= 4 {
+			switch name[3] {
+			case '1', '2', '3', '4', '5', '6', '7', '8', '9':
+				reservedNameLen = 4
+			case ss1[0]: // unicode
+				if nameLen >= 5 {
+					switch name[4] {
+					case ss1[1], ss2[1], ss3[1]:
+						reservedNameLen = 5
+					}
+				}
+			}
+		}
+	}
+
+	// All the reserved names may be followed by optional whitespaces
+	if reservedNameLen != 0 && strings.TrimSpace(name[reservedNameLen:]) == "" {
+		return true
+	}
+
+	return false
+}
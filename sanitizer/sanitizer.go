@@ -17,7 +17,7 @@
 package sanitizer
 
 import (
-	"os"
+	"path"
 	"regexp"
 	"strings"
 )
@@ -38,16 +38,74 @@ var (
 // will always produce an unrooted path with no ".." path elements.
 // If the input path had a directory separator at the end, the sanitized version will preserve that.
 func SanitizePath(in string) string {
-	sanitized := sanitizePath(in)
+	sanitized, _ := SanitizePathWithPolicy(in, defaultPolicy)
+	return sanitized
+}
 
-	// Add back trailing / if safe
-	if len(in) > 0 &&
-		(in[len(in)-1] == nixPathSeparator[0] || in[len(in)-1] == winPathSeparator[0]) &&
-		len(sanitized) > 0 {
-		sanitized = sanitized + string(os.PathSeparator)
+// InSubtree reports if the path name is prefix or lies below it, after sanitizing both of them
+// with SanitizePath. Path separators and trailing separators do not matter. Every path is in the
+// subtree of an empty prefix (or ".").
+func InSubtree(name, prefix string) bool {
+	prefix = subtreePath(prefix)
+	if prefix == "" || prefix == "." {
+		return true
 	}
+	name = subtreePath(name)
+	return name == prefix || strings.HasPrefix(name, prefix+nixPathSeparator)
+}
 
-	return sanitized
+// subtreePath returns the sanitized form of name with forward slashes and no trailing separator.
+func subtreePath(name string) string {
+	name = strings.ReplaceAll(sanitizePath(name), winPathSeparator, nixPathSeparator)
+	return strings.TrimSuffix(name, nixPathSeparator)
+}
+
+// SanitizeLinkTarget confines the target of the symbolic link name (a path within an archive) to
+// the root of the archive, by purely lexical processing: absolute targets are made relative to the
+// root, and ".." path components escaping the root are dropped. Targets staying within the root
+// are returned unchanged, so links between the entries of an archive keep working. Rewritten
+// targets are relative to the directory of name and use forward slashes.
+func SanitizeLinkTarget(name, target string) string {
+	var dir []string
+	if n := subtreePath(name); n != "" && n != "." {
+		dir = strings.Split(n, nixPathSeparator)
+		dir = dir[:len(dir)-1]
+	}
+	t := strings.ReplaceAll(target, winPathSeparator, nixPathSeparator)
+	if len(t) >= 2 && t[1] == ':' && isLetter(t[0]) {
+		// a drive letter
+		t = nixPathSeparator + t[2:]
+	}
+	escaped := strings.HasPrefix(t, nixPathSeparator)
+	var resolved []string
+	if !escaped {
+		resolved = append(resolved, dir...)
+	}
+	for _, c := range strings.Split(t, nixPathSeparator) {
+		switch c {
+		case "", ".":
+		case "..":
+			if len(resolved) == 0 {
+				escaped = true
+				continue
+			}
+			resolved = resolved[:len(resolved)-1]
+		default:
+			resolved = append(resolved, c)
+		}
+	}
+	if !escaped {
+		return target
+	}
+	re := strings.TrimSuffix(strings.Repeat("../", len(dir))+strings.Join(resolved, nixPathSeparator), nixPathSeparator)
+	if re == "" {
+		return "."
+	}
+	return re
+}
+
+func isLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
 }
 
 // HasWindowsShortFilenames reports if any path component look like a Windows short filename.
@@ -66,3 +124,86 @@ func HasWindowsShortFilenames(in string) bool {
 	}
 	return false
 }
+
+// StripComponents sanitizes name with SanitizePath, removes its n leading path components (like
+// the --strip-components of tar) and prepends prefix, also sanitized. As the components are
+// removed from the sanitized name, stripping cannot reintroduce ".." path elements. It reports
+// false if name has no more than n components, in which case nothing is left of it.
+func StripComponents(name string, n int, prefix string) (string, bool) {
+	parts := strings.Split(subtreePath(name), nixPathSeparator)
+	if parts[0] == "" || len(parts) <= n {
+		return "", false
+	}
+	if n > 0 {
+		parts = parts[n:]
+	}
+	stripped := strings.Join(parts, nixPathSeparator)
+	if p := subtreePath(prefix); p != "" {
+		stripped = p + nixPathSeparator + stripped
+	}
+	if strings.HasSuffix(name, nixPathSeparator) || strings.HasSuffix(name, winPathSeparator) {
+		stripped += nixPathSeparator
+	}
+	return SanitizePath(stripped), true
+}
+
+// StripLinkTarget returns the target of the symbolic link name once name is renamed with
+// StripComponents(name, n, prefix), so that it keeps pointing to the same path within the
+// archive: relative targets are resolved lexically against the directory of name, stripped the
+// same way and made relative to the directory of the new name. Absolute targets and targets
+// escaping the root of the archive are returned unchanged (see SanitizeLinkTarget). It reports
+// false if the target is stripped, in which case nothing is left to point to.
+func StripLinkTarget(name, target string, n int, prefix string) (string, bool) {
+	t := strings.ReplaceAll(target, winPathSeparator, nixPathSeparator)
+	if strings.HasPrefix(t, nixPathSeparator) || len(t) >= 2 && t[1] == ':' && isLetter(t[0]) {
+		return target, true
+	}
+	dir := path.Dir(subtreePath(name))
+	resolved := path.Join(dir, t)
+	if resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return target, true
+	}
+	var to string
+	if resolved == "." {
+		if n > 0 {
+			return "", false
+		}
+		to = subtreePath(prefix)
+	} else {
+		s, ok := StripComponents(resolved, n, prefix)
+		if !ok {
+			return "", false
+		}
+		to = subtreePath(s)
+	}
+	newName, ok := StripComponents(name, n, prefix)
+	if !ok {
+		return "", false
+	}
+	re := relativePath(path.Dir(subtreePath(newName)), to)
+	if re == path.Clean(t) {
+		return target, true
+	}
+	return re, true
+}
+
+// relativePath returns the relative path from the directory from to the path to, both of them
+// clean relative paths with forward slashes.
+func relativePath(from, to string) string {
+	split := func(p string) []string {
+		if p == "" || p == "." {
+			return nil
+		}
+		return strings.Split(p, nixPathSeparator)
+	}
+	f, t := split(from), split(to)
+	i := 0
+	for i < len(f) && i < len(t) && f[i] == t[i] {
+		i++
+	}
+	re := path.Join(strings.Repeat("../", len(f)-i), strings.Join(t[i:], nixPathSeparator))
+	if re == "" {
+		return "."
+	}
+	return re
+}
@@ -17,20 +17,5 @@
 
 package sanitizer
 
-import (
-	"path/filepath"
-	"strings"
-)
-
-var (
-	nixReplacer = strings.NewReplacer(`\`, `/`)
-)
-
-func sanitizePath(in string) string {
-
-	// normalizing path separators (something filepath.Clean will do it for us on Windows, but not
-	// on the other platforms)
-	in = nixReplacer.Replace(in)
-
-	return strings.TrimPrefix(filepath.Clean(nixPathSeparator+in), nixPathSeparator)
-}
+// defaultPolicy is the policy of SanitizePath.
+var defaultPolicy = Policy{Separator: '/'}
@@ -15,6 +15,9 @@
 package sanitizer
 
 import (
+	"errors"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -51,3 +54,370 @@ func TestHasWindowsShortFilenames(t *testing.T) {
 		}
 	}
 }
+
+func TestInSubtree(t *testing.T) {
+	tests := []struct {
+		name, prefix string
+		want         bool
+	}{
+		{"usr/lib/libc.so", "usr/lib", true},
+		{"usr/lib/", "usr/lib", true},
+		{"usr/lib", "usr/lib/", true},
+		{"usr/lib64/libc.so", "usr/lib", false},
+		{"usr/libc.so", "usr/lib", false},
+		{"usr/", "usr/lib", false},
+		{"usr/lib/x", "", true},
+		{"usr/lib/x", ".", true},
+		{"../usr/lib/x", "usr/lib", true},
+		{"/usr/lib/x", "/usr/lib", true},
+		{"usr/./lib//x", "usr/lib", true},
+		{`usr\lib\x`, "usr/lib", true},
+		{"usr/lib/../../etc/passwd", "usr/lib", false},
+	}
+	for _, tc := range tests {
+		if got := InSubtree(tc.name, tc.prefix); got != tc.want {
+			t.Errorf("InSubtree(%q, %q) = %v, want %v", tc.name, tc.prefix, got, tc.want)
+		}
+	}
+}
+
+func TestSanitizeLinkTarget(t *testing.T) {
+	tests := []struct {
+		name, target, want string
+	}{
+		{"usr/lib/libc.so", "libc.so.6", "libc.so.6"},
+		{"usr/lib/libc.so", "../../etc/ld.so.conf", "../../etc/ld.so.conf"},
+		{"usr/lib/libc.so", "./x/../libc.so.6", "./x/../libc.so.6"},
+		{"usr/lib/libc.so", "/lib/libc.so.6", "../../lib/libc.so.6"},
+		{"usr/lib/libc.so", "../../../etc/passwd", "../../etc/passwd"},
+		{"link", "..", "."},
+		{"link", "/", "."},
+		{"dir/link", "/", ".."},
+		{"link", `..\..\windows`, "windows"},
+		{"link", `C:\windows`, "windows"},
+		{"../a/link", "../../b", "../b"},
+	}
+	for _, tc := range tests {
+		if got := SanitizeLinkTarget(tc.name, tc.target); got != tc.want {
+			t.Errorf("SanitizeLinkTarget(%q, %q) = %q, want %q", tc.name, tc.target, got, tc.want)
+		}
+	}
+}
+
+func TestFoldName(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		same bool
+	}{
+		{"README", "readme", true},
+		{"Caf\u00e9", "cafe\u0301", true},
+		{"\u00c5ngstr\u00f6m", "\u212bngstro\u0308m", true},
+		{"\ud55c\uae00", "\u1112\u1161\u11ab\u1100\u1173\u11af", true},
+		{"dir/K", "DIR/\u212a", true},
+		{"cafe", "caf\u00e9", false},
+		{"a.txt", "a.txt ", false},
+	} {
+		if got := FoldName(tc.a) == FoldName(tc.b); got != tc.same {
+			t.Errorf("FoldName(%q) == FoldName(%q) is %v, want %v", tc.a, tc.b, got, tc.same)
+		}
+	}
+}
+
+func TestStripUnsafeRunes(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"plain/name.txt", "plain/name.txt"},
+		{"evil\u202etxt.exe", "eviltxt.exe"},
+		{"a/\u200b/b", "a/b"},
+		{"\u200b/b", "b"},
+		{"a/\u200b", "a/"},
+		{"tab\there\x00", "tabhere"},
+		{"c1\u0085/\ufeffbom", "c1/bom"},
+		{"invalid\xff", "invalid\xff"},
+	} {
+		if got := StripUnsafeRunes(tc.in); got != tc.want {
+			t.Errorf("StripUnsafeRunes(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+		if HasUnsafeRunes(StripUnsafeRunes(tc.in)) {
+			t.Errorf("StripUnsafeRunes(%q) has unsafe runes still", tc.in)
+		}
+	}
+}
+
+func TestInvalidEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		in, replaced, encoded string
+	}{
+		{"plain/name.txt", "plain/name.txt", "plain/name.txt"},
+		{"caf\u00e9/\u65e5\u672c", "caf\u00e9/\u65e5\u672c", "caf\u00e9/\u65e5\u672c"},
+		{"latin1/caf\xe9", "latin1/caf\ufffd", "latin1/caf%E9"},
+		{"nul\x00.txt", "nul\ufffd.txt", "nul%00.txt"},
+		{"overlong/\xc0\xaf", "overlong/\ufffd\ufffd", "overlong/%C0%AF"},
+		{"truncated\xe6\x97", "truncated\ufffd\ufffd", "truncated%E6%97"},
+	} {
+		if got, want := IsValidName(tc.in), tc.in == tc.replaced; got != want {
+			t.Errorf("IsValidName(%q) = %v, want %v", tc.in, got, want)
+		}
+		if got := ReplaceInvalidEncoding(tc.in); got != tc.replaced {
+			t.Errorf("ReplaceInvalidEncoding(%q) = %q, want %q", tc.in, got, tc.replaced)
+		}
+		if got := PercentEncodeInvalid(tc.in); got != tc.encoded {
+			t.Errorf("PercentEncodeInvalid(%q) = %q, want %q", tc.in, got, tc.encoded)
+		}
+	}
+}
+
+func TestSanitizePathWithPolicy(t *testing.T) {
+	windows := Policy{Windows: true, Separator: '/'}
+	tests := []struct {
+		in      string
+		p       Policy
+		want    string
+		wantErr bool
+	}{
+		{`C:\some\thing`, Policy{Separator: '/'}, "C:/some/thing", false},
+		{`../some/thing/`, Policy{Separator: '\\'}, `some\thing\`, false},
+		{`C:\some\thing`, windows, "some/thing", false},
+		{`\\.\C:\some\thing`, windows, "some/thing", false},
+		{`C:\some\thing`, Policy{Windows: true, KeepDriveLetters: true, Separator: '/'}, "C/some/thing", false},
+		{`something.txt:alternate`, windows, "something.txt/alternate", false},
+		{`dir/LPT1.txt`, windows, "dir/LPT1-safe.txt", false},
+		{`dir/LPT1.txt`, Policy{Windows: true, Separator: '/', ReservedSuffix: "_"}, "dir/LPT1_.txt", false},
+		{`dir/LPT1.txt`, Policy{Separator: '/'}, "dir/LPT1.txt", false},
+		{`abcdefghij/abcdefghij.txt`, Policy{Separator: '/', MaxComponentLength: 8}, "abcdefgh/abcd.txt", false},
+		{"\u00e9\u00e9\u00e9", Policy{Separator: '/', MaxComponentLength: 5}, "\u00e9\u00e9", false},
+		{`..aaaa/etc/passwd`, Policy{Separator: '/', MaxComponentLength: 2}, "et/pa", false},
+		{"a/..\u20aczz/..\u20aczz/x", Policy{Separator: '/', MaxComponentLength: 4}, "a/x", false},
+		{"a/.\u20ac/x", Policy{Separator: '/', MaxComponentLength: 2}, "a/x", false},
+		{"\u20ac\u20ac/x", Policy{Separator: '/', MaxComponentLength: 2}, "x", false},
+		{`some/./thing//`, Policy{Separator: '/', Strict: true}, "some/thing/", false},
+		{`some/../thing`, Policy{Separator: '/', Strict: true}, "thing", false},
+		{`/some/thing`, Policy{Separator: '/', Strict: true}, "", true},
+		{`../thing`, Policy{Separator: '/', Strict: true}, "", true},
+		{`some\thing`, Policy{Separator: '/', Strict: true}, "some/thing", false},
+		{`C:\thing`, Policy{Windows: true, Separator: '/', Strict: true}, "", true},
+		{`dir/NUL`, Policy{Windows: true, Separator: '/', Strict: true}, "", true},
+		{`abcdefghij`, Policy{Separator: '/', MaxComponentLength: 8, Strict: true}, "", true},
+	}
+	for _, tc := range tests {
+		got, err := SanitizePathWithPolicy(tc.in, tc.p)
+		if (err != nil) != tc.wantErr || (err != nil && !errors.Is(err, ErrUnsafePath)) {
+			t.Errorf("SanitizePathWithPolicy(%q, %+v) error = %v, want error: %v", tc.in, tc.p, err, tc.wantErr)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("SanitizePathWithPolicy(%q, %+v) = %q, want %q", tc.in, tc.p, got, tc.want)
+		}
+	}
+	for _, in := range []string{`/some/thing/`, `C:\some\LPT1\`, `..\..\x`} {
+		got, err := SanitizePathWithPolicy(in, DefaultPolicy())
+		if want := SanitizePath(in); err != nil || got != want {
+			t.Errorf("SanitizePathWithPolicy(%q, DefaultPolicy()) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	windows := Policy{Windows: true, Separator: '/'}
+	nix := Policy{Separator: '/'}
+	tests := []struct {
+		in   string
+		p    Policy
+		want string
+		kind []ChangeKind
+	}{
+		{"some/thing", nix, "some/thing", nil},
+		{"some/../thing", nix, "thing", nil},
+		{"/etc/passwd", nix, "etc/passwd", []ChangeKind{ChangeAbsolute}},
+		{"../../etc/passwd", nix, "etc/passwd", []ChangeKind{ChangeDotDot}},
+		{`..\x`, nix, "x", []ChangeKind{ChangeSeparator, ChangeDotDot}},
+		{`C:\x`, windows, "x", []ChangeKind{ChangeDriveLetter}},
+		{`\\?\C:\x`, windows, "x", []ChangeKind{ChangeInvalidCharacter, ChangeAbsolute, ChangeDriveLetter}},
+		{`file.txt:stream`, windows, "file.txt/stream", []ChangeKind{ChangeDataStream}},
+		{`dir/NUL.txt/x`, windows, "dir/NUL-safe.txt/x", []ChangeKind{ChangeReservedName}},
+		{`dir./NUL /x. `, windows, "dir/NUL-safe/x", []ChangeKind{ChangeTrailingDotSpace, ChangeTrailingDotSpace, ChangeReservedName, ChangeTrailingDotSpace}},
+		{`dir./x. `, nix, "dir./x. ", nil},
+		{`abcdefghij`, Policy{Separator: '/', MaxComponentLength: 4}, "abcd", []ChangeKind{ChangeTruncated}},
+	}
+	for _, tc := range tests {
+		got, changes := AnalyzeWithPolicy(tc.in, tc.p)
+		var kinds []ChangeKind
+		for _, c := range changes {
+			kinds = append(kinds, c.Kind)
+		}
+		if got != tc.want || !reflect.DeepEqual(kinds, tc.kind) {
+			t.Errorf("AnalyzeWithPolicy(%q, %+v) = %q, %v, want %q, %v", tc.in, tc.p, got, changes, tc.want, tc.kind)
+		}
+	}
+	if _, changes := AnalyzeWithPolicy(`dir/NUL.txt`, windows); len(changes) != 1 || changes[0].Component != "NUL.txt" {
+		t.Errorf("AnalyzeWithPolicy(%q) changes = %v, want the reserved component", `dir/NUL.txt`, changes)
+	}
+	for _, in := range []string{`/some/thing/`, `C:\some\LPT1\`, `..\..\x`} {
+		if got, _ := Analyze(in); got != SanitizePath(in) {
+			t.Errorf("Analyze(%q) = %q, want %q", in, got, SanitizePath(in))
+		}
+	}
+}
+
+func TestExtendedLengthPath(t *testing.T) {
+	long := strings.Repeat(`\abcdefghij`, 30)
+	tests := []struct {
+		in, want string
+	}{
+		{`C:\short\path`, `C:\short\path`},
+		{`C:` + long, `\\?\C:` + long},
+		{`\\server\share` + long, `\\?\UNC\server\share` + long},
+		{`\\?\C:` + long, `\\?\C:` + long},
+		{`relative` + long, `relative` + long},
+	}
+	for _, tc := range tests {
+		if got := ExtendedLengthPath(tc.in); got != tc.want {
+			t.Errorf("ExtendedLengthPath(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestHashLongComponents(t *testing.T) {
+	p := Policy{Separator: '/', MaxComponentLength: 16, HashLongComponents: true}
+	a, _ := SanitizePathWithPolicy("dir/a-very-long-name-one.txt", p)
+	b, _ := SanitizePathWithPolicy("dir/a-very-long-name-two.txt", p)
+	if a == b {
+		t.Errorf("SanitizePathWithPolicy() = %q for distinct long names", a)
+	}
+	for _, got := range []string{a, b} {
+		if c := strings.TrimPrefix(got, "dir/"); len(c) != 16 || !strings.HasSuffix(c, ".txt") || !strings.HasPrefix(c, "a-v") {
+			t.Errorf("SanitizePathWithPolicy() = %q, want a 16 bytes long component with its extension", got)
+		}
+	}
+	if again, _ := SanitizePathWithPolicy("dir/a-very-long-name-one.txt", p); again != a {
+		t.Errorf("SanitizePathWithPolicy() = %q, then %q", a, again)
+	}
+	if got, _ := SanitizePathWithPolicy("short.txt", p); got != "short.txt" {
+		t.Errorf("SanitizePathWithPolicy(%q) = %q", "short.txt", got)
+	}
+}
+
+func TestReplaceReservedCharacters(t *testing.T) {
+	tests := []struct {
+		in   string
+		p    Policy
+		want string
+	}{
+		{`a<b>c/"d"|e*f`, Policy{Windows: true, Separator: '/', ReplaceReservedCharacters: true}, "a_b_c/_d__e_f"},
+		{"tab\there", Policy{Windows: true, Separator: '/', ReplaceReservedCharacters: true}, "tab_here"},
+		{`a*b`, Policy{Windows: true, Separator: '/', ReplaceReservedCharacters: true, ReservedReplacement: '-'}, "a-b"},
+		{`a*b`, Policy{Windows: true, Separator: '/', ReplaceReservedCharacters: true, ReservedReplacement: '/'}, "a_b"},
+		{`a*b`, Policy{Windows: true, Separator: '/'}, "a*b"},
+		{`a*b`, Policy{Separator: '/', ReplaceReservedCharacters: true}, "a*b"},
+		{`NUL*`, Policy{Windows: true, Separator: '/', ReplaceReservedCharacters: true}, "NUL_"},
+	}
+	for _, tc := range tests {
+		if got, _ := SanitizePathWithPolicy(tc.in, tc.p); got != tc.want {
+			t.Errorf("SanitizePathWithPolicy(%q, %+v) = %q, want %q", tc.in, tc.p, got, tc.want)
+		}
+	}
+	p := Policy{Windows: true, Separator: '/', ReplaceReservedCharacters: true, Strict: true}
+	if _, err := SanitizePathWithPolicy("a|b", p); !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("SanitizePathWithPolicy(%q) error = %v, want ErrUnsafePath", "a|b", err)
+	}
+}
+
+func TestRenameReserved(t *testing.T) {
+	windows := Policy{Windows: true, Separator: '/'}
+	prefix := windows
+	prefix.ReservedPrefix = "_"
+	both := windows
+	both.ReservedPrefix, both.ReservedSuffix = "_", "_"
+	callback := windows
+	callback.RenameReserved = func(base string) string { return strings.ToLower(base) + "-device" }
+	bad := windows
+	bad.RenameReserved = func(base string) string { return "../" + base }
+	dotdot := windows
+	dotdot.RenameReserved = func(string) string { return ".." }
+	reserved := windows
+	reserved.RenameReserved = func(string) string { return "CON" }
+	colon := windows
+	colon.RenameReserved = func(base string) string { return base + ":stream" }
+	trailing := windows
+	trailing.RenameReserved = func(base string) string { return base + "-x. " }
+	prefixColon := windows
+	prefixColon.ReservedPrefix = "c:"
+	taken := windows
+	taken.ReservedTaken = func(name string) bool { return name == "dir/LPT1-safe.txt" || name == "dir/LPT1-safe-2.txt" }
+	tests := []struct {
+		in   string
+		p    Policy
+		want string
+	}{
+		{"dir/LPT1.txt", windows, "dir/LPT1-safe.txt"},
+		{"dir/LPT1.txt", prefix, "dir/_LPT1.txt"},
+		{"dir/LPT1.txt", both, "dir/_LPT1_.txt"},
+		{"dir/LPT1.txt", callback, "dir/lpt1-device.txt"},
+		{"dir/LPT1.txt", bad, "dir/LPT1-safe.txt"},
+		{"dir/LPT1.txt", dotdot, "dir/LPT1-safe.txt"},
+		{"dir/LPT1.txt", reserved, "dir/LPT1-safe.txt"},
+		{"dir/LPT1.txt", colon, "dir/LPT1-safe.txt"},
+		{"dir/LPT1.txt", trailing, "dir/LPT1-safe.txt"},
+		{"dir/LPT1.txt", prefixColon, "dir/LPT1-safe.txt"},
+		{"dir/LPT1.txt", taken, "dir/LPT1-safe-3.txt"},
+		{"dir/LPT1", taken, "dir/LPT1-safe"},
+	}
+	for _, tc := range tests {
+		if got, _ := SanitizePathWithPolicy(tc.in, tc.p); got != tc.want {
+			t.Errorf("SanitizePathWithPolicy(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestStripComponents(t *testing.T) {
+	tests := []struct {
+		name   string
+		n      int
+		prefix string
+		want   string
+		ok     bool
+	}{
+		{"pkg-1.0/src/main.go", 1, "", "src/main.go", true},
+		{"pkg-1.0/src/", 1, "", "src/", true},
+		{"pkg-1.0/src/main.go", 2, "", "main.go", true},
+		{"pkg-1.0/", 1, "", "", false},
+		{"pkg-1.0", 1, "", "", false},
+		{"", 0, "", "", false},
+		{"../../a/b", 1, "", "b", true},
+		{"a/../../../etc/passwd", 1, "", "passwd", true},
+		{"a/b", 0, "vendor/", "vendor/a/b", true},
+		{"pkg/a/b", 1, "../vendor", "vendor/a/b", true},
+	}
+	for _, tc := range tests {
+		got, ok := StripComponents(tc.name, tc.n, tc.prefix)
+		if want := filepath.FromSlash(tc.want); got != want || ok != tc.ok {
+			t.Errorf("StripComponents(%q, %d, %q) = %q, %v, want %q, %v", tc.name, tc.n, tc.prefix, got, ok, want, tc.ok)
+		}
+	}
+}
+
+func TestStripLinkTarget(t *testing.T) {
+	tests := []struct {
+		name, target string
+		n            int
+		prefix       string
+		want         string
+		ok           bool
+	}{
+		{"pkg/a/link", "b", 1, "", "b", true},
+		{"pkg/a/link", "../../pkg/x", 1, "", "../x", true},
+		{"pkg/a/b/link", "../../c/x", 1, "", "../../c/x", true},
+		{"pkg/link", "../other/x", 1, "", "x", true},
+		{"pkg/link", "../x", 1, "", "", false},
+		{"pkg/link", "..", 1, "", "", false},
+		{"a/link", "../x", 0, "vendor", "../x", true},
+		{"link", ".", 0, "vendor", ".", true},
+		{"pkg/link", "/etc", 1, "", "/etc", true},
+		{"pkg/link", "../../etc", 1, "", "../../etc", true},
+	}
+	for _, tc := range tests {
+		got, ok := StripLinkTarget(tc.name, tc.target, tc.n, tc.prefix)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("StripLinkTarget(%q, %q, %d, %q) = %q, %v, want %q, %v", tc.name, tc.target, tc.n, tc.prefix, got, ok, tc.want, tc.ok)
+		}
+	}
+}
@@ -63,10 +63,10 @@ func TestSanitizePathWindows(t *testing.T) {
 			{`somedir\LPT` + ss2, `somedir\LPT` + ss2 + `-safe`},
 			{`somedir\LPT` + ss3, `somedir\LPT` + ss3 + `-safe`},
 			{`somedir\CONIN$`, `somedir\CONIN$-safe`},
-			{`somedir\CONIN$ `, `somedir\CONIN$ -safe`},
+			{`somedir\CONIN$ `, `somedir\CONIN$-safe`},
 			{`somedir\CONIN$ .txt`, `somedir\CONIN$ -safe.txt`},
 			{`somedir\CONOUT$`, `somedir\CONOUT$-safe`},
-			{`somedir\CONOUT$ `, `somedir\CONOUT$ -safe`},
+			{`somedir\CONOUT$ `, `somedir\CONOUT$-safe`},
 			{`somedir\CONOUT$ .txt`, `somedir\CONOUT$ -safe.txt`},
 			{`somedir\LPT1`, `somedir\LPT1-safe`},
 			{`somedir\LPT1.foo`, `somedir\LPT1-safe.foo`},
@@ -78,6 +78,16 @@ func TestSanitizePathWindows(t *testing.T) {
 			{`somedir\LPT1 .foo\somefile`, `somedir\LPT1 -safe.foo\somefile`},
 			{`somedir\LPT` + ss1 + `\somefile`, `somedir\LPT` + ss1 + `-safe\somefile`},
 		},
+		"TrailingDotsAndSpaces": []testCase{
+			{`foo. `, `foo`},
+			{`bar...`, `bar`},
+			{`some\dir.\thing `, `some\dir\thing`},
+			{`some\ . \thing`, `some\thing`},
+			{`some\...\thing`, `some\thing`},
+			{`somedir\NUL.`, `somedir\NUL-safe`},
+			{`somedir\LPT1 .\somefile`, `somedir\LPT1-safe\somefile`},
+			{`some.txt. \`, `some.txt\`},
+		},
 		"RelativePaths": []testCase{
 			{`../../some/thing`, `some\thing`},
 			{`../../some/thing`, `some\thing`},
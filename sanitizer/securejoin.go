@@ -0,0 +1,131 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sanitizer
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxSymlinks is the maximum number of symbolic links SecureJoin follows.
+const maxSymlinks = 255
+
+// ErrTooManySymlinks is returned by SecureJoin when resolving a name takes more than 255
+// symbolic links, e.g. because of a loop.
+var ErrTooManySymlinks = errors.New("sanitizer: too many levels of symbolic links")
+
+// ErrSymlinkComponent is returned by SecureJoinNoFollow when an existing component of the name is
+// a symbolic link.
+var ErrSymlinkComponent = errors.New("sanitizer: path component is a symbolic link")
+
+// SecureJoinLexical joins name, sanitized with SanitizePath, to the directory base by purely
+// lexical processing. The result is within base as long as no component of name exists as a
+// symbolic link under base; see SecureJoin and SecureJoinNoFollow otherwise.
+func SecureJoinLexical(base, name string) string {
+	return filepath.Join(base, sanitizePath(name))
+}
+
+// SecureJoinNoFollow is SecureJoinLexical, but fails with an error wrapping ErrSymlinkComponent if
+// any existing component of name under base (including the last one, which would be followed by
+// writing to the result) is a symbolic link, instead of resolving it like SecureJoin. This is the
+// behavior extractions want: an archive never needs to write through a link.
+//
+// Like SecureJoin, the result is only safe to use while no one else can change the tree under
+// base.
+func SecureJoinNoFollow(base, name string) (string, error) {
+	sanitized := sanitizePath(name)
+	next := base
+	for _, part := range strings.Split(sanitized, string(os.PathSeparator)) {
+		if part == "" {
+			continue
+		}
+		next = filepath.Join(next, part)
+		fi, err := os.Lstat(next)
+		if errors.Is(err, fs.ErrNotExist) {
+			// the rest does not exist either
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			return "", &fs.PathError{Op: "securejoin", Path: name, Err: ErrSymlinkComponent}
+		}
+	}
+	return filepath.Join(base, sanitized), nil
+}
+
+// SecureJoin joins name to the directory base, so that the result is within base even if
+// components of name are existing symbolic links. name is sanitized with SanitizePath, and the
+// symbolic links among the existing components are resolved as if base was the root of the file
+// system: absolute targets are resolved from base, and ".." components cannot go above it.
+// Components that do not exist yet are joined lexically.
+//
+// Like any check of the file system, the result is only safe to use while no one else can change
+// the tree under base, as a component may be replaced by a symbolic link after SecureJoin
+// returned.
+func SecureJoin(base, name string) (string, error) {
+	const sep = string(os.PathSeparator)
+	unresolved := sanitizePath(name)
+	resolved := ""
+	links := 0
+	for unresolved != "" {
+		part := unresolved
+		if i := strings.Index(unresolved, sep); i >= 0 {
+			part, unresolved = unresolved[:i], unresolved[i+1:]
+		} else {
+			unresolved = ""
+		}
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			// resolved is clean and has no ".." components, so this stays within base
+			resolved = strings.TrimPrefix(filepath.Dir(sep+resolved), sep)
+			continue
+		}
+		next := filepath.Join(resolved, part)
+		fi, err := os.Lstat(filepath.Join(base, next))
+		if errors.Is(err, fs.ErrNotExist) {
+			resolved = next
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&fs.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		links++
+		if links > maxSymlinks {
+			return "", &fs.PathError{Op: "securejoin", Path: name, Err: ErrTooManySymlinks}
+		}
+		target, err := os.Readlink(filepath.Join(base, next))
+		if err != nil {
+			return "", err
+		}
+		target = filepath.FromSlash(target)
+		if vol := filepath.VolumeName(target); vol != "" || strings.HasPrefix(target, sep) {
+			// absolute targets are resolved from base
+			target, resolved = target[len(vol):], ""
+		}
+		unresolved = target + sep + unresolved
+	}
+	return filepath.Join(base, resolved), nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sanitizer
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecureJoin(t *testing.T) {
+	base := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(base, "dir", "sub"), 0755); err != nil {
+		t.Fatalf("MkdirAll() error = %v", err)
+	}
+	for link, target := range map[string]string{
+		"root":        "/",
+		"up":          "../../..",
+		"dir/abs":     "/etc",
+		"dir/rel":     "sub",
+		"dir/sub/esc": "../../../../outside",
+		"loop":        "loop",
+	} {
+		if err := os.Symlink(filepath.FromSlash(target), filepath.Join(base, filepath.FromSlash(link))); err != nil {
+			t.Skipf("Symlink() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"a.txt", "a.txt"},
+		{"../../a.txt", "a.txt"},
+		{"/dir/new/a.txt", "dir/new/a.txt"},
+		{"root/etc/passwd", "etc/passwd"},
+		{"up/etc/passwd", "etc/passwd"},
+		{"dir/abs/passwd", "etc/passwd"},
+		{"dir/rel/a.txt", "dir/sub/a.txt"},
+		{"dir/rel/esc/a.txt", "outside/a.txt"},
+		{"dir/rel/../a.txt", "dir/a.txt"},
+		{"dir/sub", "dir/sub"},
+	}
+	for _, tc := range tests {
+		got, err := SecureJoin(base, tc.name)
+		if err != nil {
+			t.Errorf("SecureJoin(%q) error = %v", tc.name, err)
+			continue
+		}
+		if want := filepath.Join(base, filepath.FromSlash(tc.want)); got != want {
+			t.Errorf("SecureJoin(%q) = %q, want %q", tc.name, got, want)
+		}
+	}
+
+	if _, err := SecureJoin(base, "loop/a.txt"); !errors.Is(err, ErrTooManySymlinks) {
+		t.Errorf("SecureJoin(%q) error = %v, want %v", "loop/a.txt", err, ErrTooManySymlinks)
+	}
+}
+
+func TestSecureJoinLexical(t *testing.T) {
+	for name, want := range map[string]string{
+		"a.txt":             "a.txt",
+		"../../etc/passwd":  "etc/passwd",
+		"/dir/../../a.txt":  "a.txt",
+		`dir\sub\..\a.txt`:  "dir/a.txt",
+		"dir/./sub//a.txt/": "dir/sub/a.txt",
+	} {
+		if got, want := SecureJoinLexical("base", name), filepath.Join("base", filepath.FromSlash(want)); got != want {
+			t.Errorf("SecureJoinLexical(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestSecureJoinNoFollow(t *testing.T) {
+	base := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(base, "dir", "sub"), 0755); err != nil {
+		t.Fatalf("MkdirAll() error = %v", err)
+	}
+	for link, target := range map[string]string{
+		"dir/rel": "sub",
+		"abs":     "/etc",
+	} {
+		if err := os.Symlink(filepath.FromSlash(target), filepath.Join(base, filepath.FromSlash(link))); err != nil {
+			t.Skipf("Symlink() error = %v", err)
+		}
+	}
+
+	for _, name := range []string{"a.txt", "../dir/sub/a.txt", "dir/new/a.txt", "dir/sub"} {
+		got, err := SecureJoinNoFollow(base, name)
+		if want := SecureJoinLexical(base, name); err != nil || got != want {
+			t.Errorf("SecureJoinNoFollow(%q) = %q, %v, want %q", name, got, err, want)
+		}
+	}
+	for _, name := range []string{"dir/rel/a.txt", "dir/rel", "/abs/passwd"} {
+		if _, err := SecureJoinNoFollow(base, name); !errors.Is(err, ErrSymlinkComponent) {
+			t.Errorf("SecureJoinNoFollow(%q) error = %v, want %v", name, err, ErrSymlinkComponent)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sanitizer
+
+import (
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// IsUnsafeRune reports whether r is a character commonly used to disguise file names in
+// user-facing listings: the C0 and C1 control characters (including NUL), DEL, the bidirectional
+// formatting characters (e.g. the right-to-left override U+202E, which makes "evil\u202etxt.exe"
+// display as "evilexe.txt") and the zero-width characters.
+func IsUnsafeRune(r rune) bool {
+	switch {
+	case r < 0x20, r >= 0x7f && r <= 0x9f:
+		return true
+	case r >= 0x202a && r <= 0x202e, r >= 0x2066 && r <= 0x2069, r == 0x200e, r == 0x200f, r == 0x061c:
+		// bidirectional formatting
+		return true
+	case r >= 0x200b && r <= 0x200d, r == 0x2060, r == 0xfeff, r == 0x180e:
+		// zero-width
+		return true
+	}
+	return false
+}
+
+// HasUnsafeRunes reports whether in has characters for which IsUnsafeRune is true.
+func HasUnsafeRunes(in string) bool {
+	return strings.IndexFunc(in, IsUnsafeRune) >= 0
+}
+
+// StripUnsafeRunes removes the characters for which IsUnsafeRune is true from the path in, along
+// with the path components left empty. Bytes that are not valid UTF-8 are kept as they are.
+func StripUnsafeRunes(in string) string {
+	if !HasUnsafeRunes(in) {
+		return in
+	}
+	isSeparator := func(c byte) bool { return c == nixPathSeparator[0] || c == os.PathSeparator }
+	var b strings.Builder
+	// component is the position in b of the start of the current path component, and stripped is
+	// set if it had a character removed.
+	component, stripped := 0, false
+	for i := 0; i < len(in); {
+		if isSeparator(in[i]) {
+			if stripped && b.Len() == component {
+				// drop the separator of a component that was left empty
+				i++
+				stripped = false
+				continue
+			}
+			b.WriteByte(in[i])
+			i++
+			component, stripped = b.Len(), false
+			continue
+		}
+		r, n := utf8.DecodeRuneInString(in[i:])
+		if r == utf8.RuneError && n == 1 {
+			b.WriteByte(in[i])
+		} else if IsUnsafeRune(r) {
+			stripped = true
+		} else {
+			b.WriteString(in[i : i+n])
+		}
+		i += n
+	}
+	return b.String()
+}
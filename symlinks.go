@@ -0,0 +1,128 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// MaxSymlinkChain is the default maximum number of symbolic links followed by a LinkChecker to
+// resolve a link, the limit of Linux.
+const MaxSymlinkChain = 40
+
+// LinkChecker detects the loops (e.g. a -> b and b -> a) and the overlong chains of symbolic links
+// formed across the entries of an archive, which make extractions and the programs using their
+// output fail with ELOOP or spin. Links are resolved lexically within the archive: absolute
+// targets are resolved from its root, and ".." components cannot go above it.
+// The zero value is ready to use.
+type LinkChecker struct {
+	// Max is the maximum number of links followed to resolve a link. Zero means MaxSymlinkChain.
+	Max int
+
+	links map[string]string
+	// dependents are the links whose resolution looked up a path, which are resolved again when a
+	// link is added there.
+	dependents map[string]map[string]bool
+}
+
+// Check adds the symbolic link name (a sanitized, forward slash separated path) to target, and
+// resolves it along with the links recorded before whose resolution goes through name. If one of
+// the resolutions follows more than Max links, because of a loop or of a long chain, it returns a
+// description of the problem and false, and the link is not added.
+func (c *LinkChecker) Check(name, target string) (string, bool) {
+	if c.links == nil {
+		c.links = map[string]string{}
+		c.dependents = map[string]map[string]bool{}
+	}
+	name = strings.Trim(path.Clean("/"+name), "/")
+	old, existed := c.links[name]
+	c.links[name] = target
+	for _, l := range append([]string{name}, sortedKeys(c.dependents[name])...) {
+		if detail, ok := c.resolve(l); !ok {
+			if existed {
+				c.links[name] = old
+			} else {
+				delete(c.links, name)
+			}
+			return detail, false
+		}
+	}
+	return "", true
+}
+
+// resolve resolves the recorded link name, recording the paths it looks up.
+func (c *LinkChecker) resolve(name string) (string, bool) {
+	max := c.Max
+	if max <= 0 {
+		max = MaxSymlinkChain
+	}
+	// expanded counts the expansions of the links, to tell loops from long chains
+	expanded := map[string]int{name: 1}
+	followed := 1
+	unresolved := linkTarget(name, c.links[name])
+	resolved := ""
+	for len(unresolved) > 0 {
+		part := unresolved[0]
+		unresolved = unresolved[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = strings.Trim(path.Dir("/"+resolved), "/")
+			continue
+		}
+		next := strings.TrimPrefix(resolved+"/"+part, "/")
+		if c.dependents[next] == nil {
+			c.dependents[next] = map[string]bool{}
+		}
+		c.dependents[next][name] = true
+		t, ok := c.links[next]
+		if !ok {
+			resolved = next
+			continue
+		}
+		expanded[next]++
+		if followed++; followed > max {
+			if expanded[next] > 1 {
+				return fmt.Sprintf("symbolic link loop through %s", next), false
+			}
+			return fmt.Sprintf("chain of more than %d symbolic links", max), false
+		}
+		unresolved, resolved = append(linkTarget(next, t), unresolved...), ""
+	}
+	return "", true
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]bool) []string {
+	re := make([]string, 0, len(m))
+	for k := range m {
+		re = append(re, k)
+	}
+	sort.Strings(re)
+	return re
+}
+
+// linkTarget returns the path components of the target of the link name, from the root of the
+// archive.
+func linkTarget(name, target string) []string {
+	if strings.HasPrefix(target, "/") {
+		return strings.Split(target, "/")
+	}
+	return strings.Split(path.Dir(name)+"/"+target, "/")
+}
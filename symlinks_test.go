@@ -0,0 +1,52 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLinkChecker(t *testing.T) {
+	type link struct{ name, target string }
+	tests := []struct {
+		links   []link
+		max     int
+		problem string
+	}{
+		{links: []link{{"a", "b"}, {"b", "c"}}},
+		{links: []link{{"a", "b"}, {"b", "a"}}, problem: "loop through"},
+		{links: []link{{"a", "a"}}, problem: "loop through a"},
+		{links: []link{{"dir/a", "../b/c"}, {"b", "dir"}}},
+		{links: []link{{"dir/a", "../b/a"}, {"b", "dir"}}, problem: "loop through"},
+		{links: []link{{"a", "/b"}, {"b", "../../../a"}}, problem: "loop through"},
+		{links: []link{{"l", "d"}, {"m", "l/../l/f"}}},
+		{links: []link{{"a", "b"}, {"b", "c"}, {"c", "d"}}, max: 2, problem: "chain of more than 2"},
+		{links: []link{{"a", "b"}, {"b", "c"}, {"c", "d"}}, max: 3},
+	}
+	for i, tc := range tests {
+		c := LinkChecker{Max: tc.max}
+		var problem string
+		for _, l := range tc.links {
+			if detail, ok := c.Check(l.name, l.target); !ok {
+				problem = detail
+				break
+			}
+		}
+		if tc.problem == "" && problem != "" || !strings.Contains(problem, tc.problem) {
+			t.Errorf("test %d: Check() problem = %q, want %q", i, problem, tc.problem)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import "strings"
+
+// SymlinkSet records the symbolic links of an archive in a trie of their path components, so
+// whether an entry is written through one of them is found in a single walk of its name, without
+// building its parent paths. Archives with hundreds of thousands of entries are checked in time
+// proportional to the length of their names.
+// The zero value is ready to use.
+type SymlinkSet struct {
+	root symlinkNode
+	// links are the symbolic links recorded by AddLink, the walkers of the nodes are indexes in it
+	links []symlink
+}
+
+type symlinkNode struct {
+	children map[string]*symlinkNode
+	link     bool
+	// target is the target of the links recorded by AddLink
+	target    string
+	hasTarget bool
+	// walkers are the links whose resolution went through the node
+	walkers []int
+}
+
+type symlink struct {
+	name, target string
+}
+
+// maxLinkHops is the maximum number of symbolic links followed to resolve a target, beyond which
+// AddLink considers it escapes.
+const maxLinkHops = 255
+
+// Add records the symbolic link name, a forward slash separated path.
+func (s *SymlinkSet) Add(name string) {
+	n := &s.root
+	forEachComponent(name, func(c string) bool {
+		child := n.children[c]
+		if child == nil {
+			if n.children == nil {
+				n.children = map[string]*symlinkNode{}
+			}
+			child = &symlinkNode{}
+			n.children[c] = child
+		}
+		n = child
+		return true
+	})
+	n.link = true
+}
+
+// Covers reports whether name, a forward slash separated path, or one of its parent directories is
+// a recorded symbolic link.
+func (s *SymlinkSet) Covers(name string) bool {
+	n := &s.root
+	found := false
+	forEachComponent(name, func(c string) bool {
+		if n = n.children[c]; n == nil {
+			return false
+		}
+		found = n.link
+		return !found
+	})
+	return found
+}
+
+// AddLink records the symbolic link name to target, both forward slash separated paths relative to
+// the root of the archive, if the target stays within the root once it is resolved against the
+// links recorded before, and reports whether it did. Links are not recorded either when they make
+// the target of a link recorded before escape, e.g. "d/l1" to ".." after "d/l2" to "l1/..", or
+// when their name was already recorded. Absolute targets and targets that cannot be resolved, such
+// as loops or going through links recorded by Add, are considered to escape.
+func (s *SymlinkSet) AddLink(name, target string) bool {
+	n := s.node(name)
+	if n.link {
+		return false
+	}
+	n.link, n.target, n.hasTarget = true, target, true
+	i := len(s.links)
+	s.links = append(s.links, symlink{name: name, target: target})
+	// the links whose resolution went through name resolve differently now
+	check := append([]int{i}, n.walkers...)
+	for _, j := range check {
+		if !s.resolve(j, false) {
+			n.link, n.target, n.hasTarget = false, "", false
+			s.links = s.links[:i]
+			return false
+		}
+	}
+	for _, j := range check {
+		s.resolve(j, true)
+	}
+	return true
+}
+
+// node returns the node of name, adding it if needed.
+func (s *SymlinkSet) node(name string) *symlinkNode {
+	n := &s.root
+	forEachComponent(name, func(c string) bool {
+		n = n.child(c)
+		return true
+	})
+	return n
+}
+
+// child returns the child c of n, adding it if needed.
+func (n *symlinkNode) child(c string) *symlinkNode {
+	child := n.children[c]
+	if child == nil {
+		if n.children == nil {
+			n.children = map[string]*symlinkNode{}
+		}
+		child = &symlinkNode{}
+		n.children[c] = child
+	}
+	return child
+}
+
+// resolve reports whether the target of the link s.links[i] stays within the root, following the
+// links recorded with their target. If mark is set, the nodes it goes through are added (the paths
+// may become links later) and the link is recorded as one of their walkers.
+func (s *SymlinkSet) resolve(i int, mark bool) bool {
+	l := s.links[i]
+	if strings.HasPrefix(l.target, "/") {
+		return false
+	}
+	var pending []string
+	if d := strings.LastIndexByte(l.name, '/'); d >= 0 {
+		pending = strings.Split(l.name[:d], "/")
+	}
+	pending = append(pending, strings.Split(l.target, "/")...)
+	// path are the nodes of the directories walked to, nil for the ones not in the trie
+	var path []*symlinkNode
+	for hops := 0; len(pending) > 0; {
+		c := pending[0]
+		pending = pending[1:]
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			if len(path) == 0 {
+				return false
+			}
+			path = path[:len(path)-1]
+			continue
+		}
+		parent := &s.root
+		if len(path) > 0 {
+			parent = path[len(path)-1]
+		}
+		var n *symlinkNode
+		switch {
+		case parent == nil:
+		case mark:
+			n = parent.child(c)
+			if k := len(n.walkers); k == 0 || n.walkers[k-1] != i {
+				n.walkers = append(n.walkers, i)
+			}
+		default:
+			n = parent.children[c]
+		}
+		if n != nil && n.link {
+			if hops++; !n.hasTarget || hops > maxLinkHops || strings.HasPrefix(n.target, "/") {
+				return false
+			}
+			// the target is relative to the directory of the link, the current one
+			pending = append(strings.Split(n.target, "/"), pending...)
+			continue
+		}
+		path = append(path, n)
+	}
+	return true
+}
+
+// forEachComponent calls fn on the components of name separated by slashes, like the elements of
+// strings.Split(name, "/"), until it returns false.
+func forEachComponent(name string, fn func(string) bool) {
+	for {
+		i := strings.IndexByte(name, '/')
+		if i < 0 {
+			fn(name)
+			return
+		}
+		if !fn(name[:i]) {
+			return
+		}
+		name = name[i+1:]
+	}
+}
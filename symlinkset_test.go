@@ -0,0 +1,84 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package safearchive
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSymlinkSet(t *testing.T) {
+	var s SymlinkSet
+	s.Add("a/link")
+	s.Add("b")
+	for _, tc := range []struct {
+		name string
+		want bool
+	}{
+		{"a/link", true},
+		{"a/link/file", true},
+		{"a/link/dir/file", true},
+		{"a", false},
+		{"a/linked", false},
+		{"a/other/link", false},
+		{"b/c", true},
+		{"c/b", false},
+		{"", false},
+	} {
+		if got := s.Covers(tc.name); got != tc.want {
+			t.Errorf("Covers(%q) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSymlinkSetAddLink(t *testing.T) {
+	for _, tc := range []struct {
+		desc  string
+		links [][2]string
+		want  []bool
+	}{
+		{"within the root", [][2]string{{"a/l", "../b"}, {"l", "a/l/c"}}, []bool{true, true}},
+		{"escaping", [][2]string{{"a/l", "../.."}, {"l", "/etc"}}, []bool{false, false}},
+		{"chained", [][2]string{{"d/l1", ".."}, {"d/l2", "l1/.."}}, []bool{true, false}},
+		{"chained in reverse", [][2]string{{"d/l2", "l1/.."}, {"d/l1", ".."}}, []bool{true, false}},
+		{"chained to a target", [][2]string{{"d/l2", "l1"}, {"d/l1", "../.."}}, []bool{true, false}},
+		{"library versions", [][2]string{{"lib/a.so", "a.so.1"}, {"lib/a.so.1", "a.so.1.2"}}, []bool{true, true}},
+		{"loop", [][2]string{{"a", "b"}, {"b", "a"}}, []bool{true, false}},
+		{"redefined", [][2]string{{"a", "b"}, {"a", "c"}}, []bool{true, false}},
+		{"escaping link ignored", [][2]string{{"d/l1", "../.."}, {"d/l2", "l1"}}, []bool{false, true}},
+	} {
+		var s SymlinkSet
+		for i, l := range tc.links {
+			if got := s.AddLink(l[0], l[1]); got != tc.want[i] {
+				t.Errorf("%s: AddLink(%q, %q) = %v, want %v", tc.desc, l[0], l[1], got, tc.want[i])
+			}
+		}
+	}
+}
+
+func BenchmarkSymlinkSet(b *testing.B) {
+	var s SymlinkSet
+	names := make([]string, 100000)
+	for i := range names {
+		names[i] = fmt.Sprintf("a%d/b%d/c%d/d%d/e%d/file%d.txt", i%7, i%11, i%13, i%17, i%19, i)
+		if i%1000 == 0 {
+			s.Add(fmt.Sprintf("links/link%d", i))
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Covers(names[i%len(names)])
+	}
+}
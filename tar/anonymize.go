@@ -0,0 +1,72 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar" // NOLINT
+	"io"
+
+	"github.com/google/safearchive"
+)
+
+// Anonymize rewrites the tar archive read from src to dst, so it can be shared (e.g. attached to
+// a bug report) without exposing confidential contents. The structure of the archive is kept:
+// the entries are written in the same order, with the same names, link targets, types, modes and
+// sizes, but their contents are replaced as selected by repl, and the rest of their metadata
+// (owners, times, extended attributes and other PAX records) is scrubbed. PAX global headers are
+// dropped.
+// The archive is read without the security features of Reader, so the anonymized archive
+// reproduces the problems of the original one. The contents are read to be replaced, so Anonymize
+// fails on an entry declaring more data than the archive holds.
+func Anonymize(src io.Reader, dst io.Writer, repl safearchive.ContentReplacement) error {
+	tr := tar.NewReader(src)
+	tw := NewWriter(dst)
+	tw.SetSecurityMode(0)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if h.Typeflag == TypeXGlobalHeader {
+			continue
+		}
+		content, err := safearchive.AnonymizedContent(tr, h.Size, repl)
+		if err != nil {
+			return err
+		}
+		if err := CopyEntry(tw, anonymizedHeader(h), content); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// anonymizedHeader returns the structural fields of h.
+func anonymizedHeader(h *Header) *Header {
+	return &Header{
+		Typeflag: h.Typeflag,
+		Name:     h.Name,
+		Linkname: h.Linkname,
+		Size:     h.Size,
+		Mode:     h.Mode,
+		ModTime:  safearchive.AnonymizedModTime,
+		Devmajor: h.Devmajor,
+		Devminor: h.Devminor,
+		Format:   h.Format,
+	}
+}
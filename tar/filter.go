@@ -0,0 +1,114 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"path/filepath"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/sanitizer"
+)
+
+// EntryFilter decides whether an entry is returned, see Reader.SetEntryFilter.
+type EntryFilter func(h *Header) (keep bool, err error)
+
+// SetEntryFilter sets a filter called by Next on every entry kept by the security features and the
+// rules, so applications can implement their own policies (e.g. extension denylists or path
+// allowlists) inside the safe iteration loop. Entries it does not keep are skipped without being
+// reported; if it fails, Next fails with a safearchive.EntryError wrapping its error. The filter
+// sees a copy of the entries as sanitized, so its changes are discarded rather than escaping the
+// security features: custom rules (see AddRule) can rename entries. A nil filter keeps every entry.
+func (tr *Reader) SetEntryFilter(f EntryFilter) {
+	tr.filter = f
+}
+
+// applyFilter applies the entry filter of the Reader on h.
+func (tr *Reader) applyFilter(h *Header) (bool, error) {
+	if tr.filter == nil {
+		return true, nil
+	}
+	c := *h
+	c.PAXRecords, c.Xattrs = cloneRecords(h.PAXRecords), cloneRecords(h.Xattrs)
+	keep, err := tr.filter(&c)
+	if err != nil {
+		e := safearchive.NewEntryError(tr.name, "", err)
+		e.Offset = tr.offset
+		return false, e
+	}
+	return keep, nil
+}
+
+// cloneRecords returns a copy of the PAX records or extended attributes m.
+func cloneRecords(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	re := make(map[string]string, len(m))
+	for k, v := range m {
+		re[k] = v
+	}
+	return re
+}
+
+// SetIncludePatterns restricts the entries returned by Next to the ones matched by one of the glob
+// patterns (see safearchive.Patterns), e.g. "docs/*.md", like the --wildcards of tar. Patterns are
+// matched against the sanitized names of the entries, so renamed entries are matched by their new
+// names. The data of the other entries is skipped without being read, if the underlying reader is
+// an io.Seeker; they are still checked by the security features. It fails with
+// path.ErrBadPattern, leaving the patterns unchanged, if one of them is malformed. No patterns
+// (the default) include every entry.
+func (tr *Reader) SetIncludePatterns(patterns ...string) error {
+	if err := (safearchive.Patterns{Include: patterns}).Validate(); err != nil {
+		return err
+	}
+	tr.patterns.Include = patterns
+	return nil
+}
+
+// SetExcludePatterns skips the entries matched by one of the glob patterns, even if they are
+// included, like SetIncludePatterns.
+func (tr *Reader) SetExcludePatterns(patterns ...string) error {
+	if err := (safearchive.Patterns{Exclude: patterns}).Validate(); err != nil {
+		return err
+	}
+	tr.patterns.Exclude = patterns
+	return nil
+}
+
+// selected reports whether the current entry is in the subtree of the Reader and matched by its
+// patterns.
+func (tr *Reader) selected() bool {
+	return sanitizer.InSubtree(tr.selectName, tr.subtree) && tr.patterns.Match(filepath.ToSlash(tr.selectName))
+}
+
+// SetStripComponents removes the n leading path components of the names of the entries returned
+// by Next, like the --strip-components of tar, and SetPrefix prepends a prefix to them. They are
+// applied on the sanitized names, including on the targets of hard links, and cannot reintroduce
+// ".." path elements (see sanitizer.StripComponents). The relative targets of symbolic links are
+// rewritten to keep pointing to the same entries (see sanitizer.StripLinkTarget), and the links
+// whose target is stripped are dropped with safearchive.ReasonSymlinkTarget. As the names are
+// rewritten before the entries are tracked by the other security features (e.g.
+// PreventSymlinkTraversal), these check the final names. SetSubtree and the patterns select the
+// entries by their names in the archive though. Entries with no more than n components are
+// skipped. Zero (the default) strips nothing.
+func (tr *Reader) SetStripComponents(n int) {
+	tr.strip = n
+}
+
+// SetPrefix prepends prefix (e.g. "vendor/") to the names of the entries returned by Next, see
+// SetStripComponents. An empty prefix (the default) prepends nothing.
+func (tr *Reader) SetPrefix(prefix string) {
+	tr.prefix = prefix
+}
@@ -0,0 +1,93 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"io"
+	"io/fs"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/internal/fstree"
+)
+
+// FS is a read-only file system of the regular files and directories of a tar archive, as exposed
+// by the Reader (so with its security features applied), for code written against io/fs (e.g.
+// template loading or fstest). It implements fs.ReadDirFS and fs.StatFS.
+//
+// OpenFS reads the headers of the archive once to index it (see Index); opening a file reads its
+// data directly from the archive, without keeping any of it in memory. Symbolic links and special files are left
+// out, hard links are exposed as regular files with the contents of their targets. When the
+// archive has several entries with the same name, the last one wins. An FS is safe for concurrent
+// use if the underlying io.ReaderAt is.
+type FS struct {
+	index *Index
+	tree  *fstree.Tree
+}
+
+// OpenFS indexes the tar archive r, which is size bytes long, read with the security features of
+// mode, and returns its file system. It fails with the first error of Reader.Next.
+func OpenFS(r io.ReaderAt, size int64, mode SecurityMode) (*FS, error) {
+	x, err := NewIndex(r, size, mode)
+	if err != nil {
+		return nil, err
+	}
+	return x.FS(), nil
+}
+
+// FS returns the file system of the entries of the Index.
+func (x *Index) FS() *FS {
+	f := &FS{index: x}
+	f.tree = fstree.New(func(n *fstree.Node) (io.ReadCloser, error) {
+		r, err := x.Open(n.Data().(IndexEntry))
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(r), nil
+	})
+	for _, e := range x.entries {
+		h := e.Header
+		switch h.Typeflag {
+		case TypeDir:
+			f.tree.Add(h.Name, fstree.NewNode(h.FileInfo().Mode(), 0, h.ModTime, nil))
+		case TypeReg, TypeGNUSparse:
+			f.tree.Add(h.Name, fstree.NewNode(h.FileInfo().Mode(), h.Size, h.ModTime, e))
+		case TypeLink:
+			if target, err := f.tree.Lookup(fstree.Name(h.Linkname)); err == nil && target.Mode().IsRegular() {
+				f.tree.Add(h.Name, fstree.NewNode(target.Mode(), target.Size(), h.ModTime, target.Data()))
+			}
+		}
+	}
+	return f
+}
+
+// Report returns the findings of the security features about the entries of the archive.
+func (f *FS) Report() *safearchive.Report {
+	return f.index.Report()
+}
+
+// Open opens the named file.
+func (f *FS) Open(name string) (fs.File, error) {
+	return f.tree.Open(name)
+}
+
+// ReadDir reads the named directory and returns its entries sorted by name.
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return f.tree.ReadDir(name)
+}
+
+// Stat returns a FileInfo describing the named file.
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	return f.tree.Stat(name)
+}
@@ -0,0 +1,130 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar" // NOLINT
+	"errors"
+	"io"
+	"io/fs"
+
+	"github.com/google/safearchive"
+)
+
+// IndexEntry is an entry of an Index.
+type IndexEntry struct {
+	// Header is the header of the entry, as returned by the Reader.
+	Header *tar.Header
+	// Offset is the position of the first header block of the entry in the archive.
+	Offset int64
+}
+
+// Index is an in-memory index of the entries of a tar archive, built in a single pass with the
+// security features of a Reader applied, so the data of individual entries can be read again
+// without streaming the archive (e.g. container layers or dataset bundles). An Index is safe for
+// concurrent use if the underlying io.ReaderAt is.
+type Index struct {
+	r       io.ReaderAt
+	size    int64
+	entries []IndexEntry
+	// names maps the names of the entries to their positions in entries; later entries win.
+	names  map[string]int
+	report *safearchive.Report
+}
+
+// NewIndex indexes the tar archive r, which is size bytes long, read with the security features of
+// mode. Only the headers are kept in memory. It fails with the first error of Reader.Next.
+func NewIndex(r io.ReaderAt, size int64, mode SecurityMode) (*Index, error) {
+	x := &Index{r: r, size: size, names: map[string]int{}}
+	tr := NewReader(io.NewSectionReader(r, 0, size))
+	tr.SetSecurityMode(mode)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		x.names[h.Name] = len(x.entries)
+		x.entries = append(x.entries, IndexEntry{Header: h, Offset: tr.offset})
+	}
+	x.report = tr.Report()
+	return x, nil
+}
+
+// Entries returns the entries of the archive, in the order of the archive.
+func (x *Index) Entries() []IndexEntry {
+	return append([]IndexEntry(nil), x.entries...)
+}
+
+// Lookup returns the last entry of the archive named name.
+func (x *Index) Lookup(name string) (IndexEntry, bool) {
+	i, ok := x.names[name]
+	if !ok {
+		return IndexEntry{}, false
+	}
+	return x.entries[i], true
+}
+
+// Report returns the findings of the security features about the entries of the archive.
+func (x *Index) Report() *safearchive.Report {
+	return &safearchive.Report{Findings: append([]safearchive.Finding{}, x.report.Findings...)}
+}
+
+// Open returns a reader of the data of e, which must be an entry of the Index. Every call reads the
+// data again from the archive, independently of the other readers.
+func (x *Index) Open(e IndexEntry) (io.Reader, error) {
+	tr := tar.NewReader(io.NewSectionReader(x.r, e.Offset, x.size-e.Offset))
+	if _, err := tr.Next(); err != nil {
+		return nil, err
+	}
+	return tr, nil
+}
+
+// OpenByName returns a reader of the data of the last regular file of the archive named name.
+// Hard links are resolved to the entries they link to, i.e. the last entries with the name of their
+// targets preceding them in the archive, as when the archive is extracted.
+func (x *Index) OpenByName(name string) (io.Reader, error) {
+	i, ok := x.names[name]
+	var e IndexEntry
+	if ok {
+		e = x.entries[i]
+	}
+	if ok && e.Header.Typeflag == TypeLink {
+		e, ok = x.lookupBefore(e.Header.Linkname, i)
+	}
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if t := e.Header.Typeflag; t != TypeReg && t != TypeGNUSparse {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("not a regular file")}
+	}
+	r, err := x.Open(e)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return r, nil
+}
+
+// lookupBefore returns the last entry named name preceding the i-th entry of the archive.
+func (x *Index) lookupBefore(name string, i int) (IndexEntry, bool) {
+	for i--; i >= 0; i-- {
+		if x.entries[i].Header.Name == name {
+			return x.entries[i], true
+		}
+	}
+	return IndexEntry{}, false
+}
@@ -0,0 +1,136 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"fmt"
+
+	"github.com/google/safearchive"
+)
+
+// limits are the resource limits of a Reader. Zero values mean no limit.
+type limits struct {
+	maxEntrySize int64
+	maxTotalSize int64
+	maxEntries   int
+	// maxPAXRecords, maxPAXSize and maxLongName bound the meta headers of every entry.
+	maxPAXRecords int
+	maxPAXSize    int64
+	maxLongName   int
+
+	// entries and totalSize are the number and the total declared size of the entries read so
+	// far, including the skipped ones.
+	entries   int
+	totalSize int64
+}
+
+// SetMaxEntrySize limits the size of the entries of the archive. Next fails with an error
+// wrapping ErrLimitExceeded when an entry declares a larger size. Zero (the default) means no
+// limit.
+func (tr *Reader) SetMaxEntrySize(n int64) {
+	tr.limits.maxEntrySize = n
+}
+
+// SetMaxTotalSize limits the total size of the entries of the archive, including the ones skipped
+// by the security features, as their data is read from the underlying stream as well. Next fails
+// with an error wrapping ErrLimitExceeded when an entry would exceed the limit. Zero (the default)
+// means no limit.
+func (tr *Reader) SetMaxTotalSize(n int64) {
+	tr.limits.maxTotalSize = n
+}
+
+// SetMaxEntries limits the number of entries of the archive, including the ones skipped by the
+// security features. Next fails with an error wrapping ErrLimitExceeded when the archive has more
+// entries. Zero (the default) means no limit.
+func (tr *Reader) SetMaxEntries(n int) {
+	tr.limits.maxEntries = n
+}
+
+// SetMaxPAXRecords limits the number of records of the PAX headers of an entry, or of a global PAX
+// header. Next fails with an error wrapping ErrMetadataLimit when an entry has more records. Zero
+// (the default) means no limit.
+func (tr *Reader) SetMaxPAXRecords(n int) {
+	tr.limits.maxPAXRecords = n
+}
+
+// SetMaxPAXSize limits the size of every PAX header (local or global) of the archive. The size is
+// checked before the data of the header is read, so larger headers are never buffered: Next fails
+// with an error wrapping ErrMetadataLimit as soon as their header block is read. Zero (the default)
+// means no limit, the upstream reader buffering up to 1 MiB.
+func (tr *Reader) SetMaxPAXSize(n int64) {
+	tr.limits.maxPAXSize = n
+}
+
+// SetMaxLongName limits the length of the GNU long names and long link targets of the archive. Like
+// the size of the PAX headers, it is checked before the names are read: Next fails with an error
+// wrapping ErrMetadataLimit on longer names. Zero (the default) means no limit.
+func (tr *Reader) SetMaxLongName(n int) {
+	tr.limits.maxLongName = n
+}
+
+// checkLimits accounts h against the limits of the reader, and returns the error to fail Next with
+// if it exceeds one of them.
+// The limits are checked against the sizes declared in the headers: the data of an entry read
+// from the archive is never longer than its declared size (sparse files are expanded to it).
+func (tr *Reader) checkLimits(h *Header) error {
+	l := &tr.limits
+	l.entries++
+	var detail string
+	err := ErrLimitExceeded
+	switch {
+	case l.maxEntries > 0 && l.entries > l.maxEntries:
+		detail = fmt.Sprintf("archive has more than %d entries", l.maxEntries)
+	case l.maxEntrySize > 0 && h.Size > l.maxEntrySize:
+		detail = fmt.Sprintf("entry declares %d bytes, the limit is %d", h.Size, l.maxEntrySize)
+	case l.maxTotalSize > 0 && h.Size > l.maxTotalSize-l.totalSize:
+		detail = fmt.Sprintf("entries declare more than %d bytes in total", l.maxTotalSize)
+	case l.maxPAXRecords > 0 && countPAXRecords(tr.headers) > l.maxPAXRecords:
+		detail = fmt.Sprintf("entry has more than %d PAX records", l.maxPAXRecords)
+		err = ErrMetadataLimit
+	}
+	l.totalSize += h.Size
+	if detail == "" {
+		return nil
+	}
+	f := tr.flag(safearchive.Verdict{Action: safearchive.ActionRejected, Reason: safearchive.ReasonLimitExceeded, Detail: detail})
+	return f.Err(err)
+}
+
+// checkMetaHeader checks the size of a meta header of the next entry against the limits of the
+// reader. It is called by the headerRecorder as soon as the header block has been read, before the
+// upstream reader buffers the data of the header, and fails the reads of the upstream reader with
+// the error it returns.
+func (tr *Reader) checkMetaHeader(typeflag byte, size int64) error {
+	l := &tr.limits
+	var detail string
+	switch typeflag {
+	case TypeXHeader, TypeXGlobalHeader:
+		if l.maxPAXSize > 0 && size > l.maxPAXSize {
+			detail = fmt.Sprintf("PAX header of %d bytes, the limit is %d", size, l.maxPAXSize)
+		}
+	case TypeGNULongName, TypeGNULongLink:
+		// the names are terminated by a NUL
+		if l.maxLongName > 0 && size-1 > int64(l.maxLongName) {
+			detail = fmt.Sprintf("GNU long name of %d bytes, the limit is %d", size-1, l.maxLongName)
+		}
+	}
+	if detail == "" {
+		return nil
+	}
+	// the name of the entry is not known yet
+	tr.offset, tr.raw, tr.name, tr.headers = tr.next, nil, "", tr.recorder.buf
+	f := tr.flag(safearchive.Verdict{Action: safearchive.ActionRejected, Reason: safearchive.ReasonLimitExceeded, Detail: detail})
+	return f.Err(ErrMetadataLimit)
+}
@@ -0,0 +1,359 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const blockSize = 512
+
+var errNotSeekable = errors.New("tar: underlying reader does not support seeking")
+
+// headerRecorder tracks the position of the underlying stream and records the bytes read from a
+// given position on while recording is enabled. The Reader enables recording while the upstream
+// reader parses the headers of the next entry. The reads fail once ctx, if set, is done.
+type headerRecorder struct {
+	r        io.Reader
+	ctx      context.Context
+	pos      int64
+	record   bool
+	keepFrom int64
+	buf      []byte
+	// check, if set, is called with the type flag and the size of the meta headers (PAX headers
+	// and GNU long names) as soon as their header block is recorded, before the upstream reader
+	// reads their data. Once it fails, the reads fail with its error.
+	check func(typeflag byte, size int64) error
+	// scan is the position in buf of the next header block to check, or -1 once the final header
+	// block of the entry was checked.
+	scan int64
+	err  error
+	// pending are bytes read from r already, to be read again before the rest of r, see unread.
+	pending []byte
+}
+
+func (c *headerRecorder) Read(b []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.ctx != nil && c.ctx.Err() != nil {
+		return 0, c.ctx.Err()
+	}
+	var n int
+	var err error
+	if len(c.pending) > 0 {
+		n = copy(b, c.pending)
+		c.pending = c.pending[n:]
+	} else {
+		n, err = c.r.Read(b)
+	}
+	if c.record && c.pos+int64(n) > c.keepFrom {
+		skip := c.keepFrom - c.pos
+		if skip < 0 {
+			skip = 0
+		}
+		c.buf = append(c.buf, b[skip:n]...)
+		if c.check != nil {
+			if c.err = c.checkHeaders(); c.err != nil {
+				// io.ReadFull drops the error of a complete read, so it is returned by the next
+				// reads as well
+				return n, c.err
+			}
+		}
+	}
+	c.pos += int64(n)
+	return n, err
+}
+
+// checkHeaders calls check on the meta headers recorded since the last call.
+func (c *headerRecorder) checkHeaders() error {
+	for c.scan >= 0 && c.scan+blockSize <= int64(len(c.buf)) {
+		blk := c.buf[c.scan : c.scan+blockSize]
+		switch blk[156] {
+		case TypeXHeader, TypeXGlobalHeader, TypeGNULongName, TypeGNULongLink:
+		default:
+			c.scan = -1
+			return nil
+		}
+		size, ok := parseSize(blk[124:136])
+		if !ok {
+			return fmt.Errorf("%w: invalid size of a meta header", ErrHeader)
+		}
+		if err := c.check(blk[156], size); err != nil {
+			return err
+		}
+		next := c.scan + blockSize + roundUp(size)
+		if next <= c.scan {
+			return fmt.Errorf("%w: meta header of %d bytes", ErrHeader, size)
+		}
+		c.scan = next
+	}
+	return nil
+}
+
+// Seek lets the upstream reader skip the data of entries efficiently if the underlying reader
+// supports seeking.
+func (c *headerRecorder) Seek(offset int64, whence int) (int64, error) {
+	if c.ctx != nil && c.ctx.Err() != nil {
+		return 0, c.ctx.Err()
+	}
+	s, ok := c.r.(io.Seeker)
+	if !ok || len(c.pending) > 0 {
+		// the upstream reader reads the data to skip instead
+		return 0, errNotSeekable
+	}
+	cur, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	pos, err := s.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	c.pos += pos - cur
+	return pos, nil
+}
+
+// unread makes b, the last bytes read from the underlying reader, be read again.
+func (c *headerRecorder) unread(b []byte) {
+	c.pending = append(b, c.pending...)
+	c.pos -= int64(len(b))
+}
+
+// startRecording starts recording the headers of an entry beginning at position from.
+func (c *headerRecorder) startRecording(from int64) {
+	c.buf = c.buf[:0]
+	c.keepFrom = from
+	c.record = true
+	c.scan, c.err = 0, nil
+}
+
+// stopRecording stops recording and returns the recorded bytes.
+func (c *headerRecorder) stopRecording() []byte {
+	c.record = false
+	return c.buf
+}
+
+// parseHeaders returns the final header block of the entry (the one following the meta headers)
+// and the number of bytes the entry occupies in the archive: the length of its header blocks
+// (including the preceding meta headers and their data, and the extension blocks of old GNU
+// sparse headers) plus the length of its data padded to whole blocks.
+// raw holds the headers of the entry and h is the header returned by the upstream reader, before
+// any sanitization.
+func parseHeaders(raw []byte, h *Header) ([]byte, int64) {
+	pos := int64(0)
+	for pos+blockSize <= int64(len(raw)) {
+		blk := raw[pos : pos+blockSize]
+		size := parseNumeric(blk[124:136])
+		pos += blockSize
+		switch blk[156] {
+		case TypeXHeader, TypeGNULongName, TypeGNULongLink:
+			pos += roundUp(size)
+			continue
+		case TypeGNUSparse:
+			for extended := blk[482] != 0; extended && pos+blockSize <= int64(len(raw)); pos += blockSize {
+				extended = raw[pos+504] != 0
+			}
+		}
+		switch blk[156] {
+		case TypeLink, TypeSymlink, TypeChar, TypeBlock, TypeDir, TypeFifo:
+			size = 0
+		case TypeXGlobalHeader:
+		default:
+			if s, ok := h.PAXRecords["size"]; ok {
+				size, _ = strconv.ParseInt(s, 10, 64)
+			}
+		}
+		return blk, pos + roundUp(size)
+	}
+	return nil, roundUp(int64(len(raw)))
+}
+
+// countPAXRecords returns the number of records of the PAX headers (local and global) among the
+// headers raw of an entry.
+func countPAXRecords(raw []byte) int {
+	count := 0
+	for pos := int64(0); pos+blockSize <= int64(len(raw)); {
+		blk := raw[pos : pos+blockSize]
+		size := parseNumeric(blk[124:136])
+		pos += blockSize
+		switch blk[156] {
+		case TypeXHeader, TypeXGlobalHeader:
+			if end := pos + size; end <= int64(len(raw)) {
+				count += countRecords(raw[pos:end])
+			}
+		case TypeGNULongName, TypeGNULongLink:
+		default:
+			return count
+		}
+		pos += roundUp(size)
+	}
+	return count
+}
+
+// countRecords returns the number of well-formed records at the beginning of the data of a PAX
+// header, each of them starting with its length ("%d %s=%s\n").
+func countRecords(data []byte) int {
+	count := 0
+	for len(data) > 0 {
+		sp := bytes.IndexByte(data, ' ')
+		if sp < 0 {
+			break
+		}
+		n, err := strconv.Atoi(string(data[:sp]))
+		if err != nil || n <= sp || n > len(data) {
+			break
+		}
+		count++
+		data = data[n:]
+	}
+	return count
+}
+
+// parseString parses a NUL terminated string header field.
+func parseString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return string(b[:i])
+	}
+	return string(b)
+}
+
+// linknameMismatch reports if the link name field of the ustar header block differs from the
+// linkpath PAX record. Writers store the link target in the ustar field as well, truncated and
+// with the non-ASCII characters dropped, or leave the field empty, which are not reported.
+func linknameMismatch(blk []byte, h *Header) bool {
+	linkpath, ok := h.PAXRecords["linkpath"]
+	if !ok || blk == nil {
+		return false
+	}
+	ustar := parseString(blk[157:257])
+	if ustar == "" {
+		return false
+	}
+	want := strings.Map(func(r rune) rune {
+		if r >= 0x80 {
+			return -1
+		}
+		return r
+	}, linkpath)
+	if len(want) > 100 {
+		want = want[:100]
+	}
+	return ustar != want
+}
+
+// ustarName returns the name of the entry as reconstructed from the name and prefix fields of the
+// header block, and whether the block is a V7 header (without the ustar magic). Only POSIX ustar
+// headers have a prefix field; the GNU format stores other data there.
+func ustarName(blk []byte) (name string, v7 bool) {
+	name = parseString(blk[0:100])
+	switch {
+	case bytes.Equal(blk[257:263], []byte("ustar\x00")):
+		if prefix := parseString(blk[345:500]); prefix != "" {
+			name = prefix + "/" + name
+		}
+		return name, false
+	case bytes.Equal(blk[257:263], []byte("ustar ")):
+		return name, false
+	}
+	return name, true
+}
+
+// nameMismatch returns the ambiguity of the name of the entry, if any: the name returned by the
+// upstream reader (which follows GNU tar and libarchive in preferring the path PAX record and the
+// GNU long name over the name and prefix fields) is reconstructed differently by parsers ignoring
+// these extensions, or by parsers interpreting the prefix field of V7 headers.
+// As writers store the non-ASCII characters dropped, and long names truncated to fill the name
+// field, those differences are not reported; shorter names must match.
+func nameMismatch(blk []byte, name string) string {
+	if blk == nil {
+		return ""
+	}
+	ustar, v7 := ustarName(blk)
+	if v7 {
+		if prefix := parseString(blk[345:500]); prefix != "" {
+			return fmt.Sprintf("V7 header with the ustar prefix %q", prefix)
+		}
+		return ""
+	}
+	if ustar == "" || ustar == name {
+		return ""
+	}
+	want := strings.Map(func(r rune) rune {
+		if r >= 0x80 {
+			return -1
+		}
+		return r
+	}, name)
+	// the upstream writer leaves the last byte of truncated names for a NUL
+	full := len(parseString(blk[0:100])) >= 99
+	if want == ustar || full && strings.HasPrefix(want, ustar) {
+		return ""
+	}
+	return fmt.Sprintf("ustar name %q", ustar)
+}
+
+// parseNumeric parses a numeric header field stored either as an octal string or in the base-256
+// encoding of the GNU format. Invalid fields are parsed as 0.
+func parseNumeric(b []byte) int64 {
+	n, _ := parseSize(b)
+	return n
+}
+
+// parseSize parses a numeric header field like parseNumeric, reporting whether it is a valid
+// size: negative values, values overflowing an int64 and values too large to be rounded up to
+// whole blocks are not.
+func parseSize(b []byte) (int64, bool) {
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		if b[0]&0x40 != 0 {
+			// the sign bit of the two's complement
+			return 0, false
+		}
+		var n int64
+		for i, c := range b {
+			if i == 0 {
+				c &= 0x7f
+			}
+			if n > math.MaxInt64>>8 {
+				return 0, false
+			}
+			n = n<<8 | int64(c)
+		}
+		if n > math.MaxInt64-blockSize {
+			return 0, false
+		}
+		return n, true
+	}
+	s := string(bytes.Trim(b, " \x00"))
+	if s == "" {
+		return 0, true
+	}
+	n, err := strconv.ParseInt(s, 8, 64)
+	if err != nil || n < 0 || n > math.MaxInt64-blockSize {
+		return 0, false
+	}
+	return n, true
+}
+
+func roundUp(n int64) int64 {
+	return (n + blockSize - 1) / blockSize * blockSize
+}
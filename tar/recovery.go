@@ -0,0 +1,108 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar" // NOLINT
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/google/safearchive"
+)
+
+// ReasonCorruptHeader is the reason of the findings about the byte ranges skipped by the tolerant
+// mode of the Reader (see SetTolerant) to recover from a header that could not be parsed.
+const ReasonCorruptHeader safearchive.Reason = "tar-corrupt-header"
+
+// SetTolerant enables the recovery of damaged archives: when the headers of an entry cannot be
+// parsed (ErrHeader), Next scans the archive forward for the next plausible header block (one with
+// a valid checksum) and continues from there, instead of failing. Each skipped byte range is
+// reported in the Report, with the reason ReasonCorruptHeader, and the entries it held are lost.
+// This is meant for best-effort reads of damaged tapes and files, e.g. for forensics or backup
+// recovery; by default Next fails on the first corrupt header.
+func (tr *Reader) SetTolerant(tolerant bool) {
+	tr.tolerant = tolerant
+}
+
+// resync recovers from the corrupt headers of the entry at tr.next, whose recorded bytes are in
+// tr.headers: it scans the following blocks for a plausible header block, and makes a new upstream
+// reader start from it. It returns io.EOF if the archive ends before such a block.
+func (tr *Reader) resync() error {
+	start := tr.next
+	// the blocks following the first one of the corrupt entry, starting with the ones the upstream
+	// reader read already
+	var consumed []byte
+	if len(tr.headers) > blockSize {
+		consumed = tr.headers[blockSize:]
+	}
+	br := bytes.NewReader(consumed)
+	r := io.MultiReader(br, tr.recorder)
+	if len(tr.headers) < blockSize {
+		// the rest of the first block
+		if _, err := io.CopyN(io.Discard, r, int64(blockSize-len(tr.headers))); err != nil {
+			return tr.skipped(start, start+int64(len(tr.headers)), io.EOF)
+		}
+	}
+	pos := start + blockSize
+	blk := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, blk)
+		if err != nil {
+			return tr.skipped(start, pos+int64(n), io.EOF)
+		}
+		if plausibleHeader(blk) {
+			pending := make([]byte, blockSize+br.Len())
+			copy(pending, blk)
+			br.Read(pending[blockSize:])
+			tr.recorder.unread(pending)
+			tr.unsafeReader = tar.NewReader(tr.recorder)
+			tr.next = pos
+			return tr.skipped(start, pos, nil)
+		}
+		pos += blockSize
+	}
+}
+
+// skipped records the finding about the skipped bytes from start to end, and returns err.
+func (tr *Reader) skipped(start, end int64, err error) error {
+	tr.name, tr.offset, tr.headers, tr.raw = "", start, nil, nil
+	tr.flag(safearchive.Verdict{Action: safearchive.ActionDropped, Reason: ReasonCorruptHeader, Detail: fmt.Sprintf("skipped %d bytes at offset %d", end-start, start)})
+	return err
+}
+
+// plausibleHeader reports whether blk looks like a tar header block: it has a name, and its
+// checksum is valid (the sum of its bytes, as unsigned or as signed bytes as some historic
+// implementations did, with the checksum field counted as spaces).
+func plausibleHeader(blk []byte) bool {
+	if blk[0] == 0 {
+		return false
+	}
+	want, err := strconv.ParseInt(strings.Trim(string(blk[148:156]), " \x00"), 8, 64)
+	if err != nil {
+		return false
+	}
+	var unsigned, signed int64
+	for i, b := range blk {
+		if i >= 148 && i < 156 {
+			b = ' '
+		}
+		unsigned += int64(b)
+		signed += int64(int8(b))
+	}
+	return want == unsigned || want == signed
+}
@@ -0,0 +1,67 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"io"
+)
+
+// Repack writes the entries of src to dst as a new tar archive.
+// Headers are written the way src exposes them, so the security mode of src (e.g. SanitizeFilenames
+// or DropXattrs) applies to the output as well. Entry bodies are streamed through as-is.
+func Repack(dst io.Writer, src *Reader) error {
+	tw := NewWriter(dst)
+	tw.SetSecurityMode(0)
+	for {
+		h, err := src.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := CopyEntry(tw, h, src); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// Sanitize streams the tar archive read from src through the security features of mode, and writes
+// the entries that pass them to dst as a new tar archive, with their sanitized headers. The
+// contents of the entries are copied byte-for-byte. Services storing archives for later extraction
+// by third parties can use it to store sanitized archives rather than to rely on sanitized reads.
+// Sanitize fails if the Reader does (e.g. when an entry is rejected in StrictMode), dst is left
+// with a truncated archive then.
+func Sanitize(dst io.Writer, src io.Reader, mode SecurityMode) error {
+	tr := NewReader(src)
+	tr.SetSecurityMode(mode)
+	return Repack(dst, tr)
+}
+
+// CopyEntry writes h to tw followed by the body of the entry read from r.
+// Sparse entries are written as regular files, their holes are filled with NUL-bytes.
+func CopyEntry(tw *Writer, h *Header, r io.Reader) error {
+	if h.Typeflag == TypeGNUSparse {
+		hc := *h
+		hc.Typeflag = TypeReg
+		h = &hc
+	}
+	if err := tw.WriteHeader(h); err != nil {
+		return err
+	}
+	_, err := io.Copy(tw, r)
+	return err
+}
@@ -0,0 +1,351 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/sanitizer"
+)
+
+// rule is a per-entry check of the Reader. The built-in security features and the custom rules
+// are applied the same way, see Reader.applyRules.
+type rule interface {
+	apply(tr *Reader, h *Header) safearchive.Verdict
+}
+
+// ruleFunc adapts a function to the rule interface.
+type ruleFunc func(tr *Reader, h *Header) safearchive.Verdict
+
+func (f ruleFunc) apply(tr *Reader, h *Header) safearchive.Verdict {
+	return f(tr, h)
+}
+
+// builtinRules are the built-in security features in the order they are applied, before the
+// custom rules. Each of them checks whether it is enabled in the security mode of the Reader. The
+// names are sanitized after the characters that disguise them were dealt with, as e.g. ".\u200b."
+// becomes ".." once its zero-width space is stripped.
+var builtinRules = []rule{
+	ruleFunc(checkName),
+	ruleFunc(checkLinkname),
+	ruleFunc(skipSpecialFiles),
+	ruleFunc(sanitizeFileMode),
+	ruleFunc(validateNameEncoding),
+	ruleFunc(sanitizeUnicode),
+	ruleFunc(sanitizeFilenames),
+	ruleFunc(stripComponents),
+	ruleFunc(skipWindowsShortFilenames),
+	ruleFunc(dropXattrs),
+}
+
+// recheckRules are the built-in security features applied again on the entries whose name, link
+// or mode a custom rule changed. The link targets are checked by the tracking rules.
+var recheckRules = []rule{
+	ruleFunc(sanitizeFileMode),
+	ruleFunc(validateNameEncoding),
+	ruleFunc(sanitizeUnicode),
+	ruleFunc(sanitizeFilenames),
+	ruleFunc(skipWindowsShortFilenames),
+}
+
+// trackingRules are the built-in security features keeping track of the entries seen so far,
+// applied last so they see the final names of the entries. The duplicates and collisions are
+// renamed before the symbolic links are tracked, so a renamed link still covers the entries below
+// its new name.
+var trackingRules = []rule{
+	ruleFunc(checkDuplicates),
+	ruleFunc(checkCollisions),
+	ruleFunc(preventSymlinkTraversal),
+	ruleFunc(detectSymlinkLoops),
+	ruleFunc(sanitizeSymlinkTargets),
+	ruleFunc(limitFanOut),
+	ruleFunc(requireSymlinksLast),
+}
+
+// checkName reports entries whose name is reconstructed differently by other parsers, see
+// nameMismatch. They are rejected in StrictMode.
+func checkName(tr *Reader, h *Header) safearchive.Verdict {
+	if detail := nameMismatch(tr.blk, tr.name); detail != "" {
+		return safearchive.Verdict{Action: tr.ambiguityAction(), Reason: ReasonNameMismatch, Detail: detail}
+	}
+	return safearchive.Pass
+}
+
+// checkLinkname reports entries whose linkpath PAX record disagrees with the ustar link name.
+// h.Linkname is the effective link target: the upstream reader has already replaced it with the
+// linkpath PAX record, if any. Parsers ignoring PAX records would see the link target of the
+// ustar header though. They are rejected in StrictMode.
+func checkLinkname(tr *Reader, h *Header) safearchive.Verdict {
+	if linknameMismatch(tr.blk, h) {
+		return safearchive.Verdict{Action: tr.ambiguityAction(), Reason: ReasonLinknameMismatch}
+	}
+	return safearchive.Pass
+}
+
+// ambiguityAction is the action on entries that other parsers read differently.
+func (tr *Reader) ambiguityAction() safearchive.Action {
+	if tr.securityMode&StrictMode != 0 {
+		return safearchive.ActionRejected
+	}
+	return safearchive.ActionNone
+}
+
+func skipSpecialFiles(tr *Reader, h *Header) safearchive.Verdict {
+	// non-safe entries are skipped
+	if tr.securityMode&SkipSpecialFiles != 0 && h.Typeflag != TypeReg && h.Typeflag != TypeDir && h.Typeflag != TypeSymlink {
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonSpecialFile}
+	}
+	return safearchive.Pass
+}
+
+func sanitizeFileMode(tr *Reader, h *Header) safearchive.Verdict {
+	if tr.securityMode&SanitizeFileMode != 0 && h.Mode&^0777 != 0 {
+		// clearing out any potentially special bits (e.g. setuid)
+		detail := fmt.Sprintf("mode %#o changed to %#o", h.Mode, h.Mode&0777)
+		h.Mode = h.Mode & 0777 // &^ s_ISUID &^ s_ISGID &^ s_ISVTX
+		return safearchive.Verdict{Action: safearchive.ActionModified, Reason: safearchive.ReasonSpecialMode, Detail: detail}
+	}
+	return safearchive.Pass
+}
+
+func sanitizeFilenames(tr *Reader, h *Header) safearchive.Verdict {
+	if tr.securityMode&SanitizeFilenames == 0 {
+		return safearchive.Pass
+	}
+	name := h.Name
+	h.Name = sanitizer.SanitizePath(name)
+	if filepath.ToSlash(h.Name) != strings.ReplaceAll(name, `\`, "/") {
+		return safearchive.Verdict{Action: safearchive.ActionModified, Reason: safearchive.NameReason(name)}
+	}
+	return safearchive.Pass
+}
+
+func validateNameEncoding(tr *Reader, h *Header) safearchive.Verdict {
+	if tr.securityMode&ValidateNameEncoding == 0 {
+		return safearchive.Pass
+	}
+	name, v := tr.encoding.Check(h.Name)
+	linkname, lv := tr.encoding.Check(h.Linkname)
+	if v.Reason == "" {
+		v = lv
+	}
+	if v.Action == safearchive.ActionModified {
+		h.Name, h.Linkname = name, linkname
+	}
+	return v
+}
+
+func sanitizeUnicode(tr *Reader, h *Header) safearchive.Verdict {
+	if tr.securityMode&SanitizeUnicode == 0 || !sanitizer.HasUnsafeRunes(h.Name) && !sanitizer.HasUnsafeRunes(h.Linkname) {
+		return safearchive.Pass
+	}
+	h.Name = sanitizer.StripUnsafeRunes(h.Name)
+	h.Linkname = sanitizer.StripUnsafeRunes(h.Linkname)
+	return safearchive.Verdict{Action: safearchive.ActionModified, Reason: safearchive.ReasonUnsafeUnicode}
+}
+
+// stripComponents strips the leading components of the names of h and prepends the prefix of the
+// Reader, see SetStripComponents. Entries left without a name are skipped without a finding.
+func stripComponents(tr *Reader, h *Header) safearchive.Verdict {
+	tr.selectName = h.Name
+	if tr.strip <= 0 && tr.prefix == "" {
+		return safearchive.Pass
+	}
+	name, ok := sanitizer.StripComponents(h.Name, tr.strip, tr.prefix)
+	if !ok {
+		return safearchive.Verdict{Action: safearchive.ActionDropped}
+	}
+	switch h.Typeflag {
+	case TypeLink:
+		if h.Linkname, ok = sanitizer.StripComponents(h.Linkname, tr.strip, tr.prefix); !ok {
+			return safearchive.Verdict{Action: safearchive.ActionDropped}
+		}
+	case TypeSymlink:
+		target, ok := sanitizer.StripLinkTarget(h.Name, h.Linkname, tr.strip, tr.prefix)
+		if !ok {
+			return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonSymlinkTarget, Detail: "target " + h.Linkname + " stripped"}
+		}
+		h.Linkname = target
+	}
+	h.Name = name
+	return safearchive.Pass
+}
+
+func sanitizeSymlinkTargets(tr *Reader, h *Header) safearchive.Verdict {
+	if tr.securityMode&SanitizeSymlinkTargets == 0 || h.Typeflag != TypeSymlink {
+		return safearchive.Pass
+	}
+	target := sanitizer.SanitizeLinkTarget(h.Name, h.Linkname)
+	name := strings.TrimSuffix(filepath.ToSlash(sanitizer.SanitizePath(h.Name)), "/")
+	if !tr.targets.AddLink(name, filepath.ToSlash(target)) {
+		// the target escapes through the links seen before, or makes one of them escape
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonSymlinkTarget, Detail: "target " + h.Linkname + " escapes through other links"}
+	}
+	if target == h.Linkname {
+		return safearchive.Pass
+	}
+	detail := fmt.Sprintf("target %s changed to %s", h.Linkname, target)
+	h.Linkname = target
+	return safearchive.Verdict{Action: safearchive.ActionModified, Reason: safearchive.ReasonSymlinkTarget, Detail: detail}
+}
+
+func skipWindowsShortFilenames(tr *Reader, h *Header) safearchive.Verdict {
+	if tr.securityMode&SkipWindowsShortFilenames != 0 && sanitizer.HasWindowsShortFilenames(h.Name) {
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonWindowsShortFilename}
+	}
+	return safearchive.Pass
+}
+
+func preventSymlinkTraversal(tr *Reader, h *Header) safearchive.Verdict {
+	if tr.securityMode&PreventSymlinkTraversal == 0 {
+		return safearchive.Pass
+	}
+	hName := sanitizer.SanitizePath(h.Name)
+	hName = strings.TrimSuffix(hName, "/")
+	if tr.securityMode&PreventCaseInsensitiveSymlinkTraversal != 0 {
+		hName = strings.ToLower(hName)
+	}
+	if tr.symlinks.Covers(hName) {
+		// a symlink has already been seen on this path. We need to drop this entry.
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonSymlinkTraversal}
+	}
+	if h.Linkname != "" || h.Typeflag == TypeSymlink {
+		tr.symlinks.Add(hName)
+	}
+	return safearchive.Pass
+}
+
+func detectSymlinkLoops(tr *Reader, h *Header) safearchive.Verdict {
+	if tr.securityMode&DetectSymlinkLoops == 0 || h.Typeflag != TypeSymlink {
+		return safearchive.Pass
+	}
+	name, target := filepath.ToSlash(h.Name), filepath.ToSlash(h.Linkname)
+	if tr.securityMode&PreventCaseInsensitiveSymlinkTraversal != 0 {
+		name, target = strings.ToLower(name), strings.ToLower(target)
+	}
+	if detail, ok := tr.links.Check(name, target); !ok {
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonSymlinkLoop, Detail: detail}
+	}
+	return safearchive.Pass
+}
+
+func checkDuplicates(tr *Reader, h *Header) safearchive.Verdict {
+	return applyDuplicateChecker(&tr.duplicates, h)
+}
+
+func checkCollisions(tr *Reader, h *Header) safearchive.Verdict {
+	return applyDuplicateChecker(&tr.collisions, h)
+}
+
+// applyDuplicateChecker applies c on h, renaming it if c does.
+func applyDuplicateChecker(c *safearchive.DuplicateChecker, h *Header) safearchive.Verdict {
+	v, name := c.Check(filepath.ToSlash(h.Name), h.Typeflag == TypeDir)
+	if v.Action == safearchive.ActionModified {
+		h.Name = filepath.FromSlash(name)
+	}
+	return v
+}
+
+func limitFanOut(tr *Reader, h *Header) safearchive.Verdict {
+	if !tr.fanOut.Allow(filepath.ToSlash(h.Name)) {
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonFanOut}
+	}
+	return safearchive.Pass
+}
+
+func requireSymlinksLast(tr *Reader, h *Header) safearchive.Verdict {
+	if tr.securityMode&RequireSymlinksLast == 0 {
+		return safearchive.Pass
+	}
+	name := filepath.ToSlash(h.Name)
+	if tr.securityMode&PreventCaseInsensitiveSymlinkTraversal != 0 {
+		name = strings.ToLower(name)
+	}
+	if detail, ok := tr.order.Check(name, h.Typeflag == TypeDir, h.Typeflag == TypeSymlink); !ok {
+		return safearchive.Verdict{Action: safearchive.ActionRejected, Reason: safearchive.ReasonOrderDependent, Detail: detail}
+	}
+	return safearchive.Pass
+}
+
+func dropXattrs(tr *Reader, h *Header) safearchive.Verdict {
+	if tr.securityMode&DropXattrs == 0 {
+		return safearchive.Pass
+	}
+	dropped := false
+	// Dropping extended attributes, if present, unless allow listed
+	var xattrs map[string]string
+	for k, val := range h.Xattrs {
+		if !tr.keepsPAX("SCHILY.xattr." + k) {
+			dropped = true
+			continue
+		}
+		if xattrs == nil {
+			xattrs = map[string]string{}
+		}
+		xattrs[k] = val
+	}
+	records := map[string]string{}
+	for k, val := range h.PAXRecords {
+		if tr.keepsPAX(k) {
+			records[k] = val
+		} else if isXattrKey(k) {
+			dropped = true
+		}
+	}
+	h.Xattrs, h.PAXRecords = xattrs, records
+	if dropped {
+		return safearchive.Verdict{Action: safearchive.ActionModified, Reason: safearchive.ReasonXattrs}
+	}
+	return safearchive.Pass
+}
+
+// customRule applies a safearchive.Rule to the format independent description of the header.
+type customRule struct {
+	safearchive.Rule
+}
+
+func (c customRule) apply(tr *Reader, h *Header) safearchive.Verdict {
+	e := EntryOf(h)
+	v := c.Check(&e)
+	if v.Action == safearchive.ActionModified {
+		h.Name, h.Linkname = e.Name, e.Linkname
+		if e.Mode != h.FileInfo().Mode() {
+			h.Mode = h.Mode&^07777 | modeBits(e.Mode)
+		}
+	}
+	if v.Action != safearchive.ActionNone && v.Reason == "" {
+		v.Reason = safearchive.ReasonCustomRule
+	}
+	return v
+}
+
+// modeBits returns the tar mode bits of the permissions and the special bits of m.
+func modeBits(m fs.FileMode) int64 {
+	re := int64(m.Perm())
+	if m&fs.ModeSetuid != 0 {
+		re |= 04000
+	}
+	if m&fs.ModeSetgid != 0 {
+		re |= 02000
+	}
+	if m&fs.ModeSticky != 0 {
+		re |= 01000
+	}
+	return re
+}
@@ -37,6 +37,14 @@
 // You may opt out from a certain feature like this:
 // tr.SetSecurityMode(tr.GetSecurityMode() &^ tar.SanitizeFileMode)
 //
+// If you would rather reject hostile archives entirely than read a sanitized subset of them:
+// tr.SetSecurityMode(tr.GetSecurityMode() | tar.StrictMode)
+//
+// Unlike archive/tar, the errors of Reader.Next and Reader.Read other than io.EOF are wrapped into
+// a *safearchive.EntryError telling which entry failed, so they must be matched with errors.Is
+// (e.g. errors.Is(err, io.ErrUnexpectedEOF) or errors.Is(err, tar.ErrHeader)) rather than compared
+// with ==.
+//
 // Notes about PreventSymlinkTraversal. Consider the following archive:
 // $ tar tvf traverse-via-links.tar
 // lrwxrwxrwx username/groupname 0 2023-03-08 09:43 linktoroot -> /
@@ -51,11 +59,15 @@ package tar
 
 import (
 	"archive/tar" // NOLINT
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"io/fs"
+	"strconv"
 	"strings"
 
-	"github.com/google/safearchive/sanitizer"
+	"github.com/google/safearchive"
 )
 
 // Format represents the tar archive format.
@@ -159,9 +171,23 @@ const (
 	TypeGNULongLink = tar.TypeGNULongLink
 )
 
+// ReasonLinknameMismatch is the reason of the findings about entries whose linkpath PAX record
+// disagrees with the link name of the ustar header. Such entries are extracted differently by
+// parsers that ignore PAX records, which may be exploited to smuggle links past a security check.
+const ReasonLinknameMismatch safearchive.Reason = "tar-linkname-mismatch"
+
+// ReasonNameMismatch is the reason of the findings about entries whose name is reconstructed
+// differently by other parsers: the path PAX record or the GNU long name disagrees with the name
+// and prefix fields of the ustar header, or a V7 header has a prefix field that parsers ignoring
+// the header format would prepend to the name. The Reader, like GNU tar and libarchive, prefers
+// the extensions and ignores the prefix field of V7 headers.
+const ReasonNameMismatch safearchive.Reason = "tar-name-mismatch"
+
 // SecurityMode controls security features to enforce
 type SecurityMode int
 
+// allowListedPaxKeys are the PAX records kept by DropXattrs, unless the Reader is configured
+// otherwise with SetPAXAllowlist.
 var allowListedPaxKeys = []string{"ctime", "mtime", "atime"}
 
 const (
@@ -174,7 +200,8 @@ const (
 	// The very first version (early 2022) of this library featured this security measure only.
 	// This feature is enabled by default.
 	SanitizeFilenames SecurityMode = 4
-	// DropXattrs will drop extended attributes from the header
+	// DropXattrs will drop extended attributes from the header, along with the PAX records not
+	// allow listed (see Reader.SetPAXAllowlist and Reader.SetXattrPolicy)
 	// This feature is not enabled by default.
 	DropXattrs SecurityMode = 16
 	// PreventSymlinkTraversal drops malicious entries that attempt to write to an outside location
@@ -191,11 +218,125 @@ const (
 	// By default, this is activated only on Windows builds. If you are extracting to a Windows
 	// filesystem on a non-Windows platform, you should activate this feature explicitly.
 	SkipWindowsShortFilenames SecurityMode = 128
+	// StrictMode makes Next fail with a typed error (e.g. ErrPathTraversal) instead of silently
+	// skipping or rewriting entries flagged by the other security features. Informational
+	// rewrites (e.g. a cosmetic normalization of the name, or dropping extended attributes) are
+	// performed still. Entries that other parsers read differently (see ReasonNameMismatch and
+	// ReasonLinknameMismatch) are rejected as well.
+	// This feature is not enabled by default, nor is it part of MaximumSecurityMode.
+	StrictMode SecurityMode = 256
+	// RequireSymlinksLast rejects archives whose extraction depends on the order of their entries:
+	// entries replacing a directory of earlier entries, entries written through a symbolic link
+	// and entries other than symbolic links following a symbolic link. Next fails with
+	// ErrOrderDependent on the first of them. Archives with the symbolic links at their end can be
+	// extracted safely in any order.
+	// This feature is not enabled by default, nor is it part of MaximumSecurityMode.
+	RequireSymlinksLast SecurityMode = 512
+	// SanitizeSymlinkTargets validates the targets of symbolic links, instead of relying on
+	// PreventSymlinkTraversal only: absolute targets and targets whose ".." path components escape
+	// the root of the archive are rewritten to stay within the root (see
+	// sanitizer.SanitizeLinkTarget), and are rejected in StrictMode. The targets are resolved
+	// against the links seen before: links escaping through them (e.g. "d/l2" to "l1/.." with
+	// "d/l1" to "..") are skipped, see safearchive.SymlinkSet.AddLink. Relative links between the
+	// entries of the archive are kept as they are.
+	// This feature is part of MaximumSecurityMode.
+	SanitizeSymlinkTargets SecurityMode = 1024
+	// SanitizeUnicode strips the characters used to disguise names in listings (control,
+	// bidirectional formatting and zero-width characters, see sanitizer.IsUnsafeRune) from the
+	// names and link targets of the entries, and rejects them in StrictMode.
+	// This feature is part of MaximumSecurityMode.
+	SanitizeUnicode SecurityMode = 2048
+	// DetectSymlinkLoops drops the symbolic links closing a loop (e.g. a -> b and b -> a) or a chain
+	// of more than safearchive.MaxSymlinkChain links, which make extractions fail with ELOOP.
+	// Links are resolved lexically within the archive, see safearchive.LinkChecker. Next fails
+	// with ErrSymlinkLoop on them in StrictMode.
+	// This feature is part of MaximumSecurityMode.
+	DetectSymlinkLoops SecurityMode = 4096
+	// ValidateNameEncoding checks that the names and link targets of the entries are valid UTF-8
+	// without NUL bytes, replacing the invalid bytes or rejecting the entries as set by the
+	// NameEncodingPolicy of the Reader (see SetNameEncodingPolicy), and rejects them in StrictMode.
+	// This feature is part of MaximumSecurityMode.
+	ValidateNameEncoding SecurityMode = 8192
 )
 
+var securityModeNames = []struct {
+	mode SecurityMode
+	name string
+}{
+	{SkipSpecialFiles, "SkipSpecialFiles"},
+	{SanitizeFileMode, "SanitizeFileMode"},
+	{SanitizeFilenames, "SanitizeFilenames"},
+	{DropXattrs, "DropXattrs"},
+	{PreventSymlinkTraversal, "PreventSymlinkTraversal"},
+	{PreventCaseInsensitiveSymlinkTraversal, "PreventCaseInsensitiveSymlinkTraversal"},
+	{SkipWindowsShortFilenames, "SkipWindowsShortFilenames"},
+	{StrictMode, "StrictMode"},
+	{RequireSymlinksLast, "RequireSymlinksLast"},
+	{SanitizeSymlinkTargets, "SanitizeSymlinkTargets"},
+	{SanitizeUnicode, "SanitizeUnicode"},
+	{DetectSymlinkLoops, "DetectSymlinkLoops"},
+	{ValidateNameEncoding, "ValidateNameEncoding"},
+}
+
+// options are the names of the configurable behaviors of the Reader, registered as features.
+var options = []string{
+	"MaxChildren",
+	"MaxEntries",
+	"MaxEntrySize",
+	"MaxTotalSize",
+	"MaxPAXRecords",
+	"MaxPAXSize",
+	"MaxLongName",
+	"Subtree",
+	"RetainRawHeaders",
+	"Rules",
+	"OnSanitize",
+	"Diagnostics",
+	"PAXAllowlist",
+	"XattrPolicy",
+	"DuplicatePolicy",
+	"CollisionPolicy",
+	"EntryFilter",
+	"IncludePatterns",
+	"ExcludePatterns",
+	"StripComponents",
+	"Prefix",
+	"NameEncodingPolicy",
+	"Tolerant",
+	"OnWhiteout",
+}
+
+func init() {
+	safearchive.RegisterFeatures(safearchive.Feature{Package: "tar", Kind: safearchive.FeatureFormat, Name: "tar"})
+	for _, m := range securityModeNames {
+		safearchive.RegisterFeatures(safearchive.Feature{Package: "tar", Kind: safearchive.FeatureRule, Name: m.name})
+	}
+	for _, o := range options {
+		safearchive.RegisterFeatures(safearchive.Feature{Package: "tar", Kind: safearchive.FeatureOption, Name: o})
+	}
+}
+
+// String returns the names of the enabled features separated by |.
+func (s SecurityMode) String() string {
+	var names []string
+	for _, m := range securityModeNames {
+		if s&m.mode != 0 {
+			names = append(names, m.name)
+			s &^= m.mode
+		}
+	}
+	if s != 0 {
+		names = append(names, fmt.Sprintf("%#x", int(s)))
+	}
+	if len(names) == 0 {
+		return "0"
+	}
+	return strings.Join(names, "|")
+}
+
 // MaximumSecurityMode enables all features for maximum security.
 // Recommended for integrations that need file contents only (and nothing unix specific).
-const MaximumSecurityMode = SkipSpecialFiles | SanitizeFileMode | SanitizeFilenames | PreventSymlinkTraversal | DropXattrs | PreventCaseInsensitiveSymlinkTraversal | SkipWindowsShortFilenames
+const MaximumSecurityMode = SkipSpecialFiles | SanitizeFileMode | SanitizeFilenames | PreventSymlinkTraversal | DropXattrs | PreventCaseInsensitiveSymlinkTraversal | SkipWindowsShortFilenames | SanitizeSymlinkTargets | SanitizeUnicode | DetectSymlinkLoops | ValidateNameEncoding
 
 var (
 	// ErrHeader invalid tar header
@@ -209,17 +350,32 @@ var (
 
 	// ErrWriteAfterClose write after close
 	ErrWriteAfterClose = tar.ErrWriteAfterClose
-)
 
-// Writer provides sequential writing of a tar archive.
-// Write.WriteHeader begins a new file with the provided Header,
-// and then Writer can be treated as an io.Writer to supply that file's data.
-type Writer = tar.Writer
+	// ErrLimitExceeded is wrapped by the errors of Next when the archive exceeds a limit of the
+	// Reader (see SetMaxEntrySize, SetMaxTotalSize and SetMaxEntries).
+	ErrLimitExceeded = safearchive.ErrLimitExceeded
 
-// NewWriter creates a new Writer writing to w.
-func NewWriter(w io.Writer) *tar.Writer {
-	return tar.NewWriter(w)
-}
+	// ErrMetadataLimit is wrapped by the errors of Next when the meta headers of an entry exceed a
+	// limit of the Reader (see SetMaxPAXRecords, SetMaxPAXSize and SetMaxLongName). It wraps
+	// ErrLimitExceeded.
+	ErrMetadataLimit = fmt.Errorf("%w: metadata", ErrLimitExceeded)
+)
+
+// Errors wrapped by the errors of Next rejecting an entry in StrictMode. All of them wrap
+// safearchive.ErrRejected.
+var (
+	ErrPathTraversal        = safearchive.ErrPathTraversal
+	ErrAbsolutePath         = safearchive.ErrAbsolutePath
+	ErrSymlinkTraversal     = safearchive.ErrSymlinkTraversal
+	ErrSpecialFile          = safearchive.ErrSpecialFile
+	ErrSpecialMode          = safearchive.ErrSpecialMode
+	ErrWindowsShortFilename = safearchive.ErrWindowsShortFilename
+	ErrFanOut               = safearchive.ErrFanOut
+	ErrOrderDependent       = safearchive.ErrOrderDependent
+	ErrSymlinkTarget        = safearchive.ErrSymlinkTarget
+	ErrSymlinkLoop          = safearchive.ErrSymlinkLoop
+	ErrInvalidEncoding      = safearchive.ErrInvalidEncoding
+)
 
 // FileInfoHeader creates a partially-populated Header from fi.
 // If fi describes a symlink, FileInfoHeader records link as the link target.
@@ -232,37 +388,100 @@ func FileInfoHeader(fi fs.FileInfo, link string) (*Header, error) {
 	return tar.FileInfoHeader(fi, link)
 }
 
+// EntryOf returns the format independent description of h.
+func EntryOf(h *Header) safearchive.Entry {
+	return safearchive.Entry{
+		Name:     h.Name,
+		Linkname: h.Linkname,
+		Size:     h.Size,
+		Mode:     h.FileInfo().Mode(),
+		ModTime:  h.ModTime,
+	}
+}
+
 // Reader provides sequential access to the contents of a tar archive.
 // Reader.Next advances to the next file in the archive (including the first),
 // and then Reader can be treated as an io.Reader to access the file's data.
 type Reader struct {
 	unsafeReader *tar.Reader
+	recorder     *headerRecorder
 
 	securityMode SecurityMode
-	symlinks     map[string]bool
+	symlinks     safearchive.SymlinkSet
+	targets      safearchive.SymlinkSet
+	links        safearchive.LinkChecker
+	retainRaw    bool
+	fanOut       safearchive.FanOutLimiter
+	order        safearchive.OrderChecker
+	duplicates   safearchive.DuplicateChecker
+	collisions   safearchive.DuplicateChecker
+	limits       limits
+	subtree      string
+	diagnostics  io.Writer
+	onSanitize   safearchive.SanitizeHook
+	paxAllowlist []string
+	xattrPolicy  XattrPolicy
+	filter       EntryFilter
+	patterns     safearchive.Patterns
+	strip        int
+	prefix       string
+	encoding     safearchive.NameEncodingPolicy
+	tolerant     bool
+	onWhiteout   WhiteoutHandler
+
+	// err is the sticky error of an exceeded limit.
+	err error
+
+	// next is the position of the headers of the next entry in the archive.
+	next int64
+	// offset, name and headers are the position, the original name and the header blocks of the
+	// current entry. blk is the final header block.
+	offset  int64
+	name    string
+	headers []byte
+	blk     []byte
+	raw     []byte
+	// selectName is the name of the current entry the subtree and the patterns select, see
+	// stripComponents.
+	selectName string
+
+	// rules are the custom rules applied after the built-in security features.
+	rules []rule
+
+	findings []safearchive.Finding
 }
 
 // NewReader creates a new Reader reading from r.
 func NewReader(r io.Reader) *Reader {
-	re := Reader{unsafeReader: tar.NewReader(r)}
+	rec := &headerRecorder{r: r}
+	re := &Reader{unsafeReader: tar.NewReader(rec), recorder: rec}
 	re.securityMode = DefaultSecurityMode
-	re.symlinks = make(map[string]bool)
-	return &re
+	rec.check = re.checkMetaHeader
+	return re
 }
 
+// leaveKeys returns the entries of in whose key is allow listed. Allow listed keys ending with "*"
+// match the keys they are a prefix of.
 func leaveKeys(in map[string]string, allowListedKeys ...string) map[string]string {
 	re := map[string]string{}
 	for inK, inV := range in {
-		for _, alK := range allowListedKeys {
-			if alK == inK {
-				re[inK] = inV
-				break
-			}
+		if keyAllowed(inK, allowListedKeys) {
+			re[inK] = inV
 		}
 	}
 	return re
 }
 
+// keyAllowed reports whether k is matched by one of the allow listed keys.
+func keyAllowed(k string, allowListedKeys []string) bool {
+	for _, alK := range allowListedKeys {
+		if p, ok := strings.CutSuffix(alK, "*"); ok && strings.HasPrefix(k, p) || alK == k {
+			return true
+		}
+	}
+	return false
+}
+
 // SetSecurityMode controls the security features applied when reading this tar archive
 func (tr *Reader) SetSecurityMode(s SecurityMode) {
 	tr.securityMode = s
@@ -273,72 +492,311 @@ func (tr *Reader) GetSecurityMode() SecurityMode {
 	return tr.securityMode
 }
 
+// AddRule adds a custom rule applied on the entries after the built-in sanitization and the rules
+// added before. The name, link name and mode changed by the rule are checked again, and the
+// entries are tracked (duplicates, symbolic links, ...) with their final names. Entries rejected
+// by a rule make Next fail with a safearchive.EntryError wrapping safearchive.ErrRejected.
+func (tr *Reader) AddRule(r safearchive.Rule) {
+	tr.rules = append(tr.rules, customRule{r})
+}
+
+// SetPAXAllowlist sets the PAX records kept by DropXattrs, replacing the default ("ctime", "mtime"
+// and "atime"). Keys ending with "*" allow every key they are a prefix of, e.g.
+// "SCHILY.xattr.user.*" keeps the extended attributes of the user namespace. Extended attributes
+// are only kept if allowed by their SCHILY.xattr record. A nil list restores the default.
+func (tr *Reader) SetPAXAllowlist(keys []string) {
+	tr.paxAllowlist = nil
+	if keys != nil {
+		tr.paxAllowlist = append([]string{}, keys...)
+	}
+}
+
+// paxKeys returns the PAX records kept by DropXattrs.
+func (tr *Reader) paxKeys() []string {
+	if tr.paxAllowlist == nil {
+		return allowListedPaxKeys
+	}
+	return tr.paxAllowlist
+}
+
+// SetMaxChildren limits the number of direct children of any directory of the archive. Entries
+// that would exceed the limit are skipped and reported. Zero (the default) means no limit.
+func (tr *Reader) SetMaxChildren(n int) {
+	tr.fanOut.Max = n
+}
+
+// SetDuplicatePolicy controls what happens to the entries whose (sanitized) name is already taken
+// by an earlier entry, which they would replace when extracted. The duplicates are reported in the
+// Report of the Reader. By default (safearchive.DuplicatesAllow) they are not looked for. As tar
+// archives are read sequentially, the earlier entries are never dropped: with
+// safearchive.DuplicatesKeepLast the duplicates are reported only.
+func (tr *Reader) SetDuplicatePolicy(p safearchive.DuplicatePolicy) {
+	tr.duplicates.Policy = p
+}
+
+// SetNameEncodingPolicy controls what ValidateNameEncoding does with the names and link targets
+// that are not valid UTF-8 or have NUL bytes. By default (safearchive.NameEncodingReplace) the
+// invalid bytes are replaced with U+FFFD.
+func (tr *Reader) SetNameEncodingPolicy(p safearchive.NameEncodingPolicy) {
+	tr.encoding = p
+}
+
+// SetCollisionPolicy controls what happens to the entries whose (sanitized) name differs from the
+// one of an earlier entry, but is the same on case-insensitive or normalization-insensitive file
+// systems (e.g. README and readme, or the NFC and NFD forms of a name), see sanitizer.FoldName.
+// Such entries overwrite each other when extracted on macOS or Windows. The collisions are reported
+// in the Report of the Reader. By default (safearchive.DuplicatesAllow) they are not looked for.
+func (tr *Reader) SetCollisionPolicy(p safearchive.DuplicatePolicy) {
+	tr.collisions = safearchive.DuplicateChecker{Policy: p, Fold: true}
+}
+
+// SetSubtree restricts the entries returned by Next to prefix and the entries below it, e.g.
+// "usr/lib". Both the prefix and the names of the entries are compared in their sanitized form (see
+// sanitizer.InSubtree), so renamed entries are matched by their new names. The data of the other entries
+// is skipped without being read, if the underlying reader is an io.Seeker. They are still checked
+// by the security features, so their findings (and rejections) are reported. An empty prefix
+// disables the filter.
+func (tr *Reader) SetSubtree(prefix string) {
+	tr.subtree = prefix
+}
+
+// OnSanitize sets a hook called with every finding about an entry at the moment it is made, before
+// the decision is applied, so applications can log, meter or veto the decisions of the security
+// features and rules. Vetoed decisions reject the archive instead: Next fails with a
+// safearchive.EntryError wrapping safearchive.ErrRejected.
+func (tr *Reader) OnSanitize(f func(ev safearchive.SanitizeEvent)) {
+	tr.onSanitize = f
+}
+
+// SetDiagnosticsWriter enables writing a diagnostic bundle (see safearchive.Bundle) to w as JSON
+// when Next fails, to aid bug reports about rejected archives. Errors writing the bundle are
+// ignored.
+func (tr *Reader) SetDiagnosticsWriter(w io.Writer) {
+	tr.diagnostics = w
+}
+
+// Diagnostics returns the diagnostic bundle of a failure caused by err, including the
+// configuration of the reader and its findings.
+func (tr *Reader) Diagnostics(err error) *safearchive.Bundle {
+	return safearchive.NewBundle(err, tr.Report(), map[string]string{
+		"format":           "tar",
+		"securityMode":     tr.securityMode.String(),
+		"maxChildren":      strconv.Itoa(tr.fanOut.Max),
+		"retainRawHeaders": strconv.FormatBool(tr.retainRaw),
+		"maxEntrySize":     strconv.FormatInt(tr.limits.maxEntrySize, 10),
+		"maxTotalSize":     strconv.FormatInt(tr.limits.maxTotalSize, 10),
+		"maxEntries":       strconv.Itoa(tr.limits.maxEntries),
+		"maxPAXRecords":    strconv.Itoa(tr.limits.maxPAXRecords),
+		"maxPAXSize":       strconv.FormatInt(tr.limits.maxPAXSize, 10),
+		"maxLongName":      strconv.Itoa(tr.limits.maxLongName),
+		"subtree":          tr.subtree,
+		"paxAllowlist":     strings.Join(tr.paxKeys(), ","),
+		"xattrPolicy":      tr.xattrPolicy.String(),
+		"duplicatePolicy":  strconv.Itoa(int(tr.duplicates.Policy)),
+		"collisionPolicy":  strconv.Itoa(int(tr.collisions.Policy)),
+		"entryFilter":      strconv.FormatBool(tr.filter != nil),
+		"includePatterns":  strings.Join(tr.patterns.Include, ","),
+		"excludePatterns":  strings.Join(tr.patterns.Exclude, ","),
+		"stripComponents":  strconv.Itoa(tr.strip),
+		"prefix":           tr.prefix,
+		"nameEncoding":     strconv.Itoa(int(tr.encoding)),
+		"tolerant":         strconv.FormatBool(tr.tolerant),
+		"whiteouts":        strconv.FormatBool(tr.onWhiteout != nil),
+		"offset":           strconv.FormatInt(tr.next, 10),
+	})
+}
+
+// SetRetainRawHeaders controls whether the raw header blocks of the entries flagged by a security
+// feature are retained in the findings of the Report, so they can be examined forensically.
+// The header blocks of an entry include the preceding PAX and GNU meta headers and their data.
+func (tr *Reader) SetRetainRawHeaders(retain bool) {
+	tr.retainRaw = retain
+}
+
+// Report returns the findings about the entries read so far: every entry that was renamed,
+// sanitized or dropped, along with the reason code of the security feature that flagged it.
+// Offsets are relative to the beginning of the (uncompressed) tar stream.
+func (tr *Reader) Report() *safearchive.Report {
+	return &safearchive.Report{Findings: append([]safearchive.Finding{}, tr.findings...)}
+}
+
+// flag records a finding about the current entry.
+func (tr *Reader) flag(v safearchive.Verdict) safearchive.Finding {
+	f := safearchive.Finding{Name: tr.name, Offset: tr.offset, Reason: v.Reason, Action: v.Action, Detail: v.Detail}
+	if tr.retainRaw {
+		if tr.raw == nil {
+			tr.raw = append([]byte{}, tr.headers...)
+		}
+		f.Raw = tr.raw
+	}
+	f = tr.onSanitize.Call(f)
+	tr.findings = append(tr.findings, f)
+	return f
+}
+
+// isXattrKey reports if the PAX record k is an extended attribute.
+func isXattrKey(k string) bool {
+	return strings.HasPrefix(k, "SCHILY.xattr.") || strings.HasPrefix(k, "LIBARCHIVE.xattr.")
+}
+
 // Next advances to the next entry in the tar archive.
 // The Header.Size determines how many bytes can be read for the next file.
 // Any remaining data in the current file is automatically discarded.
 //
-// io.EOF is returned at the end of the input.
+// io.EOF is returned at the end of the input. Other errors are *safearchive.EntryError values
+// telling which entry failed (e.g. wrapping ErrHeader, ErrLimitExceeded or a rejection of
+// StrictMode), so they can be matched with errors.Is and errors.As.
+// Once the archive exceeded a limit of the Reader, Next keeps returning the same error. In
+// tolerant mode (see SetTolerant), Next skips the headers that cannot be parsed instead.
 func (tr *Reader) Next() (*tar.Header, error) {
+	if tr.err != nil {
+		return nil, tr.err
+	}
 	for {
+		tr.recorder.startRecording(tr.next)
 		h, err := tr.unsafeReader.Next()
+		tr.headers = tr.recorder.stopRecording()
 		if err != nil {
-			return h, err
-		}
-
-		if tr.securityMode&SkipSpecialFiles != 0 {
-			// non-safe entries are skipped
-			if h.Typeflag != TypeReg && h.Typeflag != TypeDir && h.Typeflag != TypeSymlink {
+			if err == io.EOF {
+				return h, err
+			}
+			if tr.tolerant && errors.Is(err, ErrHeader) {
+				if err := tr.resync(); err != nil {
+					return nil, err
+				}
 				continue
 			}
+			if errors.Is(err, ErrMetadataLimit) {
+				// the error of checkMetaHeader, which flagged the entry already
+				tr.err = err
+			} else {
+				// the header of the entry could not be parsed, so only its position is known
+				err = &safearchive.EntryError{Offset: tr.next, Err: err}
+			}
+			if tr.diagnostics != nil {
+				tr.Diagnostics(err).WriteJSON(tr.diagnostics)
+			}
+			return h, err
 		}
-
-		if tr.securityMode&SanitizeFileMode != 0 {
-			// clearing out any potentially special bits (e.g. setuid)
-			h.Mode = h.Mode & 0777 // &^ s_ISUID &^ s_ISGID &^ s_ISVTX
-		}
-
-		if tr.securityMode&SanitizeFilenames != 0 {
-			// Sanitize h.Name
-			h.Name = sanitizer.SanitizePath(h.Name)
-		}
-
-		if tr.securityMode&SkipWindowsShortFilenames != 0 && sanitizer.HasWindowsShortFilenames(h.Name) {
-			continue
+		tr.offset, tr.raw, tr.name = tr.next, nil, h.Name
+		var n int64
+		tr.blk, n = parseHeaders(tr.headers, h)
+		tr.next += n
+
+		if err := tr.checkLimits(h); err != nil {
+			tr.err = err
+			if tr.diagnostics != nil {
+				tr.Diagnostics(err).WriteJSON(tr.diagnostics)
+			}
+			return nil, err
 		}
-
-		if tr.securityMode&PreventSymlinkTraversal != 0 {
-			hName := sanitizer.SanitizePath(h.Name)
-			hName = strings.TrimSuffix(hName, "/")
-			if tr.securityMode&PreventCaseInsensitiveSymlinkTraversal != 0 {
-				hName = strings.ToLower(hName)
+		start := len(tr.findings)
+		keep, err := tr.applyRules(h)
+		if err != nil {
+			if tr.diagnostics != nil {
+				tr.Diagnostics(err).WriteJSON(tr.diagnostics)
 			}
-
-			n := strings.Split(hName, "/")
-			traversal := false
-			for i := 1; i <= len(n); i++ {
-				subPath := strings.Join(n[0:i], "/")
-				if tr.symlinks[subPath] {
-					// a symlink has already been seen on this path. We need to drop this entry.
-					traversal = true
-					break
+			return nil, err
+		}
+		if keep {
+			if h.Name != tr.name {
+				for i := start; i < len(tr.findings); i++ {
+					tr.findings[i].NewName = h.Name
 				}
 			}
-			if traversal {
+			if !tr.selected() {
 				continue
 			}
-			if h.Linkname != "" {
-				tr.symlinks[hName] = true
+			if ok, err := tr.whiteout(h); ok || err != nil {
+				if err != nil {
+					if tr.diagnostics != nil {
+						tr.Diagnostics(err).WriteJSON(tr.diagnostics)
+					}
+					return nil, err
+				}
+				continue
+			}
+			keep, err := tr.applyFilter(h)
+			if err != nil {
+				if tr.diagnostics != nil {
+					tr.Diagnostics(err).WriteJSON(tr.diagnostics)
+				}
+				return nil, err
+			}
+			if !keep {
+				continue
 			}
+			return h, nil
+		}
+	}
+}
+
+// applyRules applies the built-in security features and the custom rules on h, until one of them
+// drops or rejects it. It reports whether the entry is to be kept. The fields changed by the
+// custom rules are checked again, and the entries are tracked (see trackingRules) with their
+// final names.
+func (tr *Reader) applyRules(h *Header) (bool, error) {
+	if keep, err := tr.applyStage(builtinRules, h); !keep || err != nil {
+		return keep, err
+	}
+	name, linkname, mode := h.Name, h.Linkname, h.Mode
+	if keep, err := tr.applyStage(tr.rules, h); !keep || err != nil {
+		return keep, err
+	}
+	if h.Name != name || h.Linkname != linkname || h.Mode != mode {
+		if keep, err := tr.applyStage(recheckRules, h); !keep || err != nil {
+			return keep, err
 		}
+	}
+	return tr.applyStage(trackingRules, h)
+}
 
-		if tr.securityMode&DropXattrs != 0 {
-			// Dropping extended attributes, if present
-			h.Xattrs = nil
-			h.PAXRecords = leaveKeys(h.PAXRecords, allowListedPaxKeys...)
+// applyStage applies rules on h, see applyRules.
+func (tr *Reader) applyStage(rules []rule, h *Header) (bool, error) {
+	for _, r := range rules {
+		v := r.apply(tr, h)
+		if v.Reason == "" {
+			if v.Action == safearchive.ActionDropped {
+				// skipped without a finding, see stripComponents
+				return false, nil
+			}
+			continue
+		}
+		if tr.securityMode&StrictMode != 0 {
+			v = v.Strict()
+		}
+		f := tr.flag(v)
+		switch f.Action {
+		case safearchive.ActionDropped:
+			return false, nil
+		case safearchive.ActionRejected:
+			return false, f.Err(safearchive.RejectionError(v.Reason))
 		}
+	}
+	return true, nil
+}
 
-		return h, err
+// NextContext is Next, failing with the error of ctx once it is done. The reads of the archive
+// check ctx, so skipping the data of the entries (e.g. of the ones dropped by the security
+// features) is cancelled as well. Like after any read error, the Reader is unusable once a call
+// was cancelled.
+func (tr *Reader) NextContext(ctx context.Context) (*tar.Header, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
+	tr.recorder.ctx = ctx
+	defer func() { tr.recorder.ctx = nil }()
+	return tr.Next()
+}
+
+// ReadContext is Read, failing with the error of ctx once it is done, see NextContext.
+func (tr *Reader) ReadContext(ctx context.Context, b []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	tr.recorder.ctx = ctx
+	defer func() { tr.recorder.ctx = nil }()
+	return tr.Read(b)
 }
 
 // Read reads from the current file in the tar archive.
@@ -351,6 +809,12 @@ func (tr *Reader) Next() (*tar.Header, error) {
 // Calling Read on special types like TypeLink, TypeSymlink, TypeChar,
 // TypeBlock, TypeDir, and TypeFifo returns (0, io.EOF) regardless of what
 // the Header.Size claims.
+//
+// Errors other than io.EOF are *safearchive.EntryError values about the current file.
 func (tr *Reader) Read(b []byte) (int, error) {
-	return tr.unsafeReader.Read(b)
+	n, err := tr.unsafeReader.Read(b)
+	if err != nil && err != io.EOF {
+		err = &safearchive.EntryError{Name: tr.name, Offset: tr.offset, Err: err}
+	}
+	return n, err
 }
@@ -17,20 +17,28 @@ package tar
 import (
 	"archive/tar"
 	"bytes"
-	_ "embed"
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
+	"path"
 	"reflect"
+	"sort"
 	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/corpus"
 )
 
 var (
 	// Archive containing files: readme.txt, /gopher.txt, and ../todo.txt
-	//go:embed traverse.tar
-	eTraverseTar []byte
+	eTraverseTar = corpus.Bytes("traverse.tar")
 
 	/*
 	   $ tar tvf traverse-via-links.tar
@@ -39,16 +47,14 @@ var (
 	   lrwxrwxrwx imrer/primarygroup 0 2023-03-08 09:46 linktoescape -> ../outside.txt
 	   -rw-rw-r-- imrer/primarygroup 6 2023-03-08 09:46 linktoescape
 	*/
-	//go:embed traverse-via-links.tar
-	eTraverseViaLinksTar []byte
+	eTraverseViaLinksTar = corpus.Bytes("traverse-via-links.tar")
 
 	/*
 		$ tar tvf traverse-slash-at-the-end.tar
 		lrwxrwxrwx imrer/primarygroup 0 2023-03-23 13:28 linktoroot/ -> /
 		-rw-r----- imrer/primarygroup 5 2023-03-23 13:28 linktoroot/root/.bashrc
 	*/
-	//go:embed traverse-slash-at-the-end.tar
-	eTraverseSlashAtTheEndTar []byte
+	eTraverseSlashAtTheEndTar = corpus.Bytes("traverse-slash-at-the-end.tar")
 
 	/*
 	   The input archive we are testing looks like this:
@@ -61,8 +67,7 @@ var (
 	   lrwxrwxrwx imrer/primarygroup 0 2023-03-08 13:41 symlink -> regular.txt
 	   hrw-r----- imrer/primarygroup 0 2023-03-08 13:38 hardlink link to regular.txt
 	*/
-	//go:embed specialfiles.tar
-	eSpecialFilesTar []byte
+	eSpecialFilesTar = corpus.Bytes("specialfiles.tar")
 
 	/*
 		The input archive we are testing looks like this:
@@ -72,8 +77,7 @@ var (
 		-rw-r----T imrer/primarygroup  9 2023-03-08 13:55 tmpstuff.txt
 		drwxr-x--- imrer/primarygroup  0 2023-03-09 08:23 somedir/
 	*/
-	//go:embed specialmodes.tar
-	eSpecialModesTar []byte
+	eSpecialModesTar = corpus.Bytes("specialmodes.tar")
 
 	/*
 	 archive normally containing:
@@ -84,15 +88,13 @@ var (
 	 PAXRecords:map[SCHILY.xattr.user.hello:world
 	 atime:1678289372.94598663 ctime:1678289392.687447969 mtime:1678289372.94598663] Format:PAX}:
 	*/
-	//go:embed xattr.tar
-	eXattrTar []byte
+	eXattrTar = corpus.Bytes("xattr.tar")
 
 	/*
 	   lrwxrwxrwx root/root         0 2024-10-10 11:17 tmp -> /
 	   -rw-r--r-- root/root         5 2024-10-10 11:17 Tmp/test-file
 	*/
-	//go:embed case-insensitive.tar
-	eTraverseViaCaseInsensitiveLinksTar []byte
+	eTraverseViaCaseInsensitiveLinksTar = corpus.Bytes("case-insensitive.tar")
 
 	/*
 		-rw-r----- imrer/primarygroup 5 2024-10-11 14:27 3D Objects
@@ -108,8 +110,7 @@ var (
 		-rw-r----- imrer/primarygroup 5 2024-10-11 14:27 FOOOOO~1.JPG
 		-rw-r----- imrer/primarygroup 5 2024-10-11 14:27 Some~Stuff
 	*/
-	//go:embed winshort.tar
-	eWinShortTar []byte
+	eWinShortTar = corpus.Bytes("winshort.tar")
 )
 
 func isSlashRune(r rune) bool { return r == '/' || r == '\\' }
@@ -124,6 +125,22 @@ func containsDotDot(v string) bool {
 	return false
 }
 
+// defaultMode returns DefaultSecurityMode, or the default mode of the regular profile in the
+// hardened profile (see safearchive.Hardened), so the tests about the default behavior hold there.
+func defaultMode() SecurityMode {
+	if safearchive.Hardened {
+		return SanitizeFilenames | PreventSymlinkTraversal
+	}
+	return DefaultSecurityMode
+}
+
+// newReader returns a Reader reading from r with defaultMode.
+func newReader(r io.Reader) *Reader {
+	tr := NewReader(r)
+	tr.SetSecurityMode(defaultMode())
+	return tr
+}
+
 // Based on example from: https://pkg.go.dev/archive/tar#pkg-overview
 func TestSafetar(t *testing.T) {
 	buf := bytes.NewBuffer(eTraverseTar[:])
@@ -151,7 +168,7 @@ func TestSafetarLinksDefaultMode(t *testing.T) {
 	buf := bytes.NewBuffer(eTraverseViaLinksTar[:])
 
 	// default settings with PreventSymlinkTraversal
-	tr := NewReader(buf)
+	tr := newReader(buf)
 	hdr, err := tr.Next()
 	if err != nil {
 		t.Fatal(err)
@@ -200,7 +217,7 @@ func TestSafetarLinksDefaultModeSlashAtTheEnd(t *testing.T) {
 	buf := bytes.NewBuffer(eTraverseSlashAtTheEndTar[:])
 
 	// default settings with PreventSymlinkTraversal
-	tr := NewReader(buf)
+	tr := newReader(buf)
 	hdr, err := tr.Next()
 	if err != nil {
 		t.Fatal(err)
@@ -230,7 +247,7 @@ func TestSafetarLinksWithoutSanitization(t *testing.T) {
 	buf := bytes.NewBuffer(eTraverseViaLinksTar[:])
 
 	// Open and iterate through the files in the archive.
-	tr := NewReader(buf)
+	tr := newReader(buf)
 	tr.SetSecurityMode(tr.GetSecurityMode() &^ PreventSymlinkTraversal)
 	hdr, err := tr.Next()
 	if err != nil {
@@ -488,7 +505,7 @@ func TestSafetarLinksCaseInsensitive(t *testing.T) {
 	buf := bytes.NewBuffer(eTraverseViaCaseInsensitiveLinksTar[:])
 
 	// default settings with PreventSymlinkTraversal
-	tr := NewReader(buf)
+	tr := newReader(buf)
 	tr.SetSecurityMode(tr.GetSecurityMode() | PreventCaseInsensitiveSymlinkTraversal)
 	hdr, err := tr.Next()
 	if err != nil {
@@ -535,3 +552,2220 @@ func TestWindowsShortFilenames(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestRepack(t *testing.T) {
+	tr := NewReader(bytes.NewReader(eSpecialModesTar))
+	tr.SetSecurityMode(tr.GetSecurityMode() | SanitizeFileMode)
+
+	var out bytes.Buffer
+	if err := Repack(&out, tr); err != nil {
+		t.Fatalf("Repack() error = %v", err)
+	}
+
+	// Reading the repacked archive without any security features must yield sanitized entries.
+	orig := tar.NewReader(bytes.NewReader(eSpecialModesTar))
+	repacked := tar.NewReader(&out)
+	for {
+		oh, oerr := orig.Next()
+		rh, rerr := repacked.Next()
+		if oerr == io.EOF && rerr == io.EOF {
+			break
+		}
+		if oerr != nil || rerr != nil {
+			t.Fatalf("Next() errors: original = %v, repacked = %v", oerr, rerr)
+		}
+		if rh.Name != oh.Name {
+			t.Errorf("repacked entry name = %q, want %q", rh.Name, oh.Name)
+		}
+		if rh.Mode != oh.Mode&0777 {
+			t.Errorf("repacked entry %q mode = %o, want %o", rh.Name, rh.Mode, oh.Mode&0777)
+		}
+		ob, _ := io.ReadAll(orig)
+		rb, _ := io.ReadAll(repacked)
+		if !bytes.Equal(ob, rb) {
+			t.Errorf("repacked entry %q content = %q, want %q", rh.Name, rb, ob)
+		}
+	}
+}
+
+func TestEntryOf(t *testing.T) {
+	tr := NewReader(bytes.NewReader(eSpecialModesTar))
+	tr.SetSecurityMode(tr.GetSecurityMode() | SanitizeFileMode)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := EntryOf(hdr)
+	if e.Name != "setuidstuff.txt" || e.Size != 12 || e.Mode != 0640 {
+		t.Errorf("EntryOf() = %+v, want setuidstuff.txt of 12 bytes with mode 0640", e)
+	}
+}
+
+func TestRetainRawHeaders(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	entries := []struct {
+		h       *tar.Header
+		content string
+	}{
+		{h: &tar.Header{Name: "a.txt", Typeflag: tar.TypeReg, Mode: 0644}, content: strings.Repeat("a", 700)},
+		{h: &tar.Header{Name: "../" + strings.Repeat("x", 200), Typeflag: tar.TypeReg, Mode: 0644, Format: tar.FormatPAX}, content: "hi"},
+		{h: &tar.Header{Name: "b.txt", Typeflag: tar.TypeReg, Mode: 0644}, content: strings.Repeat("b", 512)},
+		{h: &tar.Header{Name: "./" + strings.Repeat("y", 150), Typeflag: tar.TypeReg, Mode: 0644, Format: tar.FormatGNU}, content: "hello"},
+		{h: &tar.Header{Name: "/abs/", Typeflag: tar.TypeDir, Mode: 04755}},
+	}
+	type span struct{ start, end int }
+	var spans []span
+	for _, e := range entries {
+		start := (buf.Len() + 511) / 512 * 512
+		e.h.Size = int64(len(e.content))
+		if err := tw.WriteHeader(e.h); err != nil {
+			t.Fatalf("WriteHeader(%q) error = %v", e.h.Name, err)
+		}
+		spans = append(spans, span{start, buf.Len()})
+		if _, err := io.WriteString(tw, e.content); err != nil {
+			t.Fatalf("Write(%q) error = %v", e.h.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	archive := buf.Bytes()
+
+	want := []struct {
+		name   string
+		reason safearchive.Reason
+		span   span
+	}{
+		{entries[1].h.Name, safearchive.ReasonPathTraversal, spans[1]},
+		{entries[3].h.Name, safearchive.ReasonPathNormalized, spans[3]},
+		{entries[4].h.Name, safearchive.ReasonSpecialMode, spans[4]},
+		{entries[4].h.Name, safearchive.ReasonAbsolutePath, spans[4]},
+	}
+	for _, src := range []io.Reader{bytes.NewReader(archive), struct{ io.Reader }{bytes.NewReader(archive)}} {
+		tr := NewReader(src)
+		tr.SetSecurityMode(MaximumSecurityMode)
+		tr.SetRetainRawHeaders(true)
+		for {
+			_, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Next() error = %v", err)
+			}
+		}
+		got := tr.Report().Findings
+		if len(got) != len(want) {
+			t.Fatalf("Report() = %+v, want %d findings", got, len(want))
+		}
+		for i, w := range want {
+			g := got[i]
+			if g.Name != w.name || g.Reason != w.reason || g.Offset != int64(w.span.start) {
+				t.Errorf("finding %d = %q %q at %d, want %q %q at %d", i, g.Name, g.Reason, g.Offset, w.name, w.reason, w.span.start)
+			}
+			if !bytes.Equal(g.Raw, archive[w.span.start:w.span.end]) {
+				t.Errorf("finding %d raw headers = %q, want %q", i, g.Raw, archive[w.span.start:w.span.end])
+			}
+		}
+	}
+
+	// Raw headers are not retained by default.
+	tr := NewReader(bytes.NewReader(archive))
+	for {
+		if _, err := tr.Next(); err != nil {
+			break
+		}
+	}
+	for _, f := range tr.Report().Findings {
+		if f.Raw != nil {
+			t.Errorf("finding %q retained raw headers by default", f.Name)
+		}
+	}
+}
+
+// rawBlock returns a ustar header block.
+func rawBlock(name string, typeflag byte, linkname string, size int) []byte {
+	blk := make([]byte, 512)
+	copy(blk[0:], name)
+	copy(blk[100:], "0000644\x00")
+	copy(blk[124:], fmt.Sprintf("%011o\x00", size))
+	copy(blk[136:], "00000000000\x00")
+	blk[156] = typeflag
+	copy(blk[157:], linkname)
+	copy(blk[257:], "ustar\x0000")
+	copy(blk[148:], "        ")
+	sum := 0
+	for _, c := range blk {
+		sum += int(c)
+	}
+	copy(blk[148:], fmt.Sprintf("%06o\x00 ", sum))
+	return blk
+}
+
+func TestLinknameMismatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		ustar    string
+		linkpath string
+		want     bool
+	}{
+		{name: "disagree", ustar: "safe", linkpath: "/etc", want: true},
+		{name: "empty ustar field", ustar: "", linkpath: "/etc"},
+		{name: "same", ustar: "target", linkpath: "target"},
+		{name: "truncated", ustar: strings.Repeat("a", 100), linkpath: strings.Repeat("a", 150)},
+		{name: "non-ascii", ustar: "caf", linkpath: "café"},
+	}
+	for _, tc := range tests {
+		record := fmt.Sprintf("linkpath=%s\n", tc.linkpath)
+		n := len(record) + 1
+		for n != len(fmt.Sprintf("%d %s", n, record)) {
+			n++
+		}
+		record = fmt.Sprintf("%d %s", n, record)
+		var archive []byte
+		archive = append(archive, rawBlock("PaxHeaders/link", TypeXHeader, "", len(record))...)
+		data := make([]byte, 512)
+		copy(data, record)
+		archive = append(archive, data...)
+		archive = append(archive, rawBlock("link", TypeSymlink, tc.ustar, 0)...)
+		archive = append(archive, rawBlock("link/passwd", TypeReg, "", 0)...)
+		archive = append(archive, make([]byte, 1024)...)
+
+		tr := newReader(bytes.NewReader(archive))
+		var names []string
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: Next() error = %v", tc.name, err)
+			}
+			if h.Linkname != "" && h.Linkname != tc.linkpath {
+				t.Errorf("%s: Linkname = %q, want the linkpath record %q", tc.name, h.Linkname, tc.linkpath)
+			}
+			names = append(names, h.Name)
+		}
+		if !reflect.DeepEqual(names, []string{"link"}) {
+			t.Errorf("%s: entries = %q, want the entry through the link to be dropped", tc.name, names)
+		}
+		got := false
+		for _, f := range tr.Report().Findings {
+			if f.Reason == ReasonLinknameMismatch {
+				got = true
+			}
+		}
+		if got != tc.want {
+			t.Errorf("%s: linkname mismatch reported = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMaxChildren(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range []string{"dir/1", "dir/2", "dir/3", "other"} {
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644})
+	}
+	tw.Close()
+
+	tr := NewReader(&buf)
+	tr.SetMaxChildren(2)
+	var names []string
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		names = append(names, h.Name)
+	}
+	if want := []string{"dir/1", "dir/2", "other"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("entries = %q, want %q", names, want)
+	}
+	if f := tr.Report().Findings; len(f) != 1 || f[0].Name != "dir/3" || f[0].Reason != safearchive.ReasonFanOut {
+		t.Errorf("Report() = %+v, want dir/3 dropped because of fan-out", f)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	archive := func(sizes ...int64) []byte {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for i, size := range sizes {
+			tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("file%d", i), Typeflag: tar.TypeReg, Mode: 0644, Size: size})
+			if size < 1<<20 {
+				tw.Write(make([]byte, size))
+			}
+		}
+		tw.Close()
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name     string
+		archive  []byte
+		setup    func(tr *Reader)
+		wantRead int
+		wantErr  bool
+	}{
+		{
+			name:     "petabyte entry",
+			archive:  archive(10, 1<<50),
+			setup:    func(tr *Reader) { tr.SetMaxEntrySize(1 << 20) },
+			wantRead: 1,
+			wantErr:  true,
+		},
+		{
+			name:     "total size",
+			archive:  archive(600, 600, 600),
+			setup:    func(tr *Reader) { tr.SetMaxTotalSize(1500) },
+			wantRead: 2,
+			wantErr:  true,
+		},
+		{
+			name:     "entries",
+			archive:  archive(0, 0, 0, 0),
+			setup:    func(tr *Reader) { tr.SetMaxEntries(3) },
+			wantRead: 3,
+			wantErr:  true,
+		},
+		{
+			name:     "skipped entries count",
+			archive:  archive(0, 0, 0, 0),
+			setup:    func(tr *Reader) { tr.SetMaxEntries(3); tr.SetMaxChildren(1) },
+			wantRead: 1,
+			wantErr:  true,
+		},
+		{
+			name:     "within limits",
+			archive:  archive(10, 20, 30),
+			setup:    func(tr *Reader) { tr.SetMaxEntrySize(30); tr.SetMaxTotalSize(60); tr.SetMaxEntries(3) },
+			wantRead: 3,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := NewReader(bytes.NewReader(tc.archive))
+			tc.setup(tr)
+			read := 0
+			var err error
+			for {
+				if _, err = tr.Next(); err != nil {
+					break
+				}
+				read++
+			}
+			if read != tc.wantRead {
+				t.Errorf("Next() returned %d entries, want %d", read, tc.wantRead)
+			}
+			if !tc.wantErr {
+				if err != io.EOF {
+					t.Errorf("Next() error = %v, want io.EOF", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrLimitExceeded) {
+				t.Fatalf("Next() error = %v, want %v", err, ErrLimitExceeded)
+			}
+			var ee *safearchive.EntryError
+			if !errors.As(err, &ee) || ee.Reason != safearchive.ReasonLimitExceeded {
+				t.Errorf("Next() error = %#v, want an EntryError with reason %q", err, safearchive.ReasonLimitExceeded)
+			}
+			if _, again := tr.Next(); again != err {
+				t.Errorf("Next() after exceeding a limit error = %v, want %v", again, err)
+			}
+		})
+	}
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+func TestMetadataLimits(t *testing.T) {
+	comment := strings.Repeat("x", 100000)
+	for _, tc := range []struct {
+		name  string
+		h     *tar.Header
+		set   func(tr *Reader)
+		early bool
+	}{
+		{
+			name: "PAX records",
+			h:    &tar.Header{Name: "a.txt", Typeflag: tar.TypeReg, PAXRecords: map[string]string{"comment": "c", "SCHILY.xattr.a": "1", "SCHILY.xattr.b": "2"}},
+			set:  func(tr *Reader) { tr.SetMaxPAXRecords(2) },
+		},
+		{
+			name:  "PAX size",
+			h:     &tar.Header{Name: "a.txt", Typeflag: tar.TypeReg, PAXRecords: map[string]string{"comment": comment}},
+			set:   func(tr *Reader) { tr.SetMaxPAXSize(1000) },
+			early: true,
+		},
+		{
+			name:  "GNU long name",
+			h:     &tar.Header{Name: strings.Repeat("d", 100000) + "/a.txt", Typeflag: tar.TypeReg, Format: tar.FormatGNU},
+			set:   func(tr *Reader) { tr.SetMaxLongName(4096) },
+			early: true,
+		},
+		{
+			name:  "GNU long link",
+			h:     &tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: strings.Repeat("t", 100000), Format: tar.FormatGNU},
+			set:   func(tr *Reader) { tr.SetMaxLongName(4096) },
+			early: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			for _, h := range []*tar.Header{{Name: "first.txt", Typeflag: tar.TypeReg}, tc.h} {
+				if err := tw.WriteHeader(h); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tw.Close()
+
+			tr := NewReader(bytes.NewReader(buf.Bytes()))
+			for i := 0; i < 2; i++ {
+				if _, err := tr.Next(); err != nil {
+					t.Fatalf("Next() without limits error = %v", err)
+				}
+			}
+
+			cr := &countingReader{r: bytes.NewReader(buf.Bytes())}
+			tr = NewReader(cr)
+			tc.set(tr)
+			if _, err := tr.Next(); err != nil {
+				t.Fatalf("Next() error = %v", err)
+			}
+			_, err := tr.Next()
+			if !errors.Is(err, ErrMetadataLimit) || !errors.Is(err, ErrLimitExceeded) {
+				t.Fatalf("Next() error = %v, want %v", err, ErrMetadataLimit)
+			}
+			var ee *safearchive.EntryError
+			if !errors.As(err, &ee) || ee.Reason != safearchive.ReasonLimitExceeded || ee.Offset != blockSize {
+				t.Errorf("Next() error = %#v, want an EntryError at offset %d with reason %q", err, blockSize, safearchive.ReasonLimitExceeded)
+			}
+			if tc.early && cr.n > 8*blockSize {
+				t.Errorf("Next() read %d bytes of the archive, want the meta header not to be buffered", cr.n)
+			}
+			if _, again := tr.Next(); again != err {
+				t.Errorf("Next() after exceeding a limit error = %v, want %v", again, err)
+			}
+		})
+	}
+}
+
+func TestInvalidMetaHeaderSize(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: "a.txt", Typeflag: tar.TypeReg, PAXRecords: map[string]string{"comment": "c"}}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+	for _, size := range [][]byte{
+		// -1024 in base-256
+		{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfc, 0x00},
+		// overflowing an int64
+		{0x80, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		{0x80, 0x00, 0x00, 0x00, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	} {
+		archive := append([]byte{}, buf.Bytes()...)
+		copy(archive[124:136], size)
+		done := make(chan error)
+		go func() {
+			_, err := NewReader(bytes.NewReader(archive)).Next()
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if !errors.Is(err, ErrHeader) {
+				t.Errorf("Next() with the size % x error = %v, want %v", size, err, ErrHeader)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Next() with the size % x did not return", size)
+		}
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	archive := append([]byte{}, eTraverseTar...)
+	archive[148] ^= 0xff // corrupting the checksum of the first header
+
+	var diag bytes.Buffer
+	tr := NewReader(bytes.NewReader(archive))
+	tr.SetDiagnosticsWriter(&diag)
+	if _, err := tr.Next(); err == nil {
+		t.Fatalf("Next() of a corrupt archive succeeded")
+	}
+	for _, want := range []string{`"error":"entry at offset 0: archive/tar: invalid tar header"`, `"securityMode":"` + DefaultSecurityMode.String() + `"`} {
+		if !strings.Contains(diag.String(), want) {
+			t.Errorf("diagnostic bundle = %s, want it to contain %s", diag.String(), want)
+		}
+	}
+}
+
+func TestSecurityModeString(t *testing.T) {
+	if got, want := (SanitizeFilenames | DropXattrs | 8).String(), "SanitizeFilenames|DropXattrs|0x8"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	if got := SecurityMode(0).String(); got != "0" {
+		t.Errorf("String() = %q, want 0", got)
+	}
+}
+
+func TestCustomRules(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range []*tar.Header{
+		{Name: "a.txt", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: ".git/config", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "run.sh", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "huge.bin", Typeflag: tar.TypeReg, Mode: 0644, Size: 2048},
+		{Name: "never.txt", Typeflag: tar.TypeReg, Mode: 0644},
+	} {
+		tw.WriteHeader(h)
+		tw.Write(make([]byte, h.Size))
+	}
+	tw.Close()
+
+	var diag bytes.Buffer
+	tr := NewReader(&buf)
+	tr.SetDiagnosticsWriter(&diag)
+	tr.AddRule(safearchive.RuleFunc(func(e *safearchive.Entry) safearchive.Verdict {
+		if strings.HasPrefix(e.Name, ".git/") {
+			return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: "no-git"}
+		}
+		return safearchive.Pass
+	}))
+	tr.AddRule(safearchive.RuleFunc(func(e *safearchive.Entry) safearchive.Verdict {
+		if strings.HasSuffix(e.Name, ".sh") {
+			e.Name = "scripts/" + e.Name
+			e.Mode |= 0111
+			return safearchive.Verdict{Action: safearchive.ActionModified}
+		}
+		return safearchive.Pass
+	}))
+	tr.AddRule(safearchive.RuleFunc(func(e *safearchive.Entry) safearchive.Verdict {
+		if e.Size > 1024 {
+			return safearchive.Verdict{Action: safearchive.ActionRejected, Reason: "too-large"}
+		}
+		return safearchive.Pass
+	}))
+
+	var got []string
+	var err error
+	for {
+		var h *Header
+		h, err = tr.Next()
+		if err != nil {
+			break
+		}
+		got = append(got, fmt.Sprintf("%s %o", h.Name, h.Mode))
+	}
+	if want := []string{"a.txt 644", "scripts/run.sh 755"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %q, want %q", got, want)
+	}
+	var ee *safearchive.EntryError
+	if !errors.As(err, &ee) || !errors.Is(err, safearchive.ErrRejected) || ee.Name != "huge.bin" || ee.Reason != "too-large" {
+		t.Errorf("Next() error = %v, want huge.bin rejected", err)
+	}
+	if !strings.Contains(diag.String(), `"name":"huge.bin"`) {
+		t.Errorf("diagnostic bundle = %s, want the rejected entry", diag.String())
+	}
+
+	var reasons []safearchive.Reason
+	for _, f := range tr.Report().Findings {
+		reasons = append(reasons, f.Reason)
+	}
+	if want := []safearchive.Reason{"no-git", safearchive.ReasonCustomRule, "too-large"}; !reflect.DeepEqual(reasons, want) {
+		t.Errorf("Report() reasons = %q, want %q", reasons, want)
+	}
+}
+
+func TestCustomRulesChecked(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range []*tar.Header{
+		{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+		{Name: "up.txt", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "under.txt", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "a.txt", Typeflag: tar.TypeReg, Mode: 0644},
+	} {
+		tw.WriteHeader(h)
+	}
+	tw.Close()
+
+	tr := NewReader(&buf)
+	tr.SetSecurityMode(SanitizeFilenames | PreventSymlinkTraversal | SanitizeFileMode)
+	tr.AddRule(safearchive.RuleFunc(func(e *safearchive.Entry) safearchive.Verdict {
+		switch e.Name {
+		case "up.txt":
+			e.Name = "../../up.txt"
+		case "under.txt":
+			e.Name = "link/passwd"
+		case "a.txt":
+			e.Mode |= fs.ModeSetuid
+		default:
+			return safearchive.Pass
+		}
+		return safearchive.Verdict{Action: safearchive.ActionModified}
+	}))
+
+	var got []string
+	for {
+		h, err := tr.Next()
+		if err != nil {
+			if err != io.EOF {
+				t.Fatalf("Next() error = %v", err)
+			}
+			break
+		}
+		got = append(got, fmt.Sprintf("%s %o", h.Name, h.Mode))
+	}
+	if want := []string{"link 0", "up.txt 644", "a.txt 644"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %q, want %q", got, want)
+	}
+}
+
+func TestAnonymize(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	secret := "confidential contents"
+	headers := []*tar.Header{
+		{Name: "../evil.txt", Typeflag: tar.TypeReg, Mode: 04755, Size: int64(len(secret)), Uid: 1234, Uname: "secret-user", ModTime: time.Now(), PAXRecords: map[string]string{"SCHILY.xattr.user.secret": "secret-xattr", "comment": "secret-comment"}},
+		{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd", Gname: "secret-group"},
+	}
+	for _, h := range headers {
+		tw.WriteHeader(h)
+		tw.Write([]byte(secret)[:h.Size])
+	}
+	tw.Close()
+
+	for _, repl := range []safearchive.ContentReplacement{safearchive.ReplaceWithZeros, safearchive.ReplaceWithHash} {
+		var out bytes.Buffer
+		if err := Anonymize(bytes.NewReader(buf.Bytes()), &out, repl); err != nil {
+			t.Fatalf("Anonymize() error = %v", err)
+		}
+		if s := out.String(); strings.Contains(s, "secret") || strings.Contains(s, "confidential") {
+			t.Errorf("Anonymize(%d) output contains confidential data: %q", repl, s)
+		}
+
+		tr := tar.NewReader(&out)
+		for i, want := range headers {
+			h, err := tr.Next()
+			if err != nil {
+				t.Fatalf("Next() error = %v", err)
+			}
+			if h.Name != want.Name || h.Linkname != want.Linkname || h.Mode != want.Mode || h.Size != want.Size || h.Typeflag != want.Typeflag {
+				t.Errorf("entry %d = %+v, want the structure of %+v", i, h, want)
+			}
+			if h.Uid != 0 || h.Uname != "" || h.Gname != "" || len(h.PAXRecords) != 0 || !h.ModTime.Equal(safearchive.AnonymizedModTime) {
+				t.Errorf("entry %d = %+v, want scrubbed metadata", i, h)
+			}
+			b, _ := io.ReadAll(tr)
+			r, _ := safearchive.AnonymizedContent(strings.NewReader(secret[:want.Size]), want.Size, repl)
+			if wantContent, _ := io.ReadAll(r); !bytes.Equal(b, wantContent) {
+				t.Errorf("content of entry %d = %q, want %q", i, b, wantContent)
+			}
+		}
+		if _, err := tr.Next(); err != io.EOF {
+			t.Errorf("Next() at the end error = %v, want io.EOF", err)
+		}
+	}
+}
+
+func TestAnonymizeDeclaredSize(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "huge.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 1 << 40})
+	tw.Write([]byte("hello"))
+	// the archive ends after the data actually written
+	tw.Flush()
+
+	var out bytes.Buffer
+	if err := Anonymize(bytes.NewReader(buf.Bytes()), &out, safearchive.ReplaceWithZeros); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Anonymize() error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if out.Len() > 1<<20 {
+		t.Errorf("Anonymize() wrote %d bytes, want no more than the archive holds", out.Len())
+	}
+}
+
+func TestStrictMode(t *testing.T) {
+	tests := []struct {
+		name      string
+		archive   []byte
+		mode      SecurityMode
+		wantRead  []string
+		wantErr   error
+		wantEntry string
+	}{
+		{
+			name:      "absolute path",
+			archive:   eTraverseTar,
+			mode:      defaultMode() | StrictMode,
+			wantRead:  []string{"readme.txt"},
+			wantErr:   ErrAbsolutePath,
+			wantEntry: "/gopher.txt",
+		},
+		{
+			name:      "symlink traversal",
+			archive:   eTraverseViaLinksTar,
+			mode:      defaultMode() | StrictMode,
+			wantRead:  []string{"linktoroot"},
+			wantErr:   ErrSymlinkTraversal,
+			wantEntry: "linktoroot/root/.bashrc",
+		},
+		{
+			name:      "special file",
+			archive:   eSpecialFilesTar,
+			mode:      SkipSpecialFiles | StrictMode,
+			wantErr:   ErrSpecialFile,
+			wantEntry: "fifo",
+		},
+		{
+			name:      "special mode",
+			archive:   eSpecialModesTar,
+			mode:      SanitizeFileMode | StrictMode,
+			wantErr:   ErrSpecialMode,
+			wantEntry: "setuidstuff.txt",
+		},
+		{
+			name:     "informational rewrites",
+			archive:  eXattrTar,
+			mode:     MaximumSecurityMode | StrictMode,
+			wantRead: []string{"something.txt"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := NewReader(bytes.NewReader(tc.archive))
+			tr.SetSecurityMode(tc.mode)
+			var read []string
+			var err error
+			for {
+				var h *Header
+				if h, err = tr.Next(); err != nil {
+					break
+				}
+				read = append(read, h.Name)
+			}
+			if !reflect.DeepEqual(read, tc.wantRead) {
+				t.Errorf("Next() returned %q, want %q", read, tc.wantRead)
+			}
+			if tc.wantErr == nil {
+				if err != io.EOF {
+					t.Errorf("Next() error = %v, want io.EOF", err)
+				}
+				return
+			}
+			if !errors.Is(err, tc.wantErr) || !errors.Is(err, safearchive.ErrRejected) {
+				t.Errorf("Next() error = %v, want %v", err, tc.wantErr)
+			}
+			var ee *safearchive.EntryError
+			if !errors.As(err, &ee) || ee.Name != tc.wantEntry {
+				t.Errorf("Next() error = %v, want an EntryError about %s", err, tc.wantEntry)
+			}
+		})
+	}
+}
+
+func TestReport(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range []*tar.Header{
+		{Name: "../a.txt", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "/b.txt", Typeflag: tar.TypeReg, Mode: 04755},
+		{Name: "fifo", Typeflag: tar.TypeFifo, Mode: 0644},
+		{Name: "c.txt", Typeflag: tar.TypeReg, Mode: 0644},
+	} {
+		tw.WriteHeader(h)
+	}
+	tw.Close()
+
+	tr := NewReader(&buf)
+	tr.SetSecurityMode(MaximumSecurityMode)
+	for {
+		if _, err := tr.Next(); err != nil {
+			break
+		}
+	}
+	type finding struct {
+		Name, NewName string
+		Reason        safearchive.Reason
+		Action        safearchive.Action
+		Detail        string
+	}
+	var got []finding
+	for _, f := range tr.Report().Findings {
+		got = append(got, finding{f.Name, f.NewName, f.Reason, f.Action, f.Detail})
+	}
+	want := []finding{
+		{"../a.txt", "a.txt", safearchive.ReasonPathTraversal, safearchive.ActionModified, ""},
+		{"/b.txt", "b.txt", safearchive.ReasonSpecialMode, safearchive.ActionModified, "mode 04755 changed to 0755"},
+		{"/b.txt", "b.txt", safearchive.ReasonAbsolutePath, safearchive.ActionModified, ""},
+		{"fifo", "", safearchive.ReasonSpecialFile, safearchive.ActionDropped, ""},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Report() unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestSubtree(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range []struct{ name, content string }{
+		{"usr/", ""},
+		{"usr/lib/", ""},
+		{"usr/lib/a.so", "a"},
+		{"usr/lib64/b.so", "b"},
+		{"../usr/lib/c.so", "c"},
+		{"/usr/lib/d.so", "d"},
+		{"etc/passwd", "root"},
+		{"usr/libexec/e", "e"},
+	} {
+		typ := byte(tar.TypeReg)
+		if strings.HasSuffix(e.name, "/") {
+			typ = tar.TypeDir
+		}
+		tw.WriteHeader(&tar.Header{Name: e.name, Typeflag: typ, Mode: 0644, Size: int64(len(e.content))})
+		tw.Write([]byte(e.content))
+	}
+	tw.Close()
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"usr/lib", []string{"usr/lib/", "usr/lib/a.so:a", "usr/lib/c.so:c", "usr/lib/d.so:d"}},
+		{"/usr/lib/", []string{"usr/lib/", "usr/lib/a.so:a", "usr/lib/c.so:c", "usr/lib/d.so:d"}},
+		{"etc", []string{"etc/passwd:root"}},
+		{"var", nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.prefix, func(t *testing.T) {
+			tr := NewReader(bytes.NewReader(buf.Bytes()))
+			tr.SetSubtree(tc.prefix)
+			var got []string
+			for {
+				h, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Next() error = %v", err)
+				}
+				if h.Typeflag == tar.TypeDir {
+					got = append(got, h.Name)
+					continue
+				}
+				b, err := io.ReadAll(tr)
+				if err != nil {
+					t.Fatalf("Read() error = %v", err)
+				}
+				got = append(got, h.Name+":"+string(b))
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Next() returned %q, want %q", got, tc.want)
+			}
+			// Entries outside of the subtree are still checked by the security features.
+			if n := len(tr.Report().Findings); n != 2 {
+				t.Errorf("Report() has %d findings, want 2", n)
+			}
+		})
+	}
+}
+
+func TestOnSanitize(t *testing.T) {
+	tr := NewReader(bytes.NewReader(eTraverseTar))
+	var events []string
+	tr.OnSanitize(func(ev safearchive.SanitizeEvent) {
+		events = append(events, ev.Finding.Name+" "+string(ev.Finding.Reason))
+	})
+	for {
+		if _, err := tr.Next(); err != nil {
+			break
+		}
+	}
+	if want := []string{"/gopher.txt absolute-path", "../todo.txt path-traversal"}; !reflect.DeepEqual(events, want) {
+		t.Errorf("OnSanitize() events = %q, want %q", events, want)
+	}
+
+	tr = NewReader(bytes.NewReader(eTraverseTar))
+	tr.OnSanitize(func(ev safearchive.SanitizeEvent) {
+		if ev.Finding.Reason == safearchive.ReasonPathTraversal {
+			ev.Veto()
+		}
+	})
+	var read []string
+	var err error
+	for {
+		var h *Header
+		if h, err = tr.Next(); err != nil {
+			break
+		}
+		read = append(read, h.Name)
+	}
+	if want := []string{"readme.txt", "gopher.txt"}; !reflect.DeepEqual(read, want) {
+		t.Errorf("Next() returned %q, want %q", read, want)
+	}
+	if !errors.Is(err, ErrPathTraversal) {
+		t.Errorf("Next() error = %v, want %v", err, ErrPathTraversal)
+	}
+	findings := tr.Report().Findings
+	if f := findings[len(findings)-1]; f.Action != safearchive.ActionRejected {
+		t.Errorf("vetoed finding = %+v, want ActionRejected", f)
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	required := []safearchive.Feature{
+		{Package: "tar", Kind: safearchive.FeatureFormat, Name: "tar"},
+		{Package: "tar", Kind: safearchive.FeatureRule, Name: "StrictMode"},
+		{Package: "tar", Kind: safearchive.FeatureOption, Name: "Subtree"},
+	}
+	if err := safearchive.RequireFeatures(required...); err != nil {
+		t.Errorf("RequireFeatures() error = %v", err)
+	}
+}
+
+// withChecksum fixes the checksum of a raw header block.
+func withChecksum(blk []byte) []byte {
+	copy(blk[148:], "        ")
+	sum := 0
+	for _, c := range blk {
+		sum += int(c)
+	}
+	copy(blk[148:], fmt.Sprintf("%06o\x00 ", sum))
+	return blk
+}
+
+// metaEntry returns a PAX or GNU meta header of the following entry, with data.
+func metaEntry(typeflag byte, data string) []byte {
+	re := rawBlock("meta", typeflag, "", len(data))
+	blk := make([]byte, roundUp(int64(len(data))))
+	copy(blk, data)
+	return append(re, blk...)
+}
+
+func paxRecord(k, v string) string {
+	record := fmt.Sprintf("%s=%s\n", k, v)
+	n := len(record) + 1
+	for n != len(fmt.Sprintf("%d %s", n, record)) {
+		n++
+	}
+	return fmt.Sprintf("%d %s", n, record)
+}
+
+func TestNameMismatch(t *testing.T) {
+	long := strings.Repeat("d/", 60) + "file.txt"
+	writerArchive := func(name string) []byte {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Format: tar.FormatPAX})
+		tw.Close()
+		return buf.Bytes()
+	}
+	v7 := rawBlock("file.txt", TypeReg, "", 0)
+	copy(v7[257:265], make([]byte, 8))
+	copy(v7[345:], "../..")
+	withChecksum(v7)
+	ustarPrefix := rawBlock("file.txt", TypeReg, "", 0)
+	copy(ustarPrefix[345:], "dir")
+	withChecksum(ustarPrefix)
+
+	tests := []struct {
+		name     string
+		archive  []byte
+		wantName string
+		want     bool
+	}{
+		{
+			name:     "pax path disagrees",
+			archive:  append(metaEntry(TypeXHeader, paxRecord("path", "../../etc/passwd")), rawBlock("safe.txt", TypeReg, "", 0)...),
+			wantName: "etc/passwd",
+			want:     true,
+		},
+		{
+			name:     "gnu long name disagrees",
+			archive:  append(metaEntry(TypeGNULongName, "evil.sh\x00"), rawBlock("safe.txt", TypeReg, "", 0)...),
+			wantName: "evil.sh",
+			want:     true,
+		},
+		{
+			name:     "v7 header with prefix",
+			archive:  v7,
+			wantName: "file.txt",
+			want:     true,
+		},
+		{
+			name:     "ustar prefix",
+			archive:  ustarPrefix,
+			wantName: "dir/file.txt",
+		},
+		{
+			name:     "long name",
+			archive:  writerArchive(long),
+			wantName: long,
+		},
+		{
+			name:     "long name without separators",
+			archive:  writerArchive(strings.Repeat("a", 150)),
+			wantName: strings.Repeat("a", 150),
+		},
+		{
+			name:     "pax path extends the name",
+			archive:  append(metaEntry(TypeXHeader, paxRecord("path", "bin/sh.txt")), rawBlock("bin/sh", TypeReg, "", 0)...),
+			wantName: "bin/sh.txt",
+			want:     true,
+		},
+		{
+			name:     "non-ascii long name",
+			archive:  writerArchive(strings.Repeat("é", 10) + long),
+			wantName: strings.Repeat("é", 10) + long,
+		},
+		{
+			name:     "non-ascii name",
+			archive:  writerArchive("café.txt"),
+			wantName: "café.txt",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			archive := append(append([]byte{}, tc.archive...), make([]byte, 1024)...)
+			tr := NewReader(bytes.NewReader(archive))
+			h, err := tr.Next()
+			if err != nil {
+				t.Fatalf("Next() error = %v", err)
+			}
+			if h.Name != tc.wantName {
+				t.Errorf("Name = %q, want %q", h.Name, tc.wantName)
+			}
+			got := false
+			for _, f := range tr.Report().Findings {
+				if f.Reason == ReasonNameMismatch {
+					got = true
+				}
+			}
+			if got != tc.want {
+				t.Errorf("name mismatch reported = %v, want %v", got, tc.want)
+			}
+
+			tr = NewReader(bytes.NewReader(archive))
+			tr.SetSecurityMode(tr.GetSecurityMode() | StrictMode)
+			_, err = tr.Next()
+			var ee *safearchive.EntryError
+			if rejected := errors.As(err, &ee) && ee.Reason == ReasonNameMismatch && errors.Is(err, safearchive.ErrRejected); rejected != tc.want {
+				t.Errorf("Next() in StrictMode error = %v, want rejection %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestWriter(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    SecurityMode
+		headers []*Header
+		want    []*Header
+		wantErr error
+	}{
+		{
+			name: "names",
+			mode: SanitizeFilenames,
+			headers: []*Header{
+				{Name: "/abs.txt", Typeflag: TypeReg, Mode: 0644},
+				{Name: "../up.txt", Typeflag: TypeReg, Mode: 0644},
+				{Name: "dir/../../link", Typeflag: TypeLink, Linkname: "/etc/passwd"},
+			},
+			want: []*Header{
+				{Name: "abs.txt", Typeflag: TypeReg, Mode: 0644},
+				{Name: "up.txt", Typeflag: TypeReg, Mode: 0644},
+				{Name: "link", Typeflag: TypeLink, Linkname: "etc/passwd"},
+			},
+		},
+		{
+			name:    "setuid",
+			mode:    SanitizeFileMode,
+			headers: []*Header{{Name: "su", Typeflag: TypeReg, Mode: 04755}},
+			want:    []*Header{{Name: "su", Typeflag: TypeReg, Mode: 0755}},
+		},
+		{
+			name:    "xattrs",
+			mode:    DropXattrs,
+			headers: []*Header{{Name: "x", Typeflag: TypeReg, Mode: 0644, PAXRecords: map[string]string{"SCHILY.xattr.user.foo": "bar"}, Format: FormatPAX}},
+			want:    []*Header{{Name: "x", Typeflag: TypeReg, Mode: 0644}},
+		},
+		{
+			name:    "special file",
+			mode:    SkipSpecialFiles,
+			headers: []*Header{{Name: "fifo", Typeflag: TypeFifo, Mode: 0644}},
+			wantErr: ErrSpecialFile,
+		},
+		{
+			name: "symlink traversal",
+			mode: defaultMode(),
+			headers: []*Header{
+				{Name: "root", Typeflag: TypeSymlink, Linkname: "/", Mode: 0777},
+				{Name: "root/etc/passwd", Typeflag: TypeReg, Mode: 0644},
+			},
+			want:    []*Header{{Name: "root", Typeflag: TypeSymlink, Linkname: "/", Mode: 0777}},
+			wantErr: ErrSymlinkTraversal,
+		},
+		{
+			name:    "strict",
+			mode:    defaultMode() | StrictMode,
+			headers: []*Header{{Name: "../up.txt", Typeflag: TypeReg, Mode: 0644}},
+			wantErr: ErrPathTraversal,
+		},
+		{
+			name:    "no security",
+			mode:    0,
+			headers: []*Header{{Name: "../up.txt", Typeflag: TypeReg, Mode: 04644}},
+			want:    []*Header{{Name: "../up.txt", Typeflag: TypeReg, Mode: 04644}},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tw := NewWriter(&buf)
+			tw.SetSecurityMode(tc.mode)
+			var err error
+			for _, h := range tc.headers {
+				orig := *h
+				if err = tw.WriteHeader(h); err != nil {
+					break
+				}
+				if !reflect.DeepEqual(*h, orig) {
+					t.Errorf("WriteHeader() modified its argument to %+v", h)
+				}
+			}
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("WriteHeader() error = %v, want %v", err, tc.wantErr)
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			var got []*Header
+			tr := tar.NewReader(&buf)
+			for {
+				h, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Next() error = %v", err)
+				}
+				got = append(got, &Header{Name: h.Name, Typeflag: h.Typeflag, Linkname: h.Linkname, Mode: h.Mode, PAXRecords: leaveKeys(h.PAXRecords, "SCHILY.xattr.user.foo")})
+			}
+			for _, h := range tc.want {
+				h.PAXRecords = map[string]string{}
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("written headers differ (-want +got):\n%s", diff)
+			}
+			if tc.mode != 0 && len(tw.Report().Findings) == 0 {
+				t.Errorf("Report() is empty")
+			}
+		})
+	}
+}
+
+func TestRequireSymlinksLast(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []*tar.Header
+		wantErr error
+	}{
+		{
+			name: "symlinks last",
+			headers: []*tar.Header{
+				{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0644},
+				{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "dir/file"},
+			},
+		},
+		{
+			name: "content after symlink",
+			headers: []*tar.Header{
+				{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "dir"},
+				{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0644},
+			},
+			wantErr: ErrOrderDependent,
+		},
+		{
+			name: "directory replaced",
+			headers: []*tar.Header{
+				{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0644},
+				{Name: "dir", Typeflag: tar.TypeReg, Mode: 0644},
+			},
+			wantErr: ErrOrderDependent,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			for _, h := range tc.headers {
+				if err := tw.WriteHeader(h); err != nil {
+					t.Fatalf("WriteHeader(%q) error = %v", h.Name, err)
+				}
+			}
+			tw.Close()
+
+			tr := NewReader(&buf)
+			tr.SetSecurityMode(SanitizeFilenames | RequireSymlinksLast)
+			var err error
+			for err == nil {
+				_, err = tr.Next()
+			}
+			if err == io.EOF {
+				err = nil
+			}
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("Next() error = %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	// Archive containing files: readme.txt, /gopher.txt, and ../todo.txt
+	var out bytes.Buffer
+	if err := Sanitize(&out, bytes.NewReader(eTraverseTar), DefaultSecurityMode); err != nil {
+		t.Fatalf("Sanitize() error = %v", err)
+	}
+
+	contents := map[string]string{}
+	orig := tar.NewReader(bytes.NewReader(eTraverseTar))
+	for {
+		h, err := orig.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		b, _ := io.ReadAll(orig)
+		contents[strings.TrimLeft(h.Name, "./")] = string(b)
+	}
+
+	var names []string
+	sanitized := tar.NewReader(&out)
+	for {
+		h, err := sanitized.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		names = append(names, h.Name)
+		if b, _ := io.ReadAll(sanitized); string(b) != contents[h.Name] {
+			t.Errorf("sanitized entry %q content = %q, want %q", h.Name, b, contents[h.Name])
+		}
+	}
+	if want := []string{"readme.txt", "gopher.txt", "todo.txt"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("sanitized entries = %q, want %q", names, want)
+	}
+
+	if err := Sanitize(io.Discard, bytes.NewReader(eTraverseTar), DefaultSecurityMode|StrictMode); !errors.Is(err, safearchive.ErrRejected) {
+		t.Errorf("Sanitize() in StrictMode error = %v, want %v", err, safearchive.ErrRejected)
+	}
+}
+
+func TestSanitizeSymlinkTargets(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range []*tar.Header{
+		{Name: "a/inner", Typeflag: tar.TypeSymlink, Linkname: "../b"},
+		{Name: "a/abs", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"},
+		{Name: "up", Typeflag: tar.TypeSymlink, Linkname: "../../x"},
+		// escaping through d/l1
+		{Name: "d/l1", Typeflag: tar.TypeSymlink, Linkname: ".."},
+		{Name: "d/l2", Typeflag: tar.TypeSymlink, Linkname: "l1/.."},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf("WriteHeader(%q) error = %v", h.Name, err)
+		}
+	}
+	tw.Close()
+
+	tr := NewReader(bytes.NewReader(buf.Bytes()))
+	tr.SetSecurityMode(DefaultSecurityMode | SanitizeSymlinkTargets)
+	var got []string
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		got = append(got, h.Name+"->"+h.Linkname)
+	}
+	if want := []string{"a/inner->../b", "a/abs->../etc/passwd", "up->x", "d/l1->.."}; !reflect.DeepEqual(got, want) {
+		t.Errorf("links = %q, want %q", got, want)
+	}
+	if n := len(tr.Report().Findings); n != 3 {
+		t.Errorf("Report() has %d findings, want 3", n)
+	}
+
+	tr = NewReader(bytes.NewReader(buf.Bytes()))
+	tr.SetSecurityMode(DefaultSecurityMode | SanitizeSymlinkTargets | StrictMode)
+	var err error
+	for err == nil {
+		_, err = tr.Next()
+	}
+	if !errors.Is(err, ErrSymlinkTarget) {
+		t.Errorf("Next() in StrictMode error = %v, want %v", err, ErrSymlinkTarget)
+	}
+}
+
+func TestDetectSymlinkLoops(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range []*tar.Header{
+		{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "b"},
+		{Name: "b", Typeflag: tar.TypeSymlink, Linkname: "a"},
+		{Name: "c", Typeflag: tar.TypeSymlink, Linkname: "a"},
+		{Name: "d", Typeflag: tar.TypeSymlink, Linkname: "dir/e"},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatalf("WriteHeader(%q) error = %v", h.Name, err)
+		}
+	}
+	tw.Close()
+
+	tr := NewReader(bytes.NewReader(buf.Bytes()))
+	tr.SetSecurityMode(DefaultSecurityMode | DetectSymlinkLoops)
+	var got []string
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		got = append(got, h.Name)
+	}
+	if want := []string{"a", "c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("links = %q, want %q", got, want)
+	}
+
+	tr = NewReader(bytes.NewReader(buf.Bytes()))
+	tr.SetSecurityMode(DefaultSecurityMode | DetectSymlinkLoops | StrictMode)
+	var err error
+	for err == nil {
+		_, err = tr.Next()
+	}
+	if !errors.Is(err, ErrSymlinkLoop) {
+		t.Errorf("Next() in StrictMode error = %v, want %v", err, ErrSymlinkLoop)
+	}
+}
+
+func TestPAXAllowlist(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	records := map[string]string{
+		"SCHILY.xattr.user.foo":            "bar",
+		"SCHILY.xattr.security.capability": "cap",
+		"comment":                          "hi",
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "x", Typeflag: tar.TypeReg, Mode: 0644, PAXRecords: records, Format: tar.FormatPAX}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+
+	tests := []struct {
+		name      string
+		allowlist []string
+		want      []string
+		findings  int
+	}{
+		{name: "default", allowlist: nil, want: nil, findings: 1},
+		{name: "prefix", allowlist: []string{"SCHILY.xattr.user.*", "comment"}, want: []string{"SCHILY.xattr.user.foo", "comment"}, findings: 1},
+		{name: "all xattrs", allowlist: []string{"SCHILY.xattr.*"}, want: []string{"SCHILY.xattr.security.capability", "SCHILY.xattr.user.foo"}, findings: 0},
+		{name: "empty", allowlist: []string{}, want: nil, findings: 1},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := NewReader(bytes.NewReader(buf.Bytes()))
+			tr.SetSecurityMode(tr.GetSecurityMode() | DropXattrs)
+			tr.SetPAXAllowlist(tc.allowlist)
+			h, err := tr.Next()
+			if err != nil {
+				t.Fatalf("Next() error = %v", err)
+			}
+			var got []string
+			for k := range h.PAXRecords {
+				got = append(got, k)
+			}
+			sort.Strings(got)
+			sort.Strings(tc.want)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("PAXRecords keys = %q, want %q", got, tc.want)
+			}
+			if _, ok := h.Xattrs["security.capability"]; ok != contains(got, "SCHILY.xattr.security.capability") {
+				t.Errorf("Xattrs = %v disagrees with PAXRecords %v", h.Xattrs, h.PAXRecords)
+			}
+			if n := len(tr.Report().Findings); n != tc.findings {
+				t.Errorf("Report() has %d findings, want %d", n, tc.findings)
+			}
+		})
+	}
+}
+
+func TestXattrPolicy(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	records := map[string]string{
+		"SCHILY.xattr.user.mime_type":              "text/plain",
+		"SCHILY.xattr.security.capability":         "cap",
+		"SCHILY.xattr.trusted.overlay":             "y",
+		"LIBARCHIVE.xattr.user.comment":            "aGk=",
+		"LIBARCHIVE.xattr.system.posix_acl_access": "acl",
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "x", Typeflag: tar.TypeReg, Mode: 0644, PAXRecords: records, Format: tar.FormatPAX}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+
+	tr := NewReader(bytes.NewReader(buf.Bytes()))
+	tr.SetSecurityMode(tr.GetSecurityMode() | DropXattrs)
+	tr.SetXattrPolicy(KeepUserXattrs)
+	h, err := tr.Next()
+	if err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	want := map[string]string{"SCHILY.xattr.user.mime_type": "text/plain", "LIBARCHIVE.xattr.user.comment": "aGk="}
+	if !reflect.DeepEqual(h.PAXRecords, want) {
+		t.Errorf("PAXRecords = %v, want %v", h.PAXRecords, want)
+	}
+	if want := map[string]string{"user.mime_type": "text/plain"}; !reflect.DeepEqual(h.Xattrs, want) {
+		t.Errorf("Xattrs = %v, want %v", h.Xattrs, want)
+	}
+	if f := tr.Report().Findings; len(f) != 1 || f[0].Reason != safearchive.ReasonXattrs {
+		t.Errorf("Report() = %+v, want an xattrs finding", f)
+	}
+}
+
+func TestFS(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range []struct {
+		h    tar.Header
+		data string
+	}{
+		{tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		{tar.Header{Name: "dir/a.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 5}, "hello"},
+		{tar.Header{Name: "../escape.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 3, PAXRecords: map[string]string{"comment": "c"}}, "bad"},
+		{tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}, ""},
+		{tar.Header{Name: "hard", Typeflag: tar.TypeLink, Linkname: "dir/a.txt"}, ""},
+		{tar.Header{Name: "b/c/d.txt", Typeflag: tar.TypeReg, Mode: 0600, Size: 1}, "d"},
+	} {
+		if err := tw.WriteHeader(&e.h); err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(tw, e.data)
+	}
+	tw.Close()
+
+	fsys, err := OpenFS(bytes.NewReader(buf.Bytes()), int64(buf.Len()), defaultMode())
+	if err != nil {
+		t.Fatalf("OpenFS() error = %v", err)
+	}
+	if err := fstest.TestFS(fsys, "dir/a.txt", "escape.txt", "hard", "b/c/d.txt"); err != nil {
+		t.Error(err)
+	}
+	for name, want := range map[string]string{"dir/a.txt": "hello", "escape.txt": "bad", "hard": "hello"} {
+		got, err := fs.ReadFile(fsys, name)
+		if err != nil || string(got) != want {
+			t.Errorf("ReadFile(%q) = %q, %v, want %q", name, got, err, want)
+		}
+	}
+	if _, err := fs.Stat(fsys, "link"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat(link) error = %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range []struct {
+		h    tar.Header
+		data string
+	}{
+		{tar.Header{Name: "a.txt", Typeflag: tar.TypeReg, Size: 1}, "a"},
+		{tar.Header{Name: "/b.txt", Typeflag: tar.TypeReg, Size: 2}, "bb"},
+		// links to the entries preceding them, not to the later ones with the same name
+		{tar.Header{Name: "first", Typeflag: tar.TypeLink, Linkname: "a.txt"}, ""},
+		{tar.Header{Name: "a.txt", Typeflag: tar.TypeReg, Size: 3}, "aaa"},
+		{tar.Header{Name: "hard", Typeflag: tar.TypeLink, Linkname: "b.txt"}, ""},
+		{tar.Header{Name: "dir/", Typeflag: tar.TypeDir}, ""},
+	} {
+		if err := tw.WriteHeader(&e.h); err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(tw, e.data)
+	}
+	tw.Close()
+
+	x, err := NewIndex(bytes.NewReader(buf.Bytes()), int64(buf.Len()), defaultMode())
+	if err != nil {
+		t.Fatalf("NewIndex() error = %v", err)
+	}
+	if got := len(x.Entries()); got != 6 {
+		t.Errorf("len(Entries()) = %d, want 6", got)
+	}
+	// reading out of order, and twice
+	for _, tc := range []struct{ name, want string }{{"hard", "bb"}, {"a.txt", "aaa"}, {"b.txt", "bb"}, {"first", "a"}, {"a.txt", "aaa"}} {
+		r, err := x.OpenByName(tc.name)
+		if err != nil {
+			t.Fatalf("OpenByName(%q) error = %v", tc.name, err)
+		}
+		if got, err := io.ReadAll(r); err != nil || string(got) != tc.want {
+			t.Errorf("OpenByName(%q) read %q, %v, want %q", tc.name, got, err, tc.want)
+		}
+	}
+	if _, err := x.OpenByName("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("OpenByName(missing) error = %v, want fs.ErrNotExist", err)
+	}
+	if _, err := x.OpenByName("dir/"); err == nil {
+		t.Errorf("OpenByName(dir/) succeeded, want an error")
+	}
+	if e, ok := x.Lookup("b.txt"); !ok || e.Header.Size != 2 {
+		t.Errorf("Lookup(b.txt) = %+v, %v, want the sanitized entry", e, ok)
+	}
+}
+
+func TestDuplicatePolicy(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range []*tar.Header{
+		{Name: "a.txt", Typeflag: tar.TypeReg},
+		{Name: "dir/", Typeflag: tar.TypeDir},
+		{Name: "./a.txt", Typeflag: tar.TypeReg},
+		{Name: "dir/", Typeflag: tar.TypeDir},
+		{Name: "/a.txt", Typeflag: tar.TypeReg},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+
+	for _, tc := range []struct {
+		policy  safearchive.DuplicatePolicy
+		want    []string
+		reasons int
+		wantErr error
+	}{
+		{policy: safearchive.DuplicatesAllow, want: []string{"a.txt", "dir/", "a.txt", "dir/", "a.txt"}},
+		{policy: safearchive.DuplicatesKeepFirst, want: []string{"a.txt", "dir/", "dir/"}, reasons: 2},
+		{policy: safearchive.DuplicatesKeepLast, want: []string{"a.txt", "dir/", "a.txt", "dir/", "a.txt"}, reasons: 2},
+		{policy: safearchive.DuplicatesRename, want: []string{"a.txt", "dir/", "a.1.txt", "dir/", "a.2.txt"}, reasons: 2},
+		{policy: safearchive.DuplicatesReject, want: []string{"a.txt", "dir/"}, reasons: 1, wantErr: safearchive.ErrDuplicate},
+	} {
+		tr := NewReader(bytes.NewReader(buf.Bytes()))
+		tr.SetDuplicatePolicy(tc.policy)
+		var got []string
+		var err error
+		for {
+			var h *tar.Header
+			if h, err = tr.Next(); err != nil {
+				break
+			}
+			got = append(got, h.Name)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("policy %d: names = %q, want %q", tc.policy, got, tc.want)
+		}
+		if tc.wantErr == nil && err != io.EOF || tc.wantErr != nil && !errors.Is(err, tc.wantErr) {
+			t.Errorf("policy %d: Next() error = %v, want %v", tc.policy, err, tc.wantErr)
+		}
+		n := 0
+		for _, f := range tr.Report().Findings {
+			if f.Reason == safearchive.ReasonDuplicate {
+				n++
+			}
+		}
+		if n != tc.reasons {
+			t.Errorf("policy %d: %d duplicate findings, want %d", tc.policy, n, tc.reasons)
+		}
+	}
+}
+
+func TestDuplicateRenameSymlinks(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range []*tar.Header{
+		{Name: "x", Typeflag: tar.TypeReg},
+		{Name: "x", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+		{Name: "x.1/passwd", Typeflag: tar.TypeReg},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+
+	tr := NewReader(bytes.NewReader(buf.Bytes()))
+	tr.SetDuplicatePolicy(safearchive.DuplicatesRename)
+	var got []string
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		got = append(got, h.Name)
+	}
+	if want := []string{"x", "x.1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("names = %q, want %q", got, want)
+	}
+}
+
+func TestCollisionRenameSymlinks(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range []*tar.Header{
+		{Name: "X", Typeflag: tar.TypeReg},
+		{Name: "x", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+		{Name: "x.1/passwd", Typeflag: tar.TypeReg},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+
+	tr := NewReader(bytes.NewReader(buf.Bytes()))
+	tr.SetCollisionPolicy(safearchive.DuplicatesRename)
+	var got []string
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		got = append(got, h.Name)
+	}
+	if want := []string{"X", "x.1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("names = %q, want %q", got, want)
+	}
+}
+
+func TestCollisionPolicy(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range []string{"README", "readme", "caf\u00e9", "cafe\u0301", "README"} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+
+	tr := NewReader(bytes.NewReader(buf.Bytes()))
+	tr.SetCollisionPolicy(safearchive.DuplicatesKeepFirst)
+	var got []string
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		got = append(got, h.Name)
+	}
+	if want := []string{"README", "caf\u00e9", "README"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("names = %q, want %q", got, want)
+	}
+	f := tr.Report().Findings
+	if len(f) != 2 || f[0].Reason != safearchive.ReasonCollision || f[0].Detail != `collides with "README"` {
+		t.Errorf("Report() = %+v, want 2 collisions", f)
+	}
+}
+
+func TestSanitizeUnicode(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range []*tar.Header{
+		{Name: "invoice\u202efdp.exe", Typeflag: tar.TypeReg},
+		{Name: "dir/\u200b/file\n", Typeflag: tar.TypeReg},
+		{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "target\u200d"},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+
+	tr := NewReader(bytes.NewReader(buf.Bytes()))
+	tr.SetSecurityMode(DefaultSecurityMode | SanitizeUnicode)
+	var got []string
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		got = append(got, h.Name+"|"+h.Linkname)
+	}
+	if want := []string{"invoicefdp.exe|", "dir/file|", "link|target"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %q, want %q", got, want)
+	}
+	if f := tr.Report().Findings; len(f) != 3 || f[0].Reason != safearchive.ReasonUnsafeUnicode {
+		t.Errorf("Report() = %+v, want 3 unsafe-unicode findings", f)
+	}
+
+	tr = NewReader(bytes.NewReader(buf.Bytes()))
+	tr.SetSecurityMode(DefaultSecurityMode | SanitizeUnicode | StrictMode)
+	if _, err := tr.Next(); !errors.Is(err, safearchive.ErrUnsafeUnicode) {
+		t.Errorf("Next() in StrictMode error = %v, want %v", err, safearchive.ErrUnsafeUnicode)
+	}
+}
+
+func TestSanitizeUnicodeTraversal(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: ".\u200b./.\u200b./etc/passwd", Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+
+	tr := NewReader(bytes.NewReader(buf.Bytes()))
+	tr.SetSecurityMode(MaximumSecurityMode)
+	h, err := tr.Next()
+	if err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	if want := "etc/passwd"; h.Name != want {
+		t.Errorf("Next() name = %q, want %q", h.Name, want)
+	}
+}
+
+func TestValidateNameEncoding(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range []*tar.Header{
+		{Name: "caf\xe9.txt", Typeflag: tar.TypeReg, Format: tar.FormatGNU},
+		{Name: "valid/caf\u00e9.txt", Typeflag: tar.TypeReg},
+		{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "target\xff", Format: tar.FormatGNU},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+
+	for _, tc := range []struct {
+		policy safearchive.NameEncodingPolicy
+		want   []string
+	}{
+		{safearchive.NameEncodingReplace, []string{"caf\ufffd.txt|", "valid/caf\u00e9.txt|", "link|target\ufffd"}},
+		{safearchive.NameEncodingPercent, []string{"caf%E9.txt|", "valid/caf\u00e9.txt|", "link|target%FF"}},
+	} {
+		tr := NewReader(bytes.NewReader(buf.Bytes()))
+		tr.SetSecurityMode(DefaultSecurityMode | ValidateNameEncoding)
+		tr.SetNameEncodingPolicy(tc.policy)
+		var got []string
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Next() error = %v", err)
+			}
+			got = append(got, h.Name+"|"+h.Linkname)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("entries with policy %d = %q, want %q", tc.policy, got, tc.want)
+		}
+		if f := tr.Report().Findings; len(f) != 2 || f[0].Reason != safearchive.ReasonInvalidEncoding {
+			t.Errorf("Report() = %+v, want 2 invalid-encoding findings", f)
+		}
+	}
+
+	for _, sm := range []SecurityMode{DefaultSecurityMode | ValidateNameEncoding | StrictMode, MaximumSecurityMode} {
+		tr := NewReader(bytes.NewReader(buf.Bytes()))
+		tr.SetSecurityMode(sm)
+		if sm&StrictMode == 0 {
+			tr.SetNameEncodingPolicy(safearchive.NameEncodingReject)
+		}
+		if _, err := tr.Next(); !errors.Is(err, ErrInvalidEncoding) {
+			t.Errorf("Next() with %v error = %v, want %v", sm, err, ErrInvalidEncoding)
+		}
+	}
+}
+
+func TestEntryFilter(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range []*tar.Header{
+		{Name: "../a.txt", Typeflag: tar.TypeReg},
+		{Name: "b.exe", Typeflag: tar.TypeReg},
+		{Name: "c.txt", Typeflag: tar.TypeReg},
+		{Name: "d.bad", Typeflag: tar.TypeReg},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+
+	errBad := errors.New("bad entry")
+	tr := NewReader(bytes.NewReader(buf.Bytes()))
+	var seen []string
+	tr.SetEntryFilter(func(h *Header) (bool, error) {
+		seen = append(seen, h.Name)
+		if strings.HasSuffix(h.Name, ".bad") {
+			return false, errBad
+		}
+		if h.Name == "c.txt" {
+			// discarded, the filter sees a copy
+			h.Name = "../renamed.txt"
+		}
+		return !strings.HasSuffix(h.Name, ".exe"), nil
+	})
+	var got []string
+	var err error
+	for {
+		var h *tar.Header
+		if h, err = tr.Next(); err != nil {
+			break
+		}
+		got = append(got, h.Name)
+	}
+	if want := []string{"a.txt", "c.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %q, want %q", got, want)
+	}
+	if want := []string{"a.txt", "b.exe", "c.txt", "d.bad"}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("filtered entries = %q, want %q", seen, want)
+	}
+	var ee *safearchive.EntryError
+	if !errors.Is(err, errBad) || !errors.As(err, &ee) || ee.Name != "d.bad" || ee.Offset != 1536 {
+		t.Errorf("Next() error = %v, want an entry error of d.bad wrapping %v", err, errBad)
+	}
+}
+
+func TestPatterns(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range []*tar.Header{
+		{Name: "docs/", Typeflag: tar.TypeDir},
+		{Name: "docs/a.md", Typeflag: tar.TypeReg},
+		{Name: "/docs/b.txt", Typeflag: tar.TypeReg},
+		{Name: "docs/draft.md", Typeflag: tar.TypeReg},
+		{Name: "src/main.go", Typeflag: tar.TypeReg},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+
+	tr := NewReader(bytes.NewReader(buf.Bytes()))
+	if err := tr.SetIncludePatterns("docs/*"); err != nil {
+		t.Fatalf("SetIncludePatterns() error = %v", err)
+	}
+	if err := tr.SetExcludePatterns("draft.*", "*/draft.*"); err != nil {
+		t.Fatalf("SetExcludePatterns() error = %v", err)
+	}
+	if err := tr.SetExcludePatterns("[a-"); !errors.Is(err, path.ErrBadPattern) {
+		t.Errorf("SetExcludePatterns() error = %v, want %v", err, path.ErrBadPattern)
+	}
+	var got []string
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		got = append(got, h.Name)
+	}
+	if want := []string{"docs/a.md", "docs/b.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %q, want %q", got, want)
+	}
+}
+
+func TestStripComponents(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range []*tar.Header{
+		{Name: "pkg-1.0/", Typeflag: tar.TypeDir},
+		{Name: "pkg-1.0/src/main.go", Typeflag: tar.TypeReg},
+		{Name: "pkg-1.0/src/link.go", Typeflag: tar.TypeLink, Linkname: "pkg-1.0/src/main.go"},
+		{Name: "pkg-1.0/../../../etc/passwd", Typeflag: tar.TypeReg},
+		{Name: "README", Typeflag: tar.TypeReg},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+
+	tr := NewReader(bytes.NewReader(buf.Bytes()))
+	tr.SetSecurityMode(defaultMode() &^ SanitizeFilenames)
+	tr.SetStripComponents(1)
+	tr.SetPrefix("vendor/")
+	var got []string
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		got = append(got, h.Name+"|"+h.Linkname)
+	}
+	want := []string{"vendor/src/main.go|", "vendor/src/link.go|vendor/src/main.go", "vendor/passwd|"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %q, want %q", got, want)
+	}
+}
+
+func TestStripComponentsSymlinks(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range []*tar.Header{
+		{Name: "x/link", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+		{Name: "y/link/passwd", Typeflag: tar.TypeReg},
+		{Name: "x/a/up", Typeflag: tar.TypeSymlink, Linkname: "../../z/file"},
+		{Name: "x/top", Typeflag: tar.TypeSymlink, Linkname: "../q/w"},
+		{Name: "x/root", Typeflag: tar.TypeSymlink, Linkname: ".."},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+
+	tr := newReader(bytes.NewReader(buf.Bytes()))
+	tr.SetStripComponents(1)
+	var got []string
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() error = %v", err)
+		}
+		got = append(got, h.Name+"|"+h.Linkname)
+	}
+	want := []string{"link|/etc", "a/up|../file", "top|w"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %q, want %q", got, want)
+	}
+	var reasons []safearchive.Reason
+	for _, f := range tr.Report().Findings {
+		reasons = append(reasons, f.Reason)
+	}
+	if want := []safearchive.Reason{safearchive.ReasonSymlinkTraversal, safearchive.ReasonSymlinkTarget}; !reflect.DeepEqual(reasons, want) {
+		t.Errorf("Report() reasons = %q, want %q", reasons, want)
+	}
+}
+
+func TestEntryErrors(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Size: 1000}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(make([]byte, 1000))
+	}
+	tw.Close()
+
+	// corrupting the checksum of the second header
+	corrupt := append([]byte{}, buf.Bytes()...)
+	corrupt[1536+148] ^= 0xff
+	tr := NewReader(bytes.NewReader(corrupt))
+	if _, err := tr.Next(); err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	_, err := tr.Next()
+	var ee *safearchive.EntryError
+	if !errors.Is(err, ErrHeader) || !errors.As(err, &ee) || ee.Offset != 1536 {
+		t.Errorf("Next() error = %v, want an entry error at offset 1536 wrapping %v", err, ErrHeader)
+	}
+
+	// truncating the data of the first entry
+	tr = NewReader(bytes.NewReader(buf.Bytes()[:1000]))
+	if _, err := tr.Next(); err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	_, err = io.ReadAll(tr)
+	if !errors.Is(err, io.ErrUnexpectedEOF) || !errors.As(err, &ee) || ee.Name != "a.txt" || ee.Offset != 0 {
+		t.Errorf("Read() error = %v, want an entry error of a.txt wrapping %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestContext(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: 4})
+		tw.Write([]byte("data"))
+	}
+	tw.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tr := NewReader(bytes.NewReader(buf.Bytes()))
+	if h, err := tr.NextContext(ctx); err != nil || h.Name != "a.txt" {
+		t.Fatalf("NextContext() = %v, %v, want a.txt", h, err)
+	}
+	b := make([]byte, 2)
+	if _, err := tr.ReadContext(ctx, b); err != nil {
+		t.Fatalf("ReadContext() error = %v", err)
+	}
+	cancel()
+	if _, err := tr.ReadContext(ctx, b); !errors.Is(err, context.Canceled) {
+		t.Errorf("ReadContext() after cancel error = %v, want %v", err, context.Canceled)
+	}
+	if _, err := tr.NextContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("NextContext() after cancel error = %v, want %v", err, context.Canceled)
+	}
+
+	// the reads of the archive check the context, not only the calls
+	tr = NewReader(bytes.NewReader(buf.Bytes()))
+	tr.recorder.ctx = ctx
+	if _, err := tr.Next(); !errors.Is(err, context.Canceled) {
+		t.Errorf("Next() with a cancelled context error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func BenchmarkNext(b *testing.B) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i := 0; i < 100000; i++ {
+		h := &tar.Header{Name: fmt.Sprintf("a%d/b%d/c%d/d%d/e%d/file%d.txt", i%7, i%11, i%13, i%17, i%19, i), Typeflag: tar.TypeReg, Mode: 0644}
+		if i%1000 == 0 {
+			h = &tar.Header{Name: fmt.Sprintf("links/link%d", i), Typeflag: tar.TypeSymlink, Linkname: "../a0"}
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			b.Fatalf("WriteHeader(%q) error = %v", h.Name, err)
+		}
+	}
+	tw.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr := NewReader(bytes.NewReader(buf.Bytes()))
+		tr.SetSecurityMode(PreventSymlinkTraversal)
+		for {
+			if _, err := tr.Next(); err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatalf("Next() error = %v", err)
+			}
+		}
+	}
+}
+
+func TestTolerant(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range []struct {
+		name    string
+		content string
+	}{{"a", strings.Repeat("a", 600)}, {"b", "bb"}, {"c", "cc"}} {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatalf("WriteHeader(%q) error = %v", f.name, err)
+		}
+		tw.Write([]byte(f.content))
+	}
+	tw.Close()
+	// the headers of b and c are at 1536 and 2560
+	corrupt := func(offsets ...int) []byte {
+		b := bytes.Clone(buf.Bytes())
+		for _, o := range offsets {
+			b[o] = 'x'
+		}
+		return b
+	}
+
+	tests := []struct {
+		name         string
+		archive      []byte
+		wantNames    []string
+		wantFindings []safearchive.Finding
+	}{
+		{
+			name:      "intact",
+			archive:   buf.Bytes(),
+			wantNames: []string{"a", "b", "c"},
+		},
+		{
+			name:      "corrupt entry",
+			archive:   corrupt(1536),
+			wantNames: []string{"a", "c"},
+			wantFindings: []safearchive.Finding{
+				{Offset: 1536, Reason: ReasonCorruptHeader, Action: safearchive.ActionDropped, Detail: "skipped 1024 bytes at offset 1536"},
+			},
+		},
+		{
+			name:      "corrupt last entries",
+			archive:   corrupt(1536, 2560),
+			wantNames: []string{"a"},
+			wantFindings: []safearchive.Finding{
+				{Offset: 1536, Reason: ReasonCorruptHeader, Action: safearchive.ActionDropped, Detail: fmt.Sprintf("skipped %d bytes at offset 1536", buf.Len()-1536)},
+			},
+		},
+	}
+	for _, tc := range tests {
+		for _, seekable := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s/seekable=%t", tc.name, seekable), func(t *testing.T) {
+				var r io.Reader = bytes.NewReader(tc.archive)
+				if !seekable {
+					r = io.MultiReader(r)
+				}
+				tr := NewReader(r)
+				tr.SetTolerant(true)
+				var names []string
+				for {
+					h, err := tr.Next()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Fatalf("Next() error = %v", err)
+					}
+					names = append(names, h.Name)
+					if b, err := io.ReadAll(tr); err != nil || len(b) != int(h.Size) || b[0] != h.Name[0] {
+						t.Errorf("ReadAll(%q) = %q, %v, want %d bytes of %q", h.Name, b, err, h.Size, h.Name)
+					}
+				}
+				if !reflect.DeepEqual(names, tc.wantNames) {
+					t.Errorf("Next() names = %q, want %q", names, tc.wantNames)
+				}
+				if diff := cmp.Diff(tc.wantFindings, tr.Report().Findings, cmpopts.EquateEmpty()); diff != "" {
+					t.Errorf("Report() unexpected diff (-want +got):\n%s", diff)
+				}
+			})
+		}
+	}
+
+	tr := NewReader(bytes.NewReader(corrupt(1536)))
+	tr.Next()
+	if _, err := tr.Next(); !errors.Is(err, ErrHeader) {
+		t.Errorf("Next() without tolerant mode error = %v, want %v", err, ErrHeader)
+	}
+}
+
+func TestOnWhiteout(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, h := range []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir},
+		{Name: "etc/.wh.passwd", Typeflag: tar.TypeReg},
+		{Name: "var/lib/.wh..wh..opq", Typeflag: tar.TypeReg},
+		{Name: ".wh..wh..opq", Typeflag: tar.TypeReg},
+		{Name: "../../.wh.etc", Typeflag: tar.TypeReg},
+		{Name: ".wh..wh.plnk/", Typeflag: tar.TypeDir},
+		{Name: "etc/passwd", Typeflag: tar.TypeReg},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+
+	read := func(tr *Reader) ([]string, error) {
+		var names []string
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				return names, nil
+			}
+			if err != nil {
+				return names, err
+			}
+			names = append(names, h.Name)
+		}
+	}
+
+	tr := NewReader(bytes.NewReader(buf.Bytes()))
+	names, err := read(tr)
+	if err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	if len(names) != 7 {
+		t.Errorf("Next() without a whiteout handler returned %q, want every entry", names)
+	}
+
+	tr = NewReader(bytes.NewReader(buf.Bytes()))
+	var whiteouts []Whiteout
+	tr.OnWhiteout(func(w Whiteout) error {
+		whiteouts = append(whiteouts, w)
+		return nil
+	})
+	if names, err = read(tr); err != nil {
+		t.Fatalf("Next() error = %v", err)
+	}
+	if want := []string{"etc/", "etc/passwd"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Next() returned %q, want %q", names, want)
+	}
+	wantWhiteouts := []Whiteout{
+		{Path: "etc/passwd", Offset: 512},
+		{Path: "var/lib", Opaque: true, Offset: 1024},
+		{Path: ".", Opaque: true, Offset: 1536},
+		{Path: "etc", Offset: 2048},
+	}
+	if diff := cmp.Diff(wantWhiteouts, whiteouts); diff != "" {
+		t.Errorf("OnWhiteout() unexpected diff (-want +got):\n%s", diff)
+	}
+	var reasons []safearchive.Reason
+	for _, f := range tr.Report().Findings {
+		reasons = append(reasons, f.Reason)
+	}
+	if want := []safearchive.Reason{safearchive.ReasonPathTraversal, ReasonWhiteout}; !reflect.DeepEqual(reasons, want) {
+		t.Errorf("Report() reasons = %q, want %q", reasons, want)
+	}
+
+	tr = NewReader(bytes.NewReader(buf.Bytes()))
+	tr.SetSecurityMode(tr.GetSecurityMode() | StrictMode)
+	tr.OnWhiteout(func(w Whiteout) error { return nil })
+	if _, err := read(tr); err == nil {
+		t.Errorf("Next() in StrictMode succeeded, want error")
+	}
+
+	errDenied := errors.New("opaque directories are not allowed")
+	tr = NewReader(bytes.NewReader(buf.Bytes()))
+	tr.OnWhiteout(func(w Whiteout) error {
+		if w.Opaque {
+			return errDenied
+		}
+		return nil
+	})
+	_, err = read(tr)
+	var ee *safearchive.EntryError
+	if !errors.Is(err, errDenied) || !errors.As(err, &ee) || ee.Offset != 1024 {
+		t.Errorf("Next() error = %v, want an entry error at offset 1024 wrapping %v", err, errDenied)
+	}
+}
@@ -12,8 +12,8 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-//go:build windows
-// +build windows
+//go:build windows && !safearchive_hardened
+// +build windows,!safearchive_hardened
 
 package tar
 
@@ -0,0 +1,98 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/safearchive"
+)
+
+// The names of the whiteout entries of the layers of container images, see Reader.OnWhiteout.
+const (
+	// WhiteoutPrefix is the prefix of the base name of the entries deleting the file or directory
+	// named after the rest of their base name, e.g. "etc/.wh.passwd" deletes "etc/passwd".
+	WhiteoutPrefix = ".wh."
+	// WhiteoutOpaque is the base name of the entries marking their directory as opaque: the
+	// contents of the directory in the lower layers are deleted.
+	WhiteoutOpaque = WhiteoutPrefix + WhiteoutPrefix + ".opq"
+)
+
+// ReasonWhiteout is the reason of the findings about the entries of a container image layer whose
+// name has the whiteout prefix but which are not valid whiteouts, e.g. the AUFS hard link
+// directories (".wh..wh.plnk") or a whiteout of "..". They are dropped, and rejected in StrictMode.
+const ReasonWhiteout safearchive.Reason = "tar-whiteout"
+
+// Whiteout is a deletion of a layer of a container image, described by a whiteout entry.
+type Whiteout struct {
+	// Path is the slash-separated name of the deleted file or directory, or of the opaque
+	// directory ("." for the root of the layer), as sanitized by the Reader.
+	Path string
+	// Opaque is set if the contents of the directory Path in the lower layers are deleted, but not
+	// the directory itself.
+	Opaque bool
+	// Offset is the position of the whiteout entry in the archive.
+	Offset int64
+}
+
+// WhiteoutHandler is called with the deletions of a container image layer, see Reader.OnWhiteout.
+type WhiteoutHandler func(w Whiteout) error
+
+// OnWhiteout enables the container image layer mode of the Reader, for the layer tarballs of OCI
+// and Docker images: the whiteout entries (see WhiteoutPrefix and WhiteoutOpaque) are passed to f
+// as deletions instead of being returned by Next, in the order of the archive. Their names are
+// checked by the security features and the rules, and selected and stripped like the names of the
+// other entries, before they are passed to f. If f fails, Next fails with a
+// safearchive.EntryError wrapping its error. A nil handler (the default) disables the layer mode,
+// and the whiteout entries are returned as regular entries.
+func (tr *Reader) OnWhiteout(f WhiteoutHandler) {
+	tr.onWhiteout = f
+}
+
+// whiteout passes h to the whiteout handler of the Reader if it is a whiteout entry. It reports
+// whether it was one, in which case it is not returned by Next.
+func (tr *Reader) whiteout(h *Header) (bool, error) {
+	if tr.onWhiteout == nil {
+		return false, nil
+	}
+	name := filepath.ToSlash(h.Name)
+	dir, base := path.Dir(strings.TrimSuffix(name, "/")), path.Base(name)
+	target, ok := strings.CutPrefix(base, WhiteoutPrefix)
+	if !ok {
+		return false, nil
+	}
+	w := Whiteout{Path: path.Join(dir, target), Offset: tr.offset}
+	switch {
+	case base == WhiteoutOpaque:
+		w.Path, w.Opaque = dir, true
+	case strings.HasPrefix(target, WhiteoutPrefix) || target == "" || target == "." || target == "..":
+		v := safearchive.Verdict{Action: safearchive.ActionDropped, Reason: ReasonWhiteout, Detail: "invalid whiteout " + base}
+		if tr.securityMode&StrictMode != 0 {
+			v = v.Strict()
+		}
+		if f := tr.flag(v); f.Action == safearchive.ActionRejected {
+			return true, f.Err(safearchive.RejectionError(v.Reason))
+		}
+		return true, nil
+	}
+	if err := tr.onWhiteout(w); err != nil {
+		e := safearchive.NewEntryError(tr.name, "", err)
+		e.Offset = tr.offset
+		return true, e
+	}
+	return true, nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar" // NOLINT
+	"io"
+	"path/filepath"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/sanitizer"
+)
+
+// writerRules are the built-in security features the Writer applies, in the order they are
+// applied. They are the rules of the Reader that do not depend on the encoding of the headers.
+var writerRules = []rule{
+	ruleFunc(skipSpecialFiles),
+	ruleFunc(sanitizeFileMode),
+	ruleFunc(sanitizeFilenames),
+	ruleFunc(sanitizeUnicode),
+	ruleFunc(sanitizeHardlinks),
+	ruleFunc(sanitizeSymlinkTargets),
+	ruleFunc(skipWindowsShortFilenames),
+	ruleFunc(preventSymlinkTraversal),
+	ruleFunc(requireSymlinksLast),
+	ruleFunc(dropXattrs),
+}
+
+// Writer provides sequential writing of a tar archive.
+// Write.WriteHeader begins a new file with the provided Header,
+// and then Writer can be treated as an io.Writer to supply that file's data.
+//
+// Unlike the Writer of archive/tar, WriteHeader applies the security features of the SecurityMode
+// of the Writer on the header before writing it, so services creating archives cannot produce
+// entries that traverse out of the extraction directory:
+//   - SanitizeFilenames makes the names (and the targets of hard links) relative and drops their
+//     ".." path components
+//   - SanitizeSymlinkTargets confines the targets of symbolic links to the archive
+//   - SanitizeFileMode drops the setuid, setgid and sticky bits
+//   - DropXattrs drops the extended attributes
+//   - RequireSymlinksLast refuses the entries the Reader would reject
+//   - SkipSpecialFiles, SkipWindowsShortFilenames and PreventSymlinkTraversal refuse the entries
+//     the Reader would skip: WriteHeader fails with a safearchive.EntryError wrapping
+//     safearchive.ErrRejected (e.g. ErrSpecialFile), since an archive silently missing entries
+//     would be surprising to its author.
+//
+// In StrictMode, WriteHeader fails the same way instead of rewriting a header for a security
+// reason. The header passed to WriteHeader is never modified.
+type Writer struct {
+	tw           *tar.Writer
+	securityMode SecurityMode
+	// state is the state of the security features shared with the Reader (e.g. the symbolic links
+	// written so far) and the findings about the entries written so far.
+	state *Reader
+}
+
+// NewWriter creates a new Writer writing to w, with DefaultSecurityMode.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		tw:           tar.NewWriter(w),
+		securityMode: DefaultSecurityMode,
+		state:        &Reader{},
+	}
+}
+
+// SetSecurityMode controls the security features applied on the headers written after the call.
+func (tw *Writer) SetSecurityMode(s SecurityMode) {
+	tw.securityMode = s
+}
+
+// GetSecurityMode returns the currently enabled security features
+func (tw *Writer) GetSecurityMode() SecurityMode {
+	return tw.securityMode
+}
+
+// SetPAXAllowlist sets the PAX records kept by DropXattrs, see Reader.SetPAXAllowlist.
+func (tw *Writer) SetPAXAllowlist(keys []string) {
+	tw.state.SetPAXAllowlist(keys)
+}
+
+// Report returns the findings about the headers written so far: every header that was
+// sanitized or refused, along with the reason code of the security feature that flagged it.
+// Offsets are unknown (-1).
+func (tw *Writer) Report() *safearchive.Report {
+	return tw.state.Report()
+}
+
+// WriteHeader writes h, after applying the security features of the Writer on a copy of it, and
+// prepares to accept the file's contents. The Header.Size determines how many bytes can be
+// written for the next file. If the current file is not fully written, then this returns an error.
+// This implicitly flushes any padding necessary before writing the header.
+func (tw *Writer) WriteHeader(h *Header) error {
+	hc := *h
+	st := tw.state
+	st.securityMode = tw.securityMode
+	st.offset, st.name = -1, h.Name
+	for _, r := range writerRules {
+		v := r.apply(st, &hc)
+		if v.Reason == "" {
+			continue
+		}
+		if tw.securityMode&StrictMode != 0 {
+			v = v.Strict()
+		}
+		if v.Action == safearchive.ActionDropped {
+			v.Action = safearchive.ActionRejected
+		}
+		f := st.flag(v)
+		if f.Action == safearchive.ActionRejected {
+			return f.Err(safearchive.RejectionError(v.Reason))
+		}
+	}
+	// the sanitizer uses the path separator of the platform, archives always use slashes
+	if hc.Name != h.Name {
+		hc.Name = filepath.ToSlash(hc.Name)
+	}
+	if hc.Linkname != h.Linkname {
+		hc.Linkname = filepath.ToSlash(hc.Linkname)
+	}
+	return tw.tw.WriteHeader(&hc)
+}
+
+// Write writes to the current file in the tar archive.
+// Write returns the error ErrWriteTooLong if more than
+// Header.Size bytes are written after WriteHeader.
+func (tw *Writer) Write(b []byte) (int, error) {
+	return tw.tw.Write(b)
+}
+
+// Flush finishes writing the current file's block padding.
+// The current file must be fully written before Flush can be called.
+func (tw *Writer) Flush() error {
+	return tw.tw.Flush()
+}
+
+// Close closes the tar archive by flushing the padding, and writing the footer.
+// If the current file (from a prior call to WriteHeader) is not fully written,
+// then this returns an error.
+func (tw *Writer) Close() error {
+	return tw.tw.Close()
+}
+
+// sanitizeHardlinks sanitizes the targets of hard links the way SanitizeFilenames sanitizes the
+// names, as they refer to other entries of the archive.
+func sanitizeHardlinks(tr *Reader, h *Header) safearchive.Verdict {
+	if tr.securityMode&SanitizeFilenames == 0 || h.Typeflag != TypeLink {
+		return safearchive.Pass
+	}
+	linkname := filepath.ToSlash(sanitizer.SanitizePath(h.Linkname))
+	if linkname == h.Linkname {
+		return safearchive.Pass
+	}
+	v := safearchive.Verdict{Action: safearchive.ActionModified, Reason: safearchive.NameReason(h.Linkname), Detail: "hard link target " + h.Linkname + " changed to " + linkname}
+	h.Linkname = linkname
+	return v
+}
@@ -0,0 +1,71 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import "strings"
+
+// XattrPolicy selects the extended attributes kept by DropXattrs by their namespace, which is the
+// part of their name before the first dot (e.g. "user" in "user.mime_type"). The zero value keeps
+// none of them.
+type XattrPolicy struct {
+	// Keep lists the namespaces whose extended attributes are kept.
+	Keep []string
+}
+
+// KeepUserXattrs keeps the extended attributes of the user namespace, which backup tools need,
+// and drops the ones of the security, trusted and system namespaces (e.g. file capabilities,
+// SELinux labels or POSIX ACLs).
+var KeepUserXattrs = XattrPolicy{Keep: []string{"user"}}
+
+// keeps reports whether the policy keeps the extended attribute stored in the PAX record k.
+func (p XattrPolicy) keeps(k string) bool {
+	name, ok := strings.CutPrefix(k, "SCHILY.xattr.")
+	if !ok {
+		if name, ok = strings.CutPrefix(k, "LIBARCHIVE.xattr."); !ok {
+			return false
+		}
+	}
+	ns, _, ok := strings.Cut(name, ".")
+	if !ok {
+		return false
+	}
+	for _, keep := range p.Keep {
+		if ns == keep {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the namespaces kept by the policy separated by commas.
+func (p XattrPolicy) String() string {
+	return strings.Join(p.Keep, ",")
+}
+
+// SetXattrPolicy sets the extended attributes kept by DropXattrs, in addition to the ones allowed
+// by SetPAXAllowlist. By default, all of them are dropped.
+func (tr *Reader) SetXattrPolicy(p XattrPolicy) {
+	tr.xattrPolicy = XattrPolicy{Keep: append([]string{}, p.Keep...)}
+}
+
+// SetXattrPolicy sets the extended attributes kept by DropXattrs, see Reader.SetXattrPolicy.
+func (tw *Writer) SetXattrPolicy(p XattrPolicy) {
+	tw.state.SetXattrPolicy(p)
+}
+
+// keepsPAX reports whether DropXattrs keeps the PAX record k.
+func (tr *Reader) keepsPAX(k string) bool {
+	return keyAllowed(k, tr.paxKeys()) || tr.xattrPolicy.keeps(k)
+}
@@ -0,0 +1,293 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tempspace manages the temporary disk space used while processing archives, e.g. to spill
+// large streams to disk or to reassemble zip archives arriving as a stream.
+//
+// Every operation gets its own Space: a directory only accessible by the current user, whose
+// usage is accounted against a Budget shared by the operations, and which is removed when the
+// operation ends, is canceled or panics:
+//
+//	budget := tempspace.NewBudget(10 << 30)
+//	...
+//	err := tempspace.Do(ctx, "", budget, func(s *tempspace.Space) error {
+//		f, err := s.CreateFile("upload-*")
+//		...
+//	})
+package tempspace
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+var (
+	// ErrBudgetExceeded is returned when writing a file would exceed the Budget of its Space.
+	ErrBudgetExceeded = errors.New("tempspace: budget exceeded")
+	// ErrClosed is returned when using a Space (or one of its files) after it was closed.
+	ErrClosed = errors.New("tempspace: space closed")
+)
+
+// Budget limits the total size of the files of the spaces sharing it. It is safe for concurrent
+// use. A nil Budget is unlimited.
+type Budget struct {
+	max int64
+
+	mu   sync.Mutex
+	used int64
+}
+
+// NewBudget returns a Budget of max bytes.
+func NewBudget(max int64) *Budget {
+	return &Budget{max: max}
+}
+
+// Reserve accounts n more bytes against the budget, or fails with ErrBudgetExceeded.
+func (b *Budget) Reserve(n int64) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n > b.max-b.used {
+		return ErrBudgetExceeded
+	}
+	b.used += n
+	return nil
+}
+
+// Release returns n bytes to the budget.
+func (b *Budget) Release(n int64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+}
+
+// Used returns the number of bytes currently accounted against the budget.
+func (b *Budget) Used() int64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+// Space is a temporary directory of an operation. It is safe for concurrent use.
+type Space struct {
+	dir    string
+	budget *Budget
+	stop   func() bool
+
+	mu     sync.Mutex
+	used   int64
+	closed bool
+}
+
+// New creates a Space in the directory parent (os.TempDir if empty), accounted against budget
+// (which may be nil). The space is closed when ctx is done.
+func New(ctx context.Context, parent string, budget *Budget) (*Space, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// MkdirTemp creates the directory with mode 0700
+	dir, err := os.MkdirTemp(parent, "safearchive-*")
+	if err != nil {
+		return nil, err
+	}
+	s := &Space{dir: dir, budget: budget}
+	s.stop = context.AfterFunc(ctx, func() { s.Close() })
+	return s, nil
+}
+
+// Do runs f with a new Space, which is closed when f returns or panics.
+func Do(ctx context.Context, parent string, budget *Budget, f func(s *Space) error) error {
+	s, err := New(ctx, parent, budget)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return f(s)
+}
+
+// Dir returns the path of the directory of the space.
+func (s *Space) Dir() string {
+	return s.dir
+}
+
+// Used returns the number of bytes written to the files of the space that were not removed yet.
+func (s *Space) Used() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.used
+}
+
+// Mkdir creates a new directory in the space, see os.MkdirTemp for the pattern.
+func (s *Space) Mkdir(pattern string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return "", ErrClosed
+	}
+	return os.MkdirTemp(s.dir, pattern)
+}
+
+// CreateFile creates a new file in the space, see os.CreateTemp for the pattern.
+func (s *Space) CreateFile(pattern string) (*File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	f, err := os.CreateTemp(s.dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &File{f: f, space: s}, nil
+}
+
+// reserve accounts n more bytes against the space and its budget.
+func (s *Space) reserve(n int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if err := s.budget.Reserve(n); err != nil {
+		return err
+	}
+	s.used += n
+	return nil
+}
+
+// release returns n bytes to the budget.
+func (s *Space) release(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.budget.Release(n)
+	s.used -= n
+}
+
+// Close removes the directory of the space along with its content, and returns its usage to the
+// budget. Files of the space should be closed before, as some platforms cannot remove open
+// files. Closing a closed space is a no-op.
+func (s *Space) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.stop()
+	s.budget.Release(s.used)
+	s.used = 0
+	return os.RemoveAll(s.dir)
+}
+
+// File is a file of a Space. Its size is accounted against the budget of the space.
+type File struct {
+	f     *os.File
+	space *Space
+
+	mu   sync.Mutex
+	size int64
+}
+
+// Name returns the path of the file.
+func (f *File) Name() string {
+	return f.f.Name()
+}
+
+// Size returns the size of the file.
+func (f *File) Size() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.size
+}
+
+// grow accounts the growth of the file to end bytes.
+func (f *File) grow(end int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if end <= f.size {
+		return nil
+	}
+	if err := f.space.reserve(end - f.size); err != nil {
+		return err
+	}
+	f.size = end
+	return nil
+}
+
+// Write writes p at the current offset of the file.
+func (f *File) Write(p []byte) (int, error) {
+	off, err := f.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	if err := f.grow(off + int64(len(p))); err != nil {
+		return 0, err
+	}
+	return f.f.Write(p)
+}
+
+// WriteAt writes p at offset off of the file.
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.grow(off + int64(len(p))); err != nil {
+		return 0, err
+	}
+	return f.f.WriteAt(p, off)
+}
+
+// Read reads from the current offset of the file.
+func (f *File) Read(p []byte) (int, error) {
+	return f.f.Read(p)
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	return f.f.ReadAt(p, off)
+}
+
+// Seek implements io.Seeker.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	return f.f.Seek(offset, whence)
+}
+
+// Close closes the file. It is removed when its space is closed.
+func (f *File) Close() error {
+	return f.f.Close()
+}
+
+// Remove closes and removes the file, returning its size to the budget.
+func (f *File) Remove() error {
+	err := f.f.Close()
+	if rerr := os.Remove(f.f.Name()); err == nil {
+		err = rerr
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.space.release(f.size)
+	f.size = 0
+	return err
+}
@@ -0,0 +1,173 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tempspace
+
+import (
+	"context"
+	"errors"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func exists(t *testing.T, name string) bool {
+	t.Helper()
+
+	_, err := os.Stat(name)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("os.Stat(%q) error = %v", name, err)
+	}
+	return err == nil
+}
+
+func TestSpace(t *testing.T) {
+	budget := NewBudget(100)
+	s, err := New(context.Background(), t.TempDir(), budget)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(s.Dir())
+		if err != nil {
+			t.Fatalf("os.Stat(%q) error = %v", s.Dir(), err)
+		}
+		if perm := fi.Mode().Perm(); perm != 0700 {
+			t.Errorf("permissions of the space = %v, want %v", perm, os.FileMode(0700))
+		}
+	}
+
+	f, err := s.CreateFile("test-*")
+	if err != nil {
+		t.Fatalf("CreateFile() error = %v", err)
+	}
+	if _, err := f.Write(make([]byte, 40)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if _, err := f.WriteAt(make([]byte, 10), 20); err != nil {
+		t.Fatalf("WriteAt() error = %v", err)
+	}
+	if _, err := f.WriteAt(make([]byte, 30), 30); err != nil {
+		t.Fatalf("WriteAt() error = %v", err)
+	}
+	if f.Size() != 60 || s.Used() != 60 || budget.Used() != 60 {
+		t.Errorf("Size() = %d, Space.Used() = %d, Budget.Used() = %d, want 60", f.Size(), s.Used(), budget.Used())
+	}
+	if _, err := f.WriteAt(make([]byte, 50), 60); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("WriteAt() beyond the budget error = %v, want %v", err, ErrBudgetExceeded)
+	}
+	dir, err := s.Mkdir("dir-*")
+	if err != nil {
+		t.Fatalf("Mkdir() error = %v", err)
+	}
+	f.Close()
+
+	if err := s.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+	if exists(t, s.Dir()) || exists(t, dir) {
+		t.Errorf("the space still exists after Close()")
+	}
+	if budget.Used() != 0 {
+		t.Errorf("Budget.Used() after Close() = %d, want 0", budget.Used())
+	}
+	if _, err := s.CreateFile("test-*"); err != ErrClosed {
+		t.Errorf("CreateFile() after Close() error = %v, want %v", err, ErrClosed)
+	}
+	if _, err := f.Write([]byte("x")); err == nil {
+		t.Errorf("Write() after Close() succeeded")
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("second Close() error = %v", err)
+	}
+}
+
+func TestSharedBudget(t *testing.T) {
+	budget := NewBudget(100)
+	var files []*File
+	for i := 0; i < 2; i++ {
+		s, err := New(context.Background(), t.TempDir(), budget)
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer s.Close()
+		f, err := s.CreateFile("")
+		if err != nil {
+			t.Fatalf("CreateFile() error = %v", err)
+		}
+		files = append(files, f)
+	}
+	if _, err := files[0].Write(make([]byte, 70)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if _, err := files[1].Write(make([]byte, 70)); !errors.Is(err, ErrBudgetExceeded) {
+		t.Errorf("Write() to the second space error = %v, want %v", err, ErrBudgetExceeded)
+	}
+	if err := files[0].Remove(); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if _, err := files[1].Write(make([]byte, 70)); err != nil {
+		t.Errorf("Write() after removing the first file error = %v", err)
+	}
+	files[1].Close()
+}
+
+func TestCancel(t *testing.T) {
+	budget := NewBudget(100)
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := New(ctx, t.TempDir(), budget)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	f, err := s.CreateFile("")
+	if err != nil {
+		t.Fatalf("CreateFile() error = %v", err)
+	}
+	f.Write(make([]byte, 10))
+	f.Close()
+
+	cancel()
+	for deadline := time.Now().Add(10 * time.Second); exists(t, s.Dir()); {
+		if time.Now().After(deadline) {
+			t.Fatalf("the space still exists after canceling its context")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if budget.Used() != 0 {
+		t.Errorf("Budget.Used() after canceling = %d, want 0", budget.Used())
+	}
+
+	if _, err := New(ctx, t.TempDir(), budget); err != context.Canceled {
+		t.Errorf("New() with a canceled context error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestDoPanic(t *testing.T) {
+	var dir string
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Do() did not propagate the panic")
+			}
+		}()
+		Do(context.Background(), t.TempDir(), nil, func(s *Space) error {
+			dir = s.Dir()
+			panic("boom")
+		})
+	}()
+	if dir == "" || exists(t, dir) {
+		t.Errorf("the space %q still exists after a panic", dir)
+	}
+}
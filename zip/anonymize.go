@@ -0,0 +1,102 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"archive/zip" // NOLINT
+	"io"
+	"strings"
+
+	"github.com/google/safearchive"
+)
+
+// anonymizedModDate is safearchive.AnonymizedModTime in MS-DOS date format.
+const anonymizedModDate = 1<<5 | 1
+
+// Anonymize rewrites the zip archive read from src to dst, so it can be shared (e.g. attached to
+// a bug report) without exposing confidential contents. The structure of the archive is kept:
+// the entries are written in the same order, with the same names, modes, compression methods and
+// uncompressed sizes (up to the maximum compression ratio of DEFLATE), but their contents are replaced as selected by repl, and the rest of their
+// metadata (times, comments and extra fields) is scrubbed. The comment of the archive is dropped.
+// The archive is read without the security features of Reader, so the anonymized archive
+// reproduces the problems of the original one. Entries using compression methods not supported
+// by the Writer are written deflated.
+func Anonymize(src io.ReaderAt, size int64, dst io.Writer, repl safearchive.ContentReplacement) error {
+	zr, err := zip.NewReader(src, size)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(dst)
+	for _, f := range zr.File {
+		if err := anonymizeEntry(zw, f, size, repl); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// anonymizeEntry writes the anonymized f, an entry of an archive of size bytes, to zw. The
+// uncompressed size of f is capped at what its compressed data could hold, so an entry declaring
+// more data than the archive can hold does not make the anonymized archive huge.
+func anonymizeEntry(zw *zip.Writer, f *zip.File, size int64, repl safearchive.ContentReplacement) error {
+	var r io.Reader
+	if repl == safearchive.ReplaceWithHash {
+		rc, err := f.Open()
+		if err != nil {
+			return safearchive.NewEntryError(f.Name, "", err)
+		}
+		defer rc.Close()
+		r = rc
+	}
+	content, err := safearchive.AnonymizedContent(r, plausibleSize(f, size), repl)
+	if err != nil {
+		return safearchive.NewEntryError(f.Name, "", err)
+	}
+
+	fh := &zip.FileHeader{
+		Name:           f.Name,
+		NonUTF8:        f.NonUTF8,
+		CreatorVersion: f.CreatorVersion,
+		Method:         f.Method,
+		ModifiedDate:   anonymizedModDate,
+		ExternalAttrs:  f.ExternalAttrs,
+	}
+	if fh.Method != zip.Store && fh.Method != zip.Deflate {
+		fh.Method = zip.Deflate
+	}
+	w, err := zw.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(f.Name, "/") {
+		// the Writer refuses data of directories
+		return nil
+	}
+	_, err = io.Copy(w, content)
+	return err
+}
+
+// plausibleSize returns the uncompressed size of f, capped at the size its compressed data could
+// have in an archive of size bytes with the maximum compression ratio of DEFLATE.
+func plausibleSize(f *zip.File, size int64) int64 {
+	compressed := f.CompressedSize64
+	if compressed > uint64(size) {
+		compressed = uint64(size)
+	}
+	if max := compressed * DefaultImplausibleSizeFactor; f.UncompressedSize64 > max {
+		return int64(max)
+	}
+	return int64(f.UncompressedSize64)
+}
@@ -0,0 +1,134 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sync"
+
+	"github.com/google/safearchive"
+)
+
+// ReasonChecksum means the content of an entry did not match its CRC-32 checksum when it was read
+// with Reader.OpenFile, see ChecksumReport.
+const ReasonChecksum safearchive.Reason = "zip-checksum"
+
+// ChecksumPolicy controls how the entries read with Reader.OpenFile whose content does not match
+// their CRC-32 checksum are handled.
+type ChecksumPolicy int
+
+const (
+	// ChecksumFail fails the read of the entry with a *ChecksumError once its content has been
+	// read entirely. This is the default.
+	ChecksumFail ChecksumPolicy = iota
+	// ChecksumReport yields the content of the entry regardless, recording the mismatch in the
+	// Report of the Reader (see ReasonChecksum), e.g. to salvage the data of damaged archives. The
+	// mismatch of an entry is recorded once, however many times the entry is read.
+	ChecksumReport
+)
+
+// ChecksumError is returned when the content of an entry read with Reader.OpenFile does not match
+// its CRC-32 checksum. It wraps ErrChecksum.
+type ChecksumError struct {
+	// Name is the name of the entry, as returned by the Reader.
+	Name string
+	// Expected is the checksum of the central directory, Actual the one of the content.
+	Expected, Actual uint32
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("zip: checksum error in %q: content has CRC-32 %#08x, expected %#08x", e.Name, e.Actual, e.Expected)
+}
+
+func (e *ChecksumError) Unwrap() error {
+	return ErrChecksum
+}
+
+// checksumState is the checksum policy of a Reader and the mismatches it reported. It is guarded
+// by a mutex of its own, as entries are read concurrently with the setters of the Reader.
+type checksumState struct {
+	mu       sync.Mutex
+	policy   ChecksumPolicy
+	findings []safearchive.Finding
+	// reported has the names of the entries with a finding, so reading them again does not grow
+	// the findings.
+	reported map[string]bool
+}
+
+// SetChecksumPolicy controls how the entries read with OpenFile whose content does not match their
+// checksum are handled. It applies to the entries opened afterwards.
+func (r *Reader) SetChecksumPolicy(p ChecksumPolicy) {
+	r.checksums.mu.Lock()
+	defer r.checksums.mu.Unlock()
+	r.checksums.policy = p
+}
+
+// GetChecksumPolicy returns the current checksum policy.
+func (r *Reader) GetChecksumPolicy() ChecksumPolicy {
+	r.checksums.mu.Lock()
+	defer r.checksums.mu.Unlock()
+	return r.checksums.policy
+}
+
+// OpenFile returns a ReadCloser of the content of f, an entry of the Reader, like f.Open, but
+// handles the checksum mismatches as set by the checksum policy (see SetChecksumPolicy), instead of
+// failing with the ErrChecksum of f.Open, which does not tell the entry.
+func (r *Reader) OpenFile(f *File) (io.ReadCloser, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	r.checksums.mu.Lock()
+	policy := r.checksums.policy
+	r.checksums.mu.Unlock()
+	return &checksumReader{ReadCloser: rc, state: r.checksums, policy: policy, f: f, hash: crc32.NewIEEE()}, nil
+}
+
+// checksumReader computes the checksum of the content of an entry, to report the mismatches
+// detected by the upstream reader.
+type checksumReader struct {
+	io.ReadCloser
+	state  *checksumState
+	policy ChecksumPolicy
+	f      *File
+	hash   hash.Hash32
+}
+
+func (c *checksumReader) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	c.hash.Write(b[:n])
+	// errors wrapping ErrChecksum (e.g. the authentication failures of AES encrypted entries) are
+	// not checksum mismatches
+	if err != ErrChecksum {
+		return n, err
+	}
+	e := &ChecksumError{Name: c.f.Name, Expected: c.f.CRC32, Actual: c.hash.Sum32()}
+	if c.policy == ChecksumFail {
+		return n, e
+	}
+	c.state.mu.Lock()
+	if !c.state.reported[c.f.Name] {
+		if c.state.reported == nil {
+			c.state.reported = map[string]bool{}
+		}
+		c.state.reported[c.f.Name] = true
+		c.state.findings = append(c.state.findings, safearchive.Finding{Name: c.f.Name, Reason: ReasonChecksum, Detail: e.Error()})
+	}
+	c.state.mu.Unlock()
+	return n, io.EOF
+}
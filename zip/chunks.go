@@ -0,0 +1,232 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"archive/zip" // NOLINT
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/google/safearchive"
+)
+
+// chunkState is the state of a Reader parsing the central directory of its archive in chunks, see
+// Options.DirectoryChunk. The Reader presents the current chunk as an archive of its own: its
+// entries, src and records are the ones of a view of the archive whose central directory is made
+// of the records of the chunk.
+type chunkState struct {
+	// r, size and d describe the archive (after the repairs of the tolerant mode, if any).
+	r    io.ReaderAt
+	size int64
+	d    *directoryEnd
+	// records is the maximum number of records of a chunk.
+	records int
+	// starts are the positions of the chunks discovered so far.
+	starts []int64
+	// last is set once the last chunk is discovered.
+	last bool
+	cur  int
+	// state is the state of the rules at the end of the current chunk.
+	state magicState
+	// decompressors are the decompressors registered on the Reader, registered on the readers of
+	// the chunks as well.
+	decompressors map[uint16]Decompressor
+}
+
+// newChunkState returns the state of a reader parsing the central directory of r in chunks of n
+// records, or nil if the directory has n records or less. It fails if the central directory is
+// malformed or has fewer records than declared.
+func newChunkState(r io.ReaderAt, size int64, n int) (*chunkState, error) {
+	d, err := findDirectoryEnd(r, size)
+	if err != nil {
+		return nil, err
+	}
+	if d.zip64 {
+		if err := d.readDirectory64End(r); err != nil {
+			return nil, err
+		}
+	}
+	c := &chunkState{r: r, size: size, d: d, records: n, starts: []int64{d.directoryStart(r)}}
+	if _, err := c.view(0); err != nil {
+		return nil, err
+	}
+	if c.last {
+		return nil, nil
+	}
+	return c, nil
+}
+
+// view returns the view of the archive presenting the k-th chunk, which must be discovered already.
+// It discovers the next one.
+func (c *chunkState) view(k int) (*patchedReaderAt, error) {
+	start := c.starts[k]
+	// the chunks before the k-th one are full
+	first := uint64(k) * uint64(c.records)
+	end, count := start, 0
+	for ; count < c.records && first+uint64(count) < c.d.directoryRecords; count++ {
+		n, err := c.recordLen(end, first+uint64(count))
+		if err != nil {
+			return nil, err
+		}
+		end += n
+	}
+	if k+1 == len(c.starts) && !c.last {
+		if first+uint64(count) < c.d.directoryRecords {
+			c.starts = append(c.starts, end)
+		} else {
+			c.last = true
+		}
+	}
+	records := make([]byte, end-start)
+	if _, err := c.r.ReadAt(records, start); err != nil {
+		return nil, err
+	}
+	// the records take the place of the central directory
+	split := c.starts[0]
+	return &patchedReaderAt{r: c.r, split: split, tail: append(records, c.directoryEnd(split, count, len(records))...)}, nil
+}
+
+// recordLen returns the length of the i-th central directory record, at off. Like the upstream
+// parser, it fails if the record is missing or truncated, as the directory declares more records.
+func (c *chunkState) recordLen(off int64, i uint64) (int64, error) {
+	malformed := fmt.Errorf("zip: %w: central directory record %d of %d at offset %d missing or truncated", ErrFormat, i, c.d.directoryRecords, off)
+	if off+directoryHeaderLen > c.d.offset {
+		return 0, malformed
+	}
+	var hdr [directoryHeaderLen]byte
+	if _, err := c.r.ReadAt(hdr[:], off); err != nil {
+		return 0, err
+	}
+	if binary.LittleEndian.Uint32(hdr[:]) != directoryHeaderSignature {
+		return 0, malformed
+	}
+	n := directoryHeaderLen + int64(binary.LittleEndian.Uint16(hdr[28:])) + int64(binary.LittleEndian.Uint16(hdr[30:])) + int64(binary.LittleEndian.Uint16(hdr[32:]))
+	if off+n > c.d.offset {
+		return 0, malformed
+	}
+	return n, nil
+}
+
+// directoryEnd returns the end of central directory records of a central directory of count
+// records and size bytes at start (the position of the original one), preceded by zip64 records
+// if needed. The directory has the offset of the original one, so the entries are found at the
+// same positions.
+func (c *chunkState) directoryEnd(start int64, count, size int) []byte {
+	var b []byte
+	records, dirSize, dirOffset := uint64(count), uint64(size), c.d.directoryOffset
+	if records >= 0xffff || dirSize >= 0xffffffff || dirOffset >= 0xffffffff {
+		b = binary.LittleEndian.AppendUint32(b, directory64EndSignature)
+		b = binary.LittleEndian.AppendUint64(b, directory64EndLen-12)
+		b = binary.LittleEndian.AppendUint16(b, 45)
+		b = binary.LittleEndian.AppendUint16(b, 45)
+		b = binary.LittleEndian.AppendUint32(b, 0)
+		b = binary.LittleEndian.AppendUint32(b, 0)
+		b = binary.LittleEndian.AppendUint64(b, records)
+		b = binary.LittleEndian.AppendUint64(b, records)
+		b = binary.LittleEndian.AppendUint64(b, dirSize)
+		b = binary.LittleEndian.AppendUint64(b, dirOffset)
+		b = binary.LittleEndian.AppendUint32(b, directory64LocSignature)
+		b = binary.LittleEndian.AppendUint32(b, 0)
+		b = binary.LittleEndian.AppendUint64(b, uint64(start)+dirSize)
+		b = binary.LittleEndian.AppendUint32(b, 1)
+		records, dirSize, dirOffset = 0xffff, 0xffffffff, 0xffffffff
+	}
+	b = binary.LittleEndian.AppendUint32(b, directoryEndSignature)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	b = binary.LittleEndian.AppendUint16(b, uint16(records))
+	b = binary.LittleEndian.AppendUint16(b, uint16(records))
+	b = binary.LittleEndian.AppendUint32(b, uint32(dirSize))
+	b = binary.LittleEndian.AppendUint32(b, uint32(dirOffset))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(c.d.comment)))
+	return append(b, c.d.comment...)
+}
+
+// loadChunk makes the k-th chunk the entries of the Reader.
+func (r *Reader) loadChunk(k int) error {
+	v, err := r.chunks.view(k)
+	if err != nil {
+		return err
+	}
+	o, err := zip.NewReader(v, v.size())
+	if err != nil {
+		return err
+	}
+	for method, dcomp := range r.chunks.decompressors {
+		o.RegisterDecompressor(method, dcomp)
+	}
+	r.Reader, r.originalFiles, r.src, r.size = o, o.File, v, v.size()
+	r.records, r.recordsErr, r.overlaps, r.spans = nil, nil, nil, nil
+	if r.retainRaw {
+		r.parseRecords()
+	}
+	r.loadRecords()
+	return nil
+}
+
+// replayChunks applies the rules on the chunks before the current one, so st accounts for their
+// entries, and loads the current chunk again.
+func (r *Reader) replayChunks(st *magicState) error {
+	cur := r.chunks.cur
+	for k := 0; k < cur; k++ {
+		if err := r.loadChunk(k); err != nil {
+			return err
+		}
+		if _, err := r.applyRules(st); err != nil {
+			r.loadChunk(cur)
+			return err
+		}
+	}
+	if cur == 0 {
+		return nil
+	}
+	return r.loadChunk(cur)
+}
+
+// NextChunk replaces File with the entries of the next chunk of the central directory of an
+// archive opened with Options.DirectoryChunk, and applies the security rules on them. The rules
+// carry over their state from the earlier chunks (e.g. the symbolic links seen so far), and the
+// findings about the entries of all the chunks read so far are in the Report. It returns false
+// once there are no more chunks, or the error of the rules (also returned by Err). Archives
+// opened without Options.DirectoryChunk, or with a central directory fitting a single chunk,
+// have no more chunks.
+//
+// The setters of the Reader reapply the rules on the current chunk, after reapplying them on all
+// the earlier chunks to rebuild their state.
+func (r *Reader) NextChunk() (bool, error) {
+	r.applying.Lock()
+	defer r.applying.Unlock()
+	r.mu.RLock()
+	n := *r
+	r.mu.RUnlock()
+	if n.err != nil {
+		return false, n.err
+	}
+	c := n.chunks
+	if c == nil || c.cur+1 >= len(c.starts) {
+		return false, nil
+	}
+	// like reapply, the rules are applied on a copy of the Reader without holding its lock
+	c.cur++
+	n.findings = append([]safearchive.Finding{}, n.findings...)
+	var files []*zip.File
+	if n.err = n.loadChunk(c.cur); n.err == nil {
+		files, n.err = n.applyRules(&c.state)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.publish(&n, files)
+	return r.err == nil, r.err
+}
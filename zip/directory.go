@@ -0,0 +1,283 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// This file contains a minimal parser of the zip central directory. The upstream archive/zip
+// package does not expose the raw structures, but some of the security features need them.
+
+const (
+	directoryEndSignature    = 0x06054b50
+	directory64LocSignature  = 0x07064b50
+	directory64EndSignature  = 0x06064b50
+	directoryHeaderSignature = 0x02014b50
+	fileHeaderSignature      = 0x04034b50
+	directoryEndLen          = 22
+	directory64LocLen        = 20
+	directory64EndLen        = 56
+	directoryHeaderLen       = 46
+	fileHeaderLen            = 30
+	zip64ExtraID             = 0x0001
+)
+
+// directoryEnd is the end of central directory record.
+type directoryEnd struct {
+	// offset is the position of the record in the archive.
+	offset int64
+	// raw is the record itself, including the comment (which may be truncated).
+	raw              []byte
+	directoryRecords uint64
+	directorySize    uint64
+	directoryOffset  uint64
+	commentLen       int
+	comment          []byte
+	// zip64 is set if some values of the record are stored in the zip64 end of central directory
+	// record, until they are read with readDirectory64End.
+	zip64 bool
+}
+
+// directoryRecord is a central directory file header.
+type directoryRecord struct {
+	// offset is the position of the record in the archive.
+	offset           int64
+	raw              []byte
+	flags            uint16
+	method           uint16
+	crc32            uint32
+	compressedSize   uint64
+	uncompressedSize uint64
+	// headerOffset is the position of the local file header, as stored in the record. The records
+	// of Reader.directoryRecords account for data prepended to the archive.
+	headerOffset int64
+	name         string
+	extra        []byte
+}
+
+// findDirectoryEnd looks for the end of central directory record in the last 64KiB of the archive.
+// Unlike the upstream parser, it accepts records with a truncated comment.
+func findDirectoryEnd(r io.ReaderAt, size int64) (*directoryEnd, error) {
+	n := int64(directoryEndLen + 0xffff)
+	if n > size {
+		n = size
+	}
+	buf := make([]byte, n)
+	if _, err := r.ReadAt(buf, size-n); err != nil && err != io.EOF {
+		return nil, err
+	}
+	sig := []byte{'P', 'K', 0x05, 0x06}
+	for p := len(buf) - directoryEndLen; p >= 0; p-- {
+		if !bytes.Equal(buf[p:p+4], sig) {
+			continue
+		}
+		b := buf[p:]
+		d := &directoryEnd{
+			offset:           size - n + int64(p),
+			raw:              b,
+			directoryRecords: uint64(binary.LittleEndian.Uint16(b[10:])),
+			directorySize:    uint64(binary.LittleEndian.Uint32(b[12:])),
+			directoryOffset:  uint64(binary.LittleEndian.Uint32(b[16:])),
+			commentLen:       int(binary.LittleEndian.Uint16(b[20:])),
+		}
+		d.comment = b[directoryEndLen:]
+		if len(d.comment) > d.commentLen {
+			d.comment = d.comment[:d.commentLen]
+		}
+		d.zip64 = d.directoryRecords == 0xffff || d.directorySize == 0xffffffff || d.directoryOffset == 0xffffffff
+		return d, nil
+	}
+	return nil, ErrFormat
+}
+
+// readDirectory64End replaces the values of d stored in the zip64 end of central directory
+// record. It fails if the record cannot be read, or if it or its locator is inconsistent: the
+// record must end where the locator starts, after the central directory, and both of them must
+// describe a single disk, as the archives spanning multiple disks are not supported.
+func (d *directoryEnd) readDirectory64End(r io.ReaderAt) error {
+	invalid := func(detail string) error {
+		return fmt.Errorf("zip: %w: zip64 end of central directory record %s", ErrFormat, detail)
+	}
+	if d.offset < directory64LocLen+directory64EndLen {
+		return invalid("missing")
+	}
+	locOffset := d.offset - directory64LocLen
+	var loc [directory64LocLen]byte
+	if _, err := r.ReadAt(loc[:], locOffset); err != nil || binary.LittleEndian.Uint32(loc[:]) != directory64LocSignature {
+		return invalid("locator missing")
+	}
+	if disk, disks := binary.LittleEndian.Uint32(loc[4:]), binary.LittleEndian.Uint32(loc[16:]); disk != 0 || disks != 1 {
+		return invalid(fmt.Sprintf("on disk %d of %d", disk, disks))
+	}
+	off := binary.LittleEndian.Uint64(loc[8:])
+	if off > uint64(locOffset-directory64EndLen) {
+		return invalid(fmt.Sprintf("at offset %d, after its locator at offset %d", off, locOffset))
+	}
+	var b [directory64EndLen]byte
+	if _, err := r.ReadAt(b[:], int64(off)); err != nil || binary.LittleEndian.Uint32(b[:]) != directory64EndSignature {
+		return invalid(fmt.Sprintf("missing at offset %d", off))
+	}
+	if size := binary.LittleEndian.Uint64(b[4:]); size < directory64EndLen-12 || size != uint64(locOffset)-off-12 {
+		return invalid(fmt.Sprintf("of %d bytes at offset %d does not end at its locator at offset %d", size, off, locOffset))
+	}
+	if disk, dirDisk := binary.LittleEndian.Uint32(b[16:]), binary.LittleEndian.Uint32(b[20:]); disk != 0 || dirDisk != 0 {
+		return invalid(fmt.Sprintf("with disk numbers %d and %d", disk, dirDisk))
+	}
+	onDisk, records := binary.LittleEndian.Uint64(b[24:]), binary.LittleEndian.Uint64(b[32:])
+	if onDisk != records {
+		return invalid(fmt.Sprintf("with %d records on this disk of %d", onDisk, records))
+	}
+	dirSize, dirOffset := binary.LittleEndian.Uint64(b[40:]), binary.LittleEndian.Uint64(b[48:])
+	if dirOffset > off || dirSize > off-dirOffset {
+		return invalid(fmt.Sprintf("at offset %d, in the central directory", off))
+	}
+	d.directoryRecords, d.directorySize, d.directoryOffset = records, dirSize, dirOffset
+	d.zip64 = false
+	return nil
+}
+
+// directoryStart returns the position of the first central directory record in the archive.
+// Like the upstream parser, it accounts for data prepended to the archive (e.g. self-extracting
+// executables).
+func (d *directoryEnd) directoryStart(r io.ReaderAt) int64 {
+	base := d.offset - int64(d.directorySize) - int64(d.directoryOffset)
+	if base > 0 {
+		var sig [4]byte
+		if _, err := r.ReadAt(sig[:], int64(d.directoryOffset)); err == nil && binary.LittleEndian.Uint32(sig[:]) == directoryHeaderSignature {
+			base = 0
+		}
+	}
+	if base < 0 {
+		base = 0
+	}
+	return base + int64(d.directoryOffset)
+}
+
+// readDirectoryRecords reads the central directory records starting at start until the first
+// invalid or truncated record, the end of central directory record, or limit records (if limit is
+// positive).
+func readDirectoryRecords(r io.ReaderAt, start int64, d *directoryEnd, limit int) ([]directoryRecord, error) {
+	var re []directoryRecord
+	end := d.offset
+	for off := start; off+directoryHeaderLen <= end; {
+		if limit > 0 && len(re) >= limit {
+			break
+		}
+		var hdr [directoryHeaderLen]byte
+		if _, err := r.ReadAt(hdr[:], off); err != nil {
+			return re, err
+		}
+		if binary.LittleEndian.Uint32(hdr[:]) != directoryHeaderSignature {
+			break
+		}
+		nameLen := int(binary.LittleEndian.Uint16(hdr[28:]))
+		extraLen := int(binary.LittleEndian.Uint16(hdr[30:]))
+		commentLen := int(binary.LittleEndian.Uint16(hdr[32:]))
+		recLen := directoryHeaderLen + nameLen + extraLen + commentLen
+		if off+int64(recLen) > end {
+			break
+		}
+		raw := make([]byte, recLen)
+		if _, err := r.ReadAt(raw, off); err != nil {
+			return re, err
+		}
+		rec := directoryRecord{
+			offset:           off,
+			raw:              raw,
+			flags:            binary.LittleEndian.Uint16(raw[8:]),
+			method:           binary.LittleEndian.Uint16(raw[10:]),
+			crc32:            binary.LittleEndian.Uint32(raw[16:]),
+			compressedSize:   uint64(binary.LittleEndian.Uint32(raw[20:])),
+			uncompressedSize: uint64(binary.LittleEndian.Uint32(raw[24:])),
+			headerOffset:     int64(binary.LittleEndian.Uint32(raw[42:])),
+			name:             string(raw[directoryHeaderLen : directoryHeaderLen+nameLen]),
+			extra:            raw[directoryHeaderLen+nameLen : directoryHeaderLen+nameLen+extraLen],
+		}
+		rec.readZip64Extra()
+		re = append(re, rec)
+		off += int64(recLen)
+	}
+	return re, nil
+}
+
+// readZip64Extra replaces the sizes and the position of the local file header of rec stored in
+// its zip64 extra field, like the upstream parser: the field holds the values whose 32-bit field
+// of the record is 0xffffffff, in this order.
+func (rec *directoryRecord) readZip64Extra() {
+	var field []byte
+	for extra := rec.extra; len(extra) >= 4; {
+		id, n := binary.LittleEndian.Uint16(extra), int(binary.LittleEndian.Uint16(extra[2:]))
+		if 4+n > len(extra) {
+			return
+		}
+		if id == zip64ExtraID {
+			field = extra[4 : 4+n]
+			break
+		}
+		extra = extra[4+n:]
+	}
+	headerOffset := uint64(rec.headerOffset)
+	for _, v := range []*uint64{&rec.uncompressedSize, &rec.compressedSize, &headerOffset} {
+		if *v != 0xffffffff || len(field) < 8 {
+			continue
+		}
+		*v, field = binary.LittleEndian.Uint64(field), field[8:]
+	}
+	rec.headerOffset = int64(headerOffset)
+}
+
+// patchedReaderAt presents an archive whose bytes from split onwards are replaced by tail.
+type patchedReaderAt struct {
+	r     io.ReaderAt
+	split int64
+	tail  []byte
+}
+
+func (p *patchedReaderAt) size() int64 {
+	return p.split + int64(len(p.tail))
+}
+
+func (p *patchedReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	n := 0
+	if off < p.split {
+		m := len(b)
+		if int64(m) > p.split-off {
+			m = int(p.split - off)
+		}
+		k, err := p.r.ReadAt(b[:m], off)
+		n += k
+		if err != nil && !(err == io.EOF && k == m) {
+			return n, err
+		}
+		off += int64(k)
+		b = b[k:]
+	}
+	if len(b) == 0 {
+		return n, nil
+	}
+	if off-p.split >= int64(len(p.tail)) {
+		return n, io.EOF
+	}
+	k := copy(b, p.tail[off-p.split:])
+	n += k
+	if k < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
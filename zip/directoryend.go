@@ -0,0 +1,149 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// DirectoryEndError describes an inconsistency of the end of central directory record of an
+// archive, see Options.ValidateDirectoryEnd. It wraps ErrFormat.
+type DirectoryEndError struct {
+	// Offset is the position of the record in the archive.
+	Offset int64
+	// Field is the inconsistent value, e.g. "records" or "comment length".
+	Field string
+	// Declared is the value stored in the record, and Actual the one found in the archive.
+	Declared, Actual uint64
+}
+
+func (e *DirectoryEndError) Error() string {
+	return fmt.Sprintf("zip: end of central directory record at offset %d: %s declared %d, found %d", e.Offset, e.Field, e.Declared, e.Actual)
+}
+
+func (e *DirectoryEndError) Unwrap() error {
+	return ErrFormat
+}
+
+// checkComment enforces Options.MaxCommentLength.
+func checkComment(r io.ReaderAt, size int64, opts Options) error {
+	if opts.MaxCommentLength <= 0 {
+		return nil
+	}
+	d, err := findDirectoryEnd(r, size)
+	if err != nil {
+		// the upstream parser fails as well
+		return nil
+	}
+	if d.commentLen > opts.MaxCommentLength {
+		return fmt.Errorf("zip: %w: archive comment of %d bytes, the limit is %d", ErrLimitExceeded, d.commentLen, opts.MaxCommentLength)
+	}
+	return nil
+}
+
+// validateDirectoryEnd checks the end of central directory record of the archive against the
+// central directory, see Options.ValidateDirectoryEnd.
+func validateDirectoryEnd(r io.ReaderAt, size int64) error {
+	d, err := findDirectoryEnd(r, size)
+	if err != nil {
+		// the upstream parser fails as well
+		return nil
+	}
+	inconsistent := func(field string, declared, actual uint64) error {
+		return &DirectoryEndError{Offset: d.offset, Field: field, Declared: declared, Actual: actual}
+	}
+	if actual := uint64(len(d.raw) - directoryEndLen); uint64(d.commentLen) != actual {
+		// a truncated comment, or data following the archive
+		return inconsistent("comment length", uint64(d.commentLen), actual)
+	}
+	if n, err := endRecords(r, size); err != nil {
+		return err
+	} else if n > 1 {
+		return inconsistent("end of central directory records", 1, n)
+	}
+	if disk := binary.LittleEndian.Uint16(d.raw[4:]); disk != 0 {
+		return inconsistent("disk number", uint64(disk), 0)
+	}
+	if disk := binary.LittleEndian.Uint16(d.raw[6:]); disk != 0 {
+		return inconsistent("directory disk number", uint64(disk), 0)
+	}
+	if onDisk := binary.LittleEndian.Uint16(d.raw[8:]); uint64(onDisk) != d.directoryRecords && !d.zip64 {
+		return inconsistent("records on this disk", uint64(onDisk), d.directoryRecords)
+	}
+	zip64 := d.zip64
+	if zip64 {
+		if err := d.readDirectory64End(r); err != nil {
+			return err
+		}
+	}
+	start := d.directoryStart(r)
+	// The central directory ends where the record starts, or where the zip64 records start in
+	// zip64 archives, whose position is checked by readDirectory64End.
+	if end := start + int64(d.directorySize); !zip64 && end != d.offset {
+		return inconsistent("directory end", uint64(end), uint64(d.offset))
+	}
+	records, dirSize := scanDirectory(r, start, d.offset)
+	if records != d.directoryRecords {
+		return inconsistent("records", d.directoryRecords, records)
+	}
+	if dirSize != d.directorySize {
+		return inconsistent("directory size", d.directorySize, dirSize)
+	}
+	return nil
+}
+
+// endRecords returns the number of end of central directory records in the last 64KiB of the
+// archive whose comment ends exactly at the end of the archive. There is a single one unless a
+// comment holds another record, which parsers may pick instead.
+func endRecords(r io.ReaderAt, size int64) (uint64, error) {
+	n := int64(directoryEndLen + 0xffff)
+	if n > size {
+		n = size
+	}
+	buf := make([]byte, n)
+	if _, err := r.ReadAt(buf, size-n); err != nil && err != io.EOF {
+		return 0, err
+	}
+	var records uint64
+	sig := []byte{'P', 'K', 0x05, 0x06}
+	for p := 0; p+directoryEndLen <= len(buf); p++ {
+		if bytes.Equal(buf[p:p+4], sig) && p+directoryEndLen+int(binary.LittleEndian.Uint16(buf[p+20:])) == len(buf) {
+			records++
+		}
+	}
+	return records, nil
+}
+
+// scanDirectory returns the number of central directory records from start until the first
+// invalid one or end, and their total size.
+func scanDirectory(r io.ReaderAt, start, end int64) (records, size uint64) {
+	for off := start; off+directoryHeaderLen <= end; {
+		var hdr [directoryHeaderLen]byte
+		if _, err := r.ReadAt(hdr[:], off); err != nil || binary.LittleEndian.Uint32(hdr[:]) != directoryHeaderSignature {
+			break
+		}
+		recLen := directoryHeaderLen + int64(binary.LittleEndian.Uint16(hdr[28:])) + int64(binary.LittleEndian.Uint16(hdr[30:])) + int64(binary.LittleEndian.Uint16(hdr[32:]))
+		if off+recLen > end {
+			break
+		}
+		records++
+		size += uint64(recLen)
+		off += recLen
+	}
+	return records, size
+}
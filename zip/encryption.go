@@ -0,0 +1,381 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"archive/zip" // NOLINT
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+
+	"github.com/google/safearchive"
+)
+
+// ErrPassword is returned when reading an AES encrypted entry with a wrong password.
+var ErrPassword = errors.New("zip: wrong password")
+
+// EncryptionPolicy controls how encrypted entries are handled: entries encrypted with the
+// traditional PKWARE encryption, and entries encrypted with AES (the WinZip AE-1 and AE-2
+// formats). Without decryption, the upstream reader returns the encrypted data of these entries,
+// or fails with ErrAlgorithm for the AES ones.
+type EncryptionPolicy int
+
+const (
+	// EncryptedAllow keeps the encrypted entries, flagging them in the Report only. This is the
+	// default.
+	EncryptedAllow EncryptionPolicy = iota
+	// EncryptedSkip drops the encrypted entries.
+	EncryptedSkip
+	// EncryptedReject rejects archives with encrypted entries with an error wrapping
+	// ErrEncryptedEntry.
+	EncryptedReject
+	// EncryptedDecrypt keeps the AES encrypted entries, decrypted when they are read with the
+	// passwords of the PasswordProvider of the Reader (see SetPasswordProvider), and drops the
+	// other encrypted entries. All of them are dropped if there is no PasswordProvider.
+	EncryptedDecrypt
+)
+
+// AES is the method of the AES encrypted entries. Their actual method is in their AES extra field.
+const AES uint16 = 99
+
+// aesExtraID is the ID of the extra field of the AES encrypted entries.
+const aesExtraID = 0x9901
+
+// flagEncrypted and flagDataDescriptor are the bits of the general purpose flags of the encrypted
+// entries and of the entries followed by a data descriptor.
+const (
+	flagEncrypted      = 0x1
+	flagDataDescriptor = 0x8
+)
+
+// IsEncrypted reports if f is encrypted, with the traditional PKWARE encryption or with AES.
+func IsEncrypted(f *File) bool {
+	return f.Flags&flagEncrypted != 0 || f.Method == AES
+}
+
+// PasswordProvider returns the password of the AES encrypted entry called name (as named in the
+// archive, before sanitization). It is called every time the entry is opened, possibly
+// concurrently.
+type PasswordProvider func(name string) (string, error)
+
+// aesEntry describes an AES encrypted entry.
+type aesEntry struct {
+	name string
+	// strength is the AES key size: 1, 2 or 3 for 128, 192 or 256 bits.
+	strength int
+	method   uint16
+}
+
+// aesState is the decryption state of a Reader. It is guarded by a mutex of its own, because the
+// rules may open entries while they hold the mutex of the Reader.
+type aesState struct {
+	mu       sync.Mutex
+	provider PasswordProvider
+	// entries are the AES encrypted entries seen by the rules, by the offset of their data.
+	entries map[int64]aesEntry
+}
+
+// SetEncryptionPolicy controls how encrypted entries are handled and reapplies the security rules
+// on the set of files in the archive.
+func (r *Reader) SetEncryptionPolicy(p EncryptionPolicy) {
+	r.reapply(func() { r.encryption = p })
+}
+
+// GetEncryptionPolicy returns the current encryption policy.
+func (r *Reader) GetEncryptionPolicy() EncryptionPolicy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.encryption
+}
+
+// SetPasswordProvider sets the provider of the passwords of the AES encrypted entries, decrypted
+// when the encryption policy is EncryptedDecrypt, registers the decompressor of the AES method
+// and reapplies the security rules on the set of files in the archive. The decrypted data of the
+// entries is authenticated once it has been read entirely: reading a tampered entry fails with an
+// error wrapping ErrChecksum, and reading it with a wrong password fails with ErrPassword. Only
+// the Store and Deflate methods are supported in encrypted entries.
+// Decryption relies on io.SectionReader.Outer, so it requires Go 1.22 or later.
+// In the hardened profile (see safearchive.Hardened) SetPasswordProvider does nothing.
+func (r *Reader) SetPasswordProvider(p PasswordProvider) {
+	if safearchive.Hardened {
+		return
+	}
+	r.reapply(func() {
+		r.aes.mu.Lock()
+		r.aes.provider = p
+		r.aes.mu.Unlock()
+		r.registerDecompressor(AES, r.aes.decompressor)
+	})
+}
+
+// checkEncryption applies the encryption policy on encrypted entries. It runs before the rules
+// changing the extra fields, whose AES field describes the entry.
+func checkEncryption(r *Reader, st *magicState, f *zip.File) safearchive.Verdict {
+	if !IsEncrypted(f) {
+		return safearchive.Pass
+	}
+	e, isAES := aesEntryOf(f)
+	detail := "traditional PKWARE encryption"
+	if isAES {
+		detail = fmt.Sprintf("AES-%d encryption", 64+64*e.strength)
+	}
+	v := safearchive.Verdict{Reason: safearchive.ReasonEncrypted, Detail: detail}
+	switch r.encryption {
+	case EncryptedSkip:
+		v.Action = safearchive.ActionDropped
+	case EncryptedReject:
+		v.Action = safearchive.ActionRejected
+	case EncryptedDecrypt:
+		if !isAES || !r.aes.add(st.original, e, f) {
+			v.Action = safearchive.ActionDropped
+		} else if f.CRC32 == 0 {
+			// The AE-2 format leaves the checksums empty (the data is authenticated instead),
+			// but the upstream reader verifies the one of the data descriptor regardless.
+			f.Flags &^= flagDataDescriptor
+		}
+	}
+	return v
+}
+
+// aesEntryOf parses the AES extra field of f.
+func aesEntryOf(f *zip.File) (aesEntry, bool) {
+	if f.Method != AES {
+		return aesEntry{}, false
+	}
+	for b := f.Extra; len(b) >= 4; {
+		id, n := binary.LittleEndian.Uint16(b), int(binary.LittleEndian.Uint16(b[2:]))
+		if len(b) < 4+n {
+			break
+		}
+		// the version (1 or 2), the vendor ID "AE", the strength and the actual method
+		if id == aesExtraID && n == 7 && string(b[6:8]) == "AE" && b[8] >= 1 && b[8] <= 3 {
+			return aesEntry{strength: int(b[8]), method: binary.LittleEndian.Uint16(b[9:])}, true
+		}
+		b = b[4+n:]
+	}
+	return aesEntry{}, false
+}
+
+// add records the AES encrypted entry f called name, reporting whether it can be decrypted.
+func (a *aesState) add(name string, e aesEntry, f *zip.File) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.provider == nil {
+		return false
+	}
+	off, err := f.DataOffset()
+	if err != nil {
+		// reading the entry fails as well
+		return true
+	}
+	if a.entries == nil {
+		a.entries = map[int64]aesEntry{}
+	}
+	e.name = name
+	a.entries[off] = e
+	return true
+}
+
+// decompressor is the Decompressor of the AES method. The upstream reader supplies the data of the
+// entries as an io.SectionReader of the archive, whose offset identifies the entry.
+func (a *aesState) decompressor(r io.Reader) io.ReadCloser {
+	sr, ok := r.(interface {
+		Outer() (io.ReaderAt, int64, int64)
+	})
+	if !ok {
+		return errReadCloser{fmt.Errorf("%w: AES decryption requires Go 1.22", ErrAlgorithm)}
+	}
+	_, off, size := sr.Outer()
+	a.mu.Lock()
+	e, ok := a.entries[off]
+	provider := a.provider
+	a.mu.Unlock()
+	if !ok || provider == nil {
+		return errReadCloser{fmt.Errorf("%w: AES encrypted entry", ErrAlgorithm)}
+	}
+	password, err := provider(e.name)
+	if err != nil {
+		return errReadCloser{fmt.Errorf("zip: password of %q: %w", e.name, err)}
+	}
+	dr, err := newAESReader(r, size, e.strength, password)
+	if err != nil {
+		return errReadCloser{err}
+	}
+	switch e.method {
+	case zip.Store:
+		return aesDecompressed{io.NopCloser(dr), dr}
+	case zip.Deflate:
+		return aesDecompressed{flate.NewReader(dr), dr}
+	}
+	return errReadCloser{fmt.Errorf("%w: method %d in an AES encrypted entry", ErrAlgorithm, e.method)}
+}
+
+// aesDecompressed is the decompressed data of an AES encrypted entry. Decompressors may stop
+// reading at the end of their stream, so the rest of the encrypted data is read once they are
+// done, authenticating it.
+type aesDecompressed struct {
+	io.ReadCloser
+	dr *aesReader
+}
+
+func (a aesDecompressed) Read(b []byte) (int, error) {
+	n, err := a.ReadCloser.Read(b)
+	if err == io.EOF {
+		if _, err := io.Copy(io.Discard, a.dr); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+const (
+	// aesIterations is the iteration count of the key derivation of the AES encryption.
+	aesIterations = 1000
+	// aesVerifierLen and aesMACLen are the lengths of the password verifier preceding the
+	// encrypted data and of the authentication code following it.
+	aesVerifierLen = 2
+	aesMACLen      = 10
+)
+
+// aesReader decrypts the data of an AES encrypted entry: AES in counter mode, with a little-endian
+// counter starting at 1, authenticated by HMAC-SHA1 over the encrypted data.
+type aesReader struct {
+	r       io.Reader
+	block   cipher.Block
+	mac     hash.Hash
+	counter [aes.BlockSize]byte
+	stream  [aes.BlockSize]byte
+	used    int
+	// left is the length of the encrypted data not read yet.
+	left int64
+	err  error
+}
+
+// newAESReader reads the salt and the password verifier of the data of size bytes in r, which it
+// decrypts with password.
+func newAESReader(r io.Reader, size int64, strength int, password string) (*aesReader, error) {
+	keyLen := 8 + 8*strength
+	saltLen := keyLen / 2
+	if size < int64(saltLen+aesVerifierLen+aesMACLen) {
+		return nil, fmt.Errorf("%w: AES encrypted entry of %d bytes", ErrFormat, size)
+	}
+	hdr := make([]byte, saltLen+aesVerifierLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("zip: AES header: %w", err)
+	}
+	key := pbkdf2SHA1([]byte(password), hdr[:saltLen], aesIterations, 2*keyLen+aesVerifierLen)
+	if subtle.ConstantTimeCompare(key[2*keyLen:], hdr[saltLen:]) != 1 {
+		return nil, ErrPassword
+	}
+	block, err := aes.NewCipher(key[:keyLen])
+	if err != nil {
+		return nil, err
+	}
+	return &aesReader{
+		r:     r,
+		block: block,
+		mac:   hmac.New(sha1.New, key[keyLen:2*keyLen]),
+		used:  aes.BlockSize,
+		left:  size - int64(len(hdr)) - aesMACLen,
+	}, nil
+}
+
+func (a *aesReader) Read(b []byte) (int, error) {
+	if a.err != nil {
+		return 0, a.err
+	}
+	if a.left == 0 {
+		a.err = a.verify()
+		return 0, a.err
+	}
+	if int64(len(b)) > a.left {
+		b = b[:a.left]
+	}
+	n, err := a.r.Read(b)
+	a.left -= int64(n)
+	a.mac.Write(b[:n])
+	for i := range b[:n] {
+		if a.used == aes.BlockSize {
+			a.next()
+		}
+		b[i] ^= a.stream[a.used]
+		a.used++
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	a.err = err
+	return n, err
+}
+
+// next increments the counter and encrypts it into the key stream.
+func (a *aesReader) next() {
+	for i := range a.counter {
+		a.counter[i]++
+		if a.counter[i] != 0 {
+			break
+		}
+	}
+	a.block.Encrypt(a.stream[:], a.counter[:])
+	a.used = 0
+}
+
+// verify checks the authentication code following the encrypted data.
+func (a *aesReader) verify() error {
+	var code [aesMACLen]byte
+	if _, err := io.ReadFull(a.r, code[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if !hmac.Equal(a.mac.Sum(nil)[:aesMACLen], code[:]) {
+		return fmt.Errorf("%w: AES authentication code mismatch", ErrChecksum)
+	}
+	return io.EOF
+}
+
+// pbkdf2SHA1 derives a key of keyLen bytes from password and salt with PBKDF2 (RFC 8018) and
+// HMAC-SHA1.
+func pbkdf2SHA1(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha1.New, password)
+	var key, u []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, block))
+		u = prf.Sum(u[:0])
+		t := append([]byte{}, u...)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
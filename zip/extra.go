@@ -0,0 +1,77 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"archive/zip" // NOLINT
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/google/safearchive"
+)
+
+// SetExtraFieldAllowlist sets the IDs of the extra fields kept by DropExtraFields (e.g. 0x5455, the
+// extended timestamp) and reapplies the security rules on the set of files in the archive. By
+// default, all of them are dropped.
+func (r *Reader) SetExtraFieldAllowlist(ids []uint16) {
+	r.reapply(func() { r.extraFields = append([]uint16{}, ids...) })
+}
+
+// SetExtraFieldAllowlist sets the IDs of the extra fields kept by DropExtraFields, see
+// Reader.SetExtraFieldAllowlist.
+func (w *Writer) SetExtraFieldAllowlist(ids []uint16) {
+	w.state.extraFields = append([]uint16{}, ids...)
+}
+
+// extraFieldAllowed reports whether id is in the allow list of the extra fields.
+func (r *Reader) extraFieldAllowed(id uint16) bool {
+	for _, a := range r.extraFields {
+		if a == id {
+			return true
+		}
+	}
+	return false
+}
+
+// dropExtraFields drops the extra fields not allow listed from the header. The upstream reader has
+// parsed the fields it interprets (e.g. the zip64 sizes and the timestamps) already, so dropping
+// them does not change how the entry is read. A truncated trailing field is dropped as well.
+func dropExtraFields(r *Reader, st *magicState, f *zip.File) safearchive.Verdict {
+	if r.securityMode&DropExtraFields == 0 || len(f.Extra) == 0 {
+		return safearchive.Pass
+	}
+	var kept []byte
+	var dropped []string
+	for b := f.Extra; len(b) > 0; {
+		if len(b) < 4 || len(b) < 4+int(binary.LittleEndian.Uint16(b[2:])) {
+			dropped = append(dropped, "truncated field")
+			break
+		}
+		id, n := binary.LittleEndian.Uint16(b), 4+int(binary.LittleEndian.Uint16(b[2:]))
+		if r.extraFieldAllowed(id) {
+			kept = append(kept, b[:n]...)
+		} else {
+			dropped = append(dropped, fmt.Sprintf("%#04x", id))
+		}
+		b = b[n:]
+	}
+	// the header is a copy, but its Extra shares the array of the original
+	f.Extra = kept
+	if len(dropped) == 0 {
+		return safearchive.Pass
+	}
+	return safearchive.Verdict{Action: safearchive.ActionModified, Reason: safearchive.ReasonExtraFields, Detail: "dropped " + strings.Join(dropped, ", ")}
+}
@@ -0,0 +1,108 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"path/filepath"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/sanitizer"
+)
+
+// EntryFilter decides whether an entry is kept in File, see Reader.SetEntryFilter.
+type EntryFilter func(f *File) (keep bool, err error)
+
+// SetEntryFilter sets a filter called on every entry kept by the security features and the rules,
+// so applications can implement their own policies (e.g. extension denylists or path allowlists)
+// inside the safe processing of the archive, and reapplies the security rules on the set of files
+// in the archive. Entries it does not keep are left out of File without being reported; if it
+// fails, File is emptied and Err returns a safearchive.EntryError wrapping its error. The filter
+// sees a copy of the entries as sanitized, so its changes are discarded rather than escaping the
+// security features: custom rules (see AddRule) can rename entries. As the rules are reapplied by
+// the setters of the reader, the filter may see the same entry multiple times. Like the hook of
+// OnSanitize, the filter may use the getters of the Reader, but not its setters. A nil filter
+// keeps every entry.
+func (r *Reader) SetEntryFilter(f EntryFilter) error {
+	return r.reapply(func() { r.filter = f })
+}
+
+// applyFilter applies the entry filter of the Reader on f, the i-th entry of the archive.
+func (r *Reader) applyFilter(i int, f *File) (bool, error) {
+	if r.filter == nil {
+		return true, nil
+	}
+	c := *f
+	c.Extra = append([]byte(nil), f.Extra...)
+	keep, err := r.filter(&c)
+	if err != nil {
+		e := safearchive.NewEntryError(r.originalFiles[i].Name, "", err)
+		if r.records != nil {
+			e.Offset = r.records[i].offset
+		}
+		return false, e
+	}
+	return keep, nil
+}
+
+// SetIncludePatterns restricts File to the entries matched by one of the glob patterns (see
+// safearchive.Patterns), e.g. "docs/*.md", like the --wildcards of tar, and reapplies the security
+// rules on the set of files in the archive. Patterns are matched against the sanitized names of
+// the entries, so renamed entries are matched by their new names. The other entries are still
+// checked by the security features. It fails with path.ErrBadPattern, leaving the Reader
+// unchanged, if one of the patterns is malformed. No patterns (the default) include every entry.
+func (r *Reader) SetIncludePatterns(patterns ...string) error {
+	if err := (safearchive.Patterns{Include: patterns}).Validate(); err != nil {
+		return err
+	}
+	r.reapply(func() { r.patterns.Include = patterns })
+	return nil
+}
+
+// SetExcludePatterns leaves out of File the entries matched by one of the glob patterns, even if
+// they are included, like SetIncludePatterns.
+func (r *Reader) SetExcludePatterns(patterns ...string) error {
+	if err := (safearchive.Patterns{Exclude: patterns}).Validate(); err != nil {
+		return err
+	}
+	r.reapply(func() { r.patterns.Exclude = patterns })
+	return nil
+}
+
+// selected reports whether the entry named name (see magicState.selectName) is in the subtree of
+// the Reader and matched by its patterns.
+func (r *Reader) selected(name string) bool {
+	return sanitizer.InSubtree(name, r.subtree) && r.patterns.Match(filepath.ToSlash(name))
+}
+
+// SetStripComponents removes the n leading path components of the names of the entries of File,
+// like the --strip-components of tar, and reapplies the security rules on the set of files in the
+// archive. SetPrefix prepends a prefix to them. They are applied on the sanitized names and cannot
+// reintroduce ".." path elements (see sanitizer.StripComponents). As the contents of the entries
+// are not rewritten, the symbolic links whose relative target would have to change to keep
+// pointing to the same entry (see sanitizer.StripLinkTarget) are dropped with
+// safearchive.ReasonSymlinkTarget. The names are rewritten before the entries are tracked by the
+// other security features (e.g. PreventSymlinkTraversal), so these check the final names;
+// SetSubtree and the patterns select the entries by their names in the archive though. Entries
+// with no more than n components are left out. Zero (the default) strips nothing.
+func (r *Reader) SetStripComponents(n int) {
+	r.reapply(func() { r.strip = n })
+}
+
+// SetPrefix prepends prefix (e.g. "vendor/") to the names of the entries of File and reapplies the
+// security rules on the set of files in the archive, see SetStripComponents. An empty prefix (the
+// default) prepends nothing.
+func (r *Reader) SetPrefix(prefix string) {
+	r.reapply(func() { r.prefix = prefix })
+}
@@ -0,0 +1,116 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"io"
+	"io/fs"
+
+	"github.com/google/safearchive/internal/fstree"
+)
+
+// FS is a read-only file system of the regular files and directories of a snapshot of the files of
+// a Reader (see Reader.FS), so with the security features of the Reader applied. It implements
+// fs.ReadDirFS, fs.StatFS and fs.GlobFS.
+//
+// Only the sanitized names of the entries can be opened. Symbolic links are left out, along with
+// the entries below them, whether or not PreventSymlinkTraversal is enabled; special files are
+// left out as well. When the archive has several entries with the same name, the last one wins.
+// An FS is safe for concurrent use.
+type FS struct {
+	tree *fstree.Tree
+}
+
+// FS returns the file system of the files of the Reader, as they were left by the last
+// application of the rules. Like Entries, it is a snapshot: reconfiguring the Reader afterwards
+// does not change it.
+func (r *Reader) FS() *FS {
+	return newFS(r.Entries())
+}
+
+// Open opens the named file of the file system of the Reader, see FS. Unlike the Open method of
+// archive/zip, it only serves the sanitized names of the entries and always reflects the last
+// application of the rules.
+func (r *Reader) Open(name string) (fs.File, error) {
+	r.mu.RLock()
+	fsys := r.fsys
+	r.mu.RUnlock()
+	if fsys == nil {
+		// the snapshot is taken under the lock, so that a concurrent application of the rules
+		// cannot be overwritten by an outdated one
+		r.mu.Lock()
+		if r.fsys == nil {
+			r.fsys = newFS(&Entries{files: r.File, err: r.err})
+		}
+		fsys = r.fsys
+		r.mu.Unlock()
+	}
+	return fsys.Open(name)
+}
+
+func newFS(entries *Entries) *FS {
+	f := &FS{tree: fstree.New(func(n *fstree.Node) (io.ReadCloser, error) {
+		return n.Data().(*File).Open()
+	})}
+	var links []string
+	for {
+		zf, ok := entries.Next()
+		if !ok {
+			break
+		}
+		name := fstree.Name(zf.Name)
+		mode := zf.Mode()
+		switch {
+		case name == ".":
+		case mode&fs.ModeSymlink != 0:
+			links = append(links, name)
+		case mode.IsDir():
+			f.tree.Add(name, fstree.NewNode(mode, 0, zf.Modified, nil))
+		case mode.IsRegular():
+			f.tree.Add(name, fstree.NewNode(mode, int64(zf.UncompressedSize64), zf.Modified, zf))
+		}
+	}
+	// entries shadowed by a symbolic link must not be reachable through another one of the same
+	// name
+	for _, l := range links {
+		f.tree.Remove(l)
+	}
+	return f
+}
+
+// Open opens the named file.
+func (f *FS) Open(name string) (fs.File, error) {
+	return f.tree.Open(name)
+}
+
+// ReadDir reads the named directory and returns its entries sorted by name.
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return f.tree.ReadDir(name)
+}
+
+// Stat returns a FileInfo describing the named file.
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	return f.tree.Stat(name)
+}
+
+// readDirFS hides the Glob method of an FS from fs.Glob.
+type readDirFS struct {
+	fs.ReadDirFS
+}
+
+// Glob returns the names of the files matching pattern, see fs.Glob.
+func (f *FS) Glob(pattern string) ([]string, error) {
+	return fs.Glob(readDirFS{f}, pattern)
+}
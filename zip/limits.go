@@ -0,0 +1,139 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/internal/limits"
+)
+
+// ErrLimitExceeded is wrapped by the error of a Reader whose archive exceeds its Limits.
+var ErrLimitExceeded = safearchive.ErrLimitExceeded
+
+// Limits are resource limits of a Reader protecting against zip bombs. Zero values mean no limit.
+//
+// The limits are checked against the sizes declared by the central directory when the security
+// rules are applied. The readers returned by File.Open fail with ErrFormat when an entry
+// decompresses to more data than declared, so the limits bound the data read from the archive as
+// well.
+type Limits struct {
+	// MaxEntries is the maximum number of entries of the archive, including the ones skipped by
+	// the security features.
+	MaxEntries int
+	// MaxEntrySize is the maximum uncompressed size of an entry.
+	MaxEntrySize int64
+	// MaxTotalUncompressed is the maximum total uncompressed size of the entries, including the
+	// ones skipped by the security features.
+	MaxTotalUncompressed int64
+	// MaxRatio is the maximum ratio of the uncompressed and compressed size of an entry. Entries
+	// smaller than 1MiB are exempt.
+	MaxRatio float64
+}
+
+// SetLimits sets the resource limits of the reader and reapplies the security rules on the set of
+// files in the archive. If the archive exceeds the limits, File is emptied and the returned error
+// (also returned by Err) is a safearchive.EntryError wrapping ErrLimitExceeded.
+func (r *Reader) SetLimits(l Limits) error {
+	return r.reapply(func() { r.limits = l })
+}
+
+// GetLimits returns the current resource limits.
+func (r *Reader) GetLimits() Limits {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.limits
+}
+
+// checkLimits returns the error of the first entry of the archive exceeding the limits, counting
+// the entries already seen by st, and adds the entries to st.
+func (r *Reader) checkLimits(st *magicState) error {
+	l := r.limits
+	if l.MaxEntries > 0 && st.entries+len(r.originalFiles) > l.MaxEntries {
+		return r.limitExceeded(l.MaxEntries-st.entries, fmt.Sprintf("archive has more than %d entries", l.MaxEntries))
+	}
+	for i, f := range r.originalFiles {
+		size := f.UncompressedSize64
+		switch {
+		case l.MaxEntrySize > 0 && size > uint64(l.MaxEntrySize):
+			return r.limitExceeded(i, fmt.Sprintf("entry declares %d bytes, the limit is %d", size, l.MaxEntrySize))
+		case l.MaxTotalUncompressed > 0 && size > uint64(l.MaxTotalUncompressed)-st.total:
+			return r.limitExceeded(i, fmt.Sprintf("entries declare more than %d bytes in total", l.MaxTotalUncompressed))
+		case l.MaxRatio > 0 && size >= limits.MinRatioSize && float64(size) > l.MaxRatio*float64(f.CompressedSize64):
+			return r.limitExceeded(i, fmt.Sprintf("entry declares %d bytes compressed to %d, the ratio limit is %g", size, f.CompressedSize64, l.MaxRatio))
+		}
+		st.total += size
+	}
+	st.entries += len(r.originalFiles)
+	return nil
+}
+
+func (r *Reader) limitExceeded(i int, detail string) error {
+	f := r.flag(i, safearchive.Verdict{Action: safearchive.ActionRejected, Reason: safearchive.ReasonLimitExceeded, Detail: detail})
+	return f.Err(ErrLimitExceeded)
+}
+
+// checkDirectory returns an error if the central directory of the archive has more records or
+// bytes than the options allow. Both the values declared by the end of central directory record
+// and the actual records are checked, only reading the fixed size part of the records, so the
+// memory spent is bounded regardless of what the archive declares.
+func checkDirectory(r io.ReaderAt, size int64, opts Options) error {
+	if opts.MaxDirectoryRecords <= 0 && opts.MaxDirectorySize <= 0 {
+		return nil
+	}
+	d, err := findDirectoryEnd(r, size)
+	if err != nil {
+		// the upstream parser fails as well
+		return nil
+	}
+	if d.zip64 {
+		// the limits cannot be checked without the values of the zip64 record
+		if err := d.readDirectory64End(r); err != nil {
+			return err
+		}
+	}
+	if err := directoryLimitExceeded(d.directoryRecords, d.directorySize, opts); err != nil {
+		return err
+	}
+	// The upstream parser reads records until the first invalid one, regardless of the declared
+	// values.
+	var records, total uint64
+	for off := d.directoryStart(r); ; {
+		var hdr [directoryHeaderLen]byte
+		if _, err := r.ReadAt(hdr[:], off); err != nil || binary.LittleEndian.Uint32(hdr[:]) != directoryHeaderSignature {
+			return nil
+		}
+		recLen := directoryHeaderLen + int64(binary.LittleEndian.Uint16(hdr[28:])) + int64(binary.LittleEndian.Uint16(hdr[30:])) + int64(binary.LittleEndian.Uint16(hdr[32:]))
+		records++
+		total += uint64(recLen)
+		if err := directoryLimitExceeded(records, total, opts); err != nil {
+			return err
+		}
+		off += recLen
+	}
+}
+
+func directoryLimitExceeded(records, size uint64, opts Options) error {
+	switch {
+	case opts.MaxDirectoryRecords > 0 && records > uint64(opts.MaxDirectoryRecords):
+		return fmt.Errorf("zip: %w: central directory has more than %d records", ErrLimitExceeded, opts.MaxDirectoryRecords)
+	case opts.MaxDirectorySize > 0 && size > uint64(opts.MaxDirectorySize):
+		return fmt.Errorf("zip: %w: central directory has more than %d bytes", ErrLimitExceeded, opts.MaxDirectorySize)
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"archive/zip" // NOLINT
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/google/safearchive"
+)
+
+// ReasonHeaderMismatch is the reason of the findings about entries whose local file header
+// disagrees with their central directory record (name, compression method, CRC-32, sizes), or
+// whose data runs into the central directory. Streaming parsers read the local headers while
+// archive/zip reads the central directory, so such entries may smuggle different contents past a
+// scanner than what an extractor produces.
+const ReasonHeaderMismatch safearchive.Reason = "zip-header-mismatch"
+
+// ReasonOverlap is the reason of the findings about entries whose local file header or data
+// overlaps the ones of another entry. Legitimate archives never do this, but zip bombs refer to
+// the same compressed data many times over, and overlapping entries are read differently by
+// streaming parsers.
+const ReasonOverlap safearchive.Reason = "zip-overlap"
+
+// dataDescriptorFlag is set if the CRC-32 and the sizes follow the data of the entry, in which case
+// the local header has them zeroed.
+const dataDescriptorFlag = 0x8
+
+// localHeader is a local file header.
+type localHeader struct {
+	flags            uint16
+	method           uint16
+	crc32            uint32
+	compressedSize   uint64
+	uncompressedSize uint64
+	name             string
+	extraLen         int
+}
+
+func readLocalHeader(r io.ReaderAt, off int64) (*localHeader, error) {
+	var b [fileHeaderLen]byte
+	if _, err := r.ReadAt(b[:], off); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(b[:]) != fileHeaderSignature {
+		return nil, ErrFormat
+	}
+	h := &localHeader{
+		flags:            binary.LittleEndian.Uint16(b[6:]),
+		method:           binary.LittleEndian.Uint16(b[8:]),
+		crc32:            binary.LittleEndian.Uint32(b[14:]),
+		compressedSize:   uint64(binary.LittleEndian.Uint32(b[18:])),
+		uncompressedSize: uint64(binary.LittleEndian.Uint32(b[22:])),
+		extraLen:         int(binary.LittleEndian.Uint16(b[28:])),
+	}
+	name := make([]byte, binary.LittleEndian.Uint16(b[26:]))
+	if _, err := r.ReadAt(name, off+fileHeaderLen); err != nil {
+		return nil, err
+	}
+	h.name = string(name)
+	return h, nil
+}
+
+// headerMismatch returns how the local header of the entry of rec disagrees with rec, or an empty
+// string. directoryStart is the position of the central directory in the archive.
+func headerMismatch(r io.ReaderAt, rec directoryRecord, directoryStart int64) string {
+	h, err := readLocalHeader(r, rec.headerOffset)
+	if err != nil {
+		return fmt.Sprintf("no local file header at offset %d", rec.headerOffset)
+	}
+	if h.name != rec.name {
+		return fmt.Sprintf("local file header names %q", h.name)
+	}
+	if h.method != rec.method {
+		return fmt.Sprintf("compression method %d in the local file header, %d in the central directory", h.method, rec.method)
+	}
+	sized := func(n uint64) bool { return n != 0xffffffff }
+	if h.flags&dataDescriptorFlag == 0 && rec.flags&dataDescriptorFlag == 0 {
+		if h.crc32 != rec.crc32 {
+			return fmt.Sprintf("CRC-32 %#08x in the local file header, %#08x in the central directory", h.crc32, rec.crc32)
+		}
+		if sized(h.compressedSize) && sized(rec.compressedSize) && (h.compressedSize != rec.compressedSize || h.uncompressedSize != rec.uncompressedSize) {
+			return fmt.Sprintf("sizes %d/%d in the local file header, %d/%d in the central directory", h.compressedSize, h.uncompressedSize, rec.compressedSize, rec.uncompressedSize)
+		}
+	}
+	end := rec.headerOffset + fileHeaderLen + int64(len(h.name)) + int64(h.extraLen) + int64(rec.compressedSize)
+	if sized(rec.compressedSize) && end > directoryStart {
+		return fmt.Sprintf("data ends at offset %d, in the central directory at offset %d", end, directoryStart)
+	}
+	return ""
+}
+
+// verifyLocalHeaders drops the entries whose local file header disagrees with the central
+// directory. It fails closed: the entries are rejected if the records cannot be parsed.
+func verifyLocalHeaders(r *Reader, st *magicState, f *zip.File) safearchive.Verdict {
+	if r.securityMode&VerifyLocalHeaders == 0 {
+		return safearchive.Pass
+	}
+	if r.records == nil {
+		return safearchive.Verdict{Action: safearchive.ActionRejected, Reason: ReasonHeaderMismatch, Detail: fmt.Sprintf("central directory records unavailable: %v", r.recordsErr)}
+	}
+	if detail := headerMismatch(r.src, r.records[st.index], r.records[0].offset); detail != "" {
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: ReasonHeaderMismatch, Detail: detail}
+	}
+	return safearchive.Pass
+}
+
+// loadRecords parses the central directory records needed by the security mode of the Reader,
+// unless they were parsed already.
+func (r *Reader) loadRecords() {
+	if r.securityMode&(VerifyLocalHeaders|DetectOverlaps) != 0 {
+		r.parseRecords()
+	}
+	if r.securityMode&DetectOverlaps != 0 && r.overlaps == nil && r.records != nil {
+		r.spans = recordSpans(r.src, r.records)
+		r.overlaps = overlaps(r.records, r.spans)
+	}
+}
+
+// span is the part of the archive taken by the local file header and the data of the entry of
+// the i-th record.
+type span struct {
+	i          int
+	start, end int64
+}
+
+// recordSpans returns the spans of the entries of records, in the order of the records.
+func recordSpans(r io.ReaderAt, records []directoryRecord) []span {
+	spans := make([]span, len(records))
+	for i, rec := range records {
+		end := rec.headerOffset + fileHeaderLen
+		if h, err := readLocalHeader(r, rec.headerOffset); err == nil && rec.compressedSize != 0xffffffff {
+			end += int64(len(h.name)) + int64(h.extraLen) + int64(rec.compressedSize)
+		}
+		spans[i] = span{i, rec.headerOffset, end}
+	}
+	return spans
+}
+
+// overlaps returns, for each record, the name of an entry whose local file header or data
+// overlaps the ones of the entry of the record and starts earlier in the archive (or at the same
+// position, but has an earlier record), or an empty string.
+func overlaps(records []directoryRecord, recordSpans []span) []string {
+	spans := append([]span{}, recordSpans...)
+	sort.SliceStable(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	re := make([]string, len(records))
+	// last is the span reaching the furthest so far
+	last := -1
+	for k, s := range spans {
+		if last >= 0 && s.start < spans[last].end {
+			re[s.i] = records[spans[last].i].name
+		}
+		if last < 0 || s.end > spans[last].end {
+			last = k
+		}
+	}
+	return re
+}
+
+// spanSet is a set of disjoint spans of the archive, sorted by position, each of them with the name
+// of an entry it covers. It holds the spans of the entries of the chunks already read, see
+// Options.DirectoryChunk.
+type spanSet []namedSpan
+
+type namedSpan struct {
+	start, end int64
+	name       string
+}
+
+// overlap returns the name of an entry of the set overlapping s, or an empty string.
+func (set spanSet) overlap(s span) string {
+	i := sort.Search(len(set), func(i int) bool { return set[i].end > s.start })
+	if i < len(set) && set[i].start < s.end {
+		return set[i].name
+	}
+	return ""
+}
+
+// add adds s, the span of the entry name, to the set, merging it with the spans it overlaps.
+func (set *spanSet) add(s span, name string) {
+	old := *set
+	i := sort.Search(len(old), func(i int) bool { return old[i].end > s.start })
+	merged := namedSpan{s.start, s.end, name}
+	j := i
+	for ; j < len(old) && old[j].start < s.end; j++ {
+		if old[j].start < merged.start {
+			merged.start, merged.name = old[j].start, old[j].name
+		}
+		if old[j].end > merged.end {
+			merged.end = old[j].end
+		}
+	}
+	re := make(spanSet, 0, len(old)-(j-i)+1)
+	re = append(re, old[:i]...)
+	re = append(re, merged)
+	*set = append(re, old[j:]...)
+}
+
+func detectOverlaps(r *Reader, st *magicState, f *zip.File) safearchive.Verdict {
+	if r.securityMode&DetectOverlaps == 0 {
+		return safearchive.Pass
+	}
+	if r.overlaps == nil {
+		return safearchive.Verdict{Action: safearchive.ActionRejected, Reason: ReasonOverlap, Detail: fmt.Sprintf("central directory records unavailable: %v", r.recordsErr)}
+	}
+	other := r.overlaps[st.index]
+	if other == "" && r.chunks != nil {
+		other = st.chunkSpans.overlap(r.spans[st.index])
+	}
+	if other != "" {
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: ReasonOverlap, Detail: fmt.Sprintf("overlaps %q", other)}
+	}
+	return safearchive.Pass
+}
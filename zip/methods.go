@@ -0,0 +1,120 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/google/safearchive/decompress"
+)
+
+// Compression methods beyond Store and Deflate, see Reader.RegisterCompressionMethods.
+const (
+	// Bzip2 is the method of the entries compressed with bzip2.
+	Bzip2 uint16 = 12
+	// LZMA is the method of the entries compressed with LZMA.
+	LZMA uint16 = 14
+	// Zstd is the method of the entries compressed with Zstandard.
+	Zstd uint16 = 93
+	// XZ is the method of the entries compressed with xz.
+	XZ uint16 = 95
+)
+
+// compressionMethods are the methods of RegisterCompressionMethods and the names of their codecs in
+// the decompress package.
+var compressionMethods = []struct {
+	method uint16
+	codec  string
+}{
+	{Bzip2, "bzip2"},
+	{LZMA, "lzma"},
+	{Zstd, "zstd"},
+	{XZ, "xz"},
+}
+
+// RegisterCompressionMethods registers decompressors for the Bzip2, LZMA, Zstd and XZ methods on
+// the Reader, so their entries can be opened instead of failing with ErrAlgorithm, and returns the
+// methods it registered. The decompressors are the codecs of the decompress package: bzip2 is
+// built in, while "lzma" (for the .lzma format, which LZMA entries are converted to), "zstd" and
+// "xz" are only available once registered there (see decompress.Register). The data of every
+// entry is decompressed within the limits l, on top of the limits of the Reader on the declared
+// sizes (see SetLimits). Reading an entry exceeding them fails with an error wrapping
+// ErrLimitExceeded.
+// In the hardened profile (see safearchive.Hardened) only bzip2 is available, like in the
+// decompress package.
+func (r *Reader) RegisterCompressionMethods(l decompress.Limits) []uint16 {
+	r.applying.Lock()
+	defer r.applying.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var re []uint16
+	for _, m := range compressionMethods {
+		c, ok := decompress.Lookup(m.codec)
+		if !ok {
+			continue
+		}
+		dcomp := limitedDecompressor(c, l)
+		if m.method == LZMA {
+			dcomp = lzmaDecompressor(dcomp)
+		}
+		r.registerDecompressor(m.method, dcomp)
+		re = append(re, m.method)
+	}
+	r.methods = re
+	return re
+}
+
+// limitedDecompressor returns a Decompressor decompressing with c within the limits l.
+func limitedDecompressor(c decompress.Codec, l decompress.Limits) Decompressor {
+	return func(r io.Reader) io.ReadCloser {
+		zr, err := decompress.NewReader(r, c, l)
+		if err != nil {
+			return errReadCloser{err}
+		}
+		return zr
+	}
+}
+
+// lzmaHeaderLen is the length of the header of the LZMA entries: the version of the LZMA SDK and
+// the length of the properties (both 2 bytes), and the properties.
+const lzmaHeaderLen = 4 + 5
+
+// lzmaDecompressor adapts a Decompressor of the .lzma format to the LZMA entries, whose data has a
+// header of its own and no uncompressed size.
+func lzmaDecompressor(dcomp Decompressor) Decompressor {
+	return func(r io.Reader) io.ReadCloser {
+		var hdr [lzmaHeaderLen]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return errReadCloser{fmt.Errorf("zip: LZMA header: %w", err)}
+		}
+		if n := binary.LittleEndian.Uint16(hdr[2:]); n != 5 {
+			return errReadCloser{fmt.Errorf("%w: LZMA properties of %d bytes", ErrFormat, n)}
+		}
+		// the .lzma header: the properties and an unknown uncompressed size
+		lzma := append(hdr[4:], bytes.Repeat([]byte{0xff}, 8)...)
+		return dcomp(io.MultiReader(bytes.NewReader(lzma), r))
+	}
+}
+
+// errReadCloser fails every read with err.
+type errReadCloser struct {
+	err error
+}
+
+func (e errReadCloser) Read([]byte) (int, error) { return 0, e.err }
+func (e errReadCloser) Close() error             { return nil }
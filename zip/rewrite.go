@@ -0,0 +1,193 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/sanitizer"
+)
+
+var (
+	// ErrEntryNotFound is returned (wrapped into a safearchive.EntryError) by Rewrite when an edit
+	// refers to an entry that does not exist.
+	ErrEntryNotFound = errors.New("zip: entry not found")
+	// ErrDuplicateEdit is returned (wrapped into a safearchive.EntryError) by Rewrite when there are
+	// multiple edits for the same entry.
+	ErrDuplicateEdit = errors.New("zip: multiple edits for the same entry")
+	// ErrDirectoryContent is returned (wrapped into a safearchive.EntryError) by Rewrite when an edit
+	// replaces the content of a directory.
+	ErrDirectoryContent = errors.New("zip: cannot replace the content of a directory")
+)
+
+// Edit describes a modification of a single entry performed by Rewrite.
+type Edit struct {
+	// Name is the name of the entry to modify, as exposed by the (sanitized) source reader.
+	Name string
+	// Delete drops the entry from the output archive.
+	Delete bool
+	// NewName renames the entry. The new name is sanitized before it is written.
+	NewName string
+	// Content, if not nil, replaces the contents of the entry. The new contents are compressed
+	// using the compression method of the original entry.
+	Content io.Reader
+}
+
+// Rewrite writes the entries of src to dst as a new zip archive, applying the supplied edits.
+// Entries are written the way src exposes them, so the security mode of src (e.g.
+// SanitizeFilenames) applies to the output as well.
+// Entries that are not touched by any edit, or are renamed only, are copied without being
+// decompressed and recompressed, which makes redacting large archives cheap.
+// Rewrite fails without writing anything if an edit refers to an entry that does not exist.
+func Rewrite(src *ReadCloser, dst io.Writer, edits []Edit) error {
+	return src.Reader.rewrite(dst, edits)
+}
+
+func (r *Reader) rewrite(dst io.Writer, edits []Edit) error {
+	byName := map[string]*Edit{}
+	for i := range edits {
+		e := &edits[i]
+		if _, ok := byName[e.Name]; ok {
+			return safearchive.NewEntryError(e.Name, "", ErrDuplicateEdit)
+		}
+		byName[e.Name] = e
+	}
+	seen := map[string]bool{}
+	for _, f := range r.File {
+		seen[f.Name] = true
+	}
+	for name := range byName {
+		if !seen[name] {
+			return safearchive.NewEntryError(name, "", ErrEntryNotFound)
+		}
+	}
+
+	w := NewWriter(dst)
+	// the entries are written the way r exposes them
+	w.SetSecurityMode(0)
+	if err := w.SetComment(r.Comment); err != nil {
+		return err
+	}
+	for _, f := range r.File {
+		e, ok := byName[f.Name]
+		if !ok {
+			if err := w.Copy(f); err != nil {
+				return err
+			}
+			continue
+		}
+		if e.Delete {
+			continue
+		}
+
+		name := f.Name
+		if e.NewName != "" {
+			name = toZipName(sanitizer.SanitizePath(e.NewName))
+		}
+		if e.Content == nil {
+			if err := CopyRaw(w, f, name); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := replaceContent(w, f, name, e.Content); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// Repack writes the entries of src to dst as a new zip archive. Entries are written the way src
+// exposes them (so the sanitized names and file modes are persisted), but their compressed data is
+// copied as-is, without being decompressed and recompressed.
+func Repack(dst io.Writer, src *Reader) error {
+	return src.rewrite(dst, nil)
+}
+
+// Sanitize reads the zip archive of the given size from src with the security features of mode,
+// and writes the entries that pass them to dst as a new zip archive, with their sanitized headers.
+// The compressed data of the entries are copied byte-for-byte. Services storing archives for later
+// extraction by third parties can use it to store sanitized archives rather than to rely on
+// sanitized reads.
+// Sanitize fails without writing anything if the archive is rejected (e.g. in StrictMode).
+func Sanitize(dst io.Writer, src io.ReaderAt, size int64, mode SecurityMode) error {
+	r, err := NewReader(src, size)
+	if err != nil {
+		return err
+	}
+	r.SetSecurityMode(mode)
+	if err := r.Err(); err != nil {
+		return err
+	}
+	return Repack(dst, r)
+}
+
+// CopyRaw copies the compressed data of f to w without decompressing it, using name as the name of
+// the new entry. The rest of the header (including the file mode) is taken from f, so when f comes
+// from a Reader, the security mode of the Reader applies to the new entry as well. The target of a
+// symbolic link is decompressed instead when the Writer checks it (see Writer).
+func CopyRaw(w *Writer, f *File, name string) error {
+	if f.Mode()&fs.ModeSymlink != 0 && w.checksLinkTargets() && f.Method != Store {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		return replaceContent(w, f, name, rc)
+	}
+	fh := f.FileHeader
+	fh.Name = name
+	raw, err := f.OpenRaw()
+	if err != nil {
+		return err
+	}
+	fw, err := w.CreateRaw(&fh)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, raw)
+	return err
+}
+
+// replaceContent writes a new entry to w that has the metadata of f, the supplied name and content.
+func replaceContent(w *Writer, f *File, name string, content io.Reader) error {
+	if f.Mode().IsDir() {
+		return safearchive.NewEntryError(f.Name, "", ErrDirectoryContent)
+	}
+	fh := f.FileHeader
+	fh.Name = name
+	fh.CRC32 = 0
+	fh.CompressedSize = 0
+	fh.CompressedSize64 = 0
+	fh.UncompressedSize = 0
+	fh.UncompressedSize64 = 0
+	fw, err := w.CreateHeader(&fh)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, content)
+	return err
+}
+
+// toZipName converts a sanitized path to the forward slash separated form mandated by the zip
+// specification.
+func toZipName(name string) string {
+	return strings.TrimPrefix(filepath.ToSlash(name), "/")
+}
@@ -0,0 +1,366 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"archive/zip" // NOLINT
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/internal/limits"
+	"github.com/google/safearchive/sanitizer"
+)
+
+// magicState is the state of the rules during a pass of applyMagic.
+type magicState struct {
+	// original is the original name of the current entry.
+	original string
+	// index is the position of the current entry in the original entries.
+	index int
+	// selectName is the name of the current entry the subtree and the patterns select, see
+	// stripComponents.
+	selectName string
+	// entries and total are the number of entries and their total uncompressed size so far, see
+	// checkLimits.
+	entries    int
+	total      uint64
+	symlinks   safearchive.SymlinkSet
+	targets    safearchive.SymlinkSet
+	fanOut     safearchive.FanOutLimiter
+	order      safearchive.OrderChecker
+	duplicates safearchive.DuplicateChecker
+	collisions safearchive.DuplicateChecker
+	// chunkSpans are the spans of the entries of the chunks before the current one, see
+	// detectOverlaps.
+	chunkSpans spanSet
+}
+
+// rule is a per-entry check of the Reader. The built-in security features and the custom rules
+// are applied the same way, see Reader.applyMagic.
+type rule interface {
+	apply(r *Reader, st *magicState, f *zip.File) safearchive.Verdict
+}
+
+// ruleFunc adapts a function to the rule interface.
+type ruleFunc func(r *Reader, st *magicState, f *zip.File) safearchive.Verdict
+
+func (fn ruleFunc) apply(r *Reader, st *magicState, f *zip.File) safearchive.Verdict {
+	return fn(r, st, f)
+}
+
+// builtinRules are the built-in security features in the order they are applied, before the
+// custom rules. Each of them checks whether it is enabled in the security mode of the Reader. The
+// names are sanitized after the characters that disguise them were dealt with, as e.g. ".\u200b."
+// becomes ".." once its zero-width space is stripped.
+var builtinRules = []rule{
+	ruleFunc(flagImplausibleSizes),
+	ruleFunc(verifyLocalHeaders),
+	ruleFunc(detectOverlaps),
+	ruleFunc(checkEncryption),
+	ruleFunc(rejectBackslashes),
+	ruleFunc(validateNameEncoding),
+	ruleFunc(sanitizeUnicode),
+	ruleFunc(sanitizeFilenames),
+	ruleFunc(stripComponents),
+	ruleFunc(skipWindowsShortFilenames),
+}
+
+// recheckRules are the built-in security features applied again on the entries whose name a
+// custom rule changed.
+var recheckRules = []rule{
+	ruleFunc(rejectBackslashes),
+	ruleFunc(validateNameEncoding),
+	ruleFunc(sanitizeUnicode),
+	ruleFunc(sanitizeFilenames),
+	ruleFunc(skipWindowsShortFilenames),
+}
+
+// trackingRules are the built-in security features applied after the custom rules, so they see
+// the final names and modes of the entries, in particular the ones keeping track of the entries
+// seen so far. The duplicates and collisions are renamed before the symbolic links are tracked, so
+// a renamed link still covers the entries below its new name.
+var trackingRules = []rule{
+	ruleFunc(checkDuplicates),
+	ruleFunc(checkCollisions),
+	ruleFunc(preventSymlinkTraversal),
+	ruleFunc(sanitizeSymlinkTargets),
+	ruleFunc(skipSpecialFiles),
+	ruleFunc(limitFanOut),
+	ruleFunc(requireSymlinksLast),
+	ruleFunc(sanitizeFileMode),
+	ruleFunc(dropExtraFields),
+	ruleFunc(dropXattrs),
+}
+
+func flagImplausibleSizes(r *Reader, st *magicState, f *zip.File) safearchive.Verdict {
+	if r.securityMode&FlagImplausibleSizes == 0 {
+		return safearchive.Pass
+	}
+	if strings.HasSuffix(f.Name, "/") && (f.CompressedSize64 != 0 || f.UncompressedSize64 != 0) {
+		return safearchive.Verdict{Reason: safearchive.ReasonImplausibleSize, Detail: fmt.Sprintf("directory declares %d bytes compressed to %d", f.UncompressedSize64, f.CompressedSize64)}
+	}
+	factor := r.sizeFactor
+	if factor == 0 {
+		factor = DefaultImplausibleSizeFactor
+	}
+	if float64(f.UncompressedSize64) > factor*float64(r.size) {
+		return safearchive.Verdict{Reason: safearchive.ReasonImplausibleSize, Detail: fmt.Sprintf("entry declares %d bytes in an archive of %d bytes", f.UncompressedSize64, r.size)}
+	}
+	return safearchive.Pass
+}
+
+func rejectBackslashes(r *Reader, st *magicState, f *zip.File) safearchive.Verdict {
+	if r.backslashPolicy == BackslashReject && strings.Contains(f.Name, `\`) {
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonBackslash}
+	}
+	// the names would come out of sanitization with a backslash in place of the placeholder
+	if r.backslashPolicy == BackslashLiteral && runtime.GOOS != "windows" && strings.Contains(f.Name, backslashPlaceholder) {
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonBackslash, Detail: "name contains U+F05C"}
+	}
+	return safearchive.Pass
+}
+
+func sanitizeFilenames(r *Reader, st *magicState, f *zip.File) safearchive.Verdict {
+	if r.securityMode&SanitizeFilenames == 0 {
+		return safearchive.Pass
+	}
+	name := f.Name
+	f.Name = r.sanitizePath(name)
+	if r.nameChanged(name, f.Name) {
+		return safearchive.Verdict{Action: safearchive.ActionModified, Reason: safearchive.NameReason(name)}
+	}
+	return safearchive.Pass
+}
+
+// stripComponents strips the leading components of the name of f and prepends the prefix of the
+// Reader, see SetStripComponents. Entries left without a name are skipped without a finding.
+func stripComponents(r *Reader, st *magicState, f *zip.File) safearchive.Verdict {
+	st.selectName = f.Name
+	if r.strip <= 0 && r.prefix == "" {
+		return safearchive.Pass
+	}
+	literal := r.backslashPolicy == BackslashLiteral && runtime.GOOS != "windows"
+	name := f.Name
+	if literal {
+		name = strings.ReplaceAll(name, `\`, backslashPlaceholder)
+	}
+	stripped, ok := sanitizer.StripComponents(name, r.strip, r.prefix)
+	if !ok {
+		return safearchive.Verdict{Action: safearchive.ActionDropped}
+	}
+	if f.Mode()&fs.ModeSymlink != 0 {
+		target, err := readLinkTarget(f)
+		if err != nil {
+			// reading the entry fails later as well
+			return safearchive.Pass
+		}
+		if t, ok := sanitizer.StripLinkTarget(filepath.ToSlash(name), target, r.strip, r.prefix); !ok || t != target {
+			return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonSymlinkTarget, Detail: "target " + target + " stripped"}
+		}
+	}
+	if literal {
+		stripped = strings.ReplaceAll(stripped, backslashPlaceholder, `\`)
+	}
+	f.Name = stripped
+	return safearchive.Pass
+}
+
+func validateNameEncoding(r *Reader, st *magicState, f *zip.File) safearchive.Verdict {
+	if r.securityMode&ValidateNameEncoding == 0 {
+		return safearchive.Pass
+	}
+	name, v := r.nameEncoding.Check(f.Name)
+	if v.Action == safearchive.ActionModified {
+		f.Name = name
+	}
+	return v
+}
+
+func sanitizeUnicode(r *Reader, st *magicState, f *zip.File) safearchive.Verdict {
+	if r.securityMode&SanitizeUnicode == 0 || !sanitizer.HasUnsafeRunes(f.Name) {
+		return safearchive.Pass
+	}
+	f.Name = sanitizer.StripUnsafeRunes(f.Name)
+	return safearchive.Verdict{Action: safearchive.ActionModified, Reason: safearchive.ReasonUnsafeUnicode}
+}
+
+func skipWindowsShortFilenames(r *Reader, st *magicState, f *zip.File) safearchive.Verdict {
+	if r.securityMode&SkipWindowsShortFilenames != 0 && sanitizer.HasWindowsShortFilenames(f.Name) {
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonWindowsShortFilename}
+	}
+	return safearchive.Pass
+}
+
+// sanitizeSymlinkTargets is applied after preventSymlinkTraversal, so the entries below skipped
+// links are skipped as well.
+func sanitizeSymlinkTargets(r *Reader, st *magicState, f *zip.File) safearchive.Verdict {
+	if r.securityMode&SanitizeSymlinkTargets == 0 || f.Mode()&fs.ModeSymlink == 0 {
+		return safearchive.Pass
+	}
+	target, err := readLinkTarget(f)
+	if err != nil {
+		// reading the entry fails later as well
+		return safearchive.Pass
+	}
+	return checkLinkTarget(r, st, f.Name, target)
+}
+
+// checkLinkTarget drops the symbolic link name if its target points outside of the archive,
+// directly or through the links seen before. It is shared with the Writer.
+func checkLinkTarget(r *Reader, st *magicState, name, target string) safearchive.Verdict {
+	if sanitizer.SanitizeLinkTarget(filepath.ToSlash(name), target) != target {
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonSymlinkTarget, Detail: "target " + target}
+	}
+	if !st.targets.AddLink(strings.TrimSuffix(r.sanitizePath(name), "/"), filepath.ToSlash(target)) {
+		// the target escapes through the links seen before, or makes one of them escape
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonSymlinkTarget, Detail: "target " + target + " escapes through other links"}
+	}
+	return safearchive.Pass
+}
+
+// readLinkTarget reads the target of the symbolic link f, up to limits.MaxLinknameLen bytes.
+func readLinkTarget(f *zip.File) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(io.LimitReader(rc, limits.MaxLinknameLen))
+	return string(b), err
+}
+
+func preventSymlinkTraversal(r *Reader, st *magicState, f *zip.File) safearchive.Verdict {
+	if r.securityMode&PreventSymlinkTraversal == 0 {
+		return safearchive.Pass
+	}
+	fName := r.sanitizePath(f.Name)
+	fName = strings.TrimSuffix(fName, "/")
+	if r.securityMode&PreventCaseInsensitiveSymlinkTraversal != 0 {
+		fName = strings.ToLower(fName)
+	}
+	if st.symlinks.Covers(fName) {
+		// a symlink has already been seen on this path. We need to drop this entry.
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonSymlinkTraversal}
+	}
+	if f.Mode()&fs.ModeSymlink != 0 {
+		st.symlinks.Add(fName)
+	}
+	return safearchive.Pass
+}
+
+func skipSpecialFiles(r *Reader, st *magicState, f *zip.File) safearchive.Verdict {
+	if r.securityMode&SkipSpecialFiles != 0 && isSpecialFile(*f) {
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonSpecialFile}
+	}
+	return safearchive.Pass
+}
+
+func checkDuplicates(r *Reader, st *magicState, f *zip.File) safearchive.Verdict {
+	return applyDuplicateChecker(&st.duplicates, f)
+}
+
+func checkCollisions(r *Reader, st *magicState, f *zip.File) safearchive.Verdict {
+	return applyDuplicateChecker(&st.collisions, f)
+}
+
+// applyDuplicateChecker applies c on f, renaming it if c does.
+func applyDuplicateChecker(c *safearchive.DuplicateChecker, f *zip.File) safearchive.Verdict {
+	v, name := c.Check(filepath.ToSlash(f.Name), strings.HasSuffix(f.Name, "/"))
+	if v.Action == safearchive.ActionModified {
+		f.Name = name
+	}
+	return v
+}
+
+func limitFanOut(r *Reader, st *magicState, f *zip.File) safearchive.Verdict {
+	if !st.fanOut.Allow(filepath.ToSlash(f.Name)) {
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonFanOut}
+	}
+	return safearchive.Pass
+}
+
+func requireSymlinksLast(r *Reader, st *magicState, f *zip.File) safearchive.Verdict {
+	if r.securityMode&RequireSymlinksLast == 0 {
+		return safearchive.Pass
+	}
+	name := filepath.ToSlash(f.Name)
+	if r.securityMode&PreventCaseInsensitiveSymlinkTraversal != 0 {
+		name = strings.ToLower(name)
+	}
+	if detail, ok := st.order.Check(name, strings.HasSuffix(name, "/"), f.Mode()&fs.ModeSymlink != 0); !ok {
+		return safearchive.Verdict{Action: safearchive.ActionRejected, Reason: safearchive.ReasonOrderDependent, Detail: detail}
+	}
+	return safearchive.Pass
+}
+
+func sanitizeFileMode(r *Reader, st *magicState, f *zip.File) safearchive.Verdict {
+	if r.securityMode&SanitizeFileMode == 0 {
+		return safearchive.Pass
+	}
+	amode := f.Mode()
+	for _, m := range []fs.FileMode{fs.ModeTemporary, fs.ModeAppend, fs.ModeExclusive, fs.ModeSetuid, fs.ModeSetgid, fs.ModeSticky} {
+		amode = amode &^ fs.FileMode(m)
+	}
+	if amode == f.Mode() {
+		// leaving the header as is, so the entry is not copied
+		return safearchive.Pass
+	}
+	v := safearchive.Verdict{Action: safearchive.ActionModified, Reason: safearchive.ReasonSpecialMode, Detail: fmt.Sprintf("mode %v changed to %v", f.Mode(), amode)}
+	f.SetMode(amode)
+	return v
+}
+
+// appleDoubleDir is the directory in which the archivers of macOS store AppleDouble entries.
+const appleDoubleDir = "__MACOSX"
+
+func dropXattrs(r *Reader, st *magicState, f *zip.File) safearchive.Verdict {
+	if r.securityMode&DropXattrs == 0 {
+		return safearchive.Pass
+	}
+	name := strings.TrimSuffix(filepath.ToSlash(f.Name), "/")
+	if name == appleDoubleDir || strings.HasPrefix(name, appleDoubleDir+"/") || strings.HasPrefix(path.Base(name), "._") {
+		return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonXattrs, Detail: "AppleDouble entry"}
+	}
+	return safearchive.Pass
+}
+
+// customRule applies a safearchive.Rule to the format independent description of the file.
+type customRule struct {
+	safearchive.Rule
+}
+
+func (c customRule) apply(r *Reader, st *magicState, f *zip.File) safearchive.Verdict {
+	e := EntryOf(f)
+	v := c.Check(&e)
+	if v.Action == safearchive.ActionModified {
+		f.Name = e.Name
+		// only the permission bits can be changed: the type of the entry is left alone, so a
+		// rule cannot turn a file into a symbolic link
+		const bits = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+		if mode := f.Mode(); e.Mode&bits != mode&bits {
+			f.SetMode(mode&^bits | e.Mode&bits)
+		}
+	}
+	if v.Action != safearchive.ActionNone && v.Reason == "" {
+		v.Reason = safearchive.ReasonCustomRule
+	}
+	return v
+}
@@ -0,0 +1,255 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/google/safearchive"
+)
+
+// ReasonSalvaged is the reason of the findings about archives whose central directory was rebuilt
+// from the local file headers in salvage mode, see Options.Salvage, and about the entries that
+// could not be salvaged.
+const ReasonSalvaged safearchive.Reason = "zip-salvaged"
+
+const (
+	dataDescriptorSignature = 0x08074b50
+	dataDescriptorLen       = 16
+	// maxDescriptorProbes is the maximum number of data descriptor signatures checked for an entry
+	// whose sizes follow the data, as the data may contain the signature.
+	maxDescriptorProbes = 1024
+)
+
+// salvagedEntry is an entry read from its local file header.
+type salvagedEntry struct {
+	offset int64
+	// header is the fixed part of the local file header.
+	header           []byte
+	name             []byte
+	extra            []byte
+	crc32            uint32
+	compressedSize   uint32
+	uncompressedSize uint32
+	// end is the position following the data of the entry and its data descriptor.
+	end int64
+}
+
+// salvage builds a view of the archive whose central directory is rebuilt from the local file
+// headers, from the first one until the first invalid or truncated entry. It returns a nil view if
+// no entry could be salvaged. The limits of opts on the central directory apply to the rebuilt
+// one.
+// Zip64 entries are not salvaged.
+func salvage(r io.ReaderAt, size int64, opts Options) (*patchedReaderAt, []safearchive.Finding, error) {
+	off, err := newSignatureScanner(r, 0, size, fileHeaderSignature).next()
+	if err != nil || off < 0 {
+		return nil, nil, err
+	}
+	var findings []safearchive.Finding
+	var cd bytes.Buffer
+	records := 0
+	for records < 0xffff {
+		e, detail := readSalvagedEntry(r, off, size)
+		if detail != "" {
+			f := safearchive.Finding{Offset: off, Reason: ReasonSalvaged, Action: safearchive.ActionDropped, Detail: detail}
+			if e != nil {
+				f.Name = string(e.name)
+			}
+			findings = append(findings, f)
+		}
+		if e == nil || detail != "" {
+			break
+		}
+		cd.Write(e.directoryRecord())
+		records++
+		if err := directoryLimitExceeded(uint64(records), uint64(cd.Len()), opts); err != nil {
+			return nil, nil, err
+		}
+		off = e.end
+	}
+	if records == 0 {
+		return nil, nil, nil
+	}
+	findings = append([]safearchive.Finding{{
+		Offset: off,
+		Reason: ReasonSalvaged,
+		Detail: fmt.Sprintf("rebuilt the central directory from %d local file headers", records),
+	}}, findings...)
+
+	end := make([]byte, directoryEndLen)
+	binary.LittleEndian.PutUint32(end[0:], directoryEndSignature)
+	binary.LittleEndian.PutUint16(end[8:], uint16(records))
+	binary.LittleEndian.PutUint16(end[10:], uint16(records))
+	binary.LittleEndian.PutUint32(end[12:], uint32(cd.Len()))
+	binary.LittleEndian.PutUint32(end[16:], uint32(off))
+	cd.Write(end)
+
+	return &patchedReaderAt{r: r, split: off, tail: cd.Bytes()}, findings, nil
+}
+
+// readSalvagedEntry reads the entry whose local file header is at off. It returns a nil entry and
+// an empty detail if there is no local file header at off (e.g. the central directory starts
+// there), or a detail describing why the entry cannot be salvaged.
+func readSalvagedEntry(r io.ReaderAt, off, size int64) (*salvagedEntry, string) {
+	header := make([]byte, fileHeaderLen)
+	if _, err := r.ReadAt(header[:4], off); err != nil || binary.LittleEndian.Uint32(header) != fileHeaderSignature {
+		return nil, ""
+	}
+	if _, err := r.ReadAt(header, off); err != nil {
+		return nil, "truncated local file header"
+	}
+	e := &salvagedEntry{
+		offset:           off,
+		header:           header,
+		crc32:            binary.LittleEndian.Uint32(header[14:]),
+		compressedSize:   binary.LittleEndian.Uint32(header[18:]),
+		uncompressedSize: binary.LittleEndian.Uint32(header[22:]),
+	}
+	nameLen := int(binary.LittleEndian.Uint16(header[26:]))
+	b := make([]byte, nameLen+int(binary.LittleEndian.Uint16(header[28:])))
+	if _, err := r.ReadAt(b, off+fileHeaderLen); err != nil {
+		return nil, "truncated local file header"
+	}
+	e.name, e.extra = b[:nameLen], b[nameLen:]
+	e.extra = e.extra[:validExtraLen(e.extra)]
+	if off > 0xffffffff || e.compressedSize == 0xffffffff || e.uncompressedSize == 0xffffffff {
+		return e, "zip64 entry"
+	}
+
+	start := off + fileHeaderLen + int64(len(b))
+	flags := binary.LittleEndian.Uint16(header[6:])
+	switch {
+	case flags&dataDescriptorFlag != 0 && e.compressedSize == 0:
+		// The sizes follow the data: look for a data descriptor matching the length of the data.
+		s := newSignatureScanner(r, start, size, dataDescriptorSignature)
+		for probes := 0; ; probes++ {
+			if probes == maxDescriptorProbes {
+				return e, fmt.Sprintf("no data descriptor in the first %d candidates", maxDescriptorProbes)
+			}
+			q, err := s.next()
+			if err != nil || q < 0 || q-start > 0xffffffff {
+				return e, "no data descriptor"
+			}
+			var d [dataDescriptorLen]byte
+			if err := s.readAt(d[:], q); err != nil {
+				return e, "no data descriptor"
+			}
+			if int64(binary.LittleEndian.Uint32(d[8:])) == q-start {
+				e.crc32 = binary.LittleEndian.Uint32(d[4:])
+				e.compressedSize = binary.LittleEndian.Uint32(d[8:])
+				e.uncompressedSize = binary.LittleEndian.Uint32(d[12:])
+				e.end = q + dataDescriptorLen
+				return e, ""
+			}
+		}
+	case flags&dataDescriptorFlag != 0:
+		// The signature of the data descriptor is optional.
+		e.end = start + int64(e.compressedSize) + dataDescriptorLen - 4
+		var sig [4]byte
+		if _, err := r.ReadAt(sig[:], start+int64(e.compressedSize)); err == nil && binary.LittleEndian.Uint32(sig[:]) == dataDescriptorSignature {
+			e.end += 4
+		}
+	default:
+		e.end = start + int64(e.compressedSize)
+	}
+	if e.end > size {
+		return e, fmt.Sprintf("data truncated at offset %d", size)
+	}
+	return e, ""
+}
+
+// directoryRecord returns the central directory record of the entry. The local file header does
+// not store the file mode, so the entry is a regular file or a directory.
+func (e *salvagedEntry) directoryRecord() []byte {
+	b := make([]byte, directoryHeaderLen, directoryHeaderLen+len(e.name)+len(e.extra))
+	binary.LittleEndian.PutUint32(b[0:], directoryHeaderSignature)
+	// made by MS-DOS, version 2.0
+	binary.LittleEndian.PutUint16(b[4:], 20)
+	// version needed, flags, method, modification time and date
+	copy(b[6:16], e.header[4:14])
+	binary.LittleEndian.PutUint32(b[16:], e.crc32)
+	binary.LittleEndian.PutUint32(b[20:], e.compressedSize)
+	binary.LittleEndian.PutUint32(b[24:], e.uncompressedSize)
+	binary.LittleEndian.PutUint16(b[28:], uint16(len(e.name)))
+	binary.LittleEndian.PutUint16(b[30:], uint16(len(e.extra)))
+	binary.LittleEndian.PutUint32(b[42:], uint32(e.offset))
+	b = append(b, e.name...)
+	return append(b, e.extra...)
+}
+
+// signatureScanner finds the successive occurrences of a signature in the archive, reading the
+// archive once through a sliding buffer.
+type signatureScanner struct {
+	r   io.ReaderAt
+	sig [4]byte
+	buf []byte
+	// off is the position of buf in the archive, and end the position the scan stops at.
+	off, end int64
+	// i is the index in buf the next search starts at.
+	i int
+}
+
+func newSignatureScanner(r io.ReaderAt, from, to int64, sig uint32) *signatureScanner {
+	s := &signatureScanner{r: r, buf: make([]byte, 0, 32<<10), off: from, end: to}
+	binary.LittleEndian.PutUint32(s.sig[:], sig)
+	return s
+}
+
+// readAt reads len(b) bytes of the archive at off, from the buffer if it holds them.
+func (s *signatureScanner) readAt(b []byte, off int64) error {
+	if off >= s.off && off+int64(len(b)) <= s.off+int64(len(s.buf)) {
+		copy(b, s.buf[off-s.off:])
+		return nil
+	}
+	_, err := s.r.ReadAt(b, off)
+	return err
+}
+
+// next returns the position of the next occurrence of the signature, or -1.
+func (s *signatureScanner) next() (int64, error) {
+	for {
+		if j := bytes.Index(s.buf[s.i:], s.sig[:]); j >= 0 {
+			s.i += j + 1
+			return s.off + int64(s.i-1), nil
+		}
+		// the last 3 bytes may start an occurrence
+		keep := len(s.buf) - 3
+		if keep < s.i {
+			keep = s.i
+		}
+		n := copy(s.buf[:cap(s.buf)], s.buf[keep:])
+		s.off += int64(keep)
+		s.i = 0
+		want := cap(s.buf)
+		if rest := s.end - s.off; rest < int64(want) {
+			want = int(rest)
+		}
+		if want <= n {
+			s.buf = s.buf[:n]
+			return -1, nil
+		}
+		k, err := s.r.ReadAt(s.buf[n:want], s.off+int64(n))
+		s.buf = s.buf[:n+k]
+		if err != nil && err != io.EOF {
+			return -1, err
+		}
+		if k == 0 {
+			return -1, nil
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/safearchive"
+)
+
+// Reasons of the findings reported about repairs performed in tolerant mode.
+const (
+	// ReasonDirectoryCount means the number of central directory records declared by the end of
+	// central directory record did not match the actual number of records.
+	ReasonDirectoryCount safearchive.Reason = "zip-directory-count"
+	// ReasonTruncatedComment means the archive comment was shorter than declared.
+	ReasonTruncatedComment safearchive.Reason = "zip-truncated-comment"
+	// ReasonMalformedExtra means the extra fields of an entry had inconsistent lengths.
+	ReasonMalformedExtra safearchive.Reason = "zip-malformed-extra"
+	// ReasonDirectoryData means a directory entry declared a non-zero size or checksum.
+	ReasonDirectoryData safearchive.Reason = "zip-directory-data"
+)
+
+// repair builds a view of the archive with the common real-world malformations of the central
+// directory fixed, so the upstream parser accepts it. It returns a nil view if there was nothing
+// (or nothing possible) to repair.
+// Zip64 archives are not repaired.
+func repair(r io.ReaderAt, size int64) (*patchedReaderAt, []safearchive.Finding, error) {
+	d, err := findDirectoryEnd(r, size)
+	if err != nil || d.zip64 {
+		return nil, nil, nil
+	}
+	start := d.directoryStart(r)
+	if start > d.offset {
+		return nil, nil, nil
+	}
+	records, err := readDirectoryRecords(r, start, d, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var findings []safearchive.Finding
+	var cd bytes.Buffer
+	for _, rec := range records {
+		raw := rec.raw
+		if n := validExtraLen(rec.extra); n != len(rec.extra) {
+			nameEnd := directoryHeaderLen + len(rec.name)
+			fixed := append([]byte{}, raw[:nameEnd+n]...)
+			fixed = append(fixed, raw[nameEnd+len(rec.extra):]...)
+			binary.LittleEndian.PutUint16(fixed[30:], uint16(n))
+			raw = fixed
+			findings = append(findings, safearchive.Finding{
+				Name:   rec.name,
+				Offset: rec.offset,
+				Reason: ReasonMalformedExtra,
+				Detail: fmt.Sprintf("dropped %d bytes of malformed extra fields", len(rec.extra)-n),
+			})
+		}
+		if strings.HasSuffix(rec.name, "/") && (rec.uncompressedSize != 0 || rec.crc32 != 0) {
+			raw = append([]byte{}, raw...)
+			binary.LittleEndian.PutUint32(raw[16:], 0)
+			binary.LittleEndian.PutUint32(raw[24:], 0)
+			findings = append(findings, safearchive.Finding{
+				Name:   rec.name,
+				Offset: rec.offset,
+				Reason: ReasonDirectoryData,
+				Detail: fmt.Sprintf("cleared checksum %#x and size %d of a directory", rec.crc32, rec.uncompressedSize),
+			})
+		}
+		cd.Write(raw)
+	}
+	if len(records) > 0xffff {
+		return nil, nil, nil
+	}
+	if uint64(len(records)) != d.directoryRecords {
+		findings = append(findings, safearchive.Finding{
+			Offset: d.offset,
+			Reason: ReasonDirectoryCount,
+			Detail: fmt.Sprintf("declared %d records, found %d", d.directoryRecords, len(records)),
+		})
+	}
+	if len(d.comment) != d.commentLen {
+		findings = append(findings, safearchive.Finding{
+			Offset: d.offset,
+			Reason: ReasonTruncatedComment,
+			Detail: fmt.Sprintf("declared %d bytes, found %d", d.commentLen, len(d.comment)),
+		})
+	}
+	if len(findings) == 0 {
+		return nil, nil, nil
+	}
+
+	end := make([]byte, directoryEndLen, directoryEndLen+len(d.comment))
+	binary.LittleEndian.PutUint32(end[0:], directoryEndSignature)
+	binary.LittleEndian.PutUint16(end[8:], uint16(len(records)))
+	binary.LittleEndian.PutUint16(end[10:], uint16(len(records)))
+	binary.LittleEndian.PutUint32(end[12:], uint32(cd.Len()))
+	binary.LittleEndian.PutUint32(end[16:], uint32(d.directoryOffset))
+	binary.LittleEndian.PutUint16(end[20:], uint16(len(d.comment)))
+	end = append(end, d.comment...)
+	cd.Write(end)
+
+	return &patchedReaderAt{r: r, split: start, tail: cd.Bytes()}, findings, nil
+}
+
+// validExtraLen returns the length of the well-formed prefix of the extra fields.
+func validExtraLen(extra []byte) int {
+	n := 0
+	for len(extra)-n >= 4 {
+		fieldLen := int(binary.LittleEndian.Uint16(extra[n+2:]))
+		if n+4+fieldLen > len(extra) {
+			break
+		}
+		n += 4 + fieldLen
+	}
+	return n
+}
@@ -0,0 +1,303 @@
+// Copyright 2024 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zip
+
+import (
+	"archive/zip" // NOLINT
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"sync"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/internal/limits"
+)
+
+// writerRules are the built-in security features the Writer applies, in the order they are
+// applied. They are the rules of the Reader that depend on the header of the entry only.
+var writerRules = []rule{
+	ruleFunc(sanitizeFilenames),
+	ruleFunc(sanitizeUnicode),
+	ruleFunc(skipWindowsShortFilenames),
+	ruleFunc(preventSymlinkTraversal),
+	ruleFunc(skipSpecialFiles),
+	ruleFunc(requireSymlinksLast),
+	ruleFunc(sanitizeFileMode),
+	ruleFunc(dropExtraFields),
+	ruleFunc(dropXattrs),
+}
+
+// Writer implements a zip file writer.
+//
+// Unlike the Writer of archive/zip, the Writer applies the security features of its SecurityMode
+// on the headers of the entries it creates, so producers of user-facing archives cannot emit
+// entries that traverse out of the extraction directory:
+//   - SanitizeFilenames makes the names relative and drops their ".." path components
+//   - SanitizeFileMode drops the setuid, setgid and sticky bits
+//   - DropExtraFields drops the extra fields not allow listed
+//   - SkipSpecialFiles refuses special files
+//   - SanitizeSymlinkTargets refuses the symbolic links whose target points outside of the
+//     archive, directly or through the links created before, like the Reader drops them. So that
+//     the links are never written unchecked, SkipSpecialFiles confines their targets as well
+//   - SkipWindowsShortFilenames, PreventSymlinkTraversal, RequireSymlinksLast and DropXattrs
+//     refuse the entries the Reader would skip or reject
+//
+// Refused entries make CreateHeader fail with a safearchive.EntryError wrapping
+// safearchive.ErrRejected (e.g. ErrSpecialFile), since an archive silently missing entries would
+// be surprising to its author. In StrictMode, the Writer fails the same way instead of rewriting a
+// header for a security reason. The headers passed to the Writer are never modified.
+//
+// As the target of a symbolic link is the content of its entry, when the targets are checked the
+// entry of a link is only written once its target is complete: the next call to Create,
+// CreateHeader, CreateRaw, Copy, Flush or Close checks the target first, and fails about the link
+// without writing it if the target is refused.
+type Writer struct {
+	zw           *zip.Writer
+	securityMode SecurityMode
+	// state holds the findings about the entries created so far, st is the state of the rules
+	// (e.g. the symbolic links created so far).
+	state *Reader
+	st    magicState
+	// link is the symbolic link being created, whose target is checked before writing it.
+	link *pendingLink
+}
+
+// pendingLink is a symbolic link whose entry is written once its target is complete and checked.
+type pendingLink struct {
+	orig   FileHeader
+	fh     *FileHeader
+	raw    bool
+	target bytes.Buffer
+}
+
+// linkWriter collects the target of the pending symbolic link l.
+type linkWriter struct {
+	w *Writer
+	l *pendingLink
+}
+
+func (lw linkWriter) Write(p []byte) (int, error) {
+	if lw.w.link != lw.l {
+		return 0, errors.New("zip: write to closed file")
+	}
+	if lw.l.target.Len()+len(p) > limits.MaxLinknameLen {
+		lw.w.link = nil
+		return 0, lw.w.verdict(safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonSymlinkTarget, Detail: "target too long"})
+	}
+	return lw.l.target.Write(p)
+}
+
+// NewWriter returns a new Writer writing a zip file to w, with DefaultSecurityMode.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		zw:           zip.NewWriter(w),
+		securityMode: DefaultSecurityMode,
+		state:        &Reader{mu: &sync.RWMutex{}, aes: &aesState{}, checksums: &checksumState{}},
+	}
+}
+
+// SetSecurityMode controls the security features applied on the entries created after the call.
+func (w *Writer) SetSecurityMode(sm SecurityMode) {
+	w.securityMode = sm
+}
+
+// GetSecurityMode returns the currently enabled security rules
+func (w *Writer) GetSecurityMode() SecurityMode {
+	return w.securityMode
+}
+
+// Report returns the findings about the entries created so far: every entry that was sanitized
+// or refused, along with the reason code of the security feature that flagged it. Offsets are
+// unknown (-1).
+func (w *Writer) Report() *safearchive.Report {
+	return w.state.report()
+}
+
+// sanitize applies the security features of the Writer on a copy of fh.
+func (w *Writer) sanitize(fh *FileHeader) (*FileHeader, error) {
+	r := w.state
+	r.securityMode = w.securityMode
+	r.originalFiles = []*zip.File{{FileHeader: *fh}}
+	f := zip.File{FileHeader: *fh}
+	w.st.original = fh.Name
+	for _, ru := range writerRules {
+		if err := w.verdict(ru.apply(r, &w.st, &f)); err != nil {
+			return nil, err
+		}
+	}
+	if f.Name != fh.Name {
+		f.Name = toZipName(f.Name)
+	}
+	return &f.FileHeader, nil
+}
+
+// verdict records the finding v about the entry being created, and returns the error refusing
+// the entry if v drops or rejects it (or rewrites it, in StrictMode).
+func (w *Writer) verdict(v safearchive.Verdict) error {
+	if v.Reason == "" {
+		return nil
+	}
+	if w.securityMode&StrictMode != 0 {
+		v = v.Strict()
+	}
+	if v.Action == safearchive.ActionDropped {
+		v.Action = safearchive.ActionRejected
+	}
+	finding := w.state.flag(0, v)
+	if finding.Action == safearchive.ActionRejected {
+		return finding.Err(safearchive.RejectionError(v.Reason))
+	}
+	return nil
+}
+
+// create creates the entry of the sanitized header sfh, or defers it until the target is complete
+// if sfh is a symbolic link whose target has to be checked.
+func (w *Writer) create(sfh *FileHeader, raw bool) (io.Writer, error) {
+	if !w.checksLinkTargets() || sfh.Mode()&fs.ModeSymlink == 0 {
+		if raw {
+			return w.zw.CreateRaw(sfh)
+		}
+		return w.zw.CreateHeader(sfh)
+	}
+	if raw && sfh.Method != Store {
+		return nil, w.verdict(safearchive.Verdict{Action: safearchive.ActionDropped, Reason: safearchive.ReasonSymlinkTarget, Detail: "compressed target"})
+	}
+	w.link = &pendingLink{orig: w.state.originalFiles[0].FileHeader, fh: sfh, raw: raw}
+	return linkWriter{w: w, l: w.link}, nil
+}
+
+// checksLinkTargets reports if the Writer checks the targets of the symbolic links.
+func (w *Writer) checksLinkTargets() bool {
+	return w.securityMode&(SanitizeSymlinkTargets|SkipSpecialFiles) != 0
+}
+
+// finishLink checks the target of the pending symbolic link, if any, and writes its entry.
+func (w *Writer) finishLink() error {
+	l := w.link
+	if l == nil {
+		return nil
+	}
+	w.link = nil
+	w.state.originalFiles = []*zip.File{{FileHeader: l.orig}}
+	if err := w.verdict(checkLinkTarget(w.state, &w.st, l.fh.Name, l.target.String())); err != nil {
+		return err
+	}
+	var fw io.Writer
+	var err error
+	if l.raw {
+		fw, err = w.zw.CreateRaw(l.fh)
+	} else {
+		fw, err = w.zw.CreateHeader(l.fh)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = fw.Write(l.target.Bytes())
+	return err
+}
+
+// SetOffset sets the offset of the beginning of the zip data within the
+// underlying writer. It should be used when the zip data is appended to an
+// existing file, such as a binary executable.
+// It must be called before any data is written.
+func (w *Writer) SetOffset(n int64) {
+	w.zw.SetOffset(n)
+}
+
+// Flush flushes any buffered data to the underlying writer.
+// Calling Flush is not normally necessary; calling Close is sufficient.
+func (w *Writer) Flush() error {
+	if err := w.finishLink(); err != nil {
+		return err
+	}
+	return w.zw.Flush()
+}
+
+// SetComment sets the end-of-central-directory comment field.
+// It can only be called before Close.
+func (w *Writer) SetComment(comment string) error {
+	return w.zw.SetComment(comment)
+}
+
+// Close finishes writing the zip file by writing the central directory.
+// It does not close the underlying writer.
+func (w *Writer) Close() error {
+	err := w.finishLink()
+	if cerr := w.zw.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Create adds a file to the zip file using the provided name.
+// It returns a Writer to which the file contents should be written.
+// The file contents will be compressed using the Deflate method.
+// See CreateHeader for the security features applied on the entry.
+func (w *Writer) Create(name string) (io.Writer, error) {
+	return w.CreateHeader(&FileHeader{Name: name, Method: Deflate})
+}
+
+// CreateHeader adds a file to the zip archive using the provided FileHeader, after applying the
+// security features of the Writer on a copy of it, for the file metadata.
+// It returns a Writer to which the file contents should be written.
+//
+// The file's contents must be written to the io.Writer before the next
+// call to Create, CreateHeader, CreateRaw, or Close.
+func (w *Writer) CreateHeader(fh *FileHeader) (io.Writer, error) {
+	if err := w.finishLink(); err != nil {
+		return nil, err
+	}
+	sfh, err := w.sanitize(fh)
+	if err != nil {
+		return nil, err
+	}
+	return w.create(sfh, false)
+}
+
+// CreateRaw adds a file to the zip archive using the provided FileHeader, after applying the
+// security features of the Writer on a copy of it, and returns a Writer to which the file
+// contents should be written. The file's contents must be written to the io.Writer before the
+// next call to Create, CreateHeader, CreateRaw, or Close.
+//
+// In contrast to CreateHeader, the bytes passed to Writer are not compressed.
+func (w *Writer) CreateRaw(fh *FileHeader) (io.Writer, error) {
+	if err := w.finishLink(); err != nil {
+		return nil, err
+	}
+	sfh, err := w.sanitize(fh)
+	if err != nil {
+		return nil, err
+	}
+	return w.create(sfh, true)
+}
+
+// Copy copies the file f (obtained from a Reader) into w. It copies the raw
+// form directly bypassing decompression, compression, and validation.
+// The security features of the Writer are applied on the header of f.
+func (w *Writer) Copy(f *File) error {
+	return CopyRaw(w, f, f.Name)
+}
+
+// RegisterCompressor registers or overrides a custom compressor for a specific
+// method ID. If a compressor for a given method is not found, Writer will
+// default to looking up the compressor at the package level.
+// In the hardened profile (see safearchive.Hardened) RegisterCompressor does nothing.
+func (w *Writer) RegisterCompressor(method uint16, comp Compressor) {
+	if safearchive.Hardened {
+		return
+	}
+	w.zw.RegisterCompressor(method, comp)
+}
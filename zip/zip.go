@@ -15,20 +15,29 @@
 // Package zip is a drop-in replacement for archive/zip which security focus.
 //
 // To prevent security implications (e.g. directory traversal) of attacker controlled crafted zip
-// archives, this library sanitizes
-// - file names (bugos filename entries like ../something are fixed on the fly)
-// - the file mode (removing special bits like setuid)
-// It also:
-// - skips symbolic link entries
-// - skips special file types silently (fifos, device nodes, char devices, etc.)
+// archives, this library can sanitize
+// - file names (bugos filename entries like ../something are fixed on the fly, SanitizeFilenames)
+// - the file mode (removing special bits like setuid, SanitizeFileMode)
+// It can also:
+// - skip the entries that would be extracted through a symbolic link (PreventSymlinkTraversal)
+// - skip special file types silently (fifos, device nodes, char devices, etc., SkipSpecialFiles)
+// - strip the extra fields of the headers (DropExtraFields)
+// - skip the extended attributes stored by macOS in AppleDouble entries (DropXattrs)
+// - drop the entries whose local file header disagrees with the central directory
+// (VerifyLocalHeaders)
 //
-// All these features are enabled by default and can be turned off one-by-one via the SetSecurityMode
-// method of the Reader/ReadCloser.
+// Each feature can be turned on and off via the SetSecurityMode method of the Reader/ReadCloser.
+// Only DefaultSecurityMode is enabled by default; MaximumSecurityMode enables most of the others,
+// but not the ones that would break legitimate archives, such as DropExtraFields (see the
+// documentation of each feature). The hardened profile (see safearchive.Hardened) enables
+// MaximumSecurityMode by default.
 //
 // Features turned on by default:
 // - SanitizeFilenames
 // - PreventSymlinkTraversal
-// These two features are compatible with all known legitimate use-cases.
+// These two features are compatible with all known legitimate use-cases. Windows and macOS builds
+// enable PreventCaseInsensitiveSymlinkTraversal as well, and Windows builds
+// SkipWindowsShortFilenames.
 //
 // You may enable the other features individually like this:
 // tr := zip.OpenReader("some.zip")
@@ -42,10 +51,18 @@ package zip
 
 import (
 	"archive/zip" // NOLINT
+	"bytes"
+	"fmt"
 	"io"
 	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/google/safearchive"
 	"github.com/google/safearchive/sanitizer"
 )
 
@@ -65,6 +82,23 @@ var (
 	ErrChecksum = zip.ErrChecksum
 )
 
+// Errors wrapped by the error of a Reader rejecting an entry in StrictMode. All of them wrap
+// safearchive.ErrRejected.
+var (
+	ErrPathTraversal        = safearchive.ErrPathTraversal
+	ErrAbsolutePath         = safearchive.ErrAbsolutePath
+	ErrSymlinkTraversal     = safearchive.ErrSymlinkTraversal
+	ErrSpecialFile          = safearchive.ErrSpecialFile
+	ErrSpecialMode          = safearchive.ErrSpecialMode
+	ErrWindowsShortFilename = safearchive.ErrWindowsShortFilename
+	ErrBackslash            = safearchive.ErrBackslash
+	ErrFanOut               = safearchive.ErrFanOut
+	ErrOrderDependent       = safearchive.ErrOrderDependent
+	ErrSymlinkTarget        = safearchive.ErrSymlinkTarget
+	ErrEncryptedEntry       = safearchive.ErrEncryptedEntry
+	ErrInvalidEncoding      = safearchive.ErrInvalidEncoding
+)
+
 // A Compressor returns a new compressing writer, writing to w.
 // The WriteCloser's Close method must be used to flush pending data to w.
 // The Compressor itself must be safe to invoke from multiple goroutines
@@ -96,18 +130,125 @@ type FileHeader = zip.FileHeader
 // A ReadCloser is a Reader that must be closed when no longer needed.
 type ReadCloser struct {
 	Reader
-	upstreamReadCloser *zip.ReadCloser
+	upstreamReadCloser io.Closer
 }
 
 // A Reader serves content from a ZIP archive.
+//
+// The setters of the Reader (SetSecurityMode, AddRule, SetLimits, ...) replace File with the
+// outcome of the rules. They may be called concurrently with each other and with Entries, Err,
+// Report and the getters, but not with reads of the File field: use Entries to iterate over the
+// files while another goroutine may reconfigure the Reader. The entries of File left unchanged by
+// the rules are the entries of the archive as parsed, shared by the successive outcomes of the
+// rules, so they must not be modified; the others are copies.
+//
+// The Open method of the files is safe for concurrent use, including with the setters, so callers
+// may scan the contents of the entries on multiple goroutines, as long as the io.ReaderAt of the
+// archive is safe for concurrent use (os.File and bytes.Reader are). Decompressors must be
+// registered (see RegisterDecompressor) before the files are opened.
 type Reader struct {
 	*zip.Reader
-	originalFiles []*zip.File
-	securityMode  SecurityMode
+	// mu guards the configuration and the outcome of the rules (File, findings and err) against
+	// concurrent reapplications of the rules, see Entries.
+	mu *sync.RWMutex
+	// applying serializes the applications of the rules. They run on a copy of the Reader without
+	// holding mu, so the hooks and filters they call may use the getters of the Reader.
+	applying        *sync.Mutex
+	originalFiles   []*zip.File
+	securityMode    SecurityMode
+	backslashPolicy BackslashPolicy
+	maxChildren     int
+	limits          Limits
+	subtree         string
+	sizeFactor      float64
+	onSanitize      safearchive.SanitizeHook
+	extraFields     []uint16
+	duplicates      safearchive.DuplicatePolicy
+	collisions      safearchive.DuplicatePolicy
+	nameEncoding    safearchive.NameEncodingPolicy
+	filter          EntryFilter
+	patterns        safearchive.Patterns
+	strip           int
+	prefix          string
+	// rules are the custom rules applied after the built-in security features.
+	rules []rule
+	// err is the error of the last application of the rules, if a rule rejected an entry or the
+	// archive exceeded the limits.
+	err error
+	// parseFindings are the findings about the archive as a whole, collected while it was opened.
+	parseFindings []safearchive.Finding
+	// findings are the findings about the entries, collected when the security rules were applied.
+	findings []safearchive.Finding
+
+	// src and size describe the archive as supplied, before any repairs of the tolerant mode.
+	src       io.ReaderAt
+	size      int64
+	retainRaw bool
+	// records are the central directory records of originalFiles, if they could be parsed, and
+	// recordsErr why they could not be.
+	records    []directoryRecord
+	recordsErr error
+	// overlaps are the names of the entries overlapping the ones of records, and spans the parts of
+	// the archive taken by the entries, see DetectOverlaps.
+	overlaps []string
+	spans    []span
+	// fsys is the file system served by Open, built from File on first use.
+	fsys *FS
+	// methods are the compression methods registered by RegisterCompressionMethods.
+	methods    []uint16
+	encryption EncryptionPolicy
+	aes        *aesState
+	checksums  *checksumState
+	// chunks is the state of the chunked parsing of the central directory, if any. The entries,
+	// src and records of the Reader are then the ones of the current chunk.
+	chunks *chunkState
 }
 
-// Writer implements a zip file writer.
-type Writer = zip.Writer
+// Options controls how NewReaderWithOptions and OpenReaderWithOptions parse an archive.
+type Options struct {
+	// Tolerant enables a leniency mode that accepts archives with common real-world malformations
+	// instead of failing with ErrFormat: wrong checksums or sizes in directory entries, extra
+	// fields with bad lengths, a wrong number of records declared in the end of central directory
+	// record, or a truncated archive comment. The repairs are listed in the Report of the Reader.
+	Tolerant bool
+	// Salvage enables a recovery mode for archives whose central directory is missing or
+	// truncated, e.g. interrupted uploads: if the archive cannot be opened, its entries are read
+	// from the local file headers until the first invalid or truncated one. The local file headers
+	// do not store the file modes, so the salvaged entries are regular files and directories. The
+	// security rules and the limits on the central directory apply to the salvaged entries, and the
+	// recovery is listed in the Report of the Reader. The archive is scanned once; an entry whose
+	// sizes follow its data is not salvaged if its data contains more than 1024 candidate data
+	// descriptors.
+	Salvage bool
+	// Diagnostics, if set, receives a diagnostic bundle (see safearchive.Bundle) as JSON when the
+	// archive cannot be opened, to aid bug reports about rejected archives.
+	Diagnostics io.Writer
+	// MaxDirectoryRecords and MaxDirectorySize limit the number of central directory records and
+	// their total size in bytes, bounding the memory spent parsing the archive before any entry
+	// is surfaced. Archives exceeding them fail to open with an error wrapping ErrLimitExceeded.
+	// Zero values mean no limit.
+	MaxDirectoryRecords int
+	MaxDirectorySize    int64
+	// DirectoryChunk, if positive, is the maximum number of central directory records parsed at
+	// once. The Reader of an archive with more records presents their first chunk in File, and
+	// the following ones one at a time with NextChunk, so the memory spent on the entries is
+	// bounded regardless of their number. Like the upstream parser, the Reader fails with
+	// ErrFormat if the central directory has fewer (valid) records than declared. DetectOverlaps
+	// checks the entries against the ones of the earlier chunks as well.
+	DirectoryChunk int
+	// MaxCommentLength limits the length of the archive comment declared by the end of central
+	// directory record. Archives exceeding it fail to open with an error wrapping
+	// ErrLimitExceeded. Zero means no limit.
+	MaxCommentLength int
+	// ValidateDirectoryEnd rejects the archives whose end of central directory record is
+	// inconsistent with the rest of the archive, which parsers handle differently: a declared
+	// number of records or directory size that does not match the central directory, a comment
+	// length that does not match the end of the archive, a comment holding another end of central
+	// directory record, or multi-disk values. They fail to open with a *DirectoryEndError, or an
+	// error wrapping ErrFormat if the zip64 end of central directory record or its locator is
+	// inconsistent. In tolerant mode, the archive is validated once repaired.
+	ValidateDirectoryEnd bool
+}
 
 // SecurityMode controls security features to enforce
 type SecurityMode int
@@ -135,11 +276,180 @@ const (
 	// By default, this is activated only on Windows builds. If you are extracting to a Windows
 	// filesystem on a non-Windows platform, you should activate this feature explicitly.
 	SkipWindowsShortFilenames SecurityMode = 32
+	// StrictMode empties File and makes Err return a typed error (e.g. ErrPathTraversal) instead
+	// of silently skipping or rewriting entries flagged by the other security features.
+	// Informational rewrites (e.g. a cosmetic normalization of the name) are performed still.
+	// This feature is not enabled by default, nor is it part of MaximumSecurityMode.
+	StrictMode SecurityMode = 64
+	// FlagImplausibleSizes reports the entries declaring sizes they cannot have: directories with
+	// nonzero sizes and entries declaring more uncompressed data than the size of the archive
+	// times the implausible size factor (see SetImplausibleSizeFactor). These are early signals of
+	// zip bombs and tampering, available before decompressing anything. The entries are kept.
+	// This feature is not enabled by default.
+	FlagImplausibleSizes SecurityMode = 128
+	// RequireSymlinksLast rejects archives whose extraction depends on the order of their entries:
+	// entries replacing a directory of earlier entries, entries written through a symbolic link
+	// and entries other than symbolic links following a symbolic link. File is emptied and Err
+	// returns ErrOrderDependent. Archives with the symbolic links at their end can be extracted
+	// safely in any order.
+	// This feature is not enabled by default, nor is it part of MaximumSecurityMode.
+	RequireSymlinksLast SecurityMode = 256
+	// SanitizeSymlinkTargets validates the targets of symbolic links, instead of relying on
+	// PreventSymlinkTraversal only: links with absolute targets or with targets whose ".." path
+	// components escape the root of the archive are skipped (see sanitizer.SanitizeLinkTarget), as
+	// are the links escaping through the links seen before (e.g. "d/l2" to "l1/.." with "d/l1" to
+	// ".."), see safearchive.SymlinkSet.AddLink.
+	// Zip archives store the targets as the contents of the links, so unlike the tar Reader, the
+	// Reader cannot rewrite them. Relative links between the entries of the archive are kept.
+	// This feature is not enabled by default, nor is it part of MaximumSecurityMode, as it loses
+	// entries.
+	SanitizeSymlinkTargets SecurityMode = 512
+	// DropExtraFields drops the extra fields (e.g. the unix owners 0x7875, the NTFS timestamps
+	// 0x000a or other Info-ZIP blocks) from the headers, except the ones allowed by
+	// SetExtraFieldAllowlist, so no metadata reaches the extraction unnoticed. It is the
+	// counterpart of DropXattrs of the tar Reader.
+	// This feature is not enabled by default, nor is it part of MaximumSecurityMode, as most
+	// archives have extra fields, which would make every entry a finding.
+	DropExtraFields SecurityMode = 1024
+	// DropXattrs drops the AppleDouble entries (the "._" files and the __MACOSX directory) in which
+	// the archivers of macOS store the extended attributes and resource forks of the files, so
+	// they are not extracted as regular files next to them. It is the counterpart of DropXattrs of
+	// the tar Reader; see DropExtraFields for the metadata stored in the headers.
+	// This feature is not enabled by default.
+	DropXattrs SecurityMode = 2048
+	// VerifyLocalHeaders cross-checks the local file header of every entry against its central
+	// directory record (name, compression method, CRC-32, sizes and position) and drops the
+	// entries where they disagree, see ReasonHeaderMismatch. The archives whose central directory
+	// records cannot be matched with the entries are rejected.
+	VerifyLocalHeaders SecurityMode = 4096
+	// DetectOverlaps drops the entries whose local file header or data overlaps the ones of another
+	// entry, as in the zip bombs referring to the same compressed data many times over, see
+	// ReasonOverlap. The archives whose central directory records cannot be matched with the
+	// entries are rejected.
+	DetectOverlaps SecurityMode = 8192
+	// SanitizeUnicode strips the characters used to disguise names in listings (control,
+	// bidirectional formatting and zero-width characters, see sanitizer.IsUnsafeRune) from the
+	// names of the entries, and rejects them in StrictMode.
+	SanitizeUnicode SecurityMode = 16384
+	// ValidateNameEncoding checks that the names of the entries are valid UTF-8 without NUL bytes,
+	// replacing the invalid bytes or rejecting the entries as set by the NameEncodingPolicy of the
+	// Reader (see SetNameEncodingPolicy), and rejects them in StrictMode. Names flagged as not UTF-8
+	// (e.g. in the legacy code page 437) are checked as well.
+	ValidateNameEncoding SecurityMode = 32768
+)
+
+// DefaultImplausibleSizeFactor is the default implausible size factor of FlagImplausibleSizes,
+// the maximum compression ratio of DEFLATE.
+const DefaultImplausibleSizeFactor = 1032
+
+// BackslashPolicy controls how backslashes in entry names are interpreted.
+// The zip specification mandates forward slashes as path separators, but archives created on
+// Windows sometimes use backslashes.
+type BackslashPolicy int
+
+const (
+	// BackslashSeparator treats backslashes as path separators, so a\b is extracted as file b in
+	// directory a. This is the default.
+	BackslashSeparator BackslashPolicy = iota
+	// BackslashLiteral keeps backslashes as part of the path component, so a\b is extracted as a
+	// file named a\b. Backslashes are path separators on Windows, so there this policy behaves
+	// like BackslashSeparator. Elsewhere, entries whose names contain the private use character
+	// U+F05C are dropped, as it stands in for the backslashes while the names are sanitized.
+	BackslashLiteral
+	// BackslashReject drops entries that have a backslash in their name.
+	BackslashReject
 )
 
+// backslashPlaceholder stands in for literal backslashes while a name is sanitized. It is the
+// private use character Cygwin and WSL map backslashes to.
+const backslashPlaceholder = "\uf05c"
+
+var securityModeNames = []struct {
+	mode SecurityMode
+	name string
+}{
+	{PreventSymlinkTraversal, "PreventSymlinkTraversal"},
+	{SkipSpecialFiles, "SkipSpecialFiles"},
+	{SanitizeFileMode, "SanitizeFileMode"},
+	{SanitizeFilenames, "SanitizeFilenames"},
+	{PreventCaseInsensitiveSymlinkTraversal, "PreventCaseInsensitiveSymlinkTraversal"},
+	{SkipWindowsShortFilenames, "SkipWindowsShortFilenames"},
+	{StrictMode, "StrictMode"},
+	{FlagImplausibleSizes, "FlagImplausibleSizes"},
+	{RequireSymlinksLast, "RequireSymlinksLast"},
+	{SanitizeSymlinkTargets, "SanitizeSymlinkTargets"},
+	{DropExtraFields, "DropExtraFields"},
+	{DropXattrs, "DropXattrs"},
+	{VerifyLocalHeaders, "VerifyLocalHeaders"},
+	{DetectOverlaps, "DetectOverlaps"},
+	{SanitizeUnicode, "SanitizeUnicode"},
+	{ValidateNameEncoding, "ValidateNameEncoding"},
+}
+
+// options are the names of the configurable behaviors of the Reader, registered as features.
+var options = []string{
+	"Tolerant",
+	"Salvage",
+	"Diagnostics",
+	"MaxDirectoryRecords",
+	"MaxDirectorySize",
+	"DirectoryChunk",
+	"MaxCommentLength",
+	"ValidateDirectoryEnd",
+	"BackslashPolicy",
+	"MaxChildren",
+	"Limits",
+	"Subtree",
+	"ImplausibleSizeFactor",
+	"RetainRawHeaders",
+	"Rules",
+	"OnSanitize",
+	"ExtraFieldAllowlist",
+	"DuplicatePolicy",
+	"CollisionPolicy",
+	"EntryFilter",
+	"IncludePatterns",
+	"ExcludePatterns",
+	"StripComponents",
+	"Prefix",
+	"CompressionMethods",
+	"EncryptionPolicy",
+	"PasswordProvider",
+	"NameEncodingPolicy",
+	"ChecksumPolicy",
+}
+
+func init() {
+	safearchive.RegisterFeatures(safearchive.Feature{Package: "zip", Kind: safearchive.FeatureFormat, Name: "zip"})
+	for _, m := range securityModeNames {
+		safearchive.RegisterFeatures(safearchive.Feature{Package: "zip", Kind: safearchive.FeatureRule, Name: m.name})
+	}
+	for _, o := range options {
+		safearchive.RegisterFeatures(safearchive.Feature{Package: "zip", Kind: safearchive.FeatureOption, Name: o})
+	}
+}
+
+// String returns the names of the enabled features separated by |.
+func (s SecurityMode) String() string {
+	var names []string
+	for _, m := range securityModeNames {
+		if s&m.mode != 0 {
+			names = append(names, m.name)
+			s &^= m.mode
+		}
+	}
+	if s != 0 {
+		names = append(names, fmt.Sprintf("%#x", int(s)))
+	}
+	if len(names) == 0 {
+		return "0"
+	}
+	return strings.Join(names, "|")
+}
+
 // MaximumSecurityMode enables all security features. Apps that care about file contents only
 // and nothing unix specific (e.g. file modes or special devices) should use this mode.
-const MaximumSecurityMode = SanitizeFilenames | PreventSymlinkTraversal | SanitizeFileMode | SkipSpecialFiles | PreventCaseInsensitiveSymlinkTraversal | SkipWindowsShortFilenames
+const MaximumSecurityMode = SanitizeFilenames | PreventSymlinkTraversal | SanitizeFileMode | SkipSpecialFiles | PreventCaseInsensitiveSymlinkTraversal | SkipWindowsShortFilenames | FlagImplausibleSizes | DropXattrs | VerifyLocalHeaders | DetectOverlaps | SanitizeUnicode | ValidateNameEncoding
 
 func isSpecialFile(f zip.File) bool {
 	amode := f.Mode()
@@ -151,121 +461,557 @@ func isSpecialFile(f zip.File) bool {
 	return false
 }
 
+// sanitizePath sanitizes name according to the backslash policy of the reader.
+func (r *Reader) sanitizePath(name string) string {
+	if r.backslashPolicy != BackslashLiteral || runtime.GOOS == "windows" {
+		return sanitizer.SanitizePath(name)
+	}
+	name = strings.ReplaceAll(name, `\`, backslashPlaceholder)
+	return strings.ReplaceAll(sanitizer.SanitizePath(name), backslashPlaceholder, `\`)
+}
+
 // applyMagic sanitizes and/or filters the entries of this zip archive
 // depending on the SecurityMode setting.
 // See the SecurityMode constants above to learn more about what kind of
 // security measures are currently supported.
-func applyMagic(files []*zip.File, securityMode SecurityMode) []*zip.File {
-
-	symlinks := map[string]bool{}
-	var re []*zip.File
-	for _, fp := range files {
-		// making a copy, since we change some fields (Name and ExternalAttrs)
-		f := *fp
-
-		if securityMode&SanitizeFilenames != 0 {
-			// Sanitize filename
-			f.Name = sanitizer.SanitizePath(f.Name)
+// It returns the files kept by the rules, setting err, and the state of the rules after the
+// entries of the current chunk. As the File field belongs to the upstream reader, which the copies
+// of the Reader share, the files are only published by the caller (see publish).
+func (r *Reader) applyMagic() ([]*zip.File, magicState) {
+	st := magicState{fanOut: safearchive.FanOutLimiter{Max: r.maxChildren}, duplicates: safearchive.DuplicateChecker{Policy: r.duplicates}, collisions: safearchive.DuplicateChecker{Policy: r.collisions, Fold: true}}
+	r.findings, r.err, r.fsys = nil, nil, nil
+	if r.chunks != nil {
+		if r.err = r.replayChunks(&st); r.err != nil {
+			return nil, st
 		}
+	}
+	var files []*zip.File
+	files, r.err = r.applyRules(&st)
+	return files, st
+}
 
-		if securityMode&SkipWindowsShortFilenames != 0 && sanitizer.HasWindowsShortFilenames(f.Name) {
-			continue
-		}
+// applyRules applies the rules on the original files, continuing from st, and returns the files
+// they keep or their error.
+func (r *Reader) applyRules(st *magicState) ([]*zip.File, error) {
+	if err := r.checkLimits(st); err != nil {
+		return nil, err
+	}
+	re := make([]*zip.File, 0, len(r.originalFiles))
+	// f is the scratch copy the rules are applied on, since they change some fields (Name and
+	// ExternalAttrs). It is copied again only if they did.
+	var f zip.File
+files:
+	for i, fp := range r.originalFiles {
+		f = *fp
+		st.original, st.index = fp.Name, i
+		start := len(r.findings)
 
-		if securityMode&PreventSymlinkTraversal != 0 {
-			fName := sanitizer.SanitizePath(f.Name)
-			fName = strings.TrimSuffix(fName, "/")
-			if securityMode&PreventCaseInsensitiveSymlinkTraversal != 0 {
-				fName = strings.ToLower(fName)
-			}
-			n := strings.Split(fName, "/")
-			traversal := false
-			for i := 1; i <= len(n); i++ {
-				subPath := strings.Join(n[0:i], "/")
-				if symlinks[subPath] {
-					// a symlink has already been seen on this path. We need to drop this entry.
-					traversal = true
-					break
-				}
-			}
-			if traversal {
+		// the names changed by the custom rules are checked again, and the entries are tracked
+		// with their final names
+		var name string
+		for stage, rules := range [][]rule{builtinRules, r.rules, recheckRules, trackingRules} {
+			switch {
+			case stage == 1:
+				name = f.Name
+			case stage == 2 && f.Name == name:
 				continue
 			}
-			if f.Mode()&fs.ModeSymlink != 0 {
-				symlinks[fName] = true
+			keep, err := r.applyStage(rules, st, &f)
+			if err != nil {
+				return nil, err
+			}
+			if !keep {
+				continue files
 			}
 		}
 
-		if securityMode&SkipSpecialFiles != 0 {
-			if isSpecialFile(f) {
-				continue
+		if f.Name != fp.Name {
+			for j := start; j < len(r.findings); j++ {
+				r.findings[j].NewName = f.Name
 			}
 		}
+		if !r.selected(st.selectName) {
+			continue
+		}
+		keep, err := r.applyFilter(i, &f)
+		if err != nil {
+			return nil, err
+		}
+		if !keep {
+			continue
+		}
+		if sameHeader(&f.FileHeader, &fp.FileHeader) {
+			re = append(re, fp)
+			continue
+		}
+		c := f
+		re = append(re, &c)
+	}
+	if r.chunks != nil {
+		// the entries of the next chunks may overlap the ones of this one
+		for _, s := range r.spans {
+			st.chunkSpans.add(s, r.records[s.i].name)
+		}
+	}
+	return re, nil
+}
 
-		if securityMode&SanitizeFileMode != 0 {
-			amode := f.Mode()
-			for _, m := range []fs.FileMode{fs.ModeTemporary, fs.ModeAppend, fs.ModeExclusive, fs.ModeSetuid, fs.ModeSetgid, fs.ModeSticky} {
-				amode = amode &^ fs.FileMode(m)
+// applyStage applies rules on f, the current entry of st, see applyRules. It reports whether the
+// entry is to be kept.
+func (r *Reader) applyStage(rules []rule, st *magicState, f *zip.File) (bool, error) {
+	for _, ru := range rules {
+		v := ru.apply(r, st, f)
+		if v.Reason == "" {
+			if v.Action == safearchive.ActionDropped {
+				// skipped without a finding, see stripComponents
+				return false, nil
 			}
-			f.SetMode(amode)
+			continue
+		}
+		if r.securityMode&StrictMode != 0 {
+			v = v.Strict()
+		}
+		finding := r.flag(st.index, v)
+		switch finding.Action {
+		case safearchive.ActionDropped:
+			return false, nil
+		case safearchive.ActionRejected:
+			return false, finding.Err(safearchive.RejectionError(v.Reason))
 		}
+	}
+	return true, nil
+}
 
-		re = append(re, &f)
+// sameHeader reports whether the fields of a and b are equal.
+func sameHeader(a, b *zip.FileHeader) bool {
+	return a.Name == b.Name && a.Comment == b.Comment && a.NonUTF8 == b.NonUTF8 &&
+		a.CreatorVersion == b.CreatorVersion && a.ReaderVersion == b.ReaderVersion &&
+		a.Flags == b.Flags && a.Method == b.Method && a.Modified == b.Modified &&
+		a.ModifiedTime == b.ModifiedTime &&
+		a.ModifiedDate == b.ModifiedDate && a.CRC32 == b.CRC32 &&
+		a.CompressedSize == b.CompressedSize && a.UncompressedSize == b.UncompressedSize &&
+		a.CompressedSize64 == b.CompressedSize64 && a.UncompressedSize64 == b.UncompressedSize64 &&
+		bytes.Equal(a.Extra, b.Extra) && a.ExternalAttrs == b.ExternalAttrs
+}
+
+// reapply changes the configuration of the Reader with set and reapplies the security rules on the
+// set of files in the archive. It returns the error of the rules.
+func (r *Reader) reapply(set func()) error {
+	r.applying.Lock()
+	defer r.applying.Unlock()
+	r.mu.Lock()
+	set()
+	c := *r
+	r.mu.Unlock()
+	files, st := c.applyMagic()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.publish(&c, files)
+	if r.chunks != nil {
+		r.chunks.state = st
 	}
+	return r.err
+}
 
-	return re
+// publish replaces the outcome of the rules with files and the findings and error of c, a copy of
+// the Reader the rules were applied on, along with the parts of the archive they loaded.
+func (r *Reader) publish(c *Reader, files []*zip.File) {
+	r.Reader, r.originalFiles, r.src, r.size = c.Reader, c.originalFiles, c.src, c.size
+	r.records, r.recordsErr, r.overlaps, r.spans = c.records, c.recordsErr, c.overlaps, c.spans
+	r.File, r.findings, r.err, r.fsys = files, c.findings, c.err, nil
 }
 
-// OpenReader will open the Zip file specified by name and return a ReadCloser.
-func OpenReader(name string) (*ReadCloser, error) {
-	o, err := zip.OpenReader(name)
+// flag records a finding about the i-th entry of the archive.
+func (r *Reader) flag(i int, v safearchive.Verdict) safearchive.Finding {
+	f := safearchive.Finding{Name: r.originalFiles[i].Name, Offset: -1, Reason: v.Reason, Action: v.Action, Detail: v.Detail}
+	if r.records != nil {
+		f.Offset = r.records[i].offset
+		if r.retainRaw {
+			f.Raw = r.records[i].raw
+		}
+	}
+	f = r.onSanitize.Call(f)
+	r.findings = append(r.findings, f)
+	return f
+}
+
+// nameChanged reports if sanitization changed name to sanitized in any way other than the
+// choice of path separators.
+func (r *Reader) nameChanged(name, sanitized string) bool {
+	if r.backslashPolicy != BackslashLiteral || runtime.GOOS == "windows" {
+		name = strings.ReplaceAll(name, `\`, "/")
+	}
+	return filepath.ToSlash(sanitized) != name
+}
+
+// OpenReaderWithOptions will open the Zip file specified by name and return a ReadCloser.
+func OpenReaderWithOptions(name string, opts Options) (*ReadCloser, error) {
+	f, err := os.Open(name)
 	if err != nil {
 		return nil, err
 	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r, err := NewReaderWithOptions(f, fi.Size(), opts)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &ReadCloser{Reader: *r, upstreamReadCloser: f}, nil
+}
 
-	r := Reader{Reader: &o.Reader, originalFiles: o.File}
-	rc := ReadCloser{Reader: r, upstreamReadCloser: o}
-	rc.SetSecurityMode(DefaultSecurityMode)
-	return &rc, nil
+// OpenReader will open the Zip file specified by name and return a ReadCloser.
+func OpenReader(name string) (*ReadCloser, error) {
+	return OpenReaderWithOptions(name, Options{})
 }
 
 // SetSecurityMode applies the security rules on the set of files in the archive
 func (r *ReadCloser) SetSecurityMode(sm SecurityMode) {
-	r.File = applyMagic(r.originalFiles, sm)
-	r.securityMode = sm
+	r.Reader.SetSecurityMode(sm)
 }
 
 // GetSecurityMode returns the currently enabled security rules
 func (r *ReadCloser) GetSecurityMode() SecurityMode {
-	return r.securityMode
+	return r.Reader.GetSecurityMode()
 }
 
 // Close closes the Zip file, rendering it unusable for I/O.
 func (r *ReadCloser) Close() error {
+	r.applying.Lock()
+	r.mu.Lock()
 	r.originalFiles = nil
+	r.mu.Unlock()
+	r.applying.Unlock()
 	return r.upstreamReadCloser.Close()
 }
 
 // NewReader returns a new Reader reading from r, which is assumed to
 // have the given size in bytes.
 func NewReader(r io.ReaderAt, size int64) (*Reader, error) {
+	return NewReaderWithOptions(r, size, Options{})
+}
+
+// NewReaderWithOptions returns a new Reader reading from r, which is assumed to
+// have the given size in bytes.
+func NewReaderWithOptions(r io.ReaderAt, size int64, opts Options) (*Reader, error) {
+	re, err := newReader(r, size, opts)
+	if err != nil && opts.Diagnostics != nil {
+		safearchive.NewBundle(err, nil, map[string]string{
+			"format":              "zip",
+			"size":                strconv.FormatInt(size, 10),
+			"tolerant":            strconv.FormatBool(opts.Tolerant),
+			"salvage":             strconv.FormatBool(opts.Salvage),
+			"maxDirectoryRecords": strconv.Itoa(opts.MaxDirectoryRecords),
+			"maxDirectorySize":    strconv.FormatInt(opts.MaxDirectorySize, 10),
+			"directoryChunk":      strconv.Itoa(opts.DirectoryChunk),
+			"maxCommentLength":    strconv.Itoa(opts.MaxCommentLength),
+			"validateEnd":         strconv.FormatBool(opts.ValidateDirectoryEnd),
+		}).WriteJSON(opts.Diagnostics)
+	}
+	return re, err
+}
+
+func newReader(r io.ReaderAt, size int64, opts Options) (*Reader, error) {
+	src, srcSize := r, size
+	if err := checkDirectory(r, size, opts); err != nil {
+		return nil, err
+	}
+	if err := checkComment(r, size, opts); err != nil {
+		return nil, err
+	}
+	var findings []safearchive.Finding
+	if opts.Tolerant {
+		p, f, err := repair(r, size)
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			r, size, findings = p, p.size(), f
+		}
+	}
+	if opts.ValidateDirectoryEnd {
+		if err := validateDirectoryEnd(r, size); err != nil {
+			return nil, err
+		}
+	}
+	if opts.DirectoryChunk > 0 {
+		c, err := newChunkState(r, size, opts.DirectoryChunk)
+		if err != nil {
+			return nil, err
+		}
+		if c != nil {
+			re := Reader{mu: &sync.RWMutex{}, applying: &sync.Mutex{}, aes: &aesState{}, checksums: &checksumState{}, parseFindings: findings, chunks: c}
+			if err := re.loadChunk(0); err != nil {
+				return nil, err
+			}
+			re.SetSecurityMode(DefaultSecurityMode)
+			return &re, nil
+		}
+	}
 	o, err := zip.NewReader(r, size)
+	if err != nil && opts.Salvage {
+		p, f, serr := salvage(src, srcSize, opts)
+		if serr != nil {
+			return nil, serr
+		}
+		if p != nil {
+			// The rebuilt archive is the one the security features check.
+			r, size, findings = p, p.size(), f
+			src, srcSize = r, size
+			o, err = zip.NewReader(r, size)
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
-	re := Reader{Reader: o, originalFiles: o.File}
+	re := Reader{Reader: o, mu: &sync.RWMutex{}, applying: &sync.Mutex{}, aes: &aesState{}, checksums: &checksumState{}, originalFiles: o.File, parseFindings: findings, src: src, size: srcSize}
 	re.SetSecurityMode(DefaultSecurityMode)
 	return &re, nil
 }
 
+// Report returns the findings about the archive and its entries: the repairs of the tolerant mode
+// and every entry that was renamed, sanitized or dropped by the last application of the security
+// rules, along with the reason code of the feature that flagged it.
+func (r *Reader) Report() *safearchive.Report {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.report()
+}
+
+func (r *Reader) report() *safearchive.Report {
+	findings := append([]safearchive.Finding{}, r.parseFindings...)
+	findings = append(findings, r.findings...)
+	r.checksums.mu.Lock()
+	defer r.checksums.mu.Unlock()
+	return &safearchive.Report{Findings: append(findings, r.checksums.findings...)}
+}
+
+// Diagnostics returns the diagnostic bundle of a failure caused by err, including the
+// configuration of the reader and its findings.
+func (r *Reader) Diagnostics(err error) *safearchive.Bundle {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return safearchive.NewBundle(err, r.report(), map[string]string{
+		"format":             "zip",
+		"size":               strconv.FormatInt(r.size, 10),
+		"securityMode":       r.securityMode.String(),
+		"backslashPolicy":    strconv.Itoa(int(r.backslashPolicy)),
+		"maxChildren":        strconv.Itoa(r.maxChildren),
+		"limits":             fmt.Sprintf("%+v", r.limits),
+		"sizeFactor":         strconv.FormatFloat(r.sizeFactor, 'g', -1, 64),
+		"subtree":            r.subtree,
+		"retainRawHeaders":   strconv.FormatBool(r.retainRaw),
+		"extraFields":        fmt.Sprintf("%#04x", r.extraFields),
+		"duplicatePolicy":    strconv.Itoa(int(r.duplicates)),
+		"collisionPolicy":    strconv.Itoa(int(r.collisions)),
+		"entryFilter":        strconv.FormatBool(r.filter != nil),
+		"includePatterns":    strings.Join(r.patterns.Include, ","),
+		"excludePatterns":    strings.Join(r.patterns.Exclude, ","),
+		"stripComponents":    strconv.Itoa(r.strip),
+		"prefix":             r.prefix,
+		"compressionMethods": fmt.Sprint(r.methods),
+		"encryptionPolicy":   strconv.Itoa(int(r.encryption)),
+		"nameEncoding":       strconv.Itoa(int(r.nameEncoding)),
+		"checksumPolicy":     strconv.Itoa(int(r.GetChecksumPolicy())),
+	})
+}
+
+// SetRetainRawHeaders controls whether the raw central directory records of the entries flagged
+// by a security feature are retained in the findings of the Report, so they can be examined
+// forensically.
+func (r *Reader) SetRetainRawHeaders(retain bool) {
+	r.reapply(func() {
+		r.retainRaw = retain
+		if retain {
+			r.parseRecords()
+		}
+	})
+}
+
+// directoryRecords parses the central directory records of the original entries. It fails if the
+// records do not match the entries parsed by the upstream reader.
+func (r *Reader) directoryRecords() ([]directoryRecord, error) {
+	if r.src == nil {
+		return nil, fmt.Errorf("zip: %w: no central directory", ErrFormat)
+	}
+	d, err := findDirectoryEnd(r.src, r.size)
+	if err != nil {
+		return nil, err
+	}
+	if d.zip64 {
+		if err := d.readDirectory64End(r.src); err != nil {
+			return nil, err
+		}
+	}
+	start := d.directoryStart(r.src)
+	records, err := readDirectoryRecords(r.src, start, d, len(r.originalFiles))
+	if err != nil {
+		return nil, err
+	}
+	if len(records) != len(r.originalFiles) {
+		return nil, fmt.Errorf("zip: %w: %d central directory records, %d entries", ErrFormat, len(records), len(r.originalFiles))
+	}
+	for i, rec := range records {
+		if rec.name != r.originalFiles[i].Name {
+			return nil, fmt.Errorf("zip: %w: central directory record %d names %q, the entry %q", ErrFormat, i, rec.name, r.originalFiles[i].Name)
+		}
+		// account for data prepended to the archive
+		records[i].headerOffset += start - int64(d.directoryOffset)
+	}
+	return records, nil
+}
+
+// parseRecords parses the central directory records of the Reader, unless they were parsed
+// already, recording why they could not be.
+func (r *Reader) parseRecords() {
+	if r.records == nil {
+		r.records, r.recordsErr = r.directoryRecords()
+	}
+}
+
 // SetSecurityMode applies the security rules on the set of files in the archive
 func (r *Reader) SetSecurityMode(sm SecurityMode) {
-	r.File = applyMagic(r.originalFiles, sm)
-	r.securityMode = sm
+	r.reapply(func() {
+		r.securityMode = sm
+		r.loadRecords()
+	})
+}
+
+// SetBackslashPolicy controls how backslashes in entry names are interpreted and reapplies the
+// security rules on the set of files in the archive.
+func (r *Reader) SetBackslashPolicy(p BackslashPolicy) {
+	r.reapply(func() { r.backslashPolicy = p })
+}
+
+// AddRule adds a custom rule applied on the entries after the built-in sanitization and the rules
+// added before, and reapplies the rules on the set of files in the archive. The names changed by
+// the rule are checked again, and the entries are tracked (duplicates, symbolic links, ...) with
+// their final names. The rule can change the permission bits of the mode, not the type of entry.
+// If a rule rejects an entry, File is emptied and Err returns a safearchive.EntryError wrapping
+// safearchive.ErrRejected.
+func (r *Reader) AddRule(rule safearchive.Rule) error {
+	return r.reapply(func() { r.rules = append(r.rules, customRule{rule}) })
+}
+
+// Err returns the error of the last application of the rules, which is not nil if a rule
+// rejected an entry of the archive or the archive exceeded the limits. In that case File is empty.
+func (r *Reader) Err() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.err
+}
+
+// Entries returns an iterator over a snapshot of the files of the archive, as they were left by
+// the last application of the rules. The snapshot is taken atomically with respect to the setters
+// of the Reader and stays the same for the lifetime of the iterator: the setters never modify the
+// files of an earlier snapshot, they replace them.
+func (r *Reader) Entries() *Entries {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return &Entries{files: r.File, err: r.err}
+}
+
+// Entries iterates over a snapshot of the files of a Reader, see Reader.Entries. An Entries is not
+// safe for concurrent use, but any number of them may be used concurrently.
+type Entries struct {
+	files []*File
+	err   error
+	next  int
+}
+
+// Next returns the next file of the snapshot, and false once all of them were returned.
+func (e *Entries) Next() (*File, bool) {
+	if e.next >= len(e.files) {
+		return nil, false
+	}
+	e.next++
+	return e.files[e.next-1], true
+}
+
+// Len returns the number of files in the snapshot.
+func (e *Entries) Len() int {
+	return len(e.files)
+}
+
+// Err returns the error of the application of the rules the snapshot was taken from. If it is not
+// nil, the snapshot is empty.
+func (e *Entries) Err() error {
+	return e.err
+}
+
+// SetMaxChildren limits the number of direct children of any directory of the archive and
+// reapplies the security rules on the set of files in the archive. Entries that would exceed the
+// limit are skipped and reported. Zero (the default) means no limit.
+func (r *Reader) SetMaxChildren(n int) {
+	r.reapply(func() { r.maxChildren = n })
+}
+
+// SetSubtree restricts File to prefix and the entries below it (e.g. "usr/lib") and reapplies the
+// security rules on the set of files in the archive. Both the prefix and the names of the entries
+// are compared in their sanitized form (see sanitizer.InSubtree), so renamed entries are matched
+// by their new names. The other entries are still checked by the security features, so their
+// findings (and rejections) are reported. An empty prefix disables the filter.
+func (r *Reader) SetSubtree(prefix string) {
+	r.reapply(func() { r.subtree = prefix })
+}
+
+// SetDuplicatePolicy controls what happens to the entries whose (sanitized) name is already taken
+// by an earlier entry, and reapplies the security rules on the set of files in the archive. By
+// default (safearchive.DuplicatesAllow) they are kept, and extractors usually let the last of them
+// win.
+func (r *Reader) SetDuplicatePolicy(p safearchive.DuplicatePolicy) {
+	r.reapply(func() { r.duplicates = p })
+}
+
+// SetCollisionPolicy controls what happens to the entries whose (sanitized) name differs from the
+// one of an earlier entry, but is the same on case-insensitive or normalization-insensitive file
+// systems (e.g. README and readme, or the NFC and NFD forms of a name), see sanitizer.FoldName,
+// and reapplies the security rules on the set of files in the archive. Such entries overwrite each
+// other when extracted on macOS or Windows. By default (safearchive.DuplicatesAllow) they are
+// kept.
+func (r *Reader) SetCollisionPolicy(p safearchive.DuplicatePolicy) {
+	r.reapply(func() { r.collisions = p })
+}
+
+// SetNameEncodingPolicy controls what ValidateNameEncoding does with the names that are not valid
+// UTF-8 or have NUL bytes, and reapplies the security rules on the set of files in the archive. By
+// default (safearchive.NameEncodingReplace) the invalid bytes are replaced with U+FFFD.
+func (r *Reader) SetNameEncodingPolicy(p safearchive.NameEncodingPolicy) {
+	r.reapply(func() { r.nameEncoding = p })
+}
+
+// SetImplausibleSizeFactor sets the factor of the size of the archive above which FlagImplausibleSizes
+// reports the uncompressed size declared by an entry, and reapplies the security rules on the set
+// of files in the archive. Zero (the default) means DefaultImplausibleSizeFactor.
+func (r *Reader) SetImplausibleSizeFactor(factor float64) {
+	r.reapply(func() { r.sizeFactor = factor })
+}
+
+// OnSanitize sets a hook called with every finding about an entry at the moment it is made, before
+// the decision is applied, so applications can log, meter or veto the decisions of the security
+// features and rules, and reapplies the security rules on the set of files in the archive. As the
+// rules are reapplied by the setters of the reader, the hook may see the same decision multiple
+// times. Vetoed decisions reject the archive instead: File is emptied and Err returns a
+// safearchive.EntryError wrapping safearchive.ErrRejected. The hook is not called while the lock of
+// the Reader is held, so it may use the getters of the Reader (e.g. Report), but not its setters.
+func (r *Reader) OnSanitize(f func(ev safearchive.SanitizeEvent)) {
+	r.reapply(func() { r.onSanitize = f })
+}
+
+// GetBackslashPolicy returns the current backslash policy
+func (r *Reader) GetBackslashPolicy() BackslashPolicy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.backslashPolicy
 }
 
 // GetSecurityMode returns the currently enabled security rules
 func (r *Reader) GetSecurityMode() SecurityMode {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	return r.securityMode
 }
 
@@ -280,19 +1026,60 @@ func FileInfoHeader(fi fs.FileInfo) (*FileHeader, error) {
 	return zip.FileInfoHeader(fi)
 }
 
+// RegisterDecompressor registers or overrides a custom decompressor for a
+// specific method ID. If a decompressor for a given method is not found,
+// Reader will default to looking up the decompressor at the package level.
+// It must not be called concurrently with the Open method of the files.
+// In the hardened profile (see safearchive.Hardened) RegisterDecompressor does nothing.
+func (r *Reader) RegisterDecompressor(method uint16, dcomp Decompressor) {
+	if safearchive.Hardened {
+		return
+	}
+	r.applying.Lock()
+	defer r.applying.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.registerDecompressor(method, dcomp)
+}
+
+// registerDecompressor registers dcomp on the upstream reader, and on the ones of the next chunks.
+func (r *Reader) registerDecompressor(method uint16, dcomp Decompressor) {
+	if r.chunks != nil {
+		if r.chunks.decompressors == nil {
+			r.chunks.decompressors = map[uint16]Decompressor{}
+		}
+		r.chunks.decompressors[method] = dcomp
+	}
+	r.Reader.RegisterDecompressor(method, dcomp)
+}
+
 // RegisterDecompressor allows custom decompressors for a specified method ID.
 // The common methods Store and Deflate are built in.
+// In the hardened profile (see safearchive.Hardened) RegisterDecompressor does nothing.
 func RegisterDecompressor(method uint16, dcomp Decompressor) {
+	if safearchive.Hardened {
+		return
+	}
 	zip.RegisterDecompressor(method, dcomp)
 }
 
 // RegisterCompressor registers custom compressors for a specified method ID.
 // The common methods Store and Deflate are built in.
+// In the hardened profile (see safearchive.Hardened) RegisterCompressor does nothing.
 func RegisterCompressor(method uint16, comp Compressor) {
+	if safearchive.Hardened {
+		return
+	}
 	zip.RegisterCompressor(method, comp)
 }
 
-// NewWriter returns a new Writer writing a zip file to w.
-func NewWriter(w io.Writer) *Writer {
-	return zip.NewWriter(w)
+// EntryOf returns the format independent description of f.
+// The link target of symbolic links is stored as the content of the entry, so it is not populated.
+func EntryOf(f *File) safearchive.Entry {
+	return safearchive.Entry{
+		Name:    f.Name,
+		Size:    int64(f.UncompressedSize64),
+		Mode:    f.Mode(),
+		ModTime: f.Modified,
+	}
 }
@@ -16,13 +16,27 @@ package zip
 
 import (
 	"bytes"
-	_ "embed"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/google/safearchive"
+	"github.com/google/safearchive/corpus"
+	"github.com/google/safearchive/decompress"
 )
 
 func isSlashRune(r rune) bool { return r == '/' || r == '\\' }
@@ -39,16 +53,13 @@ func containsDotDot(v string) bool {
 
 var (
 	// Archive containing files: ../traverse, /absolute
-	//go:embed archive.zip
-	eArchiveZip []byte
+	eArchiveZip = corpus.Bytes("archive.zip")
 
 	// Zip archive containing symbolic links
-	//go:embed symlinks.zip
-	eSymlinksZip []byte
+	eSymlinksZip = corpus.Bytes("symlinks.zip")
 
 	// Zip archive containing files with special file modes
-	//go:embed specialmodes.zip
-	eSpecialModesZip []byte
+	eSpecialModesZip = corpus.Bytes("specialmodes.zip")
 
 	/*
 		// this archive looks like this:
@@ -63,8 +74,7 @@ var (
 
 			the entry with name root is a symbolic link pointing to /root
 	*/
-	//go:embed symlinks2.zip
-	eSymlinks2Zip []byte
+	eSymlinks2Zip = corpus.Bytes("symlinks2.zip")
 
 	/*
 		// Same as the previous, but the root entry has a slash at the end:
@@ -77,8 +87,7 @@ var (
 		        6                    2 files
 
 	*/
-	//go:embed symlinks3.zip
-	eSymlinks3Zip []byte
+	eSymlinks3Zip = corpus.Bytes("symlinks3.zip")
 
 	/*
 		// This archive attempts to traverse the path via case insensitive symlinks.
@@ -90,8 +99,7 @@ var (
 			---------                     -------
 							7                     2 files
 	*/
-	//go:embed case-insensitive.zip
-	eCaseInsensitiveSymlinksZip []byte
+	eCaseInsensitiveSymlinksZip = corpus.Bytes("case-insensitive.zip")
 
 	/*
 		Archive:  winshort.zip
@@ -112,8 +120,7 @@ var (
 		---------                     -------
 		       40                     12 files
 	*/
-	//go:embed winshort.zip
-	eWinShortFilenamesZip []byte
+	eWinShortFilenamesZip = corpus.Bytes("winshort.zip")
 )
 
 func TestSafezip(t *testing.T) {
@@ -136,6 +143,15 @@ func TestSafezip(t *testing.T) {
 	}
 }
 
+// defaultMode returns DefaultSecurityMode, or the default mode of the regular profile in the
+// hardened profile (see safearchive.Hardened), so the tests about the default behavior hold there.
+func defaultMode() SecurityMode {
+	if safearchive.Hardened {
+		return SanitizeFilenames | PreventSymlinkTraversal
+	}
+	return DefaultSecurityMode
+}
+
 func commonTestsBefore(t *testing.T, files []*File) {
 	if len(files) != 2 {
 		t.Fatalf("unexpected number of files in the archive (before): %d", len(files))
@@ -384,3 +400,2508 @@ func TestWindowsShortFilenames(t *testing.T) {
 		}
 	}
 }
+
+type testEntry struct {
+	name    string
+	content string
+}
+
+func buildZip(t testing.TB, entries ...testEntry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	// the archives of the tests may be malicious on purpose
+	w.SetSecurityMode(0)
+	for _, e := range entries {
+		fw, err := w.CreateHeader(&FileHeader{Name: e.name, Method: Deflate})
+		if err != nil {
+			t.Fatalf("zip.Writer.CreateHeader(%q) error = %v", e.name, err)
+		}
+		if _, err := fw.Write([]byte(e.content)); err != nil {
+			t.Fatalf("zip.Writer.Write(%q) error = %v", e.name, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("zip.Writer.Close() error = %v", err)
+	}
+	return buf.Bytes()
+}
+
+// zip64Archive rewrites an archive made by buildZip the way huge archives are written: the sizes
+// and positions of the entries are stored in zip64 extra fields and the ones of the central
+// directory in a zip64 end of central directory record. edit, if not nil, may modify that record
+// and its locator.
+func zip64Archive(t testing.TB, archive []byte, edit func(end, loc []byte)) []byte {
+	t.Helper()
+
+	r := bytes.NewReader(archive)
+	d, err := findDirectoryEnd(r, int64(len(archive)))
+	if err != nil {
+		t.Fatalf("findDirectoryEnd() error = %v", err)
+	}
+	start := d.directoryStart(r)
+	records, err := readDirectoryRecords(r, start, d, 0)
+	if err != nil {
+		t.Fatalf("readDirectoryRecords() error = %v", err)
+	}
+	b := append([]byte{}, archive[:start]...)
+	for _, rec := range records {
+		raw := append([]byte{}, rec.raw...)
+		binary.LittleEndian.PutUint32(raw[20:], 0xffffffff)
+		binary.LittleEndian.PutUint32(raw[24:], 0xffffffff)
+		binary.LittleEndian.PutUint32(raw[42:], 0xffffffff)
+		extraEnd := directoryHeaderLen + len(rec.name) + len(rec.extra)
+		binary.LittleEndian.PutUint16(raw[30:], uint16(len(rec.extra)+28))
+		extra := binary.LittleEndian.AppendUint16(nil, zip64ExtraID)
+		extra = binary.LittleEndian.AppendUint16(extra, 24)
+		extra = binary.LittleEndian.AppendUint64(extra, rec.uncompressedSize)
+		extra = binary.LittleEndian.AppendUint64(extra, rec.compressedSize)
+		extra = binary.LittleEndian.AppendUint64(extra, uint64(rec.headerOffset))
+		b = append(b, raw[:extraEnd]...)
+		b = append(b, extra...)
+		b = append(b, raw[extraEnd:]...)
+	}
+	endOffset := uint64(len(b))
+	end := binary.LittleEndian.AppendUint32(nil, directory64EndSignature)
+	end = binary.LittleEndian.AppendUint64(end, directory64EndLen-12)
+	end = binary.LittleEndian.AppendUint16(end, 45)
+	end = binary.LittleEndian.AppendUint16(end, 45)
+	end = binary.LittleEndian.AppendUint32(end, 0)
+	end = binary.LittleEndian.AppendUint32(end, 0)
+	end = binary.LittleEndian.AppendUint64(end, uint64(len(records)))
+	end = binary.LittleEndian.AppendUint64(end, uint64(len(records)))
+	end = binary.LittleEndian.AppendUint64(end, endOffset-uint64(start))
+	end = binary.LittleEndian.AppendUint64(end, uint64(start))
+	loc := binary.LittleEndian.AppendUint32(nil, directory64LocSignature)
+	loc = binary.LittleEndian.AppendUint32(loc, 0)
+	loc = binary.LittleEndian.AppendUint64(loc, endOffset)
+	loc = binary.LittleEndian.AppendUint32(loc, 1)
+	if edit != nil {
+		edit(end, loc)
+	}
+	b = append(append(b, end...), loc...)
+	b = binary.LittleEndian.AppendUint32(b, directoryEndSignature)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	b = binary.LittleEndian.AppendUint16(b, 0xffff)
+	b = binary.LittleEndian.AppendUint16(b, 0xffff)
+	b = binary.LittleEndian.AppendUint32(b, 0xffffffff)
+	b = binary.LittleEndian.AppendUint32(b, 0xffffffff)
+	return binary.LittleEndian.AppendUint16(b, 0)
+}
+
+func readAll(t *testing.T, f *File) string {
+	t.Helper()
+
+	rc, err := f.Open()
+	if err != nil {
+		t.Fatalf("File.Open(%q) error = %v", f.Name, err)
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("io.ReadAll(%q) error = %v", f.Name, err)
+	}
+	return string(b)
+}
+
+func TestRewrite(t *testing.T) {
+	archive := buildZip(t,
+		testEntry{"keep.txt", "keep"},
+		testEntry{"secret.txt", "secret"},
+		testEntry{"rename.txt", "rename"},
+		testEntry{"redact.txt", "confidential"},
+	)
+	src, err := OpenReader(archiveToPath(t, archive))
+	if err != nil {
+		t.Fatalf("zip.OpenReader() error = %v", err)
+	}
+	defer src.Close()
+
+	var out bytes.Buffer
+	err = Rewrite(src, &out, []Edit{
+		{Name: "secret.txt", Delete: true},
+		{Name: "rename.txt", NewName: "../renamed.txt"},
+		{Name: "redact.txt", Content: strings.NewReader("REDACTED")},
+	})
+	if err != nil {
+		t.Fatalf("Rewrite() error = %v", err)
+	}
+
+	r, err := NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatalf("zip.NewReader() error = %v", err)
+	}
+	want := []testEntry{{"keep.txt", "keep"}, {"renamed.txt", "rename"}, {"redact.txt", "REDACTED"}}
+	if len(r.File) != len(want) {
+		t.Fatalf("len(r.File) = %d, want %d", len(r.File), len(want))
+	}
+	for i, w := range want {
+		if r.File[i].Name != w.name {
+			t.Errorf("r.File[%d].Name = %q, want %q", i, r.File[i].Name, w.name)
+		}
+		if got := readAll(t, r.File[i]); got != w.content {
+			t.Errorf("content of %q = %q, want %q", w.name, got, w.content)
+		}
+	}
+}
+
+func TestRewriteUnknownEntry(t *testing.T) {
+	src, err := OpenReader(archiveToPath(t, buildZip(t, testEntry{"a.txt", "a"})))
+	if err != nil {
+		t.Fatalf("zip.OpenReader() error = %v", err)
+	}
+	defer src.Close()
+
+	var out bytes.Buffer
+	err = Rewrite(src, &out, []Edit{{Name: "missing.txt", Delete: true}})
+	var ee *safearchive.EntryError
+	if !errors.As(err, &ee) || ee.Name != "missing.txt" || !errors.Is(err, ErrEntryNotFound) {
+		t.Errorf("Rewrite() error = %v, want EntryError for missing.txt wrapping %v", err, ErrEntryNotFound)
+	}
+	if out.Len() != 0 {
+		t.Errorf("Rewrite() wrote %d bytes on failure, want 0", out.Len())
+	}
+}
+
+func TestRepack(t *testing.T) {
+	// Archive containing files: ../traverse, /absolute
+	src, err := NewReader(bytes.NewReader(eArchiveZip), int64(len(eArchiveZip)))
+	if err != nil {
+		t.Fatalf("zip.NewReader() error = %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := Repack(&out, src); err != nil {
+		t.Fatalf("Repack() error = %v", err)
+	}
+
+	r, err := NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatalf("zip.NewReader() error = %v", err)
+	}
+	r.SetSecurityMode(0)
+	commonTestsBefore(t, r.File)
+	for i, f := range r.File {
+		if f.CompressedSize64 != src.File[i].CompressedSize64 {
+			t.Errorf("CompressedSize64 of %q = %d, want %d", f.Name, f.CompressedSize64, src.File[i].CompressedSize64)
+		}
+		if got, want := readAll(t, f), readAll(t, src.File[i]); got != want {
+			t.Errorf("content of %q = %q, want %q", f.Name, got, want)
+		}
+	}
+}
+
+func TestBackslashPolicy(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("backslashes are always path separators on Windows")
+	}
+	// U+F05C stands in for the literal backslashes while the names are sanitized
+	const disguised = "..\uf05c..\uf05cdisguised.txt"
+	archive := buildZip(t, testEntry{`dir\file.txt`, "a"}, testEntry{`..\..\evil.txt`, "b"}, testEntry{"plain.txt", "c"}, testEntry{disguised, "d"})
+	r, err := NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("zip.NewReader() error = %v", err)
+	}
+
+	tests := []struct {
+		policy BackslashPolicy
+		want   []string
+	}{
+		{policy: BackslashSeparator, want: []string{"dir/file.txt", "evil.txt", "plain.txt", disguised}},
+		{policy: BackslashLiteral, want: []string{`dir\file.txt`, `..\..\evil.txt`, "plain.txt"}},
+		{policy: BackslashReject, want: []string{"plain.txt", disguised}},
+	}
+	for _, tc := range tests {
+		r.SetBackslashPolicy(tc.policy)
+		var got []string
+		for _, f := range r.File {
+			got = append(got, f.Name)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("SetBackslashPolicy(%v): entries = %q, want %q", tc.policy, got, tc.want)
+		}
+	}
+}
+
+func TestTolerant(t *testing.T) {
+	archive := buildZip(t, testEntry{"dir/", ""}, testEntry{"dir/a.txt", "hello"})
+
+	// Declaring one more central directory record than the archive has.
+	wrongCount := append([]byte{}, archive...)
+	eocd := bytes.LastIndex(wrongCount, []byte("PK\x05\x06"))
+	wrongCount[eocd+8]++
+	wrongCount[eocd+10]++
+
+	// Declaring a comment longer than the rest of the file.
+	truncatedComment := append([]byte{}, archive...)
+	truncatedComment[eocd+20] = 10
+
+	// A directory entry with a checksum and size.
+	directoryData := append([]byte{}, archive...)
+	cd := bytes.Index(directoryData, []byte("PK\x01\x02"))
+	copy(directoryData[cd+16:], []byte{1, 2, 3, 4, 5, 0, 0, 0, 5, 0, 0, 0})
+
+	tests := []struct {
+		name       string
+		archive    []byte
+		wantReason safearchive.Reason
+	}{
+		{name: "wrong count", archive: wrongCount, wantReason: ReasonDirectoryCount},
+		{name: "truncated comment", archive: truncatedComment, wantReason: ReasonTruncatedComment},
+		{name: "directory data", archive: directoryData, wantReason: ReasonDirectoryData},
+	}
+	for _, tc := range tests {
+		r, err := NewReaderWithOptions(bytes.NewReader(tc.archive), int64(len(tc.archive)), Options{Tolerant: true})
+		if err != nil {
+			t.Fatalf("NewReaderWithOptions(%s) error = %v", tc.name, err)
+		}
+		r.SetSecurityMode(defaultMode())
+		if len(r.File) != 2 {
+			t.Fatalf("NewReaderWithOptions(%s) has %d entries, want 2", tc.name, len(r.File))
+		}
+		for _, f := range r.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatalf("%s: File.Open(%q) error = %v", tc.name, f.Name, err)
+			}
+			if _, err := io.ReadAll(rc); err != nil {
+				t.Errorf("%s: reading %q error = %v", tc.name, f.Name, err)
+			}
+			rc.Close()
+		}
+		findings := r.Report().Findings
+		if len(findings) != 1 || findings[0].Reason != tc.wantReason {
+			t.Errorf("NewReaderWithOptions(%s).Report() = %+v, want a single %v finding", tc.name, findings, tc.wantReason)
+		}
+	}
+
+	if _, err := NewReader(bytes.NewReader(wrongCount), int64(len(wrongCount))); err == nil {
+		t.Errorf("NewReader() of an archive with a wrong record count succeeded, want error")
+	}
+}
+
+func TestTolerantCleanArchive(t *testing.T) {
+	archive := buildZip(t, testEntry{"a.txt", "a"})
+	r, err := NewReaderWithOptions(bytes.NewReader(archive), int64(len(archive)), Options{Tolerant: true})
+	if err != nil {
+		t.Fatalf("NewReaderWithOptions() error = %v", err)
+	}
+	if findings := r.Report().Findings; len(findings) != 0 {
+		t.Errorf("Report().Findings = %+v, want none", findings)
+	}
+
+	rc, err := OpenReaderWithOptions(archiveToPath(t, archive), Options{Tolerant: true})
+	if err != nil {
+		t.Fatalf("OpenReaderWithOptions() error = %v", err)
+	}
+	if len(rc.File) != 1 || readAll(t, rc.File[0]) != "a" {
+		t.Errorf("OpenReaderWithOptions() did not read the archive correctly")
+	}
+	if err := rc.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+}
+
+func TestRetainRawHeaders(t *testing.T) {
+	archive := buildZip(t, testEntry{"ok.txt", "ok"}, testEntry{"../evil.txt", "evil"}, testEntry{"a/./b.txt", "b"})
+	r, err := NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	r.SetSecurityMode(defaultMode())
+
+	want := []struct {
+		name   string
+		reason safearchive.Reason
+	}{
+		{"../evil.txt", safearchive.ReasonPathTraversal},
+		{"a/./b.txt", safearchive.ReasonPathNormalized},
+	}
+	check := func(retained bool) {
+		t.Helper()
+		got := r.Report().Findings
+		if len(got) != len(want) {
+			t.Fatalf("Report() = %+v, want %d findings", got, len(want))
+		}
+		for i, w := range want {
+			g := got[i]
+			if g.Name != w.name || g.Reason != w.reason || g.Action != safearchive.ActionModified {
+				t.Errorf("finding %d = %q %q %v, want %q %q modified", i, g.Name, g.Reason, g.Action, w.name, w.reason)
+			}
+			if !retained {
+				// the hardened profile parses the central directory records, and so knows the offsets
+				if g.Raw != nil || g.Offset != -1 && !safearchive.Hardened {
+					t.Errorf("finding %d retained raw header at offset %d without being asked to", i, g.Offset)
+				}
+				continue
+			}
+			if !bytes.HasPrefix(g.Raw, []byte("PK\x01\x02")) || !bytes.HasSuffix(g.Raw, []byte(w.name)) {
+				t.Errorf("finding %d raw header = %q, want the central directory record of %q", i, g.Raw, w.name)
+			}
+			if g.Offset < 0 || !bytes.Equal(archive[g.Offset:g.Offset+int64(len(g.Raw))], g.Raw) {
+				t.Errorf("finding %d offset = %d, want the offset of its raw header", i, g.Offset)
+			}
+		}
+	}
+	check(false)
+	r.SetRetainRawHeaders(true)
+	check(true)
+}
+
+func TestMaxChildren(t *testing.T) {
+	archive := buildZip(t, testEntry{"dir/1", ""}, testEntry{"dir/2", ""}, testEntry{"dir/3", ""}, testEntry{"other", ""})
+	r, err := NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	r.SetMaxChildren(2)
+	var names []string
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	if want := []string{"dir/1", "dir/2", "other"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("entries = %q, want %q", names, want)
+	}
+	if f := r.Report().Findings; len(f) != 1 || f[0].Name != "dir/3" || f[0].Reason != safearchive.ReasonFanOut {
+		t.Errorf("Report() = %+v, want dir/3 dropped because of fan-out", f)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	small := strings.Repeat("x", 100)
+	archive := buildZip(t, testEntry{"a", small}, testEntry{"b", small}, testEntry{"bomb", strings.Repeat("\x00", 2<<20)})
+	tests := []struct {
+		name      string
+		limits    Limits
+		wantEntry string
+	}{
+		{name: "entries", limits: Limits{MaxEntries: 2}, wantEntry: "bomb"},
+		{name: "entry size", limits: Limits{MaxEntrySize: 1000}, wantEntry: "bomb"},
+		{name: "total size", limits: Limits{MaxTotalUncompressed: 150}, wantEntry: "b"},
+		{name: "ratio", limits: Limits{MaxRatio: 100}, wantEntry: "bomb"},
+		{name: "within limits", limits: Limits{MaxEntries: 3, MaxEntrySize: 2 << 20, MaxTotalUncompressed: 3 << 20, MaxRatio: 5000}},
+		{name: "small entries are exempt from the ratio limit", limits: Limits{MaxRatio: 1.5, MaxEntrySize: 1000}, wantEntry: "bomb"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewReader(bytes.NewReader(archive), int64(len(archive)))
+			if err != nil {
+				t.Fatalf("NewReader() error = %v", err)
+			}
+			err = r.SetLimits(tc.limits)
+			if err != r.Err() {
+				t.Errorf("SetLimits() error = %v, Err() = %v, want them to be the same", err, r.Err())
+			}
+			if tc.wantEntry == "" {
+				if err != nil || len(r.File) != 3 {
+					t.Errorf("SetLimits() error = %v with %d entries, want no error and 3 entries", err, len(r.File))
+				}
+				return
+			}
+			if !errors.Is(err, ErrLimitExceeded) {
+				t.Fatalf("SetLimits() error = %v, want %v", err, ErrLimitExceeded)
+			}
+			var ee *safearchive.EntryError
+			if !errors.As(err, &ee) || ee.Name != tc.wantEntry || ee.Reason != safearchive.ReasonLimitExceeded {
+				t.Errorf("SetLimits() error = %v, want an EntryError about %s with reason %q", err, tc.wantEntry, safearchive.ReasonLimitExceeded)
+			}
+			if len(r.File) != 0 {
+				t.Errorf("File has %d entries after exceeding the limits, want none", len(r.File))
+			}
+
+			if err := r.SetLimits(Limits{}); err != nil || len(r.File) != 3 {
+				t.Errorf("SetLimits(Limits{}) error = %v with %d entries, want no error and 3 entries", err, len(r.File))
+			}
+		})
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	var diag bytes.Buffer
+	garbage := []byte("not a zip archive")
+	if _, err := NewReaderWithOptions(bytes.NewReader(garbage), int64(len(garbage)), Options{Diagnostics: &diag}); err == nil {
+		t.Fatalf("NewReaderWithOptions() of garbage succeeded")
+	}
+	if !strings.Contains(diag.String(), `"format":"zip"`) || !strings.Contains(diag.String(), `"error":"zip: not a valid zip file"`) {
+		t.Errorf("diagnostic bundle = %s, want the format and the error", diag.String())
+	}
+}
+
+func TestCustomRules(t *testing.T) {
+	archive := buildZip(t, testEntry{"a.txt", "a"}, testEntry{".git/config", "git"}, testEntry{"huge.bin", strings.Repeat("x", 2048)})
+	r, err := NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	noGit := safearchive.RuleFunc(func(e *safearchive.Entry) safearchive.Verdict {
+		if strings.HasPrefix(e.Name, ".git/") {
+			return safearchive.Verdict{Action: safearchive.ActionDropped, Reason: "no-git"}
+		}
+		return safearchive.Pass
+	})
+	if err := r.AddRule(noGit); err != nil {
+		t.Fatalf("AddRule() error = %v", err)
+	}
+	var names []string
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	if want := []string{"a.txt", "huge.bin"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("entries = %q, want %q", names, want)
+	}
+
+	err = r.AddRule(safearchive.RuleFunc(func(e *safearchive.Entry) safearchive.Verdict {
+		if e.Size > 1024 {
+			return safearchive.Verdict{Action: safearchive.ActionRejected, Reason: "too-large"}
+		}
+		return safearchive.Pass
+	}))
+	var ee *safearchive.EntryError
+	if !errors.As(err, &ee) || !errors.Is(err, safearchive.ErrRejected) || ee.Name != "huge.bin" {
+		t.Errorf("AddRule() error = %v, want huge.bin rejected", err)
+	}
+	if len(r.File) != 0 || r.Err() != err {
+		t.Errorf("after rejection File = %d entries, Err() = %v, want no entries and the rejection", len(r.File), r.Err())
+	}
+}
+
+func TestCustomRulesChecked(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetSecurityMode(0)
+	for _, e := range []struct {
+		name, content string
+		mode          fs.FileMode
+	}{
+		{"link", "/etc", fs.ModeSymlink | 0777},
+		{"up.txt", "up", 0644},
+		{"under.txt", "root", 0644},
+		{"a.txt", "/etc/passwd", 0644},
+	} {
+		fh := &FileHeader{Name: e.name, Method: Deflate}
+		fh.SetMode(e.mode)
+		fw, err := w.CreateHeader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(fw, e.content)
+	}
+	w.Close()
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	r.SetSecurityMode(SanitizeFilenames | PreventSymlinkTraversal)
+	err = r.AddRule(safearchive.RuleFunc(func(e *safearchive.Entry) safearchive.Verdict {
+		switch e.Name {
+		case "up.txt":
+			e.Name = "../../up.txt"
+		case "under.txt":
+			e.Name = "link/passwd"
+		case "a.txt":
+			e.Mode = fs.ModeSymlink | 0600
+		default:
+			return safearchive.Pass
+		}
+		return safearchive.Verdict{Action: safearchive.ActionModified}
+	}))
+	if err != nil {
+		t.Fatalf("AddRule() error = %v", err)
+	}
+	var got []string
+	for _, f := range r.File {
+		got = append(got, fmt.Sprintf("%s %v", f.Name, f.Mode()))
+	}
+	if want := []string{"link Lrwxrwxrwx", "up.txt -rw-r--r--", "a.txt -rw-------"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %q, want %q", got, want)
+	}
+}
+
+func TestAnonymize(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetSecurityMode(0)
+	secret := "confidential contents"
+	w.SetComment("secret comment")
+	files := []*FileHeader{
+		{Name: "../evil.txt", Method: Deflate, Comment: "secret", Extra: []byte("\xfe\xca\x06\x00secret"), Modified: time.Now()},
+		{Name: "stored.txt", Method: Store},
+		{Name: "dir/", Method: Store},
+	}
+	files[0].SetMode(04755)
+	for _, fh := range files {
+		fw, err := w.CreateHeader(fh)
+		if err != nil {
+			t.Fatalf("CreateHeader(%q) error = %v", fh.Name, err)
+		}
+		if !strings.HasSuffix(fh.Name, "/") {
+			fw.Write([]byte(secret))
+		}
+	}
+	w.Close()
+
+	for _, repl := range []safearchive.ContentReplacement{safearchive.ReplaceWithZeros, safearchive.ReplaceWithHash} {
+		var out bytes.Buffer
+		if err := Anonymize(bytes.NewReader(buf.Bytes()), int64(buf.Len()), &out, repl); err != nil {
+			t.Fatalf("Anonymize() error = %v", err)
+		}
+		if s := out.String(); strings.Contains(s, "secret") || strings.Contains(s, "confidential") {
+			t.Errorf("Anonymize(%d) output contains confidential data: %q", repl, s)
+		}
+
+		r, err := NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+		if err != nil {
+			t.Fatalf("NewReader() error = %v", err)
+		}
+		r.SetSecurityMode(0)
+		if len(r.File) != len(files) {
+			t.Fatalf("Anonymize() wrote %d entries, want %d", len(r.File), len(files))
+		}
+		for i, f := range r.File {
+			want := files[i]
+			if f.Name != want.Name || f.Method != want.Method || f.Mode() != want.Mode() {
+				t.Errorf("entry %d = %q %d %v, want %q %d %v", i, f.Name, f.Method, f.Mode(), want.Name, want.Method, want.Mode())
+			}
+			if f.Comment != "" || len(f.Extra) != 0 || !f.Modified.Equal(safearchive.AnonymizedModTime) {
+				t.Errorf("entry %d = %+v, want scrubbed metadata", i, f.FileHeader)
+			}
+			if strings.HasSuffix(f.Name, "/") {
+				continue
+			}
+			c, _ := safearchive.AnonymizedContent(strings.NewReader(secret), int64(len(secret)), repl)
+			if got, want := readAll(t, f), readAllReader(t, c); got != want {
+				t.Errorf("content of entry %d = %q, want %q", i, got, want)
+			}
+		}
+	}
+}
+
+func TestAnonymizeDeclaredSize(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetSecurityMode(0)
+	fw, err := w.CreateRaw(&FileHeader{Name: "huge.txt", Method: Store, CRC32: crc32.ChecksumIEEE([]byte("hello")), CompressedSize64: 5, UncompressedSize64: 1 << 40})
+	if err != nil {
+		t.Fatalf("CreateRaw() error = %v", err)
+	}
+	io.WriteString(fw, "hello")
+	w.Close()
+
+	var out bytes.Buffer
+	if err := Anonymize(bytes.NewReader(buf.Bytes()), int64(buf.Len()), &out, safearchive.ReplaceWithZeros); err != nil {
+		t.Fatalf("Anonymize() error = %v", err)
+	}
+	r, err := NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	if got, want := r.File[0].UncompressedSize64, uint64(5*DefaultImplausibleSizeFactor); got != want {
+		t.Errorf("UncompressedSize64 of the anonymized entry = %d, want %d", got, want)
+	}
+}
+
+func readAllReader(t *testing.T, r io.Reader) string {
+	t.Helper()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	return string(b)
+}
+
+func TestStrictMode(t *testing.T) {
+	tests := []struct {
+		name      string
+		archive   []byte
+		mode      SecurityMode
+		wantErr   error
+		wantEntry string
+	}{
+		{name: "path traversal", archive: eArchiveZip, mode: DefaultSecurityMode | StrictMode, wantErr: ErrPathTraversal, wantEntry: "../traverse"},
+		{name: "symlink traversal", archive: eSymlinks2Zip, mode: DefaultSecurityMode | StrictMode, wantErr: ErrSymlinkTraversal, wantEntry: "root/poc.txt"},
+		{name: "special mode", archive: eSpecialModesZip, mode: SanitizeFileMode | StrictMode, wantErr: ErrSpecialMode, wantEntry: "setuidstuff.txt"},
+		{name: "clean", archive: buildZip(t, testEntry{"./a.txt", "a"}), mode: MaximumSecurityMode | StrictMode},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewReader(bytes.NewReader(tc.archive), int64(len(tc.archive)))
+			if err != nil {
+				t.Fatalf("NewReader() error = %v", err)
+			}
+			r.SetSecurityMode(tc.mode)
+			if tc.wantErr == nil {
+				if r.Err() != nil || len(r.File) == 0 {
+					t.Errorf("Err() = %v with %d entries, want no error", r.Err(), len(r.File))
+				}
+				return
+			}
+			if !errors.Is(r.Err(), tc.wantErr) || !errors.Is(r.Err(), safearchive.ErrRejected) {
+				t.Errorf("Err() = %v, want %v", r.Err(), tc.wantErr)
+			}
+			var ee *safearchive.EntryError
+			if !errors.As(r.Err(), &ee) || ee.Name != tc.wantEntry {
+				t.Errorf("Err() = %v, want an EntryError about %s", r.Err(), tc.wantEntry)
+			}
+			if len(r.File) != 0 {
+				t.Errorf("File has %d entries, want none", len(r.File))
+			}
+
+			r.SetSecurityMode(tc.mode &^ StrictMode)
+			if r.Err() != nil || len(r.File) == 0 {
+				t.Errorf("Err() without StrictMode = %v with %d entries, want no error", r.Err(), len(r.File))
+			}
+		})
+	}
+}
+
+func TestReport(t *testing.T) {
+	r, err := NewReader(bytes.NewReader(eSpecialModesZip), int64(len(eSpecialModesZip)))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	r.SetSecurityMode(MaximumSecurityMode)
+	findings := r.Report().Findings
+	if len(findings) == 0 {
+		t.Fatalf("Report() has no findings")
+	}
+	for _, f := range findings {
+		if f.Reason != safearchive.ReasonSpecialMode || f.Action != safearchive.ActionModified || !strings.Contains(f.Detail, "changed to") || f.NewName != "" {
+			t.Errorf("finding = %+v, want a mode sanitization of an entry kept under its name", f)
+		}
+	}
+
+	r, err = NewReader(bytes.NewReader(eArchiveZip), int64(len(eArchiveZip)))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	var renamed []string
+	for _, f := range r.Report().Findings {
+		renamed = append(renamed, f.Name+" -> "+f.NewName)
+	}
+	if want := []string{"../traverse -> traverse", "/absolute -> absolute"}; !reflect.DeepEqual(renamed, want) {
+		t.Errorf("Report() renamed %q, want %q", renamed, want)
+	}
+}
+
+func TestSubtree(t *testing.T) {
+	archive := buildZip(t,
+		testEntry{"usr/", ""},
+		testEntry{"usr/lib/", ""},
+		testEntry{"usr/lib/a.so", "a"},
+		testEntry{"usr/lib64/b.so", "b"},
+		testEntry{"../usr/lib/c.so", "c"},
+		testEntry{"/usr/lib/d.so", "d"},
+		testEntry{"etc/passwd", "root"},
+	)
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"usr/lib", []string{"usr/lib/", "usr/lib/a.so", "usr/lib/c.so", "usr/lib/d.so"}},
+		{"/usr/lib/", []string{"usr/lib/", "usr/lib/a.so", "usr/lib/c.so", "usr/lib/d.so"}},
+		{"etc", []string{"etc/passwd"}},
+		{"var", nil},
+		{"", []string{"usr/", "usr/lib/", "usr/lib/a.so", "usr/lib64/b.so", "usr/lib/c.so", "usr/lib/d.so", "etc/passwd"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.prefix, func(t *testing.T) {
+			r, err := NewReader(bytes.NewReader(archive), int64(len(archive)))
+			if err != nil {
+				t.Fatalf("NewReader() error = %v", err)
+			}
+			r.SetSubtree(tc.prefix)
+			var got []string
+			for _, f := range r.File {
+				got = append(got, f.Name)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("File = %q, want %q", got, tc.want)
+			}
+			// Entries outside of the subtree are still checked by the security features.
+			if n := len(r.Report().Findings); n != 2 {
+				t.Errorf("Report() has %d findings, want 2", n)
+			}
+		})
+	}
+}
+
+func TestOnSanitize(t *testing.T) {
+	r, err := NewReader(bytes.NewReader(eArchiveZip), int64(len(eArchiveZip)))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	var events []string
+	r.OnSanitize(func(ev safearchive.SanitizeEvent) {
+		events = append(events, ev.Finding.Name+" "+string(ev.Finding.Reason))
+	})
+	if want := []string{"../traverse path-traversal", "/absolute absolute-path"}; !reflect.DeepEqual(events, want) {
+		t.Errorf("OnSanitize() events = %q, want %q", events, want)
+	}
+
+	r.OnSanitize(func(ev safearchive.SanitizeEvent) {
+		if ev.Finding.Reason == safearchive.ReasonAbsolutePath {
+			ev.Veto()
+		}
+	})
+	if err := r.Err(); !errors.Is(err, ErrAbsolutePath) {
+		t.Errorf("Err() = %v, want %v", err, ErrAbsolutePath)
+	}
+	if len(r.File) != 0 {
+		t.Errorf("File has %d entries after a veto, want none", len(r.File))
+	}
+
+	r.OnSanitize(nil)
+	if err := r.Err(); err != nil {
+		t.Errorf("Err() = %v after removing the hook, want nil", err)
+	}
+
+	// the hooks and filters are not called while the lock of the Reader is held
+	var modes []SecurityMode
+	r.OnSanitize(func(ev safearchive.SanitizeEvent) {
+		modes = append(modes, r.GetSecurityMode())
+		r.Report()
+	})
+	if err := r.SetEntryFilter(func(f *File) (bool, error) { return r.Err() == nil, nil }); err != nil {
+		t.Fatalf("SetEntryFilter() error = %v", err)
+	}
+	r.SetSecurityMode(MaximumSecurityMode)
+	if len(modes) == 0 || modes[len(modes)-1] != MaximumSecurityMode {
+		t.Errorf("GetSecurityMode() in the hook = %v, want %v last", modes, MaximumSecurityMode)
+	}
+}
+
+func TestFlagImplausibleSizes(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, h := range []*FileHeader{
+		{Name: "dir/", Method: Store, CompressedSize64: 4, UncompressedSize64: 4},
+		{Name: "empty/", Method: Store},
+		{Name: "bomb", Method: Deflate, CompressedSize64: 4, UncompressedSize64: 1 << 40},
+		{Name: "ok", Method: Store, CompressedSize64: 4, UncompressedSize64: 4},
+	} {
+		fw, err := w.CreateRaw(h)
+		if err != nil {
+			t.Fatalf("zip.Writer.CreateRaw(%q) error = %v", h.Name, err)
+		}
+		fw.Write(make([]byte, h.CompressedSize64))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("zip.Writer.Close() error = %v", err)
+	}
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	r.SetSecurityMode(defaultMode())
+	if n := len(r.Report().Findings); n != 0 {
+		t.Errorf("Report() has %d findings with the default security mode, want none", n)
+	}
+	r.SetSecurityMode(defaultMode() | FlagImplausibleSizes)
+	var flagged []string
+	for _, f := range r.Report().Findings {
+		if f.Reason != safearchive.ReasonImplausibleSize || f.Action != safearchive.ActionNone {
+			t.Errorf("finding = %+v, want an implausible size report", f)
+		}
+		flagged = append(flagged, f.Name)
+	}
+	if want := []string{"dir/", "bomb"}; !reflect.DeepEqual(flagged, want) {
+		t.Errorf("flagged %q, want %q", flagged, want)
+	}
+	if len(r.File) != 4 {
+		t.Errorf("File has %d entries, want 4", len(r.File))
+	}
+
+	r.SetImplausibleSizeFactor(1 << 40)
+	if n := len(r.Report().Findings); n != 1 {
+		t.Errorf("Report() has %d findings with a huge factor, want 1", n)
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	required := []safearchive.Feature{
+		{Package: "zip", Kind: safearchive.FeatureFormat, Name: "zip"},
+		{Package: "zip", Kind: safearchive.FeatureRule, Name: "StrictMode"},
+		{Package: "zip", Kind: safearchive.FeatureOption, Name: "Subtree"},
+	}
+	if err := safearchive.RequireFeatures(required...); err != nil {
+		t.Errorf("RequireFeatures() error = %v", err)
+	}
+}
+
+func TestEntries(t *testing.T) {
+	// Archive containing files: ../traverse, /absolute
+	r, err := NewReader(bytes.NewReader(eArchiveZip), int64(len(eArchiveZip)))
+	if err != nil {
+		t.Fatalf("zip.NewReader() error = %v", err)
+	}
+
+	it := r.Entries()
+	r.SetSecurityMode(DefaultSecurityMode &^ SanitizeFilenames)
+	commonTestsAfter(t, r.File)
+
+	var files []*File
+	for f, ok := it.Next(); ok; f, ok = it.Next() {
+		files = append(files, f)
+	}
+	if len(files) != it.Len() {
+		t.Errorf("Entries() returned %d files, Len() = %d", len(files), it.Len())
+	}
+	commonTestsBefore(t, files)
+	if _, ok := it.Next(); ok {
+		t.Errorf("Next() after the last file = true, want false")
+	}
+
+	r.SetSecurityMode(DefaultSecurityMode | StrictMode)
+	it = r.Entries()
+	if it.Len() != 0 || !errors.Is(it.Err(), ErrPathTraversal) {
+		t.Errorf("Entries() in StrictMode = %d files, error %v, want none and %v", it.Len(), it.Err(), ErrPathTraversal)
+	}
+}
+
+func TestRegisterCompressionMethods(t *testing.T) {
+	// "hello, world" compressed with bzip2 -9
+	hello, _ := hex.DecodeString("425a683931415926535942f7dd4a0000021180400406449080200031064c41007a2501c96c31f8bb9229c2848217beea50")
+	// a fake codec of the .lzma format, checking the header converted from the one of the entry
+	decompress.Register(decompress.Codec{Name: "lzma", NewReader: func(r io.Reader) (io.ReadCloser, error) {
+		hdr := make([]byte, 13)
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(hdr, []byte{0x5d, 0, 0, 0x10, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}) {
+			return nil, fmt.Errorf("unexpected .lzma header %x", hdr)
+		}
+		return io.NopCloser(r), nil
+	}})
+	lzma := append([]byte{9, 20, 5, 0, 0x5d, 0, 0, 0x10, 0}, "hello, world"...)
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, e := range []struct {
+		name   string
+		method uint16
+		data   []byte
+	}{{"a.bz2", Bzip2, hello}, {"b.lzma", LZMA, lzma}} {
+		fw, err := w.CreateRaw(&FileHeader{Name: e.name, Method: e.method, CRC32: crc32.ChecksumIEEE([]byte("hello, world")), CompressedSize64: uint64(len(e.data)), UncompressedSize64: 12})
+		if err != nil {
+			t.Fatalf("CreateRaw(%q) error = %v", e.name, err)
+		}
+		fw.Write(e.data)
+	}
+	w.Close()
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	if _, err := r.File[0].Open(); !errors.Is(err, ErrAlgorithm) {
+		t.Errorf("Open() of a bzip2 entry error = %v, want %v", err, ErrAlgorithm)
+	}
+	want := []uint16{Bzip2, LZMA}
+	if safearchive.Hardened {
+		want = want[:1]
+	}
+	if got := r.RegisterCompressionMethods(decompress.Limits{}); !reflect.DeepEqual(got, want) {
+		t.Errorf("RegisterCompressionMethods() = %v, want %v", got, want)
+	}
+	for _, f := range r.File[:len(want)] {
+		if got := readAll(t, f); got != "hello, world" {
+			t.Errorf("content of %s = %q, want %q", f.Name, got, "hello, world")
+		}
+	}
+
+	r.RegisterCompressionMethods(decompress.Limits{MaxOutputSize: 5})
+	rc, err := r.File[0].Open()
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer rc.Close()
+	if _, err := io.ReadAll(rc); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("ReadAll() beyond the limits error = %v, want %v", err, ErrLimitExceeded)
+	}
+}
+
+func TestConcurrentOpen(t *testing.T) {
+	var entries []testEntry
+	for i := 0; i < 20; i++ {
+		entries = append(entries, testEntry{name: fmt.Sprintf("../dir/f%d.txt", i), content: strings.Repeat("x", i*100)})
+	}
+	archive := buildZip(t, entries...)
+	r, err := NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			r.SetSecurityMode(MaximumSecurityMode &^ SanitizeFilenames)
+			r.SetSecurityMode(MaximumSecurityMode)
+		}
+	}()
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				it := r.Entries()
+				for f, ok := it.Next(); ok; f, ok = it.Next() {
+					rc, err := f.Open()
+					if err != nil {
+						t.Errorf("Open(%q) error = %v", f.Name, err)
+						return
+					}
+					b, err := io.ReadAll(rc)
+					rc.Close()
+					if err != nil || int64(len(b)) != int64(f.UncompressedSize64) {
+						t.Errorf("ReadAll(%q) = %d bytes, %v, want %d bytes", f.Name, len(b), err, f.UncompressedSize64)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestEntriesConcurrentSetSecurityMode(t *testing.T) {
+	// Archive containing files: ../traverse, /absolute
+	r, err := NewReader(bytes.NewReader(eArchiveZip), int64(len(eArchiveZip)))
+	if err != nil {
+		t.Fatalf("zip.NewReader() error = %v", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			if i%2 == 0 {
+				r.SetSecurityMode(DefaultSecurityMode &^ SanitizeFilenames)
+			} else {
+				r.SetSecurityMode(DefaultSecurityMode)
+			}
+		}
+	}()
+
+	for i := 0; i < 200; i++ {
+		it := r.Entries()
+		if err := it.Err(); err != nil {
+			t.Fatalf("Entries().Err() = %v", err)
+		}
+		// Every snapshot must be the outcome of a single security mode: either all names were
+		// sanitized or none of them.
+		var sanitized, unsanitized int
+		for f, ok := it.Next(); ok; f, ok = it.Next() {
+			if containsDotDot(f.Name) || strings.HasPrefix(f.Name, "/") {
+				unsanitized++
+			} else {
+				sanitized++
+			}
+		}
+		if sanitized != 0 && unsanitized != 0 {
+			t.Fatalf("Entries() snapshot mixes %d sanitized and %d unsanitized names", sanitized, unsanitized)
+		}
+		r.Report()
+		r.GetSecurityMode()
+	}
+	wg.Wait()
+}
+
+func TestRequireSymlinksLast(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		wantErr error
+	}{
+		{name: "symlinks last", entries: []string{"dir/", "dir/file", "link@"}},
+		{name: "content after symlink", entries: []string{"link@", "dir/file"}, wantErr: ErrOrderDependent},
+		{name: "directory replaced", entries: []string{"dir/file", "dir"}, wantErr: ErrOrderDependent},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewWriter(&buf)
+			w.SetSecurityMode(defaultMode())
+			for _, name := range tc.entries {
+				// symbolic links end with an @
+				fh := &FileHeader{Name: strings.TrimSuffix(name, "@")}
+				if strings.HasSuffix(name, "@") {
+					fh.SetMode(fs.ModeSymlink | 0777)
+				}
+				if _, err := w.CreateHeader(fh); err != nil {
+					t.Fatalf("zip.Writer.CreateHeader(%q) error = %v", name, err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("zip.Writer.Close() error = %v", err)
+			}
+
+			r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatalf("NewReader() error = %v", err)
+			}
+			r.SetSecurityMode(defaultMode() | RequireSymlinksLast)
+			if err := r.Err(); !errors.Is(err, tc.wantErr) {
+				t.Errorf("Err() error = %v, want %v", err, tc.wantErr)
+			}
+			if tc.wantErr == nil && len(r.File) != len(tc.entries) {
+				t.Errorf("File has %d entries, want %d", len(r.File), len(tc.entries))
+			}
+		})
+	}
+}
+
+func TestWriter(t *testing.T) {
+	symlink := func(name string) *FileHeader {
+		fh := &FileHeader{Name: name}
+		fh.SetMode(fs.ModeSymlink | 0777)
+		return fh
+	}
+	mode := func(name string, m fs.FileMode) *FileHeader {
+		fh := &FileHeader{Name: name}
+		fh.SetMode(m)
+		return fh
+	}
+	tests := []struct {
+		name    string
+		mode    SecurityMode
+		headers []*FileHeader
+		want    []string
+		wantErr error
+	}{
+		{
+			name:    "names",
+			mode:    SanitizeFilenames,
+			headers: []*FileHeader{{Name: "/abs.txt"}, {Name: "../up.txt"}, {Name: `..\win.txt`}},
+			want:    []string{"abs.txt -rw-rw-rw-", "up.txt -rw-rw-rw-", "win.txt -rw-rw-rw-"},
+		},
+		{
+			name:    "setuid",
+			mode:    SanitizeFileMode,
+			headers: []*FileHeader{mode("su", fs.ModeSetuid|fs.ModeSticky|0755)},
+			want:    []string{"su -rwxr-xr-x"},
+		},
+		{
+			name:    "special file",
+			mode:    SkipSpecialFiles,
+			headers: []*FileHeader{mode("fifo", fs.ModeNamedPipe|0644)},
+			wantErr: ErrSpecialFile,
+		},
+		{
+			name:    "symlink traversal",
+			mode:    defaultMode(),
+			headers: []*FileHeader{symlink("root"), {Name: "root/etc/passwd"}},
+			want:    []string{"root Lrwxrwxrwx"},
+			wantErr: ErrSymlinkTraversal,
+		},
+		{
+			name:    "strict",
+			mode:    defaultMode() | StrictMode,
+			headers: []*FileHeader{{Name: "../up.txt"}},
+			wantErr: ErrPathTraversal,
+		},
+		{
+			name:    "no security",
+			mode:    0,
+			headers: []*FileHeader{mode("../su", fs.ModeSetuid|0755)},
+			want:    []string{"../su urwxr-xr-x"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewWriter(&buf)
+			w.SetSecurityMode(tc.mode)
+			var err error
+			for _, fh := range tc.headers {
+				orig := *fh
+				if _, err = w.CreateHeader(fh); err != nil {
+					break
+				}
+				if !reflect.DeepEqual(*fh, orig) {
+					t.Errorf("CreateHeader() modified its argument to %+v", fh)
+				}
+			}
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("CreateHeader() error = %v, want %v", err, tc.wantErr)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatalf("NewReader() error = %v", err)
+			}
+			r.SetSecurityMode(0)
+			var got []string
+			for _, f := range r.File {
+				if strings.HasSuffix(f.Name, "/") {
+					continue
+				}
+				got = append(got, fmt.Sprintf("%s %v", f.Name, f.Mode()))
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("written entries = %q, want %q", got, tc.want)
+			}
+			if tc.mode != 0 && len(w.Report().Findings) == 0 {
+				t.Errorf("Report() is empty")
+			}
+		})
+	}
+}
+
+func TestWriterSymlinkTargets(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetSecurityMode(MaximumSecurityMode)
+	create := func(name, target string) error {
+		fh := &FileHeader{Name: name, Method: Deflate}
+		if target != "" {
+			fh.SetMode(fs.ModeSymlink | 0777)
+		}
+		fw, err := w.CreateHeader(fh)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(fw, target)
+		return err
+	}
+	if err := create("a", "b.txt"); err != nil {
+		t.Fatalf("CreateHeader(a -> b.txt) error = %v", err)
+	}
+	if err := create("up", "../etc"); err != nil {
+		t.Fatalf("CreateHeader(up -> ../etc) error = %v", err)
+	}
+	err := create("b.txt", "")
+	var ee *safearchive.EntryError
+	if !errors.Is(err, ErrSymlinkTarget) || !errors.As(err, &ee) || ee.Name != "up" {
+		t.Errorf("CreateHeader() after a link to ../etc error = %v, want an EntryError about up wrapping %v", err, ErrSymlinkTarget)
+	}
+	if err := create("b.txt", ""); err != nil {
+		t.Fatalf("CreateHeader(b.txt) error = %v", err)
+	}
+	if err := create("d/l1", ".."); err != nil {
+		t.Fatalf("CreateHeader(d/l1 -> ..) error = %v", err)
+	}
+	if err := create("d/l2", "l1/.."); err != nil {
+		t.Fatalf("CreateHeader(d/l2 -> l1/..) error = %v", err)
+	}
+	if err := w.Close(); !errors.Is(err, ErrSymlinkTarget) {
+		t.Errorf("Close() after a link escaping through another one error = %v, want %v", err, ErrSymlinkTarget)
+	}
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	r.SetSecurityMode(MaximumSecurityMode)
+	var got []string
+	for _, f := range r.File {
+		got = append(got, f.Name+"|"+readAll(t, f))
+	}
+	if want := []string{"a|b.txt", "b.txt|", "d/l1|.."}; !reflect.DeepEqual(got, want) {
+		t.Errorf("written entries = %q, want %q", got, want)
+	}
+	if n := len(r.Report().Findings); n != 0 {
+		t.Errorf("Report() of the written archive has %d findings, want none", n)
+	}
+
+	// the links copied from a Reader are checked as well
+	var out bytes.Buffer
+	cw := NewWriter(&out)
+	cw.SetSecurityMode(MaximumSecurityMode)
+	for _, f := range r.File {
+		if err := cw.Copy(f); err != nil {
+			t.Fatalf("Copy(%s) error = %v", f.Name, err)
+		}
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	// Archive containing files: ../traverse, /absolute
+	var out bytes.Buffer
+	if err := Sanitize(&out, bytes.NewReader(eArchiveZip), int64(len(eArchiveZip)), DefaultSecurityMode); err != nil {
+		t.Fatalf("Sanitize() error = %v", err)
+	}
+	r, err := NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+	if err != nil {
+		t.Fatalf("zip.NewReader() error = %v", err)
+	}
+	r.SetSecurityMode(0)
+	commonTestsBefore(t, r.File)
+
+	out.Reset()
+	if err := Sanitize(&out, bytes.NewReader(eArchiveZip), int64(len(eArchiveZip)), DefaultSecurityMode|StrictMode); !errors.Is(err, ErrPathTraversal) {
+		t.Errorf("Sanitize() in StrictMode error = %v, want %v", err, ErrPathTraversal)
+	}
+	if out.Len() != 0 {
+		t.Errorf("Sanitize() in StrictMode wrote %d bytes", out.Len())
+	}
+}
+
+func TestSanitizeSymlinkTargets(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetSecurityMode(0)
+	for _, l := range [][2]string{{"a/inner", "../b"}, {"a/abs", "/etc/passwd"}, {"up", "../../x"}, {"d/l1", ".."}, {"d/l2", "l1/.."}} {
+		fh := &FileHeader{Name: l[0]}
+		fh.SetMode(fs.ModeSymlink | 0777)
+		fw, err := w.CreateHeader(fh)
+		if err != nil {
+			t.Fatalf("CreateHeader(%q) error = %v", l[0], err)
+		}
+		fw.Write([]byte(l[1]))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	r.SetSecurityMode(DefaultSecurityMode | SanitizeSymlinkTargets)
+	// d/l2 escapes through d/l1
+	if len(r.File) != 2 || r.File[0].Name != "a/inner" || r.File[1].Name != "d/l1" {
+		t.Errorf("File = %v, want a/inner and d/l1 only", r.File)
+	}
+	if n := len(r.Report().Findings); n != 3 {
+		t.Errorf("Report() has %d findings, want 3", n)
+	}
+
+	r.SetSecurityMode(DefaultSecurityMode | SanitizeSymlinkTargets | StrictMode)
+	if err := r.Err(); !errors.Is(err, ErrSymlinkTarget) {
+		t.Errorf("Err() in StrictMode = %v, want %v", err, ErrSymlinkTarget)
+	}
+}
+
+func TestDropExtraFields(t *testing.T) {
+	extra := []byte{
+		0x75, 0x78, 11, 0, 1, 4, 0, 0, 0, 0, 4, 0, 0, 0, 0, // unix owners root:root
+		0x0a, 0x00, 4, 0, 0, 0, 0, 0, // NTFS, truncated attributes
+		0xfe, 0xca, 2, 0, 'h', 'i', // private
+	}
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	fw, err := w.CreateHeader(&FileHeader{Name: "a.txt", Method: Deflate, Extra: extra})
+	if err != nil {
+		t.Fatalf("CreateHeader() error = %v", err)
+	}
+	fw.Write([]byte("hello"))
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	r.SetSecurityMode(DefaultSecurityMode | DropExtraFields)
+	r.SetExtraFieldAllowlist([]uint16{0xcafe})
+	if want := []byte{0xfe, 0xca, 2, 0, 'h', 'i'}; len(r.File) != 1 || !bytes.Equal(r.File[0].Extra, want) {
+		t.Fatalf("File = %v, want a.txt with the extra field 0xcafe only", r.File)
+	}
+	if f := r.Report().Findings; len(f) != 1 || f[0].Reason != safearchive.ReasonExtraFields || f[0].Detail != "dropped 0x7875, 0x000a" {
+		t.Errorf("Report() = %+v, want a finding dropping 0x7875 and 0x000a", f)
+	}
+	if got := readAll(t, r.File[0]); got != "hello" {
+		t.Errorf("content = %q, want %q", got, "hello")
+	}
+	if !bytes.Equal(r.originalFiles[0].Extra, extra) {
+		t.Errorf("DropExtraFields modified the original header: %v", r.originalFiles[0].Extra)
+	}
+
+	// the Writer drops them too
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetSecurityMode(DefaultSecurityMode | DropExtraFields)
+	if _, err := w.CreateHeader(&FileHeader{Name: "a.txt", Extra: extra}); err != nil {
+		t.Fatalf("CreateHeader() error = %v", err)
+	}
+	w.Close()
+	r, err = NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	if len(r.File) != 1 || len(r.File[0].Extra) != 0 {
+		t.Errorf("File = %v, want a.txt without extra fields", r.File)
+	}
+}
+
+func TestDirectoryLimits(t *testing.T) {
+	archive := buildZip(t, testEntry{"a", "a"}, testEntry{"b", "b"}, testEntry{"c", "c"})
+	// each record is 47 bytes long: the fixed part and a single character name
+	lying := append([]byte{}, archive...)
+	end := len(lying) - directoryEndLen
+	binary.LittleEndian.PutUint16(lying[end+8:], 1)
+	binary.LittleEndian.PutUint16(lying[end+10:], 1)
+	binary.LittleEndian.PutUint32(lying[end+12:], 47)
+
+	tests := []struct {
+		name    string
+		archive []byte
+		opts    Options
+		wantErr bool
+	}{
+		{name: "within limits", archive: archive, opts: Options{MaxDirectoryRecords: 3, MaxDirectorySize: 3 * 47}},
+		{name: "records", archive: archive, opts: Options{MaxDirectoryRecords: 2}, wantErr: true},
+		{name: "size", archive: archive, opts: Options{MaxDirectorySize: 100}, wantErr: true},
+		{name: "declared fewer records", archive: lying, opts: Options{MaxDirectoryRecords: 2}, wantErr: true},
+		{name: "zip64", archive: zip64Archive(t, archive, nil), opts: Options{MaxDirectoryRecords: 2}, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewReaderWithOptions(bytes.NewReader(tc.archive), int64(len(tc.archive)), tc.opts)
+			if tc.wantErr != errors.Is(err, ErrLimitExceeded) || !tc.wantErr && err != nil {
+				t.Errorf("NewReaderWithOptions() error = %v, want error %v", err, tc.wantErr)
+			}
+		})
+	}
+
+	// the limits are not silently skipped when the zip64 record is unusable
+	multiDisk := zip64Archive(t, archive, func(end, loc []byte) { binary.LittleEndian.PutUint32(loc[16:], 2) })
+	if _, err := NewReaderWithOptions(bytes.NewReader(multiDisk), int64(len(multiDisk)), Options{MaxDirectoryRecords: 3}); !errors.Is(err, ErrFormat) {
+		t.Errorf("NewReaderWithOptions() of a multi-disk zip64 archive error = %v, want %v", err, ErrFormat)
+	}
+}
+
+func TestZip64DirectoryEnd(t *testing.T) {
+	archive := buildZip(t, testEntry{"a", "a"}, testEntry{"b", "b"}, testEntry{"c", "c"})
+	put32 := func(off int, v uint32, loc bool) func(end, l []byte) {
+		return func(end, l []byte) {
+			if loc {
+				end = l
+			}
+			binary.LittleEndian.PutUint32(end[off:], v)
+		}
+	}
+	for _, tc := range []struct {
+		name    string
+		edit    func(end, loc []byte)
+		wantErr bool
+	}{
+		{name: "valid"},
+		{name: "locator disk", edit: put32(4, 1, true), wantErr: true},
+		{name: "disks", edit: put32(16, 2, true), wantErr: true},
+		{name: "record position", edit: func(end, loc []byte) { binary.LittleEndian.PutUint64(loc[8:], binary.LittleEndian.Uint64(loc[8:])-4) }, wantErr: true},
+		{name: "record size", edit: put32(4, 100, false), wantErr: true},
+		{name: "disk number", edit: put32(16, 1, false), wantErr: true},
+		{name: "directory disk number", edit: put32(20, 1, false), wantErr: true},
+		{name: "records on this disk", edit: put32(24, 2, false), wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := zip64Archive(t, archive, tc.edit)
+			r, err := NewReaderWithOptions(bytes.NewReader(b), int64(len(b)), Options{ValidateDirectoryEnd: true})
+			if tc.wantErr {
+				if !errors.Is(err, ErrFormat) {
+					t.Errorf("NewReaderWithOptions() error = %v, want %v", err, ErrFormat)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewReaderWithOptions() error = %v", err)
+			}
+			if len(r.File) != 3 {
+				t.Errorf("File has %d entries, want 3", len(r.File))
+			}
+		})
+	}
+}
+
+func TestValidateDirectoryEnd(t *testing.T) {
+	archive := buildZip(t, testEntry{"a", "a"}, testEntry{"b", "b"}, testEntry{"c", "c"})
+	end := len(archive) - directoryEndLen
+	patched := func(v uint16, offs ...int) []byte {
+		b := append([]byte{}, archive...)
+		for _, off := range offs {
+			binary.LittleEndian.PutUint16(b[end+off:], v)
+		}
+		return b
+	}
+	withComment := func(comment []byte) []byte {
+		b := append([]byte{}, archive...)
+		binary.LittleEndian.PutUint16(b[end+20:], uint16(len(comment)))
+		return append(b, comment...)
+	}
+	// an end of central directory record hidden in the comment of the actual one
+	hidden := withComment(archive[end:])
+
+	tests := []struct {
+		name      string
+		archive   []byte
+		opts      Options
+		wantField string
+		wantLimit bool
+	}{
+		{name: "valid", archive: archive},
+		{name: "comment", archive: withComment([]byte("comment"))},
+		{name: "records", archive: patched(2, 8, 10), wantField: "records"},
+		{name: "records on this disk", archive: patched(2, 8), wantField: "records on this disk"},
+		{name: "disk number", archive: patched(1, 4), wantField: "disk number"},
+		{name: "directory size", archive: patched(3*47-1, 12), wantField: "directory end"},
+		{name: "trailing data", archive: append(append([]byte{}, archive...), "trail"...), wantField: "comment length"},
+		{name: "hidden record", archive: hidden, wantField: "end of central directory records"},
+		{name: "repaired", archive: patched(2, 8, 10), opts: Options{Tolerant: true}},
+		{name: "comment within limit", archive: withComment([]byte("comment")), opts: Options{MaxCommentLength: 7}},
+		{name: "comment limit", archive: withComment([]byte("comment")), opts: Options{MaxCommentLength: 6}, wantLimit: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.opts.MaxCommentLength == 0 {
+				tc.opts.ValidateDirectoryEnd = true
+			}
+			_, err := NewReaderWithOptions(bytes.NewReader(tc.archive), int64(len(tc.archive)), tc.opts)
+			var de *DirectoryEndError
+			switch {
+			case tc.wantLimit:
+				if !errors.Is(err, ErrLimitExceeded) {
+					t.Errorf("NewReaderWithOptions() error = %v, want %v", err, ErrLimitExceeded)
+				}
+			case tc.wantField == "":
+				if err != nil {
+					t.Errorf("NewReaderWithOptions() error = %v", err)
+				}
+			case !errors.As(err, &de) || !errors.Is(err, ErrFormat):
+				t.Errorf("NewReaderWithOptions() error = %v, want a DirectoryEndError", err)
+			case de.Field != tc.wantField:
+				t.Errorf("DirectoryEndError.Field = %q, want %q", de.Field, tc.wantField)
+			}
+		})
+	}
+
+	// the upstream parser accepts some of the inconsistent archives
+	for _, b := range [][]byte{patched(1, 4), append(append([]byte{}, archive...), "trail"...), hidden} {
+		if _, err := NewReader(bytes.NewReader(b), int64(len(b))); err != nil {
+			t.Errorf("NewReader() without validation error = %v", err)
+		}
+	}
+}
+
+func TestDropXattrs(t *testing.T) {
+	archive := buildZip(t,
+		testEntry{"photo.jpg", "jpeg"},
+		testEntry{"__MACOSX/", ""},
+		testEntry{"__MACOSX/._photo.jpg", "xattrs"},
+		testEntry{"dir/._notes.txt", "xattrs"},
+		testEntry{"dir/notes.txt", "notes"},
+	)
+	r, err := NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	r.SetSecurityMode(defaultMode())
+	if len(r.File) != 5 {
+		t.Errorf("len(File) = %d without DropXattrs, want 5", len(r.File))
+	}
+	r.SetSecurityMode(defaultMode() | DropXattrs)
+	var got []string
+	for _, f := range r.File {
+		got = append(got, f.Name)
+	}
+	if want := []string{"photo.jpg", "dir/notes.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("File = %q, want %q", got, want)
+	}
+	if n := len(r.Report().Findings); n != 3 {
+		t.Errorf("Report() has %d findings, want 3", n)
+	}
+	if MaximumSecurityMode&DropXattrs == 0 {
+		t.Errorf("MaximumSecurityMode = %v, want it to include DropXattrs", MaximumSecurityMode)
+	}
+}
+
+func TestFS(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetSecurityMode(0)
+	for _, e := range []struct {
+		name, content string
+		mode          fs.FileMode
+	}{
+		{"dir/a.txt", "hello", 0644},
+		{"../escape.txt", "bad", 0644},
+		{"link", "/etc", fs.ModeSymlink | 0777},
+		{"link/passwd", "root", 0644},
+		{"b/c/d.txt", "d", 0600},
+	} {
+		fh := &FileHeader{Name: e.name, Method: Deflate}
+		fh.SetMode(e.mode)
+		fw, err := w.CreateHeader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(fw, e.content)
+	}
+	w.Close()
+
+	for _, mode := range []SecurityMode{DefaultSecurityMode, SanitizeFilenames} {
+		r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatalf("NewReader() error = %v", err)
+		}
+		r.SetSecurityMode(mode)
+		if err := fstest.TestFS(r, "dir/a.txt", "escape.txt", "b/c/d.txt"); err != nil {
+			t.Errorf("mode %v: %v", mode, err)
+		}
+		for _, name := range []string{"link", "link/passwd", "../escape.txt"} {
+			if _, err := fs.Stat(r, name); err == nil {
+				t.Errorf("mode %v: Stat(%q) succeeded, want an error", mode, name)
+			}
+		}
+		got, err := fs.Glob(r.FS(), "*/*.txt")
+		if want := []string{"dir/a.txt"}; err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("mode %v: Glob() = %q, %v, want %q", mode, got, err, want)
+		}
+	}
+}
+
+func TestFSConcurrentSetSecurityMode(t *testing.T) {
+	archive := buildZip(t, testEntry{"../escape.txt", "bad"}, testEntry{"a.txt", "a"})
+	r, err := NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			r.SetSecurityMode(SanitizeFilenames)
+			r.SetSecurityMode(0)
+		}
+	}()
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				f, err := r.Open("a.txt")
+				if err != nil {
+					t.Errorf("Open(a.txt) error = %v", err)
+					return
+				}
+				f.Close()
+				fs.Stat(r, "escape.txt")
+			}
+		}()
+	}
+	wg.Wait()
+	// the file system must reflect the last security mode, not a snapshot of an earlier one
+	if _, err := fs.Stat(r, "escape.txt"); err == nil {
+		t.Errorf("Stat(escape.txt) succeeded after SetSecurityMode(0), want an error")
+	}
+}
+
+func TestVerifyLocalHeaders(t *testing.T) {
+	build := func(t *testing.T) []byte {
+		t.Helper()
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		w.SetSecurityMode(0)
+		for _, e := range []testEntry{{"a.txt", "hello"}, {"b.txt", "world"}} {
+			fw, err := w.CreateRaw(&FileHeader{Name: e.name, Method: Store, CRC32: crc32.ChecksumIEEE([]byte(e.content)), CompressedSize64: uint64(len(e.content)), UncompressedSize64: uint64(len(e.content))})
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(fw, e.content)
+		}
+		w.Close()
+		return buf.Bytes()
+	}
+	// the second local file header starts after the first entry: 30 bytes of header, the name and
+	// the content
+	const second = 30 + 5 + 5
+	tests := []struct {
+		name   string
+		tamper func(b []byte) []byte
+		want   []string
+	}{
+		{name: "consistent", tamper: func(b []byte) []byte { return b }, want: []string{"a.txt", "b.txt"}},
+		{name: "prepended data", tamper: func(b []byte) []byte { return append(make([]byte, 100), b...) }, want: []string{"a.txt", "b.txt"}},
+		{name: "name", tamper: func(b []byte) []byte { b[30] = 'x'; return b }, want: []string{"b.txt"}},
+		{name: "crc", tamper: func(b []byte) []byte { b[second+14]++; return b }, want: []string{"a.txt"}},
+		{name: "signature", tamper: func(b []byte) []byte { b[second] = 0; return b }, want: []string{"a.txt"}},
+		{name: "zip64", tamper: func(b []byte) []byte { return zip64Archive(t, b, nil) }, want: []string{"a.txt", "b.txt"}},
+		{name: "zip64 crc", tamper: func(b []byte) []byte { b[second+14]++; return zip64Archive(t, b, nil) }, want: []string{"a.txt"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b := tc.tamper(build(t))
+			r, err := NewReader(bytes.NewReader(b), int64(len(b)))
+			if err != nil {
+				t.Fatalf("NewReader() error = %v", err)
+			}
+			r.SetSecurityMode(DefaultSecurityMode | VerifyLocalHeaders)
+			var got []string
+			for _, f := range r.File {
+				got = append(got, f.Name)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("File = %q, want %q", got, tc.want)
+			}
+			for _, f := range r.Report().Findings {
+				if f.Reason != ReasonHeaderMismatch {
+					t.Errorf("unexpected finding %+v", f)
+				}
+			}
+
+			r.SetSecurityMode(DefaultSecurityMode | VerifyLocalHeaders | StrictMode)
+			if err := r.Err(); (err != nil) != (len(tc.want) != 2) {
+				t.Errorf("Err() in StrictMode = %v", err)
+			}
+		})
+	}
+
+	// the upstream reader ignores the disk numbers, but the records cannot be verified
+	b := zip64Archive(t, build(t), func(end, loc []byte) { binary.LittleEndian.PutUint32(end[20:], 1) })
+	r, err := NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	r.SetSecurityMode(DefaultSecurityMode | VerifyLocalHeaders)
+	if err := r.Err(); !errors.Is(err, safearchive.ErrRejected) || len(r.File) != 0 {
+		t.Errorf("Err() of an unverifiable archive = %v with %d entries, want %v", err, len(r.File), safearchive.ErrRejected)
+	}
+}
+
+func TestDetectOverlaps(t *testing.T) {
+	b := buildZip(t, testEntry{"a.txt", "hello"})
+	// refer to the data of a.txt from a second central directory record
+	end := len(b) - directoryEndLen
+	start := int(binary.LittleEndian.Uint32(b[end+16:]))
+	record := append([]byte{}, b[start:end]...)
+	copy(record[directoryHeaderLen:], "b.txt")
+	var tampered []byte
+	tampered = append(tampered, b[:end]...)
+	tampered = append(tampered, record...)
+	eocd := append([]byte{}, b[end:]...)
+	binary.LittleEndian.PutUint16(eocd[8:], 2)
+	binary.LittleEndian.PutUint16(eocd[10:], 2)
+	binary.LittleEndian.PutUint32(eocd[12:], uint32(2*len(record)))
+	tampered = append(tampered, eocd...)
+
+	r, err := NewReader(bytes.NewReader(tampered), int64(len(tampered)))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	r.SetSecurityMode(defaultMode())
+	if len(r.File) != 2 {
+		t.Fatalf("len(File) = %d, want 2", len(r.File))
+	}
+	r.SetSecurityMode(defaultMode() | DetectOverlaps)
+	if len(r.File) != 1 || r.File[0].Name != "a.txt" {
+		t.Errorf("File = %v, want a.txt only", r.File)
+	}
+	f := r.Report().Findings
+	if len(f) != 1 || f[0].Reason != ReasonOverlap || f[0].Name != "b.txt" || f[0].Detail != `overlaps "a.txt"` {
+		t.Errorf("Report() = %+v, want b.txt overlapping a.txt", f)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		edit    func(end, loc []byte)
+		wantErr error
+	}{
+		{name: "zip64"},
+		{name: "unverifiable zip64", edit: func(end, loc []byte) { binary.LittleEndian.PutUint32(end[20:], 1) }, wantErr: safearchive.ErrRejected},
+	} {
+		b := zip64Archive(t, tampered, tc.edit)
+		r, err := NewReader(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			t.Fatalf("%s: NewReader() error = %v", tc.name, err)
+		}
+		r.SetSecurityMode(defaultMode() | DetectOverlaps)
+		if err := r.Err(); !errors.Is(err, tc.wantErr) {
+			t.Errorf("%s: Err() = %v, want %v", tc.name, err, tc.wantErr)
+		}
+		if tc.wantErr == nil && (len(r.File) != 1 || r.File[0].Name != "a.txt") {
+			t.Errorf("%s: File = %v, want a.txt only", tc.name, r.File)
+		}
+	}
+}
+
+func TestDuplicatePolicy(t *testing.T) {
+	archive := buildZip(t, testEntry{"a.txt", "first"}, testEntry{"dir/", ""}, testEntry{"./a.txt", "second"}, testEntry{"dir/", ""}, testEntry{"dir", "file"})
+	for _, tc := range []struct {
+		policy  safearchive.DuplicatePolicy
+		want    []string
+		wantErr error
+	}{
+		{policy: safearchive.DuplicatesAllow, want: []string{"a.txt", "dir/", "a.txt", "dir/", "dir"}},
+		{policy: safearchive.DuplicatesKeepFirst, want: []string{"a.txt", "dir/", "dir/"}},
+		{policy: safearchive.DuplicatesReject, wantErr: safearchive.ErrDuplicate},
+	} {
+		r, err := NewReader(bytes.NewReader(archive), int64(len(archive)))
+		if err != nil {
+			t.Fatalf("NewReader() error = %v", err)
+		}
+		r.SetDuplicatePolicy(tc.policy)
+		var got []string
+		for _, f := range r.File {
+			got = append(got, f.Name)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("policy %d: File = %q, want %q", tc.policy, got, tc.want)
+		}
+		if err := r.Err(); !errors.Is(err, tc.wantErr) {
+			t.Errorf("policy %d: Err() = %v, want %v", tc.policy, err, tc.wantErr)
+		}
+	}
+}
+
+func TestDuplicateRenameSymlinks(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetSecurityMode(0)
+	for _, e := range []struct {
+		name, content string
+		mode          fs.FileMode
+	}{
+		{"x", "a", 0644},
+		{"x", "/etc", fs.ModeSymlink | 0777},
+		{"x.1/passwd", "root", 0644},
+	} {
+		fh := &FileHeader{Name: e.name, Method: Deflate}
+		fh.SetMode(e.mode)
+		fw, err := w.CreateHeader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(fw, e.content)
+	}
+	w.Close()
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	r.SetSecurityMode(r.GetSecurityMode() &^ SanitizeSymlinkTargets)
+	r.SetDuplicatePolicy(safearchive.DuplicatesRename)
+	var got []string
+	for _, f := range r.File {
+		got = append(got, f.Name)
+	}
+	if want := []string{"x", "x.1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("File = %q, want %q", got, want)
+	}
+}
+
+func TestCollisionRenameSymlinks(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetSecurityMode(0)
+	for _, e := range []struct {
+		name, content string
+		mode          fs.FileMode
+	}{
+		{"X", "a", 0644},
+		{"x", "/etc", fs.ModeSymlink | 0777},
+		{"x.1/passwd", "root", 0644},
+	} {
+		fh := &FileHeader{Name: e.name, Method: Deflate}
+		fh.SetMode(e.mode)
+		fw, err := w.CreateHeader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(fw, e.content)
+	}
+	w.Close()
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	r.SetSecurityMode(r.GetSecurityMode() &^ SanitizeSymlinkTargets)
+	r.SetCollisionPolicy(safearchive.DuplicatesRename)
+	var got []string
+	for _, f := range r.File {
+		got = append(got, f.Name)
+	}
+	if want := []string{"X", "x.1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("File = %q, want %q", got, want)
+	}
+}
+
+func TestCollisionPolicy(t *testing.T) {
+	archive := buildZip(t, testEntry{"README", "a"}, testEntry{"readme", "b"}, testEntry{"Dir/", ""}, testEntry{"dir/", ""})
+	r, err := NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	r.SetCollisionPolicy(safearchive.DuplicatesRename)
+	var got []string
+	for _, f := range r.File {
+		got = append(got, f.Name)
+	}
+	if want := []string{"README", "readme.1", "Dir/", "dir/"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("File = %q, want %q", got, want)
+	}
+	r.SetCollisionPolicy(safearchive.DuplicatesReject)
+	if err := r.Err(); !errors.Is(err, safearchive.ErrCollision) {
+		t.Errorf("Err() = %v, want %v", err, safearchive.ErrCollision)
+	}
+}
+
+func TestSanitizeUnicode(t *testing.T) {
+	archive := buildZip(t, testEntry{"invoice\u202efdp.exe", "x"}, testEntry{"a/\ufeff/b.txt", "y"}, testEntry{"plain.txt", "z"})
+	r, err := NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	r.SetSecurityMode(DefaultSecurityMode | SanitizeUnicode)
+	var got []string
+	for _, f := range r.File {
+		got = append(got, f.Name)
+	}
+	if want := []string{"invoicefdp.exe", "a/b.txt", "plain.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("File = %q, want %q", got, want)
+	}
+	f := r.Report().Findings
+	if len(f) != 2 || f[1].Reason != safearchive.ReasonUnsafeUnicode || f[1].NewName != "a/b.txt" {
+		t.Errorf("Report() = %+v, want 2 unsafe-unicode findings", f)
+	}
+}
+
+func TestSanitizeUnicodeTraversal(t *testing.T) {
+	archive := buildZip(t, testEntry{".\u200b./.\u200b./etc/passwd", "x"})
+	r, err := NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	r.SetSecurityMode(MaximumSecurityMode)
+	if len(r.File) != 1 || r.File[0].Name != "etc/passwd" {
+		t.Errorf("File = %+v, want etc/passwd", r.File)
+	}
+}
+
+func TestValidateNameEncoding(t *testing.T) {
+	archive := buildZip(t, testEntry{"caf\xe9.txt", "x"}, testEntry{"nul\x00.exe", "y"}, testEntry{"caf\u00e9.txt", "z"})
+	r, err := NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	for _, tc := range []struct {
+		policy safearchive.NameEncodingPolicy
+		want   []string
+	}{
+		{safearchive.NameEncodingReplace, []string{"caf\ufffd.txt", "nul\ufffd.exe", "caf\u00e9.txt"}},
+		{safearchive.NameEncodingPercent, []string{"caf%E9.txt", "nul%00.exe", "caf\u00e9.txt"}},
+	} {
+		r.SetSecurityMode(DefaultSecurityMode | ValidateNameEncoding)
+		r.SetNameEncodingPolicy(tc.policy)
+		var got []string
+		for _, f := range r.File {
+			got = append(got, f.Name)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("File with policy %d = %q, want %q", tc.policy, got, tc.want)
+		}
+		if f := r.Report().Findings; len(f) != 2 || f[0].Reason != safearchive.ReasonInvalidEncoding || f[0].NewName != tc.want[0] {
+			t.Errorf("Report() = %+v, want 2 invalid-encoding findings", f)
+		}
+	}
+
+	r.SetNameEncodingPolicy(safearchive.NameEncodingReject)
+	if err := r.Err(); !errors.Is(err, ErrInvalidEncoding) {
+		t.Errorf("Err() with NameEncodingReject = %v, want %v", err, ErrInvalidEncoding)
+	}
+	r.SetNameEncodingPolicy(safearchive.NameEncodingReplace)
+	r.SetSecurityMode(MaximumSecurityMode | StrictMode)
+	if err := r.Err(); !errors.Is(err, ErrInvalidEncoding) {
+		t.Errorf("Err() in StrictMode = %v, want %v", err, ErrInvalidEncoding)
+	}
+}
+
+func TestEntryFilter(t *testing.T) {
+	archive := buildZip(t, testEntry{"../a.txt", "a"}, testEntry{"b.exe", "b"}, testEntry{"c.txt", "c"})
+	r, err := NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	if err := r.SetEntryFilter(func(f *File) (bool, error) {
+		if f.Name == "c.txt" {
+			// discarded, the filter sees a copy
+			f.Name = "../renamed.txt"
+		}
+		return !strings.HasSuffix(f.Name, ".exe"), nil
+	}); err != nil {
+		t.Fatalf("SetEntryFilter() error = %v", err)
+	}
+	var got []string
+	for _, f := range r.File {
+		got = append(got, f.Name)
+	}
+	if want := []string{"a.txt", "c.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("File = %q, want %q", got, want)
+	}
+
+	errBad := errors.New("bad entry")
+	err = r.SetEntryFilter(func(f *File) (bool, error) {
+		if f.Name == "b.exe" {
+			return false, errBad
+		}
+		return true, nil
+	})
+	var ee *safearchive.EntryError
+	if !errors.Is(err, errBad) || !errors.As(err, &ee) || ee.Name != "b.exe" || len(r.File) != 0 {
+		t.Errorf("SetEntryFilter() error = %v, File = %d entries, want an entry error of b.exe wrapping %v", err, len(r.File), errBad)
+	}
+	if err := r.SetEntryFilter(nil); err != nil || len(r.File) != 3 {
+		t.Errorf("SetEntryFilter(nil) = %v, File = %d entries, want 3", err, len(r.File))
+	}
+}
+
+func TestPatterns(t *testing.T) {
+	archive := buildZip(t, testEntry{"docs/", ""}, testEntry{"docs/a.md", "a"}, testEntry{"../docs/b.txt", "b"}, testEntry{"docs/draft.md", "c"}, testEntry{"src/main.go", "d"})
+	r, err := NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	if err := r.SetIncludePatterns("docs/*"); err != nil {
+		t.Fatalf("SetIncludePatterns() error = %v", err)
+	}
+	if err := r.SetExcludePatterns("*/draft.*"); err != nil {
+		t.Fatalf("SetExcludePatterns() error = %v", err)
+	}
+	if err := r.SetIncludePatterns("[a-"); !errors.Is(err, path.ErrBadPattern) {
+		t.Errorf("SetIncludePatterns() error = %v, want %v", err, path.ErrBadPattern)
+	}
+	var got []string
+	for _, f := range r.File {
+		got = append(got, f.Name)
+	}
+	if want := []string{"docs/a.md", "docs/b.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("File = %q, want %q", got, want)
+	}
+}
+
+func TestStripComponents(t *testing.T) {
+	archive := buildZip(t, testEntry{"pkg-1.0/", ""}, testEntry{"pkg-1.0/src/main.go", "a"}, testEntry{"pkg-1.0/a/../../../etc/passwd", "b"}, testEntry{"README", "c"})
+	r, err := NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	r.SetSecurityMode(DefaultSecurityMode &^ SanitizeFilenames)
+	r.SetStripComponents(1)
+	r.SetPrefix("vendor")
+	var got []string
+	for _, f := range r.File {
+		got = append(got, f.Name)
+	}
+	if want := []string{"vendor/src/main.go", "vendor/passwd"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("File = %q, want %q", got, want)
+	}
+}
+
+func TestStripComponentsSymlinks(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetSecurityMode(0)
+	for _, e := range []struct {
+		name, content string
+		mode          fs.FileMode
+	}{
+		{"x/link", "/etc", fs.ModeSymlink | 0777},
+		{"y/link/passwd", "root", 0644},
+		{"x/same", "a/b", fs.ModeSymlink | 0777},
+		{"x/a/up", "../../z/file", fs.ModeSymlink | 0777},
+	} {
+		fh := &FileHeader{Name: e.name, Method: Deflate}
+		fh.SetMode(e.mode)
+		fw, err := w.CreateHeader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(fw, e.content)
+	}
+	w.Close()
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	r.SetStripComponents(1)
+	var got []string
+	for _, f := range r.File {
+		got = append(got, f.Name)
+	}
+	if want := []string{"link", "same"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("File = %q, want %q", got, want)
+	}
+	var reasons []safearchive.Reason
+	for _, f := range r.Report().Findings {
+		reasons = append(reasons, f.Reason)
+	}
+	if want := []safearchive.Reason{safearchive.ReasonSymlinkTraversal, safearchive.ReasonSymlinkTarget}; !reflect.DeepEqual(reasons, want) {
+		t.Errorf("Report() reasons = %q, want %q", reasons, want)
+	}
+}
+
+func TestSharedEntries(t *testing.T) {
+	archive := buildZip(t, testEntry{name: "safe.txt"}, testEntry{name: "../unsafe.txt"})
+	r, err := NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	if len(r.File) != 2 {
+		t.Fatalf("File has %d entries, want 2", len(r.File))
+	}
+	if r.File[0] != r.originalFiles[0] {
+		t.Errorf("File[0] is a copy of the unchanged entry %q", r.File[0].Name)
+	}
+	if r.File[1] == r.originalFiles[1] || r.originalFiles[1].Name != "../unsafe.txt" {
+		t.Errorf("the sanitized entry %q is not a copy", r.File[1].Name)
+	}
+}
+
+func TestDirectoryChunk(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetSecurityMode(0)
+	type entry struct {
+		name string
+		mode fs.FileMode
+	}
+	entries := []entry{{"dir/f0", 0644}, {"dir/f1", 0644}, {"dir/f2", 0644}, {"dir/f3", 0644}, {"dir/f4", 0644}, {"dir/f5", 0644}, {"dir/f6", 0644}, {"link", fs.ModeSymlink | 0777}, {"link/evil", 0644}, {"../escape", 0644}}
+	for _, e := range entries {
+		fh := &FileHeader{Name: e.name, Method: Deflate}
+		fh.SetMode(e.mode)
+		fw, err := w.CreateHeader(fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(fw, e.name)
+	}
+	w.Close()
+
+	r, err := NewReaderWithOptions(bytes.NewReader(buf.Bytes()), int64(buf.Len()), Options{DirectoryChunk: 4})
+	if err != nil {
+		t.Fatalf("NewReaderWithOptions() error = %v", err)
+	}
+	var got [][]string
+	for more := true; more; more, err = r.NextChunk() {
+		var names []string
+		for _, f := range r.File {
+			names = append(names, f.Name)
+			if content := readAll(t, f); !strings.HasSuffix(content, f.Name) {
+				t.Errorf("content of %q = %q", f.Name, content)
+			}
+		}
+		got = append(got, names)
+	}
+	if err != nil {
+		t.Fatalf("NextChunk() error = %v", err)
+	}
+	want := [][]string{{"dir/f0", "dir/f1", "dir/f2", "dir/f3"}, {"dir/f4", "dir/f5", "dir/f6", "link"}, {"escape"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("chunks = %q, want %q", got, want)
+	}
+	if n := len(r.Report().Findings); n != 2 {
+		t.Errorf("Report() has %d findings, want 2", n)
+	}
+
+	// the setters rebuild the state of the rules from the earlier chunks
+	r.SetSecurityMode(MaximumSecurityMode)
+	if len(r.File) != 1 || r.File[0].Name != "escape" || len(r.Report().Findings) != 2 {
+		t.Errorf("after SetSecurityMode(), File = %v and Report() = %v, want escape and 2 findings", r.File, r.Report())
+	}
+	if err := r.SetLimits(Limits{MaxEntries: 9}); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("SetLimits() error = %v, want %v", err, ErrLimitExceeded)
+	}
+
+	r, err = NewReaderWithOptions(bytes.NewReader(buf.Bytes()), int64(buf.Len()), Options{DirectoryChunk: len(entries)})
+	if err != nil {
+		t.Fatalf("NewReaderWithOptions() error = %v", err)
+	}
+	if more, err := r.NextChunk(); more || err != nil || len(r.File) != len(entries)-1 {
+		t.Errorf("NextChunk() of a single chunk archive = %v, %v with %d files", more, err, len(r.File))
+	}
+}
+
+func TestDirectoryChunkIntegrity(t *testing.T) {
+	var entries []testEntry
+	for i := 0; i < 6; i++ {
+		entries = append(entries, testEntry{fmt.Sprintf("f%d", i), "content"})
+	}
+	b := buildZip(t, entries...)
+	end := len(b) - directoryEndLen
+	start := int(binary.LittleEndian.Uint32(b[end+16:]))
+	// each record is 48 bytes long: the fixed part and a two character name
+	const recLen = directoryHeaderLen + 2
+
+	// a 7th record referring to the data of f0, in the second chunk
+	overlapping := append([]byte{}, b[:end]...)
+	overlapping = append(overlapping, b[start:start+recLen]...)
+	copy(overlapping[end+directoryHeaderLen:], "f6")
+	eocd := append([]byte{}, b[end:]...)
+	binary.LittleEndian.PutUint16(eocd[8:], 7)
+	binary.LittleEndian.PutUint16(eocd[10:], 7)
+	binary.LittleEndian.PutUint32(eocd[12:], 7*recLen)
+	overlapping = append(overlapping, eocd...)
+
+	r, err := NewReaderWithOptions(bytes.NewReader(overlapping), int64(len(overlapping)), Options{DirectoryChunk: 4})
+	if err != nil {
+		t.Fatalf("NewReaderWithOptions() error = %v", err)
+	}
+	r.SetSecurityMode(defaultMode() | DetectOverlaps)
+	if more, err := r.NextChunk(); !more || err != nil {
+		t.Fatalf("NextChunk() = %v, %v", more, err)
+	}
+	var got []string
+	for _, f := range r.File {
+		got = append(got, f.Name)
+	}
+	if want := []string{"f4", "f5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("second chunk = %q, want %q", got, want)
+	}
+	if f := r.Report().Findings; len(f) != 1 || f[0].Reason != ReasonOverlap || f[0].Detail != `overlaps "f0"` {
+		t.Errorf("Report() = %+v, want f6 overlapping f0", f)
+	}
+
+	// directories with fewer records than declared
+	short := append([]byte{}, b...)
+	binary.LittleEndian.PutUint16(short[end+8:], 8)
+	binary.LittleEndian.PutUint16(short[end+10:], 8)
+	malformed := append([]byte{}, b...)
+	malformed[start+5*recLen] = 0
+	for name, archive := range map[string][]byte{"short": short, "malformed": malformed} {
+		r, err := NewReaderWithOptions(bytes.NewReader(archive), int64(len(archive)), Options{DirectoryChunk: 4})
+		if err == nil {
+			_, err = r.NextChunk()
+		}
+		if !errors.Is(err, ErrFormat) {
+			t.Errorf("%s: error = %v, want %v", name, err, ErrFormat)
+		}
+	}
+}
+
+// largeArchiveEntries are the entries of an archive with many deeply nested files, for
+// benchmarks.
+func largeArchiveEntries(n int) []testEntry {
+	var entries []testEntry
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("a%d/b%d/c%d/d%d/e%d/file%d.txt", i%7, i%11, i%13, i%17, i%19, i)
+		entries = append(entries, testEntry{name: name})
+	}
+	return entries
+}
+
+func BenchmarkApplyMagic(b *testing.B) {
+	archive := buildZip(b, largeArchiveEntries(100000)...)
+	r, err := NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		b.Fatalf("NewReader() error = %v", err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.SetSecurityMode(PreventSymlinkTraversal)
+	}
+}
+
+func TestEncryptionPolicy(t *testing.T) {
+	// "hello, world\n" encrypted with AES-256 (AE-2) and with the traditional encryption by
+	// libarchive, with the password "secret"
+	aesZip, _ := hex.DecodeString("504b0304140009006300d042505d00000000000000000000000005002b00612e74787475780b000104000000000400000000019907000200414503080055540d0007c8ded16abcded16ac8ded16a8cc8509519755306467e59986de282141dec5cc34ef06e5d4dcbcc32a777701b41fa1238e7e0a7fcf6d7e6504b0708000000002b0000000d000000504b01021403140009006300d042505d000000002b0000000d000000050023000000000000000000a48100000000612e74787475780b00010400000000040000000001990700020041450308005554050001c8ded16a504b0506000000000100010056000000890000000000")
+	zipCrypto, _ := hex.DecodeString("504b0304140009000800d042505d00000000000000000000000005002000612e74787475780b00010400000000040000000055540d0007c8ded16ac8ded16ac8ded16ac5363a260ea08a32752e249f2d2afd31294ca0ef6b69a3115cbad1504b0708537424f41b0000000d000000504b01021403140009000800d042505d537424f41b0000000d000000050018000000000000000000a48100000000612e74787475780b0001040000000004000000005554050001c8ded16a504b050600000000010001004b0000006e0000000000")
+	open := func(t *testing.T, archive []byte) *Reader {
+		t.Helper()
+		r, err := NewReader(bytes.NewReader(archive), int64(len(archive)))
+		if err != nil {
+			t.Fatalf("NewReader() error = %v", err)
+		}
+		return r
+	}
+
+	for _, archive := range []struct {
+		name   string
+		data   []byte
+		detail string
+	}{{"AES", aesZip, "AES-256 encryption"}, {"traditional", zipCrypto, "traditional PKWARE encryption"}} {
+		t.Run(archive.name, func(t *testing.T) {
+			r := open(t, archive.data)
+			findings := r.Report().Findings
+			if len(r.File) != 1 || len(findings) != 1 || findings[0].Reason != safearchive.ReasonEncrypted || findings[0].Action != safearchive.ActionNone || findings[0].Detail != archive.detail {
+				t.Errorf("EncryptedAllow: %d files, findings %+v, want 1 file flagged with %q", len(r.File), findings, archive.detail)
+			}
+			r.SetEncryptionPolicy(EncryptedSkip)
+			if len(r.File) != 0 {
+				t.Errorf("EncryptedSkip: %d files, want 0", len(r.File))
+			}
+			r.SetSecurityMode(DefaultSecurityMode | StrictMode)
+			if err := r.Err(); !errors.Is(err, ErrEncryptedEntry) {
+				t.Errorf("EncryptedSkip in StrictMode: Err() = %v, want %v", err, ErrEncryptedEntry)
+			}
+			r.SetSecurityMode(DefaultSecurityMode)
+			r.SetEncryptionPolicy(EncryptedReject)
+			if err := r.Err(); !errors.Is(err, ErrEncryptedEntry) {
+				t.Errorf("EncryptedReject: Err() = %v, want %v", err, ErrEncryptedEntry)
+			}
+			r.SetEncryptionPolicy(EncryptedDecrypt)
+			if len(r.File) != 0 {
+				t.Errorf("EncryptedDecrypt without a password provider: %d files, want 0", len(r.File))
+			}
+		})
+	}
+
+	if safearchive.Hardened {
+		return
+	}
+	password := "secret"
+	r := open(t, aesZip)
+	r.SetEncryptionPolicy(EncryptedDecrypt)
+	r.SetPasswordProvider(func(name string) (string, error) {
+		if name != "a.txt" {
+			t.Errorf("password of %q requested, want a.txt", name)
+		}
+		return password, nil
+	})
+	if len(r.File) != 1 {
+		t.Fatalf("EncryptedDecrypt: %d files, want 1", len(r.File))
+	}
+	if got := readAll(t, r.File[0]); got != "hello, world\n" {
+		t.Errorf("decrypted content = %q, want %q", got, "hello, world\n")
+	}
+
+	password = "wrong"
+	if _, err := io.ReadAll(mustOpen(t, r.File[0])); !errors.Is(err, ErrPassword) {
+		t.Errorf("ReadAll() with a wrong password error = %v, want %v", err, ErrPassword)
+	}
+
+	// flipping a bit of the authentication code, which ends the data of the entry
+	password = "secret"
+	tampered := append([]byte{}, aesZip...)
+	off, err := r.File[0].DataOffset()
+	if err != nil {
+		t.Fatalf("DataOffset() error = %v", err)
+	}
+	tampered[off+int64(r.File[0].CompressedSize64)-1] ^= 1
+	r = open(t, tampered)
+	r.SetEncryptionPolicy(EncryptedDecrypt)
+	r.SetPasswordProvider(func(string) (string, error) { return password, nil })
+	if _, err := io.ReadAll(mustOpen(t, r.File[0])); !errors.Is(err, ErrChecksum) {
+		t.Errorf("ReadAll() of a tampered entry error = %v, want %v", err, ErrChecksum)
+	}
+}
+
+func mustOpen(t *testing.T, f *File) io.ReadCloser {
+	t.Helper()
+	rc, err := f.Open()
+	if err != nil {
+		t.Fatalf("File.Open(%q) error = %v", f.Name, err)
+	}
+	t.Cleanup(func() { rc.Close() })
+	return rc
+}
+
+func TestPBKDF2SHA1(t *testing.T) {
+	// test vectors of RFC 6070
+	for _, tc := range []struct {
+		iter int
+		want string
+	}{
+		{1, "0c60c80f961f0e71f3a9b524af6012062fe037a6"},
+		{2, "ea6c014dc72d6f8ccd1ed92ace1d41f0d8de8957"},
+		{4096, "4b007901b765489abead49d926f721d065a429c1"},
+	} {
+		if got := hex.EncodeToString(pbkdf2SHA1([]byte("password"), []byte("salt"), tc.iter, 20)); got != tc.want {
+			t.Errorf("pbkdf2SHA1(%d iterations) = %s, want %s", tc.iter, got, tc.want)
+		}
+	}
+}
+
+func TestChecksumPolicy(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	content := []byte("damaged content")
+	for _, e := range []struct {
+		name string
+		crc  uint32
+	}{{"good.txt", crc32.ChecksumIEEE(content)}, {"bad.txt", 0xdeadbeef}} {
+		fw, err := w.CreateRaw(&FileHeader{Name: e.name, Method: Store, CRC32: e.crc, CompressedSize64: uint64(len(content)), UncompressedSize64: uint64(len(content))})
+		if err != nil {
+			t.Fatalf("CreateRaw(%q) error = %v", e.name, err)
+		}
+		fw.Write(content)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	r, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("NewReader() error = %v", err)
+	}
+	read := func(f *File) ([]byte, error) {
+		rc, err := r.OpenFile(f)
+		if err != nil {
+			t.Fatalf("OpenFile(%q) error = %v", f.Name, err)
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	}
+
+	if got, err := read(r.File[0]); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("ReadAll(OpenFile(good.txt)) = %q, %v, want %q, nil", got, err, content)
+	}
+	_, err = read(r.File[1])
+	var ce *ChecksumError
+	if !errors.As(err, &ce) || !errors.Is(err, ErrChecksum) {
+		t.Fatalf("ReadAll(OpenFile(bad.txt)) error = %v, want a *ChecksumError", err)
+	}
+	if want := (ChecksumError{Name: "bad.txt", Expected: 0xdeadbeef, Actual: crc32.ChecksumIEEE(content)}); *ce != want {
+		t.Errorf("ReadAll(OpenFile(bad.txt)) error = %+v, want %+v", *ce, want)
+	}
+	if len(r.Report().Findings) != 0 {
+		t.Errorf("Report() = %v, want no findings with ChecksumFail", r.Report().Findings)
+	}
+
+	r.SetChecksumPolicy(ChecksumReport)
+	if got, err := read(r.File[1]); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("ReadAll(OpenFile(bad.txt)) with ChecksumReport = %q, %v, want %q, nil", got, err, content)
+	}
+	// reading the entry again does not report it again
+	read(r.File[1])
+	findings := r.Report().Findings
+	if len(findings) != 1 || findings[0].Name != "bad.txt" || findings[0].Reason != ReasonChecksum {
+		t.Errorf("Report() with ChecksumReport = %v, want a %s finding about bad.txt", findings, ReasonChecksum)
+	}
+	// the findings of the reads are kept when the rules are applied again
+	r.SetSecurityMode(r.GetSecurityMode())
+	if got := len(r.Report().Findings); got != 1 {
+		t.Errorf("Report() after SetSecurityMode has %d findings, want 1", got)
+	}
+}
+
+func TestSalvage(t *testing.T) {
+	streamed := buildZip(t, testEntry{"dir/", ""}, testEntry{"dir/a.txt", "hello"}, testEntry{"../b.txt", strings.Repeat("b", 1000)})
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		fw, err := w.CreateRaw(&FileHeader{Name: name, Method: Store, CRC32: crc32.ChecksumIEEE([]byte(name)), CompressedSize64: 5, UncompressedSize64: 5})
+		if err != nil {
+			t.Fatalf("CreateRaw(%q) error = %v", name, err)
+		}
+		fw.Write([]byte(name))
+	}
+	w.Close()
+	raw := buf.Bytes()
+
+	streamedDirectory := bytes.Index(streamed, []byte("PK\x01\x02"))
+	rawDirectory := bytes.Index(raw, []byte("PK\x01\x02"))
+	lastHeader := bytes.LastIndex(streamed[:streamedDirectory], []byte("PK\x03\x04"))
+	tests := []struct {
+		name      string
+		archive   []byte
+		wantFiles map[string]string
+		// wantDropped is the offset of the entry that could not be salvaged, if any
+		wantDropped int64
+	}{
+		{
+			name:      "truncated directory",
+			archive:   streamed[:streamedDirectory+10],
+			wantFiles: map[string]string{"dir/": "", "dir/a.txt": "hello", "b.txt": strings.Repeat("b", 1000)},
+		},
+		{
+			name:        "truncated entry",
+			archive:     streamed[:lastHeader+60],
+			wantFiles:   map[string]string{"dir/": "", "dir/a.txt": "hello"},
+			wantDropped: int64(lastHeader),
+		},
+		{
+			name:      "known sizes",
+			archive:   raw[:rawDirectory],
+			wantFiles: map[string]string{"a.txt": "a.txt", "b.txt": "b.txt"},
+		},
+		{
+			name:        "truncated known sizes",
+			archive:     raw[:rawDirectory-2],
+			wantFiles:   map[string]string{"a.txt": "a.txt"},
+			wantDropped: int64(rawDirectory - 35 - 5),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewReader(bytes.NewReader(tc.archive), int64(len(tc.archive))); err == nil {
+				t.Errorf("NewReader() succeeded, want error")
+			}
+			r, err := NewReaderWithOptions(bytes.NewReader(tc.archive), int64(len(tc.archive)), Options{Salvage: true})
+			if err != nil {
+				t.Fatalf("NewReaderWithOptions() error = %v", err)
+			}
+			got := map[string]string{}
+			for _, f := range r.File {
+				if f.Mode().Type()&^fs.ModeDir != 0 {
+					t.Errorf("%q has mode %v, want a regular file or directory", f.Name, f.Mode())
+				}
+				got[f.Name] = readAll(t, f)
+			}
+			if !reflect.DeepEqual(got, tc.wantFiles) {
+				t.Errorf("File = %q, want %q", got, tc.wantFiles)
+			}
+			var salvaged, dropped []safearchive.Finding
+			for _, f := range r.Report().Findings {
+				switch {
+				case f.Reason != ReasonSalvaged:
+				case f.Action == safearchive.ActionDropped:
+					dropped = append(dropped, f)
+				default:
+					salvaged = append(salvaged, f)
+				}
+			}
+			if len(salvaged) != 1 {
+				t.Errorf("Report() has %d findings about the rebuilt central directory, want 1", len(salvaged))
+			}
+			if tc.wantDropped == 0 && len(dropped) != 0 || tc.wantDropped != 0 && (len(dropped) != 1 || dropped[0].Offset != tc.wantDropped) {
+				t.Errorf("Report() dropped = %+v, want an entry at offset %d", dropped, tc.wantDropped)
+			}
+		})
+	}
+
+	if _, err := NewReaderWithOptions(bytes.NewReader([]byte("not a zip archive")), 17, Options{Salvage: true}); err == nil {
+		t.Errorf("NewReaderWithOptions() of garbage succeeded, want error")
+	}
+	archive := streamed[:streamedDirectory]
+	if _, err := NewReaderWithOptions(bytes.NewReader(archive), int64(len(archive)), Options{Salvage: true, MaxDirectoryRecords: 2}); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("NewReaderWithOptions() with MaxDirectoryRecords error = %v, want %v", err, ErrLimitExceeded)
+	}
+
+	// data full of data descriptor signatures is read once, and the search gives up
+	buf.Reset()
+	w = NewWriter(&buf)
+	fw, err := w.CreateHeader(&FileHeader{Name: "fake.txt", Method: Store})
+	if err != nil {
+		t.Fatalf("CreateHeader() error = %v", err)
+	}
+	fw.Write(bytes.Repeat([]byte("PK\x07\x08"), 2048))
+	w.Close()
+	archive = buf.Bytes()[:bytes.Index(buf.Bytes(), []byte("PK\x01\x02"))]
+	cr := &countingReaderAt{r: bytes.NewReader(archive)}
+	if _, err := NewReaderWithOptions(cr, int64(len(archive)), Options{Salvage: true}); err == nil {
+		t.Errorf("NewReaderWithOptions() of an unsalvageable archive succeeded, want error")
+	}
+	if max := 4 * int64(len(archive)); cr.n > max {
+		t.Errorf("salvage read %d bytes of a %d bytes archive, want at most %d", cr.n, len(archive), max)
+	}
+}
+
+// countingReaderAt counts the bytes read from r.
+type countingReaderAt struct {
+	r io.ReaderAt
+	n int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.n += int64(n)
+	return n, err
+}
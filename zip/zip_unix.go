@@ -12,8 +12,8 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-//go:build !windows && !darwin
-// +build !windows,!darwin
+//go:build !windows && !darwin && !safearchive_hardened
+// +build !windows,!darwin,!safearchive_hardened
 
 package zip
 